@@ -5,6 +5,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/exitcode"
 	"github.com/rapidfort/kimia/pkg/logger"
 )
 
@@ -21,17 +23,11 @@ func parseArgs(args []string) *Config {
 		BuildKitOpts:       []string{},            // Direct BuildKit options
 		ExportCache:        []string{},            // BuildKit --export-cache options
 		ImportCache:        []string{},            // BuildKit --import-cache options
-		CosignKeyPath:      "/etc/cosign/cosign.key",
+		CosignKeySecretPath: build.DefaultCosignSecretPath,
 		CosignPasswordEnv:  "COSIGN_PASSWORD",
 		BuildahOpts:        []string{}, // Direct Buildah bud options
 	}
 
-	// If no arguments provided, show help
-	if len(args) == 0 {
-		printHelp()
-		os.Exit(0)
-	}
-
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 
@@ -62,6 +58,16 @@ func parseArgs(args []string) *Config {
 				config.Dockerfile = args[i]
 			}
 
+		case "--dockerfile-content":
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if strings.TrimSpace(value) == "" {
+				logger.FatalCode(exitcode.Config, "--dockerfile-content requires the Dockerfile (e.g., --dockerfile-content=\"FROM alpine\")")
+			}
+			config.DockerfileContent = value
+
 		case "-c", "--context":
 			if value != "" {
 				config.Context = value
@@ -91,7 +97,9 @@ func parseArgs(args []string) *Config {
 				i++
 				dest = args[i]
 			}
-			if dest != "" {
+			if strings.HasPrefix(dest, "target=") || strings.HasPrefix(dest, "image=") {
+				config.TargetDestinations = append(config.TargetDestinations, dest)
+			} else if dest != "" {
 				config.Destination = append(config.Destination, dest)
 			}
 
@@ -123,7 +131,7 @@ func parseArgs(args []string) *Config {
 				i++
 				exportStr = args[i]
 			} else {
-				logger.Fatal("--export-cache requires a value (e.g., type=registry,ref=registry.io/cache:latest,mode=max)")
+				logger.FatalCode(exitcode.Config, "--export-cache requires a value (e.g., type=registry,ref=registry.io/cache:latest,mode=max)")
 			}
 			config.ExportCache = append(config.ExportCache, exportStr)
 
@@ -137,10 +145,48 @@ func parseArgs(args []string) *Config {
 				i++
 				importStr = args[i]
 			} else {
-				logger.Fatal("--import-cache requires a value (e.g., type=registry,ref=registry.io/cache:latest)")
+				logger.FatalCode(exitcode.Config, "--import-cache requires a value (e.g., type=registry,ref=registry.io/cache:latest)")
 			}
 			config.ImportCache = append(config.ImportCache, importStr)
 
+		case "--cache-export-dir":
+			// Shorthand for --export-cache type=local,dest=DIR,mode=max
+			if value != "" {
+				config.CacheExportDir = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.CacheExportDir = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--cache-export-dir requires a directory (e.g., --cache-export-dir=/cache)")
+			}
+
+		case "--cache-repo":
+			// Registry cache used by both builders (Buildah --cache-to/--cache-from,
+			// BuildKit type=registry)
+			if value != "" {
+				config.CacheRepo = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.CacheRepo = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--cache-repo requires a repository (e.g., --cache-repo=registry.io/myapp/cache)")
+			}
+
+		case "--cache-inline":
+			// Shorthand for --export-cache type=inline
+			config.CacheInline = true
+
+		case "--cache-import-dir":
+			// Shorthand for --import-cache type=local,src=DIR
+			if value != "" {
+				config.CacheImportDir = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.CacheImportDir = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--cache-import-dir requires a directory (e.g., --cache-import-dir=/cache)")
+			}
+
 		case "--storage-driver":
 			if value != "" {
 				config.StorageDriver = value
@@ -159,9 +205,74 @@ func parseArgs(args []string) *Config {
 				parseBuildArg(buildArg, config)
 			}
 
+		case "--build-arg-file":
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--build-arg-file requires a file path")
+			}
+			config.BuildArgFiles = append(config.BuildArgFiles, value)
+
+		case "--env-allowlist":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--env-allowlist requires a value (e.g., --env-allowlist='CI_*,HTTP_PROXY')")
+			}
+			config.EnvAllowlist = append(config.EnvAllowlist, value)
+
+		case "--build-arg-from-secret", "--secret-from-env":
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "%s requires a value (e.g., --build-arg-from-secret=NPM_TOKEN=/var/run/secrets/npm/token, --secret-from-env=id=npm,env=NPM_TOKEN)", key)
+			}
+			if key == "--build-arg-from-secret" {
+				config.BuildArgFromSecret = append(config.BuildArgFromSecret, value)
+			} else {
+				config.SecretFromEnv = append(config.SecretFromEnv, value)
+			}
+
 		case "--no-push":
 			config.NoPush = true
 
+		case "--verify-push":
+			config.VerifyPush = true
+
+		case "--staging-destination":
+			if value != "" {
+				config.StagingDestination = value
+			} else if i+1 < len(args) {
+				i++
+				config.StagingDestination = args[i]
+			}
+
+		case "--promote-require":
+			kinds := value
+			if kinds == "" && i+1 < len(args) {
+				i++
+				kinds = args[i]
+			}
+			for _, kind := range strings.Split(kinds, ",") {
+				if kind = strings.TrimSpace(kind); kind != "" {
+					config.PromoteRequire = append(config.PromoteRequire, kind)
+				}
+			}
+
+		case "--promote-webhook":
+			if value != "" {
+				config.PromoteWebhook = value
+			} else if i+1 < len(args) {
+				i++
+				config.PromoteWebhook = args[i]
+			}
+
 		case "--tar-path":
 			if value != "" {
 				config.TarPath = value
@@ -170,6 +281,19 @@ func parseArgs(args []string) *Config {
 				config.TarPath = args[i]
 			}
 
+		case "--load":
+			if value == "" && i+1 < len(args) && containsString(build.LoadTargets, args[i+1]) {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				value = "auto"
+			}
+			if !containsString(build.LoadTargets, value) {
+				logger.FatalCode(exitcode.Config, "Invalid --load value %q (valid: %s)", value, strings.Join(build.LoadTargets, ", "))
+			}
+			config.Load = value
+
 		case "--digest-file":
 			if value != "" {
 				config.DigestFile = value
@@ -186,6 +310,24 @@ func parseArgs(args []string) *Config {
 				config.ImageNameWithDigestFile = args[i]
 			}
 
+		case "--digest-map-file":
+			if value != "" {
+				config.DigestMapFile = value
+			} else if i+1 < len(args) {
+				i++
+				config.DigestMapFile = args[i]
+			}
+
+		case "--attach":
+			attach := value
+			if attach == "" && i+1 < len(args) {
+				i++
+				attach = args[i]
+			}
+			if attach != "" {
+				config.Attach = append(config.Attach, attach)
+			}
+
 		case "--insecure":
 			config.Insecure = true
 
@@ -202,6 +344,23 @@ func parseArgs(args []string) *Config {
 				config.InsecureRegistry = append(config.InsecureRegistry, reg)
 			}
 
+		case "--pin-registry-cert":
+			config.PinRegistryCert = true
+
+		case "--check-push-access":
+			config.CheckPushAccess = true
+
+		case "--no-ci-auth":
+			config.NoCIAuth = true
+
+		case "--registry-pin-file":
+			if value != "" {
+				config.RegistryPinFile = value
+			} else if i+1 < len(args) {
+				i++
+				config.RegistryPinFile = args[i]
+			}
+
 		case "--push-retry":
 			if value != "" {
 				config.PushRetry = parseInt(value)
@@ -210,6 +369,222 @@ func parseArgs(args []string) *Config {
 				config.PushRetry = parseInt(args[i])
 			}
 
+		case "--push-jobs":
+			if value != "" {
+				config.PushJobs = parseInt(value)
+			} else if i+1 < len(args) {
+				i++
+				config.PushJobs = parseInt(args[i])
+			}
+
+		case "--push-chunk-size":
+			if value != "" {
+				config.PushChunkSize = value
+			} else if i+1 < len(args) {
+				i++
+				config.PushChunkSize = args[i]
+			}
+
+		case "--build-timeout", "--push-timeout":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "%s requires a duration (e.g., %s=30m)", key, key)
+			}
+			if key == "--build-timeout" {
+				config.BuildTimeout = value
+			} else {
+				config.PushTimeout = value
+			}
+
+		case "--push-backend":
+			if value != "" {
+				config.PushBackend = value
+			} else if i+1 < len(args) {
+				i++
+				config.PushBackend = args[i]
+			}
+
+		case "--compression":
+			if value != "" {
+				config.Compression = value
+			} else if i+1 < len(args) {
+				i++
+				config.Compression = args[i]
+			}
+
+		case "--compression-level":
+			if value != "" {
+				config.CompressionLevel = parseInt(value)
+			} else if i+1 < len(args) {
+				i++
+				config.CompressionLevel = parseInt(args[i])
+			}
+
+		case "--pull":
+			if value != "" {
+				config.PullPolicy = value
+			} else if i+1 < len(args) && (args[i+1] == "always" || args[i+1] == "missing" || args[i+1] == "never") {
+				i++
+				config.PullPolicy = args[i]
+			} else {
+				config.PullPolicy = "always"
+			}
+
+		case "--ignore-file":
+			if value != "" {
+				config.IgnoreFile = value
+			} else if i+1 < len(args) {
+				i++
+				config.IgnoreFile = args[i]
+			}
+
+		case "--show-ignored":
+			config.ShowIgnored = true
+
+		case "--max-context-size":
+			if value != "" {
+				config.MaxContextSize = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.MaxContextSize = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--max-context-size requires a size (e.g., --max-context-size=500MB)")
+			}
+
+		case "--context-size-warning":
+			if value != "" {
+				config.ContextSizeWarning = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.ContextSizeWarning = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--context-size-warning requires a size (e.g., --context-size-warning=200MB)")
+			}
+
+		case "--reuse-daemon":
+			config.ReuseDaemon = true
+
+		case "--buildkit-addr":
+			if value != "" {
+				config.BuildkitAddr = value
+			} else if i+1 < len(args) {
+				i++
+				config.BuildkitAddr = args[i]
+			}
+
+		case "--builder-endpoint":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--builder-endpoint requires PLATFORM=ADDR (e.g., --builder-endpoint=linux/arm64=tcp://arm-builders:1234)")
+			}
+			config.BuilderEndpoints = append(config.BuilderEndpoints, value)
+
+		case "--buildkit-tls-ca":
+			if value != "" {
+				config.BuildkitTLSCACert = value
+			} else if i+1 < len(args) {
+				i++
+				config.BuildkitTLSCACert = args[i]
+			}
+
+		case "--buildkit-tls-cert":
+			if value != "" {
+				config.BuildkitTLSCert = value
+			} else if i+1 < len(args) {
+				i++
+				config.BuildkitTLSCert = args[i]
+			}
+
+		case "--buildkit-tls-key":
+			if value != "" {
+				config.BuildkitTLSKey = value
+			} else if i+1 < len(args) {
+				i++
+				config.BuildkitTLSKey = args[i]
+			}
+
+		case "--buildkitd-config-fragment":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--buildkitd-config-fragment requires a value (e.g., --buildkitd-config-fragment=/etc/kimia/buildkitd.d/*.toml)")
+			}
+			config.BuildkitdConfigFragments = append(config.BuildkitdConfigFragments, value)
+
+		case "--buildkit-tls-dir":
+			if value != "" {
+				config.BuildkitTLSDir = value
+			} else if i+1 < len(args) {
+				i++
+				config.BuildkitTLSDir = args[i]
+			}
+
+		case "--builder":
+			if value != "" {
+				config.Builder = value
+			} else if i+1 < len(args) {
+				i++
+				config.Builder = args[i]
+			}
+
+		case "--run-image":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--run-image requires a value (e.g., --run-image=paketobuildpacks/run-jammy-base)")
+			}
+			config.RunImage = value
+
+		case "--buildkit-tls-server-name":
+			if value != "" {
+				config.BuildkitTLSServerName = value
+			} else if i+1 < len(args) {
+				i++
+				config.BuildkitTLSServerName = args[i]
+			}
+
+		case "--buildah-remote":
+			if value != "" {
+				config.BuildahRemote = value
+			} else if i+1 < len(args) && strings.Contains(args[i+1], "://") {
+				i++
+				config.BuildahRemote = args[i]
+			} else if host := os.Getenv("CONTAINER_HOST"); host != "" {
+				config.BuildahRemote = host
+			} else {
+				config.BuildahRemote = build.DefaultPodmanSocket
+			}
+
+		case "--squash":
+			config.Squash = true
+
+		case "--squash-new":
+			config.SquashNew = true
+
+		case "--retry-transient":
+			if value != "" {
+				config.RetryTransient = parseInt(value)
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				if _, err := strconv.Atoi(args[i+1]); err == nil {
+					i++
+					config.RetryTransient = parseInt(args[i])
+				} else {
+					config.RetryTransient = 2
+				}
+			} else {
+				config.RetryTransient = 2
+			}
+
 		case "--image-download-retry":
 			if value != "" {
 				config.ImageDownloadRetry = parseInt(value)
@@ -237,14 +612,393 @@ func parseArgs(args []string) *Config {
 				config.CustomPlatform = args[i]
 			}
 
-		case "-t", "--target":
+		case "--register-binfmt":
+			config.RegisterBinfmt = value == "" || parseBool(value)
+
+		case "--userns-range":
+			if value != "" {
+				config.UsernsRange = value
+			} else if i+1 < len(args) {
+				i++
+				config.UsernsRange = args[i]
+			}
+
+		case "--userns-range-file":
+			if value != "" {
+				config.UsernsRangeFile = value
+			} else if i+1 < len(args) {
+				i++
+				config.UsernsRangeFile = args[i]
+			}
+
+		case "--userns-range-size":
 			if value != "" {
-				config.Target = value
+				config.UsernsRangeSize = parseInt(value)
 			} else if i+1 < len(args) {
 				i++
-				config.Target = args[i]
+				config.UsernsRangeSize = parseInt(args[i])
 			}
 
+		case "--userns-uid-map", "--userns-gid-map":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "%s requires a value (e.g., %s=1:200000:65536)", key, key)
+			}
+			if key == "--userns-uid-map" {
+				config.UsernsUIDMap = append(config.UsernsUIDMap, value)
+			} else {
+				config.UsernsGIDMap = append(config.UsernsGIDMap, value)
+			}
+
+		case "--network":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--network requires a value (host, none or slirp4netns)")
+			}
+			config.Network = value
+
+		case "--add-host", "--dns", "--dns-search":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "%s requires a value (e.g., --add-host=git.internal:10.0.0.5, --dns=10.0.0.2)", key)
+			}
+			switch key {
+			case "--add-host":
+				config.AddHosts = append(config.AddHosts, value)
+			case "--dns":
+				config.DNS = append(config.DNS, value)
+			default:
+				config.DNSSearch = append(config.DNSSearch, value)
+			}
+
+		case "--allow-privileged-steps":
+			config.AllowPrivilegedSteps = true
+
+		case "--allow", "--device", "--cap-add":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "%s requires a value (e.g., --allow=security.insecure, --device=/dev/fuse, --cap-add=SYS_ADMIN)", key)
+			}
+			switch key {
+			case "--allow":
+				config.Allow = append(config.Allow, value)
+			case "--device":
+				config.Devices = append(config.Devices, value)
+			default:
+				config.CapAdd = append(config.CapAdd, value)
+			}
+
+		case "--dry-run":
+			config.DryRun = true
+
+		case "--heartbeat-interval":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--heartbeat-interval requires a duration (e.g., --heartbeat-interval=5m)")
+			}
+			config.HeartbeatInterval = value
+
+		case "--debug-on-failure":
+			config.DebugOnFailure = true
+
+		case "--debug-hold":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--debug-hold requires a duration (e.g., --debug-hold=30m)")
+			}
+			config.DebugHold = value
+
+		case "--explain-cache":
+			config.ExplainCache = true
+
+		case "--explain-cache-file":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--explain-cache-file requires a path")
+			}
+			config.ExplainCacheFile = value
+
+		case "--history-file":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--history-file requires a path")
+			}
+			config.HistoryFile = value
+
+		case "--no-history":
+			config.NoHistory = true
+
+		case "--skip-unchanged":
+			config.SkipUnchanged = true
+
+		case "--sbom-diff":
+			config.SBOMDiff = true
+
+		case "--post-build-hook":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--post-build-hook requires a path")
+			}
+			config.PostBuildHook = value
+
+		case "--pre-push-hook":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--pre-push-hook requires a path")
+			}
+			config.PrePushHook = value
+
+		case "--post-push-hook":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--post-push-hook requires a path")
+			}
+			config.PostPushHook = value
+
+		case "--hook-failure":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--hook-failure requires abort or warn")
+			}
+			config.HookFailure = value
+
+		case "--notify-url":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--notify-url requires an http(s) URL")
+			}
+			config.NotifyURL = value
+
+		case "--notify-format":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--notify-format requires a format (generic-json, cloudevents or slack)")
+			}
+			config.NotifyFormat = value
+
+		case "--notify-secret-file":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--notify-secret-file requires a path")
+			}
+			config.NotifySecretFile = value
+
+		case "--scan-webhook":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--scan-webhook requires a URL")
+			}
+			config.ScanWebhook = value
+
+		case "--scan-webhook-timeout":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--scan-webhook-timeout requires a duration")
+			}
+			config.ScanWebhookTimeout = value
+
+		case "--scan-webhook-secret-file":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--scan-webhook-secret-file requires a path")
+			}
+			config.ScanWebhookSecretFile = value
+
+		case "--events-file":
+			if value != "" {
+				config.EventsFile = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.EventsFile = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--events-file requires a file path")
+			}
+
+		case "--offline":
+			config.Offline = true
+
+		case "--image-store":
+			if value != "" {
+				config.ImageStore = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.ImageStore = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--image-store requires a value (e.g., --image-store=/images/oci or --image-store=containerd)")
+			}
+
+		case "--metadata":
+			if value != "" {
+				config.Metadata = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.Metadata = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--metadata requires a file path (e.g., --metadata=prev.json)")
+			}
+
+		case "--result-file":
+			if value != "" {
+				config.ResultFile = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.ResultFile = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--result-file requires a file path")
+			}
+
+		case "--require":
+			var kinds string
+			if value != "" {
+				kinds = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				kinds = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--require requires a value (e.g., --require=signature,sbom,provenance)")
+			}
+			for _, kind := range strings.Split(kinds, ",") {
+				if kind = strings.TrimSpace(kind); kind != "" {
+					config.Require = append(config.Require, kind)
+				}
+			}
+
+		case "--policy":
+			if value != "" {
+				config.Policy = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.Policy = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--policy requires a value (e.g., --policy=verify-policy.yaml)")
+			}
+
+		case "--max-layer-size":
+			if value != "" {
+				config.MaxLayerSize = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.MaxLayerSize = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--max-layer-size requires a size (e.g., --max-layer-size=10GB)")
+			}
+
+		case "--max-image-size":
+			if value != "" {
+				config.MaxImageSize = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.MaxImageSize = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--max-image-size requires a size (e.g., --max-image-size=2GB)")
+			}
+
+		case "--split-large-layers":
+			config.SplitLargeLayers = true
+
+		case "--tag-template":
+			tmpl := value
+			if tmpl == "" && i+1 < len(args) {
+				i++
+				tmpl = args[i]
+			}
+			if tmpl != "" {
+				config.TagTemplates = append(config.TagTemplates, tmpl)
+			}
+
+		case "--base-image-rewrite":
+			rule := value
+			if rule == "" && i+1 < len(args) {
+				i++
+				rule = args[i]
+			}
+			if rule != "" {
+				config.BaseImageRewrites = append(config.BaseImageRewrites, rule)
+			}
+
+		case "-t", "--target":
+			targets := value
+			if targets == "" && i+1 < len(args) {
+				i++
+				targets = args[i]
+			}
+			for _, target := range strings.Split(targets, ",") {
+				if target = strings.TrimSpace(target); target != "" {
+					config.Targets = append(config.Targets, target)
+				}
+			}
+
+		case "--chain":
+			chain := value
+			if chain == "" && i+1 < len(args) {
+				i++
+				chain = args[i]
+			}
+			if chain != "" {
+				config.Chain = append(config.Chain, chain)
+			}
+
+		case "--test-cmd":
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			config.TestCmd = value
+
 		case "--label":
 			label := value
 			if label == "" && i+1 < len(args) {
@@ -255,6 +1009,9 @@ func parseArgs(args []string) *Config {
 				parseLabel(label, config)
 			}
 
+		case "--label-template-strict":
+			config.LabelTemplateStrict = value == "" || parseBool(value)
+
 		case "--git-branch":
 			if value != "" {
 				config.GitBranch = value
@@ -287,6 +1044,57 @@ func parseArgs(args []string) *Config {
 				config.GitTokenUser = args[i]
 			}
 
+		case "--git-ssh-key-file":
+			if value != "" {
+				config.GitSSHKeyFile = value
+			} else if i+1 < len(args) {
+				i++
+				config.GitSSHKeyFile = args[i]
+			}
+
+		case "--source-info-file":
+			if value != "" {
+				config.SourceInfoFile = value
+			} else if i+1 < len(args) {
+				i++
+				config.SourceInfoFile = args[i]
+			}
+
+		case "--git-depth":
+			if value != "" {
+				config.GitDepth = parseInt(value)
+			} else if i+1 < len(args) {
+				i++
+				config.GitDepth = parseInt(args[i])
+			}
+			if config.GitDepth < 1 {
+				logger.FatalCode(exitcode.Config, "--git-depth must be at least 1")
+			}
+
+		case "--git-filter":
+			if value != "" {
+				config.GitFilter = value
+			} else if i+1 < len(args) {
+				i++
+				config.GitFilter = args[i]
+			}
+
+		case "--git-sparse-path":
+			var paths string
+			if value != "" {
+				paths = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				paths = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--git-sparse-path requires a value (e.g., --git-sparse-path=services/foo)")
+			}
+			for _, path := range strings.Split(paths, ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					config.GitSparsePaths = append(config.GitSparsePaths, path)
+				}
+			}
+
 		case "--registry-certificate":
 			if value != "" {
 				config.RegistryCertificate = value
@@ -295,6 +1103,26 @@ func parseArgs(args []string) *Config {
 				config.RegistryCertificate = args[i]
 			}
 
+		case "--ca-bundle":
+			if value != "" {
+				config.CABundle = value
+			} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				config.CABundle = args[i]
+			} else {
+				logger.FatalCode(exitcode.Config, "--ca-bundle requires a value (e.g., --ca-bundle=/etc/kimia/ca.pem)")
+			}
+
+		case "--registry-config":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--registry-config requires a value (e.g., --registry-config=host=registry.local,insecure=true)")
+			}
+			config.RegistryConfigs = append(config.RegistryConfigs, value)
+
 		case "--reproducible":
 			config.Reproducible = true
 
@@ -308,6 +1136,20 @@ func parseArgs(args []string) *Config {
 			// Auto-enable reproducible mode when timestamp is set
 			config.Reproducible = true
 
+		case "--normalize-context":
+			config.NormalizeContext = true
+
+		case "--context-chown":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--context-chown requires a value (e.g., --context-chown=0:0)")
+			}
+			config.ContextChown = value
+			config.NormalizeContext = true
+
 		// Enterprise flags (will error out)
 		case "--scan":
 			config.Scan = true
@@ -329,7 +1171,7 @@ func parseArgs(args []string) *Config {
 			
 			// Validate attestation mode
 			if config.Attestation != "off" && config.Attestation != "min" && config.Attestation != "max" && config.Attestation != "" {
-				logger.Fatal("--attestation must be 'off', 'min', or 'max', got: %s", config.Attestation)
+				logger.FatalCode(exitcode.Config, "--attestation must be 'off', 'min', or 'max', got: %s", config.Attestation)
 			}
 
 		case "--attest":
@@ -341,7 +1183,7 @@ func parseArgs(args []string) *Config {
 				attestStr = args[i+1]
 				i++
 			} else {
-				logger.Fatal("--attest requires a value (e.g., type=sbom,generator=image)")
+				logger.FatalCode(exitcode.Config, "--attest requires a value (e.g., type=sbom,generator=image)")
 			}
 			
 			// Parse attestation config
@@ -357,7 +1199,7 @@ func parseArgs(args []string) *Config {
 				optStr = args[i+1]
 				i++
 			} else {
-				logger.Fatal("--buildkit-opt requires a value")
+				logger.FatalCode(exitcode.Config, "--buildkit-opt requires a value")
 			}
 			
 			config.BuildKitOpts = append(config.BuildKitOpts, optStr)
@@ -372,8 +1214,38 @@ func parseArgs(args []string) *Config {
 				config.CosignKeyPath = args[i+1]
 				i++
 			} else {
-				logger.Fatal("--cosign-key requires a value")
+				logger.FatalCode(exitcode.Config, "--cosign-key requires a value")
+			}
+
+		case "--cosign-key-secret-path":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--cosign-key-secret-path requires a directory")
+			}
+			config.CosignKeySecretPath = value
+
+		case "--attestation-repo":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
 			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--attestation-repo requires a repository (REPO or IMAGE_REPO=REPO)")
+			}
+			config.AttestationRepo = append(config.AttestationRepo, value)
+
+		case "--cosign-password-file":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.FatalCode(exitcode.Config, "--cosign-password-file requires a path")
+			}
+			config.CosignPasswordFile = value
 
 		case "--cosign-password-env":
 			if value != "" {
@@ -382,7 +1254,7 @@ func parseArgs(args []string) *Config {
 				config.CosignPasswordEnv = args[i+1]
 				i++
 			} else {
-				logger.Fatal("--cosign-password-env requires a value")
+				logger.FatalCode(exitcode.Config, "--cosign-password-env requires a value")
 			}
 
 		case "--buildah-opt":
@@ -393,7 +1265,7 @@ func parseArgs(args []string) *Config {
 				i++
 				optStr = args[i]
 			} else {
-				logger.Fatal("--buildah-opt requires a value")
+				logger.FatalCode(exitcode.Config, "--buildah-opt requires a value")
 			}
 			config.BuildahOpts = append(config.BuildahOpts, optStr)
 
@@ -417,7 +1289,7 @@ func parseArgs(args []string) *Config {
 	}
 	
 	if config.Sign && config.Attestation == "" && len(config.AttestationConfigs) == 0 {
-		logger.Fatal("--sign requires --attestation to be set (min or max) or --attest to be used")
+		logger.FatalCode(exitcode.Config, "--sign requires --attestation to be set (min or max) or --attest to be used")
 	}
 
 	// ========================================
@@ -443,6 +1315,24 @@ func parseArgs(args []string) *Config {
 		}
 	}
 
+	if err := resolveInlineDockerfile(config, os.Stdin); err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
+	}
+
+	// Build args from files fill in what --build-arg did not set, then names
+	// without a value are read from the environment
+	allowlist, err := parseEnvAllowlist(config.EnvAllowlist)
+	if err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
+	}
+	config.EnvAllowlist = allowlist
+	if err := loadBuildArgFiles(config); err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
+	}
+	if err := resolveEnvBuildArgs(config); err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
+	}
+
 	return config
 }
 
@@ -453,7 +1343,7 @@ func parseBool(value string) bool {
 	case "false", "no", "0", "off":
 		return false
 	default:
-		logger.Fatal("Invalid boolean value: %s", value)
+		logger.FatalCode(exitcode.Config, "Invalid boolean value: %s", value)
 		return false
 	}
 }
@@ -461,7 +1351,7 @@ func parseBool(value string) bool {
 func parseInt(value string) int {
 	val, err := strconv.Atoi(value)
 	if err != nil {
-		logger.Fatal("Invalid integer value: %s", value)
+		logger.FatalCode(exitcode.Config, "Invalid integer value: %s", value)
 	}
 	return val
 }
@@ -470,9 +1360,14 @@ func parseBuildArg(arg string, config *Config) {
 	parts := strings.SplitN(arg, "=", 2)
 	if len(parts) == 2 {
 		config.BuildArgs[parts[0]] = parts[1]
+		delete(config.envBuildArgs, parts[0])
 	} else {
-		// Allow just key without value (will use environment variable)
+		// Allow just key without value (read from the environment by resolveEnvBuildArgs)
 		config.BuildArgs[parts[0]] = ""
+		if config.envBuildArgs == nil {
+			config.envBuildArgs = make(map[string]bool)
+		}
+		config.envBuildArgs[parts[0]] = true
 	}
 }
 
@@ -481,7 +1376,7 @@ func parseLabel(label string, config *Config) {
 	if len(parts) == 2 {
 		config.Labels[parts[0]] = parts[1]
 	} else {
-		logger.Fatal("Invalid label format: %s", label)
+		logger.FatalCode(exitcode.Config, "Invalid label format: %s", label)
 	}
 }
 
@@ -498,7 +1393,7 @@ func parseAttestationConfig(s string) AttestationConfig {
 		// Split by = (first occurrence only)
 		kv := strings.SplitN(part, "=", 2)
 		if len(kv) != 2 {
-			logger.Fatal("Invalid attestation parameter: %s (expected key=value)", part)
+			logger.FatalCode(exitcode.Config, "Invalid attestation parameter: %s (expected key=value)", part)
 		}
 		
 		key := strings.TrimSpace(kv[0])
@@ -513,12 +1408,12 @@ func parseAttestationConfig(s string) AttestationConfig {
 	
 	// Validate type is specified
 	if config.Type == "" {
-		logger.Fatal("--attest must include 'type=sbom' or 'type=provenance'")
+		logger.FatalCode(exitcode.Config, "--attest must include 'type=sbom' or 'type=provenance'")
 	}
 	
 	// Validate type is valid
 	if config.Type != "sbom" && config.Type != "provenance" {
-		logger.Fatal("--attest type must be 'sbom' or 'provenance', got: %s", config.Type)
+		logger.FatalCode(exitcode.Config, "--attest type must be 'sbom' or 'provenance', got: %s", config.Type)
 	}
 	
 	return config
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// defaultBakeFiles are loaded, in this order, when no --file is given
+var defaultBakeFiles = []string{"docker-bake.json", "docker-bake.override.json", "docker-bake.hcl", "docker-bake.override.hcl"}
+
+// bakeListKeys are the target attributes that hold lists
+var bakeListKeys = map[string]bool{
+	"tags": true, "platforms": true, "cache-from": true, "cache-to": true,
+	"output": true, "attest": true, "secret": true, "ssh": true, "inherits": true,
+}
+
+// bakeIgnoredKeys are target attributes kimia has no equivalent for
+var bakeIgnoredKeys = map[string]bool{
+	"secret": true, "ssh": true, "contexts": true, "network": true, "shm-size": true,
+	"ulimits": true, "entitlements": true, "annotations": true, "no-cache-filter": true,
+	"call": true,
+}
+
+// bakeDefinition is the merged content of one or more bake files
+type bakeDefinition struct {
+	variables map[string]interface{} // Unevaluated defaults
+	groups    map[string]map[string]interface{}
+	targets   map[string]map[string]interface{}
+	resolved  map[string]interface{}
+	resolving map[string]bool
+}
+
+// runBake implements `kimia bake`: the targets of docker buildx bake files
+// (HCL or JSON) built like a kimia batch. Targets given as arguments, or the
+// default group, are built; other options apply to every build.
+func runBake(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia bake [-f docker-bake.hcl] [--set target.key=value] [--print] [--parallel=N] [--storage-root=DIR] [TARGET...] [kimia options as --flag=value]"
+
+	var files, sets, targets, common []string
+	storageDir := ""
+	parallel, failFast, printOnly := 0, false, false
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := strings.Cut(args[i], "=")
+		takeValue := func() string {
+			if hasValue {
+				return value
+			}
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case flag == "-f" || flag == "--file":
+			files = append(files, takeValue())
+		case flag == "--set":
+			sets = append(sets, takeValue())
+		case flag == "--print":
+			printOnly = true
+		case flag == "--push":
+			// Kimia pushes by default
+		case flag == "--parallel":
+			n, err := strconv.Atoi(takeValue())
+			if err != nil || n < 1 {
+				logger.Error("--parallel must be a positive number")
+				return 1
+			}
+			parallel = n
+		case flag == "--fail-fast":
+			failFast = !hasValue || parseBool(value)
+		case flag == "--storage-root":
+			storageDir = takeValue()
+		case flag == "--help" || flag == "-h":
+			logger.Info("%s", usage)
+			return 0
+		case strings.HasPrefix(args[i], "-"):
+			common = append(common, args[i])
+		default:
+			targets = append(targets, args[i])
+		}
+	}
+
+	if len(files) == 0 {
+		for _, name := range defaultBakeFiles {
+			if _, err := os.Stat(name); err == nil {
+				files = append(files, name)
+			}
+		}
+		if len(files) == 0 {
+			logger.Error("No bake file found (%s); use -f to name one", strings.Join(defaultBakeFiles, ", "))
+			return 1
+		}
+	}
+
+	def := &bakeDefinition{
+		variables: map[string]interface{}{},
+		groups:    map[string]map[string]interface{}{},
+		targets:   map[string]map[string]interface{}{},
+	}
+	for _, file := range files {
+		if err := def.load(file); err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+
+	names, err := def.expandTargets(targets)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	resolved := map[string]map[string]interface{}{}
+	for _, name := range names {
+		if resolved[name], err = def.resolveTarget(name, map[string]bool{}); err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+	if err := applyBakeSets(resolved, sets); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	if printOnly {
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"group":  map[string]interface{}{"default": map[string]interface{}{"targets": names}},
+			"target": resolved,
+		}, "", "  ")
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+
+	builds := make([]batchBuild, 0, len(names))
+	for _, name := range names {
+		args, err := bakeTargetArgs(name, resolved[name])
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		builds = append(builds, batchBuild{Name: name, Args: args})
+	}
+	// Like buildx, all targets build at the same time unless limited
+	if parallel == 0 {
+		parallel = len(builds)
+	}
+	return runBatchBuilds(strings.Join(files, ", "), builds, common, parallel, failFast, storageDir)
+}
+
+// load merges a bake file into def; attributes of a later file override
+// those of an earlier one
+func (def *bakeDefinition) load(path string) error {
+	// #nosec G304 -- bake file given by the user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read bake file: %v", err)
+	}
+
+	var blocks []hclBlock
+	if strings.HasSuffix(path, ".json") {
+		blocks, err = parseBakeJSON(data)
+	} else {
+		var attrs map[string]interface{}
+		attrs, blocks, err = parseHCL(string(data))
+		// Top-level attributes act as variables
+		for name, value := range attrs {
+			def.variables[name] = value
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid bake file %s: %v", path, err)
+	}
+
+	for _, block := range blocks {
+		if len(block.Labels) != 1 {
+			return fmt.Errorf("invalid bake file %s: line %d: %s block needs exactly one name", path, block.Line, block.Type)
+		}
+		name := block.Labels[0]
+		var into map[string]map[string]interface{}
+		switch block.Type {
+		case "variable":
+			def.variables[name] = block.Attrs["default"]
+			continue
+		case "group":
+			into = def.groups
+		case "target":
+			if _, ok := block.Attrs["matrix"]; ok {
+				return fmt.Errorf("invalid bake file %s: target %s: matrix targets are not supported", path, name)
+			}
+			into = def.targets
+		case "function":
+			return fmt.Errorf("invalid bake file %s: user-defined functions are not supported", path)
+		default:
+			return fmt.Errorf("invalid bake file %s: line %d: unknown block type %s", path, block.Line, block.Type)
+		}
+		if into[name] == nil {
+			into[name] = map[string]interface{}{}
+		}
+		for key, value := range block.Attrs {
+			into[name][key] = value
+		}
+	}
+	return nil
+}
+
+// parseBakeJSON converts the JSON bake format to blocks; strings are templates
+// as in HCL
+func parseBakeJSON(data []byte) ([]hclBlock, error) {
+	var doc map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var blocks []hclBlock
+	for _, kind := range []string{"variable", "group", "target"} {
+		for name, attrs := range doc[kind] {
+			block := hclBlock{Type: kind, Labels: []string{name}, Attrs: map[string]interface{}{}}
+			for key, value := range attrs {
+				block.Attrs[key] = jsonToHCL(value)
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	for kind := range doc {
+		if kind != "variable" && kind != "group" && kind != "target" {
+			return nil, fmt.Errorf("unknown block type %s", kind)
+		}
+	}
+	return blocks, nil
+}
+
+// jsonToHCL turns decoded JSON into the values parseHCL returns
+func jsonToHCL(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return hclTemplate{Text: v}
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = jsonToHCL(item)
+		}
+		return items
+	case map[string]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range v {
+			object[key] = jsonToHCL(item)
+		}
+		return object
+	}
+	return value
+}
+
+// variable returns the value of a bake variable: the environment variable of
+// the same name when set, otherwise its evaluated default
+func (def *bakeDefinition) variable(name string, line int) (interface{}, error) {
+	if def.resolved == nil {
+		def.resolved = map[string]interface{}{
+			"BAKE_CMD_CONTEXT":    ".",
+			"BAKE_LOCAL_PLATFORM": runtime.GOOS + "/" + runtime.GOARCH,
+		}
+		def.resolving = map[string]bool{}
+	}
+	if value, ok := def.resolved[name]; ok {
+		return value, nil
+	}
+	raw, ok := def.variables[name]
+	if !ok {
+		return nil, fmt.Errorf("line %d: unknown variable %s", line, name)
+	}
+	if def.resolving[name] {
+		return nil, fmt.Errorf("line %d: variable %s refers to itself", line, name)
+	}
+	def.resolving[name] = true
+	defer delete(def.resolving, name)
+
+	var value interface{}
+	if env, set := os.LookupEnv(name); set {
+		value = env
+		if _, isBool := raw.(bool); isBool {
+			value = parseBool(env)
+		}
+	} else {
+		var err error
+		if value, err = def.evaluate(raw); err != nil {
+			return nil, err
+		}
+	}
+	def.resolved[name] = value
+	return value, nil
+}
+
+// evaluate resolves the variable references and templates in value
+func (def *bakeDefinition) evaluate(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case hclRef:
+		return def.variable(v.Name, v.Line)
+	case hclTemplate:
+		return def.expandTemplate(v)
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			evaluated, err := def.evaluate(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, evaluated)
+		}
+		return items, nil
+	case map[string]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range v {
+			evaluated, err := def.evaluate(item)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = evaluated
+		}
+		return object, nil
+	}
+	return value, nil
+}
+
+// expandTemplate replaces ${VAR} in a template; $${ is a literal ${. A
+// template that is a single interpolation keeps the variable's type.
+func (def *bakeDefinition) expandTemplate(t hclTemplate) (interface{}, error) {
+	text := t.Text
+	if strings.HasPrefix(text, "${") && hclInterpolationEnd(text) == len(text) {
+		return def.interpolate(text[2:len(text)-1], t.Line)
+	}
+	if strings.Contains(text, "%{") && !strings.Contains(text, "%%{") {
+		return nil, fmt.Errorf("line %d: template directives (%%{...}) are not supported", t.Line)
+	}
+
+	var b strings.Builder
+	for {
+		idx := strings.Index(text, "${")
+		if idx < 0 {
+			b.WriteString(text)
+			break
+		}
+		if idx > 0 && text[idx-1] == '$' {
+			b.WriteString(text[:idx-1] + "${")
+			text = text[idx+2:]
+			continue
+		}
+		end := hclInterpolationEnd(text[idx:])
+		if end < 0 {
+			return nil, fmt.Errorf("line %d: unterminated interpolation", t.Line)
+		}
+		value, err := def.interpolate(text[idx+2:idx+end-1], t.Line)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(text[:idx])
+		switch v := value.(type) {
+		case nil:
+		case string, bool:
+			b.WriteString(fmt.Sprint(v))
+		default:
+			return nil, fmt.Errorf("line %d: cannot use a list or object in a string", t.Line)
+		}
+		text = text[idx+end:]
+	}
+	return strings.ReplaceAll(b.String(), "%%{", "%{"), nil
+}
+
+// interpolate evaluates the expression of a ${...}; only variable names are supported
+func (def *bakeDefinition) interpolate(expr string, line int) (interface{}, error) {
+	name := strings.TrimSpace(expr)
+	for _, r := range name {
+		if r != '_' && r != '-' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return nil, fmt.Errorf("line %d: unsupported expression ${%s}: only variable references are supported", line, expr)
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("line %d: empty interpolation", line)
+	}
+	return def.variable(name, line)
+}
+
+// expandTargets resolves groups to target names, keeping the order given and
+// building each target once. Without names the default group is built.
+func (def *bakeDefinition) expandTargets(names []string) ([]string, error) {
+	if len(names) == 0 {
+		names = []string{"default"}
+	}
+	var result []string
+	seen := map[string]bool{}
+	var expand func(name string, depth int) error
+	expand = func(name string, depth int) error {
+		if depth > 32 {
+			return fmt.Errorf("group %s: groups are nested too deeply (cycle?)", name)
+		}
+		if group, ok := def.groups[name]; ok {
+			value, err := def.evaluate(group["targets"])
+			if err != nil {
+				return fmt.Errorf("group %s: %v", name, err)
+			}
+			members, _ := value.([]interface{})
+			for _, member := range members {
+				if err := expand(fmt.Sprint(member), depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if _, ok := def.targets[name]; !ok {
+			if name == "default" && depth == 0 {
+				return fmt.Errorf("no targets given and no default group or target defined")
+			}
+			return fmt.Errorf("unknown target or group %s", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := expand(name, 0); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// resolveTarget evaluates a target with the targets it inherits from merged
+// in: its own attributes win, and args and labels are merged key by key
+func (def *bakeDefinition) resolveTarget(name string, visiting map[string]bool) (map[string]interface{}, error) {
+	if visiting[name] {
+		return nil, fmt.Errorf("target %s inherits from itself", name)
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	raw, ok := def.targets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %s", name)
+	}
+	own, err := def.evaluate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %v", name, err)
+	}
+	attrs := own.(map[string]interface{})
+
+	merged := map[string]interface{}{}
+	parents, _ := attrs["inherits"].([]interface{})
+	for _, parent := range parents {
+		inherited, err := def.resolveTarget(fmt.Sprint(parent), visiting)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", name, err)
+		}
+		mergeBakeAttrs(merged, inherited)
+	}
+	mergeBakeAttrs(merged, attrs)
+	delete(merged, "inherits")
+	return merged, nil
+}
+
+// mergeBakeAttrs copies src over dst, merging args and labels
+func mergeBakeAttrs(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if key == "args" || key == "labels" {
+			into, _ := dst[key].(map[string]interface{})
+			from, ok := value.(map[string]interface{})
+			if into != nil && ok {
+				merged := map[string]interface{}{}
+				for k, v := range into {
+					merged[k] = v
+				}
+				for k, v := range from {
+					merged[k] = v
+				}
+				dst[key] = merged
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// applyBakeSets applies --set overrides of the form target.key=value, where
+// target may be a pattern such as * and key may be args.NAME or labels.NAME
+func applyBakeSets(targets map[string]map[string]interface{}, sets []string) error {
+	for _, set := range sets {
+		path, value, ok := strings.Cut(set, "=")
+		pattern, key, hasKey := strings.Cut(path, ".")
+		if !ok || !hasKey || key == "" {
+			return fmt.Errorf("invalid --set %s: expected target.key=value", set)
+		}
+		matched := false
+		for name, attrs := range targets {
+			if match, err := filepath.Match(pattern, name); err != nil {
+				return fmt.Errorf("invalid --set %s: %v", set, err)
+			} else if !match {
+				continue
+			}
+			matched = true
+
+			attr, sub, nested := strings.Cut(key, ".")
+			switch {
+			case nested && (attr == "args" || attr == "labels"):
+				object, _ := attrs[attr].(map[string]interface{})
+				merged := map[string]interface{}{sub: value}
+				for k, v := range object {
+					if k != sub {
+						merged[k] = v
+					}
+				}
+				attrs[attr] = merged
+			case nested:
+				return fmt.Errorf("invalid --set %s: %s has no keys", set, attr)
+			case bakeListKeys[attr]:
+				attrs[attr] = []interface{}{value}
+			case attr == "no-cache" || attr == "pull":
+				attrs[attr] = parseBool(value)
+			default:
+				attrs[attr] = value
+			}
+		}
+		if !matched {
+			return fmt.Errorf("invalid --set %s: no target matches %s", set, pattern)
+		}
+	}
+	return nil
+}
+
+// bakeTargetArgs converts a resolved bake target to kimia options
+func bakeTargetArgs(name string, attrs map[string]interface{}) ([]string, error) {
+	str := func(key string) string {
+		if value, ok := attrs[key]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+	list := func(key string) []string {
+		var items []string
+		switch v := attrs[key].(type) {
+		case []interface{}:
+			for _, item := range v {
+				if item != nil && fmt.Sprint(item) != "" {
+					items = append(items, fmt.Sprint(item))
+				}
+			}
+		case string:
+			if v != "" {
+				items = append(items, v)
+			}
+		}
+		return items
+	}
+	pairs := func(key string) []string {
+		object, _ := attrs[key].(map[string]interface{})
+		keys := make([]string, 0, len(object))
+		for k, v := range object {
+			// null leaves the value to the Dockerfile's default
+			if v != nil {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			keys[i] = k + "=" + fmt.Sprint(object[k])
+		}
+		return keys
+	}
+
+	if str("dockerfile-inline") != "" {
+		return nil, fmt.Errorf("target %s: dockerfile-inline is not supported; use a Dockerfile", name)
+	}
+	context := str("context")
+	if context == "" {
+		context = "."
+	}
+	args := []string{"--context=" + context}
+	if dockerfile := str("dockerfile"); dockerfile != "" {
+		args = append(args, "--dockerfile="+dockerfile)
+	}
+	if target := str("target"); target != "" {
+		args = append(args, "--target="+target)
+	}
+
+	tags := list("tags")
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("target %s has no tags; kimia needs a destination for every target", name)
+	}
+	for _, tag := range tags {
+		args = append(args, "--destination="+tag)
+	}
+	for _, arg := range pairs("args") {
+		args = append(args, "--build-arg="+arg)
+	}
+	for _, label := range pairs("labels") {
+		args = append(args, "--label="+label)
+	}
+	if platforms := list("platforms"); len(platforms) > 0 {
+		args = append(args, "--custom-platform="+strings.Join(platforms, ","))
+	}
+
+	// BuildKit caches by default; with kimia caching is opt-in
+	if noCache, _ := attrs["no-cache"].(bool); noCache || str("no-cache") == "true" {
+		args = append(args, "--cache=false")
+	} else {
+		args = append(args, "--cache")
+	}
+	if pull, _ := attrs["pull"].(bool); pull || str("pull") == "true" {
+		args = append(args, "--pull=always")
+	}
+	for _, spec := range list("cache-from") {
+		args = append(args, "--import-cache="+bakeCacheSpec(spec))
+	}
+	for _, spec := range list("cache-to") {
+		args = append(args, "--export-cache="+bakeCacheSpec(spec))
+	}
+	for _, attest := range list("attest") {
+		args = append(args, "--attest="+attest)
+	}
+	for _, output := range list("output") {
+		outputArgs, err := bakeOutputArgs(output)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", name, err)
+		}
+		args = append(args, outputArgs...)
+	}
+
+	for key := range attrs {
+		switch {
+		case bakeIgnoredKeys[key]:
+			logger.Warning("Target %s: %s is not supported by kimia and is ignored", name, key)
+		case !bakeListKeys[key] && !map[string]bool{
+			"context": true, "dockerfile": true, "target": true, "args": true, "labels": true,
+			"no-cache": true, "pull": true, "description": true,
+		}[key]:
+			logger.Warning("Target %s: unknown attribute %s is ignored", name, key)
+		}
+	}
+	return args, nil
+}
+
+// bakeCacheSpec expands the short form of a cache-from/cache-to entry, an
+// image reference, to type=registry
+func bakeCacheSpec(spec string) string {
+	if strings.Contains(spec, "=") {
+		return spec
+	}
+	return "type=registry,ref=" + spec
+}
+
+// bakeOutputArgs maps a buildx output to kimia options
+func bakeOutputArgs(output string) ([]string, error) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(output, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[key] = value
+	}
+	if _, short := fields["type"]; !short && len(fields) == 1 {
+		for key := range fields {
+			fields = map[string]string{"type": key}
+		}
+	}
+
+	switch fields["type"] {
+	case "registry", "image":
+		if fields["push"] == "false" {
+			return []string{"--no-push"}, nil
+		}
+		return nil, nil
+	case "docker", "oci", "tar":
+		if dest := fields["dest"]; dest != "" {
+			return []string{"--tar-path=" + dest, "--no-push"}, nil
+		}
+		if fields["type"] == "docker" {
+			return []string{"--load=docker"}, nil
+		}
+		return nil, fmt.Errorf("output %s needs a dest", output)
+	case "cacheonly":
+		return []string{"--no-push"}, nil
+	}
+	return nil, fmt.Errorf("output %s is not supported (registry, image, docker, oci, tar or cacheonly)", output)
+}
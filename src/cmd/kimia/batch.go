@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// batchBuild is one entry of a batch spec with the kimia options it expands to
+type batchBuild struct {
+	Name string
+	Args []string
+}
+
+// batchJob is a batch build ready to run
+type batchJob struct {
+	name         string
+	config       *Config
+	builder      string
+	targetBuilds []build.TargetBuild
+}
+
+// batchResult is the outcome of one batch build
+type batchResult struct {
+	Name         string
+	Destinations []string
+	Duration     time.Duration
+	Err          error
+	Skipped      bool
+}
+
+// runBatch implements `kimia batch --spec builds.yaml`: several builds in one
+// process, sharing registry authentication and a single buildkitd, with at most
+// --parallel builds at a time. Options after the spec apply to every build.
+func runBatch(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia batch --spec=builds.yaml [--parallel=N] [--fail-fast] [--storage-root=DIR] [kimia options for every build]"
+
+	specPath, storageDir, parallel, failFast := "", "", 0, false
+	var common []string
+	for i := 0; i < len(args); i++ {
+		flag, value, hasValue := strings.Cut(args[i], "=")
+		takeValue := func() string {
+			if hasValue {
+				return value
+			}
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch flag {
+		case "--spec", "-s":
+			specPath = takeValue()
+		case "--parallel":
+			n, err := strconv.Atoi(takeValue())
+			if err != nil || n < 1 {
+				logger.Error("--parallel must be a positive number")
+				return 1
+			}
+			parallel = n
+		case "--fail-fast":
+			failFast = !hasValue || parseBool(value)
+		case "--storage-root":
+			storageDir = takeValue()
+		case "--help", "-h":
+			logger.Info("%s", usage)
+			return 0
+		default:
+			common = append(common, args[i])
+		}
+	}
+	if specPath == "" {
+		logger.Error("%s", usage)
+		return 1
+	}
+
+	spec, err := loadBatchSpec(specPath)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if parallel == 0 {
+		parallel = spec.Parallelism
+	}
+	return runBatchBuilds(specPath, spec.Builds, common, parallel, failFast || spec.FailFast, storageDir)
+}
+
+// runBatchBuilds runs builds, each with common appended to its options, with
+// at most parallel running at a time, and returns the exit code. It is shared
+// by kimia batch and kimia bake; source names where the builds came from, and
+// storageDir holds the storage roots of parallel Buildah builds.
+func runBatchBuilds(source string, builds []batchBuild, common []string, parallel int, failFast bool, storageDir string) int {
+	prepareBuildUser()
+
+	// Prepare every build before starting any, so a bad entry fails the whole batch
+	jobs := make([]*batchJob, len(builds))
+	for i, b := range builds {
+		job, err := prepareBatchJob(b, common)
+		if err != nil {
+			logger.Error("build %s: %v", b.Name, err)
+			return 1
+		}
+		if job.builder == "buildkit" && job.config.BuildkitAddr == "" && len(job.config.Allow) > 0 {
+			logger.Error("build %s: --allow is not supported in batch builds, which share one buildkitd", b.Name)
+			return 1
+		}
+		jobs[i] = job
+	}
+	logger.Setup(jobs[0].config.Verbosity, jobs[0].config.LogTimestamp)
+	logger.Info("Kimia - Kubernetes-Native OCI Image Builder v%s", Version)
+	logger.Info("Batch: %d builds from %s, %d at a time", len(jobs), source, parallel)
+
+	// One authentication setup for all destinations, instead of builds
+	// rewriting the Docker config concurrently
+	authSetup := auth.SetupConfig{}
+	for _, job := range jobs {
+		if job.config.StagingDestination != "" {
+			authSetup.Destinations = append(authSetup.Destinations, job.config.StagingDestination)
+		}
+		authSetup.Destinations = append(authSetup.Destinations, job.config.Destination...)
+		authSetup.InsecureRegistry = append(authSetup.InsecureRegistry, job.config.InsecureRegistry...)
+		authSetup.NoCIAuth = authSetup.NoCIAuth || job.config.NoCIAuth
+	}
+	if err := auth.Setup(authSetup); err != nil {
+		logger.Error("Failed to setup authentication: %v", err)
+		return 1
+	}
+
+	ws, err := build.StartWorkspace()
+	if err != nil {
+		logger.Warning("Temporary directories will not be tracked: %v", err)
+	} else {
+		var destinations []string
+		for _, job := range jobs {
+			destinations = append(destinations, job.config.Destination...)
+		}
+		if id, err := ws.RegisterBuild("batch", source, "", destinations); err != nil {
+			logger.Warning("The batch will not be listed by kimia builds: %v", err)
+		} else {
+			logger.Info("Build ID: %s", id)
+		}
+	}
+	defer ws.Close()
+	defer build.CancelOnSignal()()
+
+	// Local BuildKit builds share one buildkitd, which is stopped at the end
+	// unless --reuse-daemon was given
+	started := time.Now()
+	keepDaemon, sharedDaemon := false, false
+	for _, job := range jobs {
+		if job.builder == "buildkit" && job.config.BuildkitAddr == "" {
+			keepDaemon = keepDaemon || job.config.ReuseDaemon
+			sharedDaemon = sharedDaemon || !job.config.DryRun
+			job.config.ReuseDaemon = true
+		}
+		job.config.sharedAuth = true
+	}
+	isolateBuildahStorage(jobs, parallel, storageDir)
+
+	results := make([]batchResult, len(jobs))
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	slots := make(chan struct{}, parallel)
+	for i, job := range jobs {
+		slots <- struct{}{}
+		mu.Lock()
+		stop := failFast && failed
+		mu.Unlock()
+		if stop {
+			<-slots
+			results[i] = batchResult{Name: job.name, Destinations: job.config.Destination, Skipped: true}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, job *batchJob) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			logger.Info("[%s] Starting build %d/%d", job.name, i+1, len(jobs))
+			buildStarted := time.Now()
+			err := runBatchJob(job)
+			duration := time.Since(buildStarted)
+			results[i] = batchResult{Name: job.name, Destinations: job.config.Destination, Duration: duration, Err: err}
+			if err != nil {
+				logger.Error("[%s] Build failed: %v", job.name, err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			} else {
+				logger.Info("[%s] Build completed in %s", job.name, duration.Round(time.Second))
+			}
+		}(i, job)
+	}
+	wg.Wait()
+
+	if sharedDaemon && !keepDaemon {
+		build.StopSharedBuildkitd(started)
+	}
+	return printBatchSummary(results, time.Since(started))
+}
+
+// isolateBuildahStorage gives local Buildah builds that may run at the same
+// time a storage root of their own, so that they do not change each other's
+// images and containers. BuildKit builds are separate sessions of the shared
+// buildkitd and share its cache.
+func isolateBuildahStorage(jobs []*batchJob, parallel int, storageDir string) {
+	var local []*batchJob
+	for _, job := range jobs {
+		if job.builder == "buildah" && job.config.BuildahRemote == "" && !job.config.DryRun {
+			local = append(local, job)
+		}
+	}
+	if parallel < 2 || len(local) < 2 {
+		return
+	}
+	if storageDir == "" {
+		storageDir = build.DefaultStorageRootDir()
+	}
+	for _, job := range local {
+		job.config.storageRoot = build.IsolatedStorageRoot(storageDir, job.name)
+	}
+	logger.Info("Parallel Buildah builds use their own storage under %s", storageDir)
+}
+
+// runBatchJob runs one build, holding the lock of its storage root so that
+// no other build, in this batch or another, uses it at the same time
+func runBatchJob(job *batchJob) error {
+	if job.config.storageRoot != "" {
+		release, err := build.LockStorageRoot(job.config.storageRoot)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	return run(job.config, job.builder, job.targetBuilds)
+}
+
+// prepareBatchJob parses and checks one build the way main does for a single
+// build, so configuration errors are reported before anything is built
+func prepareBatchJob(b batchBuild, common []string) (*batchJob, error) {
+	config := parseArgs(append(append([]string{}, b.Args...), common...))
+	targetBuilds, err := validateBuildRequest(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyBuilderDefaults(config); err != nil {
+		return nil, err
+	}
+	builder, err := selectBuilder(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(config, builder); err != nil {
+		return nil, err
+	}
+	if err := prepareBuild(config); err != nil {
+		return nil, err
+	}
+	return &batchJob{name: b.Name, config: config, builder: builder, targetBuilds: targetBuilds}, nil
+}
+
+// printBatchSummary logs one line per build and returns the exit code
+func printBatchSummary(results []batchResult, total time.Duration) int {
+	logger.Info("Batch summary:")
+	succeeded, failures, skipped := 0, 0, 0
+	for _, result := range results {
+		destinations := strings.Join(result.Destinations, ", ")
+		switch {
+		case result.Skipped:
+			skipped++
+			logger.Warning("  SKIPPED %-20s %s", result.Name, destinations)
+		case result.Err != nil:
+			failures++
+			logger.Error("  FAILED  %-20s %s (%s): %v", result.Name, destinations, result.Duration.Round(time.Second), result.Err)
+		default:
+			succeeded++
+			logger.Info("  OK      %-20s %s (%s)", result.Name, destinations, result.Duration.Round(time.Second))
+		}
+	}
+	logger.Info("%d succeeded, %d failed, %d skipped in %s", succeeded, failures, skipped, total.Round(time.Second))
+	if failures > 0 || skipped > 0 {
+		return 1
+	}
+	return 0
+}
+
+// batchSpec is a parsed batch spec file
+type batchSpec struct {
+	Parallelism int
+	FailFast    bool
+	Builds      []batchBuild
+}
+
+// loadBatchSpec reads a batch spec:
+//
+//	parallelism: 2
+//	fail-fast: true
+//	defaults:              # options for every build
+//	  cache: true
+//	builds:
+//	  - name: api
+//	    context: services/api
+//	    destination: [registry/api:1.0, registry/api:latest]
+//	    build-arg: {VERSION: "1.0"}
+//	    args: [--target=prod]
+//
+// Every key of defaults and of a build other than name and args is a kimia
+// option: a list repeats it, a mapping passes KEY=VALUE pairs, true adds the
+// switch and false leaves it out. A relative local context is resolved
+// against the directory of the spec file.
+func loadBatchSpec(path string) (*batchSpec, error) {
+	// #nosec G304 -- spec file given by the user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch spec: %v", err)
+	}
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid batch spec %s: %v", path, err)
+	}
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid batch spec %s: expected a mapping with builds", path)
+	}
+
+	spec := &batchSpec{Parallelism: 1}
+	for key, value := range root {
+		switch key {
+		case "parallelism":
+			n, err := strconv.Atoi(fmt.Sprint(value))
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid batch spec %s: parallelism must be a positive number", path)
+			}
+			spec.Parallelism = n
+		case "fail-fast":
+			spec.FailFast = fmt.Sprint(value) == "true"
+		case "defaults", "builds":
+		default:
+			return nil, fmt.Errorf("invalid batch spec %s: unknown key %q", path, key)
+		}
+	}
+
+	var defaults []string
+	if value, ok := root["defaults"]; ok && value != nil {
+		options, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid batch spec %s: defaults must be a mapping", path)
+		}
+		if defaults, err = batchOptionArgs(options, filepath.Dir(path)); err != nil {
+			return nil, fmt.Errorf("invalid batch spec %s: defaults: %v", path, err)
+		}
+	}
+
+	entries, ok := root["builds"].([]interface{})
+	if !ok || len(entries) == 0 {
+		return nil, fmt.Errorf("invalid batch spec %s: builds must be a non-empty list", path)
+	}
+	names := map[string]bool{}
+	for i, entry := range entries {
+		options, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid batch spec %s: build %d must be a mapping", path, i+1)
+		}
+		name := fmt.Sprint(options["name"])
+		if options["name"] == nil {
+			name = strconv.Itoa(i + 1)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("invalid batch spec %s: duplicate build name %q", path, name)
+		}
+		names[name] = true
+
+		args, err := batchOptionArgs(options, filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch spec %s: build %s: %v", path, name, err)
+		}
+		spec.Builds = append(spec.Builds, batchBuild{Name: name, Args: append(append([]string{}, defaults...), args...)})
+	}
+	return spec, nil
+}
+
+// batchOptionArgs converts the option keys of a spec entry to kimia arguments
+func batchOptionArgs(options map[string]interface{}, specDir string) ([]string, error) {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		if key != "name" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		value := options[key]
+		if key == "args" {
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("args must be a list")
+			}
+			for _, item := range list {
+				args = append(args, fmt.Sprint(item))
+			}
+			continue
+		}
+
+		flag := "--" + strings.TrimLeft(key, "-")
+		switch v := value.(type) {
+		case nil:
+		case string:
+			if key == "context" && !isRemoteContext(v) && !filepath.IsAbs(v) {
+				v = filepath.Join(specDir, v)
+			}
+			switch v {
+			case "true":
+				args = append(args, flag)
+			case "false":
+			default:
+				args = append(args, flag+"="+v)
+			}
+		case []interface{}:
+			for _, item := range v {
+				args = append(args, flag+"="+fmt.Sprint(item))
+			}
+		case map[string]interface{}:
+			names := make([]string, 0, len(v))
+			for name := range v {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				args = append(args, fmt.Sprintf("%s=%s=%v", flag, name, v[name]))
+			}
+		}
+	}
+	return args, nil
+}
+
+// isRemoteContext reports whether a context is a URL rather than a local path
+func isRemoteContext(context string) bool {
+	return strings.Contains(context, "://") || strings.HasPrefix(context, "git@")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// parseEnvAllowlist splits and checks the --env-allowlist patterns
+func parseEnvAllowlist(values []string) ([]string, error) {
+	var patterns []string
+	for _, value := range values {
+		for _, pattern := range strings.Split(value, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid --env-allowlist pattern %q: %v", pattern, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// envAllowed reports whether builds may read the environment variable name.
+// Without --env-allowlist every variable is allowed.
+func envAllowed(config *Config, name string) bool {
+	if len(config.EnvAllowlist) == 0 {
+		return true
+	}
+	for _, pattern := range config.EnvAllowlist {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupBuildArgEnv returns the value of the build arg name given without a
+// value. It is an error when --env-allowlist does not allow the variable.
+func lookupBuildArgEnv(config *Config, name string) (string, bool, error) {
+	if !envAllowed(config, name) {
+		return "", false, fmt.Errorf("build arg %s reads the environment variable %s, which --env-allowlist does not allow", name, name)
+	}
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		logger.Debug("Build arg %s is not passed: the environment variable is not set", name)
+	}
+	return value, ok, nil
+}
+
+// resolveEnvBuildArgs gives the names passed to --build-arg without a value
+// the value of the environment variable of the same name, so that both
+// builders see the same value. Names whose variable is not set are left
+// out, and the ARG default of the Dockerfile applies.
+func resolveEnvBuildArgs(config *Config) error {
+	names := make([]string, 0, len(config.envBuildArgs))
+	for name := range config.envBuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok, err := lookupBuildArgEnv(config, name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			config.BuildArgs[name] = value
+		} else {
+			delete(config.BuildArgs, name)
+		}
+	}
+	config.envBuildArgs = nil
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/validation"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// loadBuildArgFiles merges the --build-arg-file files into config.BuildArgs.
+// Precedence, highest first: --build-arg, later files, earlier files. Files
+// ending in .json hold an object of names to values; any other file is read
+// as dotenv (KEY=VALUE lines). Names without a value are read from the
+// environment, like --build-arg KEY.
+func loadBuildArgFiles(config *Config) error {
+	fromFiles := make(map[string]string)
+	for _, path := range config.BuildArgFiles {
+		args, fromEnv, err := readBuildArgFile(path)
+		if err != nil {
+			return fmt.Errorf("invalid --build-arg-file %s: %v", path, err)
+		}
+		for key, value := range args {
+			fromFiles[key] = value
+		}
+		for _, key := range fromEnv {
+			if _, set := config.BuildArgs[key]; set {
+				continue
+			}
+			value, ok, err := lookupBuildArgEnv(config, key)
+			if err != nil {
+				return fmt.Errorf("invalid --build-arg-file %s: %v", path, err)
+			}
+			if ok {
+				fromFiles[key] = value
+			} else {
+				delete(fromFiles, key)
+			}
+		}
+		logger.Debug("Read %d build args from %s", len(args)+len(fromEnv), path)
+	}
+	for key, value := range fromFiles {
+		if _, set := config.BuildArgs[key]; set {
+			logger.Debug("Build arg %s from --build-arg overrides --build-arg-file", key)
+			continue
+		}
+		config.BuildArgs[key] = value
+	}
+	return nil
+}
+
+// readBuildArgFile reads one build arg file and checks its names. It returns
+// the args with a value and the names to read from the environment.
+func readBuildArgFile(path string) (map[string]string, []string, error) {
+	// #nosec G304 -- path is a user-provided CLI argument
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var args map[string]string
+	var fromEnv []string
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		args, fromEnv, err = parseBuildArgJSON(data)
+	} else {
+		args, fromEnv, err = parseBuildArgDotenv(data)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for key := range args {
+		if err := validation.ValidateBuildArg(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, key := range fromEnv {
+		if err := validation.ValidateBuildArg(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return args, fromEnv, nil
+}
+
+// parseBuildArgJSON parses {"NAME": "value", ...}. Numbers and booleans are
+// accepted and passed on as written; null means the value is taken from the
+// environment, like --build-arg NAME.
+func parseBuildArgJSON(data []byte) (map[string]string, []string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("expected a JSON object of build args: %v", err)
+	}
+	args := make(map[string]string, len(raw))
+	var fromEnv []string
+	for key, value := range raw {
+		value = bytes.TrimSpace(value)
+		switch {
+		case string(value) == "null":
+			fromEnv = append(fromEnv, key)
+		case len(value) > 0 && value[0] == '"':
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", key, err)
+			}
+			args[key] = s
+		case string(value) == "true" || string(value) == "false":
+			args[key] = string(value)
+		case len(value) > 0 && (value[0] == '-' || (value[0] >= '0' && value[0] <= '9')):
+			args[key] = string(value)
+		default:
+			return nil, nil, fmt.Errorf("%s: value must be a string, number or boolean", key)
+		}
+	}
+	sort.Strings(fromEnv)
+	return args, fromEnv, nil
+}
+
+// parseBuildArgDotenv parses dotenv lines: KEY=VALUE, with blank lines and #
+// comments skipped and an optional "export " prefix. Values may be single
+// quoted (literal) or double quoted (\n, \t, \" and \\ escapes); unquoted
+// values are trimmed and end at " #". A line with just KEY takes the value
+// from the environment, like --build-arg KEY.
+func parseBuildArgDotenv(data []byte) (map[string]string, []string, error) {
+	args := make(map[string]string)
+	env := make(map[string]bool)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if n == 0 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found {
+			delete(args, key)
+			env[key] = true
+			continue
+		}
+		value, err := dotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		args[key] = value
+		delete(env, key)
+	}
+	fromEnv := make([]string, 0, len(env))
+	for key := range env {
+		fromEnv = append(fromEnv, key)
+	}
+	sort.Strings(fromEnv)
+	return args, fromEnv, nil
+}
+
+// dotenvValue unquotes the value of a dotenv line
+func dotenvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	switch value[0] {
+	case '\'':
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return value[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			switch {
+			case c == '"':
+				return b.String(), nil
+			case c == '\\' && i+1 < len(value):
+				i++
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				default:
+					b.WriteByte(value[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	}
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return value, nil
+}
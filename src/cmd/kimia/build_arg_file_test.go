@@ -0,0 +1,277 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildArgDotenv(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantArgs    map[string]string
+		wantFromEnv []string
+	}{
+		{
+			name:        "empty file",
+			data:        "",
+			wantArgs:    map[string]string{},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "comments, blank lines and CRLF",
+			data:        "# header\r\n\r\nA=1\r\n  # indented\nB = two words \n",
+			wantArgs:    map[string]string{"A": "1", "B": "two words"},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "byte order mark and export prefix",
+			data:        "\ufeffA=1\nexport B=2\n",
+			wantArgs:    map[string]string{"A": "1", "B": "2"},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "unquoted values end at a comment",
+			data:        "A=1 # the first\nB=x#y\nC=\n",
+			wantArgs:    map[string]string{"A": "1", "B": "x#y", "C": ""},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "single quotes are literal",
+			data:        `A='it is # not a comment'` + "\n" + `B='a\nb "c"'` + "\n",
+			wantArgs:    map[string]string{"A": "it is # not a comment", "B": `a\nb "c"`},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "double quote escapes",
+			data:        `A="line1\nline2\ttab\r"` + "\n" + `B="say \"hi\" \\ \$HOME"` + "\n",
+			wantArgs:    map[string]string{"A": "line1\nline2\ttab\r", "B": `say "hi" \ $HOME`},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "text after the closing quote is dropped",
+			data:        `A="quoted" # comment` + "\n" + `B='x' y` + "\n",
+			wantArgs:    map[string]string{"A": "quoted", "B": "x"},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "equals sign in the value",
+			data:        "URL=https://example.com/?a=b\n",
+			wantArgs:    map[string]string{"URL": "https://example.com/?a=b"},
+			wantFromEnv: []string{},
+		},
+		{
+			name:        "KEY without a value comes from the environment",
+			data:        "TOKEN\nexport OTHER\nA=1\n",
+			wantArgs:    map[string]string{"A": "1"},
+			wantFromEnv: []string{"OTHER", "TOKEN"},
+		},
+		{
+			name:        "later line wins",
+			data:        "A=1\nA\nB\nB=2\n",
+			wantArgs:    map[string]string{"B": "2"},
+			wantFromEnv: []string{"A"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, fromEnv, err := parseBuildArgDotenv([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("parseBuildArgDotenv() error = %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("parseBuildArgDotenv() args = %#v, want %#v", args, tt.wantArgs)
+			}
+			if !reflect.DeepEqual(fromEnv, tt.wantFromEnv) {
+				t.Errorf("parseBuildArgDotenv() fromEnv = %#v, want %#v", fromEnv, tt.wantFromEnv)
+			}
+		})
+	}
+}
+
+func TestParseBuildArgDotenvErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "unterminated single quote",
+			data: "A=1\nB='open\n",
+			want: "line 2: unterminated single quote",
+		},
+		{
+			name: "unterminated double quote",
+			data: `A="open` + "\n",
+			want: "line 1: unterminated double quote",
+		},
+		{
+			name: "escaped closing quote",
+			data: `A="open\"` + "\n",
+			want: "line 1: unterminated double quote",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseBuildArgDotenv([]byte(tt.data))
+			if err == nil {
+				t.Fatalf("parseBuildArgDotenv() succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseBuildArgDotenv() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBuildArgJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantArgs    map[string]string
+		wantFromEnv []string
+		wantErr     string
+	}{
+		{
+			name:     "strings with escapes",
+			data:     `{"A": "1", "B": "line1\nline2 \"q\" é"}`,
+			wantArgs: map[string]string{"A": "1", "B": "line1\nline2 \"q\" é"},
+		},
+		{
+			name:     "numbers and booleans as written",
+			data:     `{"N": 1.50, "NEG": -3, "T": true, "F": false}`,
+			wantArgs: map[string]string{"N": "1.50", "NEG": "-3", "T": "true", "F": "false"},
+		},
+		{
+			name:        "null comes from the environment",
+			data:        `{"TOKEN": null, "A": "", "OTHER": null}`,
+			wantArgs:    map[string]string{"A": ""},
+			wantFromEnv: []string{"OTHER", "TOKEN"},
+		},
+		{
+			name:    "not an object",
+			data:    `["A"]`,
+			wantErr: "expected a JSON object of build args",
+		},
+		{
+			name:    "object value",
+			data:    `{"A": {"nested": 1}}`,
+			wantErr: "A: value must be a string, number or boolean",
+		},
+		{
+			name:    "array value",
+			data:    `{"A": [1]}`,
+			wantErr: "A: value must be a string, number or boolean",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, fromEnv, err := parseBuildArgJSON([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseBuildArgJSON() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBuildArgJSON() error = %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("parseBuildArgJSON() args = %#v, want %#v", args, tt.wantArgs)
+			}
+			if !reflect.DeepEqual(fromEnv, tt.wantFromEnv) {
+				t.Errorf("parseBuildArgJSON() fromEnv = %#v, want %#v", fromEnv, tt.wantFromEnv)
+			}
+		})
+	}
+}
+
+func TestLoadBuildArgFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := write("base.env", "A=base\nB=base\nC=base\nFROM_ENV\nUNSET=base\n")
+	override := write("override.json", `{"B": "json", "C": "json", "UNSET": null}`)
+	invalidName := write("invalid.env", "1BAD=x\n")
+	unterminated := write("unterminated.env", "A=\"open\n")
+
+	t.Setenv("FROM_ENV", "from-env")
+	// Restored after the test by t.Setenv
+	t.Setenv("UNSET", "")
+	os.Unsetenv("UNSET")
+
+	tests := []struct {
+		name      string
+		files     []string
+		buildArgs map[string]string
+		allowlist []string
+		want      map[string]string
+		wantErr   string
+	}{
+		{
+			name:  "later files override earlier ones",
+			files: []string{base, override},
+			want:  map[string]string{"A": "base", "B": "json", "C": "json", "FROM_ENV": "from-env"},
+		},
+		{
+			name:      "--build-arg beats files",
+			files:     []string{base, override},
+			buildArgs: map[string]string{"C": "flag", "FROM_ENV": "flag"},
+			want:      map[string]string{"A": "base", "B": "json", "C": "flag", "FROM_ENV": "flag"},
+		},
+		{
+			name:      "environment outside --env-allowlist",
+			files:     []string{base},
+			allowlist: []string{"CI_*"},
+			wantErr:   "--env-allowlist does not allow",
+		},
+		{
+			name:    "invalid name",
+			files:   []string{invalidName},
+			wantErr: "invalid --build-arg-file " + invalidName,
+		},
+		{
+			name:    "unterminated quote",
+			files:   []string{unterminated},
+			wantErr: "line 1: unterminated double quote",
+		},
+		{
+			name:    "missing file",
+			files:   []string{filepath.Join(dir, "missing.env")},
+			wantErr: "invalid --build-arg-file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{BuildArgFiles: tt.files, BuildArgs: map[string]string{}, EnvAllowlist: tt.allowlist}
+			for key, value := range tt.buildArgs {
+				config.BuildArgs[key] = value
+			}
+			err := loadBuildArgFiles(config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadBuildArgFiles() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadBuildArgFiles() error = %v", err)
+			}
+			if !reflect.DeepEqual(config.BuildArgs, tt.want) {
+				t.Errorf("loadBuildArgFiles() build args = %#v, want %#v", config.BuildArgs, tt.want)
+			}
+		})
+	}
+}
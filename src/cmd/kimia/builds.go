@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runBuilds implements `kimia builds [ID]`: list the builds running in this
+// container, or print one of them and exit 1 when it is not running, so that
+// `kubectl exec` and exec probes can watch a long-lived builder pod
+func runBuilds(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia builds [ID] [--json]"
+	var id string
+	asJSON := false
+	for _, arg := range args {
+		switch {
+		case arg == "--json":
+			asJSON = true
+		case strings.HasPrefix(arg, "-") || id != "":
+			logger.Error("Unknown option: %s", arg)
+			logger.Error("%s", usage)
+			return 1
+		default:
+			id = arg
+		}
+	}
+
+	if id != "" {
+		active, err := build.FindActiveBuild(id)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		return printJSON(active)
+	}
+
+	builds, err := build.ListActiveBuilds()
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if asJSON {
+		if builds == nil {
+			builds = []build.ActiveBuild{}
+		}
+		return printJSON(builds)
+	}
+	if len(builds) == 0 {
+		fmt.Println("No builds running")
+		return 0
+	}
+	fmt.Printf("%-12s  %7s  %-20s  %9s  %-8s  %-10s  %s\n", "ID", "PID", "STARTED", "ELAPSED", "COMMAND", "BUILDER", "DESTINATION")
+	for _, active := range builds {
+		destination, builder := "-", "-"
+		if len(active.Destinations) > 0 {
+			destination = active.Destinations[0]
+			if len(active.Destinations) > 1 {
+				destination += fmt.Sprintf(" (+%d)", len(active.Destinations)-1)
+			}
+		}
+		if active.Builder != "" {
+			builder = active.Builder
+		}
+		elapsed := time.Since(active.Started).Round(time.Second).String()
+		fmt.Printf("%-12s  %7d  %-20s  %9s  %-8s  %-10s  %s\n", active.ID, active.PID, active.Started.Local().Format("2006-01-02 15:04:05"), elapsed, active.Command, builder, destination)
+	}
+	return 0
+}
+
+// runLogs implements `kimia logs ID [--follow]`: print the output of a
+// running build, and with --follow keep printing it until the build ends
+func runLogs(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia logs ID [--follow]"
+	var id string
+	follow := false
+	for _, arg := range args {
+		switch {
+		case arg == "--follow" || arg == "-f":
+			follow = true
+		case strings.HasPrefix(arg, "-") || id != "":
+			logger.Error("Unknown option: %s", arg)
+			logger.Error("%s", usage)
+			return 1
+		default:
+			id = arg
+		}
+	}
+	if id == "" {
+		logger.Error("%s", usage)
+		return 1
+	}
+
+	active, err := build.FindActiveBuild(id)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if err := build.CopyBuildLog(active, os.Stdout, follow); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	return 0
+}
+
+// runCancel implements `kimia cancel ID`: stop a running build. The build
+// stops its builder and exits with code 11.
+func runCancel(args []string) int {
+	logger.Setup("", false)
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		logger.Error("Usage: kimia cancel ID")
+		return 1
+	}
+	active, err := build.CancelActiveBuild(args[0])
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	logger.Info("Canceling build %s (PID %d)", active.ID, active.PID)
+	return 0
+}
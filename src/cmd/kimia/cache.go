@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// cacheUnsharedEnv marks a `kimia cache` re-executed inside `buildah unshare`
+const cacheUnsharedEnv = "_KIMIA_CACHE_UNSHARED"
+
+// runCache implements `kimia cache save|restore --ref REF`: snapshot the
+// builder storage to a registry after a build, and restore it on a cold pod
+// before the next one, so autoscaled CI nodes start with a warm cache
+func runCache(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia cache save|restore --ref=registry/cache:tag [--dir=DIR] [--builder=auto|buildkit|buildah] [--chunk-size=SIZE] [--heartbeat-interval=DURATION] [--insecure] [--no-ci-auth] [--ca-bundle=ca.pem] [--registry-config=host=HOST,...]"
+	if len(args) == 0 || (args[0] != "save" && args[0] != "restore") {
+		logger.Error("%s", usage)
+		return 1
+	}
+	action := args[0]
+
+	config := build.StorageCacheConfig{}
+	var caBundle string
+	var registryConfigs []string
+	choice := ""
+	noCIAuth := false
+	for i := 1; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		} else if flag != "--insecure" && flag != "--no-ci-auth" && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		switch flag {
+		case "--ref":
+			config.Ref = value
+		case "--dir":
+			config.Dir = value
+		case "--builder":
+			if !containsString(build.Builders, value) {
+				logger.Error("Invalid --builder %q (valid: %s)", value, strings.Join(build.Builders, ", "))
+				return 1
+			}
+			if value == "buildpacks" {
+				logger.Error("--builder=buildpacks keeps its cache in --cache-dir or --cache-repo; kimia cache snapshots BuildKit and Buildah storage")
+				return 1
+			}
+			choice = value
+		case "--chunk-size":
+			size, err := build.ParseSize(value)
+			if err != nil {
+				logger.Error("Invalid --chunk-size: %v", err)
+				return 1
+			}
+			config.ChunkSize = size
+		case "--heartbeat-interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval < 0 {
+				logger.Error("Invalid --heartbeat-interval: %s", value)
+				return 1
+			}
+			config.HeartbeatInterval = interval
+		case "--insecure":
+			config.Insecure = value == "" || parseBool(value)
+		case "--no-ci-auth":
+			noCIAuth = true
+		case "--ca-bundle":
+			caBundle = value
+		case "--registry-config":
+			registryConfigs = append(registryConfigs, value)
+		default:
+			logger.Error("Unknown option: %s", flag)
+			logger.Error("%s", usage)
+			return 1
+		}
+	}
+	if config.Ref == "" {
+		logger.Error("%s", usage)
+		return 1
+	}
+
+	config.Builder = build.DetectChosenBuilder(choice)
+	if config.Builder == "unknown" && choice != "" && choice != "auto" {
+		logger.Error("--builder=%s: %s is not installed", choice, choice)
+		return 1
+	}
+	if config.Builder == "unknown" {
+		logger.Error("No builder found (expected buildkitd or buildah)")
+		return 1
+	}
+
+	// Rootless Buildah storage holds files owned by subordinate UIDs, which
+	// can only be read and restored from inside Buildah's user namespace
+	if config.Builder == "buildah" && os.Geteuid() != 0 && os.Getenv(cacheUnsharedEnv) == "" {
+		return runCacheUnshared(action, args[1:])
+	}
+
+	if ws, err := build.StartWorkspace(); err != nil {
+		logger.Warning("Temporary files will not be tracked: %v", err)
+	} else {
+		defer ws.Close()
+	}
+
+	removeCABundle, err := installCABundle(&Config{CABundle: caBundle})
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(&Config{RegistryConfigs: registryConfigs}); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	if config.Dir == "" {
+		dir, err := build.StorageCacheDir(config.Builder)
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		config.Dir = dir
+	}
+
+	// Credentials from DOCKER_USERNAME/DOCKER_PASSWORD are needed for private registries
+	if err := auth.Setup(auth.SetupConfig{Destinations: []string{config.Ref}, NoCIAuth: noCIAuth}); err != nil {
+		logger.Warning("Authentication setup failed: %v", err)
+	}
+
+	if action == "save" {
+		err = build.SaveStorageCache(config)
+	} else {
+		err = build.RestoreStorageCache(config)
+	}
+	if err != nil {
+		logger.Error("Cache %s failed: %v", action, err)
+		return 1
+	}
+	return 0
+}
+
+// runCacheUnshared runs this `kimia cache` command again inside `buildah unshare`
+func runCacheUnshared(action string, args []string) int {
+	self, err := os.Executable()
+	if err != nil {
+		logger.Error("Cannot locate the kimia binary: %v", err)
+		return 1
+	}
+
+	logger.Debug("Re-running in the Buildah user namespace")
+	// #nosec G204 -- re-executes this binary with the user's own arguments
+	cmd := exec.Command("buildah", append([]string{"unshare", self, "cache", action}, args...)...)
+	cmd.Env = append(os.Environ(), cacheUnsharedEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		logger.Error("buildah unshare failed: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// defaultCertValidityDays is the validity of certificates from buildkit-certs
+const defaultCertValidityDays = 365
+
+// runBuildKitCerts implements `kimia buildkit-certs`: create a CA with daemon
+// and client certificates so a buildkitd can be exposed over tcp:// with
+// mutual TLS and used with --buildkit-addr and --buildkit-tls-dir
+func runBuildKitCerts(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia buildkit-certs --output DIR --server-name NAME [--server-name NAME ...] [--validity DAYS]"
+	var (
+		output      string
+		serverNames []string
+		days        = defaultCertValidityDays
+	)
+
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		} else if i+1 < len(args) && flag != "--help" && flag != "-h" {
+			i++
+			value = args[i]
+		}
+
+		switch flag {
+		case "--output", "-o":
+			output = value
+		case "--server-name":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					serverNames = append(serverNames, name)
+				}
+			}
+		case "--validity":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				logger.Error("Invalid --validity %q (expected a number of days)", value)
+				return 1
+			}
+			days = n
+		case "--help", "-h":
+			logger.Info("%s", usage)
+			return 0
+		default:
+			logger.Error("Unknown option: %s", flag)
+			logger.Error("%s", usage)
+			return 1
+		}
+	}
+
+	if output == "" || len(serverNames) == 0 {
+		logger.Error("%s", usage)
+		return 1
+	}
+
+	if err := build.GenerateBuildKitCerts(output, serverNames, time.Duration(days)*24*time.Hour); err != nil {
+		logger.Error("Failed to generate certificates: %v", err)
+		return 1
+	}
+
+	logger.Info("Generated buildkitd certificates in %s (valid for %d days)", output, days)
+	logger.Info("  Server names: %s", strings.Join(serverNames, ", "))
+	logger.Info("  buildkitd:    --tlscacert %s --tlscert %s --tlskey %s",
+		filepath.Join(output, "daemon", build.BuildKitCertFiles.CA),
+		filepath.Join(output, "daemon", build.BuildKitCertFiles.Cert),
+		filepath.Join(output, "daemon", build.BuildKitCertFiles.Key))
+	logger.Info("  kimia:        --buildkit-tls-dir %s", filepath.Join(output, "client"))
+	logger.Info("Keep %s offline; it can issue new certificates", filepath.Join(output, "ca-key.pem"))
+	return 0
+}
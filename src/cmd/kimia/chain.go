@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runChains builds the --chain Dockerfiles in order, each with the image of
+// the primary build as a named context. They share the primary build's
+// builder, cache and options; their images are neither pushed nor written
+// to the output files. The chain NewTestChain returns runs the --test-cmd.
+func runChains(primary build.Config, ctx *build.Context, chains []build.ChainBuild) error {
+	count := 0
+	for _, chain := range chains {
+		if len(chain.TestCmd) == 0 {
+			count++
+		}
+	}
+	n := 0
+	for _, chain := range chains {
+		source, err := build.NewChainSource(chain.Name, primary.ChainLayout, primary.Destination, primary.DryRun)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Build, fmt.Errorf("chained build %s: %w", chain.Dockerfile, err))
+		}
+
+		chainConfig := primary
+		chainConfig.Dockerfile = chain.Dockerfile
+		chainConfig.Target = chain.Target
+		chainConfig.Destination = nil
+		chainConfig.NoPush = true
+		chainConfig.TarPath = ""
+		chainConfig.Load = ""
+		chainConfig.DigestFile = ""
+		chainConfig.ImageNameWithDigestFile = ""
+		chainConfig.ImageNameTagWithDigestFile = ""
+		chainConfig.DigestMapFile = ""
+		chainConfig.Attach = nil
+		chainConfig.Sign = false
+		chainConfig.ExportCache = nil // The primary build exports the cache
+		chainConfig.CacheExportDir = ""
+		chainConfig.CacheInline = false
+		chainConfig.History = nil
+		chainConfig.CacheExplain = nil
+		chainConfig.ChainLayout = ""
+		chainConfig.ChainFrom = source
+
+		if len(chain.TestCmd) > 0 {
+			logger.Info("Testing the image: %s", build.TestCommandString(chain.TestCmd))
+			if err := build.Execute(chainConfig, ctx); err != nil {
+				return exitcode.Wrap(exitcode.Build, fmt.Errorf("--test-cmd failed: %w", err))
+			}
+			logger.Info("Image test passed")
+			continue
+		}
+
+		stage := chain.Target
+		if stage == "" {
+			stage = "last stage"
+		}
+		n++
+		logger.Info("Chained build %d/%d: %s (%s), with the primary image as %q", n, count, chain.Dockerfile, stage, chain.Name)
+		if err := build.Execute(chainConfig, ctx); err != nil {
+			return exitcode.Wrap(exitcode.Build, fmt.Errorf("chained build %s failed: %w", chain.Dockerfile, err))
+		}
+	}
+	return nil
+}
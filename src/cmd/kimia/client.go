@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxClientRequest bounds the request line `kimia client-build` reads
+const maxClientRequest = 16 << 20
+
+// clientResultMarker starts the line with the output files of a remote build;
+// the nonce of the request follows, so build output cannot forge it
+const clientResultMarker = "kimia-client-result:"
+
+// clientRequest is what `kimia client` sends to `kimia client-build` in the
+// builder pod: the options parsed by the client, followed on stdin by the
+// archive of the local context when Context is set
+type clientRequest struct {
+	Config  Config   `json:"config"`
+	Context bool     `json:"context"`
+	Outputs []string `json:"outputs,omitempty"` // clientOutputs to send back
+	Nonce   string   `json:"nonce"`
+}
+
+// clientOutputs are the files a remote build writes that the client receives
+var clientOutputs = map[string]func(*Config) *string{
+	"digest-file":                     func(c *Config) *string { return &c.DigestFile },
+	"image-name-with-digest-file":     func(c *Config) *string { return &c.ImageNameWithDigestFile },
+	"image-name-tag-with-digest-file": func(c *Config) *string { return &c.ImageNameTagWithDigestFile },
+	"digest-map-file":                 func(c *Config) *string { return &c.DigestMapFile },
+	"events-file":                     func(c *Config) *string { return &c.EventsFile },
+	"source-info-file":                func(c *Config) *string { return &c.SourceInfoFile },
+}
+
+// runClient implements `kimia client --pod POD [build options]`: build the
+// local context in a builder pod through kubectl exec, with the options
+// parsed here as for a local build, stream the output back and write the
+// digest and metadata files locally
+func runClient(args []string) int {
+	usage := "Usage: kimia client --pod=POD [--namespace=NS] [--container=NAME] [--kubectl=PATH] --context=. --destination=REF [options]"
+	var pod, namespace, container string
+	kubectl := "kubectl"
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		}
+		switch flag {
+		case "--pod", "--namespace", "-n", "--container", "-c", "--kubectl":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.Setup("", false)
+				logger.Error("%s requires a value", flag)
+				return exitcode.Config
+			}
+			switch flag {
+			case "--pod":
+				pod = value
+			case "--namespace", "-n":
+				namespace = value
+			case "--container", "-c":
+				container = value
+			case "--kubectl":
+				kubectl = value
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	config := parseArgs(rest)
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+	if pod == "" || config.Context == "" || len(config.Destination) == 0 {
+		logger.Error("%s", usage)
+		return exitcode.Config
+	}
+	if config.TarPath != "" || config.Load != "" {
+		logger.Error("--tar-path and --load write the image in the builder pod and cannot be used with kimia client")
+		return exitcode.Config
+	}
+
+	request, local, err := newClientRequest(config)
+	if err != nil {
+		logger.Error("%v", err)
+		return exitcode.Config
+	}
+
+	kubectlArgs := []string{"exec", "-i"}
+	if namespace != "" {
+		kubectlArgs = append(kubectlArgs, "--namespace="+namespace)
+	}
+	if container != "" {
+		kubectlArgs = append(kubectlArgs, "--container="+container)
+	}
+	kubectlArgs = append(kubectlArgs, pod, "--")
+	logger.Info("Building in pod %s", pod)
+
+	// #nosec G204 -- kubectl and the pod are given by the user, passed without a shell
+	cmd := exec.Command(kubectl, append(kubectlArgs, "kimia", "client-build")...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		logger.Error("Failed to run %s: %v", kubectl, err)
+		return 1
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendClientRequest(stdin, request, config)
+	}()
+
+	// The first signal cancels the build in the pod, a second one stops waiting for it
+	var buildID atomic.Pointer[string]
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		id := buildID.Load()
+		if id == nil {
+			// #nosec G104 -- the build has not started in the pod yet
+			cmd.Process.Kill()
+			return
+		}
+		logger.Warning("Canceling build %s in pod %s (interrupt again to stop waiting)", *id, pod)
+		// #nosec G204 -- same kubectl arguments as the build
+		cancel := exec.Command(kubectl, append(kubectlArgs, "kimia", "cancel", *id)...)
+		cancel.Stdout, cancel.Stderr = os.Stderr, os.Stderr
+		if err := cancel.Run(); err != nil {
+			logger.Warning("Failed to cancel build %s: %v", *id, err)
+		}
+		<-signals
+		// #nosec G104
+		cmd.Process.Kill()
+	}()
+
+	var outputs map[string][]byte
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxClientRequest)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if encoded, ok := strings.CutPrefix(line, clientResultMarker+request.Nonce+" "); ok {
+			if outputs, err = decodeClientOutputs(encoded); err != nil {
+				logger.Warning("%v", err)
+			}
+			continue
+		}
+		if _, id, ok := strings.Cut(line, "Build ID: "); ok && buildID.Load() == nil {
+			id = strings.TrimSpace(id)
+			buildID.Store(&id)
+		}
+		fmt.Println(line)
+	}
+	// #nosec G104 -- stdout ends with the build
+	io.Copy(os.Stdout, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			return exitErr.ExitCode()
+		}
+		logger.Error("Build in pod %s failed: %v", pod, err)
+		return 1
+	}
+	if err := <-sent; err != nil {
+		logger.Error("Failed to send the build to pod %s: %v", pod, err)
+		return 1
+	}
+
+	names := make([]string, 0, len(local))
+	for name := range local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content, ok := outputs[name]
+		if !ok {
+			continue
+		}
+		// #nosec G306 -- 0644 for digest and metadata files (public build artifacts)
+		if err := os.WriteFile(local[name], content, 0644); err != nil {
+			logger.Error("Failed to write %s: %v", local[name], err)
+			return 1
+		}
+		logger.Info("Saved %s from the builder pod to %s", name, local[name])
+	}
+	return 0
+}
+
+// newClientRequest returns the request of a build and the local paths of the
+// output files it sends back. A Dockerfile outside the context is sent
+// inline, and the context archive is already filtered by the ignore file.
+func newClientRequest(config *Config) (*clientRequest, map[string]string, error) {
+	request := &clientRequest{Config: *config}
+	remote := &request.Config
+	local := make(map[string]string)
+	for name, field := range clientOutputs {
+		if path := *field(remote); path != "" {
+			local[name] = path
+			request.Outputs = append(request.Outputs, name)
+			*field(remote) = ""
+		}
+	}
+	sort.Strings(request.Outputs)
+
+	if !isRemoteContext(config.Context) {
+		info, err := os.Stat(config.Context)
+		if err != nil || !info.IsDir() {
+			return nil, nil, fmt.Errorf("build context %s is not a directory", config.Context)
+		}
+		request.Context = true
+		remote.Context = ""
+		remote.IgnoreFile = ""
+		if config.Dockerfile != "" {
+			path := config.Dockerfile
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(config.Context, path)
+			}
+			rel, err := filepath.Rel(config.Context, path)
+			if err == nil && filepath.IsLocal(rel) {
+				remote.Dockerfile = filepath.ToSlash(rel)
+			} else {
+				// #nosec G304 -- the Dockerfile given with --dockerfile
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to read Dockerfile: %v", err)
+				}
+				remote.Dockerfile, remote.DockerfileContent = "", string(content)
+			}
+		}
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	request.Nonce = hex.EncodeToString(nonce)
+	return request, local, nil
+}
+
+// sendClientRequest writes the request line and the context archive to the
+// stdin of `kimia client-build`
+func sendClientRequest(stdin io.WriteCloser, request *clientRequest, config *Config) error {
+	defer stdin.Close()
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if _, err := stdin.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if !request.Context {
+		return nil
+	}
+	dockerfile := config.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	if !filepath.IsAbs(dockerfile) {
+		dockerfile = filepath.Join(config.Context, dockerfile)
+	}
+	stats, err := build.WriteContextArchive(stdin, config.Context, dockerfile, config.IgnoreFile)
+	if err != nil {
+		return err
+	}
+	logger.Info("Sent context: %d files (%d bytes), %d paths ignored", stats.Files, stats.TotalBytes, stats.Ignored)
+	return nil
+}
+
+// decodeClientOutputs decodes the output files sent back by client-build
+func decodeClientOutputs(encoded string) (map[string][]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output files from the builder pod: %v", err)
+	}
+	var outputs map[string][]byte
+	if err := json.Unmarshal(data, &outputs); err != nil {
+		return nil, fmt.Errorf("invalid output files from the builder pod: %v", err)
+	}
+	return outputs, nil
+}
+
+// runClientBuild implements `kimia client-build`, run by kimia client in the
+// builder pod: read the request from stdin, extract the context and run the
+// build in a child process, then send the output files back. The child makes
+// sure the context is removed however the build exits.
+func runClientBuild(args []string) int {
+	logger.Setup("", false)
+	if len(args) == 1 && strings.HasPrefix(args[0], "--request=") {
+		return runClientBuildRequest(strings.TrimPrefix(args[0], "--request="))
+	}
+	if len(args) != 0 {
+		logger.Error("Usage: kimia client-build (run by kimia client through kubectl exec)")
+		return exitcode.Config
+	}
+
+	reader := bufio.NewReader(io.LimitReader(os.Stdin, maxClientRequest))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		logger.Error("Failed to read the build request: %v", err)
+		return exitcode.Config
+	}
+	var request clientRequest
+	if err := json.Unmarshal(line, &request); err != nil {
+		logger.Error("Invalid build request: %v", err)
+		return exitcode.Config
+	}
+	config := &request.Config
+
+	// Under $HOME/workspace like Git contexts: BuildKit only builds contexts within $HOME
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	workspaceDir := filepath.Join(homeDir, "workspace")
+	// #nosec G301 -- same permissions as the workspace of Git contexts
+	if err := os.MkdirAll(workspaceDir, 0750); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	workDir, err := os.MkdirTemp(workspaceDir, "kimia-client-")
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer os.RemoveAll(workDir)
+	if request.Context {
+		config.Context = filepath.Join(workDir, "context")
+		// #nosec G301 -- read by the builder
+		if err := os.Mkdir(config.Context, 0755); err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		// The archive follows the request line; the limit applied to the request only
+		files, err := build.ExtractContextArchive(io.MultiReader(reader, os.Stdin), config.Context)
+		if err != nil {
+			logger.Error("Failed to receive the build context: %v", err)
+			return exitcode.Context
+		}
+		logger.Info("Received context: %d files", files)
+	}
+	outputs := make(map[string]string)
+	for _, name := range request.Outputs {
+		field, ok := clientOutputs[name]
+		if !ok {
+			logger.Error("Invalid build request: unknown output %s", name)
+			return exitcode.Config
+		}
+		outputs[name] = filepath.Join(workDir, name)
+		*field(config) = outputs[name]
+	}
+
+	requestFile := filepath.Join(workDir, "request.json")
+	data, err := json.Marshal(request)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	// Build args may hold secrets
+	if err := os.WriteFile(requestFile, data, 0600); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	// #nosec G204 -- kimia itself, with a request file it wrote
+	cmd := exec.Command(self, "client-build", "--request="+requestFile)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	go func() {
+		for sig := range signals {
+			// #nosec G104 -- the build may have exited
+			cmd.Process.Signal(sig)
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			return exitErr.ExitCode()
+		}
+		logger.Error("%v", err)
+		return 1
+	}
+
+	results := make(map[string][]byte)
+	for name, path := range outputs {
+		// #nosec G304 -- written by the build in the work directory
+		if content, err := os.ReadFile(path); err == nil {
+			results[name] = content
+		}
+	}
+	data, err = json.Marshal(results)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	fmt.Printf("%s%s %s\n", clientResultMarker, request.Nonce, base64.StdEncoding.EncodeToString(data))
+	return 0
+}
+
+// runClientBuildRequest runs the build of a request file written by client-build
+func runClientBuildRequest(path string) int {
+	// #nosec G304 -- written by the parent client-build
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	var request clientRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		logger.Error("Invalid build request: %v", err)
+		return exitcode.Config
+	}
+	runBuildCommand(&request.Config, nil, false)
+	return 0
+}
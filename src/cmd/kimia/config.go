@@ -1,5 +1,12 @@
 package main
 
+import (
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+)
+
 // Config holds all kimia configuration options
 type Config struct {
 	// Core build arguments
@@ -8,14 +15,37 @@ type Config struct {
 	SubContext  string
 	Destination []string
 
+	// Dockerfile given inline (--dockerfile-content, or --dockerfile=- for stdin)
+	DockerfileContent string
+
+	// Destinations tagged from a specific --target (target=STAGE,image=REF)
+	TargetDestinations []string
+
+	// Templates that compute each destination's image reference (text/template)
+	TagTemplates []string
+
+	// Dockerfiles built after the primary build with its image as a named
+	// context (dockerfile=FILE,target=STAGE,name=NAME)
+	Chain []string
+
+	// Command run in the built image before it is pushed
+	TestCmd string
+
 	// Cache configuration
 	Cache        bool
 	CacheDir     string
 	ExportCache  []string // BuildKit --export-cache options (e.g. "type=registry,ref=...,mode=max")
 	ImportCache  []string // BuildKit --import-cache options (e.g. "type=registry,ref=...")
 
+	CacheExportDir string // Local directory for BuildKit type=local cache export
+	CacheImportDir string // Local directory for BuildKit type=local cache import
+	CacheInline    bool   // Embed cache metadata in the pushed image (BuildKit type=inline)
+	CacheRepo      string // Registry repository for layer cache (both builders)
+
 	// Build arguments
-	BuildArgs map[string]string
+	BuildArgs     map[string]string
+	BuildArgFiles []string // dotenv or JSON files, overridden by --build-arg
+	EnvAllowlist  []string // Patterns of the environment variables builds may read; empty = all
 
 	// Output options
 	NoPush                     bool
@@ -23,13 +53,32 @@ type Config struct {
 	DigestFile                 string
 	ImageNameWithDigestFile    string
 	ImageNameTagWithDigestFile string
+	DigestMapFile              string   // JSON map of every pushed reference to its digest
+	Attach                     []string // Files attached as referrer artifacts (type=sarif,file=scan.sarif)
+	VerifyPush                 bool     // Read pushed images back from the registry and compare them with the build
+	StagingDestination         string   // Push here first and promote to the destinations afterwards
+	PromoteRequire             []string // Artifact kinds the staged image must carry before promotion
+	PromoteWebhook             string   // URL that must approve the staged image before promotion
 
 	// Security and registry options
 	Insecure            bool
 	InsecurePull        bool
 	InsecureRegistry    []string
 	RegistryCertificate string
+	CABundle            string   // Extra CA certificates trusted by every component (PEM)
+	RegistryConfigs     []string // Per-registry TLS settings (host=HOST,insecure=true,ca=FILE,...)
+	PinRegistryCert     bool   // Trust-on-first-use pinning of destination registry certificates
+	CheckPushAccess     bool   // Check before building that the credentials can push to every destination
+	NoCIAuth            bool   // Ignore registry credentials provided by CI systems (DOCKER_AUTH_CONFIG, CI_REGISTRY_*, GITHUB_TOKEN)
+	RegistryPinFile     string // State file holding pinned certificate fingerprints
 	PushRetry           int
+	PushJobs            int    // Layers uploaded at the same time (0 = builder default)
+	PushChunkSize       string // Upload chunk size of kimia's own uploads, e.g. 64MiB
+	PushBackend         string // Who pushes: builder (default) or native
+	Compression         string // Layer compression: auto (default), gzip, zstd or estargz
+	CompressionLevel    int    // Compression level (0 = builder default)
+	BuildTimeout        string // Time limit of the build phase, e.g. 45m
+	PushTimeout         string // Time limit of the push phase, e.g. 10m
 	ImageDownloadRetry  int
 
 	// Logging options
@@ -38,19 +87,191 @@ type Config struct {
 
 	// Build behavior
 	CustomPlatform string
-	Target         string
-	StorageDriver  string // Storage driver selection (vfs, overlay, native)
-	Reproducible   bool   // Enable reproducible builds
-	Timestamp      string // Custom timestamp for reproducible builds (Unix epoch)
+	RegisterBinfmt bool     // Register missing QEMU binfmt_misc handlers (privileged pods)
+	Targets        []string // Stages to build, in order; the last one gets untargeted destinations
+	StorageDriver  string   // Storage driver selection (vfs, overlay, native)
+	Reproducible   bool     // Enable reproducible builds
+	Timestamp      string   // Custom timestamp for reproducible builds (Unix epoch)
+
+	// Build context normalization, so that contexts from different CI runners build alike
+	NormalizeContext bool   // Normalize owner, modes and modification times of the context
+	ContextChown     string // Owner of the normalized context (UID:GID); implies NormalizeContext
+
+	// Base image rewriting (e.g. docker.io/*=mirror.corp/proxy/*)
+	BaseImageRewrites []string
+
+	// Layer size limits
+	MaxLayerSize     string // Largest allowed layer (e.g. 10GB); empty = unlimited
+	MaxImageSize     string // Largest allowed image, the sum of its layers; empty = unlimited
+	SplitLargeLayers bool   // Split oversized COPY layers instead of failing
+
+	// User namespace isolation (per-build subordinate ID ranges)
+	UsernsRange     string // Explicit start:count assigned by a controller
+	UsernsRangeFile string // Node-shared allocation file
+	UsernsRangeSize int    // Size of ranges taken from the allocation file
+
+	// Explicit user namespace ID mappings (container:host:size, repeatable)
+	UsernsUIDMap []string
+	UsernsGIDMap []string
+
+	// Print the resolved builder invocation without building
+	DryRun bool
+
+	// JSON-lines file receiving build events (e.g. the per-stage timing report)
+	EventsFile string
+
+	// Log a heartbeat when the build, export or push prints nothing for this long (e.g. 5m)
+	HeartbeatInterval string
+
+	// Keep the state of a failed step for a debug shell, holding the pod this long (e.g. 30m)
+	DebugOnFailure bool
+	DebugHold      string
+
+	// Report why each step hit or missed the cache, comparing with the previous build
+	ExplainCache     bool
+	ExplainCacheFile string // Inputs of previous builds (default: $HOME/.kimia/cache-explain.json)
+
+	// Build history recording inputs, digests, duration and cache use of every build
+	HistoryFile string // Default: $HOME/.kimia/history.json
+	NoHistory   bool
+
+	// Tag the image of the last build with the same inputs instead of building
+	SkipUnchanged bool
+
+	// Compare the SBOM of the pushed image with the previous build's and attach the diff
+	SBOMDiff bool
+
+	// Webhook notified when the build finishes or fails
+	NotifyURL        string
+	NotifyFormat     string // generic-json (default), cloudevents or slack
+	NotifySecretFile string // HMAC key signing the payload (default: $KIMIA_NOTIFY_SECRET)
+
+	// Scanner that must approve the pushed image
+	ScanWebhook           string
+	ScanWebhookTimeout    string // Time to wait for the verdict, e.g. 10m
+	ScanWebhookSecretFile string // HMAC key signing the request (default: $KIMIA_SCAN_WEBHOOK_SECRET)
+
+	// Executables run after the build and before and after the push
+	PostBuildHook string
+	PrePushHook   string
+	PostPushHook  string
+	HookFailure   string // abort (default) or warn
+
+	// Retries of builds that failed with a transient network error (0 = off)
+	RetryTransient int
+
+	// Base image pull policy: always, missing or never (default: builder default)
+	PullPolicy string
+
+	// Network settings of RUN steps
+	Network   string   // host (default), none or slirp4netns
+	AddHosts  []string // host:ip entries added to /etc/hosts
+	DNS       []string // DNS servers
+	DNSSearch []string // DNS search domains
+
+	// Privileged RUN steps, only honored with --allow-privileged-steps
+	AllowPrivilegedSteps bool
+	Allow                []string // BuildKit entitlements (security.insecure, network.host)
+	Devices              []string // Buildah --device values (host[:container[:perms]])
+	CapAdd               []string // Buildah --cap-add capabilities
+
+	// Secrets of RUN --mount=type=secret steps, never passed as build args
+	BuildArgFromSecret []string // NAME=PATH of a mounted Kubernetes Secret file
+	SecretFromEnv      []string // id=ID,env=VAR
+
+	// Build context ignore rules
+	IgnoreFile  string // Ignore file used instead of .dockerignore
+	ShowIgnored bool   // List excluded context files and the final context size
+
+	// Build context size limits after ignore rules (e.g. 500MB); empty = unlimited
+	MaxContextSize     string // Fail above this size
+	ContextSizeWarning string // Warn above this size
+
+	// Keep buildkitd running across kimia invocations in the same pod (BuildKit only)
+	ReuseDaemon bool
+
+	// TOML files or globs merged into the generated buildkitd.toml (BuildKit only)
+	BuildkitdConfigFragments []string
+
+	// Builder to use: auto (BuildKit when installed), buildkit, buildah or buildpacks
+	Builder string
+
+	// Run image of buildpacks builds ("" = the one of the builder image)
+	RunImage string
+
+	// External buildkitd instead of the bundled one (default: $BUILDKIT_HOST)
+	BuildkitAddr          string
+	BuildkitTLSCACert     string
+	BuildkitTLSCert       string
+	BuildkitTLSKey        string
+	BuildkitTLSServerName string
+	BuildkitTLSDir        string // Directory with ca.pem, cert.pem and key.pem
+
+	// External buildkitd per platform as PLATFORM=ADDR (build farm routing)
+	BuilderEndpoints []string
+
+	// Podman service URL to build with Buildah in another container (--buildah-remote)
+	BuildahRemote string
+
+	// Import the image into the node's containerd or docker after the build
+	Load string // auto, containerd or docker
+
+	// Layer flattening (Buildah only)
+	Squash    bool // All layers, including the base image's, into one
+	SquashNew bool // Only the layers created by this build into one
+
+	// Offline builds: no registry lookups in `kimia plan`, and base images
+	// only from the local store given by --image-store
+	Offline    bool
+	ImageStore string // OCI layout directory, "containerd" or "containerd://NAMESPACE"
+
+	// Rebuild options (`kimia rebuild-if-base-changed`)
+	Metadata   string // Previous build metadata or SLSA provenance; updated after a rebuild
+	ResultFile string // File receiving "rebuilt" or "no-change"
+
+	// Verify options (`kimia verify`)
+	Require []string // Artifact kinds that must be attached to the image
+	Policy  string   // Policy file with allowed signers and required attestations
 
 	// Labels and metadata
 	Labels      map[string]string
 	GitBranch   string
 	GitRevision string
 
+	LabelTemplateStrict bool // Fail when a --label template uses an unset variable
+
 	// Git integration
-	GitTokenFile string
-	GitTokenUser string
+	GitTokenFile   string
+	GitTokenUser   string
+	GitSSHKeyFile  string
+	GitDepth       int
+	GitFilter      string
+	GitSparsePaths []string
+	SourceInfoFile string // JSON file with the resolved source commit
+
+	sharedAuth           bool                        // Registry authentication was set up by kimia batch
+	storageRoot          string                      // Buildah storage of this build alone, in a parallel batch
+	maxLayerBytes        int64                       // Parsed --max-layer-size
+	maxImageBytes        int64                       // Parsed --max-image-size
+	maxContextBytes      int64                       // Parsed --max-context-size
+	contextWarningBytes  int64                       // Parsed --context-size-warning
+	pushChunkBytes       int64                       // Parsed --push-chunk-size
+	buildTimeout         time.Duration               // Parsed --build-timeout
+	pushTimeout          time.Duration               // Parsed --push-timeout
+	heartbeat            time.Duration               // Parsed --heartbeat-interval
+	debugHold            time.Duration               // Parsed --debug-hold
+	attachments          []build.Attachment          // Parsed --attach values
+	chains               []build.ChainBuild          // Parsed --chain values
+	testCmd              []string                    // Parsed --test-cmd
+	attestationRepos     build.AttestationRepos      // Parsed --attestation-repo values
+	scanWebhook          build.ScanWebhookConfig     // Parsed --scan-webhook options
+	contextNormalization *build.ContextNormalization // Parsed --normalize-context options
+	envBuildArgs         map[string]bool             // Names given to --build-arg without a value
+	secrets              []build.BuildSecret         // Parsed --build-arg-from-secret and --secret-from-env values
+	registryTLS          []auth.RegistryTLS          // Parsed --registry-config values
+	endpoints            map[string]string           // Parsed --builder-endpoint values by platform
+	builds               []*build.BuildRecord        // Records of the targets built, for --notify-url
+	hooks                build.Hooks                 // Validated hooks
 
 	// Enterprise features
 	Scan   bool
@@ -68,9 +289,14 @@ type Config struct {
 	BuildKitOpts []string // Raw --opt values to pass to buildctl
 
 	// Signing
-	Sign              bool   // Enable cosign signing
-	CosignKeyPath     string // Path to cosign private key
-	CosignPasswordEnv string // Environment variable for cosign password
+	Sign                bool   // Enable cosign signing
+	CosignKeyPath       string // Path to cosign private key (default: cosign.key in CosignKeySecretPath)
+	CosignKeySecretPath string // Mount of the Kubernetes Secret with cosign.key and cosign.password
+	CosignPasswordEnv   string // Environment variable for cosign password
+	CosignPasswordFile  string // File with the cosign password (default: cosign.password in CosignKeySecretPath)
+
+	// Repositories for signatures and attestations: REPO or IMAGE_REPO=REPO (--attestation-repo)
+	AttestationRepo []string
 
 	// Direct Buildah options
 	BuildahOpts []string // Raw --opt values to pass to buildah bud
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runCopy implements `kimia copy --src IMAGE --dst IMAGE`: copy or retag an
+// existing image registry-to-registry without rebuilding it, with the same
+// registry credentials, TLS and retry settings as a build
+func runCopy(args []string) int {
+	usage := "Usage: kimia copy --src=registry/app@sha256:... --dst=registry/app:tag [--dst=...] [--no-artifacts] [options]"
+	var source string
+	var destinations []string
+	noArtifacts := false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		}
+		switch flag {
+		case "--src", "--dst":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.Setup("", false)
+				logger.Error("%s requires an image reference", flag)
+				return 1
+			}
+			if flag == "--src" {
+				source = value
+			} else {
+				destinations = append(destinations, value)
+			}
+		case "--no-artifacts":
+			noArtifacts = true
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	config := parseArgs(rest)
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+
+	destinations = append(destinations, config.Destination...)
+	if source == "" || len(destinations) == 0 {
+		logger.Error("%s", usage)
+		return 1
+	}
+	var chunkSize int64
+	if config.PushChunkSize != "" {
+		size, err := build.ParseSize(config.PushChunkSize)
+		if err != nil {
+			logger.Error("Invalid --push-chunk-size: %v", err)
+			return 1
+		}
+		chunkSize = size
+	}
+	if config.PushJobs < 0 {
+		logger.Error("--push-jobs must not be negative")
+		return 1
+	}
+
+	removeCABundle, err := installCABundle(config)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(config); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	// The source registry needs credentials as well as the destinations
+	registries := append([]string{source}, destinations...)
+	if err := auth.Setup(auth.SetupConfig{Destinations: registries, InsecureRegistry: config.InsecureRegistry, NoCIAuth: config.NoCIAuth}); err != nil {
+		logger.Error("Failed to setup authentication: %v", err)
+		return 1
+	}
+	if err := applyRegistryPins(config, registries); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	digest, err := build.CopyImage(build.CopyConfig{
+		Source:           source,
+		Destinations:     destinations,
+		Insecure:         config.Insecure,
+		InsecureRegistry: config.InsecureRegistry,
+		Retry:            config.PushRetry,
+		Jobs:             config.PushJobs,
+		ChunkSize:        chunkSize,
+		SkipArtifacts:    noArtifacts,
+		Verify:           config.VerifyPush,
+		DryRun:           config.DryRun,
+	})
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if config.DryRun {
+		return 0
+	}
+
+	if config.DigestFile != "" {
+		// #nosec G306 -- 0644 for digest file (public build artifact, not sensitive)
+		if err := os.WriteFile(config.DigestFile, []byte(digest), 0644); err != nil {
+			logger.Error("Failed to write digest file: %v", err)
+			return 1
+		}
+		logger.Info("Digest saved to: %s", config.DigestFile)
+	}
+	logger.Info("Copied %s to %s", digest, strings.Join(destinations, ", "))
+	return 0
+}
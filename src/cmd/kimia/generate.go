@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/internal/preflight"
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Formats of `kimia generate ci`
+var ciFormats = []string{"tekton", "argo", "github"}
+
+// ciSpec is what a generated CI definition runs: kimia with the build options
+// given to `kimia generate ci`, in a container with the securityContext the
+// preflight checks require
+type ciSpec struct {
+	Name           string
+	Image          string
+	Args           []string // Build options, as given
+	Security       preflight.PodSecurity
+	Unconfined     bool     // Unconfined seccomp and AppArmor profiles, for user namespaces
+	RegistrySecret string   // Secret of type kubernetes.io/dockerconfigjson
+	Registries     []string // Registries of the destinations
+	LocalContext   bool     // The context is checked out by the CI system, not a Git URL
+}
+
+// runGenerate implements `kimia generate ci --format=FORMAT [build options]`:
+// print a Tekton Task, an Argo WorkflowTemplate or a GitHub Actions workflow
+// running the build, with the securityContext derived from the checks kimia
+// runs before building
+func runGenerate(args []string) int {
+	usage := "Usage: kimia generate ci --format=tekton|argo|github [--name=NAME] [--image=IMAGE] [--registry-secret=NAME] [--unconfined] --context=. --destination=REF [options]"
+	if len(args) == 0 || args[0] != "ci" {
+		logger.Setup("", false)
+		logger.Error("%s", usage)
+		return exitcode.Config
+	}
+	spec := ciSpec{Name: "kimia-build", RegistrySecret: "registry-credentials"}
+	var format string
+	for i := 1; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		}
+		switch flag {
+		case "--unconfined":
+			spec.Unconfined = true
+		case "--format", "--name", "--image", "--registry-secret":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.Setup("", false)
+				logger.Error("%s requires a value", flag)
+				return exitcode.Config
+			}
+			switch flag {
+			case "--format":
+				format = value
+			case "--name":
+				spec.Name = value
+			case "--image":
+				spec.Image = value
+			case "--registry-secret":
+				spec.RegistrySecret = value
+			}
+		default:
+			spec.Args = append(spec.Args, args[i])
+		}
+	}
+	config := parseArgs(spec.Args)
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+
+	if !containsString(ciFormats, format) || config.Context == "" || len(config.Destination) == 0 {
+		logger.Error("%s", usage)
+		return exitcode.Config
+	}
+	if config.Dockerfile == "-" {
+		logger.Error("--dockerfile=- reads the Dockerfile from stdin, which CI systems do not provide; use --dockerfile-content")
+		return exitcode.Config
+	}
+	if config.Builder != "" && config.Builder != "auto" && !containsString(build.Builders, config.Builder) {
+		logger.Error("invalid --builder %q (valid: %s)", config.Builder, strings.Join(build.Builders, ", "))
+		return exitcode.Config
+	}
+
+	// The image runs its own builder unless --builder says otherwise: BuildKit in kimia
+	builder := config.Builder
+	if builder == "" || builder == "auto" {
+		builder = "buildkit"
+		if config.BuildahRemote != "" {
+			builder = "buildah"
+		}
+	}
+	if spec.Image == "" {
+		spec.Image = "ghcr.io/rapidfort/kimia:latest"
+		if builder == "buildah" {
+			spec.Image = "ghcr.io/rapidfort/kimia-bud:latest"
+		}
+	}
+	remote := config.BuildkitAddr != "" || config.BuildahRemote != "" || len(config.BuilderEndpoints) > 0
+	security, err := preflight.BuildPodSecurity(builder, remote, strings.ToLower(config.StorageDriver), config.CapAdd)
+	if err != nil {
+		logger.Error("%v", err)
+		return exitcode.Config
+	}
+	spec.Security = security
+	spec.LocalContext = !isRemoteContext(config.Context)
+
+	seen := make(map[string]bool)
+	for _, dest := range config.Destination {
+		if build.IsTargetDestination(dest) {
+			target, err := build.ParseTargetDestination(dest)
+			if err != nil {
+				logger.Error("%v", err)
+				return exitcode.Config
+			}
+			dest = target.Image
+		}
+		if registry := auth.NormalizeRegistryURL(auth.ExtractRegistry(dest)); !seen[registry] {
+			seen[registry] = true
+			spec.Registries = append(spec.Registries, registry)
+		}
+	}
+	sort.Strings(spec.Registries)
+
+	switch format {
+	case "tekton":
+		writeTektonTask(os.Stdout, spec)
+	case "argo":
+		writeArgoTemplate(os.Stdout, spec)
+	case "github":
+		writeGitHubWorkflow(os.Stdout, spec)
+	}
+	return 0
+}
+
+// yamlString quotes s as a YAML double-quoted scalar
+func yamlString(s string) string {
+	// #nosec G104 -- strings always marshal
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// writeSecurityContext writes the container securityContext of spec at indent
+func writeSecurityContext(w io.Writer, spec ciSpec, indent string) {
+	security := spec.Security
+	fmt.Fprintf(w, "%ssecurityContext:\n", indent)
+	fmt.Fprintf(w, "%s  runAsUser: %d\n", indent, security.RunAsUser)
+	fmt.Fprintf(w, "%s  runAsGroup: %d\n", indent, security.RunAsUser)
+	fmt.Fprintf(w, "%s  runAsNonRoot: true\n", indent)
+	fmt.Fprintf(w, "%s  allowPrivilegeEscalation: %t\n", indent, security.AllowPrivilegeEscalation)
+	fmt.Fprintf(w, "%s  capabilities:\n", indent)
+	fmt.Fprintf(w, "%s    drop: [ALL]\n", indent)
+	if len(security.Capabilities) > 0 {
+		fmt.Fprintf(w, "%s    add: [%s]\n", indent, strings.Join(security.Capabilities, ", "))
+	}
+	if spec.Unconfined {
+		fmt.Fprintf(w, "%s  seccompProfile:\n%s    type: Unconfined\n", indent, indent)
+		fmt.Fprintf(w, "%s  appArmorProfile:\n%s    type: Unconfined\n", indent, indent)
+		return
+	}
+	if security.UserNamespaces {
+		fmt.Fprintf(w, "%s  # If seccomp or AppArmor blocks user namespaces (kimia check-environment),\n", indent)
+		fmt.Fprintf(w, "%s  # regenerate with --unconfined\n", indent)
+	}
+	fmt.Fprintf(w, "%s  seccompProfile:\n%s    type: RuntimeDefault\n", indent, indent)
+}
+
+// writeArgs writes the kimia arguments of spec as a YAML sequence at indent
+func writeArgs(w io.Writer, spec ciSpec, indent string) {
+	fmt.Fprintf(w, "%sargs:\n", indent)
+	for _, arg := range spec.Args {
+		fmt.Fprintf(w, "%s- %s\n", indent, yamlString(arg))
+	}
+}
+
+// writeDockerConfigVolume writes the volume holding config.json from the
+// registry secret at indent
+func writeDockerConfigVolume(w io.Writer, spec ciSpec, indent string) {
+	fmt.Fprintf(w, "%s- name: docker-config\n", indent)
+	fmt.Fprintf(w, "%s  secret:\n", indent)
+	fmt.Fprintf(w, "%s    secretName: %s\n", indent, yamlString(spec.RegistrySecret))
+	fmt.Fprintf(w, "%s    optional: true\n", indent)
+	fmt.Fprintf(w, "%s    items:\n", indent)
+	fmt.Fprintf(w, "%s    - key: .dockerconfigjson\n", indent)
+	fmt.Fprintf(w, "%s      path: config.json\n", indent)
+}
+
+// writeTektonTask writes a Tekton Task building the source workspace
+func writeTektonTask(w io.Writer, spec ciSpec) {
+	fmt.Fprintln(w, "# Generated by kimia generate ci --format=tekton")
+	fmt.Fprintln(w, "apiVersion: tekton.dev/v1")
+	fmt.Fprintln(w, "kind: Task")
+	fmt.Fprintln(w, "metadata:")
+	fmt.Fprintf(w, "  name: %s\n", yamlString(spec.Name))
+	fmt.Fprintln(w, "spec:")
+	fmt.Fprintln(w, "  description: Build and push the image with Kimia")
+	if spec.LocalContext {
+		fmt.Fprintln(w, "  workspaces:")
+		fmt.Fprintln(w, "  - name: source")
+		fmt.Fprintln(w, "    description: Source checked out by an earlier task (the build context)")
+	}
+	fmt.Fprintln(w, "  steps:")
+	fmt.Fprintln(w, "  - name: build")
+	fmt.Fprintf(w, "    image: %s\n", yamlString(spec.Image))
+	if spec.LocalContext {
+		fmt.Fprintln(w, "    workingDir: $(workspaces.source.path)")
+	}
+	writeArgs(w, spec, "    ")
+	writeSecurityContext(w, spec, "    ")
+	fmt.Fprintln(w, "    volumeMounts:")
+	fmt.Fprintln(w, "    - name: docker-config")
+	fmt.Fprintln(w, "      mountPath: /home/kimia/.docker")
+	fmt.Fprintln(w, "  volumes:")
+	writeDockerConfigVolume(w, spec, "  ")
+}
+
+// writeArgoTemplate writes an Argo WorkflowTemplate, which checks out the
+// source from Git unless the context is a Git URL already
+func writeArgoTemplate(w io.Writer, spec ciSpec) {
+	fmt.Fprintln(w, "# Generated by kimia generate ci --format=argo")
+	fmt.Fprintln(w, "apiVersion: argoproj.io/v1alpha1")
+	fmt.Fprintln(w, "kind: WorkflowTemplate")
+	fmt.Fprintln(w, "metadata:")
+	fmt.Fprintf(w, "  name: %s\n", yamlString(spec.Name))
+	fmt.Fprintln(w, "spec:")
+	fmt.Fprintln(w, "  entrypoint: build")
+	if spec.LocalContext {
+		fmt.Fprintln(w, "  arguments:")
+		fmt.Fprintln(w, "    parameters:")
+		fmt.Fprintln(w, "    - name: git-url")
+		fmt.Fprintln(w, "    - name: git-revision")
+		fmt.Fprintln(w, "      value: main")
+	}
+	fmt.Fprintln(w, "  templates:")
+	fmt.Fprintln(w, "  - name: build")
+	if spec.LocalContext {
+		fmt.Fprintln(w, "    inputs:")
+		fmt.Fprintln(w, "      artifacts:")
+		fmt.Fprintln(w, "      - name: source")
+		fmt.Fprintln(w, "        path: /workspace")
+		fmt.Fprintln(w, "        git:")
+		fmt.Fprintln(w, "          repo: \"{{workflow.parameters.git-url}}\"")
+		fmt.Fprintln(w, "          revision: \"{{workflow.parameters.git-revision}}\"")
+	}
+	fmt.Fprintln(w, "    container:")
+	fmt.Fprintf(w, "      image: %s\n", yamlString(spec.Image))
+	if spec.LocalContext {
+		fmt.Fprintln(w, "      workingDir: /workspace")
+	}
+	writeArgs(w, spec, "      ")
+	writeSecurityContext(w, spec, "      ")
+	fmt.Fprintln(w, "      volumeMounts:")
+	fmt.Fprintln(w, "      - name: docker-config")
+	fmt.Fprintln(w, "        mountPath: /home/kimia/.docker")
+	fmt.Fprintln(w, "  volumes:")
+	writeDockerConfigVolume(w, spec, "  ")
+}
+
+// writeGitHubWorkflow writes a GitHub Actions workflow running the image with
+// docker, with the capabilities and security options of the securityContext
+func writeGitHubWorkflow(w io.Writer, spec ciSpec) {
+	fmt.Fprintln(w, "# Generated by kimia generate ci --format=github")
+	fmt.Fprintf(w, "name: %s\n", yamlString(spec.Name))
+	fmt.Fprintln(w, "on:")
+	fmt.Fprintln(w, "  push:")
+	fmt.Fprintln(w, "    branches: [main]")
+	fmt.Fprintln(w, "  workflow_dispatch: {}")
+	fmt.Fprintln(w, "jobs:")
+	fmt.Fprintln(w, "  build:")
+	fmt.Fprintln(w, "    runs-on: ubuntu-latest")
+	fmt.Fprintln(w, "    permissions:")
+	fmt.Fprintln(w, "      contents: read")
+	if containsString(spec.Registries, "ghcr.io") {
+		fmt.Fprintln(w, "      packages: write")
+	}
+	fmt.Fprintln(w, "    steps:")
+	if spec.LocalContext {
+		fmt.Fprintln(w, "    - uses: actions/checkout@v4")
+	}
+	for _, registry := range spec.Registries {
+		fmt.Fprintf(w, "    - name: %s\n", yamlString("Log in to "+registry))
+		fmt.Fprintln(w, "      uses: docker/login-action@v3")
+		fmt.Fprintln(w, "      with:")
+		if registry != "docker.io" {
+			fmt.Fprintf(w, "        registry: %s\n", yamlString(registry))
+		}
+		if registry == "ghcr.io" {
+			fmt.Fprintln(w, "        username: ${{ github.actor }}")
+			fmt.Fprintln(w, "        password: ${{ secrets.GITHUB_TOKEN }}")
+		} else {
+			fmt.Fprintln(w, "        username: ${{ secrets.REGISTRY_USERNAME }}")
+			fmt.Fprintln(w, "        password: ${{ secrets.REGISTRY_PASSWORD }}")
+		}
+	}
+
+	security := spec.Security
+	options := []string{fmt.Sprintf("--user %d:%d", security.RunAsUser, security.RunAsUser), "--cap-drop ALL"}
+	for _, capability := range security.Capabilities {
+		options = append(options, "--cap-add "+capability)
+	}
+	if !security.AllowPrivilegeEscalation {
+		options = append(options, "--security-opt no-new-privileges")
+	}
+	if spec.Unconfined {
+		options = append(options, "--security-opt seccomp=unconfined", "--security-opt apparmor=unconfined")
+	}
+	options = append(options, `-v "$HOME/.docker/config.json:/home/kimia/.docker/config.json:ro"`)
+	if spec.LocalContext {
+		options = append(options, `-v "$GITHUB_WORKSPACE:/workspace"`, "-w /workspace")
+	}
+	fmt.Fprintln(w, "    - name: Build and push with Kimia")
+	fmt.Fprintln(w, "      run: |")
+	if security.UserNamespaces && !spec.Unconfined {
+		fmt.Fprintln(w, "        # If seccomp or AppArmor blocks user namespaces, regenerate with --unconfined")
+	}
+	fmt.Fprintln(w, "        docker run --rm \\")
+	for _, option := range options {
+		fmt.Fprintf(w, "          %s \\\n", option)
+	}
+	line := "          " + build.ShellQuote(spec.Image)
+	for _, arg := range spec.Args {
+		line += " \\\n            " + build.ShellQuote(arg)
+	}
+	fmt.Fprintln(w, line)
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// hclBlock is a block such as target "app" { ... } of an HCL file
+type hclBlock struct {
+	Type   string
+	Labels []string
+	Attrs  map[string]interface{}
+	Line   int
+}
+
+// hclTemplate is a string that may contain ${...} interpolations, evaluated
+// once all variables are known
+type hclTemplate struct {
+	Text string
+	Line int
+}
+
+// hclRef is a bare variable reference such as TAG
+type hclRef struct {
+	Name string
+	Line int
+}
+
+// parseHCL parses the subset of HCL used by bake files: top-level attributes
+// and blocks with labels holding attributes, string templates (also heredocs),
+// numbers, booleans, null, lists, objects and variable references. Numbers are
+// returned as strings, strings as hclTemplate and references as hclRef.
+// Functions, operators, conditionals, index and for expressions and nested
+// blocks are rejected with an error.
+func parseHCL(data string) (map[string]interface{}, []hclBlock, error) {
+	tokens, err := lexHCL(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &hclParser{tokens: tokens}
+	attrs := map[string]interface{}{}
+	var blocks []hclBlock
+	for {
+		p.skipNewlines()
+		if p.peek().kind == hclEOF {
+			return attrs, blocks, nil
+		}
+		name, err := p.expect(hclIdent)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.peek().kind == hclEquals {
+			p.next()
+			if _, dup := attrs[name.text]; dup {
+				return nil, nil, fmt.Errorf("line %d: duplicate attribute %q", name.line, name.text)
+			}
+			if attrs[name.text], err = p.parseExpression(); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		block := hclBlock{Type: name.text, Attrs: map[string]interface{}{}, Line: name.line}
+		for p.peek().kind == hclString || p.peek().kind == hclIdent {
+			label := p.next()
+			if label.kind == hclString && strings.Contains(label.text, "${") {
+				return nil, nil, fmt.Errorf("line %d: block labels cannot be templates", label.line)
+			}
+			block.Labels = append(block.Labels, label.text)
+		}
+		if _, err := p.expect(hclLBrace); err != nil {
+			return nil, nil, err
+		}
+		if err := p.parseBody(&block); err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+type hclTokenKind int
+
+const (
+	hclEOF hclTokenKind = iota
+	hclNewline
+	hclIdent
+	hclString
+	hclNumber
+	hclEquals
+	hclColon
+	hclComma
+	hclLBrace
+	hclRBrace
+	hclLBracket
+	hclRBracket
+	hclLParen
+	hclOther
+)
+
+type hclToken struct {
+	kind hclTokenKind
+	text string
+	line int
+}
+
+// lexHCL splits data into tokens; comments are dropped and string escapes
+// are resolved outside of interpolations
+func lexHCL(data string) ([]hclToken, error) {
+	var tokens []hclToken
+	line := 1
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			tokens = append(tokens, hclToken{kind: hclNewline, line: line})
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' || (c == '/' && strings.HasPrefix(data[i:], "//")):
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(data[i:], "/*"):
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(data[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			text, n, err := lexHCLString(data[i:], line)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, hclToken{kind: hclString, text: text, line: line})
+			i += n
+		case c == '<' && strings.HasPrefix(data[i:], "<<"):
+			text, n, err := lexHCLHeredoc(data[i:], line)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, hclToken{kind: hclString, text: text, line: line})
+			line += strings.Count(data[i:i+n], "\n")
+			i += n
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(data) && (strings.IndexByte("0123456789.eE+-", data[j]) >= 0) {
+				j++
+			}
+			if c == '-' && j == i+1 {
+				tokens = append(tokens, hclToken{kind: hclOther, text: "-", line: line})
+			} else {
+				tokens = append(tokens, hclToken{kind: hclNumber, text: data[i:j], line: line})
+			}
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(data) && (data[j] == '_' || data[j] == '-' || unicode.IsLetter(rune(data[j])) || unicode.IsDigit(rune(data[j]))) {
+				j++
+			}
+			tokens = append(tokens, hclToken{kind: hclIdent, text: data[i:j], line: line})
+			i = j
+		default:
+			kind := map[byte]hclTokenKind{
+				'=': hclEquals, ':': hclColon, ',': hclComma,
+				'{': hclLBrace, '}': hclRBrace, '[': hclLBracket, ']': hclRBracket, '(': hclLParen,
+			}[c]
+			if kind == hclEOF {
+				kind = hclOther
+			}
+			// == is an operator, not an assignment
+			if c == '=' && strings.HasPrefix(data[i:], "==") {
+				kind = hclOther
+			}
+			tokens = append(tokens, hclToken{kind: kind, text: string(c), line: line})
+			i++
+		}
+	}
+	return append(tokens, hclToken{kind: hclEOF, line: line}), nil
+}
+
+// lexHCLString reads a quoted string at the start of data and returns its
+// text and length. Interpolations are kept as written.
+func lexHCLString(data string, line int) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\n':
+			return "", 0, fmt.Errorf("line %d: unterminated string", line)
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch data[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(data[i])
+			case 'u':
+				if i+4 >= len(data) {
+					return "", 0, fmt.Errorf("line %d: invalid escape sequence", line)
+				}
+				r, err := strconv.ParseUint(data[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("line %d: invalid escape sequence", line)
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("line %d: invalid escape sequence \\%c", line, data[i])
+			}
+		case c == '$' && strings.HasPrefix(data[i:], "${"):
+			// Copy the interpolation, which may itself contain quotes
+			end := hclInterpolationEnd(data[i:])
+			if end < 0 {
+				return "", 0, fmt.Errorf("line %d: unterminated interpolation", line)
+			}
+			b.WriteString(data[i : i+end])
+			i += end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("line %d: unterminated string", line)
+}
+
+// hclInterpolationEnd returns the length of the ${...} at the start of text,
+// or -1 if it is not closed
+func hclInterpolationEnd(text string) int {
+	depth := 0
+	inString := false
+	for i := 2; i < len(text); i++ {
+		switch c := text[i]; {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth == 0 {
+				return i + 1
+			}
+			depth--
+		case c == '\n':
+			return -1
+		}
+	}
+	return -1
+}
+
+// lexHCLHeredoc reads a <<EOT or indented <<-EOT heredoc
+func lexHCLHeredoc(data string, line int) (string, int, error) {
+	header, _, found := strings.Cut(data, "\n")
+	if !found {
+		return "", 0, fmt.Errorf("line %d: unterminated heredoc", line)
+	}
+	marker := strings.TrimSpace(strings.TrimPrefix(header, "<<"))
+	indented := strings.HasPrefix(marker, "-")
+	marker = strings.TrimPrefix(marker, "-")
+	if marker == "" || strings.ContainsAny(marker, " \t\"") {
+		return "", 0, fmt.Errorf("line %d: invalid heredoc marker", line)
+	}
+
+	var lines []string
+	offset := len(header) + 1
+	for offset <= len(data) {
+		end := strings.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			end = len(data) - offset
+		}
+		text := data[offset : offset+end]
+		if strings.TrimSpace(text) == marker {
+			if indented {
+				lines = dedentLines(lines)
+			}
+			value := ""
+			if len(lines) > 0 {
+				value = strings.Join(lines, "\n") + "\n"
+			}
+			return value, offset + end, nil
+		}
+		lines = append(lines, strings.TrimRight(text, "\r"))
+		offset += end + 1
+	}
+	return "", 0, fmt.Errorf("line %d: heredoc %s is not terminated", line, marker)
+}
+
+// dedentLines removes the indentation common to all non-blank lines
+func dedentLines(lines []string) []string {
+	indent := -1
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		n := len(l) - len(strings.TrimLeft(l, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		n := len(l) - len(strings.TrimLeft(l, " \t"))
+		out[i] = l[min(n, max(indent, 0)):]
+	}
+	return out
+}
+
+type hclParser struct {
+	tokens []hclToken
+	pos    int
+}
+
+func (p *hclParser) peek() hclToken {
+	return p.tokens[p.pos]
+}
+
+func (p *hclParser) next() hclToken {
+	t := p.tokens[p.pos]
+	if t.kind != hclEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *hclParser) skipNewlines() {
+	for p.peek().kind == hclNewline {
+		p.pos++
+	}
+}
+
+func (p *hclParser) expect(kind hclTokenKind) (hclToken, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("line %d: unexpected %s", t.line, describeHCLToken(t))
+	}
+	return t, nil
+}
+
+func describeHCLToken(t hclToken) string {
+	switch t.kind {
+	case hclEOF:
+		return "end of file"
+	case hclNewline:
+		return "end of line"
+	case hclString:
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// parseBody parses the attributes of a block up to its closing brace
+func (p *hclParser) parseBody(block *hclBlock) error {
+	for {
+		p.skipNewlines()
+		if p.peek().kind == hclRBrace {
+			p.next()
+			return nil
+		}
+		name, err := p.expect(hclIdent)
+		if err != nil {
+			return err
+		}
+		if p.peek().kind != hclEquals {
+			return fmt.Errorf("line %d: nested block %s is not supported", name.line, name.text)
+		}
+		p.next()
+		if _, dup := block.Attrs[name.text]; dup {
+			return fmt.Errorf("line %d: duplicate attribute %q", name.line, name.text)
+		}
+		value, err := p.parseExpression()
+		if err != nil {
+			return err
+		}
+		block.Attrs[name.text] = value
+		if t := p.peek(); t.kind != hclNewline && t.kind != hclRBrace {
+			return fmt.Errorf("line %d: unexpected %s after attribute %s", t.line, describeHCLToken(t), name.text)
+		}
+	}
+}
+
+// parseExpression parses a single value; operators after it are rejected
+func (p *hclParser) parseExpression() (interface{}, error) {
+	value, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	switch t := p.peek(); t.kind {
+	case hclOther:
+		return nil, fmt.Errorf("line %d: operators and conditionals (%s) are not supported", t.line, t.text)
+	case hclLBracket:
+		return nil, fmt.Errorf("line %d: index expressions ([...]) are not supported", t.line)
+	}
+	return value, nil
+}
+
+func (p *hclParser) parsePrimary() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case hclString:
+		return hclTemplate{Text: t.text, Line: t.line}, nil
+	case hclNumber:
+		return t.text, nil
+	case hclIdent:
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		if next := p.peek(); next.kind == hclLParen {
+			return nil, fmt.Errorf("line %d: function calls such as %s() are not supported", t.line, t.text)
+		} else if next.kind == hclOther && next.text == "." {
+			return nil, fmt.Errorf("line %d: references to attributes such as %s.* are not supported", t.line, t.text)
+		}
+		return hclRef{Name: t.text, Line: t.line}, nil
+	case hclLBracket, hclLBrace:
+		// [for x in list : x] and {for k, v in map : k => v}
+		if next := p.peek(); next.kind == hclIdent && next.text == "for" && p.tokens[p.pos+1].kind == hclIdent {
+			return nil, fmt.Errorf("line %d: for expressions are not supported", t.line)
+		}
+		if t.kind == hclLBracket {
+			return p.parseList()
+		}
+		return p.parseObject()
+	case hclLParen:
+		return nil, fmt.Errorf("line %d: parenthesized expressions are not supported", t.line)
+	case hclOther:
+		return nil, fmt.Errorf("line %d: operators (%s) are not supported", t.line, t.text)
+	}
+	return nil, fmt.Errorf("line %d: unexpected %s", t.line, describeHCLToken(t))
+}
+
+func (p *hclParser) parseList() (interface{}, error) {
+	items := []interface{}{}
+	for {
+		p.skipNewlines()
+		if p.peek().kind == hclRBracket {
+			p.next()
+			return items, nil
+		}
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+		p.skipNewlines()
+		switch t := p.next(); t.kind {
+		case hclComma:
+		case hclRBracket:
+			return items, nil
+		default:
+			return nil, fmt.Errorf("line %d: expected , or ] but found %s", t.line, describeHCLToken(t))
+		}
+	}
+}
+
+func (p *hclParser) parseObject() (interface{}, error) {
+	object := map[string]interface{}{}
+	for {
+		p.skipNewlines()
+		if p.peek().kind == hclRBrace {
+			p.next()
+			return object, nil
+		}
+		key := p.next()
+		if key.kind != hclIdent && key.kind != hclString {
+			return nil, fmt.Errorf("line %d: expected an object key but found %s", key.line, describeHCLToken(key))
+		}
+		if sep := p.next(); sep.kind != hclEquals && sep.kind != hclColon {
+			return nil, fmt.Errorf("line %d: expected = after key %s", sep.line, key.text)
+		}
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		object[key.text] = value
+
+		switch t := p.peek(); t.kind {
+		case hclComma, hclNewline:
+			p.next()
+		case hclRBrace:
+		default:
+			return nil, fmt.Errorf("line %d: expected , or } but found %s", t.line, describeHCLToken(t))
+		}
+	}
+}
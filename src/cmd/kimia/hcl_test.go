@@ -0,0 +1,309 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHCL(t *testing.T) {
+	tests := []struct {
+		name       string
+		hcl        string
+		wantAttrs  map[string]interface{}
+		wantBlocks []hclBlock
+	}{
+		{
+			name:      "top-level attributes",
+			hcl:       "TAG = \"latest\"\nCOUNT = 3\nRATIO = -1.5e3\nDEBUG = true\nOFF = false\nNONE = null\nREF = TAG\n",
+			wantAttrs: map[string]interface{}{"TAG": hclTemplate{Text: "latest", Line: 1}, "COUNT": "3", "RATIO": "-1.5e3", "DEBUG": true, "OFF": false, "NONE": nil, "REF": hclRef{Name: "TAG", Line: 7}},
+		},
+		{
+			name: "blocks with labels",
+			hcl: `variable "TAG" {
+  default = "1.0"
+}
+target "app" {
+  tags = ["registry/app:${TAG}"]
+}
+`,
+			wantAttrs: map[string]interface{}{},
+			wantBlocks: []hclBlock{
+				{Type: "variable", Labels: []string{"TAG"}, Attrs: map[string]interface{}{"default": hclTemplate{Text: "1.0", Line: 2}}, Line: 1},
+				{Type: "target", Labels: []string{"app"}, Attrs: map[string]interface{}{"tags": []interface{}{hclTemplate{Text: "registry/app:${TAG}", Line: 5}}}, Line: 4},
+			},
+		},
+		{
+			name: "string escapes and interpolations",
+			hcl:  `A = "line\n\ttab \"q\" \\ é"` + "\n" + `B = "${lookup("x")} and $${literal}"` + "\n",
+			wantAttrs: map[string]interface{}{
+				"A": hclTemplate{Text: "line\n\ttab \"q\" \\ é", Line: 1},
+				"B": hclTemplate{Text: `${lookup("x")} and $${literal}`, Line: 2},
+			},
+		},
+		{
+			name: "comments",
+			hcl:  "# hash\n// slashes\n/* block\ncomment */ A = 1 # trailing\nB = \"# not a comment\"\n",
+			wantAttrs: map[string]interface{}{
+				"A": "1",
+				"B": hclTemplate{Text: "# not a comment", Line: 5},
+			},
+		},
+		{
+			name: "heredocs",
+			hcl:  "A = <<EOT\nline 1\n  line 2\nEOT\nB = <<-EOT\n    indented\n      more\n    EOT\nC = 1\n",
+			wantAttrs: map[string]interface{}{
+				"A": hclTemplate{Text: "line 1\n  line 2\n", Line: 1},
+				"B": hclTemplate{Text: "indented\n  more\n", Line: 5},
+				"C": "1",
+			},
+		},
+		{
+			name: "lists and objects",
+			hcl: `target "app" {
+  platforms = [
+    "linux/amd64",
+    "linux/arm64",
+  ]
+  args = {
+    VERSION = "1.0"
+    "QUOTED-KEY": 2,
+    NESTED = { A = [1, 2] }
+  }
+  empty = []
+}
+`,
+			wantAttrs: map[string]interface{}{},
+			wantBlocks: []hclBlock{{Type: "target", Labels: []string{"app"}, Line: 1, Attrs: map[string]interface{}{
+				"platforms": []interface{}{hclTemplate{Text: "linux/amd64", Line: 3}, hclTemplate{Text: "linux/arm64", Line: 4}},
+				"args": map[string]interface{}{
+					"VERSION":    hclTemplate{Text: "1.0", Line: 7},
+					"QUOTED-KEY": "2",
+					"NESTED":     map[string]interface{}{"A": []interface{}{"1", "2"}},
+				},
+				"empty": []interface{}{},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attrs, blocks, err := parseHCL(tt.hcl)
+			if err != nil {
+				t.Fatalf("parseHCL() error = %v", err)
+			}
+			if !reflect.DeepEqual(attrs, tt.wantAttrs) {
+				t.Errorf("parseHCL() attrs = %#v, want %#v", attrs, tt.wantAttrs)
+			}
+			if !reflect.DeepEqual(blocks, tt.wantBlocks) {
+				t.Errorf("parseHCL() blocks = %#v, want %#v", blocks, tt.wantBlocks)
+			}
+		})
+	}
+}
+
+func TestParseHCLUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		hcl  string
+		want string // substring of the error
+	}{
+		{"function call", "A = upper(\"x\")\n", "line 1: function calls such as upper() are not supported"},
+		{"attribute reference", "A = target.app.tags\n", "references to attributes such as target.* are not supported"},
+		{"conditional", "A = B ? \"x\" : \"y\"\n", "operators and conditionals (?) are not supported"},
+		{"arithmetic", "A = 1 + 2\n", "operators and conditionals (+) are not supported"},
+		{"comparison", "A = B == \"x\"\n", "operators and conditionals (=) are not supported"},
+		{"unary operator", "A = !B\n", "operators (!) are not supported"},
+		{"index expression", "A = B[0]\n", "index expressions ([...]) are not supported"},
+		{"parentheses", "A = (B)\n", "parenthesized expressions are not supported"},
+		{"for list", "A = [for x in B : x]\n", "for expressions are not supported"},
+		{"for object", "A = {for k, v in B : k => v}\n", "for expressions are not supported"},
+		{"nested block", "target \"a\" {\n  matrix {\n  }\n}\n", "line 2: nested block matrix is not supported"},
+		{"template label", "target \"${A}\" {\n}\n", "block labels cannot be templates"},
+		{"duplicate attribute", "target \"a\" {\n  tags = []\n  tags = []\n}\n", `line 3: duplicate attribute "tags"`},
+		{"two attributes on a line", "target \"a\" {\n  tags = [] context = \".\"\n}\n", "unexpected \"context\" after attribute tags"},
+		{"unterminated string", "A = \"x\n", "line 1: unterminated string"},
+		{"invalid escape", `A = "\q"` + "\n", `invalid escape sequence \q`},
+		{"unterminated interpolation", "A = \"${B\"\n", "unterminated"},
+		{"unterminated heredoc", "A = <<EOT\ntext\n", "heredoc EOT is not terminated"},
+		{"unterminated comment", "/* open\nA = 1\n", "unterminated comment"},
+		{"unterminated block", "target \"a\" {\n  tags = []\n", "unexpected end of file"},
+		{"unterminated list", "A = [1, 2\n", "expected , or ] but found end of file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseHCL(tt.hcl)
+			if err == nil {
+				t.Fatalf("parseHCL() succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseHCL() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// loadBakeFile writes content to a bake file in a temporary directory and
+// loads it
+func loadBakeFile(t *testing.T, name, content string) (*bakeDefinition, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	def := &bakeDefinition{
+		variables: map[string]interface{}{},
+		groups:    map[string]map[string]interface{}{},
+		targets:   map[string]map[string]interface{}{},
+	}
+	return def, def.load(path)
+}
+
+const testBakeFile = `# Variables, groups and inheritance
+variable "TAG" {
+  default = "1.0"
+}
+variable "PUSH" {
+  default = true
+}
+REGISTRY = "registry.io/${OWNER}"
+OWNER = "acme"
+
+group "default" {
+  targets = ["app", "tools"]
+}
+
+target "base" {
+  dockerfile = "Dockerfile"
+  args = {
+    BASE = "alpine"
+    VERSION = "${TAG}"
+  }
+  labels = { "org.opencontainers.image.vendor" = "Acme" }
+}
+
+target "app" {
+  inherits = ["base"]
+  target = "prod"
+  tags = ["${REGISTRY}/app:${TAG}", "${REGISTRY}/app:latest"]
+  args = {
+    VERSION = "v${TAG}"
+    EXTRA = null
+  }
+  push = PUSH
+  note = "literal $${TAG}"
+}
+
+target "tools" {
+  context = "tools"
+  tags = ["${REGISTRY}/tools:${TAG}"]
+}
+`
+
+func TestBakeResolve(t *testing.T) {
+	def, err := loadBakeFile(t, "docker-bake.hcl", testBakeFile)
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	t.Setenv("TAG", "2.0")
+
+	names, err := def.expandTargets(nil)
+	if err != nil {
+		t.Fatalf("expandTargets() error = %v", err)
+	}
+	if want := []string{"app", "tools"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expandTargets() = %v, want %v", names, want)
+	}
+
+	app, err := def.resolveTarget("app", map[string]bool{})
+	if err != nil {
+		t.Fatalf("resolveTarget() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"dockerfile": "Dockerfile",
+		"target":     "prod",
+		"tags":       []interface{}{"registry.io/acme/app:2.0", "registry.io/acme/app:latest"},
+		"args":       map[string]interface{}{"BASE": "alpine", "VERSION": "v2.0", "EXTRA": nil},
+		"labels":     map[string]interface{}{"org.opencontainers.image.vendor": "Acme"},
+		"push":       true,
+		"note":       "literal ${TAG}",
+	}
+	if !reflect.DeepEqual(app, want) {
+		t.Errorf("resolveTarget(app) = %#v, want %#v", app, want)
+	}
+
+	args, err := bakeTargetArgs("app", app)
+	if err != nil {
+		t.Fatalf("bakeTargetArgs() error = %v", err)
+	}
+	for _, arg := range []string{"--dockerfile=Dockerfile", "--target=prod", "--destination=registry.io/acme/app:2.0", "--build-arg=VERSION=v2.0"} {
+		if !containsString(args, arg) {
+			t.Errorf("bakeTargetArgs() = %v, missing %s", args, arg)
+		}
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--build-arg=EXTRA") {
+			t.Errorf("bakeTargetArgs() passes the null build arg: %s", arg)
+		}
+	}
+}
+
+func TestBakeJSON(t *testing.T) {
+	def, err := loadBakeFile(t, "docker-bake.json", `{
+  "variable": {"TAG": {"default": "3.0"}},
+  "group": {"default": {"targets": ["app"]}},
+  "target": {"app": {"tags": ["registry.io/app:${TAG}"], "args": {"N": 1}}}
+}`)
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	app, err := def.resolveTarget("app", map[string]bool{})
+	if err != nil {
+		t.Fatalf("resolveTarget() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"tags": []interface{}{"registry.io/app:3.0"},
+		"args": map[string]interface{}{"N": "1"},
+	}
+	if !reflect.DeepEqual(app, want) {
+		t.Errorf("resolveTarget(app) = %#v, want %#v", app, want)
+	}
+}
+
+func TestBakeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		target  string
+		want    string // substring of the error of load or resolveTarget
+	}{
+		{"user-defined function", "docker-bake.hcl", "function \"tag\" {\n  params = []\n  result = \"x\"\n}\n", "", "user-defined functions are not supported"},
+		{"matrix", "docker-bake.hcl", "target \"a\" {\n  matrix = { v = [\"1\"] }\n}\n", "", "matrix targets are not supported"},
+		{"unknown block", "docker-bake.hcl", "service \"a\" {\n}\n", "", "unknown block type service"},
+		{"unnamed block", "docker-bake.hcl", "target {\n}\n", "", "target block needs exactly one name"},
+		{"unknown JSON block", "docker-bake.json", `{"service": {"a": {}}}`, "", "unknown block type service"},
+		{"function in an interpolation", "docker-bake.hcl", "target \"a\" {\n  tags = [\"${upper(TAG)}\"]\n}\n", "a", "only variable references are supported"},
+		{"template directive", "docker-bake.hcl", "target \"a\" {\n  tags = [\"%{ if true }x%{ endif }\"]\n}\n", "a", "template directives (%{...}) are not supported"},
+		{"unknown variable", "docker-bake.hcl", "target \"a\" {\n  tags = [\"${MISSING}\"]\n}\n", "a", "line 2: unknown variable MISSING"},
+		{"variable cycle", "docker-bake.hcl", "A = B\nB = A\ntarget \"a\" {\n  tags = [A]\n}\n", "a", "refers to itself"},
+		{"inheritance cycle", "docker-bake.hcl", "target \"a\" {\n  inherits = [\"b\"]\n}\ntarget \"b\" {\n  inherits = [\"a\"]\n}\n", "a", "inherits from itself"},
+		{"unknown parent", "docker-bake.hcl", "target \"a\" {\n  inherits = [\"b\"]\n}\n", "a", "unknown target b"},
+		{"list in a string", "docker-bake.hcl", "L = [\"x\"]\ntarget \"a\" {\n  tags = [\"t:${L}\"]\n}\n", "a", "cannot use a list or object in a string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			def, err := loadBakeFile(t, tt.file, tt.content)
+			if err == nil && tt.target != "" {
+				_, err = def.resolveTarget(tt.target, map[string]bool{})
+			}
+			if err == nil {
+				t.Fatalf("want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/internal/preflight"
+)
+
+// runHealthz implements `kimia healthz`, a quiet check for Kubernetes
+// liveness and readiness probes: it prints "ok" and exits 0 when the builder
+// can run, and prints the failed checks and exits 1 otherwise
+func runHealthz(args []string) int {
+	serve := false
+	storageDir := ""
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		}
+		switch flag {
+		case "--serve":
+			serve = value == "" || parseBool(value)
+		case "--storage-dir":
+			if value == "" && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			storageDir = value
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	config := parseArgs(rest)
+	if err := applyBuilderDefaults(config); err != nil {
+		fmt.Fprintf(os.Stderr, "healthz: %v\n", err)
+		return 1
+	}
+
+	builder := build.DetectBuilderFor(config.Builder, config.BuildkitAddr, config.BuildahRemote)
+	if builder == "unknown" {
+		// Report the missing binaries of the builder that was asked for
+		switch {
+		case config.BuildkitAddr != "":
+			builder = "buildkit"
+		case config.BuildahRemote != "":
+			builder = "buildah"
+		case config.Builder != "":
+			builder = config.Builder
+		default:
+			fmt.Fprintln(os.Stderr, "healthz: builder: no builder found (expected buildkitd or buildah)")
+			return 1
+		}
+	}
+
+	checks := preflight.RunHealthChecks(preflight.HealthConfig{
+		Builder:    builder,
+		Remote:     config.BuildkitAddr != "" || config.BuildahRemote != "",
+		StorageDir: storageDir,
+		// An external buildkitd is the builder, so it is always checked
+		Daemon: serve || config.BuildkitAddr != "",
+		Buildkit: build.Config{
+			BuildkitAddr:          config.BuildkitAddr,
+			BuildkitTLSCACert:     config.BuildkitTLSCACert,
+			BuildkitTLSCert:       config.BuildkitTLSCert,
+			BuildkitTLSKey:        config.BuildkitTLSKey,
+			BuildkitTLSServerName: config.BuildkitTLSServerName,
+		},
+	})
+	healthy := true
+	for _, check := range checks {
+		if check.Err != nil {
+			fmt.Fprintf(os.Stderr, "healthz: %s: %v\n", check.Name, check.Err)
+			healthy = false
+		}
+	}
+	if !healthy {
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
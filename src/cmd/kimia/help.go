@@ -16,29 +16,92 @@ func printHelp() {
 	fmt.Println()
 	fmt.Println("USAGE:")
 	fmt.Println("  kimia --context=<path|url> --destination=<image:tag> [options]")
-	fmt.Println("  kimia check-environment               # Validate build environment")
+	fmt.Println("  kimia check-environment [--builder=B] # Validate build environment")
+	fmt.Println("  kimia plan --context=<path> [options] # Preview stages, base digests and secrets")
+	fmt.Println("  kimia healthz [--serve]               # Quick builder health check for liveness/readiness probes")
+	fmt.Println("  kimia audit-security                  # Audit runtime for container escape risks")
+	fmt.Println("  kimia rebuild-if-base-changed --metadata=prev.json [options]")
+	fmt.Println("                                        # Rebuild only when a base image digest changed")
+	fmt.Println("  kimia package --base=IMAGE --copy SRC:DEST [--entrypoint CMD] [options]")
+	fmt.Println("                                        # Wrap local files in a base image without a Dockerfile")
+	fmt.Println("  kimia verify IMAGE [options]          # Report signatures, SBOMs and provenance attached to IMAGE")
+	fmt.Println("  kimia inspect IMAGE [--json]          # Show manifest, config, layers and artifacts of IMAGE")
+	fmt.Println("  kimia copy --src=IMAGE --dst=IMAGE    # Copy or retag an image between registries without rebuilding")
+	fmt.Println("  kimia push-artifact --type=TYPE --file=FILE --destination=REF [--sign]")
+	fmt.Println("                                        # Push a WASM module, Helm chart or other OCI artifact")
+	fmt.Println("  kimia cache save|restore --ref=REF    # Snapshot builder storage to a registry, or restore it")
+	fmt.Println("  kimia builds [ID] [--json]            # List the builds running in this container")
+	fmt.Println("  kimia logs ID [--follow]              # Print the output of a running build")
+	fmt.Println("  kimia cancel ID                       # Cancel a running build")
+	fmt.Println("  kimia generate ci --format=tekton|argo|github [--unconfined] --context=. --destination=REF [options]")
+	fmt.Println("                                        # Print a Tekton Task, Argo WorkflowTemplate or GitHub workflow for the build")
+	fmt.Println("  kimia client --pod=POD [-n NS] [-c CONTAINER] --context=. --destination=REF [options]")
+	fmt.Println("                                        # Build a local context in a builder pod through kubectl exec")
+	fmt.Println("  kimia history [ID] [--context=DIR] [--json]")
+	fmt.Println("                                        # List past builds: inputs, digests, duration and cache use")
+	fmt.Println("  kimia buildkit-certs --output DIR --server-name NAME")
+	fmt.Println("                                        # Create mTLS certificates for a tcp:// buildkitd")
+	fmt.Println("  kimia batch --spec=builds.yaml [--parallel=N] [--fail-fast] [--storage-root=DIR] [options]")
+	fmt.Println("                                        # Run several builds sharing auth and buildkitd")
+	fmt.Println("  kimia bake [-f docker-bake.hcl] [--set target.key=value] [--print] [TARGET...]")
+	fmt.Println("                                        # Build the targets of docker buildx bake files")
 	fmt.Println("  kimia --help                          # Show this help")
 	fmt.Println("  kimia --version                       # Show version info")
 	fmt.Println()
 	fmt.Println("CORE OPTIONS:")
 	fmt.Println("  -c, --context PATH                    Build context directory or Git URL")
 	fmt.Println("  --context-sub-path PATH               Sub-directory within build context")
-	fmt.Println("  -f, --dockerfile PATH                 Path to Dockerfile (default: Dockerfile)")
+	fmt.Println("  -f, --dockerfile PATH                 Path to Dockerfile, may be outside the context (default: Dockerfile, else Containerfile)")
+	fmt.Println("                                        or - to read it from stdin")
+	fmt.Println("  --dockerfile-content TEXT             Dockerfile given inline instead of a file")
 	fmt.Println("  -d, --destination IMAGE               Destination image with tag (repeatable)")
-	fmt.Println("  -t, --target STAGE                    Target stage in multi-stage Dockerfile")
+	fmt.Println("                                        or target=STAGE,image=IMAGE to tag a --target stage")
+	fmt.Println("  --tag-template TEMPLATE               Compute each destination from a Go template (repeatable),")
+	fmt.Println("                                        e.g. '{{.Image}}:{{.GitShortSHA}}-{{.Date}}'")
+	fmt.Println("  -t, --target STAGE                    Target stage in multi-stage Dockerfile (repeatable)")
+	fmt.Println("  --chain dockerfile=FILE[,target=STAGE][,name=NAME]")
+	fmt.Println("                                        Build FILE after the primary build, with the image as")
+	fmt.Println("                                        the named context primary (or NAME); repeatable")
+	fmt.Println("  --ignore-file PATH                    Ignore file to use instead of .dockerignore")
+	fmt.Println("  --show-ignored                        List excluded context files and the final context size")
+	fmt.Println("  --max-context-size SIZE               Fail when the context after ignore rules exceeds SIZE")
+	fmt.Println("  --context-size-warning SIZE           Warn when the context after ignore rules exceeds SIZE")
 	fmt.Println()
 	fmt.Println("BUILD OPTIONS:")
-	fmt.Println("  --build-arg KEY=VALUE                 Build-time variables (repeatable)")
-	fmt.Println("  --label KEY=VALUE                     Image metadata labels (repeatable)")
+	fmt.Println("  --build-arg KEY=VALUE                 Build-time variables (repeatable); KEY alone reads the env var KEY")
+	fmt.Println("  --env-allowlist PATTERNS              Env vars build args, secrets and templates may read (e.g. 'CI_*,HTTP_PROXY')")
+	fmt.Println("  --build-arg-file FILE                 Read build args from a dotenv or .json file (repeatable)")
+	fmt.Println("  --build-arg-from-secret NAME=PATH     Pass a mounted Secret file as build secret NAME (repeatable)")
+	fmt.Println("  --secret-from-env id=ID,env=VAR       Pass an environment variable as a build secret (repeatable)")
+	fmt.Println("  --label KEY=VALUE                     Image metadata labels (repeatable); VALUE may be a template: {{.Env.CI_JOB_URL}}")
+	fmt.Println("  --label-template-strict               Fail when a label template uses an unset variable")
 	fmt.Println("  --no-push                             Build only, skip push")
 	fmt.Println("  --cache                               Enable layer caching")
+	fmt.Println("  --pull[=POLICY]                       Base image pull policy: always|missing|never (bare: always)")
+	fmt.Println("  --offline                             Pull nothing; take base images from --image-store")
+	fmt.Println("  --image-store STORE                   OCI layout directory, or containerd[://NAMESPACE], holding the base images")
+	fmt.Println("  --network MODE                        Network of RUN steps: host (default), none or slirp4netns")
+	fmt.Println("  --add-host HOST:IP                    Add an /etc/hosts entry for RUN steps (repeatable)")
+	fmt.Println("  --dns IP                              DNS server for RUN steps (repeatable)")
+	fmt.Println("  --dns-search DOMAIN                   DNS search domain for RUN steps (repeatable)")
+	fmt.Println("  --allow-privileged-steps              Confirm --allow, --device and --cap-add for RUN steps")
+	fmt.Println("  --allow ENTITLEMENT                   BuildKit entitlement: security.insecure or network.host (repeatable)")
+	fmt.Println("  --device PATH[:PATH[:PERMS]]          Pass a device to Buildah RUN steps, e.g. /dev/fuse (repeatable)")
+	fmt.Println("  --cap-add CAP                         Add a capability to Buildah RUN steps (repeatable)")
 	fmt.Println("  --cache-dir PATH                      Cache directory path")
+	fmt.Println("  --cache-repo REPO                     Share layer cache through a registry repository")
+	fmt.Println("  --base-image-rewrite PATTERN=REPL     Rewrite FROM images, e.g. docker.io/*=mirror.corp/proxy/* (repeatable)")
+	fmt.Println("  --max-layer-size SIZE                 Fail when a layer exceeds SIZE (e.g. 10GB, 512MiB)")
+	fmt.Println("  --max-image-size SIZE                 Fail when the image's layers together exceed SIZE")
+	fmt.Println("  --split-large-layers                  Split oversized COPY layers instead of failing")
+	fmt.Println("  --squash                              Flatten all layers into one (Buildah only)")
+	fmt.Println("  --squash-new                          Flatten only the layers this build adds (Buildah only)")
 	if build.DetectBuilder() == "buildah" {
 			fmt.Println("BUILDAH OPTIONS:")
 			fmt.Println("  --buildah-opt \"FLAG [VALUE]\"          Pass additional flags to buildah bud (Buildah only, repeatable)")
 			fmt.Println("                                        Values cannot contain shell metacharacters")
 			fmt.Println("                                        (;, &, |, etc.).")
-			fmt.Println("                                        Example: --buildah-opt \"--squash\"")
+			fmt.Println("                                        Example: --buildah-opt \"--omit-history\"")
 			fmt.Println()
 		}
 	if build.DetectBuilder() == "buildkit" {
@@ -51,8 +114,28 @@ func printHelp() {
 		fmt.Println("                                        Examples:")
 		fmt.Println("                                          type=registry,ref=registry.io/cache:latest")
 		fmt.Println("                                          type=local,src=/tmp/cache")
+		fmt.Println("  --cache-export-dir DIR                Export build cache to a local directory (e.g. a PVC)")
+		fmt.Println("  --cache-import-dir DIR                Import build cache from a local directory")
+		fmt.Println("  --cache-inline                        Embed cache metadata in the pushed image (type=inline)")
+		fmt.Println("  --reuse-daemon                        Reuse a running buildkitd and keep a started one running")
+		fmt.Println("  --buildkitd-config-fragment PATH      TOML file, directory or glob merged into buildkitd.toml (repeatable)")
+		fmt.Println("  --buildkit-addr ADDR                  Use an external buildkitd (default: $BUILDKIT_HOST),")
+		fmt.Println("                                        e.g. tcp://buildkitd:1234 or unix:///run/buildkit/buildkitd.sock")
+		fmt.Println("  --builder-endpoint PLATFORM=ADDR      Build PLATFORM on the buildkitd at ADDR and merge the platforms")
+		fmt.Println("                                        into one index (repeatable)")
+		fmt.Println("  --buildkit-tls-ca PATH                CA certificate of the external buildkitd (tcp://)")
+		fmt.Println("  --buildkit-tls-cert PATH              Client certificate for mTLS (with --buildkit-tls-key)")
+		fmt.Println("  --buildkit-tls-key PATH               Client key for mTLS")
+		fmt.Println("  --buildkit-tls-dir DIR                Directory with ca.pem, cert.pem and key.pem (as buildctl --tlsdir)")
+		fmt.Println("  --buildkit-tls-server-name NAME       Server name to verify the buildkitd certificate against")
 	}
-	fmt.Println("  --custom-platform PLATFORM            Target platform (e.g., linux/amd64)")
+	fmt.Println("  --custom-platform PLATFORM            Target platform (e.g., linux/amd64; BuildKit: comma-separated list; auto = the node's, the default)")
+	fmt.Println("  --register-binfmt                     Register missing QEMU binfmt_misc handlers for foreign platforms (privileged pods)")
+	fmt.Println("  --builder BUILDER                     Builder to use: auto, buildkit, buildah or buildpacks (default: auto,")
+	fmt.Println("                                        BuildKit when both are installed)")
+	fmt.Println("  --run-image IMAGE                     Run image of --builder=buildpacks builds (default: the builder image's)")
+	fmt.Println("  --buildah-remote[=URL]                Build with Buildah through a Podman service (default:")
+	fmt.Println("                                        $CONTAINER_HOST or unix:///run/podman/podman.sock)")
 	if build.DetectBuilder() == "buildah" {
 		fmt.Println("  --storage-driver DRIVER               Storage driver: vfs or overlay (default: vfs)")
 	} else {
@@ -68,9 +151,14 @@ func printHelp() {
 	fmt.Println("  --timestamp EPOCH                     Custom timestamp (Unix epoch seconds)")
 	fmt.Println("                                        - Auto-enables reproducible builds")
 	fmt.Println("                                        - Overrides SOURCE_DATE_EPOCH env var")
-	fmt.Println("                                        Example: --timestamp=$(date +%s)")
+	fmt.Printf("                                        Example: --timestamp=$(date +%%s)\n")
 	fmt.Println("                                                 --timestamp=1609459200")
-	fmt.Println("                                                 --timestamp=$(git log -1 --format=%ct)")
+	fmt.Printf("                                                 --timestamp=$(git log -1 --format=%%ct)\n")
+	fmt.Println("  --normalize-context                   Normalize the build context before building")
+	fmt.Println("                                        - Owner of the build user (root when rootless)")
+	fmt.Println("                                        - Modes 0644, or 0755 for directories and executables")
+	fmt.Println("                                        - Modification times clamped to the timestamp")
+	fmt.Println("  --context-chown UID:GID               Owner of the normalized context (implies --normalize-context)")
 	fmt.Println()
 	if build.DetectBuilder() == "buildkit" {
 		fmt.Println("ATTESTATION & SIGNING:")
@@ -102,8 +190,14 @@ func printHelp() {
 		fmt.Println()
 		fmt.Println("Signing:")
 		fmt.Println("  --sign                                Sign images with cosign after build")
-		fmt.Println("  --cosign-key PATH                     Path to cosign private key")
+		fmt.Println("  --cosign-key PATH                     Path to cosign private key (default: cosign.key in the secret path)")
+		fmt.Println("  --cosign-key-secret-path DIR          Mounted Kubernetes Secret with cosign.key and cosign.password")
+		fmt.Println("                                        (default: /etc/cosign)")
+		fmt.Println("  --cosign-password-file PATH           File containing the key password (default: cosign.password in")
+		fmt.Println("                                        the secret path when the password variable is not set)")
 		fmt.Println("  --cosign-password-env VAR             Environment variable containing password")
+		fmt.Println("  --attestation-repo [IMAGE_REPO=]REPO  Store signatures and attestations in REPO, for every")
+		fmt.Println("                                        destination or those in IMAGE_REPO (repeatable)")
 		fmt.Println()
 		fmt.Println("Examples:")
 		fmt.Println("  # Simple: Provenance only")
@@ -129,14 +223,40 @@ func printHelp() {
 	fmt.Println("  --git-branch BRANCH                   Git branch to checkout")
 	fmt.Println("  --git-revision SHA                    Git commit SHA to checkout")
 	fmt.Println("  --git-token-file PATH                 File containing Git token")
-	fmt.Println("  --git-token-user USER                 Git auth username (default: oauth2)")
+	fmt.Println("  --git-token-user USER                 Git auth username (default: per provider)")
+	fmt.Println("  --git-ssh-key-file PATH               SSH deploy key for ssh:// and git@ URLs")
+	fmt.Println("  --git-depth N                         Fetch only the last N commits")
+	fmt.Println("  --git-filter SPEC                     Partial clone filter (e.g., blob:none)")
+	fmt.Println("  --git-sparse-path DIR                 Check out only DIR (repeatable)")
+	fmt.Println("  --source-info-file PATH               Write the resolved commit, URL and ref as JSON")
 	fmt.Println()
 	fmt.Println("REGISTRY OPTIONS:")
 	fmt.Println("  --insecure                            Allow insecure connections")
 	fmt.Println("  --insecure-registry REGISTRY          Specific insecure registry (repeatable)")
 	fmt.Println("  --push-retry N                        Push retry attempts (default: 1)")
+	fmt.Println("  --push-jobs N                         Layers uploaded at the same time (Buildah, promotion, cache save)")
+	fmt.Println("  --push-chunk-size SIZE                Upload chunk size of kimia's own uploads (e.g. 64MiB)")
+	fmt.Println("  --push-backend builder|native         Push with buildah (default) or kimia's registry client")
+	fmt.Println("  --compression ALGORITHM               Layer compression: gzip (default), auto, zstd, estargz (BuildKit)")
+	fmt.Println("  --compression-level N                 Compression level (gzip/estargz 1-9, zstd 1-22)")
+	fmt.Println("  --build-timeout DURATION              Stop the build after DURATION (e.g. 45m)")
+	fmt.Println("  --push-timeout DURATION               Stop the push after DURATION (e.g. 10m)")
 	fmt.Println("  --image-download-retry N              Image pull retry attempts during build")
+	fmt.Println("  --retry-transient[=N]                 Retry builds failing on DNS/TLS/5xx network errors (default N: 2)")
 	fmt.Println("  --registry-certificate PATH           Registry certificate directory")
+	fmt.Println("  --ca-bundle PATH                      Extra CA certificates (PEM) for registries, git, cosign and BuildKit")
+	fmt.Println("  --registry-config host=HOST,...       Per-registry TLS: insecure=true, ca=FILE, client-cert=FILE, client-key=FILE (repeatable)")
+	fmt.Println("  --pin-registry-cert                   Pin destination registry certificates on first use")
+	fmt.Println("  --registry-pin-file PATH              Pin state file (default: $HOME/.kimia/registry-pins.json)")
+	fmt.Println("  --check-push-access                   Check push permission on every destination before building")
+	fmt.Println("  --no-ci-auth                          Ignore registry credentials from CI variables (DOCKER_AUTH_CONFIG, CI_REGISTRY_*, GITHUB_TOKEN)")
+	fmt.Println()
+	fmt.Println("USER NAMESPACE ISOLATION:")
+	fmt.Println("  --userns-range START:COUNT            Subordinate UID/GID range assigned to this build")
+	fmt.Println("  --userns-range-file PATH              Allocate a disjoint range from a node-shared file")
+	fmt.Println("  --userns-range-size N                 IDs per allocated range (default: 65536)")
+	fmt.Println("  --userns-uid-map C:H:N[,...]          Explicit UID mapping container:host:size (repeatable)")
+	fmt.Println("  --userns-gid-map C:H:N[,...]          Explicit GID mapping (default: the UID mapping)")
 	fmt.Println()
 	fmt.Println("AUTHENTICATION:")
 	fmt.Println("  Kimia uses standard Docker config.json for registry authentication.")
@@ -153,13 +273,62 @@ func printHelp() {
 	fmt.Println("    3. Custom location:       Set DOCKER_CONFIG env var")
 	fmt.Println()
 	fmt.Println("OUTPUT OPTIONS:")
-	fmt.Println("  --tar-path PATH                       Export image to tar archive")
+	fmt.Println("  --tar-path PATH                       Export image to tar archive (also pushes unless --no-push)")
+	fmt.Println("  --load[=RUNTIME]                      Import the image into the node's containerd (k8s.io namespace)")
+	fmt.Println("                                        or docker instead of pushing: auto, containerd or docker")
 	fmt.Println("  --digest-file PATH                    Save image digest to file")
 	fmt.Println("  --image-name-with-digest-file PATH    Save image name with digest")
+	fmt.Println("  --digest-map-file PATH                Save the digest of every destination as a JSON map")
+	fmt.Println("  --attach type=T,file=PATH             Attach a file to the pushed image as an OCI referrer (repeatable)")
+	fmt.Println("  --attestation-repo [IMAGE_REPO=]REPO  Store signatures, attestations and attachments in REPO (repeatable)")
+	fmt.Println("  --test-cmd CMD                        Run CMD (or a JSON array) in the built image; push only if")
+	fmt.Println("                                        it succeeds (BuildKit: with --staging-destination)")
+	fmt.Println("  --verify-push                         Read pushed images back from the registry and fail unless")
+	fmt.Println("                                        digest, size and platforms match the build")
+	fmt.Println("  --staging-destination REF             Push to REF first, then promote to the destinations")
+	fmt.Println("                                        registry-side (mounting blobs, no re-upload)")
+	fmt.Println("  --promote-require KINDS               Artifacts the staged image must carry before promotion")
+	fmt.Println("                                        (signature, sbom, provenance, vex, attestation)")
+	fmt.Println("  --promote-webhook URL                 POST the staged image to URL; promote only on a 2xx reply")
+	fmt.Println("  --post-build-hook PATH                Run PATH after the build (IMAGE_DIGEST, DESTINATIONS, METADATA_FILE)")
+	fmt.Println("  --pre-push-hook PATH                  Run PATH before the push (Buildah)")
+	fmt.Println("  --post-push-hook PATH                 Run PATH after the push")
+	fmt.Println("  --hook-failure MODE                   A failing hook: abort (default) fails the build, warn continues")
+	fmt.Println("  --notify-url URL                      POST the result of the build to URL when it finishes or fails")
+	fmt.Println("  --notify-format FORMAT                Notification payload: generic-json (default), cloudevents or slack")
+	fmt.Println("  --notify-secret-file PATH             Sign notifications with this HMAC key (default: $KIMIA_NOTIFY_SECRET)")
+	fmt.Println("  --scan-webhook URL                    POST the staged image and its SBOM to a scanner and fail the build")
+	fmt.Println("                                        when its verdict is block (requires --staging-destination)")
+	fmt.Println("  --scan-webhook-timeout DURATION       Time to wait for the scanner's verdict (default: 10m)")
+	fmt.Println("  --scan-webhook-secret-file PATH       Sign scan requests with this HMAC key (default: $KIMIA_SCAN_WEBHOOK_SECRET)")
 	fmt.Println()
 	fmt.Println("LOGGING:")
 	fmt.Println("  -v, --verbosity LEVEL                 Log level: debug|info|warn|error")
 	fmt.Println("  --log-timestamp                       Add timestamps to log output")
+	fmt.Println("  --dry-run                             Print the resolved builder commands and configs, do not build")
+	fmt.Println("  --events-file PATH                    Append build events (e.g. per-stage timing) as JSON lines")
+	fmt.Println("  --heartbeat-interval DURATION         Log a heartbeat when build, export or push is quiet this long (e.g. 5m)")
+	fmt.Println("  --debug-on-failure                    Keep the state of a failed step and open or print a debug shell")
+	fmt.Println("  --debug-hold DURATION                 Keep a failed build's pod running this long for debugging (default: 30m)")
+	fmt.Println("  --explain-cache                       Report why each step hit or missed the cache")
+	fmt.Println("  --explain-cache-file PATH             Inputs of previous builds (default: ~/.kimia/cache-explain.json)")
+	fmt.Println("  --history-file PATH                   Build history file (default: ~/.kimia/history.json)")
+	fmt.Println("  --no-history                          Do not record the build in the history")
+	fmt.Println("  --skip-unchanged                      Tag the image of the last build with the same inputs instead of building")
+	fmt.Println("  --sbom-diff                           Print and attach the package changes since the previous build's SBOM")
+	fmt.Println()
+	fmt.Println("PLAN OPTIONS:")
+	fmt.Println("  --offline                             Skip base image digest lookups")
+	fmt.Println()
+	fmt.Println("REBUILD OPTIONS:")
+	fmt.Println("  --metadata FILE                       Previous build metadata or SLSA provenance; updated after rebuild")
+	fmt.Println("  --result-file FILE                    Write \"rebuilt\" or \"no-change\" to FILE")
+	fmt.Println()
+	fmt.Println("VERIFY OPTIONS:")
+	fmt.Println("  --require KINDS                       Fail unless these are attached (signature,sbom,provenance,vex,attestation)")
+	fmt.Println("  --cosign-key PATH                     Verify signatures with this cosign public key")
+	fmt.Println("  --policy FILE                         Allowed signers, required attestations and max age (YAML)")
+	fmt.Println("  --attestation-repo REPO               Also look for artifacts in the repository they were stored in")
 	fmt.Println()
 	fmt.Println("OTHER:")
 	fmt.Println("  --version                             Show version information")
@@ -230,7 +399,7 @@ func printHelp() {
 	fmt.Println("         --timestamp=1609459200")
 	fmt.Println()
 	fmt.Println("  # CI/CD: Reproducible build with git commit timestamp")
-	fmt.Println("  export SOURCE_DATE_EPOCH=$(git log -1 --format=%ct)")
+	fmt.Printf("  export SOURCE_DATE_EPOCH=$(git log -1 --format=%%ct)\n")
 	fmt.Println("  kimia --context=. \\")
 	fmt.Println("         --destination=registry.io/myapp:v1 \\")
 	fmt.Println("         --reproducible")
@@ -325,15 +494,21 @@ func printHelp() {
 	fmt.Println("  SOURCE_DATE_EPOCH   - Timestamp for reproducible builds (Unix epoch)")
 	fmt.Println("  STORAGE_DRIVER      - Override storage driver (vfs/native or overlay)")
 	fmt.Println("  BUILDAH_FORMAT      - Image format (oci or docker)")
+	fmt.Println("  KIMIA_PLATFORM      - Override platform detection for check-environment hints")
+	fmt.Println("                        (openshift, eks, gke, gke-autopilot, kubernetes, docker, containerd)")
 	fmt.Println("")
 	fmt.Println("  Authentication (in order of precedence):")
 	fmt.Println("  DOCKER_CONFIG       - Docker config directory (default: /home/kimia/.docker)")
 	fmt.Println("  DOCKER_USERNAME     - Username for registry (creates config.json if missing)")
 	fmt.Println("  DOCKER_PASSWORD     - Password for registry (creates config.json if missing)")
 	fmt.Println("  DOCKER_REGISTRY     - Registry URL (optional, auto-detected from --destination)")
+	fmt.Println("  DOCKER_AUTH_CONFIG  - Docker config JSON provided by GitLab CI")
+	fmt.Println("  CI_REGISTRY_USER    - GitLab CI job credentials for CI_REGISTRY (with CI_REGISTRY_PASSWORD)")
+	fmt.Println("  GITHUB_TOKEN        - GitHub Actions token, used for ghcr.io as GITHUB_ACTOR")
 	fmt.Println("")
 	fmt.Println("  Note: If DOCKER_USERNAME/PASSWORD are set but no config.json exists,")
 	fmt.Println("        Kimia automatically creates config.json with auth for the destination registry.")
+	fmt.Println("        CI variables are added to it unless --no-ci-auth is given.")
 	fmt.Println()
 	printVersionInfo()
 	fmt.Println()
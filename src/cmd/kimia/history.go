@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runHistory implements `kimia history [ID]`: list the builds recorded in the
+// history file, newest first, or print one build in full
+func runHistory(args []string) int {
+	logger.Setup("", false)
+	usage := "Usage: kimia history [ID] [--history-file=PATH] [--context=DIR|URL] [--destination=REF] [--failed] [--limit=N] [--json]"
+
+	file := build.DefaultHistoryFile()
+	var id, context, destination string
+	failedOnly, asJSON := false, false
+	limit := 20
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		} else if flag != "--failed" && flag != "--json" && strings.HasPrefix(flag, "--") && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		switch flag {
+		case "--history-file":
+			file = value
+		case "--context":
+			context = value
+		case "--destination":
+			destination = value
+		case "--failed":
+			failedOnly = true
+		case "--json":
+			asJSON = true
+		case "--limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				logger.Error("Invalid --limit %q (expected a number, 0 for all builds)", value)
+				return 1
+			}
+			limit = n
+		default:
+			if strings.HasPrefix(flag, "-") || id != "" {
+				logger.Error("Unknown option: %s", flag)
+				logger.Error("%s", usage)
+				return 1
+			}
+			id = flag
+		}
+	}
+
+	records, err := build.ReadHistory(file)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	if id != "" {
+		for _, record := range records {
+			if record.ID == id {
+				return printJSON(record)
+			}
+		}
+		logger.Error("No build %s in %s", id, file)
+		return 1
+	}
+
+	if context != "" && !strings.Contains(context, "://") && !strings.HasPrefix(context, "git@") {
+		if abs, err := filepath.Abs(context); err == nil {
+			context = abs
+		}
+	}
+	var matched []build.BuildRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if failedOnly && record.Succeeded {
+			continue
+		}
+		if context != "" && record.Inputs.Context != context && !strings.HasPrefix(record.Inputs.Context, context+"#") {
+			continue
+		}
+		if destination != "" && !containsString(record.Destinations, destination) {
+			continue
+		}
+		matched = append(matched, record)
+		if limit > 0 && len(matched) == limit {
+			break
+		}
+	}
+
+	if asJSON {
+		if matched == nil {
+			matched = []build.BuildRecord{}
+		}
+		return printJSON(matched)
+	}
+	if len(matched) == 0 {
+		fmt.Printf("No builds recorded in %s\n", file)
+		return 0
+	}
+	fmt.Printf("%-12s  %-20s  %-7s  %9s  %7s  %-19s  %s\n", "ID", "STARTED", "RESULT", "DURATION", "CACHED", "DIGEST", "DESTINATION")
+	for _, record := range matched {
+		result := "ok"
+		switch {
+		case !record.Succeeded:
+			result = "failed"
+		case record.ReusedFrom != "":
+			result = "reused"
+		}
+		cached := "-"
+		if record.Steps > 0 {
+			cached = fmt.Sprintf("%d/%d", record.CachedSteps, record.Steps)
+		}
+		destination, digest := "-", "-"
+		if len(record.Destinations) > 0 {
+			destination = record.Destinations[0]
+			if len(record.Destinations) > 1 {
+				destination += fmt.Sprintf(" (+%d)", len(record.Destinations)-1)
+			}
+			if d := record.Digests[record.Destinations[0]]; d != "" {
+				digest = truncateDigest(d)
+			}
+		}
+		duration := time.Duration(record.Seconds * float64(time.Second)).Round(time.Second).String()
+		fmt.Printf("%-12s  %-20s  %-7s  %9s  %7s  %-19s  %s\n", record.ID, record.Started.Local().Format("2006-01-02 15:04:05"), result, duration, cached, digest, destination)
+	}
+	return 0
+}
+
+// truncateDigest shortens sha256:... to the first 12 hex digits
+func truncateDigest(digest string) string {
+	if len(digest) > len("sha256:")+12 {
+		return digest[:len("sha256:")+12]
+	}
+	return digest
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/build"
+)
+
+// maxInlineDockerfile bounds a Dockerfile read from stdin
+const maxInlineDockerfile = 4 << 20
+
+// resolveInlineDockerfile reads the Dockerfile from stdin for --dockerfile=-
+// and checks that --dockerfile-content is not combined with another Dockerfile
+func resolveInlineDockerfile(config *Config, stdin io.Reader) error {
+	if config.Dockerfile != build.InlineDockerfile {
+		if config.DockerfileContent != "" && config.Dockerfile != "" {
+			return fmt.Errorf("--dockerfile-content cannot be used with --dockerfile %s", config.Dockerfile)
+		}
+		return nil
+	}
+	if config.DockerfileContent != "" {
+		return fmt.Errorf("--dockerfile=- reads the Dockerfile from stdin and cannot be used with --dockerfile-content")
+	}
+	content, err := io.ReadAll(io.LimitReader(stdin, maxInlineDockerfile+1))
+	if err != nil {
+		return fmt.Errorf("failed to read the Dockerfile from stdin: %v", err)
+	}
+	if len(content) > maxInlineDockerfile {
+		return fmt.Errorf("the Dockerfile read from stdin exceeds %d MiB", maxInlineDockerfile>>20)
+	}
+	if strings.TrimSpace(string(content)) == "" {
+		return fmt.Errorf("--dockerfile=- read an empty Dockerfile from stdin")
+	}
+	config.Dockerfile, config.DockerfileContent = "", string(content)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runInspect implements `kimia inspect IMAGE`: print the manifest, config,
+// layers, platforms and attached artifacts of an image as its registry holds
+// them, with the same registry credentials and TLS settings as a build.
+func runInspect(args []string) int {
+	var image string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		image, args = args[0], args[1:]
+	}
+	asJSON := false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--json":
+			asJSON = true
+		case args[i] == "--platform" && i+1 < len(args):
+			i++
+			rest = append(rest, "--custom-platform="+args[i])
+		case strings.HasPrefix(args[i], "--platform="):
+			rest = append(rest, "--custom-platform="+strings.TrimPrefix(args[i], "--platform="))
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	config := parseArgs(rest)
+	verbosity := config.Verbosity
+	if asJSON && verbosity != "debug" {
+		// Keep stdout for the JSON document
+		verbosity = "warn"
+	}
+	logger.Setup(verbosity, config.LogTimestamp)
+
+	if image == "" && len(config.Destination) > 0 {
+		image = config.Destination[0]
+	}
+	if image == "" {
+		logger.Error("Usage: kimia inspect IMAGE [--platform=linux/amd64] [--json]")
+		return 1
+	}
+
+	removeCABundle, err := installCABundle(config)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(config); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	// Credentials from DOCKER_USERNAME/DOCKER_PASSWORD are needed for private images
+	if err := auth.Setup(auth.SetupConfig{Destinations: []string{image}, InsecureRegistry: config.InsecureRegistry, NoCIAuth: config.NoCIAuth}); err != nil {
+		logger.Warning("Authentication setup failed: %v", err)
+	}
+
+	platform := config.CustomPlatform
+	if platform == build.PlatformAuto {
+		platform = build.NodePlatform()
+	}
+	inspection, err := build.InspectImage(build.InspectConfig{
+		Image:            image,
+		Insecure:         config.Insecure || config.InsecurePull,
+		InsecureRegistry: config.InsecureRegistry,
+		Platform:         platform,
+	})
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(inspection, "", "  ")
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+	build.PrintImageInspection(inspection)
+	return 0
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// renderLabelTemplates renders the --label values holding a Go template, such
+// as build.url={{.Env.CI_JOB_URL}}, with the variables of --tag-template plus
+// .Env. An unset environment variable or build arg renders empty with a
+// warning, or fails the build with --label-template-strict.
+func renderLabelTemplates(config *Config, source *build.SourceInfo) error {
+	var keys []string
+	for key, value := range config.Labels {
+		if strings.Contains(value, "{{") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	data := newTemplateData(config, source)
+	// Labels describe the image, so the destination variables are the first one's
+	if len(config.Destination) > 0 {
+		data.Image, data.Tag = splitDestinationTag(config.Destination[0])
+		data.Registry, data.Repo = splitDestinationRegistry(data.Image)
+	}
+
+	for _, key := range keys {
+		text := config.Labels[key]
+		value, err := renderLabelTemplate(text, data, "error")
+		if err != nil && !config.LabelTemplateStrict && strings.Contains(err.Error(), "map has no entry for key") {
+			logger.Warning("--label %s=%s: %v; the variable renders empty (--label-template-strict makes this an error)", key, text, err)
+			value, err = renderLabelTemplate(text, data, "zero")
+		}
+		if err != nil {
+			return fmt.Errorf("--label %s=%s: %v", key, text, err)
+		}
+		config.Labels[key] = value
+		logger.Debug("Label template %s rendered: %s", key, value)
+	}
+	return nil
+}
+
+// renderLabelTemplate renders one label value; missingKey is the
+// text/template missingkey option
+func renderLabelTemplate(text string, data templateData, missingKey string) (string, error) {
+	tmpl, err := template.New("label").Option("missingkey=" + missingKey).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rapidfort/kimia/internal/auth"
 	"github.com/rapidfort/kimia/internal/build"
 	"github.com/rapidfort/kimia/internal/preflight"
+	"github.com/rapidfort/kimia/pkg/exitcode"
 	"github.com/rapidfort/kimia/pkg/logger"
 )
 
@@ -27,44 +32,138 @@ func main() {
 
 	// Handle check-environment command
 	if len(os.Args) > 1 && os.Args[1] == "check-environment" {
-		exitCode := preflight.CheckEnvironment()
+		exitCode := preflight.CheckEnvironment(checkEnvironmentBuilder(os.Args[2:]))
 		os.Exit(exitCode)
 	}
 
+	// Handle healthz command (Kubernetes probes)
+	if len(os.Args) > 1 && os.Args[1] == "healthz" {
+		os.Exit(runHealthz(os.Args[2:]))
+	}
+
+	// Handle audit-security command
+	if len(os.Args) > 1 && os.Args[1] == "audit-security" {
+		exitCode := preflight.AuditSecurity()
+		os.Exit(exitCode)
+	}
+
+	// Handle plan command
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		os.Exit(runPlan(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		os.Exit(runInspect(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "copy" {
+		os.Exit(runCopy(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "push-artifact" {
+		os.Exit(runPushArtifact(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCache(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "buildkit-certs" {
+		os.Exit(runBuildKitCerts(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "builds" {
+		os.Exit(runBuilds(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "logs" {
+		os.Exit(runLogs(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cancel" {
+		os.Exit(runCancel(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		os.Exit(runGenerate(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		os.Exit(runClient(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "client-build" {
+		os.Exit(runClientBuild(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		os.Exit(runHistory(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		os.Exit(runBatch(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "bake" {
+		os.Exit(runBake(os.Args[2:]))
+	}
+
+	// Handle rebuild-if-base-changed command: a normal build that is skipped
+	// when no base image changed since the previous build
+	args := os.Args[1:]
+	rebuildIfBaseChanged := len(args) > 0 && args[0] == "rebuild-if-base-changed"
+	if rebuildIfBaseChanged {
+		args = args[1:]
+	}
+
+	// Handle package command: a normal build of a Dockerfile generated from
+	// the package options
+	var pkg *packageSpec
+	if len(args) > 0 && args[0] == "package" {
+		var err error
+		if pkg, args, err = parsePackageArgs(args[1:]); err != nil {
+			logger.FatalCode(exitcode.Config, "%v", err)
+		}
+	}
+
 	// Detect which builder is available (moved to build.Execute)
 	// No need to detect here anymore - build.Execute handles it
 
+	// If no arguments provided, show help
+	if len(args) == 0 && pkg == nil {
+		printHelp()
+		os.Exit(0)
+	}
+
 	// Parse configuration
-	config := parseArgs(os.Args[1:])
+	config := parseArgs(args)
 
+	runBuildCommand(config, pkg, rebuildIfBaseChanged)
+}
+
+// runBuildCommand runs the build of config, from its validation to the push,
+// and exits on failure. pkg is the image of kimia package, if that is the
+// command, and rebuildIfBaseChanged skips builds whose base images did not change.
+func runBuildCommand(config *Config, pkg *packageSpec, rebuildIfBaseChanged bool) {
 	// Log kimia version (builder will be logged by build.Execute)
 	logger.Info("Kimia - Kubernetes-Native OCI Image Builder v%s", Version)
 	logger.Debug("Build Date: %s, Commit: %s, Branch: %s", BuildDate, CommitSHA, Branch)
 
-	// Validate storage driver only if specified
-	// BuildKit supports: native, overlay
-	// Buildah supports: vfs, overlay
-	if config.StorageDriver != "" {
-		validDrivers := []string{"vfs", "overlay", "native"}
-		storageDriver := strings.ToLower(config.StorageDriver)
-		isValid := false
-		for _, driver := range validDrivers {
-			if storageDriver == driver {
-				isValid = true
-				break
-			}
-		}
-		if !isValid {
-			// Sanitize storage driver for safe output
-			// Remove control characters, limit length, keep only printable ASCII
-			sanitized := sanitizeForOutput(config.StorageDriver, 50)
+	prepareBuildUser()
 
-			// #nosec G705 -- sanitized is cleaned by sanitizeForOutput() which removes all control characters and limits length
-			fmt.Fprintf(os.Stderr, "Error: Invalid storage driver '%s'\n", sanitized)
-			fmt.Fprintf(os.Stderr, "Valid options: native, overlay (BuildKit), vfs, overlay (Buildah)\n\n")
-			os.Exit(1)
+	if pkg != nil {
+		if err := pkg.apply(config); err != nil {
+			logger.FatalCode(exitcode.Config, "%v", err)
 		}
+	}
 
+	// The storage driver is checked against the detected builder in validateConfig
+	if config.StorageDriver != "" {
+		storageDriver := strings.ToLower(config.StorageDriver)
 		// Log storage driver selection
 		logger.Info("Using storage driver: %s", storageDriver)
 		if storageDriver == "overlay" {
@@ -78,75 +177,660 @@ func main() {
 		}
 	}
 
-	if config.Context == "" {
-		fmt.Fprintf(os.Stderr, "Error: Kimia only supports BUILD mode\n\n")
-		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  kimia --context=. --destination=registry/image:tag\n\n")
-		fmt.Fprintf(os.Stderr, "Run 'kimia --help' for more information.\n")
-		os.Exit(1)
+	// Validate build requirements and assign destinations to the --target stages
+	targetBuilds, err := validateBuildRequest(config)
+	if err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
 	}
 
-	// Check for enterprise-only flags
-	if config.Scan {
-		fmt.Fprintf(os.Stderr, "Error: --scan is an enterprise-only feature\n")
-		fmt.Fprintf(os.Stderr, "This is the OSS version which supports build-only operations.\n")
-		os.Exit(1)
+	// Setup logging
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+
+	if err := applyBuilderDefaults(config); err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
 	}
 
-	if config.Harden {
-		fmt.Fprintf(os.Stderr, "Error: --harden is an enterprise-only feature\n")
-		fmt.Fprintf(os.Stderr, "This is the OSS version which supports build-only operations.\n")
-		os.Exit(1)
+	// Detect which builder is available early (needed for context preparation)
+	builder, err := selectBuilder(config)
+	if err != nil {
+		logger.FatalCode(exitcode.Preflight, "%v", err)
 	}
+	logger.Info("Detected builder: %s", strings.ToUpper(builder))
 
-	// Validate build requirements
-	if len(config.Destination) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: Build mode requires:\n")
-		fmt.Fprintf(os.Stderr, "  --context: Build context (directory or Git URL)\n")
-		fmt.Fprintf(os.Stderr, "  --destination: Target image name\n\n")
-		fmt.Fprintf(os.Stderr, "Example:\n")
-		fmt.Fprintf(os.Stderr, "  kimia --context=. --destination=registry/image:tag\n\n")
-		os.Exit(1)
+	if err := validateConfig(config, builder); err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
+	}
+	if err := prepareBuild(config); err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
 	}
 
-	// Setup logging
-	logger.Setup(config.Verbosity, config.LogTimestamp)
+	var refresh *baseRefresh
+	if rebuildIfBaseChanged {
+		var err error
+		refresh, err = checkBaseImages(config)
+		if err != nil {
+			logger.FatalCode(exitcode.Of(err), "%v", err)
+		}
+		if refresh == nil {
+			logger.Info("Skipping build: image is up to date")
+			reportRebuildResult(config, rebuildResultNoChange)
+			return
+		}
+	}
 
-	// Detect which builder is available early (needed for context preparation)
-	builder := build.DetectBuilder()
-	if builder == "unknown" {
-		logger.Fatal("No builder found (expected buildkitd or buildah)")
+	notify, err := notifyConfig(config)
+	if err != nil {
+		logger.FatalCode(exitcode.Config, "%v", err)
 	}
-	logger.Info("Detected builder: %s", strings.ToUpper(builder))
+
+	// Track temporary directories and remove those of crashed earlier runs
+	ws, err := build.StartWorkspace()
+	if err != nil {
+		logger.Warning("Temporary directories will not be tracked: %v", err)
+	} else if id, err := ws.RegisterBuild("build", config.Context, builder, config.Destination); err != nil {
+		logger.Warning("The build will not be listed by kimia builds: %v", err)
+	} else {
+		logger.Info("Build ID: %s", id)
+	}
+	stopSignals := build.CancelOnSignal()
 
 	// Run the build pipeline in a separate function so that deferred cleanup
 	// use error returns instead and only call Fatal at the very end.
-	if err := run(config, builder); err != nil {
-		logger.Fatal("%v", err)
+	started := time.Now()
+	err = run(config, builder, targetBuilds)
+	stopSignals()
+	ws.Close()
+	if notify != nil && !config.DryRun {
+		sendNotification(config, builder, *notify, started, err)
+	}
+	if err != nil {
+		logger.FatalCode(exitcode.Of(err), "%v", err)
 	}
 
+	if config.DryRun {
+		logger.Info("Dry run completed - nothing was built or pushed")
+		return
+	}
 	logger.Info("Build completed successfully!")
+
+	if refresh != nil {
+		if err := refresh.save(config); err != nil {
+			logger.FatalCode(exitcode.Build, "failed to record the base images: %v", err)
+		}
+		reportRebuildResult(config, rebuildResultRebuilt)
+	}
+}
+
+// applyBuilderDefaults checks --builder, selects an external buildkitd the way
+// buildctl does, expands --buildkit-tls-dir and parses --builder-endpoint
+func applyBuilderDefaults(config *Config) error {
+	if config.BuildahRemote != "" && config.BuildkitAddr != "" {
+		return fmt.Errorf("--buildah-remote and --buildkit-addr are mutually exclusive")
+	}
+	if config.Builder != "" && !containsString(build.Builders, config.Builder) {
+		return fmt.Errorf("invalid --builder %q (valid: %s)", config.Builder, strings.Join(build.Builders, ", "))
+	}
+	if config.Builder == "auto" {
+		config.Builder = ""
+	}
+	if config.Builder == "buildkit" && config.BuildahRemote != "" {
+		return fmt.Errorf("--buildah-remote requires Buildah and cannot be used with --builder=buildkit")
+	}
+	if config.Builder == "buildah" && config.BuildkitAddr != "" {
+		return fmt.Errorf("--buildkit-addr requires BuildKit and cannot be used with --builder=buildah")
+	}
+	if config.Builder == "buildpacks" && (config.BuildkitAddr != "" || config.BuildahRemote != "") {
+		return fmt.Errorf("--builder=buildpacks runs the lifecycle in this container and cannot be used with --buildkit-addr or --buildah-remote")
+	}
+	if config.RunImage != "" && config.Builder != "buildpacks" {
+		return fmt.Errorf("--run-image requires --builder=buildpacks")
+	}
+	// BUILDKIT_HOST does not apply when Buildah or buildpacks are forced
+	if config.BuildkitAddr == "" && config.BuildahRemote == "" && config.Builder != "buildah" && config.Builder != "buildpacks" {
+		config.BuildkitAddr = os.Getenv("BUILDKIT_HOST")
+	}
+	// --buildkit-tls-dir uses the file names of buildctl --tlsdir
+	if config.BuildkitTLSDir != "" {
+		if config.BuildkitTLSCACert == "" {
+			config.BuildkitTLSCACert = filepath.Join(config.BuildkitTLSDir, build.BuildKitCertFiles.CA)
+		}
+		if config.BuildkitTLSCert == "" && config.BuildkitTLSKey == "" {
+			config.BuildkitTLSCert = filepath.Join(config.BuildkitTLSDir, build.BuildKitCertFiles.Cert)
+			config.BuildkitTLSKey = filepath.Join(config.BuildkitTLSDir, build.BuildKitCertFiles.Key)
+		}
+	}
+	return parseBuilderEndpoints(config)
+}
+
+// parseBuilderEndpoints parses --builder-endpoint. The platform images are
+// merged into an index in the registry, so the build must be pushed.
+func parseBuilderEndpoints(config *Config) error {
+	config.endpoints = nil
+	if len(config.BuilderEndpoints) == 0 {
+		return nil
+	}
+	if config.Builder == "buildah" || config.BuildahRemote != "" {
+		return fmt.Errorf("--builder-endpoint requires BuildKit and cannot be used with Buildah")
+	}
+	if config.Builder == "buildpacks" {
+		return fmt.Errorf("--builder-endpoint requires BuildKit and cannot be used with buildpacks")
+	}
+	if config.NoPush || config.TarPath != "" || config.Load != "" {
+		return fmt.Errorf("--builder-endpoint merges the platform images in the registry and cannot be used with --no-push, --tar-path or --load")
+	}
+	config.endpoints = make(map[string]string, len(config.BuilderEndpoints))
+	for _, spec := range config.BuilderEndpoints {
+		platform, addr, err := build.ParseBuilderEndpoint(spec)
+		if err != nil {
+			return err
+		}
+		if _, set := config.endpoints[platform]; set {
+			return fmt.Errorf("--builder-endpoint is given twice for %s", platform)
+		}
+		config.endpoints[platform] = addr
+	}
+	return nil
+}
+
+// prepareBuildUserOnce runs the arbitrary UID setup once per process, which
+// kimia batch shares between its builds
+var prepareBuildUserOnce sync.Once
+
+// prepareBuildUser adjusts HOME, storage paths and, under OpenShift, the
+// subuid entries for an arbitrary UID before the first build. Other commands
+// leave the environment and /etc alone.
+func prepareBuildUser() {
+	prepareBuildUserOnce.Do(func() {
+		if err := preflight.PrepareArbitraryUID(); err != nil {
+			logger.Warning("Arbitrary UID setup failed: %v", err)
+		}
+	})
+}
+
+// checkEnvironmentBuilder returns the --builder given to `kimia check-environment`
+func checkEnvironmentBuilder(args []string) string {
+	config := parseArgs(args)
+	if config.Builder != "" && !containsString(build.Builders, config.Builder) {
+		logger.FatalCode(exitcode.Config, "invalid --builder %q (valid: %s)", config.Builder, strings.Join(build.Builders, ", "))
+	}
+	return config.Builder
+}
+
+// selectBuilder returns the builder to use. A builder forced with --builder
+// must be installed and this host must meet its requirements.
+func selectBuilder(config *Config) (string, error) {
+	builder := build.DetectBuilderFor(config.Builder, build.RoutedBuildkitAddr(config.BuildkitAddr, config.endpoints), config.BuildahRemote)
+	if config.Builder == "" {
+		if builder == "unknown" {
+			return "", fmt.Errorf("no builder found (expected buildkitd or buildah)")
+		}
+		return builder, nil
+	}
+	remote := config.BuildkitAddr != "" || config.BuildahRemote != "" || len(config.endpoints) > 0
+	if err := preflight.CheckBuilderRequirements(config.Builder, remote); err != nil {
+		return "", fmt.Errorf("--builder=%s: %v", config.Builder, err)
+	}
+	return builder, nil
+}
+
+// resolveBuildkitdFragments expands the --buildkitd-config-fragment globs and
+// directories into absolute file paths, keeping the order of the flags and
+// sorting the files each pattern matches
+func resolveBuildkitdFragments(config *Config) error {
+	var files []string
+	for _, pattern := range config.BuildkitdConfigFragments {
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			pattern = filepath.Join(pattern, "*.toml")
+		} else if !strings.ContainsAny(pattern, "*?[") {
+			if err != nil {
+				return fmt.Errorf("invalid --buildkitd-config-fragment: %v", err)
+			}
+			files = append(files, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid --buildkitd-config-fragment pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			logger.Warning("--buildkitd-config-fragment %s matches no files", pattern)
+		}
+		files = append(files, matches...)
+	}
+	for i, file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			return fmt.Errorf("invalid --buildkitd-config-fragment: %v", err)
+		}
+		files[i] = path
+	}
+	config.BuildkitdConfigFragments = files
+	return nil
+}
+
+// setupUsernsMaps applies --userns-uid-map and --userns-gid-map, where a
+// missing map defaults to the other. Buildah running as root or through a
+// Podman service takes them as flags, which are returned; rootless Buildah
+// and rootlesskit get them through /etc/subuid and /etc/subgid.
+func setupUsernsMaps(config *Config, builder string) ([]string, []string, error) {
+	if len(config.UsernsUIDMap) == 0 && len(config.UsernsGIDMap) == 0 {
+		return nil, nil, nil
+	}
+	if config.UsernsRange != "" || config.UsernsRangeFile != "" {
+		return nil, nil, fmt.Errorf("--userns-uid-map/--userns-gid-map and --userns-range/--userns-range-file are mutually exclusive")
+	}
+	uidMappings, err := preflight.ParseIDMappings(config.UsernsUIDMap)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --userns-uid-map: %v", err)
+	}
+	gidMappings, err := preflight.ParseIDMappings(config.UsernsGIDMap)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --userns-gid-map: %v", err)
+	}
+	if len(uidMappings) == 0 {
+		uidMappings = gidMappings
+	}
+	if len(gidMappings) == 0 {
+		gidMappings = uidMappings
+	}
+
+	if builder == "buildah" && (os.Getuid() == 0 || config.BuildahRemote != "") {
+		var uidMap, gidMap []string
+		for _, mapping := range uidMappings {
+			uidMap = append(uidMap, mapping.String())
+		}
+		for _, mapping := range gidMappings {
+			gidMap = append(gidMap, mapping.String())
+		}
+		return uidMap, gidMap, nil
+	}
+	if builder == "buildkit" && config.BuildkitAddr != "" {
+		logger.Warning("--userns-uid-map/--userns-gid-map have no effect with an external buildkitd")
+		return nil, nil, nil
+	}
+	if config.DryRun {
+		if err := preflight.ValidateIDMappings(uidMappings, gidMappings); err != nil {
+			return nil, nil, err
+		}
+		logger.Info("Dry run: /etc/subuid and /etc/subgid would be rewritten for the UID/GID mappings")
+		return nil, nil, nil
+	}
+	return nil, nil, preflight.SetupIDMappings(uidMappings, gidMappings)
+}
+
+// validateNetworkOptions checks --network, --add-host, --dns and --dns-search
+func validateNetworkOptions(config *Config) error {
+	if config.Network != "" && !containsString(build.NetworkModes, config.Network) {
+		return fmt.Errorf("invalid --network %q (valid: %s)", config.Network, strings.Join(build.NetworkModes, ", "))
+	}
+	if config.Network == "none" && (len(config.AddHosts) > 0 || len(config.DNS) > 0 || len(config.DNSSearch) > 0) {
+		logger.Warning("--add-host, --dns and --dns-search have no effect with --network=none")
+	}
+	for _, entry := range config.AddHosts {
+		if _, _, err := build.ParseAddHost(entry); err != nil {
+			return err
+		}
+	}
+	for _, server := range config.DNS {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("invalid --dns %q: not an IP address", server)
+		}
+	}
+	for _, domain := range config.DNSSearch {
+		if domain == "" || strings.ContainsAny(domain, " \t,") {
+			return fmt.Errorf("invalid --dns-search %q", domain)
+		}
+	}
+	return nil
+}
+
+// buildkitEntitlements are the values of --allow
+var buildkitEntitlements = []string{"security.insecure", "network.host"}
+
+// validatePrivilegedSteps checks --allow, --device and --cap-add, which only
+// take effect with --allow-privileged-steps, against the builder and the
+// devices and capabilities this container actually has
+func validatePrivilegedSteps(config *Config, builder string) error {
+	if len(config.Allow) == 0 && len(config.Devices) == 0 && len(config.CapAdd) == 0 {
+		if config.AllowPrivilegedSteps {
+			logger.Warning("--allow-privileged-steps has no effect without --allow, --device or --cap-add")
+		}
+		return nil
+	}
+	if !config.AllowPrivilegedSteps {
+		return fmt.Errorf("--allow, --device and --cap-add grant RUN steps privileges beyond the default sandbox; add --allow-privileged-steps to confirm")
+	}
+
+	if builder == "buildkit" && (len(config.Devices) > 0 || len(config.CapAdd) > 0) {
+		return fmt.Errorf("--device and --cap-add are Buildah options; with BuildKit use --allow=security.insecure and RUN --security=insecure")
+	}
+	if builder == "buildah" && len(config.Allow) > 0 {
+		return fmt.Errorf("--allow is a BuildKit option; with Buildah use --device and --cap-add")
+	}
+	for _, entitlement := range config.Allow {
+		if !containsString(buildkitEntitlements, entitlement) {
+			return fmt.Errorf("invalid --allow %q (valid: %s)", entitlement, strings.Join(buildkitEntitlements, ", "))
+		}
+	}
+	// Entitlements are granted by the buildkitd config of this run only
+	if len(config.Allow) > 0 && config.ReuseDaemon && config.BuildkitAddr == "" {
+		return fmt.Errorf("--allow cannot be combined with --reuse-daemon: the shared buildkitd would keep granting the entitlements to later builds")
+	}
+
+	// Devices and capabilities of a remote Buildah are those of the Podman service
+	if config.BuildahRemote == "" {
+		caps, err := preflight.CheckPrivilegedSteps(config.Devices, config.CapAdd)
+		if err != nil {
+			return err
+		}
+		config.CapAdd = caps
+	}
+
+	logger.Warning("Audit: privileged RUN steps allowed (entitlements %v, devices %v, capabilities %v)",
+		config.Allow, config.Devices, config.CapAdd)
+	return nil
+}
+
+// validatePromoteOptions checks --staging-destination and the promotion gates
+func validatePromoteOptions(config *Config) error {
+	if config.StagingDestination == "" {
+		if len(config.PromoteRequire) > 0 || config.PromoteWebhook != "" {
+			return fmt.Errorf("--promote-require and --promote-webhook need --staging-destination")
+		}
+		return nil
+	}
+	if config.NoPush || config.Load != "" {
+		return fmt.Errorf("--staging-destination needs the image to be pushed (remove --no-push/--load)")
+	}
+	if containsString(config.Destination, config.StagingDestination) {
+		return fmt.Errorf("--staging-destination %s is also a --destination", config.StagingDestination)
+	}
+	for _, kind := range config.PromoteRequire {
+		if !containsString(build.VerifyArtifactKinds, kind) {
+			return fmt.Errorf("invalid --promote-require value %q (valid: %s)", kind, strings.Join(build.VerifyArtifactKinds, ", "))
+		}
+	}
+	if config.PromoteWebhook != "" && !strings.HasPrefix(config.PromoteWebhook, "https://") && !strings.HasPrefix(config.PromoteWebhook, "http://") {
+		return fmt.Errorf("--promote-webhook must be an http(s) URL")
+	}
+	return nil
+}
+
+// installCABundle trusts the --ca-bundle certificates in every component;
+// the returned function removes the combined bundle
+func installCABundle(config *Config) (func(), error) {
+	if config.CABundle == "" {
+		return func() {}, nil
+	}
+	path, err := filepath.Abs(config.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --ca-bundle: %v", err)
+	}
+	config.CABundle = path
+	return build.InstallCABundle(path)
+}
+
+// configureRegistryTLS applies the --registry-config settings to Kimia's own
+// registry clients. Insecure registries are added to --insecure-registry so
+// the builders and pushes skip verification for them too.
+func configureRegistryTLS(config *Config) error {
+	config.registryTLS = nil
+	seen := make(map[string]bool)
+	for _, spec := range config.RegistryConfigs {
+		registry, err := auth.ParseRegistryTLS(spec)
+		if err != nil {
+			return fmt.Errorf("invalid --registry-config %q: %v", spec, err)
+		}
+		if seen[registry.Host] {
+			return fmt.Errorf("--registry-config is given more than once for %s", registry.Host)
+		}
+		seen[registry.Host] = true
+		for _, path := range []*string{&registry.CA, &registry.ClientCert, &registry.ClientKey} {
+			if *path == "" {
+				continue
+			}
+			if *path, err = filepath.Abs(*path); err != nil {
+				return fmt.Errorf("invalid --registry-config %q: %v", spec, err)
+			}
+		}
+		if registry.Insecure {
+			if registry.CA != "" {
+				logger.Warning("--registry-config for %s: ca has no effect with insecure=true", registry.Host)
+			}
+			config.InsecureRegistry = append(config.InsecureRegistry, registry.Host)
+		}
+		config.registryTLS = append(config.registryTLS, registry)
+	}
+	return auth.SetRegistryTLS(config.registryTLS)
+}
+
+// applyRegistryPins checks the certificates of the registries against their
+// pins (--pin-registry-cert) and makes the pinned certificates the only trust
+// anchor of each registry, for Kimia's clients, the buildkitd config and
+// Buildah, instead of skipping their verification
+func applyRegistryPins(config *Config, registries []string) error {
+	if !config.PinRegistryCert {
+		return nil
+	}
+	if config.Insecure {
+		return exitcode.Wrap(exitcode.Config, fmt.Errorf("--pin-registry-cert cannot be used with --insecure, which turns off certificate checks for every registry; list registries without TLS in --insecure-registry instead"))
+	}
+	anchors, err := auth.VerifyRegistryPins(registries, config.RegistryPinFile)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Auth, fmt.Errorf("registry certificate pinning failed: %w", err))
+	}
+	if len(anchors) == 0 {
+		return nil
+	}
+
+	pinned := make(map[string]bool)
+	for i := range config.registryTLS {
+		registry := &config.registryTLS[i]
+		if anchor, ok := anchors[registry.Host]; ok {
+			if registry.CA != "" {
+				logger.Warning("--registry-config for %s: the pinned certificate replaces its ca", registry.Host)
+			}
+			registry.CA, registry.Insecure, registry.Pinned = anchor, false, true
+			pinned[registry.Host] = true
+		}
+	}
+	for host, anchor := range anchors {
+		if !pinned[host] {
+			config.registryTLS = append(config.registryTLS, auth.RegistryTLS{Host: host, CA: anchor, Pinned: true})
+		}
+	}
+	sort.Slice(config.registryTLS, func(i, j int) bool { return config.registryTLS[i].Host < config.registryTLS[j].Host })
+
+	// Pinned registries are verified against the pin rather than not at all
+	var insecure []string
+	for _, registry := range config.InsecureRegistry {
+		if _, ok := anchors[auth.NormalizeRegistryURL(registry)]; ok {
+			logger.Info("Verifying %s against its pinned certificate instead of --insecure-registry", registry)
+			continue
+		}
+		insecure = append(insecure, registry)
+	}
+	config.InsecureRegistry = insecure
+	return auth.SetRegistryTLS(config.registryTLS)
+}
+
+// pinnedCertDirs returns the Buildah --cert-dir of each registry with a
+// pinned certificate, the directory applyRegistryPins wrote it to
+func pinnedCertDirs(config *Config) map[string]string {
+	dirs := make(map[string]string)
+	for _, registry := range config.registryTLS {
+		if registry.Pinned {
+			dirs[registry.Host] = filepath.Dir(registry.CA)
+		}
+	}
+	return dirs
+}
+
+// validateOfflineOptions checks --offline and --image-store
+func validateOfflineOptions(config *Config) error {
+	if !config.Offline {
+		if config.ImageStore != "" {
+			return fmt.Errorf("--image-store is only used with --offline")
+		}
+		return nil
+	}
+	if config.ImageStore == "" {
+		return fmt.Errorf("--offline needs --image-store: an OCI layout directory or containerd[://NAMESPACE] holding the base images")
+	}
+	if config.PullPolicy == "always" {
+		return fmt.Errorf("--pull=always cannot be used with --offline")
+	}
+	if isRemoteContext(config.Context) {
+		return fmt.Errorf("--offline needs a local build context, not %s", logger.SanitizeGitURL(config.Context))
+	}
+	if config.ImageStore != "containerd" && !strings.HasPrefix(config.ImageStore, "containerd://") {
+		store, err := filepath.Abs(config.ImageStore)
+		if err != nil {
+			return fmt.Errorf("invalid --image-store: %v", err)
+		}
+		config.ImageStore = store
+	}
+	return nil
+}
+
+// resolvePlatform sets the platform of a build without --custom-platform, or
+// with --custom-platform=auto, to the node's; auto also records it in a
+// label. With --builder-endpoint the default is every routed platform.
+func resolvePlatform(config *Config) error {
+	if config.CustomPlatform == "" && len(config.endpoints) > 0 {
+		config.CustomPlatform = build.EndpointPlatforms(config.endpoints)
+		logger.Info("Target platforms: %s (from --builder-endpoint)", config.CustomPlatform)
+	}
+	remote := config.BuildkitAddr != "" || config.BuildahRemote != ""
+	auto := config.CustomPlatform == build.PlatformAuto
+	platform, detected, err := build.ResolvePlatform(config.CustomPlatform, remote)
+	if err != nil {
+		return err
+	}
+	config.CustomPlatform = platform
+	if detected {
+		logger.Info("Target platform: %s (detected from the node)", platform)
+		if _, set := config.Labels[build.BuildPlatformLabel]; auto && !set {
+			config.Labels[build.BuildPlatformLabel] = platform
+		}
+	}
+	return nil
+}
+
+// prepareEmulation checks that this node can run the RUN steps of every
+// platform, registering QEMU with --register-binfmt. Only the platforms built
+// locally are checked; a remote builder has its own emulation.
+func prepareEmulation(config *Config) error {
+	platform := config.CustomPlatform
+	remote := config.BuildkitAddr != "" || config.BuildahRemote != ""
+	switch {
+	case remote || platform == "":
+		if config.RegisterBinfmt {
+			logger.Warning("--register-binfmt has no effect with a remote builder")
+		}
+	case config.DryRun && config.RegisterBinfmt:
+		logger.Info("Dry run: binfmt_misc handlers are neither checked nor registered")
+	default:
+		var local []string
+		for _, name := range strings.Split(platform, ",") {
+			if _, routed := build.EndpointFor(config.endpoints, name); !routed {
+				local = append(local, name)
+			}
+		}
+		if len(local) == 0 {
+			break
+		}
+		if err := preflight.CheckEmulation(local, config.RegisterBinfmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSecrets parses --build-arg-from-secret and --secret-from-env; the
+// secrets are read by prepareBuild
+func parseSecrets(config *Config) error {
+	config.secrets = nil
+	for _, spec := range config.BuildArgFromSecret {
+		secret, err := build.ParseSecretFile(spec)
+		if err != nil {
+			return err
+		}
+		config.secrets = append(config.secrets, secret)
+	}
+	for _, spec := range config.SecretFromEnv {
+		secret, err := build.ParseSecretEnv(spec)
+		if err != nil {
+			return err
+		}
+		if !envAllowed(config, secret.Env) {
+			return fmt.Errorf("secret %s reads the environment variable %s, which --env-allowlist does not allow", secret.ID, secret.Env)
+		}
+		config.secrets = append(config.secrets, secret)
+	}
+	for _, secret := range config.secrets {
+		// A build arg would store the value in the image history
+		if _, set := config.BuildArgs[secret.ID]; set {
+			return fmt.Errorf("%s is given both as a secret and as a build arg; read it with RUN --mount=type=secret,id=%s instead of ARG", secret.ID, secret.ID)
+		}
+	}
+	return nil
+}
+
+// prepareBuild does the setup that validateConfig only checks: it reads the
+// secrets, expands --buildkitd-config-fragment and checks, or with
+// --register-binfmt registers, the emulation of foreign platforms
+func prepareBuild(config *Config) error {
+	if err := build.PrepareSecrets(config.secrets); err != nil {
+		return err
+	}
+	if err := resolveBuildkitdFragments(config); err != nil {
+		return err
+	}
+	return prepareEmulation(config)
 }
 
 // run executes the build pipeline. By returning errors instead of calling
 // logger.Fatal directly, we ensure that deferred cleanup (ctx.Cleanup)
 // always runs — even when the build fails.
-func run(config *Config, builder string) error {
+func run(config *Config, builder string, targetBuilds []build.TargetBuild) error {
+	// Trust private CAs before anything (the git clone included) connects
+	removeCABundle, err := installCABundle(config)
+	if err != nil {
+		return err
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(config); err != nil {
+		return err
+	}
+
 	// Prepare build context
 	gitConfig := build.GitConfig{
-		Context:   config.Context,
-		Branch:    config.GitBranch,
-		Revision:  config.GitRevision,
-		TokenFile: config.GitTokenFile,
-		TokenUser: config.GitTokenUser,
+		Context:     config.Context,
+		Branch:      config.GitBranch,
+		Revision:    config.GitRevision,
+		TokenFile:   config.GitTokenFile,
+		TokenUser:   config.GitTokenUser,
+		SSHKeyFile:  config.GitSSHKeyFile,
+		Depth:       config.GitDepth,
+		Filter:      config.GitFilter,
+		SparsePaths: config.GitSparsePaths,
 	}
 
 	ctx, err := build.Prepare(gitConfig, builder)
 	if err != nil {
-		return fmt.Errorf("failed to prepare build context: %v", err)
+		return exitcode.Wrap(exitcode.Context, fmt.Errorf("failed to prepare build context: %w", err))
 	}
 	defer ctx.Cleanup()
 
+	// A subdirectory from the context URL (repo.git#ref:dir) applies unless
+	// --context-sub-path is given
+	if config.SubContext == "" {
+		config.SubContext = ctx.SubContext
+	} else if ctx.SubContext != "" && filepath.Clean(ctx.SubContext) != filepath.Clean(config.SubContext) {
+		logger.Warning("Ignoring sub-path %s in the context URL, --context-sub-path=%s takes precedence", ctx.SubContext, config.SubContext)
+	}
+
 	// Store SubContext in context for BuildKit Git URL formatting
 	ctx.SubContext = config.SubContext
 
@@ -166,99 +850,529 @@ func run(config *Config, builder string) error {
 		// by checking if the relative path starts with ".."
 		relPath, err := filepath.Rel(cleanContextPath, subPath)
 		if err != nil {
-			return fmt.Errorf("invalid context sub-path: %s", config.SubContext)
+			return exitcode.Wrap(exitcode.Context, fmt.Errorf("invalid context sub-path: %s", config.SubContext))
 		}
 
 		// If the relative path starts with "..", it's trying to escape
 		if strings.HasPrefix(relPath, "..") {
-			return fmt.Errorf("context sub-path attempts to escape build context: %s", config.SubContext)
+			return exitcode.Wrap(exitcode.Context, fmt.Errorf("context sub-path attempts to escape build context: %s", config.SubContext))
 		}
 
 		// Verify the subdirectory exists
 		// #nosec G703 -- subPath is validated to be within cleanContextPath using filepath.Rel() check above
 		if _, err := os.Stat(subPath); err != nil {
-			return fmt.Errorf("context sub-path does not exist: %s (full path: %s)", config.SubContext, subPath)
+			if len(config.GitSparsePaths) > 0 {
+				return exitcode.Wrap(exitcode.Context, fmt.Errorf("context sub-path does not exist: %s (not inside --git-sparse-path %s)", config.SubContext, strings.Join(config.GitSparsePaths, ",")))
+			}
+			return exitcode.Wrap(exitcode.Context, fmt.Errorf("context sub-path does not exist: %s (full path: %s)", config.SubContext, subPath))
 		}
 
 		logger.Info("Using context sub-path: %s", config.SubContext)
 		ctx.Path = subPath
 	}
 
-	// Setup authentication
-	authSetup := auth.SetupConfig{
-		Destinations:     config.Destination,
-		InsecureRegistry: config.InsecureRegistry,
+	// Fall back to a Containerfile, copy a Dockerfile from outside the context
+	// and write an inline one. Buildpacks build without a Dockerfile.
+	if builder != "buildpacks" {
+		if config.Dockerfile, err = ctx.ResolveDockerfile(config.Dockerfile, config.DockerfileContent); err != nil {
+			return exitcode.Wrap(exitcode.Context, err)
+		}
+		for i := range config.chains {
+			if config.chains[i].Dockerfile, err = ctx.ResolveChainDockerfile(config.chains[i].Dockerfile); err != nil {
+				return exitcode.Wrap(exitcode.Context, err)
+			}
+		}
 	}
 
-	err = auth.Setup(authSetup)
+	// Record the exact commit being built, for provenance and release tooling
+	sourceInfo, err := build.ResolveSourceInfo(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to setup authentication: %v", err)
+		if config.SourceInfoFile != "" {
+			return exitcode.Wrap(exitcode.Context, fmt.Errorf("failed to resolve source commit: %w", err))
+		}
+		logger.Warning("Could not resolve the source commit: %v", err)
+	}
+	if sourceInfo != nil {
+		if sourceInfo.URL != "" {
+			logger.Info("Source: %s at %s", sourceInfo.URL, sourceInfo.Commit)
+		} else {
+			logger.Info("Source commit: %s", sourceInfo.Commit)
+		}
+		for key, value := range sourceInfo.BuildArgs() {
+			if _, set := config.BuildArgs[key]; !set {
+				config.BuildArgs[key] = value
+			}
+		}
+		if config.SourceInfoFile != "" {
+			if err := build.WriteSourceInfo(config.SourceInfoFile, sourceInfo); err != nil {
+				return err
+			}
+		}
+	} else if config.SourceInfoFile != "" && err == nil {
+		logger.Warning("Context is not a Git repository, %s not written", config.SourceInfoFile)
+	}
+
+	// Compute the destinations from --tag-template now that the commit is known
+	if err := renderTagTemplates(config, targetBuilds, sourceInfo); err != nil {
+		return err
+	}
+	if err := renderLabelTemplates(config, sourceInfo); err != nil {
+		return err
+	}
+
+	// Resolve --ignore-file against the context, then report and limit what is
+	// left after the ignore rules before anything copies the context
+	ignoreFile := ""
+	if config.IgnoreFile != "" || config.ShowIgnored || config.maxContextBytes > 0 || config.contextWarningBytes > 0 {
+		if ctx.Path == "" {
+			if config.IgnoreFile != "" {
+				return fmt.Errorf("--ignore-file is not supported with BuildKit Git contexts")
+			}
+			logger.Warning("--show-ignored and context size limits are not supported with BuildKit Git contexts")
+		} else {
+			ignoreFile, err = build.ResolveIgnoreFile(ctx.Path, config.IgnoreFile)
+			if err != nil {
+				return exitcode.Wrap(exitcode.Context, err)
+			}
+			if config.ShowIgnored || config.maxContextBytes > 0 || config.contextWarningBytes > 0 {
+				report, err := build.AnalyzeContext(ctx.Path, config.Dockerfile, ignoreFile)
+				if err != nil {
+					return exitcode.Wrap(exitcode.Context, err)
+				}
+				if config.ShowIgnored {
+					build.PrintIgnored(report)
+				}
+				if err := build.CheckContextSize(report, config.maxContextBytes, config.contextWarningBytes); err != nil {
+					return exitcode.Wrap(exitcode.Context, err)
+				}
+			}
+		}
+	}
+
+	// Registries pushed to, including the staging registry
+	pushDestinations := config.Destination
+	if config.StagingDestination != "" {
+		pushDestinations = append([]string{config.StagingDestination}, config.Destination...)
+	}
+
+	// Setup authentication (kimia batch sets it up once for all builds)
+	if !config.sharedAuth {
+		authSetup := auth.SetupConfig{
+			Destinations:     pushDestinations,
+			InsecureRegistry: config.InsecureRegistry,
+			NoCIAuth:         config.NoCIAuth,
+		}
+
+		err = auth.Setup(authSetup)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Auth, fmt.Errorf("failed to setup authentication: %w", err))
+		}
+	}
+
+	// Trust-on-first-use certificate pinning for destination registries
+	if err := applyRegistryPins(config, pushDestinations); err != nil {
+		return err
+	}
+
+	// Fail before a long build rather than at the push
+	if config.CheckPushAccess {
+		if config.NoPush || config.Load != "" {
+			logger.Warning("--check-push-access has no effect when the image is not pushed")
+		} else {
+			pushAccess := build.PushAccessConfig{
+				Destinations:     pushDestinations,
+				Insecure:         config.Insecure,
+				InsecureRegistry: config.InsecureRegistry,
+			}
+			if err := build.CheckPushAccess(pushAccess); err != nil {
+				return exitcode.Wrap(exitcode.Preflight, fmt.Errorf("push access check failed: %w", err))
+			}
+		}
+	}
+
+	// Isolate this build's user namespace from other builds on the node
+	// (skipped for dry runs, which must not touch /etc/subuid or the allocation file)
+	subIDConfig := preflight.SubIDRangeConfig{
+		Range:          config.UsernsRange,
+		AllocationFile: config.UsernsRangeFile,
+		Size:           config.UsernsRangeSize,
+	}
+	if config.DryRun {
+		subIDConfig = preflight.SubIDRangeConfig{}
+	}
+	subIDRange, err := preflight.SetupSubIDRange(subIDConfig)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Preflight, fmt.Errorf("failed to assign user namespace range: %w", err))
+	}
+	defer subIDRange.Release()
+	uidMap, gidMap, err := setupUsernsMaps(config, builder)
+	if err != nil {
+		return err
 	}
 
 	// Execute build based on detected builder
 	buildConfig := build.Config{
 		Dockerfile:                 config.Dockerfile,
-		Destination:                config.Destination,
-		Target:                     config.Target,
 		BuildArgs:                  config.BuildArgs,
 		Labels:                     config.Labels,
 		CustomPlatform:             config.CustomPlatform,
 		Cache:                      config.Cache,
 		CacheDir:                   config.CacheDir,
+		CacheExportDir:             config.CacheExportDir,
+		CacheImportDir:             config.CacheImportDir,
+		CacheInline:                config.CacheInline,
+		CacheRepo:                  config.CacheRepo,
 		ExportCache:                config.ExportCache,
 		ImportCache:                config.ImportCache,
 		StorageDriver:              config.StorageDriver,
+		StorageRoot:                config.storageRoot,
 		Insecure:                   config.Insecure,
 		InsecurePull:               config.InsecurePull,
 		InsecureRegistry:           config.InsecureRegistry,
 		RegistryCertificate:        config.RegistryCertificate,
+		CABundle:                   config.CABundle,
+		RegistryTLS:                config.registryTLS,
+		BuildkitdConfigFragments:   config.BuildkitdConfigFragments,
+		UsernsUIDMap:               uidMap,
+		UsernsGIDMap:               gidMap,
+		Network:                    config.Network,
+		AddHosts:                   config.AddHosts,
+		DNS:                        config.DNS,
+		DNSSearch:                  config.DNSSearch,
+		BuildTimeout:               config.buildTimeout,
+		PushTimeout:                config.pushTimeout,
+		HeartbeatInterval:          config.heartbeat,
+		DebugOnFailure:             config.DebugOnFailure,
+		DebugHold:                  config.debugHold,
+		Allow:                      config.Allow,
+		Devices:                    config.Devices,
+		CapAdd:                     config.CapAdd,
+		Secrets:                    config.secrets,
 		ImageDownloadRetry:         config.ImageDownloadRetry,
-		NoPush:                     config.NoPush,
+		NoPush:                     config.NoPush || config.Load != "", // --load replaces the push
 		TarPath:                    config.TarPath,
 		DigestFile:                 config.DigestFile,
 		ImageNameWithDigestFile:    config.ImageNameWithDigestFile,
 		ImageNameTagWithDigestFile: config.ImageNameTagWithDigestFile,
+		DigestMapFile:              config.DigestMapFile,
+		Attach:                     config.attachments,
+		VerifyPush:                 config.VerifyPush,
 		Reproducible:               config.Reproducible,
 		Timestamp:                  config.Timestamp,
+		NormalizeContext:           config.contextNormalization,
 		Attestation:                config.Attestation,
 		AttestationConfigs:         convertAttestationConfigs(config.AttestationConfigs),
 		BuildKitOpts:               config.BuildKitOpts,
+		AttestationRepos:           config.attestationRepos,
 		Sign:                       config.Sign,
 		CosignKeyPath:              config.CosignKeyPath,
 		CosignPasswordEnv:          config.CosignPasswordEnv,
+		CosignPasswordFile:         config.CosignPasswordFile,
 		BuildahOpts:                config.BuildahOpts,
+		BaseImageRewrites:          config.BaseImageRewrites,
+		MaxLayerSize:               config.maxLayerBytes,
+		MaxImageSize:               config.maxImageBytes,
+		Compression:                config.Compression,
+		CompressionLevel:           config.CompressionLevel,
+		SplitLargeLayers:           config.SplitLargeLayers,
+		DryRun:                     config.DryRun,
+		EventsFile:                 config.EventsFile,
+		RetryTransient:             config.RetryTransient,
+		Squash:                     config.Squash,
+		SquashNew:                  config.SquashNew,
+		PullPolicy:                 config.PullPolicy,
+		IgnoreFile:                 ignoreFile,
+		ReuseDaemon:                config.ReuseDaemon,
+		Builder:                    config.Builder,
+		RunImage:                   config.RunImage,
+		BuildkitAddr:               config.BuildkitAddr,
+		BuildkitTLSCACert:          config.BuildkitTLSCACert,
+		BuildkitTLSCert:            config.BuildkitTLSCert,
+		BuildkitTLSKey:             config.BuildkitTLSKey,
+		BuildkitTLSServerName:      config.BuildkitTLSServerName,
+		BuilderEndpoints:           config.endpoints,
+		BuildahRemote:              config.BuildahRemote,
+		Load:                       config.Load,
+	}
+
+	// Fail on a misspelled target before any stage is built
+	if len(config.Targets) > 0 && ctx.Path != "" {
+		if err := build.ValidateTargets(ctx.Path, config.Dockerfile, config.Targets); err != nil {
+			return err
+		}
+	}
+
+	// Check that every base image is in the local store before anything is built
+	if config.Offline {
+		targets := make([]string, 0, len(targetBuilds))
+		for _, target := range targetBuilds {
+			targets = append(targets, target.Target)
+		}
+		store, err := build.OpenImageStore(buildConfig, ctx, config.ImageStore, targets)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		buildConfig.ImageStore = store
+	}
+
+	// Build each target in turn; later targets reuse the cached steps they share with earlier ones
+	for i, target := range targetBuilds {
+		targetConfig := buildConfig
+		targetConfig.Target = target.Target
+		targetConfig.Destination = target.Destinations
+
+		if len(targetBuilds) > 1 {
+			logger.Info("Building target %d/%d: %s (%d destinations)", i+1, len(targetBuilds), target.Target, len(target.Destinations))
+
+			// Output files describe the last target; earlier targets are only pushed
+			if i < len(targetBuilds)-1 {
+				targetConfig.TarPath = ""
+				targetConfig.Load = ""
+				targetConfig.DigestFile = ""
+				targetConfig.ImageNameWithDigestFile = ""
+				targetConfig.ImageNameTagWithDigestFile = ""
+				targetConfig.Attach = nil
+			}
+		}
+
+		// Chained builds start from the image of the last target, which is
+		// the one tested; BuildKit tests it in a chained build of its own
+		var chains []build.ChainBuild
+		if i == len(targetBuilds)-1 {
+			chains = config.chains
+			if len(config.testCmd) > 0 && builder == "buildkit" {
+				test, cleanup, err := build.NewTestChain(config.testCmd)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				chains = append(chains[:len(chains):len(chains)], test)
+			} else if len(config.testCmd) > 0 {
+				targetConfig.TestCmd = config.testCmd
+			}
+			if len(chains) > 0 && builder == "buildkit" {
+				layout, cleanup, err := build.NewChainLayout()
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				targetConfig.ChainLayout = layout
+			}
+		}
+
+		if err := buildAndPush(config, targetConfig, ctx, chains); err != nil {
+			if target.Target != "" && len(targetBuilds) > 1 {
+				return fmt.Errorf("target %s: %w", target.Target, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildAndPush builds one target, then the chained builds starting from its
+// image, and pushes its destinations
+func buildAndPush(config *Config, buildConfig build.Config, ctx *build.Context, chains []build.ChainBuild) (err error) {
+	var record *build.BuildRecord
+	if !config.NoHistory || config.NotifyURL != "" || config.hooks.Enabled() {
+		record = build.NewBuildRecord(buildConfig, ctx)
+		buildConfig.History = record
+		config.builds = append(config.builds, record)
+		if !config.NoHistory && !config.DryRun {
+			defer func() { recordHistory(config, record, err) }()
+		}
+	}
+
+	// With --skip-unchanged the image of an earlier build with the same inputs is tagged instead
+	if config.SkipUnchanged && reuseUnchangedBuild(config, buildConfig, ctx, record) {
+		return config.hooks.Run(build.HookPostPush, buildConfig.Destination, record.Digests, record)
+	}
+
+	// With --staging-destination only the staging reference is pushed; the
+	// destinations receive the image once it is promoted
+	var promoteTo []string
+	if config.StagingDestination != "" && !buildConfig.NoPush {
+		promoteTo = buildConfig.Destination
+		buildConfig.Destination = []string{config.StagingDestination}
+	}
+	if !buildConfig.NoPush {
+		// Staged images are promoted with their layers, so the final registries count too
+		buildConfig.Compression = build.ResolveCompression(config.Compression, append(append([]string{}, buildConfig.Destination...), promoteTo...))
+	}
+
+	if config.ExplainCache && !config.DryRun {
+		file := config.ExplainCacheFile
+		if file == "" {
+			file = build.DefaultCacheExplainFile()
+		}
+		explanation, err := build.NewCacheExplanation(buildConfig, ctx, file)
+		if err != nil {
+			logger.Warning("--explain-cache: %v", err)
+		} else {
+			buildConfig.CacheExplain = explanation
+		}
 	}
 
-	// Execute build
-	if err := build.Execute(buildConfig, ctx); err != nil {
-		return fmt.Errorf("build failed: %v", err)
+	err = build.Execute(buildConfig, ctx)
+	if buildConfig.CacheExplain != nil {
+		buildConfig.CacheExplain.Report(err == nil)
+	}
+	if err != nil {
+		return exitcode.Wrap(exitcode.Build, fmt.Errorf("build failed: %w", err))
+	}
+	if err := config.hooks.Run(build.HookPostBuild, buildConfig.Destination, recordDigests(record), record); err != nil {
+		return err
+	}
+	if err := runChains(buildConfig, ctx, chains); err != nil {
+		return err
 	}
 
 	// Push images if not disabled
-	if !config.NoPush && config.TarPath == "" {
+	if !buildConfig.NoPush && len(buildConfig.Destination) > 0 {
+		if err := config.hooks.Run(build.HookPrePush, buildConfig.Destination, nil, record); err != nil {
+			return err
+		}
+
 		pushConfig := build.PushConfig{
-			Destinations:        config.Destination,
+			Destinations:        buildConfig.Destination,
 			Insecure:            config.Insecure,
 			InsecureRegistry:    config.InsecureRegistry,
 			RegistryCertificate: config.RegistryCertificate,
+			PinnedCertDirs:      pinnedCertDirs(config),
 			PushRetry:           config.PushRetry,
 			StorageDriver:       config.StorageDriver,
+			StorageRoot:         config.storageRoot,
+			DryRun:              config.DryRun,
+			Builder:             config.Builder,
+			BuildahRemote:       config.BuildahRemote,
+			VerifyPush:          config.VerifyPush,
+			Platform:            config.CustomPlatform,
+			PromoteTo:           promoteTo,
+			PromoteRequire:      config.PromoteRequire,
+			PromoteWebhook:      config.PromoteWebhook,
+			Jobs:                config.PushJobs,
+			ChunkSize:           config.pushChunkBytes,
+			Backend:             config.PushBackend,
+			Compression:         buildConfig.Compression,
+			CompressionLevel:    buildConfig.CompressionLevel,
+			Attach:              buildConfig.Attach,
+			AttestationRepos:    buildConfig.AttestationRepos,
+			Scan:                config.scanWebhook,
+			Timeout:             config.pushTimeout,
+			HeartbeatInterval:   config.heartbeat,
+			EventsFile:          config.EventsFile,
 		}
 
 		digestMap, err := build.Push(pushConfig)
 		if err != nil {
-			return fmt.Errorf("push failed: %v", err)
+			return exitcode.Wrap(exitcode.Push, fmt.Errorf("push failed: %w", err))
+		}
+
+		if config.DryRun {
+			return nil
+		}
+		if buildConfig.History != nil {
+			buildConfig.History.SetDigests(digestMap)
 		}
 
 		// Save digest information after successful push
 		if err := build.SaveDigestInfo(buildConfig, digestMap); err != nil {
 			logger.Warning("Failed to save digest information: %v", err)
 		}
+
+		if config.SBOMDiff && record != nil {
+			err := build.DiffSBOM(build.SBOMDiffConfig{
+				HistoryFile:      historyFile(config),
+				Record:           record,
+				Insecure:         config.Insecure,
+				InsecureRegistry: config.InsecureRegistry,
+				AttestationRepos: config.attestationRepos,
+				EventsFile:       config.EventsFile,
+			})
+			if err != nil {
+				logger.Warning("SBOM diff: %v", err)
+			}
+		}
+
+		destinations := buildConfig.Destination
+		if len(promoteTo) > 0 {
+			destinations = promoteTo
+		}
+		if err := config.hooks.Run(build.HookPostPush, destinations, recordDigests(record), record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordHistory adds a finished build to the --history-file
+func recordHistory(config *Config, record *build.BuildRecord, err error) {
+	record.Finish(err)
+	file := historyFile(config)
+	if err := build.AppendHistory(file, record); err != nil {
+		logger.Warning("Failed to record the build in the history: %v", err)
+		return
+	}
+	logger.Debug("Build %s recorded in %s", record.ID, file)
+}
+
+// recordDigests returns the digests recorded for the build so far
+func recordDigests(record *build.BuildRecord) map[string]string {
+	if record == nil {
+		return nil
 	}
+	return record.Digests
+}
 
+// setupHooks checks the hook executables and --hook-failure
+func setupHooks(config *Config, builder string) error {
+	config.hooks = build.Hooks{
+		PostBuild: config.PostBuildHook,
+		PrePush:   config.PrePushHook,
+		PostPush:  config.PostPushHook,
+		Failure:   config.HookFailure,
+		Builder:   builder,
+		DryRun:    config.DryRun,
+	}
+	if config.HookFailure != "" && !containsString(build.HookFailureModes, config.HookFailure) {
+		return fmt.Errorf("invalid --hook-failure %q (valid: %s)", config.HookFailure, strings.Join(build.HookFailureModes, ", "))
+	}
+	hooks := []struct{ flag, path string }{
+		{"--post-build-hook", config.PostBuildHook},
+		{"--pre-push-hook", config.PrePushHook},
+		{"--post-push-hook", config.PostPushHook},
+	}
+	for _, hook := range hooks {
+		if hook.path == "" {
+			continue
+		}
+		if err := build.ValidateHook(hook.flag, hook.path); err != nil {
+			return err
+		}
+	}
+	if config.PrePushHook != "" && builder == "buildkit" {
+		return fmt.Errorf("--pre-push-hook needs Buildah: BuildKit pushes while it builds; use --post-build-hook, or --staging-destination with --promote-webhook to gate the push")
+	}
+	if config.PrePushHook != "" && builder == "buildpacks" {
+		return fmt.Errorf("--pre-push-hook needs Buildah: the buildpacks lifecycle pushes while it builds; use --staging-destination with --promote-webhook to gate the push")
+	}
+	if (config.PrePushHook != "" || config.PostPushHook != "") && config.NoPush {
+		logger.Warning("--pre-push-hook and --post-push-hook do not run with --no-push")
+	}
 	return nil
 }
 
+// historyFile returns the --history-file, or the default history file
+func historyFile(config *Config) string {
+	if config.HistoryFile != "" {
+		return config.HistoryFile
+	}
+	return build.DefaultHistoryFile()
+}
+
 // convertAttestationConfigs converts main package AttestationConfig to build package AttestationConfig
 func convertAttestationConfigs(mainConfigs []AttestationConfig) []build.AttestationConfig {
 	buildConfigs := make([]build.AttestationConfig, len(mainConfigs))
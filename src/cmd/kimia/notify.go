@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// notifySecretEnv holds the HMAC key of notifications when no --notify-secret-file is given
+const notifySecretEnv = "KIMIA_NOTIFY_SECRET"
+
+// notifyConfig checks the --notify-* options and reads the signing secret.
+// It returns nil when no notification is wanted.
+func notifyConfig(config *Config) (*build.NotifyConfig, error) {
+	if config.NotifyURL == "" {
+		if config.NotifyFormat != "" || config.NotifySecretFile != "" {
+			logger.Warning("--notify-format and --notify-secret-file have no effect without --notify-url")
+		}
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.NotifyURL, "https://") && !strings.HasPrefix(config.NotifyURL, "http://") {
+		return nil, fmt.Errorf("--notify-url must be an http(s) URL")
+	}
+	if config.NotifyFormat != "" && !containsString(build.NotifyFormats, config.NotifyFormat) {
+		return nil, fmt.Errorf("invalid --notify-format %q (valid: %s)", config.NotifyFormat, strings.Join(build.NotifyFormats, ", "))
+	}
+
+	notify := &build.NotifyConfig{URL: config.NotifyURL, Format: config.NotifyFormat}
+	if config.NotifySecretFile != "" {
+		// #nosec G304 -- user-specified secret file, e.g. a mounted Kubernetes Secret
+		secret, err := os.ReadFile(config.NotifySecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --notify-secret-file: %v", err)
+		}
+		notify.Secret = []byte(strings.TrimSpace(string(secret)))
+	} else if secret := os.Getenv(notifySecretEnv); secret != "" {
+		notify.Secret = []byte(secret)
+	}
+	if len(notify.Secret) == 0 {
+		logger.Warning("Build notifications are not signed; set --notify-secret-file or %s", notifySecretEnv)
+	}
+	return notify, nil
+}
+
+// sendNotification posts the result of the build to --notify-url. A failed
+// notification is logged and does not change the result of the build.
+func sendNotification(config *Config, builder string, notify build.NotifyConfig, started time.Time, err error) {
+	notification := build.NewBuildNotification(config.builds, config.Destination, started, err)
+	if notification.Builder == "" {
+		notification.Builder = builder
+	}
+	if err == nil && !config.NoPush {
+		var attestations []string
+		if builder == "buildkit" {
+			attestations = attestationKinds(config)
+		}
+		notification.AddArtifacts(config.Sign && config.CosignKeyPath != "", attestations, config.attachments, config.attestationRepos)
+	}
+	if err := build.Notify(notify, notification); err != nil {
+		logger.Warning("%v", err)
+	}
+}
+
+// attestationKinds returns the attestations BuildKit adds to the image index
+func attestationKinds(config *Config) []string {
+	if len(config.AttestationConfigs) > 0 {
+		var kinds []string
+		for _, attestation := range config.AttestationConfigs {
+			if !containsString(kinds, attestation.Type) {
+				kinds = append(kinds, attestation.Type)
+			}
+		}
+		return kinds
+	}
+	switch config.Attestation {
+	case "min":
+		return []string{"provenance"}
+	case "max":
+		return []string{"sbom", "provenance"}
+	}
+	return nil
+}
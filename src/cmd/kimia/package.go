@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// packageSpec is the image `kimia package` builds: a base image with local
+// files copied in, from a Dockerfile it generates
+type packageSpec struct {
+	base       string
+	copies     []packageCopy
+	env        []string // KEY=VALUE
+	workdir    string
+	user       string
+	entrypoint []string
+	cmd        []string
+}
+
+// packageCopy is a --copy SRC:DEST of `kimia package`
+type packageCopy struct {
+	src, dest string
+}
+
+// parsePackageArgs takes the options of `kimia package` from args and returns
+// the remaining ones, which are build options
+func parsePackageArgs(args []string) (*packageSpec, []string, error) {
+	spec := &packageSpec{}
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		key, value, hasValue := strings.Cut(args[i], "=")
+		switch key {
+		case "--base", "--copy", "--env", "--workdir", "--user", "--entrypoint", "--cmd":
+		default:
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if value == "" && key != "--cmd" && key != "--entrypoint" {
+			return nil, nil, fmt.Errorf("%s requires a value", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, nil, fmt.Errorf("%s must not contain line breaks", key)
+		}
+		var err error
+		switch key {
+		case "--base":
+			spec.base = value
+		case "--copy":
+			sep := strings.LastIndex(value, ":")
+			if sep <= 0 || sep == len(value)-1 {
+				return nil, nil, fmt.Errorf("invalid --copy %q (expected SRC:DEST such as bin/app:/app)", value)
+			}
+			spec.copies = append(spec.copies, packageCopy{src: value[:sep], dest: value[sep+1:]})
+		case "--env":
+			if name, _, ok := strings.Cut(value, "="); !ok || name == "" || strings.ContainsAny(name, " \t") {
+				return nil, nil, fmt.Errorf("invalid --env %q (expected KEY=VALUE)", value)
+			}
+			spec.env = append(spec.env, value)
+		case "--workdir":
+			spec.workdir = value
+		case "--user":
+			spec.user = value
+		case "--entrypoint":
+			spec.entrypoint, err = parseExecForm(key, value)
+		case "--cmd":
+			spec.cmd, err = parseExecForm(key, value)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if spec.base == "" {
+		return nil, nil, fmt.Errorf("kimia package requires --base (e.g., --base=gcr.io/distroless/static)")
+	}
+	if len(spec.copies) == 0 {
+		return nil, nil, fmt.Errorf("kimia package requires at least one --copy SRC:DEST")
+	}
+	return spec, rest, nil
+}
+
+// parseExecForm parses --entrypoint and --cmd: a JSON array, or words
+// separated by spaces. An empty value clears the one of the base image.
+func parseExecForm(flag, value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "[") {
+		return append([]string{}, strings.Fields(value)...), nil
+	}
+	var words []string
+	if err := json.Unmarshal([]byte(value), &words); err != nil {
+		return nil, fmt.Errorf("invalid %s %s (expected a JSON array of strings): %v", flag, value, err)
+	}
+	return words, nil
+}
+
+// apply makes the build of config build the package: the context defaults to
+// the working directory, and the generated Dockerfile replaces --dockerfile
+func (spec *packageSpec) apply(config *Config) error {
+	if config.Dockerfile != "" || config.DockerfileContent != "" {
+		return fmt.Errorf("kimia package generates the Dockerfile and cannot be used with --dockerfile or --dockerfile-content")
+	}
+	if config.Context == "" {
+		config.Context = "."
+	}
+	if err := spec.checkSources(config.Context); err != nil {
+		return err
+	}
+	config.DockerfileContent = spec.dockerfile()
+	logger.Info("Packaging with the generated Dockerfile:")
+	for _, line := range strings.Split(strings.TrimSpace(config.DockerfileContent), "\n") {
+		logger.Info("  %s", line)
+	}
+	return nil
+}
+
+// checkSources makes the --copy sources relative to a local context and checks
+// that they exist. Sources in Git contexts are left to the builder.
+func (spec *packageSpec) checkSources(contextDir string) error {
+	if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+		return nil
+	}
+	root, err := filepath.Abs(contextDir)
+	if err != nil {
+		return err
+	}
+	for i, c := range spec.copies {
+		src := filepath.Clean(c.src)
+		if filepath.IsAbs(src) {
+			if src, err = filepath.Rel(root, src); err != nil {
+				return fmt.Errorf("--copy source %s is outside the context %s", c.src, contextDir)
+			}
+		}
+		if src == ".." || strings.HasPrefix(src, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("--copy source %s is outside the context %s", c.src, contextDir)
+		}
+		if !strings.ContainsAny(src, "*?[") {
+			if _, err := os.Stat(filepath.Join(root, src)); err != nil {
+				return fmt.Errorf("--copy source %s not found in the context %s", c.src, contextDir)
+			}
+		}
+		spec.copies[i].src = filepath.ToSlash(src)
+	}
+	return nil
+}
+
+// dockerfile generates the Dockerfile of the package
+func (spec *packageSpec) dockerfile() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FROM %s\n", spec.base)
+	for _, env := range spec.env {
+		name, value, _ := strings.Cut(env, "=")
+		// Quoted, and without variable expansion
+		fmt.Fprintf(&b, "ENV %s=%s\n", name, strings.ReplaceAll(strconv.Quote(value), "$", `\$`))
+	}
+	if spec.workdir != "" {
+		fmt.Fprintf(&b, "WORKDIR %s\n", spec.workdir)
+	}
+	for _, c := range spec.copies {
+		fmt.Fprintf(&b, "COPY %s\n", execForm([]string{c.src, c.dest}))
+	}
+	if spec.user != "" {
+		fmt.Fprintf(&b, "USER %s\n", spec.user)
+	}
+	if spec.entrypoint != nil {
+		fmt.Fprintf(&b, "ENTRYPOINT %s\n", execForm(spec.entrypoint))
+	}
+	if spec.cmd != nil {
+		fmt.Fprintf(&b, "CMD %s\n", execForm(spec.cmd))
+	}
+	return b.String()
+}
+
+// execForm formats words as the JSON array of an exec-form instruction
+func execForm(words []string) string {
+	data, _ := json.Marshal(words)
+	return string(data)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runPlan implements `kimia plan`: resolve the Dockerfile, build args, stages,
+// base image digests and required secrets without building anything.
+// It returns a non-zero exit code when the build would fail.
+func runPlan(args []string) int {
+	// Plan the current directory when no options are given
+	if len(args) == 0 {
+		args = []string{"--context=."}
+	}
+	config := parseArgs(args)
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+
+	if config.Context == "" {
+		config.Context = "."
+	}
+
+	if ws, err := build.StartWorkspace(); err != nil {
+		logger.Warning("Temporary directories will not be tracked: %v", err)
+	} else {
+		defer ws.Close()
+	}
+
+	removeCABundle, err := installCABundle(config)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(config); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	plan, err := generatePlan(config, !config.Offline)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	build.PrintPlan(plan)
+	if plan.HasErrors() {
+		return 1
+	}
+	return 0
+}
+
+// generatePlan prepares a local checkout of the build context and resolves the
+// Dockerfile. When resolve is true, base image digests are looked up.
+func generatePlan(config *Config, resolve bool) (*build.Plan, error) {
+	// Always prepare a local checkout so the Dockerfile can be read
+	ctx, err := build.Prepare(build.GitConfig{
+		Context:     config.Context,
+		Branch:      config.GitBranch,
+		Revision:    config.GitRevision,
+		TokenFile:   config.GitTokenFile,
+		TokenUser:   config.GitTokenUser,
+		SSHKeyFile:  config.GitSSHKeyFile,
+		Depth:       config.GitDepth,
+		Filter:      config.GitFilter,
+		SparsePaths: config.GitSparsePaths,
+	}, "buildah")
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare build context: %v", err)
+	}
+	defer ctx.Cleanup()
+
+	// A subdirectory from the context URL (repo.git#ref:dir) applies unless
+	// --context-sub-path is given
+	if config.SubContext == "" {
+		config.SubContext = ctx.SubContext
+	}
+	if config.SubContext != "" {
+		subPath := filepath.Join(ctx.Path, filepath.Clean("/"+config.SubContext))
+		if rel, err := filepath.Rel(ctx.Path, subPath); err != nil || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("context sub-path attempts to escape build context: %s", config.SubContext)
+		}
+		ctx.Path = subPath
+	}
+	dockerfile, err := ctx.ResolveDockerfile(config.Dockerfile, config.DockerfileContent)
+	if err != nil {
+		return nil, err
+	}
+
+	if resolve {
+		// Credentials from DOCKER_USERNAME/DOCKER_PASSWORD are needed for private base images
+		if err := auth.Setup(auth.SetupConfig{Destinations: config.Destination, NoCIAuth: config.NoCIAuth}); err != nil {
+			logger.Warning("Authentication setup failed: %v", err)
+		}
+	}
+
+	return build.GeneratePlan(build.Config{
+		Dockerfile:        dockerfile,
+		Target:            lastTarget(config),
+		BuildArgs:         config.BuildArgs,
+		Insecure:          config.Insecure,
+		InsecurePull:      config.InsecurePull,
+		InsecureRegistry:  config.InsecureRegistry,
+		BaseImageRewrites: config.BaseImageRewrites,
+	}, ctx, resolve)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runPushArtifact implements `kimia push-artifact --type TYPE --file FILE
+// --destination REF`: push files that are not a container image, such as WASM
+// modules or Helm charts, as an OCI artifact with the registry credentials,
+// TLS settings and cosign signing of a build
+func runPushArtifact(args []string) int {
+	usage := "Usage: kimia push-artifact --type=application/vnd.wasm.module.v1 --file=module.wasm[:MEDIATYPE] --destination=registry/app:tag [--config=FILE[:MEDIATYPE]] [--annotation=KEY=VALUE] [--sign] [options]"
+	artifact := build.Artifact{Annotations: make(map[string]string)}
+	var files []string
+	var configFile string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		if idx := strings.Index(flag, "="); idx > 0 {
+			flag, value = flag[:idx], flag[idx+1:]
+		}
+		switch flag {
+		case "--type", "--file", "--config", "--annotation":
+			if value == "" && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			}
+			if value == "" {
+				logger.Setup("", false)
+				logger.Error("%s requires a value", flag)
+				return 1
+			}
+			switch flag {
+			case "--type":
+				artifact.Type = value
+			case "--file":
+				files = append(files, value)
+			case "--config":
+				configFile = value
+			case "--annotation":
+				key, annotation, ok := strings.Cut(value, "=")
+				if !ok || key == "" {
+					logger.Setup("", false)
+					logger.Error("Invalid --annotation %q (expected KEY=VALUE)", value)
+					return 1
+				}
+				artifact.Annotations[key] = annotation
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	config := parseArgs(rest)
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+
+	if artifact.Type == "" || len(files) == 0 || len(config.Destination) == 0 {
+		logger.Error("%s", usage)
+		return 1
+	}
+	if !strings.Contains(artifact.Type, "/") {
+		logger.Error("--type must be a media type such as application/vnd.wasm.module.v1")
+		return 1
+	}
+	for _, spec := range files {
+		file, err := build.ParseArtifactFile(spec, "")
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		if info, err := os.Stat(file.Path); err != nil || !info.Mode().IsRegular() {
+			logger.Error("--file %s is not a readable file", file.Path)
+			return 1
+		}
+		artifact.Files = append(artifact.Files, file)
+	}
+	if configFile != "" {
+		file, err := build.ParseArtifactFile(configFile, "application/json")
+		if err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+		if info, err := os.Stat(file.Path); err != nil || !info.Mode().IsRegular() {
+			logger.Error("--config %s is not a readable file", file.Path)
+			return 1
+		}
+		artifact.Config = &file
+	}
+
+	attestationRepos, err := build.ParseAttestationRepos(config.AttestationRepo)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if config.Sign {
+		if err := resolveCosignSecrets(config); err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+
+	removeCABundle, err := installCABundle(config)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(config); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	if err := auth.Setup(auth.SetupConfig{Destinations: config.Destination, InsecureRegistry: config.InsecureRegistry, NoCIAuth: config.NoCIAuth}); err != nil {
+		logger.Error("Failed to setup authentication: %v", err)
+		return 1
+	}
+	if err := applyRegistryPins(config, config.Destination); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	buildConfig := build.Config{
+		Destination:                config.Destination,
+		Insecure:                   config.Insecure,
+		InsecureRegistry:           config.InsecureRegistry,
+		DigestFile:                 config.DigestFile,
+		ImageNameWithDigestFile:    config.ImageNameWithDigestFile,
+		ImageNameTagWithDigestFile: config.ImageNameTagWithDigestFile,
+		DigestMapFile:              config.DigestMapFile,
+		AttestationRepos:           attestationRepos,
+		Sign:                       config.Sign,
+		CosignKeyPath:              config.CosignKeyPath,
+		CosignPasswordEnv:          config.CosignPasswordEnv,
+		CosignPasswordFile:         config.CosignPasswordFile,
+		EventsFile:                 config.EventsFile,
+		DryRun:                     config.DryRun,
+	}
+	digest, err := build.PushArtifact(buildConfig, artifact)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	if config.DryRun {
+		return 0
+	}
+
+	digestMap := make(map[string]string, len(config.Destination))
+	for _, dest := range config.Destination {
+		digestMap[dest] = digest
+	}
+	if err := build.SaveDigestInfo(buildConfig, digestMap); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	logger.Info("Pushed artifact %s to %s", digest, strings.Join(config.Destination, ", "))
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Results reported by `kimia rebuild-if-base-changed`
+const (
+	rebuildResultNoChange = "no-change"
+	rebuildResultRebuilt  = "rebuilt"
+)
+
+// baseRefresh carries the resolved base images of `kimia rebuild-if-base-changed`
+// through the build so they can be recorded once it succeeds
+type baseRefresh struct {
+	baseImages []build.BaseImageDigest
+}
+
+// checkBaseImages resolves the current base image digests and compares them
+// with the previous build's metadata or provenance. It returns nil when no
+// base image changed and the build can be skipped.
+func checkBaseImages(config *Config) (*baseRefresh, error) {
+	if config.Metadata == "" {
+		return nil, exitcode.Wrap(exitcode.Config, fmt.Errorf("rebuild-if-base-changed requires --metadata (previous build metadata or provenance)"))
+	}
+
+	logger.Info("Resolving base image digests...")
+	plan, err := generatePlan(config, true)
+	if err != nil {
+		return nil, exitcode.Wrap(exitcode.Build, err)
+	}
+	if plan.HasErrors() {
+		return nil, exitcode.Wrap(exitcode.Build, fmt.Errorf("cannot resolve base images: %s", strings.Join(plan.Errors, "; ")))
+	}
+	refresh := &baseRefresh{baseImages: build.PlanBaseImages(plan)}
+
+	previous, err := build.LoadBaseImageDigests(config.Metadata)
+	if os.IsNotExist(err) {
+		logger.Info("No previous build metadata at %s, rebuilding", config.Metadata)
+		return refresh, nil
+	}
+	if err != nil {
+		return nil, exitcode.Wrap(exitcode.Config, err)
+	}
+
+	changes := build.CompareBaseImages(previous, refresh.baseImages)
+	if len(changes) == 0 {
+		logger.Info("No base image changed since the previous build:")
+		for _, image := range refresh.baseImages {
+			logger.Info("  %s@%s", image.Ref, image.Digest)
+		}
+		return nil, nil
+	}
+
+	logger.Info("Base images changed since the previous build:")
+	for _, change := range changes {
+		if change.PreviousDigest == "" {
+			logger.Info("  %s: new base image (%s)", change.Ref, change.CurrentDigest)
+		} else {
+			logger.Info("  %s: %s -> %s", change.Ref, change.PreviousDigest, change.CurrentDigest)
+		}
+	}
+	return refresh, nil
+}
+
+// save records the base images of the completed build for the next run
+func (r *baseRefresh) save(config *Config) error {
+	return build.WriteBuildMetadata(config.Metadata, build.BuildMetadata{
+		Destinations: config.Destination,
+		Built:        time.Now().UTC(),
+		BaseImages:   r.baseImages,
+	})
+}
+
+// reportRebuildResult prints the result marker and writes it to --result-file
+func reportRebuildResult(config *Config, result string) {
+	fmt.Printf("KIMIA_REBUILD_RESULT=%s\n", result)
+	if config.ResultFile == "" {
+		return
+	}
+	// #nosec G306 -- 0644 for a pipeline result marker (not sensitive)
+	if err := os.WriteFile(config.ResultFile, []byte(result+"\n"), 0644); err != nil {
+		logger.Warning("Failed to write result file %s: %v", config.ResultFile, err)
+	}
+}
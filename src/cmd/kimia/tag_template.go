@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/internal/validation"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// invalidTagChars matches what an image tag cannot contain
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// templateData holds the variables of a --tag-template or a --label template
+type templateData struct {
+	Registry         string // Registry of the destination, e.g. registry.io ("docker.io" if none)
+	Repo             string // Repository of the destination, e.g. team/app
+	Image            string // Destination without its tag
+	Tag              string // Tag of the destination, "" if none
+	GitSHA           string
+	GitShortSHA      string
+	GitBranch        string // Branch built, "" for tags and detached checkouts
+	GitTag           string // Tag built, "" otherwise
+	GitRef           string // Branch or tag name
+	GitURL           string // Repository URL without credentials, "" if unknown
+	Date             string // UTC date, 20060102
+	Timestamp        string // UTC time, 20060102150405
+	TimestampRFC3339 string // UTC time, 2006-01-02T15:04:05Z
+	Unix             string // Seconds since the epoch
+	Platform         string // Target platform(s), e.g. linux/amd64
+	BuildArgs        map[string]string
+	Env              map[string]string
+}
+
+// newTemplateData returns the variables that do not depend on the destination
+func newTemplateData(config *Config, source *build.SourceInfo) templateData {
+	data := templateData{BuildArgs: config.BuildArgs, Platform: config.CustomPlatform, Env: environMap(config)}
+	if data.Platform == "" {
+		data.Platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	now := time.Now().UTC()
+	// Reproducible builds use their fixed timestamp
+	if epoch, err := strconv.ParseInt(config.Timestamp, 10, 64); err == nil {
+		now = time.Unix(epoch, 0).UTC()
+	}
+	data.Date, data.Timestamp, data.Unix = now.Format("20060102"), now.Format("20060102150405"), strconv.FormatInt(now.Unix(), 10)
+	data.TimestampRFC3339 = now.Format(time.RFC3339)
+	if source != nil {
+		data.GitSHA = source.Commit
+		data.GitShortSHA = source.Commit
+		if len(data.GitShortSHA) > 7 {
+			data.GitShortSHA = data.GitShortSHA[:7]
+		}
+		data.GitURL = source.URL
+		switch {
+		case strings.HasPrefix(source.Ref, "refs/heads/"):
+			data.GitBranch = strings.TrimPrefix(source.Ref, "refs/heads/")
+			data.GitRef = data.GitBranch
+		case strings.HasPrefix(source.Ref, "refs/tags/"):
+			data.GitTag = strings.TrimPrefix(source.Ref, "refs/tags/")
+			data.GitRef = data.GitTag
+		}
+	}
+	return data
+}
+
+// environMap returns the environment --env-allowlist allows as a map
+func environMap(config *Config) map[string]string {
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if key, value, ok := strings.Cut(entry, "="); ok && envAllowed(config, key) {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// parseTagTemplates parses --tag-template values
+func parseTagTemplates(texts []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, len(texts))
+	for i, text := range texts {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --tag-template %q: %v", text, err)
+		}
+		templates[i] = tmpl
+	}
+	return templates, nil
+}
+
+// renderTagTemplates replaces every destination with the images its
+// --tag-template values render to, in config and in the target builds.
+// Characters a tag cannot hold (e.g. the / of a branch) become -.
+func renderTagTemplates(config *Config, targetBuilds []build.TargetBuild, source *build.SourceInfo) error {
+	templates, err := parseTagTemplates(config.TagTemplates)
+	if err != nil || len(templates) == 0 {
+		return err
+	}
+
+	base := newTemplateData(config, source)
+
+	rendered := map[string][]string{}
+	render := func(destination string) ([]string, error) {
+		if images, ok := rendered[destination]; ok {
+			return images, nil
+		}
+		data := base
+		data.Image, data.Tag = splitDestinationTag(destination)
+		data.Registry, data.Repo = splitDestinationRegistry(data.Image)
+
+		var images []string
+		for i, tmpl := range templates {
+			var out strings.Builder
+			if err := tmpl.Execute(&out, data); err != nil {
+				return nil, fmt.Errorf("--tag-template %q: %v", config.TagTemplates[i], err)
+			}
+			image := sanitizeRenderedTag(strings.TrimSpace(out.String()))
+			err := validation.ValidateImageName(image)
+			if err == nil && strings.HasSuffix(image, ":") {
+				err = fmt.Errorf("the tag is empty")
+			}
+			if err != nil {
+				if source == nil && strings.Contains(config.TagTemplates[i], ".Git") {
+					return nil, fmt.Errorf("--tag-template %q rendered %q: %v (the context is not a Git repository, so Git variables are empty)", config.TagTemplates[i], image, err)
+				}
+				return nil, fmt.Errorf("--tag-template %q rendered %q: %v", config.TagTemplates[i], image, err)
+			}
+			images = appendUnique(images, image)
+		}
+		rendered[destination] = images
+		return images, nil
+	}
+
+	renderAll := func(destinations []string) ([]string, error) {
+		var result []string
+		for _, destination := range destinations {
+			images, err := render(destination)
+			if err != nil {
+				return nil, err
+			}
+			for _, image := range images {
+				result = appendUnique(result, image)
+			}
+		}
+		return result, nil
+	}
+
+	if config.Destination, err = renderAll(config.Destination); err != nil {
+		return err
+	}
+	for i := range targetBuilds {
+		if targetBuilds[i].Destinations, err = renderAll(targetBuilds[i].Destinations); err != nil {
+			return err
+		}
+	}
+	for _, destination := range config.Destination {
+		logger.Info("Tag template destination: %s", destination)
+	}
+	return nil
+}
+
+// splitDestinationTag splits an image reference into name and tag; a digest
+// is dropped since rendered destinations are tagged
+func splitDestinationTag(ref string) (string, string) {
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		ref = ref[:idx]
+	}
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		return ref[:idx], ref[idx+1:]
+	}
+	return ref, ""
+}
+
+// splitDestinationRegistry splits an image name into registry and repository
+// the way Docker does: the first component is a registry if it has a dot or
+// port, or is localhost
+func splitDestinationRegistry(name string) (string, string) {
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		domain := name[:idx]
+		if strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			return domain, name[idx+1:]
+		}
+	}
+	return "docker.io", name
+}
+
+// sanitizeRenderedTag makes the tag of a rendered image valid: invalid
+// characters become -, and it may not start with . or - or exceed 128 characters.
+// The tag starts at the first : after the registry, since the template data
+// may hold a / (a branch), : (a timestamp) or @.
+func sanitizeRenderedTag(image string) string {
+	idx := strings.Index(image, ":")
+	if slash := strings.Index(image, "/"); slash >= 0 {
+		// A : before the first / is a registry port
+		if idx = strings.Index(image[slash:], ":"); idx >= 0 {
+			idx += slash
+		}
+	}
+	if idx < 0 {
+		return image
+	}
+	name, tag := image[:idx], image[idx+1:]
+	tag = strings.TrimLeft(invalidTagChars.ReplaceAllString(tag, "-"), ".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return name + ":" + tag
+}
+
+// appendUnique appends value unless list already has it
+func appendUnique(list []string, value string) []string {
+	for _, item := range list {
+		if item == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rapidfort/kimia/internal/build"
+)
+
+func TestSplitDestinationTag(t *testing.T) {
+	tests := []struct {
+		ref      string
+		wantName string
+		wantTag  string
+	}{
+		{"app", "app", ""},
+		{"app:1.0", "app", "1.0"},
+		{"reg.io/team/app:v1", "reg.io/team/app", "v1"},
+		{"localhost:5000/app", "localhost:5000/app", ""},
+		{"localhost:5000/app:dev", "localhost:5000/app", "dev"},
+		{"reg.io/app@sha256:0123abcd", "reg.io/app", ""},
+		{"reg.io/app:v1@sha256:0123abcd", "reg.io/app", "v1"},
+		{"reg.io/app:", "reg.io/app", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			name, tag := splitDestinationTag(tt.ref)
+			if name != tt.wantName || tag != tt.wantTag {
+				t.Errorf("splitDestinationTag(%q) = %q, %q, want %q, %q", tt.ref, name, tag, tt.wantName, tt.wantTag)
+			}
+		})
+	}
+}
+
+func TestSplitDestinationRegistry(t *testing.T) {
+	tests := []struct {
+		name         string
+		wantRegistry string
+		wantRepo     string
+	}{
+		{"app", "docker.io", "app"},
+		{"team/app", "docker.io", "team/app"},
+		{"localhost/app", "localhost", "app"},
+		{"localhost:5000/app", "localhost:5000", "app"},
+		{"reg.io/team/app", "reg.io", "team/app"},
+		{"reg:5000/app", "reg:5000", "app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, repo := splitDestinationRegistry(tt.name)
+			if registry != tt.wantRegistry || repo != tt.wantRepo {
+				t.Errorf("splitDestinationRegistry(%q) = %q, %q, want %q, %q", tt.name, registry, repo, tt.wantRegistry, tt.wantRepo)
+			}
+		})
+	}
+}
+
+func TestSanitizeRenderedTag(t *testing.T) {
+	long := strings.Repeat("a", 200)
+
+	tests := []struct {
+		name  string
+		image string
+		want  string
+	}{
+		{
+			name:  "valid tag",
+			image: "reg.io/app:v1.2_3-rc",
+			want:  "reg.io/app:v1.2_3-rc",
+		},
+		{
+			name:  "no tag",
+			image: "reg.io/app",
+			want:  "reg.io/app",
+		},
+		{
+			name:  "no tag after a registry port",
+			image: "localhost:5000/app",
+			want:  "localhost:5000/app",
+		},
+		{
+			name:  "branch with a slash",
+			image: "localhost:5000/app:feature/x",
+			want:  "localhost:5000/app:feature-x",
+		},
+		{
+			name:  "invalid characters",
+			image: "reg.io/app:fix #12 @home",
+			want:  "reg.io/app:fix-12-home",
+		},
+		{
+			name:  "timestamp with colons",
+			image: "localhost:5000/app:2026-01-02T03:04:05Z",
+			want:  "localhost:5000/app:2026-01-02T03-04-05Z",
+		},
+		{
+			name:  "branch with a slash and no registry",
+			image: "app:feature/x",
+			want:  "app:feature/x",
+		},
+		{
+			name:  "leading dots and dashes",
+			image: "reg.io/app:.-/v1",
+			want:  "reg.io/app:v1",
+		},
+		{
+			name:  "empty branch",
+			image: "reg.io/app:",
+			want:  "reg.io/app:",
+		},
+		{
+			name:  "cut at 128 characters",
+			image: "reg.io/app:" + long,
+			want:  "reg.io/app:" + long[:128],
+		},
+		{
+			name:  "cut after sanitizing",
+			image: "reg.io/app:-" + long,
+			want:  "reg.io/app:" + long[:128],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeRenderedTag(tt.image); got != tt.want {
+				t.Errorf("sanitizeRenderedTag(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTagTemplates(t *testing.T) {
+	branch := &build.SourceInfo{Ref: "refs/heads/feature/login", Commit: "0123456789abcdef"}
+	tag := &build.SourceInfo{Ref: "refs/tags/v1.0", Commit: "0123456789abcdef"}
+
+	tests := []struct {
+		name         string
+		destinations []string
+		templates    []string
+		source       *build.SourceInfo
+		want         []string
+		wantErr      string
+	}{
+		{
+			name:         "branch and short SHA",
+			destinations: []string{"localhost:5000/app:latest"},
+			templates:    []string{"{{.Image}}:{{.GitBranch}}", "{{.Registry}}/{{.Repo}}:{{.GitShortSHA}}"},
+			source:       branch,
+			want:         []string{"localhost:5000/app:feature-login", "localhost:5000/app:0123456"},
+		},
+		{
+			name:         "duplicates are dropped",
+			destinations: []string{"reg.io/app:1", "reg.io/app:2"},
+			templates:    []string{"{{.Image}}:{{.GitRef}}"},
+			source:       tag,
+			want:         []string{"reg.io/app:v1.0"},
+		},
+		{
+			name:         "digest of the destination is dropped",
+			destinations: []string{"reg.io/app:v1@sha256:0123abcd"},
+			templates:    []string{"{{.Image}}:{{.Tag}}-{{.GitShortSHA}}"},
+			source:       branch,
+			want:         []string{"reg.io/app:v1-0123456"},
+		},
+		{
+			name:         "empty branch of a tag build",
+			destinations: []string{"reg.io/app:1"},
+			templates:    []string{"reg.io/app:{{.GitBranch}}"},
+			source:       tag,
+			wantErr:      `rendered "reg.io/app:": the tag is empty`,
+		},
+		{
+			name:         "no Git repository",
+			destinations: []string{"reg.io/app:1"},
+			templates:    []string{"reg.io/app:{{.GitBranch}}"},
+			wantErr:      "the context is not a Git repository",
+		},
+		{
+			name:         "unknown variable",
+			destinations: []string{"reg.io/app:1"},
+			templates:    []string{"{{.Image}}:{{.Env.MISSING}}"},
+			wantErr:      `--tag-template "{{.Image}}:{{.Env.MISSING}}"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Destination: tt.destinations, TagTemplates: tt.templates}
+			err := renderTagTemplates(config, nil, tt.source)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renderTagTemplates() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderTagTemplates() error = %v", err)
+			}
+			if !reflect.DeepEqual(config.Destination, tt.want) {
+				t.Errorf("renderTagTemplates() destinations = %#v, want %#v", config.Destination, tt.want)
+			}
+		})
+	}
+}
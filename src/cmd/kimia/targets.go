@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/rapidfort/kimia/internal/build"
+)
+
+// resolveTargetBuilds parses target-mapped destinations and assigns every
+// destination to a --target stage. Mapped images are added to
+// config.Destination so authentication and registry checks cover them.
+func resolveTargetBuilds(config *Config) ([]build.TargetBuild, error) {
+	var mapped []build.TargetDestination
+	for _, spec := range config.TargetDestinations {
+		dest, err := build.ParseTargetDestination(spec)
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, dest)
+	}
+
+	builds, err := build.PlanTargetBuilds(config.Targets, config.Destination, mapped)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dest := range mapped {
+		config.Destination = append(config.Destination, dest.Image)
+	}
+	config.TargetDestinations = nil
+	return builds, nil
+}
+
+// lastTarget returns the stage built by a single-target command such as
+// `kimia plan`: the last --target, or the final stage when none is given
+func lastTarget(config *Config) string {
+	if len(config.Targets) == 0 {
+		return ""
+	}
+	return config.Targets[len(config.Targets)-1]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// reuseUnchangedBuild looks up the last build in the history with the same
+// input hash and tags its image with the destinations. It reports whether the
+// build was skipped; when the inputs cannot be hashed or the earlier image
+// cannot be copied, the build runs as usual.
+func reuseUnchangedBuild(config *Config, buildConfig build.Config, ctx *build.Context, record *build.BuildRecord) bool {
+	if len(buildConfig.Attach) > 0 {
+		logger.Info("--skip-unchanged: building, since --attach files are attached to newly pushed images")
+		return false
+	}
+	logger.Info("Hashing the build inputs (--skip-unchanged)...")
+	if err := record.ResolveInputHash(buildConfig, ctx); err != nil {
+		logger.Warning("--skip-unchanged: %v; building", err)
+		return false
+	}
+	logger.Info("Input hash: %s", record.Inputs.InputHash)
+
+	previous, err := build.LastUnchangedBuild(historyFile(config), record)
+	if err != nil {
+		logger.Warning("--skip-unchanged: %v; building", err)
+		return false
+	}
+	if previous == nil {
+		logger.Info("No earlier build with the same inputs, building")
+		return false
+	}
+
+	digests, err := build.ReuseBuild(buildConfig, previous, buildConfig.Destination, config.PushRetry)
+	if err != nil {
+		logger.Warning("Cannot reuse the image of build %s: %v; building", previous.ID, err)
+		return false
+	}
+	if config.DryRun {
+		return true
+	}
+	record.ReusedFrom = previous.ID
+	record.SetDigests(digests)
+	if err := build.SaveDigestInfo(buildConfig, digests); err != nil {
+		logger.Warning("Failed to save digest information: %v", err)
+	}
+	logger.Info("Skipped the build: tagged the image of build %s", previous.ID)
+	return true
+}
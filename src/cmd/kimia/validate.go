@@ -0,0 +1,404 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/internal/validation"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// storageDrivers lists the --storage-driver values of each builder
+var storageDrivers = map[string][]string{
+	"buildkit": {"native", "overlay"},
+	"buildah":  {"vfs", "overlay"},
+}
+
+// validateBuildRequest checks the options every build needs, before a
+// builder is selected, and assigns the destinations to the --target stages
+func validateBuildRequest(config *Config) ([]build.TargetBuild, error) {
+	var errs validation.Errors
+	if config.Context == "" {
+		errs.Add("--context is required: Kimia only supports BUILD mode (kimia --context=. --destination=registry/image:tag)")
+	}
+	if config.Scan {
+		errs.Add("--scan is an enterprise-only feature; this is the OSS version, which supports build-only operations")
+	}
+	if config.Harden {
+		errs.Add("--harden is an enterprise-only feature; this is the OSS version, which supports build-only operations")
+	}
+	targetBuilds, err := resolveTargetBuilds(config)
+	errs.Check(err)
+	if err == nil && len(config.Destination) == 0 {
+		errs.Add("--destination is required: name the image to build (kimia --context=. --destination=registry/image:tag)")
+	}
+	return targetBuilds, errs.Err()
+}
+
+// validateConfig checks the options of a build for the detected builder and
+// parses those with a value syntax of their own. Every problem is collected,
+// so that a misconfigured build reports them all at once. Nothing is set up
+// here; prepareBuild does that once the options are valid.
+func validateConfig(config *Config, builder string) error {
+	var errs validation.Errors
+
+	if config.StorageDriver != "" && builder != "buildpacks" {
+		driver := strings.ToLower(config.StorageDriver)
+		if valid := storageDrivers[builder]; !containsString(valid, driver) {
+			errs.Add("invalid storage driver '%s' for %s (valid: %s)", sanitizeForOutput(config.StorageDriver, 50), builder, strings.Join(valid, ", "))
+		}
+	}
+
+	// Buildah has no equivalent of these; dropping them would silently weaken
+	// the supply-chain guarantees the build asked for
+	if builder == "buildah" {
+		if unsupported := buildKitOnlyFlags(config); len(unsupported) > 0 {
+			errs.Add("Buildah does not support %s; build with BuildKit (--builder=buildkit) or remove them", strings.Join(unsupported, ", "))
+		}
+	}
+	if builder == "buildpacks" {
+		if unsupported := buildpacksUnsupportedFlags(config); len(unsupported) > 0 {
+			errs.Add("--builder=buildpacks does not support %s: buildpacks build without a Dockerfile and push the image themselves", strings.Join(unsupported, ", "))
+		}
+	}
+
+	if config.Sign {
+		switch {
+		case config.NoPush && config.TarPath != "":
+			errs.Add("--sign signs pushed images and cannot be used with --tar-path and --no-push")
+		case config.NoPush:
+			errs.Add("--sign signs pushed images and cannot be used with --no-push")
+		case config.Load != "":
+			errs.Add("--sign signs pushed images and cannot be used with --load")
+		}
+		errs.Check(resolveCosignSecrets(config))
+	}
+
+	config.maxLayerBytes = parseSizeOption(&errs, "--max-layer-size", config.MaxLayerSize)
+	config.maxImageBytes = parseSizeOption(&errs, "--max-image-size", config.MaxImageSize)
+	config.maxContextBytes = parseSizeOption(&errs, "--max-context-size", config.MaxContextSize)
+	config.contextWarningBytes = parseSizeOption(&errs, "--context-size-warning", config.ContextSizeWarning)
+	config.pushChunkBytes = parseSizeOption(&errs, "--push-chunk-size", config.PushChunkSize)
+
+	if config.BuildTimeout != "" {
+		timeout, err := time.ParseDuration(config.BuildTimeout)
+		if err != nil || timeout <= 0 {
+			errs.Add("invalid --build-timeout %q (expected a positive duration such as 45m)", config.BuildTimeout)
+		}
+		config.buildTimeout = timeout
+	}
+	if config.PushTimeout != "" {
+		timeout, err := time.ParseDuration(config.PushTimeout)
+		if err != nil || timeout <= 0 {
+			errs.Add("invalid --push-timeout %q (expected a positive duration such as 10m)", config.PushTimeout)
+		}
+		config.pushTimeout = timeout
+	}
+	if config.HeartbeatInterval != "" {
+		interval, err := time.ParseDuration(config.HeartbeatInterval)
+		if err != nil || interval < 0 {
+			errs.Add("invalid --heartbeat-interval %q (expected a duration such as 5m, or 0 to disable)", config.HeartbeatInterval)
+		}
+		config.heartbeat = interval
+	}
+	config.debugHold = build.DefaultDebugHold
+	if config.DebugHold != "" {
+		hold, err := time.ParseDuration(config.DebugHold)
+		if err != nil || hold < 0 {
+			errs.Add("invalid --debug-hold %q (expected a duration such as 30m, or 0 not to hold)", config.DebugHold)
+		} else {
+			if !config.DebugOnFailure {
+				logger.Warning("--debug-hold has no effect without --debug-on-failure")
+			}
+			config.debugHold = hold
+		}
+	}
+
+	errs.Check(setupHooks(config, builder))
+	if config.SkipUnchanged {
+		switch {
+		case config.NoHistory:
+			errs.Add("--skip-unchanged looks up earlier builds in the history and cannot be used with --no-history")
+		case config.NoPush || config.TarPath != "" || config.Load != "":
+			errs.Add("--skip-unchanged reuses pushed images and cannot be used with --no-push, --tar-path or --load")
+		}
+	}
+	if config.SBOMDiff {
+		switch {
+		case config.NoHistory:
+			errs.Add("--sbom-diff looks up the previous build in the history and cannot be used with --no-history")
+		case config.NoPush || config.TarPath != "" || config.Load != "":
+			errs.Add("--sbom-diff compares pushed images and cannot be used with --no-push, --tar-path or --load")
+		}
+	}
+	if config.PinRegistryCert && config.Insecure {
+		errs.Add("--pin-registry-cert cannot be used with --insecure, which turns off certificate checks for every registry; list registries without TLS in --insecure-registry instead")
+	}
+	if config.PushJobs < 0 {
+		errs.Add("--push-jobs must not be negative")
+	}
+	if config.PushBackend != "" && !containsString(build.PushBackends, config.PushBackend) {
+		errs.Add("invalid --push-backend %q (valid: %s)", config.PushBackend, strings.Join(build.PushBackends, ", "))
+	}
+	if config.Compression != "" && !containsString(build.Compressions, config.Compression) {
+		errs.Add("invalid --compression %q (valid: %s)", config.Compression, strings.Join(build.Compressions, ", "))
+	} else {
+		errs.Check(build.ValidateCompressionLevel(config.Compression, config.CompressionLevel))
+	}
+
+	config.attachments = nil
+	for _, spec := range config.Attach {
+		attachment, err := build.ParseAttachment(spec)
+		if err != nil {
+			errs.Check(err)
+			continue
+		}
+		if info, err := os.Stat(attachment.File); err != nil || !info.Mode().IsRegular() {
+			errs.Add("--attach file %s is not a readable file", attachment.File)
+			continue
+		}
+		config.attachments = append(config.attachments, attachment)
+	}
+	if len(config.attachments) > 0 && (config.NoPush || config.Load != "") {
+		logger.Warning("--attach has no effect without a push")
+	}
+
+	config.chains = nil
+	for _, spec := range config.Chain {
+		chain, err := build.ParseChainBuild(spec)
+		if err != nil {
+			errs.Check(err)
+			continue
+		}
+		config.chains = append(config.chains, chain)
+	}
+	if len(config.chains) > 0 {
+		switch {
+		case len(config.BuilderEndpoints) > 0:
+			errs.Add("--chain cannot be used with --builder-endpoint: chained builds need the primary image on the same builder")
+		case builder == "buildah" && len(config.Destination) == 0 && len(config.TargetDestinations) == 0:
+			errs.Add("--chain with Buildah needs a --destination to refer to the primary image by")
+		}
+	}
+
+	config.testCmd = nil
+	if config.TestCmd != "" {
+		argv, err := build.ParseTestCommand(config.TestCmd)
+		errs.Check(err)
+		config.testCmd = argv
+		switch {
+		case len(config.BuilderEndpoints) > 0:
+			errs.Add("--test-cmd cannot be used with --builder-endpoint: the image is tested on the builder that built it")
+		case builder == "buildkit" && !config.NoPush && config.Load == "" && config.StagingDestination == "":
+			errs.Add("--test-cmd with BuildKit needs --staging-destination: BuildKit pushes while it builds, so only promotion can wait for the test")
+		}
+	}
+
+	if repos, err := build.ParseAttestationRepos(config.AttestationRepo); err != nil {
+		errs.Check(err)
+	} else {
+		config.attestationRepos = repos
+		if repos.IsSet() && (config.NoPush || config.Load != "") {
+			logger.Warning("--attestation-repo has no effect without a push")
+		}
+	}
+
+	errs.Check(resolveContextNormalization(config))
+	errs.Check(resolveScanWebhook(config))
+	errs.Check(parseSecrets(config))
+	errs.Check(resolvePlatform(config))
+	errs.Check(validatePromoteOptions(config))
+	errs.Check(validateOfflineOptions(config))
+	errs.Check(validateNetworkOptions(config))
+	errs.Check(validatePrivilegedSteps(config, builder))
+	return errs.Err()
+}
+
+// resolveCosignSecrets takes the signing key, and the password unless it is
+// given otherwise, from the secret at --cosign-key-secret-path and checks
+// that they can be read
+func resolveCosignSecrets(config *Config) error {
+	var errs validation.Errors
+	key, password := build.CosignSecretFiles(config.CosignKeySecretPath)
+	if config.CosignKeyPath == "" {
+		config.CosignKeyPath = key
+	}
+	// KMS and other key URIs are resolved by cosign
+	if !strings.Contains(config.CosignKeyPath, "://") {
+		errs.Check(build.CheckSecretFile("--cosign-key", config.CosignKeyPath))
+	}
+
+	// An explicit password file, then the environment variable, then the secret
+	if config.CosignPasswordFile == "" && os.Getenv(config.CosignPasswordEnv) == "" {
+		config.CosignPasswordFile = password
+	}
+	if config.CosignPasswordFile != "" {
+		errs.Check(build.CheckSecretFile("--cosign-password-file", config.CosignPasswordFile))
+	}
+	return errs.Err()
+}
+
+// scanWebhookSecretEnv holds the HMAC key of scan requests when no
+// --scan-webhook-secret-file is given
+const scanWebhookSecretEnv = "KIMIA_SCAN_WEBHOOK_SECRET"
+
+// resolveScanWebhook checks the --scan-webhook options and reads the secret
+// signing the requests
+func resolveScanWebhook(config *Config) error {
+	config.scanWebhook = build.ScanWebhookConfig{}
+	if config.ScanWebhook == "" {
+		if config.ScanWebhookTimeout != "" || config.ScanWebhookSecretFile != "" {
+			logger.Warning("--scan-webhook-timeout and --scan-webhook-secret-file have no effect without --scan-webhook")
+		}
+		return nil
+	}
+	var errs validation.Errors
+	if !strings.HasPrefix(config.ScanWebhook, "https://") && !strings.HasPrefix(config.ScanWebhook, "http://") {
+		errs.Add("--scan-webhook must be an http(s) URL")
+	}
+	switch {
+	case config.NoPush || config.TarPath != "" || config.Load != "":
+		errs.Add("--scan-webhook scans pushed images and cannot be used with --no-push, --tar-path or --load")
+	case config.StagingDestination == "":
+		// Without staging the image would be on its final tags before the verdict
+		errs.Add("--scan-webhook needs --staging-destination: the scanner approves the staged image before it is promoted to the destinations")
+	}
+	scan := build.ScanWebhookConfig{URL: config.ScanWebhook}
+	if config.ScanWebhookTimeout != "" {
+		timeout, err := time.ParseDuration(config.ScanWebhookTimeout)
+		if err != nil || timeout <= 0 {
+			errs.Add("invalid --scan-webhook-timeout %q (expected a positive duration such as 10m)", config.ScanWebhookTimeout)
+		}
+		scan.Timeout = timeout
+	}
+	if config.ScanWebhookSecretFile != "" {
+		// #nosec G304 -- secret file given by the operator
+		secret, err := os.ReadFile(config.ScanWebhookSecretFile)
+		if err != nil {
+			errs.Add("failed to read --scan-webhook-secret-file: %v", err)
+		}
+		scan.Secret = []byte(strings.TrimSpace(string(secret)))
+	} else if secret := os.Getenv(scanWebhookSecretEnv); secret != "" {
+		scan.Secret = []byte(secret)
+	}
+	logger.AddSecret(string(scan.Secret))
+	config.scanWebhook = scan
+	return errs.Err()
+}
+
+// resolveContextNormalization parses the --normalize-context options.
+// Modification times are clamped to the timestamp of reproducible builds,
+// else to SOURCE_DATE_EPOCH, else to the Unix epoch.
+func resolveContextNormalization(config *Config) error {
+	config.contextNormalization = nil
+	if !config.NormalizeContext {
+		return nil
+	}
+	var errs validation.Errors
+	normalization := &build.ContextNormalization{}
+	normalization.UID, normalization.GID = build.DefaultContextOwner()
+	if config.ContextChown != "" {
+		uid, gid, err := build.ParseContextOwner(config.ContextChown)
+		errs.Check(err)
+		normalization.UID, normalization.GID = uid, gid
+	}
+	epoch := config.Timestamp
+	if !config.Reproducible {
+		epoch = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	if epoch == "" {
+		epoch = "0"
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		errs.Add("--normalize-context cannot clamp modification times to %q (expected Unix seconds)", epoch)
+	}
+	normalization.ModTime = time.Unix(seconds, 0)
+	config.contextNormalization = normalization
+	return errs.Err()
+}
+
+// buildKitOnlyFlags returns the attestation, signing and BuildKit options
+// that are set
+func buildKitOnlyFlags(config *Config) []string {
+	var flags []string
+	if config.Attestation != "" && config.Attestation != "off" {
+		flags = append(flags, "--attestation")
+	}
+	if len(config.AttestationConfigs) > 0 {
+		flags = append(flags, "--attest")
+	}
+	if config.Sign {
+		flags = append(flags, "--sign")
+	}
+	if len(config.BuildKitOpts) > 0 {
+		flags = append(flags, "--buildkit-opt")
+	}
+	if config.Compression == build.CompressionEstargz {
+		flags = append(flags, "--compression=estargz")
+	}
+	return flags
+}
+
+// buildpacksUnsupportedFlags returns the options that are set but have no
+// meaning for buildpacks builds: Dockerfile, builder storage and local output
+// options, and the attestations BuildKit generates while building
+func buildpacksUnsupportedFlags(config *Config) []string {
+	var flags []string
+	set := []struct {
+		flag string
+		set  bool
+	}{
+		{"--dockerfile", config.Dockerfile != ""},
+		{"--dockerfile-content", config.DockerfileContent != ""},
+		{"--target", len(config.Targets) > 0},
+		{"--chain", len(config.Chain) > 0},
+		{"--test-cmd", config.TestCmd != ""},
+		{"--base-image-rewrite", len(config.BaseImageRewrites) > 0},
+		{"--max-layer-size", config.MaxLayerSize != ""},
+		{"--max-image-size", config.MaxImageSize != ""},
+		{"--compression", config.Compression != "" && config.Compression != build.CompressionEstargz},
+		{"--compression-level", config.CompressionLevel != 0},
+		{"--build-arg-from-secret", len(config.BuildArgFromSecret) > 0},
+		{"--secret-from-env", len(config.SecretFromEnv) > 0},
+		{"--offline", config.Offline},
+		{"--storage-driver", config.StorageDriver != ""},
+		{"--no-push", config.NoPush},
+		{"--tar-path", config.TarPath != ""},
+		{"--load", config.Load != ""},
+		{"--buildah-opt", len(config.BuildahOpts) > 0},
+		{"--squash", config.Squash},
+		{"--squash-new", config.SquashNew},
+		{"--debug-on-failure", config.DebugOnFailure},
+		{"--allow", len(config.Allow) > 0},
+		{"--device", len(config.Devices) > 0},
+		{"--cap-add", len(config.CapAdd) > 0},
+	}
+	for _, option := range set {
+		if option.set {
+			flags = append(flags, option.flag)
+		}
+	}
+	// Kimia signs the images the lifecycle pushed
+	for _, flag := range buildKitOnlyFlags(config) {
+		if flag != "--sign" {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// parseSizeOption parses the size given to a flag, 0 when it is not set
+func parseSizeOption(errs *validation.Errors, flag, value string) int64 {
+	if value == "" {
+		return 0
+	}
+	size, err := build.ParseSize(value)
+	if err != nil {
+		errs.Add("invalid %s: %v", flag, err)
+	}
+	return size
+}
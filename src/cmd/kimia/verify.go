@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// runVerify implements `kimia verify IMAGE`: discover every signature, SBOM,
+// provenance and other artifact attached to the image digest, whichever tool
+// produced it, and evaluate --require and the --policy file. It returns a
+// non-zero exit code when either is not met.
+func runVerify(args []string) int {
+	var image string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		image, args = args[0], args[1:]
+	}
+	config := parseArgs(args)
+	logger.Setup(config.Verbosity, config.LogTimestamp)
+
+	if image == "" && len(config.Destination) > 0 {
+		image = config.Destination[0]
+	}
+	if image == "" {
+		logger.Error("Usage: kimia verify IMAGE [--require=signature,sbom,provenance] [--cosign-key=cosign.pub] [--policy=policy.yaml]")
+		return 1
+	}
+
+	for _, kind := range config.Require {
+		if !containsString(build.VerifyArtifactKinds, kind) {
+			logger.Error("Invalid --require value %q (valid: %s)", kind, strings.Join(build.VerifyArtifactKinds, ", "))
+			return 1
+		}
+	}
+
+	attestationRepos, err := build.ParseAttestationRepos(config.AttestationRepo)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	var policy *build.VerifyPolicy
+	if config.Policy != "" {
+		var err error
+		if policy, err = loadVerifyPolicy(config.Policy); err != nil {
+			logger.Error("%v", err)
+			return 1
+		}
+	}
+
+	removeCABundle, err := installCABundle(config)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+	defer removeCABundle()
+	if err := configureRegistryTLS(config); err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	// Credentials from DOCKER_USERNAME/DOCKER_PASSWORD are needed for private images
+	if err := auth.Setup(auth.SetupConfig{Destinations: []string{image}, InsecureRegistry: config.InsecureRegistry, NoCIAuth: config.NoCIAuth}); err != nil {
+		logger.Warning("Authentication setup failed: %v", err)
+	}
+
+	verifyConfig := build.VerifyConfig{
+		Image:            image,
+		Insecure:         config.Insecure || config.InsecurePull,
+		InsecureRegistry: config.InsecureRegistry,
+		Require:          config.Require,
+		Policy:           policy,
+		AttestationRepo:  attestationRepos.For(image),
+	}
+	// --cosign-key defaults to the signing key path; only verify when it is given
+	for _, arg := range args {
+		if arg == "--cosign-key" || strings.HasPrefix(arg, "--cosign-key=") {
+			verifyConfig.CosignKeyPath = config.CosignKeyPath
+		}
+	}
+
+	report, err := build.GenerateTrustReport(verifyConfig)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
+	}
+
+	build.PrintTrustReport(report)
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
+
+// containsString reports whether values contains s
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/build"
+)
+
+// loadVerifyPolicy reads a `kimia verify --policy` file:
+//
+//	signature:
+//	  keys: [cosign.pub]
+//	  identities:
+//	    - issuer: https://token.actions.githubusercontent.com
+//	      subject-regexp: ^https://github.com/acme/.*/release.yml@refs/tags/
+//	attestations:
+//	  - predicate-type: https://slsa.dev/provenance/
+//	    max-age: 30d
+//	require: [sbom]
+//
+// Any listed key or identity may sign the image and its attestations. A
+// predicate type ending in "/" matches every version below it. A relative key
+// path is resolved against the directory of the policy file.
+func loadVerifyPolicy(path string) (*build.VerifyPolicy, error) {
+	// #nosec G304 -- policy file given by the user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %v", err)
+	}
+	doc, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid policy %s: expected a mapping", path)
+	}
+
+	policy := &build.VerifyPolicy{}
+	for key, value := range root {
+		switch key {
+		case "signature":
+			err = parsePolicySignature(policy, value, filepath.Dir(path))
+		case "attestations":
+			err = parsePolicyAttestations(policy, value)
+		case "require":
+			policy.Require, err = policyStrings(value)
+			for _, kind := range policy.Require {
+				if err == nil && !containsString(build.VerifyArtifactKinds, kind) {
+					err = fmt.Errorf("require: invalid kind %q (valid: %s)", kind, strings.Join(build.VerifyArtifactKinds, ", "))
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown key %q (valid: signature, attestations, require)", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+		}
+	}
+	if len(policy.Attestations) > 0 && len(policy.Keys) == 0 && len(policy.Identities) == 0 {
+		return nil, fmt.Errorf("invalid policy %s: attestations need a signature key or identity to verify them with", path)
+	}
+	if len(policy.Keys) == 0 && len(policy.Identities) == 0 && len(policy.Require) == 0 {
+		return nil, fmt.Errorf("invalid policy %s: no signature, attestations or require rules", path)
+	}
+	return policy, nil
+}
+
+// parsePolicySignature reads the signature section of a policy
+func parsePolicySignature(policy *build.VerifyPolicy, value interface{}, policyDir string) error {
+	section, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("signature must be a mapping with keys or identities")
+	}
+	for key, value := range section {
+		switch key {
+		case "keys":
+			keys, err := policyStrings(value)
+			if err != nil {
+				return fmt.Errorf("signature.keys: %v", err)
+			}
+			for _, keyPath := range keys {
+				// KMS and other cosign key URIs are passed through
+				if !strings.Contains(keyPath, "://") && !filepath.IsAbs(keyPath) {
+					keyPath = filepath.Join(policyDir, keyPath)
+				}
+				policy.Keys = append(policy.Keys, keyPath)
+			}
+		case "identities":
+			entries, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("signature.identities must be a list")
+			}
+			for i, entry := range entries {
+				identity, err := parsePolicyIdentity(entry)
+				if err != nil {
+					return fmt.Errorf("signature.identities[%d]: %v", i, err)
+				}
+				policy.Identities = append(policy.Identities, identity)
+			}
+		default:
+			return fmt.Errorf("unknown key signature.%s (valid: keys, identities)", key)
+		}
+	}
+	return nil
+}
+
+// parsePolicyIdentity reads one keyless signer of a policy
+func parsePolicyIdentity(value interface{}) (build.SignerIdentity, error) {
+	var identity build.SignerIdentity
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return identity, fmt.Errorf("must be a mapping with issuer and subject or subject-regexp")
+	}
+	for key, value := range fields {
+		text := fmt.Sprint(value)
+		switch key {
+		case "issuer":
+			identity.Issuer = text
+		case "subject":
+			identity.Subject = text
+		case "subject-regexp":
+			if _, err := regexp.Compile(text); err != nil {
+				return identity, fmt.Errorf("invalid subject-regexp: %v", err)
+			}
+			identity.SubjectRegexp = text
+		default:
+			return identity, fmt.Errorf("unknown key %q (valid: issuer, subject, subject-regexp)", key)
+		}
+	}
+	if identity.Issuer == "" {
+		return identity, fmt.Errorf("issuer is required")
+	}
+	if (identity.Subject == "") == (identity.SubjectRegexp == "") {
+		return identity, fmt.Errorf("exactly one of subject and subject-regexp is required")
+	}
+	return identity, nil
+}
+
+// parsePolicyAttestations reads the attestations section of a policy
+func parsePolicyAttestations(policy *build.VerifyPolicy, value interface{}) error {
+	entries, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("attestations must be a list")
+	}
+	for i, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("attestations[%d] must be a mapping with predicate-type", i)
+		}
+		var requirement build.AttestationRequirement
+		for key, value := range fields {
+			switch key {
+			case "predicate-type":
+				requirement.PredicateType = fmt.Sprint(value)
+			case "max-age":
+				age, err := parsePolicyAge(fmt.Sprint(value))
+				if err != nil {
+					return fmt.Errorf("attestations[%d].max-age: %v", i, err)
+				}
+				requirement.MaxAge = age
+			default:
+				return fmt.Errorf("unknown key attestations[%d].%s (valid: predicate-type, max-age)", i, key)
+			}
+		}
+		if requirement.PredicateType == "" {
+			return fmt.Errorf("attestations[%d]: predicate-type is required", i)
+		}
+		policy.Attestations = append(policy.Attestations, requirement)
+	}
+	return nil
+}
+
+// parsePolicyAge parses a max-age: a Go duration (72h) or a number of days (30d)
+func parsePolicyAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid age %q (e.g. 72h or 30d)", value)
+	}
+	return age, nil
+}
+
+// policyStrings reads a policy value that is a string or a list of strings
+func policyStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("must be a string or a list")
+}
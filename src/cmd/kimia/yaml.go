@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by kimia spec files: block
+// mappings and sequences, flow sequences and mappings ([a, b], {k: v}), plain
+// and quoted scalars, literal (|) and folded (>) block scalars, and comments.
+// Mappings are map[string]interface{}, sequences []interface{} and scalars
+// strings; an empty value is nil. Anchors, tags and multiple documents are not
+// supported.
+func parseYAML(data string) (interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		text := strings.TrimRight(raw, " \t")
+		content := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		if content == "---" || content == "..." {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(text) - len(content), text: content, raw: raw})
+	}
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	value, err := p.parseBlock(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].number)
+	}
+	return value, nil
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string // without indentation; comments are stripped when parsed
+	raw    string // original line, for block scalars
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// skipBlank moves past empty and comment-only lines
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		text := stripYAMLComment(p.lines[p.pos].text)
+		if text != "" {
+			return
+		}
+		p.pos++
+	}
+}
+
+// parseBlock parses the mapping or sequence whose entries start at indent
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	p.skipBlank()
+	line := p.lines[p.pos]
+	text := stripYAMLComment(line.text)
+	if text == "-" || strings.HasPrefix(text, "- ") {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseYAMLScalar(text, line.number)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) || p.lines[p.pos].indent != indent {
+			return items, nil
+		}
+		line := p.lines[p.pos]
+		text := stripYAMLComment(line.text)
+		if text != "-" && !strings.HasPrefix(text, "- ") {
+			return items, nil
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			value, err := p.parseNested(indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+			continue
+		}
+
+		// "- key: value" starts a mapping at the column of key
+		column := indent + len(text) - len(rest)
+		if _, _, ok := splitYAMLKey(rest); ok && !strings.HasPrefix(rest, "{") && !strings.HasPrefix(rest, "[") {
+			p.lines[p.pos] = yamlLine{number: line.number, indent: column, text: rest, raw: line.raw}
+			value, err := p.parseMapping(column)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+			continue
+		}
+
+		p.pos++
+		value, err := parseYAMLScalar(rest, line.number)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	mapping := map[string]interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) || p.lines[p.pos].indent != indent {
+			return mapping, nil
+		}
+		line := p.lines[p.pos]
+		text := stripYAMLComment(line.text)
+		key, rest, ok := splitYAMLKey(text)
+		if !ok {
+			if text == "-" || strings.HasPrefix(text, "- ") {
+				return mapping, nil
+			}
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", line.number)
+		}
+		if _, dup := mapping[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+		}
+		p.pos++
+
+		var value interface{}
+		var err error
+		switch {
+		case rest == "":
+			value, err = p.parseNested(indent)
+		case rest == "|" || rest == ">" || rest == "|-" || rest == ">-":
+			value = p.parseBlockScalar(indent, rest)
+		default:
+			value, err = parseYAMLScalar(rest, line.number)
+		}
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = value
+	}
+}
+
+// parseNested parses the value of a key or item with nothing after the colon
+// or dash: a more indented block, a sequence at the key's indentation, or nil
+func (p *yamlParser) parseNested(indent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	text := stripYAMLComment(next.text)
+	if next.indent > indent || (next.indent == indent && (text == "-" || strings.HasPrefix(text, "- "))) {
+		return p.parseBlock(next.indent)
+	}
+	return nil, nil
+}
+
+// parseBlockScalar collects the lines of a | or > scalar
+func (p *yamlParser) parseBlockScalar(indent int, style string) string {
+	var lines []string
+	blockIndent := -1
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.text != "" && line.indent <= indent {
+			break
+		}
+		if blockIndent < 0 && line.text != "" {
+			blockIndent = line.indent
+		}
+		if line.text == "" || blockIndent < 0 {
+			lines = append(lines, "")
+		} else {
+			lines = append(lines, line.raw[blockIndent:])
+		}
+		p.pos++
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	separator := "\n"
+	if strings.HasPrefix(style, ">") {
+		separator = " "
+	}
+	value := strings.Join(lines, separator)
+	if !strings.HasSuffix(style, "-") {
+		value += "\n"
+	}
+	return value
+}
+
+// stripYAMLComment removes a # comment that is outside quotes and starts the
+// line or follows whitespace
+func stripYAMLComment(text string) string {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimRight(text[:i], " \t")
+		}
+	}
+	return text
+}
+
+// splitYAMLKey splits "key: value" (or "key:") outside quotes and brackets
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+	var quote rune
+	depth := 0
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			if i == 0 {
+				quote = r
+			}
+		case r == '[' || r == '{':
+			depth++
+		case r == ']' || r == '}':
+			depth--
+		case r == ':' && depth == 0 && (i == len(text)-1 || text[i+1] == ' '):
+			key = strings.TrimSpace(text[:i])
+			if unquoted, err := unquoteYAML(key); err == nil {
+				key = unquoted
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLScalar parses a scalar or a flow collection
+func parseYAMLScalar(text string, line int) (interface{}, error) {
+	if text == "" || text == "~" || text == "null" {
+		return nil, nil
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		value, rest, err := parseYAMLFlow(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" {
+			return nil, fmt.Errorf("line %d: unexpected %q after flow collection", line, rest)
+		}
+		return value, nil
+	}
+	value, err := unquoteYAML(text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", line, err)
+	}
+	return value, nil
+}
+
+// unquoteYAML returns a plain scalar as is and removes the quotes of a
+// single- or double-quoted one
+func unquoteYAML(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted string %s", text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("invalid single-quoted string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	return text, nil
+}
+
+// parseYAMLFlow parses a flow sequence or mapping at the start of text and
+// returns the remaining text
+func parseYAMLFlow(text string) (interface{}, string, error) {
+	open := text[0]
+	closing := byte(']')
+	if open == '{' {
+		closing = '}'
+	}
+	rest := strings.TrimSpace(text[1:])
+
+	var items []interface{}
+	mapping := map[string]interface{}{}
+	for {
+		if rest == "" {
+			return nil, "", fmt.Errorf("unterminated %c", open)
+		}
+		if rest[0] == closing {
+			rest = rest[1:]
+			break
+		}
+
+		var entry string
+		var value interface{}
+		var err error
+		if rest[0] == '[' || rest[0] == '{' {
+			value, rest, err = parseYAMLFlow(rest)
+			if err != nil {
+				return nil, "", err
+			}
+		} else {
+			entry, rest = splitYAMLFlowEntry(rest, closing)
+			if open == '{' {
+				key, val, ok := splitYAMLKey(entry)
+				if !ok {
+					return nil, "", fmt.Errorf("expected \"key: value\" in %q", entry)
+				}
+				if val != "" && (val[0] == '[' || val[0] == '{') {
+					value, _, err = parseYAMLFlow(val)
+				} else {
+					value, err = parseYAMLScalar(val, 0)
+				}
+				if err != nil {
+					return nil, "", err
+				}
+				mapping[key] = value
+			} else if value, err = parseYAMLScalar(entry, 0); err != nil {
+				return nil, "", err
+			}
+		}
+		if open == '[' {
+			items = append(items, value)
+		}
+
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+
+	if open == '{' {
+		return mapping, rest, nil
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+	return items, rest, nil
+}
+
+// splitYAMLFlowEntry returns the text up to the next comma or closing bracket
+// outside quotes and nested brackets
+func splitYAMLFlowEntry(text string, closing byte) (string, string) {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case (c == ']' || c == '}') && depth > 0:
+			depth--
+		case depth == 0 && (c == ',' || c == closing):
+			return strings.TrimSpace(text[:i]), text[i:]
+		}
+	}
+	return strings.TrimSpace(text), ""
+}
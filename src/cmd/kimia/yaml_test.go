@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want interface{}
+	}{
+		{
+			name: "empty document",
+			yaml: "# only a comment\n\n",
+			want: nil,
+		},
+		{
+			name: "scalars",
+			yaml: "a: 1\nb: hello world\nc:\nd: ~\ne: null\n",
+			want: map[string]interface{}{"a": "1", "b": "hello world", "c": nil, "d": nil, "e": nil},
+		},
+		{
+			name: "document markers",
+			yaml: "---\na: 1\n...\n",
+			want: map[string]interface{}{"a": "1"},
+		},
+		{
+			name: "double-quoted",
+			yaml: `a: "x: y # not a comment"` + "\n" + `b: "tab\there \"q\""` + "\n",
+			want: map[string]interface{}{"a": "x: y # not a comment", "b": "tab\there \"q\""},
+		},
+		{
+			name: "single-quoted",
+			yaml: "a: 'it''s: #1'\n'quoted key': v\n",
+			want: map[string]interface{}{"a": "it's: #1", "quoted key": "v"},
+		},
+		{
+			name: "comments",
+			yaml: "# header\na: 1 # trailing\nb: x#y\n  # indented comment\nc: 'v' # after quotes\n",
+			want: map[string]interface{}{"a": "1", "b": "x#y", "c": "v"},
+		},
+		{
+			name: "colon without space stays in the value",
+			yaml: "image: registry:5000/app:1.0\nurl: https://example.com\n",
+			want: map[string]interface{}{"image": "registry:5000/app:1.0", "url": "https://example.com"},
+		},
+		{
+			name: "block sequence",
+			yaml: "list:\n  - a\n  - 'b c'\n  -\n",
+			want: map[string]interface{}{"list": []interface{}{"a", "b c", nil}},
+		},
+		{
+			name: "sequence at the key's indentation",
+			yaml: "list:\n- a\n- b\nnext: 1\n",
+			want: map[string]interface{}{"list": []interface{}{"a", "b"}, "next": "1"},
+		},
+		{
+			name: "sequence of mappings",
+			yaml: "builds:\n  - name: api\n    context: svc/api\n    args: [--target=prod]\n  - name: web\n    cache: true\n",
+			want: map[string]interface{}{"builds": []interface{}{
+				map[string]interface{}{"name": "api", "context": "svc/api", "args": []interface{}{"--target=prod"}},
+				map[string]interface{}{"name": "web", "cache": "true"},
+			}},
+		},
+		{
+			name: "nested sequences",
+			yaml: "-\n  - a\n  - b\n-\n  - c\n",
+			want: []interface{}{[]interface{}{"a", "b"}, []interface{}{"c"}},
+		},
+		{
+			name: "nested mappings",
+			yaml: "a:\n  b:\n    c: 1\n  d: 2\ne: 3\n",
+			want: map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": "1"}, "d": "2"}, "e": "3"},
+		},
+		{
+			name: "flow collections",
+			yaml: "a: [x, 'y, z', \"w]\"]\nb: {K: \"1\", L: [2, 3]}\nc: [[1, 2], {m: n}]\nd: []\ne: {}\n",
+			want: map[string]interface{}{
+				"a": []interface{}{"x", "y, z", "w]"},
+				"b": map[string]interface{}{"K": "1", "L": []interface{}{"2", "3"}},
+				"c": []interface{}{[]interface{}{"1", "2"}, map[string]interface{}{"m": "n"}},
+				"d": []interface{}{},
+				"e": map[string]interface{}{},
+			},
+		},
+		{
+			name: "literal block scalar",
+			yaml: "script: |\n  line 1\n    indented # kept\n\n  line 3\nnext: x\n",
+			want: map[string]interface{}{"script": "line 1\n  indented # kept\n\nline 3\n", "next": "x"},
+		},
+		{
+			name: "folded block scalar without final newline",
+			yaml: "text: >-\n  one\n  two\n",
+			want: map[string]interface{}{"text": "one two"},
+		},
+		{
+			name: "windows line endings",
+			yaml: "a: 1\r\nb: 2\r\n",
+			want: map[string]interface{}{"a": "1", "b": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.yaml)
+			if err != nil {
+				t.Fatalf("parseYAML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string // substring of the error
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs are not allowed"},
+		{"duplicate key", "a: 1\na: 2\n", `line 2: duplicate key "a"`},
+		{"unterminated flow sequence", "a: [x, y\n", "line 1: unterminated ["},
+		{"unterminated flow mapping", "a: {k: v\n", "line 1: unterminated {"},
+		{"text after flow collection", "a: [x] y\n", `unexpected "y"`},
+		{"flow mapping entry without colon", "a: {k}\n", `expected "key: value"`},
+		{"invalid double quotes", `a: "x\q"` + "\n", "invalid double-quoted string"},
+		{"unterminated single quote", "a: 'x\n", "invalid single-quoted string"},
+		{"scalar in a mapping", "a: 1\njust text\n", `line 2: expected "key: value"`},
+		{"unexpected indentation", "a: 1\n  b: 2\nc: 3\n  d: 4\n", "unexpected indentation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML(tt.yaml)
+			if err == nil {
+				t.Fatalf("parseYAML() succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parseYAML() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBatchSpec(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		spec    string
+		want    *batchSpec
+		wantErr string
+	}{
+		{
+			name: "defaults and builds",
+			spec: `parallelism: 2
+fail-fast: true
+defaults:
+  cache: true
+  push-retry: 3
+builds:
+  - name: api
+    context: services/api   # relative to the spec
+    destination: [registry/api:1.0, registry/api:latest]
+    build-arg: {VERSION: "1.0"}
+    no-push: false
+    args: [--target=prod]
+  - context: git@github.com:acme/web.git
+    destination: registry/web:1.0
+`,
+			want: &batchSpec{Parallelism: 2, FailFast: true, Builds: []batchBuild{
+				{Name: "api", Args: []string{
+					"--cache", "--push-retry=3",
+					"--target=prod",
+					"--build-arg=VERSION=1.0",
+					"--context=" + filepath.Join(dir, "services/api"),
+					"--destination=registry/api:1.0", "--destination=registry/api:latest",
+				}},
+				{Name: "2", Args: []string{
+					"--cache", "--push-retry=3",
+					"--context=git@github.com:acme/web.git",
+					"--destination=registry/web:1.0",
+				}},
+			}},
+		},
+		{name: "unknown key", spec: "builds: [{context: .}]\nparallel: 2\n", wantErr: `unknown key "parallel"`},
+		{name: "no builds", spec: "parallelism: 1\n", wantErr: "builds must be a non-empty list"},
+		{name: "invalid parallelism", spec: "parallelism: 0\nbuilds: [{context: .}]\n", wantErr: "parallelism must be a positive number"},
+		{name: "duplicate names", spec: "builds:\n  - name: a\n  - name: a\n", wantErr: `duplicate build name "a"`},
+		{name: "args not a list", spec: "builds:\n  - args: --target=prod\n", wantErr: "args must be a list"},
+		{name: "malformed YAML", spec: "builds:\n  - name: [a\n", wantErr: "unterminated ["},
+		{name: "not a mapping", spec: "- a\n- b\n", wantErr: "expected a mapping with builds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "builds.yaml")
+			if err := os.WriteFile(path, []byte(tt.spec), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadBatchSpec(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadBatchSpec() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadBatchSpec() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadBatchSpec() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// newTransferClient returns an HTTP client for blob transfers to host, which may take
+// far longer than registryRequestTimeout; only the wait for response headers is bounded
+func newTransferClient(host string, insecure bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = registryRequestTimeout
+	transport.TLSClientConfig = tlsConfigFor(host, insecure)
+	return &http.Client{Transport: transport}
+}
+
+// send issues an authenticated request with an optional body. body is called
+// again when a 401 challenge has to be answered, so it must return a fresh reader.
+// The token is kept for later requests to the same repository.
+func (r *Repository) send(client *http.Client, method, requestURL string, header http.Header, body func() (io.ReadCloser, error), length int64) (*http.Response, error) {
+	do := func() (*http.Response, error) {
+		var reader io.ReadCloser
+		if body != nil {
+			var err error
+			if reader, err = body(); err != nil {
+				return nil, err
+			}
+		}
+		ctx := r.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+		if err != nil {
+			if reader != nil {
+				reader.Close()
+			}
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if body != nil {
+			req.ContentLength = length
+		}
+		r.mu.Lock()
+		token := r.token
+		r.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("registry unreachable: %v", err)
+		}
+		return resp, nil
+	}
+
+	resp, err := do()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	// Push requests are challenged again for a token with push scope
+	token, err := fetchRegistryToken(r.client, resp.Header.Get("WWW-Authenticate"), r.Host, r.Repository)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.token = token
+	r.mu.Unlock()
+	return do()
+}
+
+// BlobExists reports whether the repository already has the blob digest
+func (r *Repository) BlobExists(digest string) (bool, error) {
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", r.Host, r.Repository, digest)
+	resp, err := r.send(r.client, http.MethodHead, blobURL, nil, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("registry returned HTTP %d for blob %s", resp.StatusCode, digest)
+}
+
+// PushBlob uploads the file at path as blob digest, in a single request or,
+// with ChunkSize set, in PATCH requests of at most ChunkSize bytes
+func (r *Repository) PushBlob(path, digest string, size int64) error {
+	uploadURL := fmt.Sprintf("https://%s/v2/%s/blobs/uploads/", r.Host, r.Repository)
+	resp, err := r.send(r.client, http.MethodPost, uploadURL, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("registry returned HTTP %d when starting the upload to %s/%s", resp.StatusCode, r.Host, r.Repository)
+	}
+	base, _ := url.Parse(uploadURL)
+	location, err := uploadLocation(base, resp)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	client := newTransferClient(r.Host, r.insecure)
+	var body func() (io.ReadCloser, error)
+	length := int64(0)
+	if r.ChunkSize > 0 && size > r.ChunkSize {
+		for offset := int64(0); offset < size; offset += r.ChunkSize {
+			n := min(r.ChunkSize, size-offset)
+			chunkHeader := http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+n-1)},
+			}
+			resp, err := r.send(client, http.MethodPatch, location.String(), chunkHeader, fileSection(path, offset, n), n)
+			if err != nil {
+				return err
+			}
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				return fmt.Errorf("registry returned HTTP %d for blob chunk at offset %d: %s", resp.StatusCode, offset, strings.TrimSpace(string(message)))
+			}
+			if location, err = uploadLocation(location, resp); err != nil {
+				return err
+			}
+		}
+	} else {
+		body, length = fileSection(path, 0, size), size
+	}
+
+	// The PUT completes the upload, carrying the whole blob or nothing after chunks
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	resp, err = r.send(client, http.MethodPut, location.String(), header, body, length)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("registry returned HTTP %d for blob upload: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// uploadLocation returns the upload URL a registry response points to,
+// resolved against base
+func uploadLocation(base *url.URL, resp *http.Response) (*url.URL, error) {
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return nil, fmt.Errorf("registry returned no upload location")
+	}
+	return base.ResolveReference(location), nil
+}
+
+// fileSection returns a body func reading n bytes of the file at path from offset
+func fileSection(path string, offset, n int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		// #nosec G304 -- file written by the caller
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(file, offset, n), file}, nil
+	}
+}
+
+// PushManifest uploads manifest under reference (a tag) and returns its digest
+func (r *Repository) PushManifest(reference, mediaType string, manifest []byte) (string, error) {
+	if _, err := r.putManifest(reference, mediaType, manifest); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// putManifest uploads a manifest and returns the response headers
+func (r *Repository) putManifest(reference, mediaType string, manifest []byte) (http.Header, error) {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.Host, r.Repository, reference)
+	header := http.Header{"Content-Type": {mediaType}}
+	body := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(manifest)), nil
+	}
+	resp, err := r.send(r.client, http.MethodPut, manifestURL, header, body, int64(len(manifest)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("registry returned HTTP %d for manifest upload: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return resp.Header, nil
+}
+
+// FetchBlob returns a reader for blob digest. The caller must close it and
+// check the content against the digest.
+func (r *Repository) FetchBlob(digest string) (io.ReadCloser, error) {
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", r.Host, r.Repository, digest)
+	resp, err := r.send(newTransferClient(r.Host, r.insecure), http.MethodGet, blobURL, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("registry returned HTTP %d for blob %s", resp.StatusCode, digest)
+	}
+	return resp.Body, nil
+}
+
+// FetchRawManifest returns the manifest for a tag or digest exactly as the
+// registry serves it, with its media type
+func (r *Repository) FetchRawManifest(reference string) ([]byte, string, error) {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.Host, r.Repository, reference)
+	header := http.Header{"Accept": {strings.Join(manifestAcceptTypes, ", ")}}
+	resp, err := r.send(r.client, http.MethodGet, manifestURL, header, nil, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("registry returned HTTP %d for %s/%s@%s", resp.StatusCode, r.Host, r.Repository, reference)
+	}
+
+	manifest, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest %s: %v", reference, err)
+	}
+	if len(manifest) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest %s exceeds %d bytes", reference, maxManifestSize)
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != int64(len(manifest)) {
+		return nil, "", fmt.Errorf("registry sent %d bytes for manifest %s but announced %d", len(manifest), reference, resp.ContentLength)
+	}
+	return manifest, resp.Header.Get("Content-Type"), nil
+}
+
+// BlobSize returns the size the registry reports for blob digest
+func (r *Repository) BlobSize(digest string) (int64, error) {
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", r.Host, r.Repository, digest)
+	resp, err := r.send(r.client, http.MethodHead, blobURL, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, fmt.Errorf("blob %s not found in %s/%s", digest, r.Host, r.Repository)
+	}
+	return 0, fmt.Errorf("registry returned HTTP %d for blob %s", resp.StatusCode, digest)
+}
+
+// CheckPushAccess starts a blob upload to verify that the stored credentials
+// may push to the repository, then cancels it
+func (r *Repository) CheckPushAccess() error {
+	uploadURL := fmt.Sprintf("https://%s/v2/%s/blobs/uploads/", r.Host, r.Repository)
+	resp, err := r.send(r.client, http.MethodPost, uploadURL, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("credentials cannot push to %s/%s (HTTP %d): %s", r.Host, r.Repository, resp.StatusCode, strings.TrimSpace(string(message)))
+	case http.StatusNotFound:
+		return fmt.Errorf("repository %s/%s does not exist or is not visible to these credentials (HTTP 404)", r.Host, r.Repository)
+	default:
+		return fmt.Errorf("registry returned HTTP %d when starting an upload to %s/%s: %s", resp.StatusCode, r.Host, r.Repository, strings.TrimSpace(string(message)))
+	}
+
+	r.cancelUpload(uploadURL, resp.Header.Get("Location"))
+	return nil
+}
+
+// MountBlob asks the registry to link blob digest from repository from on
+// the same registry, so that it is not uploaded again. It reports false when
+// the registry started a regular upload instead, e.g. because it does not
+// support mounting or the credentials cannot read from.
+func (r *Repository) MountBlob(digest, from string) (bool, error) {
+	uploadURL := fmt.Sprintf("https://%s/v2/%s/blobs/uploads/", r.Host, r.Repository)
+	mountURL := uploadURL + "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+	resp, err := r.send(r.client, http.MethodPost, mountURL, nil, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		r.cancelUpload(uploadURL, resp.Header.Get("Location"))
+		return false, nil
+	}
+	return false, fmt.Errorf("registry returned HTTP %d when mounting blob %s from %s", resp.StatusCode, digest, from)
+}
+
+// cancelUpload cancels the upload session at location. Registries expire
+// abandoned uploads, so a failed cancel is harmless.
+func (r *Repository) cancelUpload(uploadURL, location string) {
+	target, err := url.Parse(location)
+	if err != nil || location == "" {
+		return
+	}
+	base, _ := url.Parse(uploadURL)
+	resp, err := r.send(r.client, http.MethodDelete, base.ResolveReference(target).String(), nil, nil, 0)
+	if err != nil {
+		logger.Debug("Failed to cancel upload to %s/%s: %v", r.Host, r.Repository, err)
+		return
+	}
+	resp.Body.Close()
+	logger.Debug("Cancelled upload to %s/%s (HTTP %d)", r.Host, r.Repository, resp.StatusCode)
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// ciAuths returns the registry credentials CI systems put in the environment
+// of a job, so that pipelines do not have to write config.json themselves:
+//
+//   - DOCKER_AUTH_CONFIG: a Docker config.json (GitLab CI)
+//   - CI_REGISTRY_USER and CI_REGISTRY_PASSWORD: the job token for CI_REGISTRY (GitLab CI)
+//   - GITHUB_TOKEN: a token for ghcr.io, as GITHUB_ACTOR (GitHub Actions)
+//
+// DOCKER_AUTH_CONFIG is set by the user and wins over the job tokens. The
+// credentials are redacted from the logs.
+func ciAuths() (map[string]DockerAuth, error) {
+	auths := make(map[string]DockerAuth)
+	var sources []string
+
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		actor := os.Getenv("GITHUB_ACTOR")
+		if actor == "" {
+			actor = "x-access-token" // ghcr.io checks the token, not the user name
+		}
+		auths["ghcr.io"] = DockerAuth{Auth: EncodeAuth(actor, token)}
+		addAuthSecrets(auths["ghcr.io"])
+		sources = append(sources, "GITHUB_TOKEN (ghcr.io)")
+	}
+
+	user, password, registry := os.Getenv("CI_REGISTRY_USER"), os.Getenv("CI_REGISTRY_PASSWORD"), os.Getenv("CI_REGISTRY")
+	if user != "" && password != "" && registry != "" {
+		registry = NormalizeRegistryURL(registry)
+		auths[registry] = DockerAuth{Auth: EncodeAuth(user, password)}
+		addAuthSecrets(auths[registry])
+		sources = append(sources, fmt.Sprintf("CI_REGISTRY_USER (%s)", registry))
+	}
+
+	if data := os.Getenv("DOCKER_AUTH_CONFIG"); data != "" {
+		logger.AddSecret(data)
+		var config DockerConfig
+		if err := json.Unmarshal([]byte(data), &config); err != nil {
+			return nil, fmt.Errorf("invalid DOCKER_AUTH_CONFIG: %v", err)
+		}
+		registries := make([]string, 0, len(config.Auths))
+		for registry, auth := range config.Auths {
+			addAuthSecrets(auth)
+			if auth.Auth == "" && (auth.Username == "" || auth.Password == "") {
+				continue
+			}
+			auths[registry] = auth
+			registries = append(registries, registry)
+		}
+		sort.Strings(registries)
+		if len(registries) > 0 {
+			sources = append(sources, fmt.Sprintf("DOCKER_AUTH_CONFIG (%s)", strings.Join(registries, ", ")))
+		}
+		if len(config.CredHelpers) > 0 || config.CredsStore != "" {
+			logger.Warning("Credential helpers in DOCKER_AUTH_CONFIG are not used; only its auths are")
+		}
+	}
+
+	if len(sources) > 0 {
+		logger.Info("Using registry credentials from the CI environment: %s", strings.Join(sources, ", "))
+	}
+	return auths, nil
+}
+
+// addAuthSecrets redacts the password of auth from the logs, together with
+// the auth value and its decoded user:password form
+func addAuthSecrets(auth DockerAuth) {
+	logger.AddSecret(auth.Password)
+	if auth.Auth == "" {
+		return
+	}
+	logger.AddSecret(auth.Auth)
+	if username, password, err := DecodeAuth(auth.Auth); err == nil {
+		logger.AddSecret(username + ":" + password)
+		logger.AddSecret(password)
+	}
+}
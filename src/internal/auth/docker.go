@@ -29,6 +29,7 @@ type DockerAuth struct {
 type SetupConfig struct {
 	Destinations     []string
 	InsecureRegistry []string
+	NoCIAuth         bool // Ignore the registry credentials of CI systems (DOCKER_AUTH_CONFIG, CI_REGISTRY_*, GITHUB_TOKEN)
 }
 
 // validateDockerConfigPath validates that a config path is within the expected Docker config directory
@@ -84,7 +85,17 @@ func Setup(config SetupConfig) error {
 	if _, err := os.Stat(configPath); err != nil {
 		if os.IsNotExist(err) {
 			logger.Debug("No Docker config found at %s", configPath)
-			
+
+			// Credentials of the CI system, which DOCKER_USERNAME/DOCKER_PASSWORD override
+			auths := make(map[string]DockerAuth)
+			if !config.NoCIAuth {
+				ciAuths, err := ciAuths()
+				if err != nil {
+					return err
+				}
+				auths = ciAuths
+			}
+
 			// Fallback: Check environment variables
 			dockerUsername := os.Getenv("DOCKER_USERNAME")
 			dockerPassword := os.Getenv("DOCKER_PASSWORD")
@@ -94,7 +105,6 @@ func Setup(config SetupConfig) error {
 				logger.Info("Creating Docker config from environment variables")
 				
 				// Create config from environment variables
-				auths := make(map[string]DockerAuth)
 				authString := EncodeAuth(dockerUsername, dockerPassword)
 
 				if dockerRegistry != "" {
@@ -137,7 +147,9 @@ func Setup(config SetupConfig) error {
 						logger.Debug("Added auth for common registries")
 					}
 				}
+			}
 
+			if len(auths) > 0 {
 				// Create the config directory if it doesn't exist
 				// Docker config directory should be restrictive (contains credentials)
 				if err := os.MkdirAll(dockerConfigDir, 0700); err != nil {
@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// manifestAcceptTypes lists the manifest media types accepted when resolving digests
+var manifestAcceptTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// registryRequestTimeout bounds each registry API request
+const registryRequestTimeout = 30 * time.Second
+
+// ParseImageReference splits an image reference into the registry API host,
+// repository and tag or digest (defaulting to "latest")
+func ParseImageReference(ref string) (host, repository, reference string) {
+	name := ref
+	reference = "latest"
+
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		reference = name[idx+1:]
+		name = name[:idx]
+	} else if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		reference = name[idx+1:]
+		name = name[:idx]
+	}
+
+	host = "docker.io"
+	repository = name
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		domain := name[:idx]
+		if strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			host = NormalizeRegistryURL(domain)
+			repository = name[idx+1:]
+		}
+	}
+
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	return host, repository, reference
+}
+
+// ResolveImageDigest returns the manifest digest of an image reference by
+// querying the registry API. Credentials from the Docker config are used
+// when present; otherwise anonymous access is attempted.
+func ResolveImageDigest(ref string, insecure bool) (string, error) {
+	host, repository, reference := ParseImageReference(ref)
+	if strings.HasPrefix(reference, "sha256:") {
+		return reference, nil
+	}
+
+	client := newRegistryClient(host, insecure)
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repository, reference)
+	resp, err := registryRequest(client, http.MethodHead, manifestURL, strings.Join(manifestAcceptTypes, ", "), host, repository)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("image not found: %s", ref)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("access denied to %s (HTTP %d)", ref, resp.StatusCode)
+	default:
+		return "", fmt.Errorf("registry returned HTTP %d for %s", resp.StatusCode, ref)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry did not return a digest for %s", ref)
+	}
+	return digest, nil
+}
+
+// rootCAs are the certificate authorities registry connections trust (nil = system roots)
+var rootCAs *x509.CertPool
+
+// SetRootCAs makes Kimia's registry clients trust pool instead of the system roots
+func SetRootCAs(pool *x509.CertPool) {
+	rootCAs = pool
+}
+
+// newRegistryClient returns an HTTP client for registry API requests to host
+func newRegistryClient(host string, insecure bool) *http.Client {
+	client := &http.Client{Timeout: registryRequestTimeout}
+	if tlsConfig := tlsConfigFor(host, insecure); tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+	return client
+}
+
+// registryRequest issues a registry API request, answering a 401 challenge with
+// a token obtained from the stored (or anonymous) credentials. The caller must
+// close the response body.
+func registryRequest(client *http.Client, method, requestURL, accept, host, repository string) (*http.Response, error) {
+	resp, err := doRegistryRequest(client, method, requestURL, accept, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	token, err := fetchRegistryToken(client, resp.Header.Get("WWW-Authenticate"), host, repository)
+	if err != nil {
+		return nil, err
+	}
+	return doRegistryRequest(client, method, requestURL, accept, token)
+}
+
+// doRegistryRequest issues a single registry API request
+func doRegistryRequest(client *http.Client, method, requestURL, accept, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("registry unreachable: %v", err)
+	}
+	return resp, nil
+}
+
+// fetchRegistryToken answers a WWW-Authenticate challenge and returns an
+// Authorization header value
+func fetchRegistryToken(client *http.Client, challenge, host, repository string) (string, error) {
+	var basicAuth string
+	registry := host
+	if host == "registry-1.docker.io" {
+		registry = "docker.io"
+	}
+	if creds, err := GetRegistryAuth(registry); err == nil {
+		basicAuth = creds
+	} else {
+		logger.Debug("No stored credentials for %s, using anonymous access", registry)
+	}
+
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if basicAuth == "" {
+			return "", fmt.Errorf("registry %s requires credentials", registry)
+		}
+		return "Basic " + basicAuth, nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry auth challenge: %q", challenge)
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("registry auth challenge has no realm")
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %v", realm, err)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if basicAuth != "" {
+		req.Header.Set("Authorization", "Basic "+basicAuth)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned HTTP %d", resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("token response contained no token")
+	}
+	return "Bearer " + token, nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	for _, kv := range strings.Split(parts[1], ",") {
+		pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(pair) == 2 {
+			params[strings.ToLower(pair[0])] = strings.Trim(pair[1], `"`)
+		}
+	}
+	return parts[0], params
+}
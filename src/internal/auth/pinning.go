@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// RegistryPin records the public keys a registry's certificate chained to on
+// first contact. Certificates that verify against the system roots (or
+// SSL_CERT_FILE) pin their issuing CAs, so that routine leaf rotations keep
+// matching; others, such as self-signed certificates, pin the leaf key.
+type RegistryPin struct {
+	SPKI        []string  `json:"spki,omitempty"`        // SHA-256 of the pinned public keys
+	Fingerprint string    `json:"fingerprint,omitempty"` // Leaf certificate SHA-256 of pins from older versions
+	Subject     string    `json:"subject,omitempty"`     // Subject of the first pinned certificate
+	NotAfter    time.Time `json:"notAfter,omitempty"`
+	FirstSeen   time.Time `json:"firstSeen"`
+}
+
+// RegistryPins maps a registry host to its pinned certificate
+type RegistryPins map[string]RegistryPin
+
+// registryDialTimeout bounds the TLS handshake used to fetch a registry certificate
+const registryDialTimeout = 15 * time.Second
+
+// presentedChain is what a registry presented in a TLS handshake
+type presentedChain struct {
+	leafFingerprint string              // SHA-256 of the leaf certificate
+	keys            []string            // SPKI hashes a pin may match: the verified chain, or only the leaf
+	certs           []*x509.Certificate // Certificates of keys
+	pin             RegistryPin
+}
+
+// DefaultPinFile returns the default location of the certificate pin state file
+func DefaultPinFile() string {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	return filepath.Join(homeDir, ".kimia", "registry-pins.json")
+}
+
+// VerifyRegistryPins implements trust-on-first-use certificate pinning for the
+// destination registries. The first time a registry is contacted the keys its
+// certificate chains to are recorded in pinFile; later runs fail if the
+// registry presents a certificate that chains to none of them. Self-signed
+// registries, which are otherwise only reachable with --insecure-registry,
+// are pinned too; only http:// destinations and registries that turn out to
+// serve plain HTTP are skipped.
+//
+// It returns, per registry, a PEM file with the pinned certificates, written
+// next to pinFile. Callers make it the only trust anchor of the registry
+// (see RegistryTLS.Pinned), so that the connections of the pushes are
+// verified against the pin and not only the handshake made here.
+func VerifyRegistryPins(destinations []string, pinFile string) (map[string]string, error) {
+	if pinFile == "" {
+		pinFile = DefaultPinFile()
+	}
+
+	pins, err := loadRegistryPins(pinFile)
+	if err != nil {
+		return nil, err
+	}
+
+	registries := make(map[string]bool)
+	for _, dest := range destinations {
+		registry := NormalizeRegistryURL(ExtractRegistry(dest))
+		if strings.HasPrefix(dest, "http://") {
+			logger.Debug("Not pinning %s, which is reached over plain HTTP", registry)
+			continue
+		}
+		registries[registry] = true
+	}
+
+	hosts := make([]string, 0, len(registries))
+	for registry := range registries {
+		hosts = append(hosts, registry)
+	}
+	sort.Strings(hosts)
+
+	updated := false
+	anchors := make(map[string]string)
+	for _, registry := range hosts {
+		chain, err := fetchRegistryChain(registry)
+		var plainHTTP tls.RecordHeaderError
+		if errors.As(err, &plainHTTP) {
+			logger.Warning("Not pinning %s, which serves plain HTTP", registry)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch certificate for %s: %v", registry, err)
+		}
+
+		pin, known := pins[registry]
+		switch {
+		case !known:
+			logger.Warning("Pinning certificate for %s on first use (%s, SPKI SHA256 %s)", registry, chain.pin.Subject, strings.Join(chain.pin.SPKI, ", "))
+			chain.pin.FirstSeen = time.Now().UTC()
+			pin = chain.pin
+			pins[registry] = pin
+			updated = true
+		case len(pin.SPKI) == 0 && strings.EqualFold(pin.Fingerprint, chain.leafFingerprint):
+			// Pins of older versions name the leaf certificate; keep the first-seen date
+			logger.Info("Upgrading the certificate pin of %s to public key pins", registry)
+			chain.pin.FirstSeen = pin.FirstSeen
+			pin = chain.pin
+			pins[registry] = pin
+			updated = true
+		case !containsAny(pin.SPKI, chain.keys):
+			return nil, fmt.Errorf("certificate for %s does not chain to the keys pinned on %s\n"+
+				"  pinned:    %s\n"+
+				"  presented: %s (SPKI SHA256 %s)\n"+
+				"If the registry moved to another CA or certificate, remove the entry from %s",
+				registry, pin.FirstSeen.Format(time.RFC3339), pinnedDescription(pin),
+				chain.pin.Subject, strings.Join(chain.keys, ", "), pinFile)
+		default:
+			logger.Debug("Certificate for %s matches a pinned key", registry)
+		}
+
+		anchor, err := writePinAnchor(pinFile, registry, chain.pinnedCerts(pin))
+		if err != nil {
+			return nil, err
+		}
+		anchors[registry] = anchor
+	}
+
+	if updated {
+		if err := saveRegistryPins(pinFile, pins); err != nil {
+			return nil, err
+		}
+		logger.Info("Registry certificate pins saved to %s", pinFile)
+	}
+
+	return anchors, nil
+}
+
+// pinnedCerts returns the presented certificates whose keys pin names
+func (c presentedChain) pinnedCerts(pin RegistryPin) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for i, key := range c.keys {
+		if containsAny(pin.SPKI, []string{key}) {
+			certs = append(certs, c.certs[i])
+		}
+	}
+	return certs
+}
+
+// pinAnchorDir returns the directory holding the pinned certificates of
+// registry, usable as a Buildah --cert-dir
+func pinAnchorDir(pinFile, registry string) string {
+	return filepath.Join(filepath.Dir(pinFile), "certs.d", strings.ReplaceAll(registry, "/", "_"))
+}
+
+// writePinAnchor writes the pinned certificates of registry to a PEM file
+// and returns its path
+func writePinAnchor(pinFile, registry string, certs []*x509.Certificate) (string, error) {
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	dir := pinAnchorDir(pinFile, registry)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create certificate pin directory: %v", err)
+	}
+	path := filepath.Join(dir, "pinned.crt")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write the pinned certificate of %s: %v", registry, err)
+	}
+	return path, nil
+}
+
+// pinnedDescription describes a pin in error messages
+func pinnedDescription(pin RegistryPin) string {
+	if len(pin.SPKI) == 0 {
+		return fmt.Sprintf("%s (certificate SHA256 %s)", pin.Subject, pin.Fingerprint)
+	}
+	return fmt.Sprintf("%s (SPKI SHA256 %s)", pin.Subject, strings.Join(pin.SPKI, ", "))
+}
+
+// containsAny reports whether any of values is in set
+func containsAny(set, values []string) bool {
+	for _, value := range values {
+		for _, s := range set {
+			if strings.EqualFold(s, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetchRegistryChain performs a TLS handshake with the registry and returns
+// the keys its certificate chains to. The handshake proves that the registry
+// holds the leaf key; issuing CAs only count when the chain verifies, since
+// a certificate sent along is no proof by itself.
+func fetchRegistryChain(registry string) (presentedChain, error) {
+	host := registry
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+
+	serverName, _, _ := net.SplitHostPort(host)
+	dialer := &net.Dialer{Timeout: registryDialTimeout}
+	// #nosec G402 -- the chain is verified below; self-signed certificates are pinned by their key instead
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return presentedChain{}, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return presentedChain{}, fmt.Errorf("registry presented no certificate")
+	}
+	leaf := certs[0]
+	sum := sha256.Sum256(leaf.Raw)
+	chain := presentedChain{leafFingerprint: hex.EncodeToString(sum[:])}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	verified, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates})
+	if err != nil || len(verified) == 0 || len(verified[0]) < 2 {
+		logger.Debug("Certificate of %s does not verify (%v); pinning its key", registry, err)
+		chain.keys = []string{spkiHash(leaf)}
+		chain.certs = []*x509.Certificate{leaf}
+		chain.pin = RegistryPin{SPKI: chain.keys, Subject: leaf.Subject.String(), NotAfter: leaf.NotAfter.UTC()}
+		return chain, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, path := range verified {
+		for _, cert := range path {
+			if hash := spkiHash(cert); !seen[hash] {
+				seen[hash] = true
+				chain.keys = append(chain.keys, hash)
+				chain.certs = append(chain.certs, cert)
+			}
+		}
+	}
+	// Pin the issuing CAs of the first chain, not the leaf
+	issuer := verified[0][1]
+	chain.pin = RegistryPin{Subject: issuer.Subject.String(), NotAfter: issuer.NotAfter.UTC()}
+	for _, cert := range verified[0][1:] {
+		chain.pin.SPKI = append(chain.pin.SPKI, spkiHash(cert))
+	}
+	return chain, nil
+}
+
+// spkiHash returns the SHA-256 of a certificate's public key, which stays the
+// same when a certificate is reissued for the same key
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadRegistryPins reads the pin state file; a missing file yields an empty set
+func loadRegistryPins(pinFile string) (RegistryPins, error) {
+	pins := make(RegistryPins)
+
+	// #nosec G304 -- pinFile is an operator-supplied state file path
+	data, err := os.ReadFile(pinFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pins, nil
+		}
+		return nil, fmt.Errorf("failed to read certificate pin file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate pin file %s: %v", pinFile, err)
+	}
+	return pins, nil
+}
+
+// saveRegistryPins writes the pin state file atomically
+func saveRegistryPins(pinFile string, pins RegistryPins) error {
+	if err := os.MkdirAll(filepath.Dir(pinFile), 0700); err != nil {
+		return fmt.Errorf("failed to create certificate pin directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate pins: %v", err)
+	}
+
+	tmpFile := pinFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write certificate pin file: %v", err)
+	}
+	if err := os.Rename(tmpFile, pinFile); err != nil {
+		return fmt.Errorf("failed to write certificate pin file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Sources of artifacts attached to an image
+const (
+	ReferrersAPI = "referrers API"
+	ReferrersTag = "referrers tag"
+	CosignTag    = "cosign tag"
+)
+
+// maxManifestSize bounds manifests and referrer indexes read from a registry
+const maxManifestSize = 4 << 20
+
+// Descriptor is an OCI content descriptor
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+// Platform is the platform of a manifest in an image index, or of an image config
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is the subset of an OCI image manifest or index used to discover
+// artifacts attached to an image
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Manifests     []Descriptor      `json:"manifests,omitempty"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// referrersIndex is the image index kept under the referrers tag of an image
+type referrersIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// ociIndexType is the media type of OCI image indexes
+const ociIndexType = "application/vnd.oci.image.index.v1+json"
+
+// Repository queries the registry API of a single image repository
+type Repository struct {
+	Host       string
+	Repository string
+	ChunkSize  int64           // Upload blobs in chunks of this many bytes (0 = one request)
+	Context    context.Context // Cancels the requests of the repository (nil = never)
+	client     *http.Client
+	insecure   bool
+	token      string     // Authorization header from the last answered challenge
+	mu         sync.Mutex // Guards token for concurrent uploads
+}
+
+// NewRepository returns a client for the repository of ref and the tag or
+// digest ref points to
+func NewRepository(ref string, insecure bool) (*Repository, string) {
+	host, repository, reference := ParseImageReference(ref)
+	return &Repository{Host: host, Repository: repository, client: newRegistryClient(host, insecure), insecure: insecure}, reference
+}
+
+// FetchManifest returns the manifest or index for a tag or digest and its digest
+func (r *Repository) FetchManifest(reference string) (*Manifest, string, error) {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.Host, r.Repository, reference)
+	resp, err := registryRequest(r.client, http.MethodGet, manifestURL, strings.Join(manifestAcceptTypes, ", "), r.Host, r.Repository)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("registry returned HTTP %d for %s/%s:%s", resp.StatusCode, r.Host, r.Repository, reference)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&manifest); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest for %s: %v", reference, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" && strings.HasPrefix(reference, "sha256:") {
+		digest = reference
+	}
+	return &manifest, digest, nil
+}
+
+// Referrers lists the artifacts whose subject is digest. The OCI 1.1
+// referrers API is used when the registry supports it; otherwise the
+// referrers tag schema (sha256-<hex>) is read. It returns the source used.
+func (r *Repository) Referrers(digest string) ([]Descriptor, string, error) {
+	referrersURL := fmt.Sprintf("https://%s/v2/%s/referrers/%s", r.Host, r.Repository, digest)
+	resp, err := registryRequest(r.client, http.MethodGet, referrersURL, "application/vnd.oci.image.index.v1+json", r.Host, r.Repository)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var index Manifest
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index); err != nil {
+			return nil, "", fmt.Errorf("invalid referrers response: %v", err)
+		}
+		return index.Manifests, ReferrersAPI, nil
+	}
+
+	// Registries without the referrers API keep an index under a fallback tag
+	index, _, err := r.FetchManifest(ArtifactTag(digest, ""))
+	if err != nil {
+		return nil, ReferrersTag, nil
+	}
+	return index.Manifests, ReferrersTag, nil
+}
+
+// CosignTags returns the legacy cosign tags (sha256-<hex>.sig, .att, .sbom)
+// that exist for digest, mapped to their manifest digest
+func (r *Repository) CosignTags(digest string) (map[string]string, error) {
+	found := make(map[string]string)
+	for _, suffix := range []string{"sig", "att", "sbom"} {
+		tag := ArtifactTag(digest, suffix)
+		manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.Host, r.Repository, tag)
+		resp, err := registryRequest(r.client, http.MethodHead, manifestURL, strings.Join(manifestAcceptTypes, ", "), r.Host, r.Repository)
+		if err != nil {
+			return found, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			found[suffix] = resp.Header.Get("Docker-Content-Digest")
+		}
+	}
+	return found, nil
+}
+
+// ArtifactTag returns the tag under which artifacts for digest are stored by
+// registries without the referrers API, e.g. sha256-<hex> or sha256-<hex>.sig
+func ArtifactTag(digest, suffix string) string {
+	tag := strings.Replace(digest, ":", "-", 1)
+	if suffix != "" {
+		tag += "." + suffix
+	}
+	return tag
+}
+
+// PushReferrer uploads an artifact manifest that names subject as its subject.
+// Registries with the referrers API index it themselves; for the others it is
+// added to the index under the referrers tag of subject, where clients
+// without the API look for it.
+func (r *Repository) PushReferrer(subject string, artifact Descriptor, manifest []byte) error {
+	header, err := r.putManifest(artifact.Digest, artifact.MediaType, manifest)
+	if err != nil {
+		return err
+	}
+	if header.Get("OCI-Subject") != "" {
+		return nil
+	}
+
+	tag := ArtifactTag(subject, "")
+	index, err := r.fetchReferrersIndex(tag)
+	if err != nil {
+		return err
+	}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest == artifact.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, artifact)
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if _, err := r.putManifest(tag, ociIndexType, data); err != nil {
+		return fmt.Errorf("failed to update referrers tag %s: %v", tag, err)
+	}
+	return nil
+}
+
+// fetchReferrersIndex returns the index under tag, or an empty index if there is none
+func (r *Repository) fetchReferrersIndex(tag string) (*referrersIndex, error) {
+	index := &referrersIndex{SchemaVersion: 2, MediaType: ociIndexType, Manifests: []Descriptor{}}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", r.Host, r.Repository, tag)
+	resp, err := r.send(r.client, http.MethodGet, manifestURL, http.Header{"Accept": {ociIndexType}}, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return index, nil
+	case http.StatusOK:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(index); err != nil {
+			return nil, fmt.Errorf("invalid referrers index %s: %v", tag, err)
+		}
+		return index, nil
+	}
+	return nil, fmt.Errorf("registry returned HTTP %d for %s/%s:%s", resp.StatusCode, r.Host, r.Repository, tag)
+}
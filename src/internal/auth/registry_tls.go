@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RegistryTLS is the TLS configuration of one registry (--registry-config)
+type RegistryTLS struct {
+	Host       string // Registry host, with port if not 443
+	Insecure   bool   // Skip certificate verification and allow plain HTTP
+	CA         string // PEM file with CAs trusted for this registry only
+	ClientCert string // Client certificate for mutual TLS
+	ClientKey  string // Key of ClientCert
+	Pinned     bool   // CA holds the pinned certificates and is the only trust anchor (--pin-registry-cert)
+}
+
+// registryTLS holds the per-registry TLS settings of Kimia's own clients,
+// keyed by normalized host
+var registryTLS = map[string]*tls.Config{}
+
+// ParseRegistryTLS parses a --registry-config value:
+// host=HOST[,insecure=true][,ca=FILE][,client-cert=FILE,client-key=FILE]
+func ParseRegistryTLS(spec string) (RegistryTLS, error) {
+	var config RegistryTLS
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || value == "" {
+			return config, fmt.Errorf("invalid field %q (expected key=value)", field)
+		}
+		switch key {
+		case "host":
+			config.Host = NormalizeRegistryURL(value)
+		case "insecure":
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return config, fmt.Errorf("invalid insecure value %q", value)
+			}
+			config.Insecure = insecure
+		case "ca":
+			config.CA = value
+		case "client-cert":
+			config.ClientCert = value
+		case "client-key":
+			config.ClientKey = value
+		default:
+			return config, fmt.Errorf("unknown key %q (valid: host, insecure, ca, client-cert, client-key)", key)
+		}
+	}
+	if config.Host == "" || strings.Contains(config.Host, "/") {
+		return config, fmt.Errorf("host is required and must be a registry host, not a repository")
+	}
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return config, fmt.Errorf("client-cert and client-key must be given together")
+	}
+	return config, nil
+}
+
+// SetRegistryTLS configures Kimia's registry clients with the per-registry
+// CAs, client certificates and verification settings of configs. CAs are
+// trusted in addition to the system roots (or those of SetRootCAs), so it
+// must be called after SetRootCAs.
+func SetRegistryTLS(configs []RegistryTLS) error {
+	registryTLS = map[string]*tls.Config{}
+	for _, config := range configs {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.Insecure {
+			// #nosec G402 -- only used for registries the user explicitly marked insecure
+			tlsConfig.InsecureSkipVerify = true
+		}
+		if config.CA != "" {
+			pool, err := baseCertPool()
+			if err != nil {
+				return err
+			}
+			if config.Pinned {
+				pool = x509.NewCertPool()
+			}
+			// #nosec G304 -- CA file given by the user with --registry-config
+			data, err := os.ReadFile(config.CA)
+			if err != nil {
+				return fmt.Errorf("failed to read CA of %s: %v", config.Host, err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("CA file %s of %s contains no PEM certificates", config.CA, config.Host)
+			}
+			tlsConfig.RootCAs = pool
+		} else {
+			tlsConfig.RootCAs = rootCAs
+		}
+		if config.ClientCert != "" {
+			pair, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+			if err != nil {
+				return fmt.Errorf("failed to load client certificate of %s: %v", config.Host, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		registryTLS[config.Host] = tlsConfig
+	}
+	return nil
+}
+
+// baseCertPool returns a copy of the roots trusted by every registry
+func baseCertPool() (*x509.CertPool, error) {
+	if rootCAs != nil {
+		return rootCAs.Clone(), nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load system CA certificates: %v", err)
+	}
+	return pool, nil
+}
+
+// tlsConfigFor returns the TLS configuration of connections to host, or nil
+// for Go's defaults
+func tlsConfigFor(host string, insecure bool) *tls.Config {
+	if host == "registry-1.docker.io" {
+		host = "docker.io"
+	}
+	if config, ok := registryTLS[host]; ok {
+		config = config.Clone()
+		if insecure {
+			config.InsecureSkipVerify = true
+		}
+		return config
+	}
+	if insecure {
+		// #nosec G402 -- only used for registries the user explicitly marked insecure
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+	if rootCAs != nil {
+		return &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Timing of `kimia logs --follow` and of the last output of a finished build
+const (
+	logFollowInterval = 500 * time.Millisecond
+	outputDrainWait   = 2 * time.Second
+)
+
+// ActiveBuild is a build running in this container, as listed by `kimia
+// builds`. Its run manifest stays locked while the build runs.
+type ActiveBuild struct {
+	ID           string    `json:"id"`
+	PID          int       `json:"pid"`
+	Started      time.Time `json:"started"`
+	Command      string    `json:"command"` // build or batch
+	Context      string    `json:"context,omitempty"`
+	Builder      string    `json:"builder,omitempty"`
+	Destinations []string  `json:"destinations,omitempty"`
+	Log          string    `json:"log,omitempty"` // Output of the build, removed when it ends; none for a terminal
+
+	manifest string // Run manifest, to tell whether the build still runs
+}
+
+// RegisterBuild makes the run of the workspace an active build that `kimia
+// builds`, `kimia logs` and `kimia cancel` find by its ID, and copies the
+// output of kimia and of the builders it runs to the build log. It returns
+// the build ID; the first history record of the run gets the same ID.
+func (w *Workspace) RegisterBuild(command, contextPath, builder string, destinations []string) (string, error) {
+	if w == nil {
+		return "", fmt.Errorf("no workspace to register the build in")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.build != nil {
+		return w.build.ID, nil
+	}
+	id := newBuildID()
+	// Output to a terminal is left alone, so builders keep their interactive progress display
+	var logPath string
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		logPath = filepath.Join(filepath.Dir(w.manifest.Name()), "build-"+id+".log")
+		output, err := startOutputTee(logPath)
+		if err != nil {
+			return "", err
+		}
+		w.output = output
+	}
+	w.build = &ActiveBuild{
+		ID:           id,
+		PID:          os.Getpid(),
+		Started:      w.started,
+		Command:      command,
+		Context:      logger.SanitizeGitURL(contextPath),
+		Builder:      builder,
+		Destinations: destinations,
+		Log:          logPath,
+	}
+	if err := w.save(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// nextBuildID returns the ID of the registered build for the first history
+// record of the run, so that a build listed by `kimia builds` is found in
+// `kimia history` once it ends, and a new ID for other records
+func nextBuildID() string {
+	if w := workspace; w != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.build != nil && !w.idUsed {
+			w.idUsed = true
+			return w.build.ID
+		}
+	}
+	return newBuildID()
+}
+
+// ListActiveBuilds returns the registered builds that are still running,
+// oldest first
+func ListActiveBuilds() ([]ActiveBuild, error) {
+	manifests, err := filepath.Glob(filepath.Join(workspaceRunsDir(), "run-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var builds []ActiveBuild
+	for _, name := range manifests {
+		build, ok := readActiveBuild(name)
+		if ok {
+			builds = append(builds, build)
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Started.Before(builds[j].Started) })
+	return builds, nil
+}
+
+// FindActiveBuild returns the running build with the ID
+func FindActiveBuild(id string) (ActiveBuild, error) {
+	builds, err := ListActiveBuilds()
+	if err != nil {
+		return ActiveBuild{}, err
+	}
+	for _, build := range builds {
+		if build.ID == id {
+			return build, nil
+		}
+	}
+	return ActiveBuild{}, fmt.Errorf("no running build %s (finished builds are listed by kimia history)", id)
+}
+
+// readActiveBuild reads the build of a run manifest, if the run registered
+// one and has not ended
+func readActiveBuild(name string) (ActiveBuild, bool) {
+	if !runLocked(name) {
+		return ActiveBuild{}, false
+	}
+	// #nosec G304 -- manifest in the per-user runs directory
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return ActiveBuild{}, false
+	}
+	// The manifest may be read while it is rewritten; the next read sees it
+	var manifest workspaceManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Build == nil {
+		return ActiveBuild{}, false
+	}
+	build := *manifest.Build
+	build.manifest = name
+	return build, true
+}
+
+// runLocked reports whether the run of a manifest is alive, i.e. still
+// holds the lock on it
+func runLocked(name string) bool {
+	// #nosec G304 -- manifest in the per-user runs directory
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		// #nosec G104 -- released right away, the run has ended
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return false
+	}
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+// CancelActiveBuild sends SIGTERM to the kimia process of a running build,
+// which stops the builder and exits with exitcode.Canceled
+func CancelActiveBuild(id string) (ActiveBuild, error) {
+	build, err := FindActiveBuild(id)
+	if err != nil {
+		return build, err
+	}
+	if err := syscall.Kill(build.PID, syscall.SIGTERM); err != nil {
+		return build, fmt.Errorf("failed to cancel build %s (PID %d): %v", id, build.PID, err)
+	}
+	return build, nil
+}
+
+// CopyBuildLog writes the log of a running build to out. With follow, it
+// keeps writing what the build prints until the build ends.
+func CopyBuildLog(build ActiveBuild, out io.Writer, follow bool) error {
+	if build.Log == "" {
+		return fmt.Errorf("build %s prints to a terminal and keeps no log", build.ID)
+	}
+	// #nosec G304 -- log path read from a manifest in the per-user runs directory
+	file, err := os.Open(build.Log)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("build %s has ended (see kimia history %s)", build.ID, build.ID)
+		}
+		return fmt.Errorf("failed to read the log of build %s: %v", build.ID, err)
+	}
+	defer file.Close()
+	for {
+		// Checked before copying so that the output printed last is not missed
+		running := follow && runLocked(build.manifest)
+		if _, err := io.Copy(out, file); err != nil {
+			return fmt.Errorf("failed to read the log of build %s: %v", build.ID, err)
+		}
+		if !running {
+			return nil
+		}
+		time.Sleep(logFollowInterval)
+	}
+}
+
+// outputTee copies what is written to the standard output and error of this
+// process, by kimia or by the commands it runs, to a build log as well
+type outputTee struct {
+	log   *os.File
+	mu    sync.Mutex // Serializes the writes of both streams to the log
+	fds   []int      // Redirected descriptors
+	saved []int      // Their original targets
+	done  sync.WaitGroup
+}
+
+// startOutputTee redirects stdout and stderr through pipes that copy to the
+// original descriptors and to the log at logPath
+func startOutputTee(logPath string) (*outputTee, error) {
+	// #nosec G304 -- log in the per-user runs directory
+	log, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build log: %v", err)
+	}
+	t := &outputTee{log: log}
+	for _, fd := range []int{int(os.Stdout.Fd()), int(os.Stderr.Fd())} {
+		if err := t.redirect(fd); err != nil {
+			t.stop()
+			// #nosec G104 -- the log is not used
+			os.Remove(logPath)
+			return nil, fmt.Errorf("failed to copy output to the build log: %v", err)
+		}
+	}
+	return t, nil
+}
+
+// redirect makes fd the write end of a pipe copied to its original target and the log
+func (t *outputTee) redirect(fd int) error {
+	saved, err := syscall.Dup(fd)
+	if err != nil {
+		return err
+	}
+	syscall.CloseOnExec(saved)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		syscall.Close(saved)
+		return err
+	}
+	if err := syscall.Dup3(int(writer.Fd()), fd, 0); err != nil {
+		reader.Close()
+		writer.Close()
+		syscall.Close(saved)
+		return err
+	}
+	// fd now holds the write end
+	writer.Close()
+	t.fds = append(t.fds, fd)
+	t.saved = append(t.saved, saved)
+
+	target := os.NewFile(uintptr(saved), "output")
+	t.done.Add(1)
+	go func() {
+		defer t.done.Done()
+		defer reader.Close()
+		defer target.Close()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				// #nosec G104 -- output is best effort, as when written directly
+				target.Write(buf[:n])
+				t.mu.Lock()
+				// #nosec G104
+				t.log.Write(buf[:n])
+				t.mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stop restores stdout and stderr and waits briefly for the output still in
+// the pipes, which commands left running (a shared buildkitd) may keep open
+func (t *outputTee) stop() {
+	if t == nil {
+		return
+	}
+	for i, fd := range t.fds {
+		// #nosec G104 -- restoring the original descriptor also closes the pipe
+		syscall.Dup3(t.saved[i], fd, 0)
+	}
+	drained := make(chan struct{})
+	go func() {
+		t.done.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(outputDrainWait):
+	}
+	t.fds = nil
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// #nosec G104 -- the log is removed with the run manifest
+	t.log.Close()
+}
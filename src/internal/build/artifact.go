@@ -0,0 +1,177 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// defaultArtifactFileType is the media type of artifact files given without one
+const defaultArtifactFileType = "application/octet-stream"
+
+// Artifact is a non-container OCI artifact, such as a WASM module or a Helm
+// chart, pushed with `kimia push-artifact`
+type Artifact struct {
+	Type        string            // Artifact type of the manifest
+	Files       []ArtifactFile    // Layers, in order
+	Config      *ArtifactFile     // Config blob; the empty config when nil
+	Annotations map[string]string // Manifest annotations
+}
+
+// ArtifactFile is a blob of an artifact
+type ArtifactFile struct {
+	Path      string
+	MediaType string
+}
+
+// ParseArtifactFile parses PATH or PATH:MEDIATYPE. Files without a media
+// type get defaultType, or application/octet-stream.
+func ParseArtifactFile(spec, defaultType string) (ArtifactFile, error) {
+	file := ArtifactFile{Path: spec, MediaType: defaultType}
+	// A media type always has a slash, which tells it from a colon in the path
+	if idx := strings.LastIndex(spec, ":"); idx > 0 && strings.Contains(spec[idx+1:], "/") {
+		file.Path, file.MediaType = spec[:idx], spec[idx+1:]
+	}
+	if file.Path == "" {
+		return file, fmt.Errorf("invalid artifact file %q (expected PATH or PATH:MEDIATYPE)", spec)
+	}
+	if file.MediaType == "" {
+		file.MediaType = defaultArtifactFileType
+	}
+	return file, nil
+}
+
+// PushArtifact pushes the artifact under every destination of config and
+// returns the digest of its manifest, which is the same everywhere. The
+// artifact is then signed like a built image when config.Sign is set.
+func PushArtifact(config Config, artifact Artifact) (string, error) {
+	blobs := make([]attachmentBlob, 0, len(artifact.Files))
+	for _, file := range artifact.Files {
+		blob, err := hashAttachment(Attachment{File: file.Path, ArtifactType: file.MediaType})
+		if err != nil {
+			return "", err
+		}
+		blobs = append(blobs, blob)
+	}
+	configBlob := attachmentBlob{Attachment: Attachment{ArtifactType: ociEmptyType}, digest: ociEmptyDigest, size: 2}
+	if artifact.Config != nil {
+		blob, err := hashAttachment(Attachment{File: artifact.Config.Path, ArtifactType: artifact.Config.MediaType})
+		if err != nil {
+			return "", err
+		}
+		configBlob = blob
+	}
+
+	manifest, err := artifactManifest(artifact, configBlob, blobs)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256Digest(manifest)
+	logger.Info("Artifact %s: %d file(s), manifest %s", artifact.Type, len(blobs), digest)
+
+	if config.DryRun {
+		for _, blob := range blobs {
+			logger.Info("Dry run: would push %s (%s, %s)", blob.File, blob.ArtifactType, formatBytes(blob.size))
+		}
+		logger.Info("Dry run: would push the artifact to %s", strings.Join(config.Destination, ", "))
+		if config.Sign {
+			logger.Info("Dry run: would sign the artifact with cosign")
+		}
+		return digest, nil
+	}
+
+	// Blobs are uploaded once per repository
+	done := make(map[string]bool)
+	for _, dest := range config.Destination {
+		repo, reference := auth.NewRepository(dest, config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry))
+		if strings.HasPrefix(reference, "sha256:") {
+			return "", fmt.Errorf("artifact destination must be a tag, not a digest: %s", dest)
+		}
+		name := repo.Host + "/" + repo.Repository
+		if !done[name] {
+			if err := pushArtifactBlobs(repo, configBlob, blobs); err != nil {
+				return "", fmt.Errorf("failed to push artifact to %s: %v", dest, err)
+			}
+			done[name] = true
+		}
+		pushed, err := repo.PushManifest(reference, ociManifestType, manifest)
+		if err != nil {
+			return "", fmt.Errorf("failed to push artifact to %s: %v", dest, err)
+		}
+		if pushed != "" && pushed != digest {
+			return "", fmt.Errorf("registry stored the artifact pushed to %s with digest %s, expected %s", dest, pushed, digest)
+		}
+		logger.Info("Pushed %s@%s", dest, digest)
+	}
+
+	if config.Sign {
+		digestMap := make(map[string]string, len(config.Destination))
+		for _, dest := range config.Destination {
+			digestMap[dest] = digest
+		}
+		if err := signImages(config, digestMap); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// artifactManifest returns the OCI image manifest of an artifact. Layers are
+// titled with their file name, as ORAS and Helm expect.
+func artifactManifest(artifact Artifact, configBlob attachmentBlob, blobs []attachmentBlob) ([]byte, error) {
+	layers := make([]auth.Descriptor, 0, len(blobs))
+	for _, blob := range blobs {
+		layers = append(layers, auth.Descriptor{
+			MediaType:   blob.ArtifactType,
+			Digest:      blob.digest,
+			Size:        blob.size,
+			Annotations: map[string]string{attachmentTitleAnnotation: filepath.Base(blob.File)},
+		})
+	}
+	annotations := map[string]string{attachmentCreatedAnnotation: time.Now().UTC().Format(time.RFC3339)}
+	for key, value := range artifact.Annotations {
+		annotations[key] = value
+	}
+	manifest, err := json.Marshal(auth.Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  artifact.Type,
+		Config:        auth.Descriptor{MediaType: configBlob.ArtifactType, Digest: configBlob.digest, Size: configBlob.size},
+		Layers:        layers,
+		Annotations:   annotations,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode artifact manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// pushArtifactBlobs uploads the config and layers of an artifact the
+// repository does not have yet
+func pushArtifactBlobs(repo *auth.Repository, configBlob attachmentBlob, blobs []attachmentBlob) error {
+	if configBlob.File == "" {
+		if err := pushEmptyConfig(repo); err != nil {
+			return err
+		}
+	} else {
+		blobs = append([]attachmentBlob{configBlob}, blobs...)
+	}
+	for _, blob := range blobs {
+		exists, err := repo.BlobExists(blob.digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := repo.PushBlob(blob.File, blob.digest, blob.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
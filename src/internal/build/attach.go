@@ -0,0 +1,223 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Annotations recorded on attached artifacts
+const (
+	attachmentTitleAnnotation   = "org.opencontainers.image.title"
+	attachmentCreatedAnnotation = "org.opencontainers.image.created"
+)
+
+// attachmentTypes maps the --attach type shorthands to artifact types
+var attachmentTypes = map[string]string{
+	"sarif":     "application/sarif+json",
+	"spdx":      "application/spdx+json",
+	"cyclonedx": "application/vnd.cyclonedx+json",
+	"openvex":   "application/vnd.openvex+json",
+	"in-toto":   "application/vnd.in-toto+json",
+}
+
+// Attachment is a file attached to the pushed image as an OCI referrer
+// artifact (--attach)
+type Attachment struct {
+	File         string
+	ArtifactType string
+}
+
+// AttachmentTypes returns the --attach type shorthands
+func AttachmentTypes() []string {
+	types := make([]string, 0, len(attachmentTypes))
+	for name := range attachmentTypes {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ParseAttachment parses an --attach value: file=PATH with type=NAME or
+// artifact-type=MEDIATYPE
+func ParseAttachment(spec string) (Attachment, error) {
+	var attachment Attachment
+	var kind string
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || value == "" {
+			return attachment, fmt.Errorf("invalid --attach field %q (expected key=value)", field)
+		}
+		switch key {
+		case "type":
+			kind = value
+		case "file":
+			attachment.File = value
+		case "artifact-type":
+			attachment.ArtifactType = value
+		default:
+			return attachment, fmt.Errorf("unknown --attach key %q (valid: type, file, artifact-type)", key)
+		}
+	}
+	if attachment.File == "" {
+		return attachment, fmt.Errorf("--attach %s: file= is required", spec)
+	}
+	if kind != "" {
+		artifactType, ok := attachmentTypes[kind]
+		if !ok {
+			return attachment, fmt.Errorf("--attach %s: unknown type %q (valid: %s; or give artifact-type=)", spec, kind, strings.Join(AttachmentTypes(), ", "))
+		}
+		if attachment.ArtifactType == "" {
+			attachment.ArtifactType = artifactType
+		}
+	}
+	if attachment.ArtifactType == "" {
+		return attachment, fmt.Errorf("--attach %s: type= or artifact-type= is required", spec)
+	}
+	if !strings.Contains(attachment.ArtifactType, "/") {
+		return attachment, fmt.Errorf("--attach %s: artifact-type must be a media type such as application/vnd.example+json", spec)
+	}
+	return attachment, nil
+}
+
+// attachmentBlob is the content of an attachment file
+type attachmentBlob struct {
+	Attachment
+	digest string
+	size   int64
+}
+
+// AttachArtifacts uploads every attachment as a referrer artifact of the
+// pushed images, to the attestation repository of an image when it has one.
+// Destinations in the same repository share one artifact.
+func AttachArtifacts(images []PushedImage, attachments []Attachment, repos AttestationRepos, insecure func(string) bool, dryRun bool) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	if dryRun {
+		for _, attachment := range attachments {
+			logger.Info("Dry run: would attach %s (%s) to the pushed image", attachment.File, attachment.ArtifactType)
+		}
+		return nil
+	}
+
+	blobs := make([]attachmentBlob, 0, len(attachments))
+	for _, attachment := range attachments {
+		blob, err := hashAttachment(attachment)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	done := make(map[string]bool)
+	for _, image := range images {
+		if image.Digest == "" {
+			return fmt.Errorf("no digest known for %s to attach artifacts to", image.Destination)
+		}
+		repo, _ := auth.NewRepository(image.Destination, insecure(image.Destination))
+		target := repo
+		if name := repos.For(image.Destination); name != "" {
+			target, _ = auth.NewRepository(name, insecure(name))
+		}
+		key := target.Host + "/" + target.Repository + "@" + image.Digest
+		if done[key] {
+			continue
+		}
+		if err := attachToImage(repo, target, image.Digest, blobs); err != nil {
+			return fmt.Errorf("failed to attach artifacts to %s: %v", image.Destination, err)
+		}
+		done[key] = true
+	}
+	return nil
+}
+
+// hashAttachment returns the digest and size of an attachment file
+func hashAttachment(attachment Attachment) (attachmentBlob, error) {
+	blob := attachmentBlob{Attachment: attachment}
+	// #nosec G304 -- file given by the user with --attach
+	file, err := os.Open(attachment.File)
+	if err != nil {
+		return blob, fmt.Errorf("failed to open attachment: %v", err)
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if blob.size, err = io.Copy(hasher, file); err != nil {
+		return blob, fmt.Errorf("failed to read attachment %s: %v", attachment.File, err)
+	}
+	blob.digest = "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	return blob, nil
+}
+
+// attachToImage pushes one artifact manifest per blob with digest in repo as
+// its subject to target
+func attachToImage(repo, target *auth.Repository, digest string, blobs []attachmentBlob) error {
+	raw, mediaType, err := repo.FetchRawManifest(digest)
+	if err != nil {
+		return err
+	}
+	if got := sha256Digest(raw); got != digest {
+		return fmt.Errorf("registry returned manifest content with digest %s for %s", got, digest)
+	}
+	if mediaType == "" {
+		var manifest auth.Manifest
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return fmt.Errorf("invalid manifest %s: %v", digest, err)
+		}
+		mediaType = manifest.MediaType
+	}
+	subject := &auth.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+
+	if err := pushEmptyConfig(target); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		exists, err := target.BlobExists(blob.digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := target.PushBlob(blob.File, blob.digest, blob.size); err != nil {
+				return err
+			}
+		}
+
+		manifest, err := json.Marshal(auth.Manifest{
+			SchemaVersion: 2,
+			MediaType:     ociManifestType,
+			ArtifactType:  blob.ArtifactType,
+			Config:        auth.Descriptor{MediaType: ociEmptyType, Digest: ociEmptyDigest, Size: 2},
+			Layers: []auth.Descriptor{{
+				MediaType:   blob.ArtifactType,
+				Digest:      blob.digest,
+				Size:        blob.size,
+				Annotations: map[string]string{attachmentTitleAnnotation: filepath.Base(blob.File)},
+			}},
+			Subject:     subject,
+			Annotations: map[string]string{attachmentCreatedAnnotation: time.Now().UTC().Format(time.RFC3339)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode artifact manifest: %v", err)
+		}
+		artifact := auth.Descriptor{MediaType: ociManifestType, ArtifactType: blob.ArtifactType, Digest: sha256Digest(manifest), Size: int64(len(manifest))}
+		if err := target.PushReferrer(digest, artifact, manifest); err != nil {
+			return err
+		}
+		if target == repo {
+			logger.Info("Attached %s (%s) to %s/%s@%s", blob.File, blob.ArtifactType, repo.Host, repo.Repository, digest)
+		} else {
+			logger.Info("Attached %s (%s) to %s/%s@%s in %s/%s", blob.File, blob.ArtifactType, repo.Host, repo.Repository, digest, target.Host, target.Repository)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Annotations BuildKit puts on the attestation manifests of an image index
+const (
+	attestationReferenceType   = "vnd.docker.reference.type"
+	attestationReferenceDigest = "vnd.docker.reference.digest"
+	predicateTypeAnnotation    = "in-toto.io/predicate-type"
+)
+
+// inTotoArtifactType is the artifact type of attestations stored as referrers
+const inTotoArtifactType = "application/vnd.in-toto+json"
+
+// AttestationRepos maps destinations to the repository that holds their
+// signatures and attestations (--attestation-repo), like COSIGN_REPOSITORY
+// does for cosign. Destinations without one keep them next to the image.
+type AttestationRepos struct {
+	Default      string            // Repository of the destinations without their own
+	ByRepository map[string]string // host/repository of the image -> attestation repository
+}
+
+// ParseAttestationRepos parses --attestation-repo values: REPO for every
+// destination, or IMAGE_REPO=REPO for the destinations in IMAGE_REPO
+func ParseAttestationRepos(specs []string) (AttestationRepos, error) {
+	repos := AttestationRepos{ByRepository: make(map[string]string)}
+	for _, spec := range specs {
+		image, repo, perImage := strings.Cut(spec, "=")
+		if !perImage {
+			image, repo = "", spec
+		}
+		if err := checkRepositoryName(repo); err != nil {
+			return repos, fmt.Errorf("invalid --attestation-repo %q: %v", spec, err)
+		}
+		if !perImage {
+			if repos.Default != "" && repos.Default != repo {
+				return repos, fmt.Errorf("--attestation-repo given twice without an image repository (%s, %s)", repos.Default, repo)
+			}
+			repos.Default = repo
+			continue
+		}
+		if err := checkRepositoryName(image); err != nil {
+			return repos, fmt.Errorf("invalid --attestation-repo %q: %v", spec, err)
+		}
+		key := repositoryKey(image)
+		if existing, ok := repos.ByRepository[key]; ok && existing != repo {
+			return repos, fmt.Errorf("--attestation-repo gives %s two repositories (%s, %s)", image, existing, repo)
+		}
+		repos.ByRepository[key] = repo
+	}
+	return repos, nil
+}
+
+// checkRepositoryName rejects empty names and names with a tag or digest
+func checkRepositoryName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("repository is empty")
+	case strings.Contains(name, "@"), strings.LastIndex(name, ":") > strings.LastIndex(name, "/"):
+		return fmt.Errorf("%s must be a repository without a tag or digest", name)
+	}
+	return nil
+}
+
+// repositoryKey returns the registry host and repository of an image reference
+func repositoryKey(ref string) string {
+	host, repository, _ := auth.ParseImageReference(ref)
+	return host + "/" + repository
+}
+
+// For returns the attestation repository of dest, "" to keep its
+// signatures and attestations in its own repository
+func (r AttestationRepos) For(dest string) string {
+	if repo, ok := r.ByRepository[repositoryKey(dest)]; ok {
+		return repo
+	}
+	return r.Default
+}
+
+// IsSet reports whether any --attestation-repo was given
+func (r AttestationRepos) IsSet() bool {
+	return r.Default != "" || len(r.ByRepository) > 0
+}
+
+// StoreAttestations copies the SBOM and provenance attestations BuildKit put
+// in the index of each pushed image to its attestation repository, one
+// in-toto referrer of the image digest per attestation. Images without an
+// attestation repository and images without attestations are skipped.
+func StoreAttestations(images []PushedImage, repos AttestationRepos, insecure func(string) bool) error {
+	done := make(map[string]bool)
+	for _, image := range images {
+		target := repos.For(image.Destination)
+		if target == "" {
+			continue
+		}
+		if image.Digest == "" {
+			return fmt.Errorf("no digest known for %s to store its attestations", image.Destination)
+		}
+		key := repositoryKey(target) + "@" + image.Digest
+		if done[key] {
+			continue
+		}
+		src, _ := auth.NewRepository(image.Destination, insecure(image.Destination))
+		dst, _ := auth.NewRepository(target, insecure(target))
+		stored, err := storeImageAttestations(src, dst, image.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to store the attestations of %s in %s: %v", image.Destination, target, err)
+		}
+		if stored > 0 {
+			logger.Info("Stored %d attestation(s) of %s@%s in %s", stored, src.Repository, image.Digest, target)
+		}
+		done[key] = true
+	}
+	return nil
+}
+
+// storeImageAttestations pushes every in-toto statement of the attestation
+// manifests of image digest in src to dst and returns how many it pushed
+func storeImageAttestations(src, dst *auth.Repository, digest string) (int, error) {
+	raw, mediaType, err := src.FetchRawManifest(digest)
+	if err != nil {
+		return 0, err
+	}
+	var index auth.Manifest
+	if err := json.Unmarshal(raw, &index); err != nil {
+		return 0, fmt.Errorf("invalid manifest %s: %v", digest, err)
+	}
+	if mediaType == "" {
+		mediaType = index.MediaType
+	}
+	subject := &auth.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw))}
+
+	stored := 0
+	copier := &imageCopier{src: src, dst: dst}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[attestationReferenceType] != "attestation-manifest" {
+			continue
+		}
+		attestation, _, err := src.FetchManifest(desc.Digest)
+		if err != nil {
+			return stored, fmt.Errorf("attestation manifest %s: %v", desc.Digest, err)
+		}
+		if stored == 0 {
+			if err := pushEmptyConfig(dst); err != nil {
+				return stored, err
+			}
+		}
+		if err := copier.copyBlobs(attestation.Layers); err != nil {
+			return stored, err
+		}
+		for _, layer := range attestation.Layers {
+			annotations := map[string]string{
+				predicateTypeAnnotation:     layer.Annotations[predicateTypeAnnotation],
+				attestationReferenceDigest:  desc.Annotations[attestationReferenceDigest],
+				attachmentCreatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			}
+			manifest, err := json.Marshal(auth.Manifest{
+				SchemaVersion: 2,
+				MediaType:     ociManifestType,
+				ArtifactType:  inTotoArtifactType,
+				Config:        auth.Descriptor{MediaType: ociEmptyType, Digest: ociEmptyDigest, Size: 2},
+				Layers:        []auth.Descriptor{layer},
+				Subject:       subject,
+				Annotations:   annotations,
+			})
+			if err != nil {
+				return stored, fmt.Errorf("failed to encode attestation manifest: %v", err)
+			}
+			artifact := auth.Descriptor{
+				MediaType:    ociManifestType,
+				ArtifactType: inTotoArtifactType,
+				Digest:       sha256Digest(manifest),
+				Size:         int64(len(manifest)),
+				Annotations:  annotations,
+			}
+			if err := dst.PushReferrer(digest, artifact, manifest); err != nil {
+				return stored, err
+			}
+			stored++
+		}
+	}
+	return stored, nil
+}
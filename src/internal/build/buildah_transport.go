@@ -0,0 +1,156 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+)
+
+// DefaultPodmanSocket is the Podman service used by a bare --buildah-remote
+// when CONTAINER_HOST is not set
+const DefaultPodmanSocket = "unix:///run/podman/podman.sock"
+
+// podmanRemoteSchemes are the service URL schemes accepted by --buildah-remote
+var podmanRemoteSchemes = []string{"unix://", "tcp://", "ssh://"}
+
+// buildahTransport runs Buildah subcommands, either with the buildah binary in
+// this container or through a Podman service socket (--buildah-remote), so the
+// builder can run in a privileged sidecar while Kimia stays unprivileged
+type buildahTransport interface {
+	// commandLine returns the program and arguments that run a Buildah
+	// subcommand such as "bud", "push", "images" or "inspect"
+	commandLine(args []string) (string, []string)
+	// archiveCommand writes image as a docker-archive at path on this machine
+	archiveCommand(image, path string) *exec.Cmd
+	// remote reports whether images live in the service's storage
+	remote() bool
+}
+
+// newBuildahTransport returns the remote transport for a Podman service URL,
+// or the local buildah binary when url is empty, using the storage under root
+// when it is set
+func newBuildahTransport(url, root string) buildahTransport {
+	if url == "" {
+		return localBuildah{root: root}
+	}
+	return podmanRemote{url: url}
+}
+
+// buildahCommand returns the command running a Buildah subcommand over t
+func buildahCommand(t buildahTransport, args ...string) *exec.Cmd {
+	program, programArgs := t.commandLine(args)
+	// #nosec G204 -- callers pass validated Buildah arguments
+	return exec.Command(program, programArgs...)
+}
+
+// buildahCommandContext is buildahCommand for a phase limited by ctx
+func buildahCommandContext(ctx context.Context, t buildahTransport, args ...string) *exec.Cmd {
+	program, programArgs := t.commandLine(args)
+	return commandContext(ctx, program, programArgs...)
+}
+
+// localBuildah runs the buildah binary in this container, in its default
+// storage or in a storage root of its own (builds running in parallel)
+type localBuildah struct {
+	root string
+}
+
+func (l localBuildah) commandLine(args []string) (string, []string) {
+	return "buildah", append(l.globalArgs(), args...)
+}
+
+func (l localBuildah) archiveCommand(image, path string) *exec.Cmd {
+	args := append(l.globalArgs(), "push", image, fmt.Sprintf("docker-archive:%s:%s", path, image))
+	// #nosec G204 -- image and path validated by validateBuildahInputs
+	return exec.Command("buildah", args...)
+}
+
+// globalArgs selects the storage root of the build
+func (l localBuildah) globalArgs() []string {
+	if l.root == "" {
+		return nil
+	}
+	return []string{"--root", l.root, "--runroot", filepath.Join(l.root, "run")}
+}
+
+func (localBuildah) remote() bool {
+	return false
+}
+
+// podmanRemote runs Buildah subcommands through a Podman service with podman
+// --remote. Podman builds with Buildah and accepts the same build and push flags.
+type podmanRemote struct {
+	url string
+}
+
+func (p podmanRemote) commandLine(args []string) (string, []string) {
+	remoteArgs := []string{"--remote", "--url", p.url}
+	if len(args) == 0 {
+		return "podman", remoteArgs
+	}
+
+	subcommand := args[0]
+	if subcommand == "bud" {
+		subcommand = "build"
+	}
+	remoteArgs = append(remoteArgs, subcommand)
+
+	// The service pulls and pushes with credentials sent by the client
+	if subcommand == "build" || subcommand == "push" {
+		authFile := filepath.Join(auth.GetDockerConfigDir(), "config.json")
+		if _, err := os.Stat(authFile); err == nil {
+			remoteArgs = append(remoteArgs, "--authfile", authFile)
+		}
+	}
+	return "podman", append(remoteArgs, args[1:]...)
+}
+
+func (p podmanRemote) archiveCommand(image, path string) *exec.Cmd {
+	// podman save streams the archive from the service to the client
+	// #nosec G204 -- image and path validated by validateBuildahInputs, URL by validateBuildahRemote
+	return exec.Command("podman", "--remote", "--url", p.url, "save", "--format", "docker-archive", "-o", path, image)
+}
+
+func (podmanRemote) remote() bool {
+	return true
+}
+
+// DetectBuilderFor determines the builder selected with --builder (choice)
+// when an external buildkitd address or a remote Buildah service may be
+// configured: only the client is needed to use a builder running elsewhere
+func DetectBuilderFor(choice, buildkitAddr, buildahRemote string) string {
+	switch {
+	case buildahRemote != "":
+		if _, err := exec.LookPath("podman"); err == nil {
+			return "buildah"
+		}
+		return "unknown"
+	case buildkitAddr != "":
+		if _, err := exec.LookPath("buildctl"); err == nil {
+			return "buildkit"
+		}
+		return "unknown"
+	}
+	return DetectChosenBuilder(choice)
+}
+
+// validateBuildahRemote checks the Podman service URL given to --buildah-remote
+func validateBuildahRemote(url string) error {
+	if url == "" {
+		return nil
+	}
+	if strings.ContainsAny(url, "\x00 \t\n") {
+		return fmt.Errorf("invalid --buildah-remote URL %q", url)
+	}
+	for _, scheme := range podmanRemoteSchemes {
+		if strings.HasPrefix(url, scheme) && len(url) > len(scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid --buildah-remote URL %q (expected one of: %s)", url, strings.Join(podmanRemoteSchemes, ", "))
+}
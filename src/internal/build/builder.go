@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"github.com/rapidfort/kimia/internal/auth"
 	"github.com/rapidfort/kimia/internal/validation"
@@ -36,8 +37,19 @@ type Config struct {
 	ExportCache []string // BuildKit --export-cache options (e.g. "type=registry,ref=...,mode=max")
 	ImportCache []string // BuildKit --import-cache options (e.g. "type=registry,ref=...")
 
+	// Local directory cache for cross-job reuse (BuildKit type=local)
+	CacheExportDir string
+	CacheImportDir string
+
+	// Embed cache metadata in the pushed image (BuildKit type=inline)
+	CacheInline bool
+
+	// Registry repository for layer cache, used by both builders
+	CacheRepo string
+
 	// Storage driver
 	StorageDriver string
+	StorageRoot   string // Buildah storage of this build alone (parallel batch builds); "" = the default storage
 
 	// Security options
 	Insecure            bool
@@ -52,11 +64,17 @@ type Config struct {
 	DigestFile                 string
 	ImageNameWithDigestFile    string
 	ImageNameTagWithDigestFile string
+	DigestMapFile              string       // JSON map of every pushed reference to its digest
+	Attach                     []Attachment // Files attached to the pushed image as referrer artifacts
+	VerifyPush                 bool         // Read pushed images back from the registry and compare them with the build
 
 	// Reproducible builds
 	Reproducible bool
 	Timestamp    string
 
+	// Owner, modes and modification times given to the build context (--normalize-context); nil = as is
+	NormalizeContext *ContextNormalization
+
 	// Attestation and signing (BuildKit only)
 	// Level 1: Simple mode (backward compatible)
 	Attestation string // "off", "min" or "max"
@@ -66,14 +84,159 @@ type Config struct {
 	
 	// Level 3: Direct BuildKit options (escape hatch)
 	BuildKitOpts []string
+
+	// Repositories that store signatures and attestations (--attestation-repo)
+	AttestationRepos AttestationRepos
 	
 	// Signing
-	Sign              bool   // Enable signing with cosign
-	CosignKeyPath     string // Path to cosign private key
-	CosignPasswordEnv string // Environment variable for cosign password
+	Sign               bool   // Enable signing with cosign
+	CosignKeyPath      string // Path to cosign private key
+	CosignPasswordEnv  string // Environment variable for cosign password
+	CosignPasswordFile string // File with the cosign password, read instead of CosignPasswordEnv
 
 	// Direct Buildah options
 	BuildahOpts []string
+
+	// Base image rewrite rules (PATTERN=REPLACEMENT) applied to FROM images
+	BaseImageRewrites []string
+
+	// Layer size limit in bytes (0 = unlimited) and opt-in splitting of large COPY layers
+	MaxLayerSize     int64
+	SplitLargeLayers bool
+
+	// Image size limit in bytes, the sum of its layers (0 = unlimited)
+	MaxImageSize int64
+
+	// Layer compression of pushed images (--compression, see
+	// ResolveCompression) and its level (0 = the builder default)
+	Compression      string
+	CompressionLevel int
+
+	// Print the resolved builder invocation instead of building
+	DryRun bool
+
+	// JSON-lines file receiving build events such as the timing report
+	EventsFile string
+
+	// Retries of builds that failed with a transient network error (0 = off)
+	RetryTransient int
+
+	// Flatten all layers, or only the layers created by this build (Buildah only)
+	Squash    bool
+	SquashNew bool
+
+	// Base image pull policy: "always", "missing", "never" or "" for the builder default
+	PullPolicy string
+
+	// PEM file of extra CA certificates (--ca-bundle), already installed
+	// process-wide by InstallCABundle; listed per registry in buildkitd.toml
+	CABundle string
+
+	// Per-registry TLS settings (--registry-config); insecure hosts are also
+	// listed in InsecureRegistry
+	RegistryTLS []auth.RegistryTLS
+
+	// TOML files merged, in order, into the generated buildkitd.toml (BuildKit only)
+	BuildkitdConfigFragments []string
+
+	// Buildah --userns-uid-map/--userns-gid-map values (container:host:size),
+	// set when Buildah runs as root or remotely; rootless builds map IDs
+	// through /etc/subuid and /etc/subgid instead
+	UsernsUIDMap []string
+	UsernsGIDMap []string
+
+	// Network settings of RUN steps
+	Network   string   // "host", "none", "slirp4netns" or "" for host
+	AddHosts  []string // host:ip entries added to /etc/hosts
+	DNS       []string // DNS servers
+	DNSSearch []string // DNS search domains
+
+	// Privileged RUN steps (--allow-privileged-steps): BuildKit entitlements,
+	// Buildah devices and capabilities
+	Allow   []string
+	Devices []string
+	CapAdd  []string
+
+	// Secrets for RUN --mount=type=secret (--build-arg-from-secret, --secret-from-env)
+	Secrets []BuildSecret
+
+	// Local store all base images come from; nothing is pulled (--offline)
+	ImageStore *ImageStore
+
+	// Chained builds (--chain): the primary build exports its image to
+	// ChainLayout (BuildKit), and a chained build refers to it as ChainFrom
+	ChainLayout string
+	ChainFrom   *ChainSource
+
+	// Command run in the built image before it is pushed (--test-cmd, Buildah;
+	// BuildKit runs it as a chained build, see NewTestChain)
+	TestCmd []string
+
+	// Explains the cache hit or miss of every step (--explain-cache)
+	CacheExplain *CacheExplanation
+
+	// History record receiving the step counts and pushed digests of the build
+	History *BuildRecord
+
+	// Ignore file used instead of .dockerignore (absolute path, "" = default)
+	IgnoreFile string
+
+	// Time limits of the build and push phases (0 = none); BuildKit pushes
+	// during the build, so buildctl gets both
+	BuildTimeout time.Duration
+	PushTimeout  time.Duration
+
+	// Log a heartbeat when the build has printed nothing for this long (0 = off)
+	HeartbeatInterval time.Duration
+
+	// Keep the state of a failed step for a shell, holding the pod for DebugHold
+	DebugOnFailure bool
+	DebugHold      time.Duration
+
+	// Reuse a running buildkitd and leave a started one running (BuildKit only)
+	ReuseDaemon bool
+
+	// Builder selected with --builder: buildkit, buildah, buildpacks or "" to detect it
+	Builder string
+
+	// Run image of buildpacks builds (--run-image); "" = that of the builder image
+	RunImage string
+
+	// External buildkitd (--buildkit-addr or BUILDKIT_HOST) used instead of
+	// starting one, and the mTLS files for a tcp:// address
+	BuildkitAddr          string
+	BuildkitTLSCACert     string
+	BuildkitTLSCert       string
+	BuildkitTLSKey        string
+	BuildkitTLSServerName string
+
+	// External buildkitd per platform (--builder-endpoint); the platforms of a
+	// multi-platform build are built on their own builder and merged into one index
+	BuilderEndpoints map[string]string
+
+	// Push the image by digest without tagging it, for platform images that
+	// are merged into an index afterwards
+	pushByDigest bool
+
+	// Podman service URL used to build with Buildah remotely (--buildah-remote)
+	BuildahRemote string
+
+	// Local runtime to import the image into after the build (--load): auto, containerd or docker
+	Load string
+}
+
+// Base image pull policies for --pull
+const (
+	PullAlways  = "always"
+	PullMissing = "missing"
+	PullNever   = "never"
+)
+
+// buildkitResolveModes maps a pull policy to the Dockerfile frontend's image-resolve-mode
+var buildkitResolveModes = map[string]string{
+	PullAlways:  "pull",
+	PullMissing: "default",
+	PullNever:   "local",
 }
 
 // AttestationConfig represents a single --attest flag
@@ -82,6 +245,35 @@ type AttestationConfig struct {
 	Params map[string]string // Key-value pairs from the flag
 }
 
+// Builders are the values of --builder; auto prefers BuildKit and never
+// selects buildpacks, which build without a Dockerfile
+var Builders = []string{"auto", "buildkit", "buildah", "buildpacks"}
+
+// DetectChosenBuilder returns the builder selected with --builder if it is
+// installed, or "unknown"; "" and "auto" detect it like DetectBuilder
+func DetectChosenBuilder(choice string) string {
+	switch choice {
+	case "buildkit":
+		if _, err := exec.LookPath("buildkitd"); err == nil {
+			if _, err := exec.LookPath("buildctl"); err == nil {
+				return "buildkit"
+			}
+		}
+		return "unknown"
+	case "buildah":
+		if _, err := exec.LookPath("buildah"); err == nil {
+			return "buildah"
+		}
+		return "unknown"
+	case "buildpacks":
+		if LifecycleCreator() != "" {
+			return "buildpacks"
+		}
+		return "unknown"
+	}
+	return DetectBuilder()
+}
+
 // DetectBuilder determines which builder is available
 func DetectBuilder() string {
 	// Check for BuildKit first (preferred/default)
@@ -99,9 +291,10 @@ func DetectBuilder() string {
 	return "unknown"
 }
 
-// Execute executes a build using the detected builder (buildah or buildkit)
+// Execute executes a build using the detected builder (buildah or buildkit),
+// or buildpacks when selected
 func Execute(config Config, ctx *Context) error {
-	builder := DetectBuilder()
+	builder := DetectBuilderFor(config.Builder, RoutedBuildkitAddr(config.BuildkitAddr, config.BuilderEndpoints), config.BuildahRemote)
 
 	if builder == "unknown" {
 		return fmt.Errorf("no builder found (expected buildkitd or buildah)")
@@ -109,11 +302,18 @@ func Execute(config Config, ctx *Context) error {
 
 	logger.Info("Using builder: %s", strings.ToUpper(builder))
 
-	if builder == "buildkit" {
-		return executeBuildKit(config, ctx)
+	execute := executeBuildah
+	if builder == "buildkit" && len(config.BuilderEndpoints) > 0 {
+		execute = executeRoutedBuildKit
+	} else if builder == "buildkit" {
+		execute = executeBuildKit
+	} else if builder == "buildpacks" {
+		execute = executeBuildpacks
 	}
-
-	return executeBuildah(config, ctx)
+	if config.Load != "" {
+		return executeAndLoad(config, ctx, execute)
+	}
+	return execute(config, ctx)
 }
 
 // executeBuildah executes a buildah build with authentication
@@ -128,9 +328,30 @@ func executeBuildah(config Config, ctx *Context) error {
 		logger.Debug("Running as non-root (UID %d) - using chroot isolation with user namespaces", os.Getuid())
 	}
 
-	// Warn if --buildkit-opt was passed — these are ignored by Buildah
-	if len(config.BuildKitOpts) > 0 {
-		logger.Warning("--buildkit-opt flags are ignored when using Buildah backend: %v", config.BuildKitOpts)
+	// Buildah has no local cache exporter; layers persist in its storage instead
+	if config.CacheExportDir != "" || config.CacheImportDir != "" {
+		logger.Warning("--cache-export-dir/--cache-import-dir are ignored when using Buildah backend; use --cache with persistent storage instead")
+	}
+	if config.CacheInline {
+		logger.Warning("--cache-inline is ignored when using Buildah backend; Buildah cannot embed cache metadata in images")
+	}
+
+	// Without --layers Buildah commits everything a build adds as a single layer,
+	// so there are no intermediate layers to cache
+	if config.SquashNew && config.Cache {
+		logger.Warning("--cache has no effect with --squash-new: Buildah keeps no intermediate layers to cache")
+		config.Cache = false
+	}
+	if config.ReuseDaemon {
+		logger.Warning("--reuse-daemon has no effect with Buildah, which builds without a daemon")
+	}
+	if len(config.BuildkitdConfigFragments) > 0 {
+		logger.Warning("--buildkitd-config-fragment is ignored when using Buildah backend")
+	}
+
+	transport := newBuildahTransport(config.BuildahRemote, config.StorageRoot)
+	if transport.remote() {
+		logger.Info("Using remote Buildah through the Podman service at %s", config.BuildahRemote)
 	}
 
 	logger.Info("Starting buildah build...")
@@ -156,6 +377,20 @@ func executeBuildah(config Config, ctx *Context) error {
 		}
 	}
 
+	if err := configureBuildahRegistries(config, transport); err != nil {
+		return err
+	}
+
+	// Copy the base images into Buildah's storage; the build then pulls nothing
+	if config.ImageStore != nil {
+		if transport.remote() {
+			return fmt.Errorf("--offline is not supported with --buildah-remote")
+		}
+		if err := buildahLoadOfflineImages(config, transport); err != nil {
+			return err
+		}
+	}
+
 	// Construct buildah command
 	args := []string{"bud"}
 
@@ -170,6 +405,27 @@ func executeBuildah(config Config, ctx *Context) error {
 		dockerfilePath = filepath.Join(ctx.Path, dockerfilePath)
 	}
 
+	// Rewrite FROM images and split oversized COPY layers without touching the user's Dockerfile
+	originalDockerfile := dockerfilePath
+	var splits map[int]int
+	if len(config.BaseImageRewrites) > 0 || config.MaxLayerSize > 0 {
+		prepared, err := prepareRewrittenDockerfile(config, dockerfilePath, ctx.Path)
+		if err != nil {
+			return err
+		}
+		if prepared != nil {
+			defer removeTemp(prepared.Dir)
+			dockerfilePath = filepath.Join(prepared.Dir, "Dockerfile")
+			splits = prepared.Splits
+			if len(prepared.Rewrites) > 0 {
+				config.Labels = withLabel(config.Labels, BaseImageRewriteLabel, rewriteLabelValue(prepared.Rewrites))
+			}
+			if config.DryRun && (len(prepared.Rewrites) > 0 || len(splits) > 0) {
+				printDryRunDockerfile(dockerfilePath)
+			}
+		}
+	}
+
 	args = append(args, "-f", dockerfilePath)
 
 	// ========================================
@@ -183,14 +439,10 @@ func executeBuildah(config Config, ctx *Context) error {
 	}
 	sort.Strings(buildArgKeys)
 
+	// Args given without a value were already read from Kimia's environment,
+	// so an empty value is passed as such
 	for _, key := range buildArgKeys {
-		value := config.BuildArgs[key]
-		if value != "" {
-			args = append(args, "--build-arg", fmt.Sprintf("%s=%s", key, value))
-		} else {
-			// Use environment variable
-			args = append(args, "--build-arg", key)
-		}
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", key, config.BuildArgs[key]))
 	}
 
 	// ========================================
@@ -212,8 +464,25 @@ func executeBuildah(config Config, ctx *Context) error {
 		args = append(args, "--target", config.Target)
 	}
 
+	// Alternate ignore file (Buildah reads .containerignore/.dockerignore otherwise)
+	if config.IgnoreFile != "" {
+		args = append(args, "--ignorefile", config.IgnoreFile)
+	}
+
+	// Base image pull policy
+	if config.ImageStore != nil {
+		args = append(args, "--pull=never")
+		logger.Info("Offline build: base images come from %s", config.ImageStore.Spec)
+	} else if config.PullPolicy != "" {
+		args = append(args, "--pull="+config.PullPolicy)
+		logger.Info("Base image pull policy: %s", config.PullPolicy)
+	}
+
 	// Add platform if specified
 	if config.CustomPlatform != "" {
+		if strings.Contains(config.CustomPlatform, ",") {
+			return fmt.Errorf("building several platforms (%s) requires the BuildKit backend", config.CustomPlatform)
+		}
 		args = append(args, "--platform", config.CustomPlatform)
 	}
 
@@ -230,6 +499,26 @@ func executeBuildah(config Config, ctx *Context) error {
 		args = append(args, "--no-cache")
 	}
 
+	// Flatten layers: --squash merges base and new layers into one, while
+	// without intermediate layers Buildah keeps the base layers plus one new layer
+	if config.Squash {
+		args = append(args, "--squash")
+	} else if config.SquashNew {
+		args = append(args, "--layers=false")
+	}
+
+	// Keep the working container of a failed step for --debug-on-failure
+	if config.DebugOnFailure {
+		args = append(args, "--force-rm=false")
+	}
+
+	// Share cached layers through a registry (same flag as BuildKit)
+	cacheRepoArgs, err := buildahCacheRepoArgs(config)
+	if err != nil {
+		return err
+	}
+	args = append(args, cacheRepoArgs...)
+
 	// Add retry option for image downloads
 	if config.ImageDownloadRetry > 0 {
 		args = append(args, "--retry", fmt.Sprintf("%d", config.ImageDownloadRetry))
@@ -259,6 +548,33 @@ func executeBuildah(config Config, ctx *Context) error {
 		args = append(args, "--tls-verify=false")
 	}
 
+	// Network namespace, extra /etc/hosts entries and DNS settings of RUN steps
+	args = append(args, buildahNetworkArgs(config)...)
+
+	// Devices and capabilities of privileged RUN steps
+	for _, device := range config.Devices {
+		args = append(args, "--device", device)
+	}
+	for _, capability := range config.CapAdd {
+		args = append(args, "--cap-add", capability)
+	}
+
+	// Secrets of RUN --mount=type=secret steps
+	args = append(args, secretArgs(config.Secrets)...)
+
+	// The primary image of a chained build
+	if config.ChainFrom != nil {
+		args = append(args, buildahChainArgs(config.ChainFrom)...)
+	}
+
+	// Explicit user namespace mappings (root or remote Buildah only)
+	for _, mapping := range config.UsernsUIDMap {
+		args = append(args, "--userns-uid-map", mapping)
+	}
+	for _, mapping := range config.UsernsGIDMap {
+		args = append(args, "--userns-gid-map", mapping)
+	}
+
 	// ========================================
 	// REPRODUCIBLE BUILDS: Sort destinations
 	// ========================================
@@ -270,6 +586,19 @@ func executeBuildah(config Config, ctx *Context) error {
 		args = append(args, "-t", dest)
 	}
 
+	// Without a push the digest files record the local image ID
+	iidFile := ""
+	if config.NoPush && len(config.Destination) > 0 && wantsDigests(config) {
+		file, err := newTempFile("", "kimia-iid-*")
+		if err != nil {
+			return fmt.Errorf("failed to create image ID file: %v", err)
+		}
+		file.Close()
+		iidFile = file.Name()
+		defer removeTemp(iidFile)
+		args = append(args, "--iidfile", iidFile)
+	}
+
 	// ========================================
 	// Pass-through args — must be added before ctx.Path
 	// ========================================
@@ -285,11 +614,23 @@ func executeBuildah(config Config, ctx *Context) error {
 		}
 	}
 
-	// Add context path
-	args = append(args, ctx.Path)
+	// Add context path, or its normalized copy
+	contextDir := ctx.Path
+	if config.NormalizeContext != nil && config.DryRun {
+		logger.Info("Dry run: context %s would be normalized into a temporary copy", ctx.Path)
+	} else if config.NormalizeContext != nil {
+		normalized, err := normalizedContextCopy(config, ctx.Path, originalDockerfile)
+		if err != nil {
+			return err
+		}
+		defer removeTemp(normalized)
+		contextDir = normalized
+	}
+	args = append(args, contextDir)
 
 	// Log the command
-	logger.Debug("Buildah command: buildah %s", strings.Join(sanitizeCommandArgs(args), " "))
+	program, programArgs := transport.commandLine(args)
+	logger.Debug("Buildah command: %s %s", program, strings.Join(sanitizeCommandArgs(programArgs), " "))
 
 	// Execute buildah
 	// #nosec G204 -- all args validated by validateBuildahInputs:
@@ -299,10 +640,19 @@ func executeBuildah(config Config, ctx *Context) error {
 	//     would reject; conflict-checked against Kimia-managed flags
 	//   - All other args (dockerfile, build-arg, label, dest) are Kimia-constructed
 	//     from validated inputs
-	cmd := exec.Command("buildah", args...)
+	buildCtx, cancelBuild := phaseContext(config.BuildTimeout)
+	defer cancelBuild()
+	cmd := buildahCommandContext(buildCtx, transport, args...)
 	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = io.MultiWriter(os.Stdout, &stdoutBuf)
-	cmd.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+	steps := newBuildahStepRecorder()
+	beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "build", "")
+	defer beat.stop()
+	// Secret values are redacted from what the build prints
+	stdout, stderr := logger.NewRedactWriter(os.Stdout), logger.NewRedactWriter(os.Stderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	cmd.Stdout = io.MultiWriter(stdout, &stdoutBuf, steps, beat)
+	cmd.Stderr = io.MultiWriter(stderr, &stderrBuf, beat)
 	cmd.Env = os.Environ()
 
 	// Always use chroot isolation for both root and rootless
@@ -334,16 +684,86 @@ func executeBuildah(config Config, ctx *Context) error {
 		}
 	}
 
+	if config.DryRun {
+		printDryRunCommand("buildah build command", kimiaEnv(cmd.Env, os.Environ()), program, programArgs)
+		if len(config.TestCmd) > 0 {
+			logger.Info("Dry run: would run --test-cmd in the built image: %s", TestCommandString(config.TestCmd))
+		}
+		return nil
+	}
+
 	// Log the command being executed
-	logger.Info("Executing: buildah %s", strings.Join(sanitizeCommandArgs(args), " "))
+	logger.Info("Executing: %s %s", program, strings.Join(sanitizeCommandArgs(programArgs), " "))
 
 	// #nosec G204 -- all args validated by validateBuildahInputs function
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("buildah build failed: %v", err)
+	oom := startOOMWatch()
+	started := time.Now()
+	err = cmd.Run()
+	reportBuildTiming(config, newBuildTiming("buildah", time.Since(started), err == nil, steps.finish(err == nil)))
+
+	// Retry builds that failed on a flaky network. Buildah cannot skip the cache
+	// of a single stage; the failed step was not committed, so it runs again.
+	for attempt := 1; err != nil && buildCtx.Err() == nil && attempt <= config.RetryTransient; attempt++ {
+		signature := transientFailure(stderrBuf.String() + stdoutBuf.String())
+		if signature == "" {
+			logger.Debug("Build failure does not look transient, not retrying")
+			break
+		}
+		logger.Warning("%s", transientRetryMessage(signature, attempt, config.RetryTransient))
+		time.Sleep(transientRetryDelay(attempt))
+
+		stdoutBuf.Reset()
+		stderrBuf.Reset()
+		steps = newBuildahStepRecorder()
+		// #nosec G204 -- same args validated by validateBuildahInputs
+		retry := buildahCommandContext(buildCtx, transport, args...)
+		retry.Stdout = io.MultiWriter(stdout, &stdoutBuf, steps, beat)
+		retry.Stderr, retry.Env = cmd.Stderr, cmd.Env
+		started = time.Now()
+		err = retry.Run()
+		reportBuildTiming(config, newBuildTiming("buildah", time.Since(started), err == nil, steps.finish(err == nil)))
+	}
+	if err != nil && buildCtx.Err() == nil {
+		failed := failedStep(steps.finish(false))
+		if config.DebugOnFailure {
+			debugBuildahFailure(config, transport, cmd.Env, failed)
+		}
+		if oomErr := oom.check(err, stderrBuf.String()+stdoutBuf.String(), failed); oomErr != nil {
+			return fmt.Errorf("buildah build failed: %v", oomErr)
+		}
+	}
+	if err := timeoutError(buildCtx, err, "buildah build", "--build-timeout", config.BuildTimeout); err != nil {
+		return fmt.Errorf("buildah build failed: %w", err)
 	}
 
 	logger.Info("Build completed successfully")
 
+	// The image ID Buildah printed last, else the image's first destination
+	image := ""
+	if lines := strings.Split(strings.TrimSpace(stdoutBuf.String()), "\n"); len(lines) > 0 {
+		image = strings.TrimSpace(lines[len(lines)-1])
+	}
+	if !imageIDRegex.MatchString(image) && len(config.Destination) > 0 {
+		image = config.Destination[0]
+	}
+
+	// Check the committed layer sizes before anything is exported or pushed
+	if hasSizeBudget(config) && transport.remote() {
+		logger.Warning("--max-layer-size and --max-image-size cannot inspect committed layers in a remote Buildah service; only COPY layers were checked")
+	} else if hasSizeBudget(config) {
+		if err := checkImageLayerSizes(image, cmd.Env, config, originalDockerfile, splits); err != nil {
+			return err
+		}
+	}
+
+	// Smoke-test the image; a failure leaves nothing exported or pushed
+	if len(config.TestCmd) > 0 {
+		err := runBuildahTest(buildCtx, transport, cmd.Env, image, config.TestCmd)
+		if err := timeoutError(buildCtx, err, "--test-cmd", "--build-timeout", config.BuildTimeout); err != nil {
+			return err
+		}
+	}
+
 	// Handle TAR export if requested
 	if config.TarPath != "" {
 		if err := exportToTar(config); err != nil {
@@ -354,24 +774,24 @@ func executeBuildah(config Config, ctx *Context) error {
 	if config.NoPush {
 		logger.Info("No push requested, skipping image push to registries")
 		
-		// If digest files are requested, we need to extract the local Image ID
-		// since we aren't pushing to a registry to get a manifest digest.
-		if config.DigestFile != "" || config.ImageNameWithDigestFile != "" || config.ImageNameTagWithDigestFile != "" {
-			if len(config.Destination) > 0 {
-				stdoutStr := stdoutBuf.String()
-				lines := strings.Split(strings.TrimSpace(stdoutStr), "\n")
-				if len(lines) > 0 {
-					// Buildah bud outputs the image ID on the last line
-					imageID := lines[len(lines)-1]
-					if imageID != "" {
-						digestMap := make(map[string]string)
-						for _, dest := range config.Destination {
-							digestMap[dest] = imageID
-						}
-						if err := SaveDigestInfo(config, digestMap); err != nil {
-							logger.Warning("Failed to save digest information: %v", err)
-						}
-					}
+		// If digest files are requested, record the local image ID buildah
+		// wrote, since we aren't pushing to a registry to get a manifest digest.
+		if iidFile != "" {
+			// #nosec G304 -- temporary file created above
+			data, err := os.ReadFile(iidFile)
+			if err != nil {
+				logger.Warning("Failed to read image ID: %v", err)
+			} else {
+				imageID := strings.TrimSpace(string(data))
+				if !strings.HasPrefix(imageID, "sha256:") {
+					imageID = "sha256:" + imageID
+				}
+				digestMap := make(map[string]string)
+				for _, dest := range config.Destination {
+					digestMap[dest] = imageID
+				}
+				if err := SaveDigestInfo(config, digestMap); err != nil {
+					logger.Warning("Failed to save digest information: %v", err)
 				}
 			}
 		}
@@ -380,6 +800,51 @@ func executeBuildah(config Config, ctx *Context) error {
 	return nil
 }
 
+// startBuildkitd starts the rootlesskit-wrapped buildkitd and waits for its socket.
+// The caller is responsible for stopping the process.
+func startBuildkitd(daemonCmd *exec.Cmd, cleanSocket string) error {
+	if err := daemonCmd.Start(); err != nil {
+		return fmt.Errorf("failed to start buildkitd: %v", err)
+	}
+
+	logger.Debug("buildkitd process started (PID: %d)", daemonCmd.Process.Pid)
+
+	// ========================================
+	// WAIT FOR BUILDKITD TO BE READY
+	// ========================================
+	logger.Debug("Waiting for buildkitd to be ready...")
+	ready := false
+	for i := 0; i < 30; i++ {
+		// #nosec G204,G702 -- socket validated and cleaned by the caller before starting the daemon
+		checkCmd := exec.Command("buildctl", "--addr=unix://"+cleanSocket, "debug", "info")
+		output, err := checkCmd.CombinedOutput()
+
+		if err == nil {
+			ready = true
+			break
+		}
+
+		logger.Debug("Waiting for buildkitd... (%d/30) - error: %v", i+1, err)
+		if len(output) > 0 {
+			logger.Debug("  Output: %s", string(output))
+		}
+
+		// Check if daemon is still running
+		if daemonCmd.Process == nil {
+			return fmt.Errorf("buildkitd process died")
+		}
+
+		time.Sleep(1 * time.Second)
+	}
+
+	if !ready {
+		return fmt.Errorf("buildkitd failed to become ready after 30 seconds")
+	}
+
+	logger.Debug("buildkitd is ready")
+	return nil
+}
+
 // validateCommonBuildInputs validates inputs common to both buildah and buildkit
 func validateCommonBuildInputs(config Config, ctx *Context) error {
 	// Validate build args
@@ -457,11 +922,52 @@ func validateCommonBuildInputs(config Config, ctx *Context) error {
 		return fmt.Errorf("dockerfile path contains null byte")
 	}
 
+	// Validate base image rewrite rules
+	if _, err := ParseBaseImageRewrites(config.BaseImageRewrites); err != nil {
+		return err
+	}
+
+	if config.CacheRepo != "" {
+		if err := validateCacheRepo(config.CacheRepo); err != nil {
+			return err
+		}
+		if !config.Cache {
+			logger.Warning("--cache-repo has no effect without --cache")
+		}
+	}
+
+	if config.MaxLayerSize < 0 {
+		return fmt.Errorf("--max-layer-size must be positive")
+	}
+	if config.MaxImageSize < 0 {
+		return fmt.Errorf("--max-image-size must be positive")
+	}
+	if err := ValidateCompressionLevel(config.Compression, config.CompressionLevel); err != nil {
+		return err
+	}
+	if config.SplitLargeLayers && config.MaxLayerSize == 0 {
+		return fmt.Errorf("--split-large-layers requires --max-layer-size")
+	}
+	if config.PullPolicy != "" {
+		if _, ok := buildkitResolveModes[config.PullPolicy]; !ok {
+			return fmt.Errorf("invalid --pull value %q (valid: always, missing, never)", config.PullPolicy)
+		}
+	}
+	if config.Squash && config.SquashNew {
+		return fmt.Errorf("--squash and --squash-new are mutually exclusive")
+	}
+	if config.RetryTransient < 0 || config.RetryTransient > 10 {
+		return fmt.Errorf("--retry-transient must be between 0 and 10, got %d", config.RetryTransient)
+	}
+
 	// Warning for no-push and digest options
-	if config.NoPush && (config.DigestFile != "" || config.ImageNameWithDigestFile != "" || config.ImageNameTagWithDigestFile != "") {
+	if config.NoPush && wantsDigests(config) {
 		logger.Warning("--no-push is set along with digest file options.")
 		logger.Warning("A digest file might not contain a registry manifest digest, but rather a local image ID.")
 	}
+	if config.NoPush && config.VerifyPush {
+		logger.Warning("--verify-push has no effect with --no-push")
+	}
 
 	return nil
 }
@@ -473,6 +979,10 @@ func validateBuildKitInputs(config Config, ctx *Context, buildContext string, ho
 		return err
 	}
 
+	if err := validateBuildKitAddr(config); err != nil {
+		return err
+	}
+
 	// Validate Git context URL if applicable (BuildKit-specific)
 	if ctx.IsGitRepo && strings.HasPrefix(buildContext, "http") {
 		// Git URLs are validated during FormatGitURLForBuildKit
@@ -504,6 +1014,10 @@ func validateBuildahInputs(config Config, ctx *Context) error {
 		return err
 	}
 
+	if err := validateBuildahRemote(config.BuildahRemote); err != nil {
+		return err
+	}
+
 	// Validate tar path if specified
 	if config.TarPath != "" {
 		// Get HOME directory for validation
@@ -536,12 +1050,26 @@ func validateBuildahInputs(config Config, ctx *Context) error {
 		"--tag":               "use -d/--destination instead",
 		"--no-cache":          "use --cache=false instead",
 		"--layers":            "use --cache instead",
+		"--cache-to":          "use --cache-repo instead",
+		"--cache-from":        "use --cache-repo instead",
+		"--squash":            "use --squash or --squash-new instead",
+		"--squash-all":        "use --squash instead",
+		"--pull":              "use --pull instead",
+		"--pull-always":       "use --pull=always instead",
+		"--pull-never":        "use --pull=never instead",
+		"--ignorefile":        "use --ignore-file instead",
+		"--add-host":          "use --add-host instead",
+		"--network":           "use --network instead",
+		"--net":               "use --network instead",
+		"--dns":               "use --dns instead",
+		"--dns-search":        "use --dns-search instead",
 		// Security-sensitive flags managed implicitly by Kimia via BUILDAH_ISOLATION=chroot
 		"--isolation":         "isolation is managed by Kimia (chroot)",
 		"--userns":            "user namespace configuration is managed by Kimia",
-		"--userns-uid-map":    "user namespace configuration is managed by Kimia",
-		"--userns-gid-map":    "user namespace configuration is managed by Kimia",
-		"--cap-add":           "capability management is outside Kimia's scope",
+		"--userns-uid-map":    "use --userns-uid-map instead",
+		"--userns-gid-map":    "use --userns-gid-map instead",
+		"--cap-add":           "use --cap-add with --allow-privileged-steps instead",
+		"--device":            "use --device with --allow-privileged-steps instead",
 		"--cap-drop":          "capability management is outside Kimia's scope",
 		"--security-opt":      "security options are managed by Kimia",
 		"--privileged":        "privileged mode is not supported by Kimia",
@@ -596,6 +1124,16 @@ func validateBuildahInputs(config Config, ctx *Context) error {
 }
 
 func executeBuildKit(config Config, ctx *Context) error {
+	digestMap, descriptor, err := runBuildKit(config, ctx)
+	if err != nil || config.DryRun {
+		return err
+	}
+	return publishPushedImages(config, digestMap, descriptor)
+}
+
+// runBuildKit builds the image with buildctl, which also pushes it, and returns
+// the digest of each destination and the descriptor BuildKit recorded
+func runBuildKit(config Config, ctx *Context) (map[string]string, auth.Descriptor, error) {
 	logger.Info("Starting BuildKit build...")
 
 	// Warn if --buildah-opt was passed — these are ignored by BuildKit
@@ -603,6 +1141,11 @@ func executeBuildKit(config Config, ctx *Context) error {
 		logger.Warning("--buildah-opt flags are ignored when using BuildKit backend: %v", config.BuildahOpts)
 	}
 
+	// BuildKit's image exporter has no option to merge layers
+	if config.Squash || config.SquashNew {
+		return nil, auth.Descriptor{}, fmt.Errorf("--squash and --squash-new require the Buildah backend; BuildKit cannot flatten image layers")
+	}
+
 	// ========================================
 	// SETUP: Environment and paths
 	// ========================================
@@ -621,12 +1164,12 @@ func executeBuildKit(config Config, ctx *Context) error {
 
 	// Check for null bytes
 	if strings.Contains(homeDir, "\x00") {
-		return fmt.Errorf("HOME directory contains null bytes - invalid path")
+		return nil, auth.Descriptor{}, fmt.Errorf("HOME directory contains null bytes - invalid path")
 	}
 
 	// Ensure HOME is an absolute path
 	if !filepath.IsAbs(homeDir) {
-		return fmt.Errorf("HOME directory must be an absolute path, got: %s", homeDir)
+		return nil, auth.Descriptor{}, fmt.Errorf("HOME directory must be an absolute path, got: %s", homeDir)
 	}
 
 	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
@@ -639,11 +1182,12 @@ func executeBuildKit(config Config, ctx *Context) error {
 
 	// Check for null bytes in XDG_RUNTIME_DIR
 	if strings.Contains(xdgRuntimeDir, "\x00") {
-		return fmt.Errorf("XDG_RUNTIME_DIR contains null bytes - invalid path")
+		return nil, auth.Descriptor{}, fmt.Errorf("XDG_RUNTIME_DIR contains null bytes - invalid path")
 	}
 
 	buildkitSocket := filepath.Join(xdgRuntimeDir, "buildkitd.sock")
 	buildkitConfig := filepath.Join(homeDir, ".config/buildkit/buildkitd.toml")
+	buildkitConfigBase := homeDir
 
 	logger.Debug("BuildKit configuration:")
 	logger.Debug("  HOME: %s", homeDir)
@@ -656,18 +1200,20 @@ func executeBuildKit(config Config, ctx *Context) error {
 	// ========================================
 	var buildContext string
 	var isGitContext bool
-	var tempContext string
 	workspaceMount := filepath.Join(homeDir, "workspace")
 
 	// Check if this is a Git context (BuildKit native Git support)
 	if ctx.IsGitRepo && ctx.GitURL != "" {
 		logger.Info("Using BuildKit native Git context (no local clone)")
 		isGitContext = true
+		if config.NormalizeContext != nil {
+			logger.Warning("--normalize-context has no effect on Git contexts BuildKit clones itself")
+		}
 		
 		// Format Git URL with authentication, branch/revision, and subcontext
 		formattedURL, err := FormatGitURLForBuildKit(ctx.GitURL, ctx.GitConfig, ctx.SubContext)
 		if err != nil {
-			return fmt.Errorf("failed to format Git URL for BuildKit: %v", err)
+			return nil, auth.Descriptor{}, fmt.Errorf("failed to format Git URL for BuildKit: %v", err)
 		}
 		buildContext = formattedURL
 	} else {
@@ -675,38 +1221,50 @@ func executeBuildKit(config Config, ctx *Context) error {
 		buildContext = ctx.Path
 		
 		// Only copy if it's a bind mount, not a git clone
+		// Normalized contexts are synced too, wherever they are
 		isBindMount := (ctx.Path == workspaceMount || ctx.Path == "/workspace") && !ctx.IsGitRepo
-		if isBindMount {
-			logger.Debug("Detected bind-mounted context at %s, copying to buildkit cache...", ctx.Path)
-
-			// Create cache directory
+		if (isBindMount || config.NormalizeContext != nil) && config.DryRun {
+			logger.Info("Dry run: context %s would be synced to %s", ctx.Path, stableContextDir(filepath.Join(homeDir, ".cache/buildkit"), ctx.Path))
+		} else if isBindMount || config.NormalizeContext != nil {
+			logger.Debug("Syncing context at %s to buildkit cache...", ctx.Path)
+
+			// Sync into a stable per-context directory rather than a fresh copy, so
+			// unchanged files keep their metadata and BuildKit only transfers changes
+			// Files excluded by the ignore file are not synced, since BuildKit would skip them
 			cacheDir := filepath.Join(homeDir, ".cache/buildkit")
-			// #nosec G301,G703 -- 0755 for cache directory (non-sensitive); homeDir sanitized at function start
-			if err := os.MkdirAll(cacheDir, 0755); err != nil {
-				return fmt.Errorf("failed to create cache directory: %v", err)
+			fullDockerfilePath := config.Dockerfile
+			if fullDockerfilePath == "" {
+				fullDockerfilePath = "Dockerfile"
 			}
-
-			// Create temp directory for context copy
-			tempDir, err := os.MkdirTemp(cacheDir, "context-*")
-			if err != nil {
-				return fmt.Errorf("failed to create temp context directory: %v", err)
+			if !filepath.IsAbs(fullDockerfilePath) {
+				fullDockerfilePath = filepath.Join(ctx.Path, fullDockerfilePath)
+			}
+			filter := newContextSyncFilter(ctx.Path, fullDockerfilePath, config.IgnoreFile)
+			syncDir := stableContextDir(cacheDir, ctx.Path)
+			if config.NormalizeContext != nil {
+				dir, err := normalizedContextDir(cacheDir, ctx.Path, filter, config.NormalizeContext)
+				if err != nil {
+					return nil, auth.Descriptor{}, err
+				}
+				syncDir = dir
 			}
-			tempContext = tempDir
-
-			defer func() {
-				logger.Debug("Cleaning up temp context directory: %s", tempContext)
-				// #nosec G104 -- Ignoring cleanup error in defer (best-effort)
-				os.RemoveAll(tempContext)
-			}()
-
-			// Copy context to temp directory
-			logger.Debug("Copying context from %s to %s", ctx.Path, tempContext)
-			if err := copyDir(ctx.Path, tempContext); err != nil {
-				return fmt.Errorf("failed to copy context: %v", err)
+			stats, err := syncContextDir(ctx.Path, syncDir, filter, config.NormalizeContext, false)
+			if err != nil {
+				return nil, auth.Descriptor{}, fmt.Errorf("failed to copy context: %v", err)
 			}
-
-			buildContext = tempContext
-			logger.Debug("Using copied context at: %s", buildContext)
+			logger.Info("Context sync: %d of %d files changed (%s), %d unchanged, %d removed, %d paths ignored",
+				stats.Copied, stats.Files, formatBytes(stats.CopiedBytes), stats.Unchanged, stats.Removed, stats.Ignored)
+			logNormalizedContext(config.NormalizeContext)
+			logger.Debug("Context sync methods: %d reflinked, %d hardlinked, %d copied",
+				stats.Methods[copiedReflink], stats.Methods[copiedHardlink], stats.Methods[copiedStream])
+
+			// Mark the synced context as used; unused ones are pruned after a week
+			now := time.Now()
+			// #nosec G104 -- only affects pruning of the context cache
+			os.Chtimes(syncDir, now, now)
+
+			buildContext = syncDir
+			logger.Debug("Using synced context at: %s", buildContext)
 		} else {
 			logger.Debug("Using original context at: %s", buildContext)
 		}
@@ -717,14 +1275,42 @@ func executeBuildKit(config Config, ctx *Context) error {
 	// ========================================
 	logger.Debug("Validating buildctl inputs...")
 	if err := validateBuildKitInputs(config, ctx, buildContext, homeDir); err != nil {
-		return fmt.Errorf("input validation failed: %v", err)
+		return nil, auth.Descriptor{}, fmt.Errorf("input validation failed: %v", err)
 	}
 	logger.Debug("All buildctl inputs validated successfully")
 
 	// ========================================
-	// INSECURE REGISTRY CONFIGURATION
+	// INSECURE REGISTRY AND CA CONFIGURATION
 	// ========================================
-	if config.Insecure || len(config.InsecureRegistry) > 0 {
+	var resolvedBuildkitConfig string
+	external := config.BuildkitAddr != ""
+	if external && (config.Insecure || len(config.InsecureRegistry) > 0) {
+		logger.Warning("Insecure registries must be configured in the external buildkitd's buildkitd.toml; --insecure-registry only affects Kimia's own registry access")
+	}
+	if external && config.CABundle != "" {
+		logger.Warning("The external buildkitd does not see --ca-bundle; add the CA to its trust store or buildkitd.toml (registry ca = [...])")
+	}
+	if external && len(config.RegistryTLS) > 0 {
+		logger.Warning("The external buildkitd does not see --registry-config; configure its buildkitd.toml registry sections instead")
+	}
+	if external && len(config.BuildkitdConfigFragments) > 0 {
+		logger.Warning("--buildkitd-config-fragment is ignored with an external buildkitd, which reads its own buildkitd.toml")
+	}
+	if external && config.Network == "slirp4netns" {
+		logger.Warning("--network=slirp4netns has no effect with an external buildkitd; RUN steps use the network of its worker")
+	} else if config.Network == "slirp4netns" && !config.DryRun {
+		if _, err := exec.LookPath("slirp4netns"); err != nil {
+			return nil, auth.Descriptor{}, fmt.Errorf("--network=slirp4netns needs the slirp4netns binary, which is not in PATH")
+		}
+	}
+	customDNS := len(config.DNS) > 0 || len(config.DNSSearch) > 0
+	if external && customDNS {
+		logger.Warning("--dns and --dns-search are ignored with an external buildkitd; set [dns] in its buildkitd.toml")
+	}
+	if external && len(config.Allow) > 0 {
+		logger.Warning("The external buildkitd must allow the %v entitlements (insecure-entitlements in its buildkitd.toml)", config.Allow)
+	}
+	if !external && (config.Insecure || len(config.InsecureRegistry) > 0 || config.CABundle != "" || len(config.RegistryTLS) > 0 || len(config.BuildkitdConfigFragments) > 0 || customDNS || len(config.Allow) > 0) {
 		// Read existing config (should always exist from Dockerfile)
 		var existingConfig string
 		// #nosec G703 -- buildkitConfig constructed from sanitized homeDir (cleaned, validated for null bytes and absolute path)
@@ -740,13 +1326,6 @@ func executeBuildKit(config Config, ctx *Context) error {
   noProcessSandbox = true
 `
 			logger.Debug("Config file not found, using default (matches Dockerfile)")
-			
-			// Create config directory if it doesn't exist
-			configDir := filepath.Dir(buildkitConfig)
-			// #nosec G301,G703 -- 0755 for config directory (contains TOML, not credentials); configDir from sanitized homeDir
-			if err := os.MkdirAll(configDir, 0755); err != nil {
-				return fmt.Errorf("failed to create buildkit config directory: %v", err)
-			}
 		}
 
 		// Collect all registries that need insecure config
@@ -767,32 +1346,122 @@ func executeBuildKit(config Config, ctx *Context) error {
 			registries[registry] = true
 		}
 
-		// Append insecure config for each registry
+		// Destination registries trust --ca-bundle explicitly; base image
+		// registries through the SSL_CERT_FILE buildkitd inherits
+		caRegistries := make(map[string]bool)
+		if config.CABundle != "" {
+			for _, dest := range config.Destination {
+				if idx := strings.Index(dest, "/"); idx > 0 {
+					caRegistries[dest[:idx]] = true
+				}
+			}
+		}
+		// Registries with their own CA or client certificate
+		tlsRegistries := make(map[string]auth.RegistryTLS)
+		for _, registry := range config.RegistryTLS {
+			if registry.CA != "" || registry.ClientCert != "" {
+				tlsRegistries[registry.Host] = registry
+			}
+		}
+		names := make([]string, 0, len(registries)+len(caRegistries)+len(tlsRegistries))
+		for registry := range registries {
+			names = append(names, registry)
+		}
+		for registry := range caRegistries {
+			if !registries[registry] {
+				names = append(names, registry)
+			}
+		}
+		for registry := range tlsRegistries {
+			if !registries[registry] && !caRegistries[registry] {
+				names = append(names, registry)
+			}
+		}
+		sort.Strings(names)
+
+		// Append the config of each registry
 		configContent := existingConfig
 		configModified := false
 
-		for registry := range registries {
-			if !strings.Contains(existingConfig, fmt.Sprintf(`[registry."%s"]`, registry)) {
-				configContent += fmt.Sprintf(`
-[registry."%s"]
-  http = true
-  insecure = true
-`, registry)
-				logger.Info("Adding insecure registry: %s", registry)
-				configModified = true
-			} else {
+		for _, registry := range names {
+			if strings.Contains(existingConfig, fmt.Sprintf(`[registry."%s"]`, registry)) {
 				logger.Debug("Registry already configured: %s", registry)
+				continue
+			}
+			configContent += fmt.Sprintf("\n[registry.\"%s\"]\n", registry)
+			if registries[registry] {
+				configContent += "  http = true\n  insecure = true\n"
+				logger.Info("Adding insecure registry: %s", registry)
+			}
+			if tlsRegistry, ok := tlsRegistries[registry]; ok {
+				extraCA := ""
+				if caRegistries[registry] && !tlsRegistry.Pinned {
+					extraCA = config.CABundle
+				}
+				configContent += buildkitRegistryTLS(tlsRegistry, extraCA)
+				logger.Info("Adding TLS settings of registry: %s", registry)
+			} else if caRegistries[registry] {
+				configContent += fmt.Sprintf("  ca = [\"%s\"]\n", config.CABundle)
+				logger.Info("Trusting --ca-bundle for registry: %s", registry)
+			}
+			configModified = true
+		}
+
+		if customDNS {
+			merged, err := mergeBuildkitdConfig(configContent, buildkitDNSConfig(config))
+			if err != nil {
+				return nil, auth.Descriptor{}, err
+			}
+			logger.Info("Build DNS: servers %v, search domains %v", config.DNS, config.DNSSearch)
+			configModified = configModified || merged != configContent
+			configContent = merged
+		}
+
+		if len(config.Allow) > 0 {
+			merged, err := mergeBuildkitdConfig(configContent, fmt.Sprintf("insecure-entitlements = [%s]\n", quoteTOMLStrings(config.Allow)))
+			if err != nil {
+				return nil, auth.Descriptor{}, err
+			}
+			configModified = configModified || merged != configContent
+			configContent = merged
+		}
+
+		// User fragments last, so they can override the generated settings
+		if len(config.BuildkitdConfigFragments) > 0 {
+			merged, err := mergeBuildkitdFragments(configContent, config.BuildkitdConfigFragments)
+			if err != nil {
+				return nil, auth.Descriptor{}, err
+			}
+			for _, fragment := range config.BuildkitdConfigFragments {
+				logger.Info("Merging buildkitd config fragment: %s", fragment)
+			}
+			configModified = configModified || merged != configContent
+			configContent = merged
+		}
+
+		resolvedBuildkitConfig = configContent
+
+		// The settings of this run go to a config of its own, passed to
+		// buildkitd with --config; the user's buildkitd.toml is left as is
+		if configModified && config.DryRun {
+			logger.Debug("Dry run: not writing the buildkitd config of this run")
+			buildkitConfig, buildkitConfigBase = filepath.Join(os.TempDir(), "buildkitd-<run>.toml"), os.TempDir()
+		} else if configModified {
+			runConfig, err := newTempFile("", "buildkitd-*.toml")
+			if err != nil {
+				return nil, auth.Descriptor{}, fmt.Errorf("failed to create buildkit config: %v", err)
+			}
+			// buildkitd reads its config at startup, which startBuildkitd waits for
+			defer removeTemp(runConfig.Name())
+			_, err = runConfig.WriteString(configContent)
+			if closeErr := runConfig.Close(); err == nil {
+				err = closeErr
 			}
-		}
-
-		// Only write if we modified it
-		if configModified {
-			// BuildKit config may contain registry credentials in the future, use restrictive permissions
-			// #nosec G703 -- buildkitConfig constructed from sanitized homeDir
-			if err := os.WriteFile(buildkitConfig, []byte(configContent), 0600); err != nil {
-				return fmt.Errorf("failed to write buildkit config: %v", err)
+			if err != nil {
+				return nil, auth.Descriptor{}, fmt.Errorf("failed to write buildkit config: %v", err)
 			}
-			logger.Debug("Updated buildkit config written to: %s", buildkitConfig)
+			buildkitConfig, buildkitConfigBase = runConfig.Name(), os.TempDir()
+			logger.Debug("Buildkit config of this run written to: %s", buildkitConfig)
 		} else {
 			logger.Debug("No changes needed to buildkit config")
 		}
@@ -803,47 +1472,52 @@ func executeBuildKit(config Config, ctx *Context) error {
 	// ========================================
 	// Validate socket path
 	if err := validation.ValidateSocketPath(buildkitSocket); err != nil {
-		return fmt.Errorf("invalid buildkit socket: %v", err)
+		return nil, auth.Descriptor{}, fmt.Errorf("invalid buildkit socket: %v", err)
 	}
 
 	// Validate config path
-	if err := validation.ValidatePathWithinBase(buildkitConfig, homeDir); err != nil {
-		return fmt.Errorf("invalid buildkit config path: %v", err)
+	if err := validation.ValidatePathWithinBase(buildkitConfig, buildkitConfigBase); err != nil {
+		return nil, auth.Descriptor{}, fmt.Errorf("invalid buildkit config path: %v", err)
 	}
 
 	cleanSocket := filepath.Clean(buildkitSocket)
 	cleanConfig := filepath.Clean(buildkitConfig)
 
 	logger.Debug("Starting buildkitd with rootlesskit...")
-	// #nosec G204,G702 -- socket validated by ValidateSocketPath, config by ValidatePathWithinBase
-	daemonCmd := exec.Command(
-		"rootlesskit",
-		"--state-dir="+filepath.Join(xdgRuntimeDir, "rk-buildkit"),
+	rootlesskitArgs := []string{
+		"--state-dir=" + filepath.Join(xdgRuntimeDir, "rk-buildkit"),
 		"--net=host",
-		"--copy-up=/home",  // <-- rootlesskit creates new mount namespaces.
+		"--copy-up=/home", // <-- rootlesskit creates new mount namespaces.
 		"--disable-host-loopback",
+	}
+	if config.Network == "slirp4netns" {
+		// A separate network namespace; /etc is copied up so resolv.conf can be replaced
+		rootlesskitArgs[1] = "--net=slirp4netns"
+		rootlesskitArgs = append(rootlesskitArgs, "--copy-up=/etc")
+	}
+	// #nosec G204,G702 -- socket validated by ValidateSocketPath, config by ValidatePathWithinBase
+	daemonCmd := exec.Command("rootlesskit", append(rootlesskitArgs,
 		"buildkitd",
 		"--config="+cleanConfig,
 		"--addr=unix://"+cleanSocket,
-	)
+	)...)
 
+	// Use the resolved HOME/DOCKER_CONFIG rather than the image defaults so
+	// arbitrary UIDs (OpenShift) with a relocated HOME keep working
 	daemonCmd.Env = append(os.Environ(),
-		"HOME=/home/kimia",
-		"DOCKER_CONFIG=/home/kimia/.docker",
+		"HOME="+homeDir,
+		"DOCKER_CONFIG="+auth.GetDockerConfigDir(),
 		"XDG_RUNTIME_DIR=/tmp/run",
 	)
 
 	daemonCmd.Stdout = os.Stdout
 	daemonCmd.Stderr = os.Stderr
 
-	if err := daemonCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start buildkitd: %v", err)
-	}
-
-	logger.Debug("buildkitd process started (PID: %d)", daemonCmd.Process.Pid)
-
-	// Ensure daemon cleanup
+	// Ensure daemon cleanup (a shared daemon keeps running for later builds)
 	defer func() {
+		if config.ReuseDaemon {
+			return
+		}
 		logger.Debug("Stopping buildkitd...")
 		if daemonCmd.Process != nil {
 			// #nosec G104 -- Ignoring kill error in cleanup (process may already be dead)
@@ -851,44 +1525,41 @@ func executeBuildKit(config Config, ctx *Context) error {
 		}
 	}()
 
-	// ========================================
-	// WAIT FOR BUILDKITD TO BE READY
-	// ========================================
-	logger.Debug("Waiting for buildkitd to be ready...")
-	ready := false
-	for i := 0; i < 30; i++ {
-		// #nosec G204,G702 -- socket validated and cleaned above in daemon startup section
-		checkCmd := exec.Command("buildctl", "--addr=unix://"+cleanSocket, "debug", "info")
-		output, err := checkCmd.CombinedOutput()
+	if external && config.ReuseDaemon {
+		logger.Warning("--reuse-daemon has no effect with an external buildkitd")
+	}
 
-		if err == nil {
-			ready = true
-			break
+	if external && config.DryRun {
+		logger.Info("Dry run: the external buildkitd at %s would be used; no daemon is started", config.BuildkitAddr)
+	} else if config.DryRun {
+		if resolvedBuildkitConfig == "" {
+			// #nosec G304,G703 -- buildkitConfig constructed from sanitized homeDir
+			if data, err := os.ReadFile(buildkitConfig); err == nil {
+				resolvedBuildkitConfig = string(data)
+			}
 		}
-
-		logger.Debug("Waiting for buildkitd... (%d/30) - error: %v", i+1, err)
-		if len(output) > 0 {
-			logger.Debug("  Output: %s", string(output))
+		printDryRunFile(buildkitConfig, resolvedBuildkitConfig)
+		if config.ReuseDaemon {
+			logger.Info("Dry run: a healthy buildkitd at %s would be reused; otherwise this daemon is started and left running", cleanSocket)
 		}
-
-		// Check if daemon is still running
-		if daemonCmd.Process == nil {
-			return fmt.Errorf("buildkitd process died")
+		printDryRunCommand("buildkitd daemon command", kimiaEnv(daemonCmd.Env, os.Environ()), "rootlesskit", daemonCmd.Args[1:])
+	} else if external {
+		if err := checkRemoteBuildkitd(config); err != nil {
+			return nil, auth.Descriptor{}, err
 		}
-
-		time.Sleep(1 * time.Second)
-	}
-
-	if !ready {
-		return fmt.Errorf("buildkitd failed to become ready after 30 seconds")
+	} else if config.ReuseDaemon {
+		if err := ensureSharedBuildkitd(daemonCmd, cleanSocket, cleanConfig); err != nil {
+			return nil, auth.Descriptor{}, err
+		}
+	} else if err := startBuildkitd(daemonCmd, cleanSocket); err != nil {
+		return nil, auth.Descriptor{}, err
 	}
 
-	logger.Debug("buildkitd is ready")
 
 	// ========================================
 	// BUILD BUILDCTL COMMAND
 	// ========================================
-	args := []string{"build", "--frontend", "dockerfile.v0"}
+	args := append(buildctlGlobalArgs(config), "build", "--frontend", "dockerfile.v0")
 
 	// Add Dockerfile
 	dockerfilePath := config.Dockerfile
@@ -896,25 +1567,79 @@ func executeBuildKit(config Config, ctx *Context) error {
 		dockerfilePath = "Dockerfile"
 	}
 
-	// Handle dockerfile path for copied contexts
-	if !isGitContext && buildContext != ctx.Path {
-		// Context was copied to temp directory
-		if filepath.IsAbs(dockerfilePath) {
-			if relPath, err := filepath.Rel(ctx.Path, dockerfilePath); err == nil {
+	// An absolute Dockerfile in the context is found at the same relative path
+	// in a synced copy; one outside the context (see ResolveDockerfile) is sent
+	// from its own directory
+	dockerfileDir := buildContext
+	if filepath.IsAbs(dockerfilePath) {
+		if !isGitContext && within(ctx.Path, dockerfilePath) {
+			contextDir, _ := filepath.Abs(ctx.Path)
+			if relPath, err := filepath.Rel(contextDir, dockerfilePath); err == nil {
 				dockerfilePath = relPath
 			}
+		} else {
+			dockerfileDir, dockerfilePath = filepath.Dir(dockerfilePath), filepath.Base(dockerfilePath)
 		}
-	} else if !isGitContext {
-		// Context not copied, use normal relative path logic
-		if filepath.IsAbs(dockerfilePath) {
-			relPath, err := filepath.Rel(buildContext, dockerfilePath)
-			if err == nil {
-				dockerfilePath = relPath
+	}
+
+	// Layers are traced back to the lines of the user's Dockerfile
+	originalDockerfile := filepath.Join(dockerfileDir, dockerfilePath)
+	var splits map[int]int
+
+	// Rewrite FROM images and split oversized COPY layers without touching the user's Dockerfile
+	if len(config.BaseImageRewrites) > 0 || config.MaxLayerSize > 0 || config.IgnoreFile != "" {
+		if isGitContext {
+			logger.Warning("--base-image-rewrite and --max-layer-size are not supported with BuildKit Git contexts; the Dockerfile is used unchanged")
+		} else {
+			fullDockerfilePath := filepath.Join(dockerfileDir, dockerfilePath)
+			prepared, err := prepareRewrittenDockerfile(config, fullDockerfilePath, buildContext)
+			if err != nil {
+				return nil, auth.Descriptor{}, err
+			}
+			if prepared != nil {
+				defer removeTemp(prepared.Dir)
+				dockerfileDir = prepared.Dir
+				dockerfilePath = "Dockerfile"
+				splits = prepared.Splits
+				if len(prepared.Rewrites) > 0 {
+					config.Labels = withLabel(config.Labels, BaseImageRewriteLabel, rewriteLabelValue(prepared.Rewrites))
+				}
+				if config.DryRun && (len(prepared.Rewrites) > 0 || len(prepared.Splits) > 0) {
+					printDryRunDockerfile(filepath.Join(prepared.Dir, "Dockerfile"))
+				}
 			}
 		}
 	}
 
 	args = append(args, "--opt", fmt.Sprintf("filename=%s", dockerfilePath))
+	if len(config.AddHosts) > 0 {
+		args = append(args, "--opt", buildkitAddHostsOpt(config.AddHosts))
+	}
+	if config.Network == "none" {
+		args = append(args, "--opt", "force-network-mode=none")
+	}
+	for _, entitlement := range config.Allow {
+		args = append(args, "--allow", entitlement)
+	}
+	args = append(args, secretArgs(config.Secrets)...)
+
+	// Base images come from the store as named contexts instead of registries
+	if config.ImageStore != nil {
+		effectiveDockerfile := dockerfilePath
+		if !filepath.IsAbs(effectiveDockerfile) {
+			effectiveDockerfile = filepath.Join(dockerfileDir, effectiveDockerfile)
+		}
+		if syntax := dockerfileSyntax(effectiveDockerfile); syntax != "" {
+			return nil, auth.Descriptor{}, fmt.Errorf("--offline: the Dockerfile's \"# syntax=%s\" directive makes BuildKit pull a frontend image; remove it to use the built-in frontend", syntax)
+		}
+		args = append(args, buildkitOfflineArgs(config.ImageStore)...)
+		logger.Info("Offline build: base images come from %s", config.ImageStore.Spec)
+	}
+
+	// The primary image of a chained build, from the layout its build exported
+	if config.ChainFrom != nil {
+		args = append(args, buildkitChainArgs(config.ChainFrom)...)
+	}
 
 	// Add context: Git URL or local path
 	if isGitContext {
@@ -922,12 +1647,25 @@ func executeBuildKit(config Config, ctx *Context) error {
 		// BuildKit requires Git URLs to be passed as --opt context=
 		logger.Debug("Using Git context: %s", logger.SanitizeGitURL(buildContext))
 		args = append(args, "--opt", fmt.Sprintf("context=%s", buildContext))
-		args = append(args, "--opt", fmt.Sprintf("dockerfile=%s", buildContext))
+		if dockerfileDir != buildContext {
+			// An inline Dockerfile, or one prepared by Kimia, is sent from its directory
+			args = append(args, "--local", fmt.Sprintf("dockerfile=%s", dockerfileDir))
+		} else {
+			args = append(args, "--opt", fmt.Sprintf("dockerfile=%s", buildContext))
+		}
+
+		// Header tokens and SSH deploy keys cannot be given in the URL
+		authArgs, cleanupAuth, err := buildkitGitAuthArgs(ctx.GitURL, ctx.GitConfig)
+		if err != nil {
+			return nil, auth.Descriptor{}, err
+		}
+		defer cleanupAuth()
+		args = append(args, authArgs...)
 	} else {
 		// Use local context
 		logger.Debug("Using local context: %s", buildContext)
 		args = append(args, "--local", fmt.Sprintf("context=%s", buildContext))
-		args = append(args, "--local", fmt.Sprintf("dockerfile=%s", buildContext))
+		args = append(args, "--local", fmt.Sprintf("dockerfile=%s", dockerfileDir))
 	}
 
 	// ========================================
@@ -940,12 +1678,7 @@ func executeBuildKit(config Config, ctx *Context) error {
 	sort.Strings(buildArgKeys)
 
 	for _, key := range buildArgKeys {
-		value := config.BuildArgs[key]
-		if value != "" {
-			args = append(args, "--opt", fmt.Sprintf("build-arg:%s=%s", key, value))
-		} else {
-			args = append(args, "--opt", fmt.Sprintf("build-arg:%s", key))
-		}
+		args = append(args, "--opt", fmt.Sprintf("build-arg:%s=%s", key, config.BuildArgs[key]))
 	}
 
 	// ========================================
@@ -967,6 +1700,12 @@ func executeBuildKit(config Config, ctx *Context) error {
 		args = append(args, "--opt", fmt.Sprintf("target=%s", config.Target))
 	}
 
+	// Base image pull policy
+	if config.PullPolicy != "" {
+		args = append(args, "--opt", "image-resolve-mode="+buildkitResolveModes[config.PullPolicy])
+		logger.Info("Base image pull policy: %s", config.PullPolicy)
+	}
+
 	// Add platform if specified
 	if config.CustomPlatform != "" {
 		args = append(args, "--opt", fmt.Sprintf("platform=%s", config.CustomPlatform))
@@ -999,25 +1738,31 @@ func executeBuildKit(config Config, ctx *Context) error {
 	// ========================================
 	// CACHE EXPORT / IMPORT (BuildKit advanced caching)
 	// ========================================
+	// Local directory cache (--cache-import-dir / --cache-export-dir) and inline cache (--cache-inline)
+	importCache, exportCache, err := cacheSpecs(config)
+	if err != nil {
+		return nil, auth.Descriptor{}, err
+	}
+
 	// Import cache sources first (used during build)
-	for _, ic := range config.ImportCache {
+	for _, ic := range importCache {
 		if config.Reproducible {
 			logger.Warning("--import-cache ignored: reproducible builds disable caching")
 		} else {
 			if err := validation.ValidateBuildKitCacheSpec(ic); err != nil {
-				return fmt.Errorf("invalid --import-cache value %q: %v", ic, err)
+				return nil, auth.Descriptor{}, fmt.Errorf("invalid --import-cache value %q: %v", ic, err)
 			}
 			args = append(args, "--import-cache", ic)
 			logger.Debug("Added import-cache: %s", ic)
 		}
 	}
 	// Export cache after build (push cache layers to registry/local/inline)
-	for _, ec := range config.ExportCache {
+	for _, ec := range exportCache {
 		if config.Reproducible {
 			logger.Warning("--export-cache ignored: reproducible builds disable caching")
 		} else {
 			if err := validation.ValidateBuildKitCacheSpec(ec); err != nil {
-				return fmt.Errorf("invalid --export-cache value %q: %v", ec, err)
+				return nil, auth.Descriptor{}, fmt.Errorf("invalid --export-cache value %q: %v", ec, err)
 			}
 			args = append(args, "--export-cache", ec)
 			logger.Debug("Added export-cache: %s", ec)
@@ -1035,27 +1780,61 @@ func executeBuildKit(config Config, ctx *Context) error {
 	// OUTPUT CONFIGURATION
 	// ========================================
 	if config.TarPath != "" {
-		// Export to tar
+		// Export to tar; with a push this is a second exporter of the same build result
 		outputOpts := fmt.Sprintf("type=docker,dest=%s", config.TarPath)
+		// Tag the archive so docker load and ctr import (--load) name the image
+		if len(sortedDests) > 0 {
+			outputOpts += fmt.Sprintf(",\"name=%s\"", strings.Join(sortedDests, ","))
+		}
 		if config.Reproducible && sourceEpoch != "" {
 			outputOpts += ",rewrite-timestamp=true"
 			logger.Debug("Added rewrite-timestamp=true for reproducible tar export")
 		}
 		args = append(args, "--output", outputOpts)
+	}
+	// Size budgets are checked on an OCI layout of the image, which is pushed
+	// by kimia once it passed instead of by BuildKit while building
+	layout := config.ChainLayout
+	checkBudget, deferPush := false, false
+	if hasSizeBudget(config) && isGitContext {
+		logger.Warning("--max-layer-size and --max-image-size are not checked for BuildKit Git contexts")
+	} else if hasSizeBudget(config) && config.pushByDigest {
+		logger.Warning("--max-layer-size and --max-image-size are not checked after routed builds (--builder-endpoint); only COPY layers were checked")
+	} else if hasSizeBudget(config) {
+		if layout == "" {
+			dir, err := newTempDir("", "kimia-layout-")
+			if err != nil {
+				return nil, auth.Descriptor{}, fmt.Errorf("failed to create OCI layout directory: %v", err)
+			}
+			defer removeTemp(dir)
+			layout = dir
+		}
+		checkBudget = true
+		deferPush = !config.NoPush && len(sortedDests) > 0
+	}
+
+	compressionOpts := buildkitCompressionOpts(config.Compression, config.CompressionLevel)
+	if deferPush {
+		logger.Info("The image is pushed once it is within the size budget")
 	} else if !config.NoPush {
 		// Push to registries
 		for _, dest := range sortedDests {
 			outputOpts := fmt.Sprintf("type=image,name=%s,push=true", dest)
+			if config.pushByDigest {
+				// Only the manifest index merged afterwards is tagged
+				outputOpts += ",push-by-digest=true"
+			}
+			outputOpts += compressionOpts
 			if config.Reproducible && sourceEpoch != "" {
 				outputOpts += ",rewrite-timestamp=true"
 				logger.Debug("Added rewrite-timestamp=true for reproducible push: %s", dest)
 			}
 			args = append(args, "--output", outputOpts)
 		}
-	} else {
+	} else if config.TarPath == "" {
 		// Build only, no push
 		for _, dest := range sortedDests {
-			outputOpts := fmt.Sprintf("type=image,name=%s,push=false", dest)
+			outputOpts := fmt.Sprintf("type=image,name=%s,push=false", dest) + compressionOpts
 			if config.Reproducible && sourceEpoch != "" {
 				outputOpts += ",rewrite-timestamp=true"
 				logger.Debug("Added rewrite-timestamp=true for reproducible build: %s", dest)
@@ -1064,6 +1843,15 @@ func executeBuildKit(config Config, ctx *Context) error {
 		}
 	}
 
+	if layout != "" {
+		// Chained builds and the size budget check read the image from this layout
+		outputOpts := fmt.Sprintf("type=oci,dest=%s,tar=false", layout) + compressionOpts
+		if config.Reproducible && sourceEpoch != "" {
+			outputOpts += ",rewrite-timestamp=true"
+		}
+		args = append(args, "--output", outputOpts)
+	}
+
 	// ========================================
 	// ATTESTATION: Configure attestations for BuildKit
 	// ========================================
@@ -1100,6 +1888,19 @@ func executeBuildKit(config Config, ctx *Context) error {
 		logger.Debug("Added direct BuildKit opt: %s", opt)
 	}
 
+	// Digests come from the build metadata BuildKit writes, not from its log
+	metadataFile := ""
+	if len(config.Destination) > 0 {
+		file, err := newTempFile("", "kimia-buildctl-metadata-*.json")
+		if err != nil {
+			return nil, auth.Descriptor{}, fmt.Errorf("failed to create build metadata file: %v", err)
+		}
+		file.Close()
+		metadataFile = file.Name()
+		defer removeTemp(metadataFile)
+		args = append(args, "--metadata-file", metadataFile)
+	}
+
 	// ========================================
 	// FINAL VALIDATION: Validate all buildctl arguments
 	// ========================================
@@ -1107,7 +1908,7 @@ func executeBuildKit(config Config, ctx *Context) error {
 	for i, arg := range args {
 		// Validate each argument for shell metacharacters and injection vectors
 		if err := validation.ValidateBuildctlArg(arg); err != nil {
-			return fmt.Errorf("validation failed for buildctl argument %d (%q): %v", i, arg, err)
+			return nil, auth.Descriptor{}, fmt.Errorf("validation failed for buildctl argument %d (%q): %v", i, arg, err)
 		}
 	}
 	
@@ -1118,7 +1919,7 @@ func executeBuildKit(config Config, ctx *Context) error {
 			url := strings.TrimPrefix(arg, "context=")
 			if strings.HasPrefix(url, "http") || strings.HasPrefix(url, "git") {
 				if err := validation.ValidateGitURL(url); err != nil {
-					return fmt.Errorf("invalid Git URL in context: %v", err)
+					return nil, auth.Descriptor{}, fmt.Errorf("invalid Git URL in context: %v", err)
 				}
 			}
 		}
@@ -1131,7 +1932,7 @@ func executeBuildKit(config Config, ctx *Context) error {
 				if strings.HasPrefix(part, "name=") {
 					imageName := strings.TrimPrefix(part, "name=")
 					if err := validation.ValidateImageReference(imageName); err != nil {
-						return fmt.Errorf("invalid image name in output: %v", err)
+						return nil, auth.Descriptor{}, fmt.Errorf("invalid image name in output: %v", err)
 					}
 				}
 			}
@@ -1139,9 +1940,11 @@ func executeBuildKit(config Config, ctx *Context) error {
 		
 		// Validate platform strings
 		if strings.HasPrefix(arg, "platform=") {
-			platform := strings.TrimPrefix(arg, "platform=")
-			if err := validation.ValidatePlatform(platform); err != nil {
-				return fmt.Errorf("invalid platform: %v", err)
+			// BuildKit builds a multi-platform image from a comma-separated list
+			for _, platform := range strings.Split(strings.TrimPrefix(arg, "platform="), ",") {
+				if err := validation.ValidatePlatform(platform); err != nil {
+					return nil, auth.Descriptor{}, fmt.Errorf("invalid platform: %v", err)
+				}
 			}
 		}
 		
@@ -1149,7 +1952,7 @@ func executeBuildKit(config Config, ctx *Context) error {
 		if strings.HasPrefix(arg, "build-arg:") {
 			buildArg := strings.TrimPrefix(arg, "build-arg:")
 			if err := validation.ValidateBuildArgKeyValue(buildArg); err != nil {
-				return fmt.Errorf("invalid build argument: %v", err)
+				return nil, auth.Descriptor{}, fmt.Errorf("invalid build argument: %v", err)
 			}
 		}
 		
@@ -1157,7 +1960,7 @@ func executeBuildKit(config Config, ctx *Context) error {
 		if strings.HasPrefix(arg, "label:") {
 			label := strings.TrimPrefix(arg, "label:")
 			if err := validation.ValidateLabelKeyValue(label); err != nil {
-				return fmt.Errorf("invalid label: %v", err)
+				return nil, auth.Descriptor{}, fmt.Errorf("invalid label: %v", err)
 			}
 		}
 	}
@@ -1168,7 +1971,30 @@ func executeBuildKit(config Config, ctx *Context) error {
 	// ========================================
 	// Create command with output capture for digest extraction
 	var stdoutBuf, stderrBuf bytes.Buffer
+	buildkitHost := "unix://" + buildkitSocket
+	if external {
+		buildkitHost = config.BuildkitAddr
+	}
 	
+	if config.DryRun {
+		env := []string{fmt.Sprintf("BUILDKIT_HOST=%s", buildkitHost), fmt.Sprintf("DOCKER_CONFIG=%s", auth.GetDockerConfigDir())}
+		if sourceEpoch != "" {
+			env = append(env, fmt.Sprintf("SOURCE_DATE_EPOCH=%s", sourceEpoch))
+		}
+		printDryRunCommand("buildctl build command", env, "buildctl", args)
+		return nil, auth.Descriptor{}, nil
+	}
+
+	// buildctl pushes during the build, so it also gets the push time
+	buildTimeout := config.BuildTimeout
+	if buildTimeout > 0 && !config.NoPush {
+		buildTimeout += config.PushTimeout
+	} else if config.PushTimeout > 0 && !config.NoPush {
+		logger.Warning("--push-timeout needs --build-timeout with BuildKit, which pushes during the build")
+	}
+	buildCtx, cancelBuild := phaseContext(buildTimeout)
+	defer cancelBuild()
+
 	// Log the command being executed (with credentials sanitized)
 	logger.Info("Executing: buildctl %s", strings.Join(sanitizeCommandArgs(args), " "))
 
@@ -1182,13 +2008,19 @@ func executeBuildKit(config Config, ctx *Context) error {
 	//   - Platform strings validated by validation.ValidatePlatform against OS/arch allowlists
 	//   - All validation checks for null bytes, path traversal, and dangerous characters
 	//   - Validation occurs immediately before command execution with no modification of args after validation
-	cmd := exec.Command("buildctl", args...)
-	cmd.Stdout = io.MultiWriter(os.Stdout, &stdoutBuf)
-	cmd.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+	cmd := commandContext(buildCtx, "buildctl", args...)
+	beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "build", "")
+	defer beat.stop()
+	// Secret values are redacted from what the build prints
+	stdout, stderr := logger.NewRedactWriter(os.Stdout), logger.NewRedactWriter(os.Stderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	cmd.Stdout = io.MultiWriter(stdout, &stdoutBuf, beat)
+	cmd.Stderr = io.MultiWriter(stderr, &stderrBuf, beat)
 	cmd.Env = os.Environ()
 
 	// Set BUILDKIT_HOST
-	cmd.Env = append(cmd.Env, fmt.Sprintf("BUILDKIT_HOST=unix://%s", buildkitSocket))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("BUILDKIT_HOST=%s", buildkitHost))
 
 	// Set DOCKER_CONFIG for authentication
 	dockerConfigDir := auth.GetDockerConfigDir()
@@ -1215,86 +2047,163 @@ func executeBuildKit(config Config, ctx *Context) error {
 	}
 
 	// Execute build
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("buildkit build failed: %v", err)
+	oom := startOOMWatch()
+	started := time.Now()
+	err = cmd.Run()
+	reportBuildTiming(config, newBuildTiming("buildkit", time.Since(started), err == nil, parseBuildKitTimings(stderrBuf.String())))
+	if !isGitContext {
+		logContextTransferStats(stderrBuf.String(), contextSize(buildContext), buildContext != ctx.Path)
+	}
+
+	// Retry builds that failed on a flaky network, ignoring the cache of the failed stage
+	for attempt := 1; err != nil && buildCtx.Err() == nil && attempt <= config.RetryTransient; attempt++ {
+		output := stderrBuf.String()
+		failed, logs, ok := buildkitFailedStep(output)
+		if ok {
+			output = logs
+		}
+		signature := transientFailure(output)
+		if signature == "" {
+			logger.Debug("Build failure does not look transient, not retrying")
+			break
+		}
+		logger.Warning("%s", transientRetryMessage(signature, attempt, config.RetryTransient))
+		time.Sleep(transientRetryDelay(attempt))
+
+		retryArgs := buildkitRetryArgs(args, failed.Stage)
+		stdoutBuf.Reset()
+		stderrBuf.Reset()
+		logger.Info("Executing: buildctl %s", strings.Join(sanitizeCommandArgs(retryArgs), " "))
+		// #nosec G204,G702 -- the validated args above plus a no-cache option for a stage name checked by stageNameRegex
+		retry := commandContext(buildCtx, "buildctl", retryArgs...)
+		retry.Stdout, retry.Stderr, retry.Env = cmd.Stdout, cmd.Stderr, cmd.Env
+		started = time.Now()
+		err = retry.Run()
+		reportBuildTiming(config, newBuildTiming("buildkit", time.Since(started), err == nil, parseBuildKitTimings(stderrBuf.String())))
+	}
+	if err != nil && buildCtx.Err() == nil {
+		var failed *StepTiming
+		if step, _, ok := buildkitFailedStep(stderrBuf.String()); ok {
+			failed = &step
+		}
+		if config.DebugOnFailure && isGitContext {
+			logger.Warning("--debug-on-failure is not supported with BuildKit Git contexts")
+		} else if config.DebugOnFailure {
+			effectiveDockerfile := dockerfilePath
+			if !filepath.IsAbs(effectiveDockerfile) {
+				effectiveDockerfile = filepath.Join(dockerfileDir, effectiveDockerfile)
+			}
+			debugBuildKitFailure(config, args, cmd.Env, effectiveDockerfile, failed)
+		}
+		if oomErr := oom.check(err, stderrBuf.String(), failed); oomErr != nil {
+			return nil, auth.Descriptor{}, fmt.Errorf("buildkit build failed: %v", oomErr)
+		}
+	}
+	if err := timeoutError(buildCtx, err, "buildkit build", "--build-timeout", buildTimeout); err != nil {
+		return nil, auth.Descriptor{}, fmt.Errorf("buildkit build failed: %w", err)
 	}
 
 	logger.Info("Build completed successfully")
 
 	// ========================================
-	// REPRODUCIBLE BUILDS: Extract digest from output
+	// SIZE BUDGETS: Check the exported layers before the push
 	// ========================================
-	digestMap := make(map[string]string) // Map tag -> digest
-	
-	if len(config.Destination) > 0 {
-		stderrOutput := stderrBuf.String()
-		stdoutOutput := stdoutBuf.String()
+	if checkBudget {
+		if err := checkLayoutSizeBudget(layout, config, originalDockerfile, splits); err != nil {
+			return nil, auth.Descriptor{}, err
+		}
+	}
+	if deferPush {
+		return pushBuildKitLayout(config, layout)
+	}
 
+	// ========================================
+	// REPRODUCIBLE BUILDS: Read the image digest
+	// ========================================
+	digestMap := make(map[string]string) // Map tag -> digest
+	var descriptor auth.Descriptor
+	if metadataFile != "" {
+		descriptor, err = readBuildKitMetadata(metadataFile)
+		if err != nil {
+			if config.VerifyPush && !config.NoPush {
+				return nil, auth.Descriptor{}, fmt.Errorf("push verification failed: %v", err)
+			}
+			logger.Warning("Could not determine the image digest: %v", err)
+		}
 		for _, dest := range config.Destination {
-			var digest string
-
-			// Pattern 1: Look for "exporting manifest list sha256:xxx" in stderr (PRIORITY)
-			// This is the correct digest to sign when attestations are present
-			for _, line := range strings.Split(stderrOutput, "\n") {
-				if strings.Contains(line, "exporting manifest list sha256:") {
-					parts := strings.Fields(line)
-					for _, part := range parts {
-						if strings.HasPrefix(part, "sha256:") {
-							digest = part
-							logger.Debug("Found manifest list digest: %s", digest)
-							break
-						}
-					}
-				}
-				if digest != "" {
-					break
+			digest := descriptor.Digest
+			// With --tar-path the metadata may describe the archive; ask the registry instead
+			if config.TarPath != "" && !config.NoPush {
+				insecure := config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+				if digest, err = auth.ResolveImageDigest(dest, insecure); err != nil {
+					logger.Warning("Failed to resolve the pushed digest of %s: %v", dest, err)
+					continue
 				}
 			}
-
-			// Pattern 2: Look for "exporting manifest sha256:xxx" in stderr (fallback)
-			// This is for images without attestations (single manifest)
-			if digest == "" {
-				for _, line := range strings.Split(stderrOutput, "\n") {
-					if strings.Contains(line, "exporting manifest sha256:") {
-						parts := strings.Fields(line)
-						for _, part := range parts {
-							if strings.HasPrefix(part, "sha256:") {
-								digest = part
-								logger.Debug("Found platform manifest digest: %s", digest)
-								break
-							}
-						}
-					}
-					if digest != "" {
-						break
-					}
-				}
+			if digest != "" {
+				logger.Debug("Image digest for %s: %s", dest, digest)
+				digestMap[dest] = digest
 			}
+		}
+	}
 
-			// Pattern 3: Look for digest in stdout (last resort fallback)
-			if digest == "" {
-				for _, line := range strings.Split(stdoutOutput, "\n") {
-					if strings.Contains(line, "sha256:") {
-						parts := strings.Fields(line)
-						for _, part := range parts {
-							if strings.HasPrefix(part, "sha256:") && len(part) == 71 {
-								digest = part
-								break
-							}
-						}
-					}
-					if digest != "" {
-						break
-					}
-				}
+	return digestMap, descriptor, nil
+}
+
+// storeBuildKitAttestations copies the attestations in the pushed image
+// indexes to the --attestation-repo of their destinations
+func storeBuildKitAttestations(config Config, digestMap map[string]string) error {
+	insecure := func(dest string) bool {
+		return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+	}
+	images := make([]PushedImage, 0, len(config.Destination))
+	for _, dest := range config.Destination {
+		digest := digestMap[dest]
+		if digest == "" && config.AttestationRepos.For(dest) != "" {
+			resolved, err := auth.ResolveImageDigest(dest, insecure(dest))
+			if err != nil {
+				return fmt.Errorf("failed to resolve pushed image %s: %v", dest, err)
 			}
+			digest = resolved
+		}
+		images = append(images, PushedImage{Destination: dest, Digest: digest})
+	}
+	return StoreAttestations(images, config.AttestationRepos, insecure)
+}
 
-			if digest != "" {
-				logger.Debug("Extracted digest for %s: %s", dest, digest)
-				digestMap[dest] = digest
-			} else {
-				logger.Debug("Could not extract digest from BuildKit output for %s", dest)
+// publishPushedImages verifies, signs and records the digests of the images
+// BuildKit or the buildpacks lifecycle pushed while building
+func publishPushedImages(config Config, digestMap map[string]string, descriptor auth.Descriptor) error {
+	if config.History != nil {
+		config.History.SetDigests(digestMap)
+	}
+
+	// ========================================
+	// PUSH VERIFICATION
+	// ========================================
+	if config.VerifyPush && !config.NoPush && len(config.Destination) > 0 {
+		images := make([]PushedImage, 0, len(config.Destination))
+		for _, dest := range config.Destination {
+			image := PushedImage{Destination: dest, Digest: digestMap[dest]}
+			if image.Digest == descriptor.Digest {
+				image.Size = descriptor.Size
 			}
+			images = append(images, image)
+		}
+		insecure := func(dest string) bool {
+			return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+		}
+		if err := VerifyPushedImages(images, splitPlatforms(config.CustomPlatform), insecure); err != nil {
+			return err
+		}
+	}
+
+	// ========================================
+	// ATTESTATION STORAGE: Copy attestations to --attestation-repo
+	// ========================================
+	if config.AttestationRepos.IsSet() && !config.NoPush {
+		if err := storeBuildKitAttestations(config, digestMap); err != nil {
+			return err
 		}
 	}
 
@@ -1304,46 +2213,15 @@ func executeBuildKit(config Config, ctx *Context) error {
 	if config.Sign && !config.NoPush {
 		if config.CosignKeyPath == "" {
 			logger.Warning("Signing requested but no cosign key provided (--cosign-key), skipping signature")
-		} else {
-			logger.Info("Signing images with cosign...")
-			
-			for _, dest := range config.Destination {
-				// Use digest-based reference if available
-				imageToSign := dest
-				if digest, ok := digestMap[dest]; ok {
-					// Remove tag but keep registry:port/repo
-					// Find the last ':' which separates the tag
-					if idx := strings.LastIndex(dest, ":"); idx > 0 {
-						// Check if this is actually a tag (not a port number)
-						// Port numbers come before '/', tags come after
-						afterColon := dest[idx+1:]
-						if !strings.Contains(afterColon, "/") {
-							// This is a tag, remove it
-							imageToSign = dest[:idx] + "@" + digest
-						} else {
-							// This is a port, append digest to the full reference
-							imageToSign = dest + "@" + digest
-						}
-					} else {
-						imageToSign = dest + "@" + digest
-					}
-					logger.Info("Signing with digest reference: %s", imageToSign)
-				} else {
-					logger.Warning("No digest found for %s, signing with tag (not recommended)", dest)
-				}
-				
-				if err := signImageWithCosign(imageToSign, config); err != nil {
-					return fmt.Errorf("failed to sign image %s: %v", imageToSign, err)
-				}
-				logger.Info("Successfully signed: %s", imageToSign)
-			}
+		} else if err := signImages(config, digestMap); err != nil {
+			return err
 		}
 	}
 
 	// ========================================
 	// DIGEST FILE EXPORT
 	// ========================================
-	if config.DigestFile != "" || config.ImageNameWithDigestFile != "" || config.ImageNameTagWithDigestFile != "" {
+	if wantsDigests(config) {
 		if err := SaveDigestInfo(config, digestMap); err != nil {
 			logger.Warning("Failed to save digest information: %v", err)
 		}
@@ -1355,6 +2233,8 @@ func executeBuildKit(config Config, ctx *Context) error {
 // exportToTar exports the built image to a tar file (Buildah only)
 func exportToTar(config Config) error {
 	logger.Info("Exporting image to TAR: %s", config.TarPath)
+	beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "export", config.TarPath)
+	defer beat.stop()
 
 	// Ensure Docker config exists - buildah requires a credentials file
 	// even for local tar export operations
@@ -1377,10 +2257,23 @@ func exportToTar(config Config) error {
 
 	image := config.Destination[0]
 
+	// A remote service streams the archive back; the fallbacks below need local storage
+	transport := newBuildahTransport(config.BuildahRemote, config.StorageRoot)
+	if transport.remote() {
+		cmd := transport.archiveCommand(image, config.TarPath)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to export to tar through the Podman service: %v", err)
+		}
+		logger.Info("Successfully exported to %s", config.TarPath)
+		return nil
+	}
+
 	// Method 1: Try direct buildah push (works for VFS and newer buildah versions)
 	logger.Debug("Attempting TAR export with buildah push...")
 	// #nosec G204 -- image and tarPath validated by validateBuildahInputs
-	cmd := exec.Command("buildah", "push", image, fmt.Sprintf("docker-archive:%s", config.TarPath))
+	cmd := transport.archiveCommand(image, config.TarPath)
 
 	
 	var stderr strings.Builder
@@ -1394,7 +2287,7 @@ func exportToTar(config Config) error {
 		// Method 2: Try with image ID instead of name (most reliable for overlay)
 		logger.Debug("Attempting with image ID...")
 		// #nosec G204 -- image validated by validateBuildahInputs
-		getIDCmd := exec.Command("buildah", "images", "--format", "{{.ID}}", "--filter", fmt.Sprintf("reference=%s", image))
+		getIDCmd := buildahCommand(transport, "images", "--format", "{{.ID}}", "--filter", fmt.Sprintf("reference=%s", image))
 		idOutput, idErr := getIDCmd.Output()
 
 		if idErr == nil && len(strings.TrimSpace(string(idOutput))) > 0 {
@@ -1402,7 +2295,7 @@ func exportToTar(config Config) error {
 			logger.Debug("Found image ID: %s", imageID)
 
 			// #nosec G204 -- imageID derived from validated image, tarPath validated
-			cmd2 := exec.Command("buildah", "push", imageID, fmt.Sprintf("docker-archive:%s", config.TarPath))
+			cmd2 := buildahCommand(transport, "push", imageID, fmt.Sprintf("docker-archive:%s:%s", config.TarPath, image))
 			cmd2.Stdout = os.Stdout
 			cmd2.Stderr = os.Stderr
 
@@ -1414,7 +2307,7 @@ func exportToTar(config Config) error {
 			// Method 3: List all images and find a match
 			logger.Debug("Image ID lookup failed, searching all images...")
 			// #nosec G204 -- listing all images, no user input in command
-			listCmd := exec.Command("buildah", "images", "--format", "{{.ID}}:{{.Names}}")
+			listCmd := buildahCommand(transport, "images", "--format", "{{.ID}}:{{.Names}}")
 			listOutput, listErr := listCmd.Output()
 
 			if listErr == nil {
@@ -1427,7 +2320,7 @@ func exportToTar(config Config) error {
 							logger.Debug("Found matching image ID from list: %s", foundID)
 
 							// #nosec G204 -- foundID derived from validated image, tarPath validated
-							cmd3 := exec.Command("buildah", "push", foundID, fmt.Sprintf("docker-archive:%s", config.TarPath))
+							cmd3 := buildahCommand(transport, "push", foundID, fmt.Sprintf("docker-archive:%s:%s", config.TarPath, image))
 							cmd3.Stdout = os.Stdout
 							cmd3.Stderr = os.Stderr
 
@@ -1462,9 +2355,53 @@ success:
 	return nil
 }
 
-// SaveDigestInfo saves image digest information to files (Buildah only)
-// The digest should be obtained from the push operation output
+// wantsDigests reports whether any digest file is requested
+func wantsDigests(config Config) bool {
+	return config.DigestFile != "" || config.ImageNameWithDigestFile != "" || config.ImageNameTagWithDigestFile != "" || config.DigestMapFile != ""
+}
+
+// digestMaps holds the digests recorded for each --digest-map-file, so that
+// the builds of several targets all end up in the file
+var (
+	digestMaps   = make(map[string]map[string]string)
+	digestMapsMu sync.Mutex
+)
+
+// saveDigestMap adds digestMap to the digests recorded for path and rewrites it
+func saveDigestMap(path string, digestMap map[string]string) error {
+	digestMapsMu.Lock()
+	defer digestMapsMu.Unlock()
+	recorded := digestMaps[path]
+	if recorded == nil {
+		recorded = make(map[string]string)
+		digestMaps[path] = recorded
+	}
+	for image, digest := range digestMap {
+		if !isDigest(digest) {
+			return fmt.Errorf("invalid digest %q for %s", digest, image)
+		}
+		recorded[image] = digest
+	}
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return err
+	}
+	// #nosec G306 -- 0644 for digest map file (public build artifact, not sensitive)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write digest map file: %v", err)
+	}
+	logger.Info("Digests of %d images saved to: %s", len(recorded), path)
+	return nil
+}
+
+// SaveDigestInfo saves image digest information to files
+// The digests come from the push output (Buildah) or the buildctl metadata file (BuildKit)
 func SaveDigestInfo(config Config, digestMap map[string]string) error {
+	if config.DigestMapFile != "" && len(digestMap) > 0 {
+		if err := saveDigestMap(config.DigestMapFile, digestMap); err != nil {
+			return err
+		}
+	}
 	if len(config.Destination) == 0 || len(digestMap) == 0 {
 		return nil
 	}
@@ -1477,7 +2414,10 @@ func SaveDigestInfo(config Config, digestMap map[string]string) error {
 		return nil
 	}
 
-	logger.Debug("Using digest from push output: %s", digest)
+	if !isDigest(digest) {
+		return fmt.Errorf("invalid digest %q for %s", digest, image)
+	}
+	logger.Debug("Using digest %s of %s", digest, image)
 
 	// Save digest file
 	if config.DigestFile != "" {
@@ -1524,96 +2464,6 @@ func SaveDigestInfo(config Config, digestMap map[string]string) error {
 	return nil
 }
 
-// copyDir recursively copies a directory from src to dst
-func copyDir(src, dst string) error {
-	// Sanitize and validate source path
-	src = filepath.Clean(src)
-	if strings.Contains(src, "\x00") {
-		return fmt.Errorf("source path contains null bytes - invalid path")
-	}
-
-	// Sanitize and validate destination path
-	dst = filepath.Clean(dst)
-	if strings.Contains(dst, "\x00") {
-		return fmt.Errorf("destination path contains null bytes - invalid path")
-	}
-
-	// Get source directory info
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return fmt.Errorf("failed to stat source: %v", err)
-	}
-
-	// Create destination directory
-	// #nosec G703 -- dst is sanitized above (cleaned and validated for null bytes)
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
-		return fmt.Errorf("failed to create destination: %v", err)
-	}
-
-	// Read directory entries
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		return fmt.Errorf("failed to read directory: %v", err)
-	}
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
-	})
-
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			// Recursively copy subdirectory
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			// Copy file
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-// copyFile copies a single file from src to dst
-func copyFile(src, dst string) error {
-	// Sanitize and validate source path
-	src = filepath.Clean(src)
-	if strings.Contains(src, "\x00") {
-		return fmt.Errorf("source path contains null bytes - invalid path")
-	}
-
-	// Sanitize and validate destination path
-	dst = filepath.Clean(dst)
-	if strings.Contains(dst, "\x00") {
-		return fmt.Errorf("destination path contains null bytes - invalid path")
-	}
-
-	// Get source file info for permissions
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return fmt.Errorf("failed to stat source file: %v", err)
-	}
-
-	// Read source file
-	srcData, err := os.ReadFile(src)
-	if err != nil {
-		return fmt.Errorf("failed to read source: %v", err)
-	}
-
-	// Write to destination with same permissions
-	// #nosec G703 -- dst is sanitized above (cleaned and validated for null bytes)
-	if err := os.WriteFile(dst, srcData, srcInfo.Mode()); err != nil {
-		return fmt.Errorf("failed to write destination: %v", err)
-	}
-
-	return nil
-}
-
 // buildAttestationOptsFromSimpleMode converts simple mode to BuildKit opts
 func buildAttestationOptsFromSimpleMode(mode string, reproducible bool) []string {
 	var opts []string
@@ -1770,53 +2620,6 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-// signImageWithCosign signs a container image using cosign
-func signImageWithCosign(image string, config Config) error {
-	logger.Debug("Signing image with cosign: %s", image)
-
-	// Prepare cosign command
-	args := []string{"sign", "--key", config.CosignKeyPath}
-
-	// Add insecure registry flag if needed
-	if config.Insecure || len(config.InsecureRegistry) > 0 {
-		args = append(args, "--allow-insecure-registry")
-		logger.Debug("Added --allow-insecure-registry flag for insecure registry")
-	}
-
-	// Add the image reference
-	args = append(args, image)
-
-	// Create the command
-	// #nosec G204 -- image validated by validateBuildahInputs or validateBuildKitInputs, key path from config
-	cmd := exec.Command("cosign", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	
-	cmd.Env = append(cmd.Env, "COSIGN_EXPERIMENTAL=1")
-
-	// Set cosign password from environment variable if specified
-	if config.CosignPasswordEnv != "" {
-		password := os.Getenv(config.CosignPasswordEnv)
-		if password == "" {
-			logger.Warning("Cosign password environment variable %s is not set or empty", config.CosignPasswordEnv)
-		} else {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("COSIGN_PASSWORD=%s", password))
-			logger.Debug("Set COSIGN_PASSWORD from %s", config.CosignPasswordEnv)
-		}
-	}
-
-	// Log the command being executed
-	logger.Debug("Executing: cosign %s", strings.Join(sanitizeCommandArgs(args), " "))
-
-	// Execute cosign
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("cosign signing failed: %v", err)
-	}
-
-	return nil
-}
-
 // sanitizeCommandArgs removes credentials from Git URLs and sensitive build-args
 func sanitizeCommandArgs(args []string) []string {
 	// List of build-arg names that contain sensitive data
@@ -1840,8 +2643,8 @@ func sanitizeCommandArgs(args []string) []string {
 			} else {
 				sanitized[i] = arg
 			}
-		} else if strings.HasPrefix(arg, "build-arg:") {
-			// Handle --opt build-arg:KEY=VALUE format
+		} else if strings.HasPrefix(arg, "build-arg:") || (i > 0 && args[i-1] == "--build-arg") {
+			// Handle --opt build-arg:KEY=VALUE (BuildKit) and --build-arg KEY=VALUE (Buildah) formats
 			parts := strings.SplitN(arg, "=", 2)
 			if len(parts) == 2 {
 				argName := strings.TrimPrefix(parts[0], "build-arg:")
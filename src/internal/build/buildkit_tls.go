@@ -0,0 +1,226 @@
+package build
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// certExpiryWarning is how long before expiry a buildkitd or client certificate is reported
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// BuildKitCertFiles are the file names buildctl and buildkitd expect in a TLS
+// directory (buildctl --tlsdir), used by --buildkit-tls-dir and buildkit-certs
+var BuildKitCertFiles = struct{ CA, Cert, Key string }{"ca.pem", "cert.pem", "key.pem"}
+
+// buildkitClientTLS loads the CA and client certificate for a tcp:// buildkitd.
+// The server name defaults to the host of the address.
+func buildkitClientTLS(config Config) (*tls.Config, error) {
+	u, err := url.Parse(config.BuildkitAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid buildkit address %q: %v", config.BuildkitAddr, err)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.BuildkitTLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	if config.BuildkitTLSCACert != "" {
+		// #nosec G304 -- user-specified CA certificate
+		caPEM, err := os.ReadFile(config.BuildkitTLSCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --buildkit-tls-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("--buildkit-tls-ca %s contains no PEM certificates", config.BuildkitTLSCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.BuildkitTLSCert != "" {
+		pair, err := tls.LoadX509KeyPair(config.BuildkitTLSCert, config.BuildkitTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load buildkit client certificate: %v", err)
+		}
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil {
+			warnCertificateExpiry("buildkit client certificate", leaf)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+// verifyBuildkitdIdentity connects to a tcp:// buildkitd and checks that its
+// certificate is signed by --buildkit-tls-ca and issued for the expected server
+// name, before any build context or credentials are sent to it
+func verifyBuildkitdIdentity(config Config) error {
+	tlsConfig, err := buildkitClientTLS(config)
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(config.BuildkitAddr)
+
+	dialer := &net.Dialer{Timeout: remoteBuildkitdTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to verify buildkitd identity at %s: %v", config.BuildkitAddr, err)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("buildkitd at %s presented no certificate", config.BuildkitAddr)
+	}
+	leaf := certs[0]
+	fingerprint := sha256.Sum256(leaf.Raw)
+	logger.Info("Verified buildkitd identity: %s (issuer: %s)", tlsConfig.ServerName, leaf.Issuer.CommonName)
+	logger.Debug("  Certificate SHA256: %s", hex.EncodeToString(fingerprint[:]))
+	logger.Debug("  Valid until: %s", leaf.NotAfter.Format(time.RFC3339))
+	warnCertificateExpiry("buildkitd certificate", leaf)
+	return nil
+}
+
+// warnCertificateExpiry warns when cert expires within certExpiryWarning
+func warnCertificateExpiry(what string, cert *x509.Certificate) {
+	if remaining := time.Until(cert.NotAfter); remaining < certExpiryWarning {
+		logger.Warning("The %s expires on %s", what, cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// GenerateBuildKitCerts writes a CA plus daemon and client certificates for
+// mutual TLS between buildctl and a tcp:// buildkitd:
+//
+//	DIR/ca.pem, DIR/ca-key.pem            CA (keep ca-key.pem offline)
+//	DIR/daemon/{ca,cert,key}.pem          buildkitd --tlscacert/--tlscert/--tlskey
+//	DIR/client/{ca,cert,key}.pem          kimia --buildkit-tls-dir DIR/client
+func GenerateBuildKitCerts(dir string, serverNames []string, validity time.Duration) error {
+	if len(serverNames) == 0 {
+		return fmt.Errorf("at least one server name is required")
+	}
+
+	now := time.Now()
+	caKey, caCert, caDER, err := newCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "kimia buildkit CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	daemon := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: serverNames[0]},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range serverNames {
+		if ip := net.ParseIP(name); ip != nil {
+			daemon.IPAddresses = append(daemon.IPAddresses, ip)
+		} else {
+			daemon.DNSNames = append(daemon.DNSNames, name)
+		}
+	}
+	daemonKey, _, daemonDER, err := newCertificate(daemon, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	clientKey, _, clientDER, err := newCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "kimia"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	files := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{filepath.Join(dir, BuildKitCertFiles.CA), caPEM, 0644},
+		{filepath.Join(dir, "ca-key.pem"), encodeKey(caKey), 0600},
+		{filepath.Join(dir, "daemon", BuildKitCertFiles.CA), caPEM, 0644},
+		{filepath.Join(dir, "daemon", BuildKitCertFiles.Cert), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: daemonDER}), 0644},
+		{filepath.Join(dir, "daemon", BuildKitCertFiles.Key), encodeKey(daemonKey), 0600},
+		{filepath.Join(dir, "client", BuildKitCertFiles.CA), caPEM, 0644},
+		{filepath.Join(dir, "client", BuildKitCertFiles.Cert), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDER}), 0644},
+		{filepath.Join(dir, "client", BuildKitCertFiles.Key), encodeKey(clientKey), 0600},
+	}
+	for _, f := range files {
+		// #nosec G301 -- certificate directories; keys inside are 0600
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return fmt.Errorf("failed to create certificate directory: %v", err)
+		}
+		// #nosec G306 -- certificates are public; private keys use 0600
+		if err := os.WriteFile(f.path, f.data, f.mode); err != nil {
+			return fmt.Errorf("failed to write %s: %v", f.path, err)
+		}
+	}
+	return nil
+}
+
+// newCertificate creates a P-256 key and a certificate from template, signed
+// by parent (self-signed when parent is nil)
+func newCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, *x509.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+	template.SerialNumber = serial
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	return key, cert, der, nil
+}
+
+// encodeKey returns key as a PEM-encoded PKCS#8 private key
+func encodeKey(key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
@@ -0,0 +1,283 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tomlDocument is a TOML file split into tables, keeping the original text of
+// every line so a merge only rewrites what a fragment changes. The first
+// table is the root table, with an empty header.
+type tomlDocument struct {
+	tables []*tomlTable
+}
+
+// tomlTable is a [table] or [[array]] table and its entries
+type tomlTable struct {
+	name    string // Header without brackets and whitespace (e.g. worker.oci)
+	array   bool
+	header  string // Original header line
+	entries []tomlEntry
+}
+
+// tomlEntry is a key/value pair (possibly spanning lines) or a comment or
+// blank line, which has no key
+type tomlEntry struct {
+	key  string
+	text string
+}
+
+// parseTOMLDocument splits TOML text into tables and entries. Values are not
+// interpreted beyond finding where multi-line arrays, inline tables and
+// strings end.
+func parseTOMLDocument(content string) (*tomlDocument, error) {
+	doc := &tomlDocument{tables: []*tomlTable{{}}}
+	current := doc.tables[0]
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			current.entries = append(current.entries, tomlEntry{text: line})
+		case strings.HasPrefix(trimmed, "["):
+			array := strings.HasPrefix(trimmed, "[[")
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			header := stripTOMLComment(trimmed)
+			if !strings.HasSuffix(header, closing) {
+				return nil, fmt.Errorf("line %d: unterminated table header", i+1)
+			}
+			name := normalizeTOMLKey(header[len(closing) : len(header)-len(closing)])
+			if name == "" {
+				return nil, fmt.Errorf("line %d: empty table header", i+1)
+			}
+			current = &tomlTable{name: name, array: array, header: line}
+			doc.tables = append(doc.tables, current)
+		default:
+			key, _, ok := strings.Cut(trimmed, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return nil, fmt.Errorf("line %d: expected key = value, [table] or a comment", i+1)
+			}
+			text := line
+			for depth := tomlValueDepth(line); depth != 0; depth = tomlValueDepth(text) {
+				if i+1 >= len(lines) {
+					return nil, fmt.Errorf("line %d: unterminated value of %s", i+1, strings.TrimSpace(key))
+				}
+				i++
+				text += "\n" + lines[i]
+			}
+			current.entries = append(current.entries, tomlEntry{key: normalizeTOMLKey(key), text: text})
+		}
+	}
+	return doc, nil
+}
+
+// tomlValueDepth returns how many brackets, braces and multi-line strings are
+// still open at the end of a key/value text
+func tomlValueDepth(text string) int {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case strings.HasPrefix(text[i:], `"""`) || strings.HasPrefix(text[i:], "'''"):
+			end := strings.Index(text[i+3:], text[i:i+3])
+			if end < 0 {
+				return depth + 1
+			}
+			i += end + 5
+		case c == '"':
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case c == '\'':
+			for i++; i < len(text) && text[i] != '\''; i++ {
+			}
+		case c == '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// stripTOMLComment removes a trailing comment from a header line
+func stripTOMLComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// normalizeTOMLKey removes the whitespace outside quotes from a (dotted) key
+// or table name, so `registry . "docker.io"` and `registry."docker.io"` match
+func normalizeTOMLKey(key string) string {
+	var sb strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ' || c == '\t':
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// merge applies a fragment: its keys replace the same keys of the same
+// table, new keys and tables are added, and its [[array]] tables replace all
+// existing tables of that name, where the first of them was. Merging the same
+// fragment again changes nothing.
+func (d *tomlDocument) merge(fragment *tomlDocument) {
+	arrays := make(map[string][]*tomlTable)
+	var order []string
+	for _, table := range fragment.tables {
+		if table.array {
+			if _, ok := arrays[table.name]; !ok {
+				order = append(order, table.name)
+			}
+			arrays[table.name] = append(arrays[table.name], table)
+			continue
+		}
+
+		target := d.table(table.name)
+		if target == nil {
+			d.tables = append(d.tables, table)
+			continue
+		}
+		for _, entry := range table.entries {
+			if entry.key == "" {
+				continue
+			}
+			if i := target.entry(entry.key); i >= 0 {
+				target.entries[i] = entry
+			} else {
+				target.insert(entry)
+			}
+		}
+	}
+
+	tables := make([]*tomlTable, 0, len(d.tables))
+	for _, table := range d.tables {
+		replacement, ok := arrays[table.name]
+		if !table.array || !ok {
+			tables = append(tables, table)
+			continue
+		}
+		tables = append(tables, replacement...)
+		arrays[table.name] = nil
+	}
+	for _, name := range order {
+		tables = append(tables, arrays[name]...)
+	}
+	d.tables = tables
+}
+
+// table returns the [table] called name, or nil
+func (d *tomlDocument) table(name string) *tomlTable {
+	for _, table := range d.tables {
+		if !table.array && table.name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// entry returns the index of key in the table, or -1
+func (t *tomlTable) entry(key string) int {
+	for i, entry := range t.entries {
+		if entry.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// insert adds an entry after the last key/value of the table, before the
+// blank lines and comments that separate it from the next table
+func (t *tomlTable) insert(entry tomlEntry) {
+	at := len(t.entries)
+	for at > 0 && t.entries[at-1].key == "" {
+		at--
+	}
+	t.entries = append(t.entries[:at], append([]tomlEntry{entry}, t.entries[at:]...)...)
+}
+
+// String renders the document
+func (d *tomlDocument) String() string {
+	var sb strings.Builder
+	for i, table := range d.tables {
+		if i > 0 {
+			if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n\n") {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(table.header + "\n")
+		}
+		for _, entry := range table.entries {
+			sb.WriteString(entry.text + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// mergeBuildkitdConfig merges settings generated by Kimia into buildkitd.toml
+func mergeBuildkitdConfig(content, settings string) (string, error) {
+	doc, err := parseTOMLDocument(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse buildkitd.toml: %v", err)
+	}
+	fragment, err := parseTOMLDocument(settings)
+	if err != nil {
+		return "", err
+	}
+	doc.merge(fragment)
+	return doc.String(), nil
+}
+
+// mergeBuildkitdFragments merges the --buildkitd-config-fragment files, in
+// order, into the generated buildkitd.toml
+func mergeBuildkitdFragments(content string, fragments []string) (string, error) {
+	doc, err := parseTOMLDocument(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse buildkitd.toml: %v", err)
+	}
+	for _, path := range fragments {
+		// #nosec G304 -- fragment files given by the user with --buildkitd-config-fragment
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read buildkitd config fragment: %v", err)
+		}
+		fragment, err := parseTOMLDocument(string(data))
+		if err != nil {
+			return "", fmt.Errorf("invalid buildkitd config fragment %s: %v", path, err)
+		}
+		doc.merge(fragment)
+	}
+	return doc.String(), nil
+}
@@ -0,0 +1,262 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// generatedConfig is a buildkitd.toml as Kimia writes it for an insecure
+// registry and a registry with a client certificate
+const generatedConfig = `[worker.oci]
+  enabled = true
+  rootless = true
+
+[registry."registry.local:5000"]
+  http = true
+  insecure = true
+
+[registry."secure.io"]
+  ca = ["/certs/ca.crt"]
+
+[[registry."secure.io".keypair]]
+  key = "/certs/client.key"
+  cert = "/certs/client.crt"
+`
+
+func TestMergeBuildkitdConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		settings string
+		want     string
+	}{
+		{
+			name:     "new root key",
+			content:  generatedConfig,
+			settings: "insecure-entitlements = [\"network.host\"]\n",
+			want: `insecure-entitlements = ["network.host"]
+
+[worker.oci]
+  enabled = true
+  rootless = true
+
+[registry."registry.local:5000"]
+  http = true
+  insecure = true
+
+[registry."secure.io"]
+  ca = ["/certs/ca.crt"]
+
+[[registry."secure.io".keypair]]
+  key = "/certs/client.key"
+  cert = "/certs/client.crt"
+`,
+		},
+		{
+			name:     "new table",
+			content:  "[worker.oci]\n  enabled = true\n",
+			settings: "[dns]\n  nameservers = [\"10.0.0.10\"]\n",
+			want:     "[worker.oci]\n  enabled = true\n\n[dns]\n  nameservers = [\"10.0.0.10\"]\n",
+		},
+		{
+			name:     "registry table gains a key before the blank line",
+			content:  generatedConfig,
+			settings: "[registry.\"registry.local:5000\"]\n  mirrors = [\"mirror.local\"]\n",
+			want: `[worker.oci]
+  enabled = true
+  rootless = true
+
+[registry."registry.local:5000"]
+  http = true
+  insecure = true
+  mirrors = ["mirror.local"]
+
+[registry."secure.io"]
+  ca = ["/certs/ca.crt"]
+
+[[registry."secure.io".keypair]]
+  key = "/certs/client.key"
+  cert = "/certs/client.crt"
+`,
+		},
+		{
+			name:     "duplicate key replaces the generated value in place",
+			content:  generatedConfig,
+			settings: "[registry.\"registry.local:5000\"]\n  insecure = false\n",
+			want: `[worker.oci]
+  enabled = true
+  rootless = true
+
+[registry."registry.local:5000"]
+  http = true
+  insecure = false
+
+[registry."secure.io"]
+  ca = ["/certs/ca.crt"]
+
+[[registry."secure.io".keypair]]
+  key = "/certs/client.key"
+  cert = "/certs/client.crt"
+`,
+		},
+		{
+			name:     "table names match across whitespace",
+			content:  "[ registry . \"docker.io\" ]\n  mirrors = [\"a.io\"]\n",
+			settings: "[registry.\"docker.io\"]\n  mirrors = [\"b.io\"]\n",
+			want:     "[ registry . \"docker.io\" ]\n  mirrors = [\"b.io\"]\n",
+		},
+		{
+			name:     "last of duplicate keys in the settings wins",
+			content:  "[dns]\n  nameservers = [\"1.1.1.1\"]\n",
+			settings: "[dns]\n  nameservers = [\"8.8.8.8\"]\n  nameservers = [\"10.0.0.10\"]\n",
+			want:     "[dns]\n  nameservers = [\"10.0.0.10\"]\n",
+		},
+		{
+			name:     "multi-line value is replaced whole",
+			content:  "[dns]\n  nameservers = [\n    \"1.1.1.1\",\n    \"8.8.8.8\",\n  ]\n  searchDomains = [\"svc\"]\n",
+			settings: "[dns]\n  nameservers = [\"10.0.0.10\"]\n",
+			want:     "[dns]\n  nameservers = [\"10.0.0.10\"]\n  searchDomains = [\"svc\"]\n",
+		},
+		{
+			name:     "array tables replace all tables of that name",
+			content:  generatedConfig,
+			settings: "[[registry.\"secure.io\".keypair]]\n  key = \"/other/client.key\"\n  cert = \"/other/client.crt\"\n",
+			want: `[worker.oci]
+  enabled = true
+  rootless = true
+
+[registry."registry.local:5000"]
+  http = true
+  insecure = true
+
+[registry."secure.io"]
+  ca = ["/certs/ca.crt"]
+
+[[registry."secure.io".keypair]]
+  key = "/other/client.key"
+  cert = "/other/client.crt"
+`,
+		},
+		{
+			name:     "comments of the document are kept",
+			content:  "# managed by ops\n[worker.oci]\n  # keep rootless\n  rootless = true\n",
+			settings: "[worker.oci]\n  rootless = false # overridden\n",
+			want:     "# managed by ops\n\n[worker.oci]\n  # keep rootless\n  rootless = false # overridden\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeBuildkitdConfig(tt.content, tt.settings)
+			if err != nil {
+				t.Fatalf("mergeBuildkitdConfig() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("mergeBuildkitdConfig() =\n%s\nwant\n%s", got, tt.want)
+			}
+			again, err := mergeBuildkitdConfig(got, tt.settings)
+			if err != nil {
+				t.Fatalf("mergeBuildkitdConfig() again error = %v", err)
+			}
+			if again != got {
+				t.Errorf("merging the settings again changed the config:\n%s", again)
+			}
+		})
+	}
+}
+
+func TestMergeBuildkitdConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		settings string
+		want     string
+	}{
+		{
+			name:     "unterminated header",
+			content:  "[worker.oci\n",
+			settings: "[dns]\n",
+			want:     "failed to parse buildkitd.toml: line 1: unterminated table header",
+		},
+		{
+			name:     "empty header",
+			content:  "[]\n",
+			settings: "[dns]\n",
+			want:     "empty table header",
+		},
+		{
+			name:     "unterminated array",
+			content:  generatedConfig,
+			settings: "[dns]\n  nameservers = [\"10.0.0.10\",\n",
+			want:     "line 2: unterminated value of nameservers",
+		},
+		{
+			name:     "line without a key",
+			content:  generatedConfig,
+			settings: "[dns]\n  = 1\n",
+			want:     "line 2: expected key = value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mergeBuildkitdConfig(tt.content, tt.settings)
+			if err == nil {
+				t.Fatalf("mergeBuildkitdConfig() succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("mergeBuildkitdConfig() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeBuildkitdFragments(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.toml")
+	second := filepath.Join(dir, "second.toml")
+	invalid := filepath.Join(dir, "invalid.toml")
+	files := map[string]string{
+		first:   "[registry.\"registry.local:5000\"]\n  insecure = false\n  mirrors = [\"mirror.local\"]\n",
+		second:  "[registry.\"registry.local:5000\"]\n  mirrors = [\"mirror2.local\"]\n",
+		invalid: "[registry.\"registry.local:5000\"\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := mergeBuildkitdFragments(generatedConfig, []string{first, second})
+	if err != nil {
+		t.Fatalf("mergeBuildkitdFragments() error = %v", err)
+	}
+	want := `[worker.oci]
+  enabled = true
+  rootless = true
+
+[registry."registry.local:5000"]
+  http = true
+  insecure = false
+  mirrors = ["mirror2.local"]
+
+[registry."secure.io"]
+  ca = ["/certs/ca.crt"]
+
+[[registry."secure.io".keypair]]
+  key = "/certs/client.key"
+  cert = "/certs/client.crt"
+`
+	if got != want {
+		t.Errorf("mergeBuildkitdFragments() =\n%s\nwant\n%s", got, want)
+	}
+
+	if _, err := mergeBuildkitdFragments(generatedConfig, []string{first, invalid}); err == nil || !strings.Contains(err.Error(), "invalid buildkitd config fragment "+invalid) {
+		t.Errorf("mergeBuildkitdFragments() error = %v, want the invalid fragment named", err)
+	}
+	if _, err := mergeBuildkitdFragments(generatedConfig, []string{filepath.Join(dir, "missing.toml")}); err == nil || !strings.Contains(err.Error(), "failed to read buildkitd config fragment") {
+		t.Errorf("mergeBuildkitdFragments() error = %v, want a read error", err)
+	}
+}
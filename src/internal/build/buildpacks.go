@@ -0,0 +1,277 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// DefaultLifecycleDir is where Cloud Native Buildpacks builder images install
+// the lifecycle; Kimia runs in such an image to build with --builder=buildpacks
+const DefaultLifecycleDir = "/cnb/lifecycle"
+
+// buildpacksPlatformAPI is the Platform API Kimia speaks to the lifecycle
+// unless CNB_PLATFORM_API is set
+const buildpacksPlatformAPI = "0.12"
+
+// LifecycleCreator returns the lifecycle's creator, which runs every phase of
+// a buildpacks build: `creator` in PATH, else the one of the builder image.
+// It returns "" when there is none.
+func LifecycleCreator() string {
+	if path, err := exec.LookPath("creator"); err == nil {
+		return path
+	}
+	path := filepath.Join(DefaultLifecycleDir, "creator")
+	if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+		return path
+	}
+	return ""
+}
+
+// executeBuildpacks builds the context with the buildpacks of the builder
+// image, which detect the language of the sources instead of a Dockerfile.
+// The lifecycle pushes the image; Kimia then verifies, signs and records it
+// like a BuildKit build.
+func executeBuildpacks(config Config, ctx *Context) error {
+	digestMap, descriptor, err := runBuildpacks(config, ctx)
+	if err != nil || config.DryRun {
+		return err
+	}
+	return publishPushedImages(config, digestMap, descriptor)
+}
+
+// runBuildpacks runs the lifecycle creator and returns the digest of each
+// destination and the descriptor of the pushed manifest
+func runBuildpacks(config Config, ctx *Context) (map[string]string, auth.Descriptor, error) {
+	logger.Info("Starting buildpacks build...")
+	creator := LifecycleCreator()
+	if creator == "" {
+		return nil, auth.Descriptor{}, fmt.Errorf("no buildpacks lifecycle found (expected creator in PATH or %s)", DefaultLifecycleDir)
+	}
+	if ctx.Path == "" {
+		return nil, auth.Descriptor{}, fmt.Errorf("buildpacks builds need a local context")
+	}
+	if len(config.Destination) == 0 {
+		return nil, auth.Descriptor{}, fmt.Errorf("buildpacks builds push the image and need a --destination")
+	}
+	if strings.Contains(config.CustomPlatform, ",") {
+		return nil, auth.Descriptor{}, fmt.Errorf("building several platforms (%s) requires the BuildKit backend", config.CustomPlatform)
+	}
+	if config.CustomPlatform != "" && normalizePlatform(config.CustomPlatform) != normalizePlatform(NodePlatform()) {
+		logger.Warning("--platform %s is ignored by buildpacks, which build for the platform of the builder image", config.CustomPlatform)
+	}
+	if len(config.Labels) > 0 {
+		logger.Info("Labels are not applied to buildpacks images (%d --label values); buildpacks set their own", len(config.Labels))
+	}
+
+	workDir, err := newTempDir("", "kimia-buildpacks-")
+	if err != nil {
+		return nil, auth.Descriptor{}, fmt.Errorf("failed to create buildpacks directory: %v", err)
+	}
+	defer removeTemp(workDir)
+	appDir := filepath.Join(workDir, "workspace")
+	layersDir := filepath.Join(workDir, "layers")
+	platformDir := filepath.Join(workDir, "platform")
+	reportFile := filepath.Join(workDir, "report.toml")
+	for _, dir := range []string{appDir, layersDir, filepath.Join(platformDir, "env")} {
+		// #nosec G301 -- buildpacks run as the build user and write here
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, auth.Descriptor{}, fmt.Errorf("failed to create buildpacks directory: %v", err)
+		}
+	}
+
+	// Build args are the platform environment of the buildpacks (BP_*, BPE_* ...)
+	if err := writeBuildpacksEnv(platformDir, config.BuildArgs); err != nil {
+		return nil, auth.Descriptor{}, err
+	}
+
+	// Buildpacks write into the application directory, so they get a private copy
+	if config.DryRun {
+		logger.Info("Dry run: context %s would be copied to the buildpacks workspace", ctx.Path)
+	} else {
+		filter := newContextSyncFilter(ctx.Path, "", config.IgnoreFile)
+		stats, err := syncContextDir(ctx.Path, appDir, filter, config.NormalizeContext, true)
+		if err != nil {
+			return nil, auth.Descriptor{}, fmt.Errorf("failed to copy context: %v", err)
+		}
+		logger.Info("Context copy: %d files (%s), %d paths ignored", stats.Files, formatBytes(stats.TotalBytes), stats.Ignored)
+		logNormalizedContext(config.NormalizeContext)
+	}
+
+	args := buildpacksArgs(config, appDir, layersDir, platformDir, reportFile)
+
+	buildCtx, cancelBuild := phaseContext(config.BuildTimeout)
+	defer cancelBuild()
+	cmd := commandContext(buildCtx, creator, args...)
+	var outputBuf bytes.Buffer
+	beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "build", "")
+	defer beat.stop()
+	stdout, stderr := logger.NewRedactWriter(os.Stdout), logger.NewRedactWriter(os.Stderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	cmd.Stdout = io.MultiWriter(stdout, &outputBuf, beat)
+	cmd.Stderr = io.MultiWriter(stderr, &outputBuf, beat)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("DOCKER_CONFIG=%s", auth.GetDockerConfigDir()))
+	if os.Getenv("CNB_PLATFORM_API") == "" {
+		cmd.Env = append(cmd.Env, "CNB_PLATFORM_API="+buildpacksPlatformAPI)
+	}
+	// The lifecycle dates images at 1980-01-01 unless SOURCE_DATE_EPOCH is set
+	if config.Reproducible && config.Timestamp != "" {
+		cmd.Env = append(cmd.Env, "SOURCE_DATE_EPOCH="+config.Timestamp)
+	}
+
+	if config.DryRun {
+		printDryRunCommand("lifecycle creator command", kimiaEnv(cmd.Env, os.Environ()), creator, args)
+		return nil, auth.Descriptor{}, nil
+	}
+
+	logger.Info("Executing: %s %s", creator, strings.Join(sanitizeCommandArgs(args), " "))
+	oom := startOOMWatch()
+	started := time.Now()
+	err = cmd.Run()
+	reportBuildTiming(config, newBuildTiming("buildpacks", time.Since(started), err == nil, nil))
+	if err != nil && buildCtx.Err() == nil {
+		if oomErr := oom.check(err, outputBuf.String(), nil); oomErr != nil {
+			return nil, auth.Descriptor{}, fmt.Errorf("buildpacks build failed: %v", oomErr)
+		}
+	}
+	if err := timeoutError(buildCtx, err, "buildpacks build", "--build-timeout", config.BuildTimeout); err != nil {
+		return nil, auth.Descriptor{}, fmt.Errorf("buildpacks build failed: %w", err)
+	}
+	logger.Info("Build completed successfully")
+
+	descriptor, err := readBuildpacksReport(reportFile)
+	if err != nil {
+		if config.VerifyPush {
+			return nil, auth.Descriptor{}, fmt.Errorf("push verification failed: %v", err)
+		}
+		logger.Warning("Could not determine the image digest: %v", err)
+	}
+	digestMap := make(map[string]string)
+	if descriptor.Digest != "" {
+		for _, dest := range config.Destination {
+			digestMap[dest] = descriptor.Digest
+		}
+	}
+	return digestMap, descriptor, nil
+}
+
+// buildpacksArgs returns the arguments of the lifecycle creator
+func buildpacksArgs(config Config, appDir, layersDir, platformDir, reportFile string) []string {
+	args := []string{
+		"-app=" + appDir,
+		"-layers=" + layersDir,
+		"-platform=" + platformDir,
+		"-report=" + reportFile,
+	}
+	if config.RunImage != "" {
+		args = append(args, "-run-image="+config.RunImage)
+	}
+
+	// Layers of the previous image are reused unless the build must not use
+	// a cache; the cache of build-time layers lives in --cache-dir or --cache-repo
+	if config.Cache && !config.Reproducible {
+		switch {
+		case config.CacheDir != "":
+			args = append(args, "-cache-dir="+filepath.Join(config.CacheDir, "buildpacks"))
+		case config.CacheRepo != "":
+			args = append(args, "-cache-image="+config.CacheRepo)
+		}
+	} else {
+		args = append(args, "-skip-restore")
+	}
+
+	var insecure []string
+	for _, dest := range config.Destination {
+		if config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry) {
+			insecure = append(insecure, auth.ExtractRegistry(dest))
+		}
+	}
+	insecure = append(insecure, config.InsecureRegistry...)
+	sort.Strings(insecure)
+	for i, registry := range insecure {
+		if i == 0 || registry != insecure[i-1] {
+			args = append(args, "-insecure-registry="+registry)
+		}
+	}
+
+	// The first destination is the image, the others are extra tags
+	sortedDests := append([]string{}, config.Destination...)
+	sort.Strings(sortedDests)
+	for _, dest := range sortedDests[1:] {
+		args = append(args, "-tag="+dest)
+	}
+	return append(args, sortedDests[0])
+}
+
+// writeBuildpacksEnv writes each build arg as a file of the platform
+// environment directory, where buildpacks read their configuration
+func writeBuildpacksEnv(platformDir string, buildArgs map[string]string) error {
+	for name, value := range buildArgs {
+		if name == "" || strings.ContainsAny(name, "/\\\x00") || name == "." || name == ".." {
+			return fmt.Errorf("invalid build arg name %q for buildpacks", name)
+		}
+		path := filepath.Join(platformDir, "env", name)
+		// #nosec G306 -- read by the buildpacks running as the build user
+		if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("failed to write buildpacks environment: %v", err)
+		}
+	}
+	return nil
+}
+
+// readBuildpacksReport reads the digest and manifest size of the pushed image
+// from the report.toml the lifecycle writes:
+//
+//	[image]
+//	  tags = ["registry.io/app:1.0"]
+//	  digest = "sha256:..."
+//	  manifest-size = 1234
+func readBuildpacksReport(path string) (auth.Descriptor, error) {
+	var descriptor auth.Descriptor
+	// #nosec G304 -- report written by the lifecycle in Kimia's temporary directory
+	file, err := os.Open(path)
+	if err != nil {
+		return descriptor, fmt.Errorf("failed to read the lifecycle report: %v", err)
+	}
+	defer file.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[] ")
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != "image" {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "digest":
+			descriptor.Digest = value
+		case "manifest-size":
+			descriptor.Size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return descriptor, fmt.Errorf("failed to read the lifecycle report: %v", err)
+	}
+	if !strings.HasPrefix(descriptor.Digest, "sha256:") {
+		return descriptor, fmt.Errorf("no image digest in the lifecycle report")
+	}
+	return descriptor, nil
+}
@@ -0,0 +1,121 @@
+package build
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// systemCABundles are the usual locations of the system trust store
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // RHEL
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/ssl/cert.pem",                                 // Alpine, macOS
+}
+
+// InstallCABundle makes the CA certificates in path trusted by every
+// component of the build. The certificates are appended to the system trust
+// store in a combined bundle that SSL_CERT_FILE points Buildah, buildkitd,
+// cosign and ctr at and GIT_SSL_CAINFO points git at, and Kimia's own
+// registry clients trust them directly. The returned function removes the
+// combined bundle.
+func InstallCABundle(path string) (func(), error) {
+	// #nosec G304 -- CA bundle given by the user with --ca-bundle
+	custom, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --ca-bundle: %v", err)
+	}
+	count, err := countCertificates(custom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --ca-bundle %s: %v", path, err)
+	}
+
+	system, systemPath := readSystemCABundle()
+	if systemPath == "" {
+		logger.Warning("No system CA bundle found; only the --ca-bundle certificates are trusted")
+	}
+	combined := append(append(system, '\n'), custom...)
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(combined) {
+		return nil, fmt.Errorf("invalid --ca-bundle %s: no usable certificates", path)
+	}
+
+	file, err := newTempFile("", "kimia-ca-*.pem")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write CA bundle: %v", err)
+	}
+	_, err = file.Write(combined)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeTemp(file.Name())
+		return nil, fmt.Errorf("failed to write CA bundle: %v", err)
+	}
+
+	for _, name := range []string{"SSL_CERT_FILE", "GIT_SSL_CAINFO"} {
+		if err := os.Setenv(name, file.Name()); err != nil {
+			removeTemp(file.Name())
+			return nil, fmt.Errorf("failed to set %s: %v", name, err)
+		}
+	}
+	auth.SetRootCAs(pool)
+
+	if systemPath != "" {
+		logger.Info("Trusting %d CA certificates from %s in addition to %s", count, path, systemPath)
+	} else {
+		logger.Info("Trusting %d CA certificates from %s", count, path)
+	}
+	return func() { removeTemp(file.Name()) }, nil
+}
+
+// userCertFile is SSL_CERT_FILE as set before InstallCABundle replaced it
+var userCertFile = os.Getenv("SSL_CERT_FILE")
+
+// readSystemCABundle returns the system trust store and where it was read
+// from, honoring an SSL_CERT_FILE set before Kimia started
+func readSystemCABundle() ([]byte, string) {
+	candidates := systemCABundles
+	if userCertFile != "" {
+		candidates = append([]string{userCertFile}, candidates...)
+	}
+	for _, candidate := range candidates {
+		// #nosec G304 -- well-known trust store locations or the user's SSL_CERT_FILE
+		if data, err := os.ReadFile(candidate); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			return bytes.TrimRight(data, "\n"), candidate
+		}
+	}
+	return nil, ""
+}
+
+// countCertificates returns the number of certificates in a PEM bundle and
+// fails on blocks that are not parseable certificates
+func countCertificates(data []byte) (int, error) {
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return count, fmt.Errorf("unexpected PEM block %q (only certificates are allowed)", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return count, fmt.Errorf("certificate %d: %v", count+1, err)
+		}
+		count++
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no PEM certificates found")
+	}
+	return count, nil
+}
@@ -0,0 +1,131 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/validation"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// cacheRepoTag is the tag BuildKit stores --cache-repo cache manifests under.
+// Buildah tags its cache images by cache key within the repository instead.
+const cacheRepoTag = "buildcache"
+
+// buildahVersionRegex matches the output of "buildah --version"
+var buildahVersionRegex = regexp.MustCompile(`version (\d+)\.(\d+)`)
+
+// cacheSpecs returns the import/export cache specs with --cache-import-dir and
+// --cache-export-dir translated to BuildKit type=local caches and --cache-inline
+// to a type=inline export
+func cacheSpecs(config Config) ([]string, []string, error) {
+	importCache := config.ImportCache
+	exportCache := config.ExportCache
+
+	if config.CacheImportDir != "" {
+		if err := validation.ValidateCachePath(config.CacheImportDir); err != nil {
+			return nil, nil, fmt.Errorf("invalid --cache-import-dir: %v", err)
+		}
+		dir := filepath.Clean(config.CacheImportDir)
+		// The first job has nothing to import; BuildKit fails on an empty directory
+		if _, err := os.Stat(filepath.Join(dir, "index.json")); err != nil {
+			logger.Info("No local cache found in %s, building without cache import", dir)
+		} else {
+			importCache = append(append([]string{}, importCache...), "type=local,src="+dir)
+			logger.Info("Importing build cache from %s", dir)
+		}
+	}
+
+	if config.CacheExportDir != "" {
+		if err := validation.ValidateCachePath(config.CacheExportDir); err != nil {
+			return nil, nil, fmt.Errorf("invalid --cache-export-dir: %v", err)
+		}
+		dir := filepath.Clean(config.CacheExportDir)
+		// #nosec G301 -- 0755 for cache directory (layer blobs, no credentials)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, fmt.Errorf("failed to create cache export directory: %v", err)
+		}
+		// mode=max also exports intermediate stages so multi-stage builds hit the cache
+		exportCache = append(append([]string{}, exportCache...), "type=local,dest="+dir+",mode=max")
+		logger.Info("Exporting build cache to %s", dir)
+	}
+
+	// --cache-repo stores the cache as a registry cache manifest next to the image
+	if config.CacheRepo != "" && config.Cache {
+		ref := config.CacheRepo + ":" + cacheRepoTag
+		importCache = append(append([]string{}, importCache...), "type=registry,ref="+ref)
+		exportCache = append(append([]string{}, exportCache...), "type=registry,ref="+ref+",mode=max")
+		logger.Info("Using registry cache %s", ref)
+	}
+
+	if config.CacheInline && !hasCacheType(exportCache, "inline") {
+		// Inline cache only records the final stage's layers (mode=min)
+		exportCache = append(append([]string{}, exportCache...), "type=inline")
+		logger.Info("Embedding build cache metadata in the image (inline cache)")
+		if config.NoPush && config.TarPath == "" {
+			logger.Warning("--cache-inline has no effect with --no-push; the cache is stored in the pushed image")
+		}
+	}
+
+	return importCache, exportCache, nil
+}
+
+// hasCacheType reports whether specs already contain a cache of the given type
+func hasCacheType(specs []string, cacheType string) bool {
+	for _, spec := range specs {
+		for _, field := range strings.Split(spec, ",") {
+			if strings.TrimSpace(field) == "type="+cacheType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateCacheRepo checks that --cache-repo names a repository without a tag
+// or digest, as both builders derive the cache tags themselves
+func validateCacheRepo(repo string) error {
+	if err := validation.ValidateImageName(repo); err != nil {
+		return fmt.Errorf("invalid --cache-repo: %v", err)
+	}
+	if strings.Contains(repo, "@") || strings.Contains(repo[strings.LastIndex(repo, "/")+1:], ":") {
+		return fmt.Errorf("invalid --cache-repo %q: must be a repository without tag or digest", repo)
+	}
+	return nil
+}
+
+// buildahCacheRepoArgs returns the buildah bud flags that push layers to and
+// pull layers from --cache-repo. These require Buildah 1.30 or later.
+func buildahCacheRepoArgs(config Config) ([]string, error) {
+	if config.CacheRepo == "" {
+		return nil, nil
+	}
+	if !config.Cache || config.Reproducible {
+		return nil, nil
+	}
+
+	if config.BuildahRemote != "" {
+		logger.Info("Using registry cache %s", config.CacheRepo)
+		return []string{"--cache-from", config.CacheRepo, "--cache-to", config.CacheRepo}, nil
+	}
+
+	// #nosec G204 -- fixed command and arguments
+	output, err := exec.Command("buildah", "--version").Output()
+	if m := buildahVersionRegex.FindStringSubmatch(string(output)); err == nil && m != nil {
+		major, _ := strconv.Atoi(m[1])
+		minor, _ := strconv.Atoi(m[2])
+		if major < 1 || major == 1 && minor < 30 {
+			return nil, fmt.Errorf("--cache-repo requires Buildah 1.30 or later for --cache-to/--cache-from (found %s.%s)", m[1], m[2])
+		}
+	} else {
+		logger.Warning("Could not determine Buildah version; assuming --cache-to/--cache-from are supported")
+	}
+
+	logger.Info("Using registry cache %s", config.CacheRepo)
+	return []string{"--cache-from", config.CacheRepo, "--cache-to", config.CacheRepo}, nil
+}
@@ -0,0 +1,150 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultChainContext is the name under which a chained build finds the
+// primary image (FROM primary) unless --chain sets name=
+const DefaultChainContext = "primary"
+
+// chainLayoutStoreID names the OCI layout of the primary image in buildctl's
+// --oci-layout and the oci-layout:// named context that refers to it
+const chainLayoutStoreID = "kimia-chain"
+
+// ChainBuild is a second Dockerfile built after the primary build, with the
+// primary image as a named build context
+// (--chain dockerfile=Dockerfile.test,target=test). Its image is not pushed;
+// a failing chained build stops the primary image from being pushed.
+type ChainBuild struct {
+	Dockerfile string // Relative to the build context
+	Target     string
+	Name       string // Build context name of the primary image
+
+	TestCmd []string // The --test-cmd a generated Dockerfile runs (see NewTestChain)
+}
+
+// ChainSource is the primary image as a chained build sees it: BuildKit reads
+// it from the OCI layout the primary build exported, Buildah from its own
+// storage
+type ChainSource struct {
+	Name   string
+	Layout string // OCI layout directory (BuildKit)
+	Digest string // Digest of the image in Layout
+	Image  string // Reference in the local storage (Buildah)
+}
+
+// ParseChainBuild parses a --chain value of the form
+// dockerfile=FILE[,target=STAGE][,name=NAME]
+func ParseChainBuild(spec string) (ChainBuild, error) {
+	chain := ChainBuild{Name: DefaultChainContext}
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return chain, fmt.Errorf("invalid --chain %q (expected dockerfile=FILE[,target=STAGE][,name=NAME])", spec)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "dockerfile":
+			chain.Dockerfile = value
+		case "target":
+			chain.Target = value
+		case "name":
+			chain.Name = value
+		default:
+			return chain, fmt.Errorf("invalid --chain %q: unknown key %q (expected dockerfile, target and name)", spec, kv[0])
+		}
+	}
+	if chain.Dockerfile == "" {
+		return chain, fmt.Errorf("invalid --chain %q: dockerfile= is required", spec)
+	}
+	if chain.Name == "" || strings.ContainsAny(chain.Name, " =,") {
+		return chain, fmt.Errorf("invalid --chain %q: invalid context name %q", spec, chain.Name)
+	}
+	return chain, nil
+}
+
+// ResolveChainDockerfile returns the Dockerfile of a chained build as an
+// absolute path, so that the builders find it the way they find a
+// --dockerfile outside the context. Git contexts BuildKit clones itself keep
+// the path relative to the repository.
+func (ctx *Context) ResolveChainDockerfile(dockerfile string) (string, error) {
+	if ctx.Path == "" {
+		return dockerfile, nil
+	}
+	path := dockerfile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.Path, path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("chained Dockerfile %s not found", dockerfile)
+	}
+	return path, nil
+}
+
+// NewChainSource returns the primary image of a build for the chained builds.
+// layout is the directory BuildKit exported it to (Config.ChainLayout);
+// Buildah's builds find it in storage under the first destination.
+func NewChainSource(name, layout string, destinations []string, dryRun bool) (*ChainSource, error) {
+	source := &ChainSource{Name: name}
+	if layout == "" {
+		if len(destinations) == 0 {
+			return nil, fmt.Errorf("the primary image has no destination to refer to it by")
+		}
+		source.Image = destinations[0]
+		return source, nil
+	}
+	source.Layout = layout
+	if dryRun {
+		// Nothing was exported; the printed command shows where the digest goes
+		source.Digest = "sha256:" + strings.Repeat("0", 64)
+		return source, nil
+	}
+	// #nosec G304 -- OCI layout kimia exported
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the primary image: %v", err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid OCI layout of the primary image: %v", err)
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("OCI layout of the primary image holds %d images, expected 1", len(index.Manifests))
+	}
+	source.Digest = index.Manifests[0].Digest
+	return source, nil
+}
+
+// NewChainLayout creates the directory BuildKit exports the primary image to
+func NewChainLayout() (string, func(), error) {
+	dir, err := newTempDir("", "kimia-chain-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create the chained build layout: %v", err)
+	}
+	// #nosec G104 -- best-effort cleanup
+	return dir, func() { removeTemp(dir) }, nil
+}
+
+// buildkitChainArgs makes the primary image available to a chained BuildKit
+// build as a named context
+func buildkitChainArgs(source *ChainSource) []string {
+	return []string{
+		"--oci-layout", chainLayoutStoreID + "=" + source.Layout,
+		"--opt", fmt.Sprintf("context:%s=oci-layout://%s@%s", source.Name, chainLayoutStoreID, source.Digest),
+	}
+}
+
+// buildahChainArgs makes the primary image available to a chained Buildah
+// build as a named context
+func buildahChainArgs(source *ChainSource) []string {
+	return []string{"--build-context", fmt.Sprintf("%s=container-image://%s", source.Name, source.Image)}
+}
@@ -0,0 +1,133 @@
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Layer compression of pushed images (--compression)
+const (
+	CompressionAuto    = "auto"    // zstd where every registry accepts it, gzip otherwise (opt-in)
+	CompressionGzip    = "gzip"    // The default, readable by every runtime
+	CompressionZstd    = "zstd"    // Faster to push and pull; needs containerd 1.5+ or Docker 23+
+	CompressionEstargz = "estargz" // gzip that lazy-pulling snapshotters can read on demand (BuildKit)
+)
+
+// Compressions lists the valid --compression values
+var Compressions = []string{CompressionAuto, CompressionGzip, CompressionZstd, CompressionEstargz}
+
+// compressionLevels is the range of --compression-level of each algorithm
+var compressionLevels = map[string][2]int{
+	CompressionGzip:    {1, 9},
+	CompressionZstd:    {1, 22},
+	CompressionEstargz: {1, 9},
+}
+
+// zstdRegistries are the registries known to accept zstd-compressed layers.
+// With --compression=auto, other registries, including self-hosted ones, get
+// gzip.
+var zstdRegistries = []func(string) bool{
+	func(r string) bool { return r == "docker.io" || r == "ghcr.io" },
+	func(r string) bool { return strings.HasSuffix(r, ".azurecr.io") },
+	auth.IsECRRegistry,
+	auth.IsGARRegistry,
+}
+
+// ValidateCompressionLevel checks --compression-level against the range of
+// the algorithm, which has to be chosen explicitly (0 = the builder default)
+func ValidateCompressionLevel(compression string, level int) error {
+	if level == 0 {
+		return nil
+	}
+	levels, ok := compressionLevels[compression]
+	if !ok {
+		return fmt.Errorf("--compression-level needs --compression=%s, %s or %s", CompressionGzip, CompressionZstd, CompressionEstargz)
+	}
+	if level < levels[0] || level > levels[1] {
+		return fmt.Errorf("--compression-level %d is out of range for %s (%d-%d)", level, compression, levels[0], levels[1])
+	}
+	return nil
+}
+
+// registryAcceptsZstd reports whether the registry of dest is known to accept
+// zstd-compressed layers
+func registryAcceptsZstd(dest string) bool {
+	registry := auth.NormalizeRegistryURL(auth.ExtractRegistry(dest))
+	for _, accepts := range zstdRegistries {
+		if accepts(registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveCompression returns the compression of the layers pushed to
+// destinations, which include the final destinations of a staged image.
+// Without --compression the layers keep gzip; auto picks zstd when every
+// registry is known to accept it and gzip otherwise, since all of them
+// receive the same layers.
+func ResolveCompression(compression string, destinations []string) string {
+	if compression != CompressionAuto {
+		return compression
+	}
+	if len(destinations) == 0 {
+		return CompressionGzip
+	}
+	for _, dest := range destinations {
+		if !registryAcceptsZstd(dest) {
+			logger.Debug("Compression: gzip (%s is not known to accept zstd layers)", auth.ExtractRegistry(dest))
+			return CompressionGzip
+		}
+	}
+	logger.Info("Compression: zstd (all registries accept zstd layers; use --compression=gzip for runtimes older than containerd 1.5 or Docker 23)")
+	return CompressionZstd
+}
+
+// compressionChanged reports whether the layers are compressed differently
+// from the builders' default gzip
+func compressionChanged(compression string, level int) bool {
+	return (compression != "" && compression != CompressionAuto && compression != CompressionGzip) || level > 0
+}
+
+// buildkitCompressionOpts returns the options of a BuildKit image or OCI
+// exporter for the compression, or "" for the default. Layers of the base
+// image are recompressed too, so that the whole image uses it; BuildKit keeps
+// the recompressed blobs for later builds.
+func buildkitCompressionOpts(compression string, level int) string {
+	if !compressionChanged(compression, level) {
+		return ""
+	}
+	if compression == "" || compression == CompressionAuto {
+		compression = CompressionGzip
+	}
+	opts := ",compression=" + compression
+	if level > 0 {
+		opts += ",compression-level=" + strconv.Itoa(level)
+	}
+	opts += ",force-compression=true"
+	if compression != CompressionGzip {
+		// zstd and estargz layers are only defined for OCI images
+		opts += ",oci-mediatypes=true"
+	}
+	return opts
+}
+
+// buildahCompressionArgs returns the buildah push flags for the compression,
+// or nil for the default
+func buildahCompressionArgs(compression string, level int) []string {
+	if !compressionChanged(compression, level) {
+		return nil
+	}
+	var args []string
+	if compression != "" && compression != CompressionAuto {
+		args = append(args, "--compression-format", compression)
+	}
+	if level > 0 {
+		args = append(args, "--compression-level", strconv.Itoa(level))
+	}
+	return args
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/rapidfort/kimia/internal/validation"
@@ -19,25 +21,42 @@ type Context struct {
 	GitURL     string    // Original Git URL (for BuildKit)
 	SubContext string    // Subdirectory within context
 	GitConfig  GitConfig // Git configuration for URL formatting
+
+	dockerfileDir    string // Copy of a Dockerfile outside the context, or inline one (see ResolveDockerfile)
+	dockerfileSource string // --dockerfile of that Dockerfile, InlineDockerfile for inline content
 }
 
-// Cleanup removes temporary directories created for Git repositories
+// Cleanup removes temporary directories created for Git repositories and
+// Dockerfiles outside the context
 func (ctx *Context) Cleanup() {
-	if ctx.TempDir != "" {
-		logger.Debug("Cleaning up temporary directory: %s", ctx.TempDir)
-		if err := os.RemoveAll(ctx.TempDir); err != nil {
-			logger.Warning("Failed to cleanup temporary directory %s: %v", ctx.TempDir, err)
+	for _, dir := range []string{ctx.TempDir, ctx.dockerfileDir} {
+		if dir == "" {
+			continue
+		}
+		logger.Debug("Cleaning up temporary directory: %s", dir)
+		if err := removeTemp(dir); err != nil {
+			logger.Warning("Failed to cleanup temporary directory %s: %v", dir, err)
 		}
 	}
 }
 
 // GitConfig holds Git-specific configuration
 type GitConfig struct {
-	Context   string
-	Branch    string
-	Revision  string
-	TokenFile string
-	TokenUser string
+	Context     string
+	Branch      string
+	Revision    string
+	TokenFile   string
+	TokenUser   string
+	Depth       int      // History depth to fetch (0: default)
+	Filter      string   // Partial clone filter, e.g. blob:none
+	SparsePaths []string // Directories to check out (cone mode); empty checks out everything
+	SSHKeyFile  string   // Deploy key for ssh:// and git@ URLs
+}
+
+// needsLocalClone reports whether the clone options require a local clone.
+// BuildKit's Git source fetches the full tree of a commit and cannot filter it.
+func (g GitConfig) needsLocalClone() bool {
+	return g.Filter != "" || len(g.SparsePaths) > 0
 }
 
 // Prepare prepares the build context from either a Git repository or local directory
@@ -53,11 +72,18 @@ func Prepare(gitConfig GitConfig, builder string) (*Context, error) {
 	if isGitURL(gitConfig.Context) {
 		logger.Info("Detected git repository context: %s", logger.SanitizeGitURL(gitConfig.Context))
 
+		// Docker/Kaniko-style fragment (repo.git#ref:subdir) sets the ref and sub-path
+		gitConfig, ctx.SubContext = applyGitFragment(gitConfig)
+		ctx.GitConfig.Branch, ctx.GitConfig.Revision = gitConfig.Branch, gitConfig.Revision
+
 		// Normalize git:// URLs to https:// for known providers (GitHub, GitLab, etc)
-		normalizedURL := normalizeGitURL(gitConfig.Context)
+		// SSH URLs are kept when a deploy key is given
+		preferSSH := os.Getenv("KIMIA_PREFER_SSH") == "true" || gitConfig.SSHKeyFile != ""
+		normalizedURL := normalizeGitURL(gitConfig.Context, preferSSH)
 		
-		// For BuildKit, pass Git URL directly without cloning (for better SBOM generation)
-		if builder == "buildkit" {
+		// For BuildKit, pass Git URL directly without cloning (for better SBOM generation),
+		// unless only part of the repository should be fetched
+		if builder == "buildkit" && !gitConfig.needsLocalClone() {
 			logger.Info("Using BuildKit native Git support (no local clone)")
 			ctx.IsGitRepo = true
 			ctx.GitURL = normalizedURL  // Use normalized URL
@@ -69,7 +95,11 @@ func Prepare(gitConfig GitConfig, builder string) (*Context, error) {
 		}
 		
 		// For Buildah, clone the repository locally (existing behavior)
-		logger.Info("Cloning repository for Buildah...")
+		if builder == "buildkit" {
+			logger.Info("Cloning repository locally for a filtered or sparse checkout...")
+		} else {
+			logger.Info("Cloning repository for Buildah...")
+		}
 
 		// Create directory in $HOME/workspace for git clone
 		homeDir := os.Getenv("HOME")
@@ -106,31 +136,39 @@ func Prepare(gitConfig GitConfig, builder string) (*Context, error) {
 		}
 
 		// Create temporary directory for git clone inside workspace
-		tempDir, err := os.MkdirTemp(workspaceDir, "kimia-build-*")
+		tempDir, err := newTempDir(workspaceDir, "kimia-build-*")
 		if err != nil {
 			return nil, fmt.Errorf("failed to create temp directory: %v", err)
 		}
 
 		// Validate that tempDir is actually within workspaceDir
-		// This is a defense-in-depth check since os.MkdirTemp should always create within workspaceDir
+		// This is a defense-in-depth check since newTempDir (os.MkdirTemp) should always create within workspaceDir
 		tempDir = filepath.Clean(tempDir)
 		relPath, err := filepath.Rel(workspaceDir, tempDir)
 		if err != nil || strings.HasPrefix(relPath, "..") {
 			// If we can't compute relative path or it escapes, something is very wrong
 			// Clean up the temp dir and fail
-			// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir from os.MkdirTemp
-			os.RemoveAll(tempDir) // Safe to ignore error here since we're already in error path
+			// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir from newTempDir
+			removeTemp(tempDir) // Safe to ignore error here since we're already in error path
 			return nil, fmt.Errorf("temp directory validation failed: directory not within workspace")
 		}
 
 		ctx.TempDir = tempDir
 		ctx.IsGitRepo = true
 
-		// Clone the repository (use normalized URL from line 51)
-		normalizedURL = normalizeGitURL(gitConfig.Context)
-		if err := cloneGitRepo(normalizedURL, tempDir, gitConfig); err != nil {
+		// Credentials for the remote: a token (in the URL or a header) or an SSH deploy key
+		cloneURL, gitEnv, cleanupAuth, err := gitRemoteAuth(normalizedURL, gitConfig)
+		if err != nil {
+			// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir validated above
+			removeTemp(tempDir)
+			return nil, err
+		}
+		defer cleanupAuth()
+
+		// Clone the repository
+		if err := cloneGitRepo(cloneURL, tempDir, gitConfig, gitEnv); err != nil {
 			// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir validated above
-			os.RemoveAll(tempDir)
+			removeTemp(tempDir)
 			return nil, fmt.Errorf("failed to clone repository: %v", err)
 		}
 
@@ -140,19 +178,26 @@ func Prepare(gitConfig GitConfig, builder string) (*Context, error) {
 		if gitConfig.Revision != "" {
 			logger.Info("Checking out revision: %s", gitConfig.Revision)
 			
+			// A shallow clone may not contain the revision yet
+			if gitConfig.Depth > 0 {
+				if err := fetchGitRevision(tempDir, gitConfig.Revision, gitConfig.Depth, gitEnv); err != nil {
+					logger.Debug("Fetching revision %s failed (will attempt checkout anyway): %v", gitConfig.Revision, err)
+				}
+			}
+
 			// Try to checkout the revision
-			if err := checkoutGitRevision(tempDir, gitConfig.Revision); err != nil {
+			if err := checkoutGitRevision(tempDir, gitConfig.Revision, gitEnv); err != nil {
 				// Revision doesn't exist, fall back to branch if specified
 				if gitConfig.Branch != "" {
 					logger.Warning("Revision %s not found, falling back to branch %s", gitConfig.Revision, gitConfig.Branch)
-					if err := checkoutGitBranch(tempDir, gitConfig.Branch); err != nil {
+					if err := checkoutGitBranch(tempDir, gitConfig.Branch, gitEnv); err != nil {
 						// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir validated above
-						os.RemoveAll(tempDir)
+						removeTemp(tempDir)
 						return nil, fmt.Errorf("failed to checkout branch %s: %v", gitConfig.Branch, err)
 					}
 				} else {
 					// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir validated above
-					os.RemoveAll(tempDir)
+					removeTemp(tempDir)
 					return nil, fmt.Errorf("failed to checkout revision %s: %v", gitConfig.Revision, err)
 				}
 			} else {
@@ -169,9 +214,9 @@ func Prepare(gitConfig GitConfig, builder string) (*Context, error) {
 		} else if gitConfig.Branch != "" {
 			// No revision specified, just checkout the branch
 			logger.Info("Checking out branch: %s", gitConfig.Branch)
-			if err := checkoutGitBranch(tempDir, gitConfig.Branch); err != nil {
+			if err := checkoutGitBranch(tempDir, gitConfig.Branch, gitEnv); err != nil {
 				// #nosec G104,G703 -- Ignoring cleanup error in error path; tempDir validated above
-				os.RemoveAll(tempDir)
+				removeTemp(tempDir)
 				return nil, fmt.Errorf("failed to checkout branch %s: %v", gitConfig.Branch, err)
 			}
 		}
@@ -192,10 +237,62 @@ func Prepare(gitConfig GitConfig, builder string) (*Context, error) {
 	return ctx, nil
 }
 
+// gitFullSHAPattern matches a full SHA-1 or SHA-256 commit ID
+var gitFullSHAPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// parseGitFragment splits a Git URL with a Docker-style fragment
+// (repo.git#ref:subdir, #ref or #:subdir) or a Kaniko-style one
+// (repo.git#refs/heads/branch#commit) into the URL and its parts
+func parseGitFragment(url string) (base, ref, commit, subdir string) {
+	base, fragment, found := strings.Cut(url, "#")
+	if !found {
+		return url, "", "", ""
+	}
+	fragment, commit, _ = strings.Cut(fragment, "#")
+	ref, subdir, _ = strings.Cut(fragment, ":")
+	return base, ref, commit, strings.Trim(subdir, "/")
+}
+
+// applyGitFragment moves the fragment of gitConfig.Context into Branch and
+// Revision and returns the subdirectory it names. Full commit IDs are revisions,
+// refs/heads/ and refs/tags/ are stripped, anything else is a branch or tag.
+// --git-branch and --git-revision take precedence over the fragment.
+func applyGitFragment(gitConfig GitConfig) (GitConfig, string) {
+	base, ref, commit, subdir := parseGitFragment(gitConfig.Context)
+	if base == gitConfig.Context {
+		return gitConfig, ""
+	}
+	gitConfig.Context = base
+
+	branch, revision := "", commit
+	if gitFullSHAPattern.MatchString(ref) {
+		revision = ref
+	} else {
+		branch = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	}
+	if branch != "" {
+		if gitConfig.Branch != "" && gitConfig.Branch != branch {
+			logger.Warning("Ignoring ref %s in the context URL, --git-branch=%s takes precedence", branch, gitConfig.Branch)
+		} else {
+			gitConfig.Branch = branch
+		}
+	}
+	if revision != "" {
+		if gitConfig.Revision != "" && gitConfig.Revision != revision {
+			logger.Warning("Ignoring commit %s in the context URL, --git-revision=%s takes precedence", revision, gitConfig.Revision)
+		} else {
+			gitConfig.Revision = revision
+		}
+	}
+	logger.Debug("Context URL fragment: branch=%q revision=%q subdir=%q", branch, revision, subdir)
+	return gitConfig, subdir
+}
+
 // isGitURL checks if a URL appears to be a Git repository
 func isGitURL(url string) bool {
 	return strings.HasPrefix(url, "git://") ||
 		strings.HasPrefix(url, "git@") ||
+		strings.HasPrefix(url, "ssh://") ||
 		strings.HasPrefix(url, "https://github.com/") ||
 		strings.HasPrefix(url, "https://gitlab.com/") ||
 		strings.HasPrefix(url, "https://bitbucket.org/") ||
@@ -206,11 +303,9 @@ func isGitURL(url string) bool {
 
 // normalizeGitURL converts deprecated git:// URLs and git@ SSH URLs to https:// for known providers
 // GitHub, GitLab, and Bitbucket have all disabled the insecure git:// protocol
-// For automation/CI, HTTPS is preferred over SSH (no key management, no prompts)
-func normalizeGitURL(url string) string {
-	// Check if user wants to force SSH (skip normalization for git@)
-	preferSSH := os.Getenv("KIMIA_PREFER_SSH") == "true"
-	
+// For automation/CI, HTTPS is preferred over SSH (no key management, no prompts);
+// preferSSH keeps git@ URLs, e.g. when a deploy key is given
+func normalizeGitURL(url string, preferSSH bool) string {
 	// Convert git:// to https://
 	if strings.HasPrefix(url, "git://") {
 		knownProviders := []string{
@@ -260,7 +355,7 @@ func normalizeGitURL(url string) string {
 		}
 	}
 	
-	if strings.HasPrefix(url, "git@") && preferSSH {
+	if strings.HasPrefix(url, "git@") && preferSSH && os.Getenv("KIMIA_PREFER_SSH") == "true" {
 		logger.Info("Using SSH URL as requested (KIMIA_PREFER_SSH=true)")
 		logger.Info("Ensure SSH agent is running with keys loaded for non-interactive operation")
 	}
@@ -269,7 +364,8 @@ func normalizeGitURL(url string) string {
 }
 
 // cloneGitRepo clones a Git repository to the target directory
-func cloneGitRepo(url, targetDir string, gitConfig GitConfig) error {
+// env carries the credentials from gitRemoteAuth, nil for the default environment
+func cloneGitRepo(url, targetDir string, gitConfig GitConfig, env []string) error {
 	logger.Info("Cloning git repository...")
 
 	// Validate git branch name if provided
@@ -286,29 +382,52 @@ func cloneGitRepo(url, targetDir string, gitConfig GitConfig) error {
 		}
 	}
 
-	// Prepare git clone command
-	args := []string{"clone"}
-
-	// Add authentication if token is provided
-	if gitConfig.TokenFile != "" {
-		token, err := os.ReadFile(gitConfig.TokenFile)
+	if gitConfig.Depth < 0 {
+		return fmt.Errorf("invalid git depth: %d", gitConfig.Depth)
+	}
+	if gitConfig.Filter != "" {
+		if err := validateGitFilter(gitConfig.Filter); err != nil {
+			return err
+		}
+	}
+	sparsePaths := make([]string, 0, len(gitConfig.SparsePaths))
+	for _, path := range gitConfig.SparsePaths {
+		clean, err := cleanSparsePath(path)
 		if err != nil {
-			return fmt.Errorf("failed to read git token file: %v", err)
+			return err
 		}
+		sparsePaths = append(sparsePaths, clean)
+	}
 
-		// Modify URL to include token
-		url = addGitToken(url, string(token), gitConfig.TokenUser)
+	// Prepare git clone command
+	args := []string{"clone"}
+
+	// Partial clone: blobs (or trees) are fetched only when checked out
+	if gitConfig.Filter != "" {
+		args = append(args, "--filter="+gitConfig.Filter)
+	}
+	// Check out only top-level files until the sparse paths are set
+	if len(sparsePaths) > 0 {
+		args = append(args, "--sparse")
 	}
 
 	// If revision is specified, we need to clone without --single-branch
 	// to ensure the revision is available even if it's on a different branch
-	if gitConfig.Revision != "" {
+	if gitConfig.Revision != "" && gitConfig.Depth > 0 {
+		// The revision is fetched by itself after the clone
+		args = append(args, "--depth", strconv.Itoa(gitConfig.Depth))
+	} else if gitConfig.Revision != "" {
 		// Clone without depth/single-branch restrictions to get all refs
 		// This ensures the revision can be found regardless of which branch it's on
 		logger.Debug("Cloning full repository to access revision %s", gitConfig.Revision)
 	} else if gitConfig.Branch != "" {
 		// Only restrict to single branch if no revision is specified
 		args = append(args, "--branch", gitConfig.Branch, "--single-branch")
+		if gitConfig.Depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(gitConfig.Depth))
+		}
+	} else if gitConfig.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(gitConfig.Depth))
 	} else {
 		// Add depth 1 for faster cloning if no specific revision or branch is needed
 		args = append(args, "--depth", "1")
@@ -323,6 +442,7 @@ func cloneGitRepo(url, targetDir string, gitConfig GitConfig) error {
 
 	// #nosec G204,G702 -- args validated by validateGitOperation, refs by validateGitRef
 	cmd := exec.Command("git", args...)
+	cmd.Env = env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -330,13 +450,81 @@ func cloneGitRepo(url, targetDir string, gitConfig GitConfig) error {
 		return fmt.Errorf("git clone failed: %v", err)
 	}
 
+	if len(sparsePaths) > 0 {
+		if err := setSparseCheckout(targetDir, sparsePaths, env); err != nil {
+			return err
+		}
+	}
+
 	logger.Info("Repository cloned successfully")
 	return nil
 }
 
-// addGitToken adds authentication token to a Git URL
+// gitFilterPattern matches the partial clone filters accepted by --git-filter
+var gitFilterPattern = regexp.MustCompile(`^(blob:none|blob:limit=[0-9]+[kmg]?|tree:[0-9]+)$`)
+
+// validateGitFilter checks a partial clone filter specification
+func validateGitFilter(filter string) error {
+	if !gitFilterPattern.MatchString(filter) {
+		return fmt.Errorf("invalid git filter %q (expected blob:none, blob:limit=<size> or tree:<depth>)", filter)
+	}
+	return nil
+}
+
+// cleanSparsePath validates a --git-sparse-path directory and returns it
+// relative to the repository root with forward slashes
+func cleanSparsePath(path string) (string, error) {
+	clean := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(path, "/")))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || strings.HasPrefix(clean, "-") {
+		return "", fmt.Errorf("invalid git sparse path %q: must be a directory inside the repository", path)
+	}
+	return clean, nil
+}
+
+// setSparseCheckout restricts the working tree of repoDir to paths (cone mode)
+func setSparseCheckout(repoDir string, paths []string, env []string) error {
+	logger.Info("Sparse checkout: %s", strings.Join(paths, ", "))
+
+	args := append([]string{"sparse-checkout", "set", "--cone"}, paths...)
+	if err := validateGitOperation(repoDir, args...); err != nil {
+		return fmt.Errorf("validation failed for git sparse-checkout: %v", err)
+	}
+
+	// #nosec G204 -- paths validated by cleanSparsePath and validateGitOperation
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoDir
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git sparse-checkout failed: %v", err)
+	}
+	return nil
+}
+
+// fetchGitRevision fetches a single revision into a shallow clone
+func fetchGitRevision(repoDir, revision string, depth int, env []string) error {
+	args := []string{"fetch", "--depth", strconv.Itoa(depth), "origin", revision}
+	if err := validateGitOperation(repoDir, args...); err != nil {
+		return fmt.Errorf("validation failed for git fetch: %v", err)
+	}
+
+	// #nosec G204 -- revision validated by validateGitOperation with validation.ValidateGitRef
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoDir
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// addGitToken adds authentication token to a Git URL. A user name already in
+// the URL (as in Azure DevOps and Bitbucket clone URLs) is kept unless user is set.
 func addGitToken(url, token, user string) string {
 	token = strings.TrimSpace(token)
+	if user == "" {
+		user = urlUser(url)
+	}
 	if user == "" {
 		user = "oauth2"
 	}
@@ -349,7 +537,10 @@ func addGitToken(url, token, user string) string {
 			remainder := parts[1]
 			
 			// Check for existing credentials
-			if strings.Contains(remainder, "@") {
+			if existing := urlUser(url); existing != "" {
+				// Only a user name: replace it with user:token
+				remainder = remainder[len(existing)+1:]
+			} else if strings.Contains(remainder, "@") {
 				// URL already has credentials, don't add more
 				logger.Debug("URL already contains credentials, not adding token")
 				return url
@@ -443,6 +634,8 @@ func isValidGitFlag(flag string) bool {
 		"--single-branch",    // Clone options
 		"--branch",           // Branch specification
 		"--depth",            // Shallow clone
+		"--sparse",           // Sparse clone
+		"--cone",             // Sparse checkout mode
 	}
 	
 	for _, safe := range safeFlags {
@@ -451,11 +644,16 @@ func isValidGitFlag(flag string) bool {
 		}
 	}
 	
+	// Partial clone filter, validated by validateGitFilter
+	if strings.HasPrefix(flag, "--filter=") {
+		return validateGitFilter(strings.TrimPrefix(flag, "--filter=")) == nil
+	}
+	
 	return false
 }
 
 // checkoutGitBranch checks out a specific Git branch
-func checkoutGitBranch(repoDir, branch string) error {
+func checkoutGitBranch(repoDir, branch string, env []string) error {
 	logger.Info("Checking out branch: %s", branch)
 
 	// Validate inputs before git fetch
@@ -467,6 +665,7 @@ func checkoutGitBranch(repoDir, branch string) error {
 	// #nosec G204 -- branch validated by validateGitOperation with validation.ValidateGitRef
 	fetchCmd := exec.Command("git", "fetch", "origin", branch)
 	fetchCmd.Dir = repoDir
+	fetchCmd.Env = env
 	fetchCmd.Stdout = os.Stdout
 	fetchCmd.Stderr = os.Stderr
 	if err := fetchCmd.Run(); err != nil {
@@ -482,6 +681,7 @@ func checkoutGitBranch(repoDir, branch string) error {
 	// #nosec G204 -- branch validated by validateGitOperation with validation.ValidateGitRef
 	cmd := exec.Command("git", "checkout", branch)
 	cmd.Dir = repoDir
+	cmd.Env = env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -497,6 +697,7 @@ func checkoutGitBranch(repoDir, branch string) error {
 		// #nosec G204 -- branch validated by validateGitOperation with validation.ValidateGitRef, flag validated by isValidGitFlag
 		cmd2 := exec.Command("git", "checkout", "-b", branch, "origin/"+branch)
 		cmd2.Dir = repoDir
+		cmd2.Env = env
 		cmd2.Stdout = os.Stdout
 		cmd2.Stderr = os.Stderr
 
@@ -509,7 +710,7 @@ func checkoutGitBranch(repoDir, branch string) error {
 	return nil
 }
 
-func checkoutGitRevision(repoDir, revision string) error {
+func checkoutGitRevision(repoDir, revision string, env []string) error {
 	logger.Info("Checking out revision: %s", revision)
 
 	// Validate inputs
@@ -520,6 +721,7 @@ func checkoutGitRevision(repoDir, revision string) error {
 	// #nosec G204 -- revision validated by validateGitOperation with validation.ValidateGitRef
 	cmd := exec.Command("git", "checkout", revision)
 	cmd.Dir = repoDir
+	cmd.Env = env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -534,16 +736,25 @@ func checkoutGitRevision(repoDir, revision string) error {
 // BuildKit Git URL format: git://host/repo.git#ref:subdir
 // Returns the formatted URL and whether authentication was applied
 func FormatGitURLForBuildKit(gitURL string, gitConfig GitConfig, subContext string) (string, error) {
-	url := gitURL
+	// A fragment still in the URL is merged with the options, which take precedence
+	gitConfig.Context = gitURL
+	gitConfig, fragmentSubdir := applyGitFragment(gitConfig)
+	if subContext == "" {
+		subContext = fragmentSubdir
+	}
+	url := gitConfig.Context
 	
-	// Add authentication token if provided
+	// Add authentication token if provided. A token that has to be sent as a
+	// header (Azure DevOps) is passed as a secret instead, see buildkitGitAuthArgs
 	if gitConfig.TokenFile != "" {
-		token, err := os.ReadFile(gitConfig.TokenFile)
+		authURL, header, err := gitTokenAuth(url, gitConfig)
 		if err != nil {
-			return "", fmt.Errorf("failed to read git token file: %v", err)
+			return "", err
+		}
+		if header == "" {
+			url = authURL
+			logger.Debug("Added authentication token to Git URL")
 		}
-		url = addGitToken(url, string(token), gitConfig.TokenUser)
-		logger.Debug("Added authentication token to Git URL")
 	}
 	
 	// BuildKit Git URL format: URL#<ref>:<subdir>
@@ -0,0 +1,148 @@
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteContextArchive writes the files of a local context to w as a gzipped
+// tar stream, leaving out what the ignore rules exclude, so that `kimia
+// client` sends only what the builder would see. Ownership is not kept; the
+// builder pod owns the files it extracts.
+func WriteContextArchive(w io.Writer, contextDir, dockerfilePath, ignoreFile string) (ContextSyncStats, error) {
+	var stats ContextSyncStats
+	filter := newContextSyncFilter(contextDir, dockerfilePath, ignoreFile)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contextDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if filter.skip(rel, info.IsDir()) {
+			stats.Ignored++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil // Sockets, devices and FIFOs are not build inputs
+		}
+
+		target := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink: %v", err)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return fmt.Errorf("cannot archive %s: %v", path, err)
+		}
+		header.Name = rel
+		header.Format = tar.FormatPAX
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to archive context: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		// #nosec G304 -- file within the build context
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.Copy(tw, file); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", path, err)
+		}
+		stats.Files++
+		stats.TotalBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := tw.Close(); err != nil {
+		return stats, err
+	}
+	return stats, gz.Close()
+}
+
+// ExtractContextArchive extracts a context written by WriteContextArchive
+// into dir. Only files, directories and symlinks are extracted, and no entry
+// may be written outside dir.
+func ExtractContextArchive(r io.Reader, dir string) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("invalid context archive: %v", err)
+	}
+	defer gz.Close()
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+	files := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, fmt.Errorf("invalid context archive: %v", err)
+		}
+		if !filepath.IsLocal(header.Name) {
+			return files, fmt.Errorf("invalid context archive: unsafe path %q", header.Name)
+		}
+		path := filepath.Join(dir, header.Name)
+		// Parents are checked too: a symlink in the archive must not redirect later entries
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil && !within(root, parent) {
+			return files, fmt.Errorf("invalid context archive: %q is below a symlink leaving the context", header.Name)
+		}
+		mode := header.FileInfo().Mode().Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// #nosec G301 -- modes of the user's own context
+			if err := os.MkdirAll(path, mode|0700); err != nil {
+				return files, err
+			}
+		case tar.TypeReg:
+			// #nosec G304 -- path checked with filepath.IsLocal
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode|0600)
+			if err != nil {
+				return files, err
+			}
+			// #nosec G110 -- the context of the user running the client
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return files, fmt.Errorf("failed to extract %s: %v", header.Name, err)
+			}
+			if err := file.Close(); err != nil {
+				return files, err
+			}
+			files++
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return files, err
+			}
+			continue
+		default:
+			return files, fmt.Errorf("invalid context archive: unsupported entry %s (type %c)", header.Name, header.Typeflag)
+		}
+		// #nosec G104 -- modification times are kept for the builder's cache checks
+		os.Chtimes(path, header.ModTime, header.ModTime)
+	}
+}
@@ -0,0 +1,231 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, which makes dst share src's extents
+// copy-on-write on filesystems that support it (btrfs, XFS, overlayfs on those)
+const ficlone = 0x40049409
+
+// maxContextCopyWorkers bounds how many context files are copied concurrently
+const maxContextCopyWorkers = 8
+
+// How a context file was placed in the synced directory
+const (
+	copiedReflink  = "reflink"
+	copiedHardlink = "hardlink"
+	copiedStream   = "copy"
+)
+
+// contextCopyJob is a regular file that must be (re)created in the synced context
+type contextCopyJob struct {
+	src, dst  string
+	info      os.FileInfo
+	normalize *ContextNormalization // Metadata given to dst instead of that of src; nil = keep it
+	writable  bool                  // dst may be modified, so it must not share the data of src
+}
+
+// copyContextFiles places every job in its destination using the cheapest
+// method available and returns how many files each method handled. Files are
+// processed concurrently because a large context is dominated by per-file latency.
+func copyContextFiles(jobs []contextCopyJob) (map[string]int, error) {
+	methods := make(map[string]int)
+	if len(jobs) == 0 {
+		return methods, nil
+	}
+
+	workers := runtime.NumCPU()
+	if workers > maxContextCopyWorkers {
+		workers = maxContextCopyWorkers
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	queue := make(chan contextCopyJob)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				method, err := placeContextFile(job)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				methods[method]++
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	return methods, firstErr
+}
+
+// placeContextFile creates job.dst with the content and metadata of job.src:
+// as a reflink when the filesystem supports it, else as a hardlink when both
+// are on the same filesystem, else as a streamed copy. Normalized and writable
+// files are never hardlinked, since changing them would change the source.
+func placeContextFile(job contextCopyJob) (string, error) {
+	// Never write through an existing file: it may be a hardlink to the source
+	if err := os.Remove(job.dst); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to replace %s: %v", job.dst, err)
+	}
+
+	method := copiedReflink
+	if err := reflinkFile(job.src, job.dst, job.info.Mode()); err != nil {
+		// #nosec G104 -- a partially created reflink target is replaced below
+		os.Remove(job.dst)
+		if job.normalize == nil && !job.writable {
+			if err := os.Link(job.src, job.dst); err == nil {
+				// A hardlink shares mode, ownership, times and xattrs with the source
+				return copiedHardlink, nil
+			}
+		}
+		method = copiedStream
+		if err := streamCopyFile(job.src, job.dst, job.info.Mode()); err != nil {
+			return method, err
+		}
+	}
+
+	// Extended attributes differ between runners too, and are left out
+	if job.normalize != nil {
+		if err := job.normalize.apply(job.dst, job.info); err != nil {
+			return method, fmt.Errorf("failed to normalize %s: %v", job.dst, err)
+		}
+		return method, nil
+	}
+
+	copyXattrs(job.src, job.dst)
+	copyOwnership(job.dst, job.info)
+	// #nosec G703 -- dst is within the synced context directory
+	if err := os.Chmod(job.dst, job.info.Mode()); err != nil {
+		return method, fmt.Errorf("failed to set mode: %v", err)
+	}
+	// BuildKit's context transfer (fsutil) uses modification times to detect changes
+	if err := os.Chtimes(job.dst, job.info.ModTime(), job.info.ModTime()); err != nil {
+		return method, fmt.Errorf("failed to set modification time: %v", err)
+	}
+	return method, nil
+}
+
+// reflinkFile creates dst as a copy-on-write clone of src
+func reflinkFile(src, dst string, mode os.FileMode) error {
+	// #nosec G304 -- src is a file within the user-specified build context
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// #nosec G302,G304 -- dst is within the synced context directory; mode mirrors the source
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0200)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// streamCopyFile copies src to dst without loading it into memory. io.Copy
+// between files uses copy_file_range, so the data stays in the kernel.
+func streamCopyFile(src, dst string, mode os.FileMode) error {
+	// #nosec G304 -- src is a file within the user-specified build context
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to read source: %v", err)
+	}
+	defer in.Close()
+
+	// #nosec G302,G304 -- dst is within the synced context directory; mode mirrors the source
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0200)
+	if err != nil {
+		return fmt.Errorf("failed to write destination: %v", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write destination: %v", err)
+	}
+	return nil
+}
+
+// copyOwnership gives path the owner of the source file. Rootless builds can
+// only keep their own files, so failures are ignored.
+func copyOwnership(path string, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || (int(stat.Uid) == os.Geteuid() && int(stat.Gid) == os.Getegid()) {
+		return
+	}
+	// #nosec G104 -- best effort; EPERM is expected without CAP_CHOWN
+	os.Lchown(path, int(stat.Uid), int(stat.Gid))
+}
+
+// copyXattrs copies the extended attributes of src to dst. Attributes the
+// destination filesystem or the current user cannot set are skipped.
+func copyXattrs(src, dst string) {
+	for name, value := range readXattrs(src) {
+		// #nosec G104 -- best effort, e.g. security.* needs privileges
+		syscall.Setxattr(dst, name, []byte(value), 0)
+	}
+}
+
+// readXattrs returns the extended attributes of path that the current user can read
+func readXattrs(path string) map[string]string {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+		vsize, err := syscall.Getxattr(path, name, nil)
+		if err != nil || vsize < 0 {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize > 0 {
+			if vsize, err = syscall.Getxattr(path, name, value); err != nil {
+				continue
+			}
+		}
+		attrs[name] = string(value[:vsize])
+	}
+	return attrs
+}
@@ -0,0 +1,166 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// ContextNormalization rewrites the metadata of the build context before the
+// builder sees it (--normalize-context). Builders hash the owner and mode of
+// copied files into their cache keys and keep modification times in the
+// layers, so the same sources checked out on different CI runners would
+// otherwise produce different cache keys and images.
+type ContextNormalization struct {
+	UID, GID int       // Owner of every file and directory
+	ModTime  time.Time // Later modification times are clamped to this one
+}
+
+// ParseContextOwner parses --context-chown: UID:GID, or UID for UID:UID
+func ParseContextOwner(spec string) (uid, gid int, err error) {
+	user, group, hasGroup := strings.Cut(spec, ":")
+	if !hasGroup {
+		group = user
+	}
+	uid, uidErr := strconv.Atoi(user)
+	gid, gidErr := strconv.Atoi(group)
+	if uidErr != nil || gidErr != nil || uid < 0 || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid --context-chown %q (expected numeric UID:GID such as 0:0)", spec)
+	}
+	return uid, gid, nil
+}
+
+// DefaultContextOwner returns the owner of normalized contexts without
+// --context-chown: root for builds running as root, else the build user,
+// which rootless builders map to root in their user namespace
+func DefaultContextOwner() (uid, gid int) {
+	return os.Geteuid(), os.Getegid()
+}
+
+// mode returns the normalized mode of a file or directory: 0755 for
+// directories and executables, 0644 for other files. Special bits are dropped.
+func (n *ContextNormalization) mode(info os.FileInfo) os.FileMode {
+	switch {
+	case info.IsDir():
+		return os.ModeDir | 0755
+	case info.Mode()&0111 != 0:
+		return 0755
+	}
+	return 0644
+}
+
+// modTime clamps a modification time to the normalized one
+func (n *ContextNormalization) modTime(t time.Time) time.Time {
+	if t.After(n.ModTime) {
+		return n.ModTime
+	}
+	return t
+}
+
+// chown gives path the normalized owner. Files kimia creates already belong to
+// the build user, so nothing is changed when that is the normalized owner.
+func (n *ContextNormalization) chown(path string) error {
+	if n.UID == os.Geteuid() && n.GID == os.Getegid() {
+		return nil
+	}
+	// #nosec G703 -- path is within the synced context directory
+	if err := os.Lchown(path, n.UID, n.GID); err != nil {
+		return fmt.Errorf("failed to set owner %d:%d: %v", n.UID, n.GID, err)
+	}
+	return nil
+}
+
+// apply gives a copied file or directory the normalized owner, mode and
+// modification time of its source
+func (n *ContextNormalization) apply(path string, info os.FileInfo) error {
+	if err := n.chown(path); err != nil {
+		return err
+	}
+	// #nosec G703 -- path is within the synced context directory
+	if err := os.Chmod(path, n.mode(info).Perm()); err != nil {
+		return fmt.Errorf("failed to set mode: %v", err)
+	}
+	mtime := n.modTime(info.ModTime())
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return fmt.Errorf("failed to set modification time: %v", err)
+	}
+	return nil
+}
+
+// unchanged reports whether an existing copy already matches the normalized source
+func (n *ContextNormalization) unchanged(existing, src os.FileInfo) bool {
+	return existing.Mode() == n.mode(src) && existing.Size() == src.Size() &&
+		existing.ModTime().Equal(n.modTime(src.ModTime()))
+}
+
+// normalizedContextDir returns the cache directory of a normalized sync of src.
+// Clamped modification times hide changes from BuildKit's incremental context
+// transfer, which compares sizes and times only, so every state of the source
+// gets a directory of its own instead of the one stableContextDir returns.
+func normalizedContextDir(cacheDir, src string, filter *contextSyncFilter, n *ContextNormalization) (string, error) {
+	src = filepath.Clean(src)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d:%d\x00%d\x00", src, n.UID, n.GID, n.ModTime.UnixNano())
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if filter.skip(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink: %v", err)
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%v\x00%d\x00%d\x00%s\x00", rel, info.Mode(), info.Size(), info.ModTime().UnixNano(), link)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan context: %v", err)
+	}
+	return filepath.Join(cacheDir, "context-"+hex.EncodeToString(h.Sum(nil))[:12]), nil
+}
+
+// normalizedContextCopy copies the context of a Buildah build to a temporary
+// directory with normalized metadata. The caller removes it with removeTemp.
+func normalizedContextCopy(config Config, contextDir, dockerfilePath string) (string, error) {
+	dir, err := newTempDir("", "kimia-context-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create normalized context: %v", err)
+	}
+	filter := newContextSyncFilter(contextDir, dockerfilePath, config.IgnoreFile)
+	stats, err := syncContextDir(contextDir, dir, filter, config.NormalizeContext, false)
+	if err != nil {
+		// #nosec G104 -- best-effort cleanup of a partial copy
+		removeTemp(dir)
+		return "", fmt.Errorf("failed to copy context: %v", err)
+	}
+	logger.Info("Context copy: %d files (%s), %d paths ignored", stats.Files, formatBytes(stats.TotalBytes), stats.Ignored)
+	logNormalizedContext(config.NormalizeContext)
+	return dir, nil
+}
+
+// logNormalizedContext reports the metadata a normalized context was given
+func logNormalizedContext(n *ContextNormalization) {
+	if n == nil {
+		return
+	}
+	logger.Info("Context normalized: owner %d:%d, modes 0644/0755, modification times clamped to %s",
+		n.UID, n.GID, n.ModTime.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,205 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxIgnoredListed bounds how many excluded paths --show-ignored prints
+const maxIgnoredListed = 100
+
+// maxLargestFiles is how many of the largest context files are reported when
+// the context exceeds --max-context-size
+const maxLargestFiles = 10
+
+// ContextEntry is a file, or a whole directory, in or left out of the build context
+type ContextEntry struct {
+	Path  string // Context-relative, slash-separated
+	Dir   bool
+	Files int
+	Bytes int64
+}
+
+// ContextReport is the effect of the ignore file on a local build context
+type ContextReport struct {
+	IgnoreFile    string // "" when no ignore file applies
+	IncludedFiles int
+	IncludedBytes int64
+	ExcludedFiles int
+	ExcludedBytes int64
+	Excluded      []ContextEntry
+	Largest       []ContextEntry // Largest included files, biggest first
+}
+
+// ResolveIgnoreFile makes an --ignore-file path absolute, relative to the
+// build context like --dockerfile, and checks that it is a readable file
+func ResolveIgnoreFile(contextPath, ignoreFile string) (string, error) {
+	if ignoreFile == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(ignoreFile) {
+		ignoreFile = filepath.Join(contextPath, ignoreFile)
+	}
+	info, err := os.Stat(ignoreFile)
+	if err != nil {
+		return "", fmt.Errorf("invalid --ignore-file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("invalid --ignore-file: %s is not a regular file", ignoreFile)
+	}
+	return ignoreFile, nil
+}
+
+// AnalyzeContext walks a local build context and reports which files the
+// applicable ignore file excludes. Excluded directories without "!"
+// exceptions are reported as a single entry.
+func AnalyzeContext(contextPath, dockerfile, ignoreFile string) (*ContextReport, error) {
+	dockerfilePath := dockerfile
+	if dockerfilePath == "" {
+		dockerfilePath = "Dockerfile"
+	}
+	if !filepath.IsAbs(dockerfilePath) {
+		dockerfilePath = filepath.Join(contextPath, dockerfilePath)
+	}
+
+	report := &ContextReport{IgnoreFile: ignoreFilePath(contextPath, dockerfilePath, ignoreFile)}
+	ignore := loadDockerIgnore(contextPath, dockerfilePath, ignoreFile)
+
+	err := filepath.Walk(contextPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.Debug("Skipping %s: %v", p, err)
+			return nil
+		}
+		rel, _ := filepath.Rel(contextPath, p)
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+
+		if info.IsDir() {
+			if !ignore.hasExceptions && ignore.excluded(rel) {
+				files, bytes := directorySize(p)
+				report.Excluded = append(report.Excluded, ContextEntry{Path: rel, Dir: true, Files: files, Bytes: bytes})
+				report.ExcludedFiles += files
+				report.ExcludedBytes += bytes
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		size := int64(0)
+		if info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		if ignore.excluded(rel) {
+			report.Excluded = append(report.Excluded, ContextEntry{Path: rel, Files: 1, Bytes: size})
+			report.ExcludedFiles++
+			report.ExcludedBytes += size
+		} else {
+			report.IncludedFiles++
+			report.IncludedBytes += size
+			report.addLargest(ContextEntry{Path: rel, Files: 1, Bytes: size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk build context: %v", err)
+	}
+	return report, nil
+}
+
+// addLargest keeps the maxLargestFiles biggest included files
+func (r *ContextReport) addLargest(entry ContextEntry) {
+	i := sort.Search(len(r.Largest), func(i int) bool { return r.Largest[i].Bytes < entry.Bytes })
+	if i >= maxLargestFiles {
+		return
+	}
+	r.Largest = append(r.Largest, ContextEntry{})
+	copy(r.Largest[i+1:], r.Largest[i:])
+	r.Largest[i] = entry
+	if len(r.Largest) > maxLargestFiles {
+		r.Largest = r.Largest[:maxLargestFiles]
+	}
+}
+
+// directorySize counts the files below dir and their total size
+func directorySize(dir string) (int, int64) {
+	files := 0
+	var bytes int64
+	// #nosec G104 -- best-effort count; unreadable entries are skipped
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		files++
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+// PrintIgnored prints the files excluded from a local build context and the
+// size of the context that is sent to the builder (--show-ignored)
+func PrintIgnored(report *ContextReport) {
+	logger.Info("")
+	if report.IgnoreFile == "" {
+		logger.Info("Build context: no ignore file found, nothing is excluded")
+	} else {
+		logger.Info("Build context ignore file: %s", report.IgnoreFile)
+	}
+
+	if len(report.Excluded) > 0 {
+		logger.Info("Excluded from the build context:")
+		for i, excluded := range report.Excluded {
+			if i == maxIgnoredListed {
+				logger.Info("  ... and %d more (use --verbosity=debug to list all)", len(report.Excluded)-maxIgnoredListed)
+				break
+			}
+			if excluded.Dir {
+				logger.Info("  %-56s %10s  (%d files)", truncate(excluded.Path+"/", 56), formatBytes(excluded.Bytes), excluded.Files)
+			} else {
+				logger.Info("  %-56s %10s", truncate(excluded.Path, 56), formatBytes(excluded.Bytes))
+			}
+		}
+		for _, excluded := range report.Excluded[min(len(report.Excluded), maxIgnoredListed):] {
+			logger.Debug("  %s (%s)", excluded.Path, formatBytes(excluded.Bytes))
+		}
+	}
+
+	logger.Info("Excluded: %d files, %s", report.ExcludedFiles, formatBytes(report.ExcludedBytes))
+	logger.Info("Final build context: %d files, %s", report.IncludedFiles, formatBytes(report.IncludedBytes))
+	logger.Info("")
+}
+
+// CheckContextSize fails when the context left after ignore rules is larger
+// than limit and warns when it is larger than warnAt (0 disables either check).
+// Both report the largest files, which are usually what belongs in the ignore file.
+func CheckContextSize(report *ContextReport, limit, warnAt int64) error {
+	switch {
+	case limit > 0 && report.IncludedBytes > limit:
+		printLargestFiles(report, logger.Error)
+		return fmt.Errorf("build context is %s (%d files), exceeding --max-context-size %s; exclude files with .dockerignore or --ignore-file",
+			formatBytes(report.IncludedBytes), report.IncludedFiles, formatBytes(limit))
+	case warnAt > 0 && report.IncludedBytes > warnAt:
+		logger.Warning("Build context is %s (%d files), exceeding --context-size-warning %s",
+			formatBytes(report.IncludedBytes), report.IncludedFiles, formatBytes(warnAt))
+		printLargestFiles(report, logger.Warning)
+	default:
+		logger.Debug("Build context size: %s (%d files)", formatBytes(report.IncludedBytes), report.IncludedFiles)
+	}
+	return nil
+}
+
+// printLargestFiles lists the largest context files at the given log level
+func printLargestFiles(report *ContextReport, logf func(string, ...interface{})) {
+	logf("Largest files in the build context:")
+	for _, entry := range report.Largest {
+		logf("  %-56s %10s", truncate(entry.Path, 56), formatBytes(entry.Bytes))
+	}
+}
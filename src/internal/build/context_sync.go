@@ -0,0 +1,297 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// ContextSyncStats summarises an incremental sync of the build context
+type ContextSyncStats struct {
+	Files       int
+	Copied      int
+	Unchanged   int
+	Removed     int
+	TotalBytes  int64
+	CopiedBytes int64
+	Ignored     int            // Files and whole directories excluded by the ignore file
+	Methods     map[string]int // Changed files per placement method (reflink, hardlink, copy)
+}
+
+// contextSyncFilter leaves files excluded by the ignore file out of the synced
+// context, since BuildKit would not send them anyway. The Dockerfile and ignore
+// files are always kept because BuildKit reads them from the synced directory.
+type contextSyncFilter struct {
+	ignore *dockerIgnore
+	keep   map[string]bool // Slash-separated context-relative paths
+}
+
+// newContextSyncFilter loads the ignore rules that apply to a build of contextDir
+func newContextSyncFilter(contextDir, dockerfilePath, ignoreFile string) *contextSyncFilter {
+	filter := &contextSyncFilter{
+		ignore: loadDockerIgnore(contextDir, dockerfilePath, ignoreFile),
+		keep:   map[string]bool{".dockerignore": true},
+	}
+	for _, p := range []string{dockerfilePath, dockerfilePath + ".dockerignore"} {
+		if rel, err := filepath.Rel(contextDir, p); err == nil && !strings.HasPrefix(rel, "..") {
+			filter.keep[filepath.ToSlash(rel)] = true
+		}
+	}
+	return filter
+}
+
+// skip reports whether a context-relative path is left out of the sync. A
+// directory is skipped as a whole only when no "!" exception or kept file can
+// re-include something below it.
+func (f *contextSyncFilter) skip(rel string, isDir bool) bool {
+	if f == nil || rel == "." || f.keep[rel] || !f.ignore.excluded(rel) {
+		return false
+	}
+	if !isDir {
+		return true
+	}
+	if f.ignore.hasExceptions {
+		return false
+	}
+	for kept := range f.keep {
+		if strings.HasPrefix(kept, rel+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// transferringContextRegex matches BuildKit plain progress lines such as
+// "#4 transferring context: 12.34MB 0.5s done"
+var transferringContextRegex = regexp.MustCompile(`transferring context: ([0-9.]+)([kMGT]?B)`)
+
+// stableContextDir returns a cache directory that is reused for every build of
+// the same source context, so BuildKit sees the same files with the same
+// metadata and only transfers what changed
+func stableContextDir(cacheDir, src string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(src)))
+	return filepath.Join(cacheDir, "context-"+hex.EncodeToString(sum[:])[:12])
+}
+
+// syncContextDir makes dst an exact copy of src, copying only files whose size,
+// mode or modification time changed and removing files that no longer exist.
+// Modification times are preserved because BuildKit's context transfer (fsutil)
+// uses them to decide which files to resend. Changed files are reflinked or
+// hardlinked when possible and otherwise copied concurrently (see copyContextFiles).
+// Paths the filter skips are not copied, and removed from dst if present.
+// With normalize, the copies get its owner, modes and clamped times instead
+// of those of the source, and are never hardlinked; nor are writable copies,
+// which the build may modify.
+func syncContextDir(src, dst string, filter *contextSyncFilter, normalize *ContextNormalization, writable bool) (ContextSyncStats, error) {
+	var stats ContextSyncStats
+
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+	if strings.Contains(src, "\x00") || strings.Contains(dst, "\x00") {
+		return stats, fmt.Errorf("context path contains null bytes - invalid path")
+	}
+
+	seen := make(map[string]bool)
+	var jobs []contextCopyJob
+	var dirs []string
+	var dirInfos []os.FileInfo
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if filter.skip(filepath.ToSlash(rel), info.IsDir()) {
+			stats.Ignored++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		seen[rel] = true
+		target := filepath.Join(dst, rel)
+
+		// A path that changed between file and directory is replaced
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() != info.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("failed to replace %s: %v", rel, err)
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			// #nosec G301,G703 -- mirrors the source directory mode; target is within dst
+			if err := os.MkdirAll(target, info.Mode().Perm()|0700); err != nil {
+				return fmt.Errorf("failed to create directory: %v", err)
+			}
+			if normalize != nil {
+				dirs, dirInfos = append(dirs, target), append(dirInfos, info)
+			}
+			return nil
+
+		case info.Mode()&os.ModeSymlink != 0:
+			stats.Files++
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink: %v", err)
+			}
+			if existing, err := os.Readlink(target); err == nil && existing == link {
+				stats.Unchanged++
+				return nil
+			}
+			// #nosec G104 -- target may not exist yet
+			os.RemoveAll(target)
+			if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("failed to create symlink: %v", err)
+			}
+			if normalize != nil {
+				if err := normalize.chown(target); err != nil {
+					return fmt.Errorf("%s: %v", rel, err)
+				}
+			} else {
+				copyOwnership(target, info)
+			}
+			stats.Copied++
+			return nil
+
+		case !info.Mode().IsRegular():
+			// Sockets, devices and FIFOs cannot be part of a build context
+			return nil
+		}
+
+		stats.Files++
+		stats.TotalBytes += info.Size()
+		if existing, err := os.Lstat(target); err == nil {
+			if normalize != nil && normalize.unchanged(existing, info) ||
+				normalize == nil && existing.Mode() == info.Mode() && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()) {
+				stats.Unchanged++
+				return nil
+			}
+		}
+
+		jobs = append(jobs, contextCopyJob{src: path, dst: target, info: info, normalize: normalize, writable: writable})
+		stats.Copied++
+		stats.CopiedBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to sync context: %v", err)
+	}
+
+	stats.Methods, err = copyContextFiles(jobs)
+	if err != nil {
+		return stats, fmt.Errorf("failed to sync context: %v", err)
+	}
+
+	// Remove files deleted from the source since the last build
+	var stale []string
+	// #nosec G104 -- walk errors only hide files that cannot be removed anyway
+	filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(dst, path)
+		if !seen[rel] {
+			stale = append(stale, path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	for _, path := range stale {
+		if err := os.RemoveAll(path); err != nil {
+			return stats, fmt.Errorf("failed to remove stale context file: %v", err)
+		}
+		stats.Removed++
+	}
+
+	// Directories last and deepest first, as placing their entries changed their times
+	if normalize != nil {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := normalize.apply(dirs[i], dirInfos[i]); err != nil {
+				return stats, fmt.Errorf("failed to normalize %s: %v", dirs[i], err)
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// parseContextTransferBytes returns the size of the last "transferring context"
+// progress line in BuildKit output
+func parseContextTransferBytes(output string) (int64, bool) {
+	matches := transferringContextRegex.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+	last := matches[len(matches)-1]
+	value, err := strconv.ParseFloat(last[1], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	// BuildKit uses decimal units (go-units HumanSize)
+	multiplier := map[string]float64{"B": 1, "kB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12}[last[2]]
+	return int64(value * multiplier), true
+}
+
+// logContextTransferStats reports how much of the build context BuildKit had to
+// resend; unchanged files are skipped by its incremental (fsutil) transfer.
+// filtered tells whether contextBytes already excludes ignored files.
+func logContextTransferStats(output string, contextBytes int64, filtered bool) {
+	transferred, ok := parseContextTransferBytes(output)
+	if !ok {
+		logger.Debug("No context transfer statistics in BuildKit output")
+		return
+	}
+
+	if contextBytes <= 0 {
+		logger.Info("Context transfer: %s sent to BuildKit", formatBytes(transferred))
+		return
+	}
+	if filtered {
+		logger.Info("Context transfer: %s sent to BuildKit for a %s context",
+			formatBytes(transferred), formatBytes(contextBytes))
+		return
+	}
+	logger.Info("Context transfer: %s sent to BuildKit for a %s context (before .dockerignore)",
+		formatBytes(transferred), formatBytes(contextBytes))
+}
+
+// contextSize returns the total size of regular files under dir
+func contextSize(dir string) int64 {
+	var total int64
+	// #nosec G104 -- best-effort statistics
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// formatBytes renders a byte count with decimal units, matching BuildKit output
+func formatBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(n)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
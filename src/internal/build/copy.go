@@ -0,0 +1,112 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// CopyConfig describes a registry-to-registry copy of an existing image
+type CopyConfig struct {
+	Source           string   // Image to copy, by tag or digest
+	Destinations     []string // References to copy it to
+	Insecure         bool
+	InsecureRegistry []string
+	Retry            int   // Attempts per destination (0 = 1)
+	Jobs             int   // Blobs copied at the same time (0 = defaultPushJobs)
+	ChunkSize        int64 // Upload blobs in chunks of this size (0 = one request)
+	SkipArtifacts    bool  // Do not copy signatures, attestations and referrers
+	Verify           bool  // Read the copies back (--verify-push)
+	DryRun           bool
+}
+
+// CopyImage copies an image, with every platform of an index, to each
+// destination without rebuilding it: blobs already present are skipped, blobs
+// in the same registry are mounted and only blobs on another registry are
+// transferred. The manifests are pushed unchanged, so every destination gets
+// the source digest, which is returned. Cosign signatures and attestations
+// and referrers are copied along with the image unless SkipArtifacts is set.
+func CopyImage(config CopyConfig) (string, error) {
+	insecure := config.Insecure || isInsecureRegistry(config.Source, config.InsecureRegistry)
+	src, _ := auth.NewRepository(config.Source, insecure)
+	digest, err := auth.ResolveImageDigest(config.Source, insecure)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", config.Source, err)
+	}
+	logger.Info("Copying %s/%s@%s", src.Host, src.Repository, digest)
+
+	if config.DryRun {
+		logger.Info("Dry run: would copy %s to %s", digest, strings.Join(config.Destinations, ", "))
+		return digest, nil
+	}
+
+	var artifacts []stagedArtifact
+	if !config.SkipArtifacts {
+		artifacts = stagedArtifacts(src, digest)
+	}
+	retries := config.Retry
+	if retries == 0 {
+		retries = 1
+	}
+
+	for _, dest := range config.Destinations {
+		dst, reference := auth.NewRepository(dest, config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry))
+		dst.ChunkSize = config.ChunkSize
+		var p *imageCopier
+		for i := 0; i < retries; i++ {
+			if i > 0 {
+				logger.Warning("Copy to %s failed: %v", dest, err)
+				logger.Info("Retrying copy (attempt %d/%d)...", i+1, retries)
+				time.Sleep(time.Second * time.Duration(i*2))
+			}
+			// Blobs copied by a failed attempt are found present by the next
+			p = &imageCopier{src: src, dst: dst, jobs: config.Jobs}
+			if err = p.copyImage(digest, reference, artifacts); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to copy to %s after %d attempts: %v", dest, retries, err)
+		}
+		logger.Info("Copied to %s (%d blobs mounted, %d copied, %d already present)", dest, p.mounted, p.copied, p.present)
+	}
+
+	if config.Verify {
+		copied := make([]PushedImage, len(config.Destinations))
+		for i, dest := range config.Destinations {
+			copied[i] = PushedImage{Destination: dest, Digest: digest}
+		}
+		insecure := func(dest string) bool {
+			return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+		}
+		platforms, err := sourcePlatforms(src, digest)
+		if err != nil {
+			return "", err
+		}
+		if err := VerifyPushedImages(copied, platforms, insecure); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// sourcePlatforms returns the platforms of an image index, which the copies
+// must have too, or nil for a single-platform image
+func sourcePlatforms(src *auth.Repository, digest string) ([]string, error) {
+	manifest, err := fetchVerifiedManifest(src, digest, 0)
+	if err != nil {
+		return nil, err
+	}
+	var platforms []string
+	for _, child := range manifest.Manifests {
+		// Attestations are stored as unknown/unknown manifests
+		if child.Annotations["vnd.docker.reference.type"] == "attestation-manifest" || child.Platform == nil || child.Platform.OS == "unknown" {
+			continue
+		}
+		platforms = append(platforms, formatPlatform(*child.Platform))
+	}
+	return platforms, nil
+}
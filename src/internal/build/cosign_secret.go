@@ -0,0 +1,79 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// DefaultCosignSecretPath is where the Kubernetes Secret with the signing key
+// is mounted. `cosign generate-key-pair k8s://NAMESPACE/NAME` creates such a
+// secret with cosign.key, cosign.pub and cosign.password.
+const DefaultCosignSecretPath = "/etc/cosign"
+
+// Files of a cosign key secret
+const (
+	cosignSecretKey      = "cosign.key"
+	cosignSecretPassword = "cosign.password"
+)
+
+// CosignSecretFiles returns the key and the password file of the secret
+// mounted at dir. The password is "" when the secret has none.
+func CosignSecretFiles(dir string) (key, password string) {
+	key = filepath.Join(dir, cosignSecretKey)
+	password = filepath.Join(dir, cosignSecretPassword)
+	if _, err := os.Stat(password); err != nil {
+		password = ""
+	}
+	return key, password
+}
+
+// CheckSecretFile checks that a mounted secret file can be read. A file every
+// user can read is restricted to its owner and group when the mount allows it.
+func CheckSecretFile(flag, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s: %s does not exist; mount the secret there or give the path with %s", flag, path, flag)
+		}
+		return fmt.Errorf("%s: %v", flag, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: %s is not a file", flag, path)
+	}
+	perm := info.Mode().Perm()
+
+	// #nosec G304 -- secret file given by the operator
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("%s: %s (mode %04o) is not readable by UID %d; set defaultMode: 0440 on the secret volume and a pod fsGroup, or run as the file's owner", flag, path, perm, os.Getuid())
+		}
+		return fmt.Errorf("%s: %v", flag, err)
+	}
+	file.Close()
+
+	if perm&0007 != 0 {
+		// Secret volumes are read-only; the files of other mounts can be fixed
+		if err := os.Chmod(path, perm&^0007); err == nil {
+			logger.Info("Restricted the permissions of %s to %04o", path, perm&^0007)
+		} else {
+			logger.Warning("%s is readable by every user (mode %04o); set defaultMode: 0440 on the secret volume", path, perm)
+		}
+	}
+	return nil
+}
+
+// readCosignPassword returns the password in a password file, without the
+// trailing newline
+func readCosignPassword(path string) (string, error) {
+	// #nosec G304 -- password file given by the operator
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cosign password file: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,193 @@
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// buildkitdHealthTimeout bounds the health check of an existing buildkitd
+const buildkitdHealthTimeout = 5 * time.Second
+
+// Files next to the buildkitd socket that coordinate a shared daemon (--reuse-daemon)
+const (
+	buildkitdLockName   = "buildkitd.lock"
+	buildkitdPIDName    = "buildkitd.pid"
+	buildkitdConfigName = "buildkitd.config-sha256"
+	buildkitdLogName    = "buildkitd.log"
+)
+
+// buildkitdHealthy reports whether a buildkitd answers on socket
+func buildkitdHealthy(socket string) bool {
+	if _, err := os.Stat(socket); err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), buildkitdHealthTimeout)
+	defer cancel()
+	// #nosec G204 -- socket validated and cleaned by the caller
+	return exec.CommandContext(ctx, "buildctl", "--addr=unix://"+socket, "debug", "info").Run() == nil
+}
+
+// DefaultBuildkitSocket returns the socket of the buildkitd Kimia starts, in
+// $XDG_RUNTIME_DIR as for the build
+func DefaultBuildkitSocket() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = "/tmp/run"
+	}
+	return filepath.Join(filepath.Clean(runtimeDir), "buildkitd.sock")
+}
+
+// CheckBuildkitd checks that the buildkitd at config.BuildkitAddr, or the one
+// Kimia starts when it is empty, answers within buildkitdHealthTimeout
+func CheckBuildkitd(config Config) error {
+	addr := config.BuildkitAddr
+	if addr == "" {
+		addr = "unix://" + DefaultBuildkitSocket()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), buildkitdHealthTimeout)
+	defer cancel()
+	args := append([]string{"--addr=" + addr}, buildctlGlobalArgs(config)...)
+	// #nosec G204 -- address and TLS paths given by the user, passed without a shell
+	output, err := exec.CommandContext(ctx, "buildctl", append(args, "debug", "info")...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("buildkitd at %s did not answer within %s", addr, buildkitdHealthTimeout)
+		}
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("buildkitd at %s: %v: %s", addr, err, message)
+		}
+		return fmt.Errorf("buildkitd at %s: %v", addr, err)
+	}
+	return nil
+}
+
+// daemonDigest returns the sha256 of what a shared buildkitd is started with:
+// the rootlesskit and buildkitd arguments (e.g. the network mode) and the
+// contents of the config file at configPath
+func daemonDigest(daemonCmd *exec.Cmd, configPath string) string {
+	hash := sha256.New()
+	for _, arg := range daemonCmd.Args {
+		hash.Write([]byte(arg))
+		hash.Write([]byte{0})
+	}
+	// #nosec G304 -- buildkitd config path validated by the caller
+	if data, err := os.ReadFile(configPath); err == nil {
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ensureSharedBuildkitd makes a buildkitd available on socket for this and
+// later kimia runs in the same pod (--reuse-daemon). A healthy daemon, from a
+// previous run or a sidecar, is reused; otherwise daemonCmd is started detached
+// so it outlives this process. A lock file serialises concurrent runs so only
+// one of them starts the daemon. A daemon started by kimia with other
+// arguments or another config is not reused: it may be running builds of
+// other runs, so this fails instead of restarting it.
+func ensureSharedBuildkitd(daemonCmd *exec.Cmd, socket, configPath string) error {
+	runtimeDir := filepath.Dir(socket)
+	// #nosec G301 -- XDG_RUNTIME_DIR of the build user
+	if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+		return fmt.Errorf("failed to create runtime directory: %v", err)
+	}
+
+	lockPath := filepath.Join(runtimeDir, buildkitdLockName)
+	// #nosec G304 -- lock file next to the validated socket
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open buildkitd lock file: %v", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock buildkitd lock file: %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	digestPath := filepath.Join(runtimeDir, buildkitdConfigName)
+	digest := daemonDigest(daemonCmd, configPath)
+	if buildkitdHealthy(socket) {
+		// #nosec G304 -- file next to the validated socket
+		if started, err := os.ReadFile(digestPath); err == nil && string(started) != digest {
+			return fmt.Errorf("the shared buildkitd at %s was started with a different configuration (e.g. another --insecure-registry, --registry-config or --network); "+
+				"stop it (PID in %s) or restart the pod to apply this one", socket, filepath.Join(runtimeDir, buildkitdPIDName))
+		}
+		logger.Info("Reusing running buildkitd at %s", socket)
+		return nil
+	}
+
+	logger.Info("No running buildkitd found, starting a shared daemon")
+	// #nosec G304 -- log file next to the validated socket
+	logFile, err := os.OpenFile(filepath.Join(runtimeDir, buildkitdLogName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open buildkitd log file: %v", err)
+	}
+	defer logFile.Close()
+
+	// A new session keeps the daemon alive after this kimia process exits
+	daemonCmd.Stdout = logFile
+	daemonCmd.Stderr = logFile
+	daemonCmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := startBuildkitd(daemonCmd, socket); err != nil {
+		if daemonCmd.Process != nil {
+			// #nosec G104 -- the daemon failed to start; it may already be dead
+			daemonCmd.Process.Kill()
+		}
+		return err
+	}
+
+	pid := daemonCmd.Process.Pid
+	// #nosec G104 -- the pid and config digest files are informational
+	os.WriteFile(filepath.Join(runtimeDir, buildkitdPIDName), []byte(strconv.Itoa(pid)+"\n"), 0600)
+	// #nosec G104
+	os.WriteFile(digestPath, []byte(digest), 0600)
+	// #nosec G104 -- the daemon is intentionally not waited for
+	daemonCmd.Process.Release()
+
+	logger.Info("Started shared buildkitd (PID: %d, log: %s)", pid, logFile.Name())
+	return nil
+}
+
+// StopSharedBuildkitd stops the shared buildkitd if it was started at or after
+// since, i.e. by this process rather than by an earlier --reuse-daemon run.
+// kimia batch uses it so builds share a daemon without leaving it running.
+func StopSharedBuildkitd(since time.Time) {
+	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if xdgRuntimeDir == "" {
+		xdgRuntimeDir = "/tmp/run"
+	}
+	pidPath := filepath.Join(filepath.Clean(xdgRuntimeDir), buildkitdPIDName)
+	info, err := os.Stat(pidPath)
+	if err != nil || info.ModTime().Before(since) {
+		return
+	}
+	// #nosec G304 -- pid file in the runtime directory of the build user
+	data, err := os.ReadFile(pidPath)
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 1 {
+		return
+	}
+
+	// The daemon runs in its own session; stop rootlesskit and its children
+	logger.Debug("Stopping shared buildkitd (PID: %d)...", pid)
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		logger.Debug("Failed to stop buildkitd: %v", err)
+	}
+	// #nosec G104 -- the daemon is gone; a stale pid file is harmless
+	os.Remove(pidPath)
+}
@@ -0,0 +1,277 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// DefaultDebugHold is how long --debug-on-failure keeps a failed build around
+const DefaultDebugHold = 30 * time.Minute
+
+// debugHoldInterval is how often the remaining hold time is logged
+const debugHoldInterval = 5 * time.Minute
+
+// debugReleaseFile ends the hold of --debug-on-failure early when it is removed
+func debugReleaseFile() string {
+	return filepath.Join(os.TempDir(), "kimia-debug-hold")
+}
+
+// interactiveStdin reports whether stdin is a terminal, as with kubectl run -it
+func interactiveStdin() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// debugPod returns the name to pass to kubectl exec: the pod's hostname
+func debugPod() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "POD"
+}
+
+// logFailedStep names the step a debug session starts from
+func logFailedStep(failed *StepTiming) {
+	logger.Info("")
+	logger.Info("Debugging the failed build (--debug-on-failure)")
+	if failed != nil {
+		logger.Info("  Failed step: [%s %s] %s", failed.Stage, failed.Step, failed.Instruction)
+	}
+}
+
+// debugBuildahFailure opens a shell in, or holds on to, the working container
+// Buildah leaves behind when a step fails: it has the changes of the failed
+// RUN step up to the point where it exited
+func debugBuildahFailure(config Config, transport buildahTransport, env []string, failed *StepTiming) {
+	if transport.remote() {
+		logger.Warning("--debug-on-failure needs a local Buildah: the failed container is in the storage of the Podman service")
+		return
+	}
+	cmd := buildahCommand(transport, "containers", "--format", "{{.ContainerName}}")
+	cmd.Env = env
+	output, err := cmd.Output()
+	if err != nil {
+		logger.Warning("--debug-on-failure: cannot list Buildah containers: %v", err)
+		return
+	}
+	// Containers are listed in creation order; the failed step's is the last
+	container := ""
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			container = line
+		}
+	}
+	if container == "" {
+		logger.Warning("--debug-on-failure: Buildah left no working container of the failed step")
+		return
+	}
+	defer func() {
+		// #nosec G204 -- container name read from buildah containers
+		rm := buildahCommand(transport, "rm", container)
+		rm.Env = env
+		if err := rm.Run(); err != nil {
+			logger.Debug("Failed to remove debug container %s: %v", container, err)
+		}
+	}()
+
+	shell := append([]string{"buildah"}, localBuildah{root: config.StorageRoot}.globalArgs()...)
+	if config.StorageDriver != "" {
+		shell = append(shell, "--storage-driver", config.StorageDriver)
+	}
+	shell = append(shell, "run", "--isolation", "chroot", "-t", container, "--", "/bin/sh")
+
+	logFailedStep(failed)
+	logger.Info("  Container:   %s (state of the failed step)", container)
+	logger.Info("  Shell:       kubectl exec -it %s -- %s", debugPod(), strings.Join(shell, " "))
+
+	if interactiveStdin() {
+		logger.Info("Starting a shell in %s; exit it to end the build", container)
+		// #nosec G204 -- fixed buildah arguments and a container name read from buildah containers
+		session := exec.Command(shell[0], shell[1:]...)
+		session.Env, session.Stdin, session.Stdout, session.Stderr = env, os.Stdin, os.Stdout, os.Stderr
+		if err := session.Run(); err != nil {
+			logger.Warning("Debug shell exited: %v", err)
+		}
+		return
+	}
+	holdForDebugging(config.DebugHold)
+}
+
+// debugBuildKitFailure exports the filesystem of the failed stage just before
+// the failed step, which BuildKit does not keep, by building a copy of the
+// Dockerfile that ends there from the cache of the failed build
+func debugBuildKitFailure(config Config, args, env []string, dockerfile string, failed *StepTiming) {
+	if failed == nil {
+		logger.Warning("--debug-on-failure: the failed step could not be found in the BuildKit output")
+		return
+	}
+	// #nosec G304 -- the Dockerfile of this build
+	content, err := os.ReadFile(dockerfile)
+	if err != nil {
+		logger.Warning("--debug-on-failure: %v", err)
+		return
+	}
+	line, ok := failedInstructionLine(string(content), failed)
+	if !ok {
+		logger.Warning("--debug-on-failure: %q was not found in stage %s of the Dockerfile", failed.Instruction, failed.Stage)
+		return
+	}
+
+	dockerfileDir, err := newTempDir("", "kimia-debug-dockerfile-*")
+	if err != nil {
+		logger.Warning("--debug-on-failure: %v", err)
+		return
+	}
+	defer removeTemp(dockerfileDir)
+	lines := strings.Split(string(content), "\n")
+	truncated := strings.Join(lines[:line-1], "\n") + "\n"
+	// #nosec G306 -- a copy of the build's Dockerfile
+	if err := os.WriteFile(filepath.Join(dockerfileDir, "Dockerfile"), []byte(truncated), 0644); err != nil {
+		logger.Warning("--debug-on-failure: %v", err)
+		return
+	}
+	rootfs, err := newTempDir("", "kimia-debug-rootfs-*")
+	if err != nil {
+		logger.Warning("--debug-on-failure: %v", err)
+		return
+	}
+
+	logFailedStep(failed)
+	logger.Info("Exporting the filesystem before Dockerfile line %d...", line)
+	debugArgs := buildkitDebugArgs(args, dockerfileDir, rootfs)
+	logger.Debug("Executing: buildctl %s", strings.Join(sanitizeCommandArgs(debugArgs), " "))
+	// #nosec G204 -- the validated build args with outputs replaced by a local export
+	cmd := exec.Command("buildctl", debugArgs...)
+	cmd.Env = env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.Warning("--debug-on-failure: exporting the filesystem failed: %v: %s", err, lastLines(string(output), 5))
+		return
+	}
+
+	logger.Info("  Filesystem:  %s (before the failed step)", rootfs)
+	logger.Info("  Shell:       kubectl exec -it %s -- sh -c 'cd %s && exec sh'", debugPod(), rootfs)
+	logger.Info("  Copy:        kubectl cp %s:%s ./rootfs", debugPod(), rootfs)
+
+	if interactiveStdin() {
+		logger.Info("Starting a shell in %s; exit it to end the build", rootfs)
+		session := exec.Command("/bin/sh")
+		session.Dir, session.Stdin, session.Stdout, session.Stderr = rootfs, os.Stdin, os.Stdout, os.Stderr
+		if err := session.Run(); err != nil {
+			logger.Warning("Debug shell exited: %v", err)
+		}
+		return
+	}
+	holdForDebugging(config.DebugHold)
+}
+
+// failedInstructionLine returns the first line of the failed instruction in
+// its stage. BuildKit names unnamed stages stage-N.
+func failedInstructionLine(content string, failed *StepTiming) (int, bool) {
+	stage := -1
+	inStage := false
+	for _, inst := range parseDockerfile(content) {
+		if inst.Command == "FROM" {
+			stage++
+			fields := strings.Fields(inst.Args)
+			name := fmt.Sprintf("stage-%d", stage)
+			if len(fields) >= 3 && strings.EqualFold(fields[len(fields)-2], "AS") {
+				name = fields[len(fields)-1]
+			}
+			inStage = strings.EqualFold(name, failed.Stage)
+			continue
+		}
+		if !inStage {
+			continue
+		}
+		if sameInstruction(inst.Command+" "+inst.Args, failed.Instruction) {
+			return inst.Line, true
+		}
+	}
+	return 0, false
+}
+
+// buildkitDebugArgs turns the buildctl args of the failed build into a build
+// of the truncated Dockerfile in dockerfileDir exported to dest. The cache is
+// used, so only steps that did not finish in the failed build run again.
+func buildkitDebugArgs(args []string, dockerfileDir, dest string) []string {
+	var result []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--output", "--export-cache", "--metadata-file":
+			i++
+			continue
+		case "--no-cache":
+			continue
+		case "--opt", "--local":
+			if i+1 >= len(args) {
+				break
+			}
+			i++
+			value := args[i]
+			switch {
+			case arg == "--local" && strings.HasPrefix(value, "dockerfile="):
+				value = "dockerfile=" + dockerfileDir
+			case strings.HasPrefix(value, "filename="):
+				value = "filename=Dockerfile"
+			case strings.HasPrefix(value, "target="), strings.HasPrefix(value, "attest:"), strings.HasPrefix(value, "no-cache="):
+				continue
+			}
+			result = append(result, arg, value)
+			continue
+		}
+		result = append(result, arg)
+	}
+	return append(result, "--output", "type=local,dest="+dest)
+}
+
+// lastLines returns the last n non-empty lines of output
+func lastLines(output string, n int) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// holdForDebugging keeps the pod, and with it the failed state, around for
+// hold so that it can be examined with kubectl exec. Removing the release
+// file ends the hold early.
+func holdForDebugging(hold time.Duration) {
+	if hold <= 0 {
+		return
+	}
+	release := debugReleaseFile()
+	// #nosec G306 -- an empty marker file
+	if err := os.WriteFile(release, nil, 0644); err != nil {
+		logger.Warning("Cannot create %s: %v", release, err)
+	}
+	defer os.Remove(release)
+
+	deadline := time.Now().Add(hold)
+	logger.Info("Holding the failed build for %s; end it with: kubectl exec %s -- rm %s", hold, debugPod(), release)
+	lastLog := time.Now()
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(release); os.IsNotExist(err) {
+			logger.Info("Debug hold released")
+			return
+		}
+		if time.Since(lastLog) >= debugHoldInterval {
+			logger.Info("Holding the failed build for %s more", time.Until(deadline).Round(time.Minute))
+			lastLog = time.Now()
+		}
+		time.Sleep(2 * time.Second)
+	}
+	logger.Info("Debug hold of %s expired", hold)
+}
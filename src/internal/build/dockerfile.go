@@ -0,0 +1,121 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// defaultDockerfiles are the files built without --dockerfile, in order of
+// preference; Containerfile is the Podman and Buildah convention
+var defaultDockerfiles = []string{"Dockerfile", "Containerfile"}
+
+// InlineDockerfile is the --dockerfile name recorded for a Dockerfile given
+// with --dockerfile-content or read from stdin
+const InlineDockerfile = "-"
+
+// ResolveDockerfile returns the Dockerfile to build from the local context.
+// Without --dockerfile it is the context's Dockerfile, else its Containerfile.
+// A Dockerfile outside the context is copied to a temporary directory, with
+// its NAME.dockerignore, and the copy is returned; Cleanup removes it. Git
+// contexts BuildKit clones itself are left to BuildKit. Inline content, when
+// not empty, is written to a temporary Dockerfile instead.
+func (ctx *Context) ResolveDockerfile(dockerfile, content string) (string, error) {
+	if content != "" {
+		dir, err := ctx.newDockerfileDir(InlineDockerfile)
+		if err != nil {
+			return "", err
+		}
+		path := filepath.Join(dir, "Dockerfile")
+		// #nosec G306 -- the builder reads the Dockerfile
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return "", fmt.Errorf("failed to write the inline Dockerfile: %v", err)
+		}
+		logger.Info("Building from the inline Dockerfile (%d bytes)", len(content))
+		return path, nil
+	}
+	if ctx.Path == "" {
+		return dockerfile, nil
+	}
+	if dockerfile == "" {
+		for _, name := range defaultDockerfiles {
+			if info, err := os.Stat(filepath.Join(ctx.Path, name)); err == nil && info.Mode().IsRegular() {
+				if name == "Dockerfile" {
+					return "", nil
+				}
+				logger.Info("No Dockerfile in the build context, using %s", name)
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("no Dockerfile or Containerfile in the build context %s (use --dockerfile)", ctx.Path)
+	}
+
+	path := dockerfile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ctx.Path, path)
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("Dockerfile %s not found", dockerfile)
+	}
+	if within(ctx.Path, path) {
+		return dockerfile, nil
+	}
+
+	dir, err := ctx.newDockerfileDir(dockerfile)
+	if err != nil {
+		return "", err
+	}
+	copied := filepath.Join(dir, filepath.Base(path))
+	if err := copyDockerfile(path, copied); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path + ".dockerignore"); err == nil {
+		if err := copyDockerfile(path+".dockerignore", copied+".dockerignore"); err != nil {
+			return "", err
+		}
+	}
+	logger.Info("Dockerfile %s is outside the build context, building from a copy", dockerfile)
+	return copied, nil
+}
+
+// newDockerfileDir creates the temporary directory of a Dockerfile that is not
+// in the context; source is the name recorded for it in the build history
+func (ctx *Context) newDockerfileDir(source string) (string, error) {
+	dir, err := newTempDir("", "kimia-dockerfile-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create Dockerfile directory: %v", err)
+	}
+	ctx.dockerfileDir, ctx.dockerfileSource = dir, source
+	return dir, nil
+}
+
+// within reports whether path is dir or below it
+func within(dir, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// copyDockerfile copies a Dockerfile or ignore file from outside the context
+func copyDockerfile(src, dst string) error {
+	// #nosec G304 -- src is the Dockerfile given with --dockerfile
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", src, err)
+	}
+	// #nosec G306 -- the builder reads the copy
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+	return nil
+}
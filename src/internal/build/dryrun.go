@@ -0,0 +1,100 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// printDryRunCommand prints a fully-resolved command line with credentials
+// redacted. Only the environment variables Kimia sets are shown.
+func printDryRunCommand(title string, env []string, name string, args []string) {
+	logger.Info("Dry run: %s", title)
+
+	var line strings.Builder
+	for _, e := range env {
+		line.WriteString(ShellQuote(e) + " ")
+	}
+	line.WriteString(name)
+	sanitized := sanitizeCommandArgs(args)
+	for i := 0; i < len(sanitized); i++ {
+		line.WriteString(" \\\n    " + ShellQuote(sanitized[i]))
+		// Keep "--flag value" pairs on one line
+		if isDryRunFlag(sanitized[i]) && i+1 < len(sanitized) && !strings.HasPrefix(sanitized[i+1], "-") {
+			i++
+			line.WriteString(" " + ShellQuote(sanitized[i]))
+		}
+	}
+	fmt.Println(line.String())
+	fmt.Println()
+}
+
+// dryRunValueFlags are the buildah/buildctl flags Kimia passes with a separate value
+var dryRunValueFlags = map[string]bool{
+	"-f": true, "-t": true, "--build-arg": true, "--label": true, "--target": true,
+	"--platform": true, "--retry": true, "--timestamp": true, "--cert-dir": true,
+	"--frontend": true, "--opt": true, "--local": true, "--output": true,
+	"--import-cache": true, "--export-cache": true, "--cache-from": true, "--cache-to": true,
+	"--oci-layout": true, "--userns-uid-map": true, "--userns-gid-map": true,
+	"--add-host": true, "--dns": true, "--dns-search": true,
+	"--device": true, "--cap-add": true, "--allow": true, "--secret": true,
+}
+
+// isDryRunFlag reports whether arg is a flag that takes a separate value
+func isDryRunFlag(arg string) bool {
+	return dryRunValueFlags[arg]
+}
+
+// printDryRunFile prints the contents of a generated configuration file
+func printDryRunFile(path, content string) {
+	logger.Info("Dry run: generated %s", path)
+	fmt.Println(strings.TrimRight(content, "\n"))
+	fmt.Println()
+}
+
+// ShellQuote quotes s for POSIX shells when it contains special characters
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./:=,@+%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printDryRunDockerfile prints a Dockerfile generated for the build
+func printDryRunDockerfile(path string) {
+	// #nosec G304 -- path is a Dockerfile Kimia generated in a temp directory
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Warning("Dry run: cannot read generated Dockerfile: %v", err)
+		return
+	}
+	printDryRunFile("Dockerfile", string(data))
+}
+
+// kimiaEnv returns the entries of env that Kimia added on top of base
+func kimiaEnv(env, base []string) []string {
+	inherited := make(map[string]bool, len(base))
+	for _, e := range base {
+		inherited[e] = true
+	}
+	var added []string
+	for _, e := range env {
+		if !inherited[e] {
+			added = append(added, e)
+		}
+	}
+	return added
+}
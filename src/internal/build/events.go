@@ -0,0 +1,50 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Event is one line of the --events-file JSON stream
+type Event struct {
+	Time time.Time   `json:"time"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Event types written to the events file
+const (
+	EventBuildTiming      = "build.timing"
+	EventHeartbeat        = "heartbeat"
+	EventCacheExplanation = "cache.explanation"
+	EventImageSigning     = "image.signing"
+	EventSBOMDiff         = "sbom.diff"
+	EventScanVerdict      = "scan.verdict"
+)
+
+// writeEvent appends an event to the events file as a single JSON line.
+// Nothing is written when no events file is configured.
+func writeEvent(path, eventType string, data interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(Event{Time: time.Now().UTC(), Type: eventType, Data: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventType, err)
+	}
+
+	// #nosec G302,G304 -- user-specified events file; 0644 for a non-sensitive build log
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open events file: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write events file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxExplainedFiles is how many changed files a cache miss lists by name
+const maxExplainedFiles = 5
+
+// DefaultCacheExplainFile returns the default location of the file keeping
+// the cache inputs of previous builds for --explain-cache
+func DefaultCacheExplainFile() string {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	return filepath.Join(homeDir, ".kimia", "cache-explain.json")
+}
+
+// cacheInputs are the inputs of an instruction that its cache key depends on
+type cacheInputs struct {
+	Stage string            `json:"stage"`
+	Index int               `json:"index"` // Position within the stage, FROM = 0
+	Text  string            `json:"text"`
+	Base  string            `json:"base,omitempty"`  // FROM: image, with @digest when resolved
+	Args  map[string]string `json:"args,omitempty"`  // Build args in effect, hashed
+	Files map[string]string `json:"files,omitempty"` // COPY/ADD context files and their sha256
+}
+
+// cacheRecord is the entry of one build in the --explain-cache file
+type cacheRecord struct {
+	Updated time.Time     `json:"updated"`
+	Steps   []cacheInputs `json:"steps"`
+}
+
+// CacheExplanation records the cache inputs of every instruction before a
+// build and explains, after it, why each step that ran missed the cache:
+// a changed base image, build arg, instruction or context file, an earlier
+// miss, or a builder that had no cache
+type CacheExplanation struct {
+	file        string
+	key         string
+	eventsFile  string
+	disabled    string // Why the cache was not used at all, if it was not
+	current     []cacheInputs
+	previous    []cacheInputs
+	hasPrevious bool
+	steps       []StepTiming
+}
+
+// CacheStepExplanation is the result of one build step in the explanation
+type CacheStepExplanation struct {
+	Stage       string `json:"stage"`
+	Step        string `json:"step"`
+	Instruction string `json:"instruction"`
+	Cached      bool   `json:"cached"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// argReferenceRegex matches $NAME and ${NAME...} references
+var argReferenceRegex = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// NewCacheExplanation reads the Dockerfile and context of a build and the
+// inputs recorded for the same build in file
+func NewCacheExplanation(config Config, ctx *Context, file string) (*CacheExplanation, error) {
+	if ctx.Path == "" {
+		return nil, fmt.Errorf("--explain-cache needs a local build context")
+	}
+	dockerfilePath := config.Dockerfile
+	if dockerfilePath == "" {
+		dockerfilePath = "Dockerfile"
+	}
+	if !filepath.IsAbs(dockerfilePath) {
+		dockerfilePath = filepath.Join(ctx.Path, dockerfilePath)
+	}
+	// #nosec G304 -- dockerfilePath is the user-specified Dockerfile within the build context
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+
+	source := ctx.Path
+	if ctx.GitURL != "" {
+		source = logger.SanitizeGitURL(ctx.GitURL) + "#" + ctx.SubContext
+	}
+	relDockerfile, err := filepath.Rel(ctx.Path, dockerfilePath)
+	if err != nil {
+		relDockerfile = dockerfilePath
+	}
+
+	e := &CacheExplanation{
+		file:       file,
+		key:        source + "|" + relDockerfile + "|" + config.Target,
+		eventsFile: config.EventsFile,
+		current:    collectCacheInputs(string(content), ctx.Path, dockerfilePath, config),
+	}
+	switch {
+	case config.Reproducible:
+		e.disabled = "--reproducible disables the cache"
+	case !config.Cache:
+		e.disabled = "the cache is disabled (use --cache)"
+	}
+
+	records, err := loadCacheRecords(file)
+	if err != nil {
+		return nil, err
+	}
+	if record, ok := records[e.key]; ok {
+		e.previous, e.hasPrevious = record.Steps, true
+	}
+	return e, nil
+}
+
+// collectCacheInputs walks the Dockerfile the way the builder computes cache
+// keys: a RUN depends on every build arg in scope, other instructions on the
+// args they reference, and COPY/ADD on the context files they copy
+func collectCacheInputs(content, contextPath, dockerfilePath string, config Config) []cacheInputs {
+	ignore := loadDockerIgnore(contextPath, dockerfilePath, config.IgnoreFile)
+	globalArgs := make(map[string]string)
+	var stageArgs map[string]string
+	var inputs []cacheInputs
+	stage, stageName, index := -1, "", 0
+	digests := make(map[string]string)
+
+	for _, inst := range parseDockerfile(content) {
+		text := inst.Command + " " + inst.Args
+		if inst.Command == "FROM" {
+			stage++
+			index = 0
+			stageName = fmt.Sprintf("stage-%d", stage)
+			fields := strings.Fields(inst.Args)
+			if len(fields) >= 3 && strings.EqualFold(fields[len(fields)-2], "AS") {
+				stageName = strings.ToLower(fields[len(fields)-1])
+			}
+			stageArgs = make(map[string]string)
+			input := cacheInputs{Stage: stageName, Text: text}
+			for _, field := range fields {
+				if !strings.HasPrefix(field, "--") {
+					input.Base = resolveExplainedBase(expandDockerfileArgs(field, globalArgs, config.BuildArgs), config, digests)
+					break
+				}
+			}
+			inputs = append(inputs, input)
+			continue
+		}
+
+		if inst.Command == "ARG" {
+			for _, decl := range strings.Fields(inst.Args) {
+				name, value, hasDefault := strings.Cut(decl, "=")
+				if provided, ok := config.BuildArgs[name]; ok {
+					value = provided
+				} else if !hasDefault {
+					value = globalArgs[name]
+				}
+				if stage < 0 {
+					globalArgs[name] = value
+				} else {
+					stageArgs[name] = value
+				}
+			}
+		}
+		if stage < 0 {
+			continue
+		}
+
+		index++
+		input := cacheInputs{Stage: stageName, Index: index, Text: text}
+		used := make(map[string]string)
+		if inst.Command == "RUN" {
+			for name, value := range stageArgs {
+				used[name] = value
+			}
+		} else {
+			for _, m := range argReferenceRegex.FindAllStringSubmatch(inst.Args, -1) {
+				if value, ok := stageArgs[m[1]]; ok {
+					used[m[1]] = value
+				}
+			}
+		}
+		if len(used) > 0 {
+			input.Args = make(map[string]string, len(used))
+			for name, value := range used {
+				input.Args[name] = hashStrings(value)
+			}
+		}
+		if inst.Command == "COPY" || inst.Command == "ADD" {
+			input.Files = contextFileDigests(inst, contextPath, ignore)
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs
+}
+
+// resolveExplainedBase returns image@digest for a registry base image, or the
+// image alone for stages, scratch, offline builds and unresolvable images
+func resolveExplainedBase(image string, config Config, digests map[string]string) string {
+	if image == "scratch" || config.ImageStore != nil || strings.Contains(image, "@") {
+		return image
+	}
+	digest, ok := digests[image]
+	if !ok {
+		insecure := config.Insecure || config.InsecurePull || isInsecureRegistry(image, config.InsecureRegistry)
+		var err error
+		if digest, err = auth.ResolveImageDigest(image, insecure); err != nil {
+			// Stage names and unreachable images are compared by name
+			logger.Debug("--explain-cache: not resolving %s: %v", image, err)
+		}
+		digests[image] = digest
+	}
+	if digest == "" {
+		return image
+	}
+	return image + "@" + digest
+}
+
+// contextFileDigests returns the sha256 of every context file a COPY or ADD
+// copies, by path relative to the context
+func contextFileDigests(inst dockerfileInstruction, contextPath string, ignore *dockerIgnore) map[string]string {
+	var sources []string
+	for _, field := range strings.Fields(inst.Args) {
+		if strings.HasPrefix(field, "--from=") {
+			return nil
+		}
+		if !strings.HasPrefix(field, "--") {
+			sources = append(sources, field)
+		}
+	}
+	if len(sources) < 2 {
+		return nil
+	}
+
+	files := make(map[string]string)
+	for _, src := range sources[:len(sources)-1] {
+		if strings.Contains(src, "://") || strings.HasPrefix(src, "<<") {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(contextPath, filepath.Clean("/"+src)))
+		for _, match := range matches {
+			// #nosec G104 -- unreadable files are left out of the explanation
+			filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return nil
+				}
+				rel, err := filepath.Rel(contextPath, path)
+				if err != nil || ignore.excluded(filepath.ToSlash(rel)) {
+					return nil
+				}
+				if digest := fileDigest(path); digest != "" {
+					files[filepath.ToSlash(rel)] = digest
+				}
+				return nil
+			})
+		}
+	}
+	return files
+}
+
+// fileDigest returns the sha256 of a file, or "" when it cannot be read
+func fileDigest(path string) string {
+	// #nosec G304 -- a file within the build context
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// observe records the steps of the build, replacing those of a retried attempt
+func (e *CacheExplanation) observe(steps []StepTiming) {
+	e.steps = steps
+}
+
+// Report prints why each step hit or missed the cache and, after a successful
+// build, records its inputs for the next build
+func (e *CacheExplanation) Report(succeeded bool) {
+	if len(e.steps) == 0 {
+		logger.Info("Cache explanation: the builder reported no steps")
+		return
+	}
+
+	explained := e.explain()
+	hits := 0
+	logger.Info("")
+	logger.Info("Cache explanation")
+	logger.Info("  %-24s %-6s %s", "STEP", "CACHE", "INSTRUCTION / REASON")
+	for _, step := range explained {
+		result := "miss"
+		if step.Cached {
+			result = "hit"
+			hits++
+		}
+		logger.Info("  %-24s %-6s %s", truncate(step.Stage+" "+step.Step, 24), result, truncate(step.Instruction, 72))
+		if step.Reason != "" {
+			logger.Info("  %-24s %-6s   -> %s", "", "", step.Reason)
+		}
+	}
+	logger.Info("  %d of %d steps used the cache", hits, len(explained))
+	logger.Info("")
+	if err := writeEvent(e.eventsFile, EventCacheExplanation, explained); err != nil {
+		logger.Warning("%v", err)
+	}
+
+	if !succeeded {
+		return
+	}
+	records, err := loadCacheRecords(e.file)
+	if err == nil {
+		records[e.key] = cacheRecord{Updated: time.Now().UTC(), Steps: e.current}
+		err = saveCacheRecords(e.file, records)
+	}
+	if err != nil {
+		logger.Warning("--explain-cache: %v", err)
+	}
+}
+
+// explain pairs each build step with its inputs and finds why it missed
+func (e *CacheExplanation) explain() []CacheStepExplanation {
+	var result []CacheStepExplanation
+	missed := make(map[string]string) // Stage -> first step that missed
+	for _, step := range e.steps {
+		explained := CacheStepExplanation{Stage: step.Stage, Step: step.Step, Instruction: step.Instruction, Cached: step.Status == stepCached}
+		current := findCacheInputs(e.current, step.Stage, step.Instruction)
+		stage := strings.ToLower(step.Stage)
+		if !explained.Cached {
+			switch {
+			case step.Status == stepError || step.Status == stepCanceled:
+				explained.Reason = "the step " + map[string]string{stepError: "failed", stepCanceled: "was canceled"}[step.Status]
+			case e.disabled != "":
+				explained.Reason = e.disabled
+			default:
+				explained.Reason = e.missReason(current, stage, missed)
+			}
+			if _, ok := missed[stage]; !ok {
+				missed[stage] = step.Step
+			}
+		}
+		result = append(result, explained)
+	}
+	return result
+}
+
+// missReason explains a cache miss by the first input that changed since
+// the previous build, or by an earlier miss in the stage or its base stage
+func (e *CacheExplanation) missReason(current *cacheInputs, stage string, missed map[string]string) string {
+	if current == nil {
+		return "the instruction was not found in the Dockerfile"
+	}
+	if !e.hasPrevious {
+		return fmt.Sprintf("no previous build recorded in %s", e.file)
+	}
+	previous := findCacheInputs(e.previous, current.Stage, current.Text)
+	if current.Index == 0 {
+		previous = stageBase(e.previous, current.Stage)
+	}
+	if previous == nil {
+		for i := range e.previous {
+			if e.previous[i].Stage == current.Stage && e.previous[i].Index == current.Index {
+				return fmt.Sprintf("instruction changed (was: %s)", truncate(e.previous[i].Text, 60))
+			}
+		}
+		return "new instruction"
+	}
+
+	if current.Index == 0 && previous.Base != current.Base {
+		return fmt.Sprintf("base image changed: %s -> %s", shortBase(previous.Base), shortBase(current.Base))
+	}
+	if changed := changedKeys(previous.Args, current.Args); len(changed) > 0 {
+		return "build arg changed: " + strings.Join(changed, ", ")
+	}
+	if changed := changedKeys(previous.Files, current.Files); len(changed) > 0 {
+		listed := changed
+		if len(listed) > maxExplainedFiles {
+			listed = listed[:maxExplainedFiles]
+		}
+		reason := fmt.Sprintf("%d context files changed: %s", len(changed), strings.Join(listed, ", "))
+		if len(changed) > len(listed) {
+			reason += fmt.Sprintf(" (+%d more)", len(changed)-len(listed))
+		}
+		return reason
+	}
+	if earlierMiss, ok := missed[stage]; ok {
+		return fmt.Sprintf("follows the miss of step %s in this stage", earlierMiss)
+	}
+	// A stage built FROM another stage misses whenever that stage did
+	if base := stageBase(e.current, stage); base != nil {
+		if _, ok := missed[strings.ToLower(base.Base)]; ok {
+			return fmt.Sprintf("stage %s, which this stage is built on, missed the cache", base.Base)
+		}
+	}
+	return "inputs unchanged: the builder had no cache for this step (new builder, pruned or not imported cache)"
+}
+
+// findCacheInputs returns the inputs of a step, matched by stage and instruction
+func findCacheInputs(inputs []cacheInputs, stage, instruction string) *cacheInputs {
+	fromStep := strings.HasPrefix(strings.ToUpper(strings.TrimSpace(instruction)), "FROM ")
+	for i := range inputs {
+		if !strings.EqualFold(inputs[i].Stage, stage) {
+			continue
+		}
+		// BuildKit names FROM steps by the resolved image, not the Dockerfile text
+		if fromStep && inputs[i].Index == 0 {
+			return &inputs[i]
+		}
+		if !fromStep && sameInstruction(inputs[i].Text, instruction) {
+			return &inputs[i]
+		}
+	}
+	return nil
+}
+
+// stageBase returns the FROM inputs of a stage
+func stageBase(inputs []cacheInputs, stage string) *cacheInputs {
+	for i := range inputs {
+		if inputs[i].Index == 0 && strings.EqualFold(inputs[i].Stage, stage) {
+			return &inputs[i]
+		}
+	}
+	return nil
+}
+
+// sameInstruction compares a Dockerfile instruction with the instruction a
+// builder printed for it, ignoring whitespace and truncation
+func sameInstruction(text, printed string) bool {
+	got := strings.Join(strings.Fields(text), " ")
+	want := strings.Join(strings.Fields(printed), " ")
+	return want != "" && (strings.EqualFold(got, want) || strings.HasPrefix(got, want))
+}
+
+// shortBase shortens the digest of image@sha256:... for display
+func shortBase(base string) string {
+	if image, digest, ok := strings.Cut(base, "@sha256:"); ok && len(digest) > 12 {
+		return image + "@sha256:" + digest[:12]
+	}
+	return base
+}
+
+// changedKeys returns the sorted keys added, removed or changed between two maps
+func changedKeys(previous, current map[string]string) []string {
+	var changed []string
+	for key, value := range current {
+		if old, ok := previous[key]; !ok || old != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// loadCacheRecords reads the --explain-cache file; a missing file yields no records
+func loadCacheRecords(file string) (map[string]cacheRecord, error) {
+	records := make(map[string]cacheRecord)
+	// #nosec G304 -- operator-supplied state file
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, fmt.Errorf("failed to read cache explanation file: %v", err)
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse cache explanation file %s: %v", file, err)
+	}
+	return records, nil
+}
+
+// saveCacheRecords writes the --explain-cache file atomically
+func saveCacheRecords(file string, records map[string]cacheRecord) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return fmt.Errorf("failed to create cache explanation directory: %v", err)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cache explanation: %v", err)
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cache explanation file: %v", err)
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		return fmt.Errorf("failed to write cache explanation file: %v", err)
+	}
+	return nil
+}
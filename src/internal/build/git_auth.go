@@ -0,0 +1,275 @@
+package build
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// gitProvider is the hosting service of a Git URL, which decides how a token
+// is presented to it
+type gitProvider string
+
+const (
+	gitProviderGitHub    gitProvider = "github"
+	gitProviderGitLab    gitProvider = "gitlab"
+	gitProviderBitbucket gitProvider = "bitbucket"
+	gitProviderAzure     gitProvider = "azure"
+	gitProviderGeneric   gitProvider = "generic"
+)
+
+// gitURLHost returns the host of an https://, ssh:// or git@host:path URL
+func gitURLHost(url string) string {
+	rest := url
+	if idx := strings.Index(rest, "://"); idx >= 0 {
+		rest = rest[idx+3:]
+	}
+	if idx := strings.IndexAny(rest, "/#"); idx >= 0 {
+		rest = rest[:idx]
+	}
+	if idx := strings.LastIndex(rest, "@"); idx >= 0 {
+		rest = rest[idx+1:]
+	}
+	if idx := strings.Index(rest, ":"); idx >= 0 {
+		rest = rest[:idx]
+	}
+	return strings.ToLower(rest)
+}
+
+// detectGitProvider recognizes the hosted services and their self-managed
+// editions by host name
+func detectGitProvider(url string) gitProvider {
+	host := gitURLHost(url)
+	switch {
+	case host == "dev.azure.com" || strings.HasSuffix(host, ".visualstudio.com") || strings.Contains(host, "azure"):
+		return gitProviderAzure
+	case strings.Contains(host, "bitbucket"):
+		return gitProviderBitbucket
+	case strings.Contains(host, "gitlab"):
+		return gitProviderGitLab
+	case strings.Contains(host, "github"):
+		return gitProviderGitHub
+	}
+	return gitProviderGeneric
+}
+
+// defaultGitTokenUser is the user name a provider expects with an access token:
+// x-access-token works for GitHub PATs and App installation tokens, Bitbucket
+// repository/workspace access tokens require x-token-auth
+func defaultGitTokenUser(provider gitProvider) string {
+	switch provider {
+	case gitProviderGitHub:
+		return "x-access-token"
+	case gitProviderBitbucket:
+		return "x-token-auth"
+	}
+	return "oauth2"
+}
+
+// readGitToken reads the token file of gitConfig, "" when none is configured
+func readGitToken(gitConfig GitConfig) (string, error) {
+	if gitConfig.TokenFile == "" {
+		return "", nil
+	}
+	token, err := os.ReadFile(gitConfig.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read git token file: %v", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// gitTokenAuth applies the token of gitConfig to url. Azure DevOps takes the
+// token in an Authorization header (Basic for PATs, Bearer for the pipeline's
+// System.AccessToken), returned as header; other providers get it in the URL.
+func gitTokenAuth(url string, gitConfig GitConfig) (authURL, header string, err error) {
+	token, err := readGitToken(gitConfig)
+	if err != nil || token == "" {
+		return url, "", err
+	}
+
+	provider := detectGitProvider(url)
+	if provider == gitProviderAzure && gitConfig.TokenUser == "" {
+		logger.Debug("Using Authorization header for Azure DevOps")
+		// System.AccessToken is a JWT; personal access tokens are not
+		if strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2 {
+			return url, "Bearer " + token, nil
+		}
+		return url, "Basic " + base64.StdEncoding.EncodeToString([]byte(":"+token)), nil
+	}
+
+	user := gitConfig.TokenUser
+	if user == "" && urlUser(url) == "" {
+		user = defaultGitTokenUser(provider)
+		logger.Debug("Using Git token user %s for %s", user, provider)
+	}
+	return addGitToken(url, token, user), "", nil
+}
+
+// urlUser returns the user name of an https:// URL with a user but no password
+func urlUser(url string) string {
+	if !strings.HasPrefix(url, "https://") {
+		return ""
+	}
+	authority := strings.TrimPrefix(url, "https://")
+	if idx := strings.Index(authority, "/"); idx >= 0 {
+		authority = authority[:idx]
+	}
+	idx := strings.LastIndex(authority, "@")
+	if idx < 0 || strings.Contains(authority[:idx], ":") {
+		return ""
+	}
+	return authority[:idx]
+}
+
+// gitAuthEnv returns the environment for git commands that talk to the remote:
+// the Authorization header as configuration (kept out of the command line and
+// .git/config) and the SSH command for a deploy key
+func gitAuthEnv(header, sshCommand string) []string {
+	var env []string
+	if header != "" {
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: "+header)
+	}
+	if sshCommand != "" {
+		env = append(env, "GIT_SSH_COMMAND="+sshCommand)
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), env...)
+}
+
+// prepareSSHKey returns a path to the deploy key that ssh accepts. Keys mounted
+// from Kubernetes secrets are often group or world readable, which ssh rejects,
+// so those are copied to a private temporary file.
+func prepareSSHKey(keyFile string) (path string, temporary bool, err error) {
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read git SSH key file: %v", err)
+	}
+	if info.Mode().Perm()&0077 == 0 {
+		return keyFile, false, nil
+	}
+
+	// #nosec G304 -- key file given by the user
+	src, err := os.Open(keyFile)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read git SSH key file: %v", err)
+	}
+	defer src.Close()
+	dst, err := newTempFile("", "kimia-ssh-key-*")
+	if err != nil {
+		return "", false, fmt.Errorf("failed to copy git SSH key: %v", err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		// #nosec G104 -- cleanup in error path
+		removeTemp(dst.Name())
+		return "", false, fmt.Errorf("failed to copy git SSH key: %v", err)
+	}
+	logger.Debug("Copied git SSH key with permissions %o to a private file", info.Mode().Perm())
+	return dst.Name(), true, nil
+}
+
+// gitSSHCommand builds GIT_SSH_COMMAND for a deploy key. Host keys are checked
+// against ~/.ssh/known_hosts when it exists; otherwise any host key is accepted.
+func gitSSHCommand(keyPath string) (string, error) {
+	if strings.ContainsAny(keyPath, " '\"\\") {
+		return "", fmt.Errorf("git SSH key path must not contain spaces or quotes: %s", keyPath)
+	}
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	knownHosts := filepath.Join(homeDir, ".ssh", "known_hosts")
+	if _, err := os.Stat(knownHosts); err != nil || strings.ContainsAny(knownHosts, " '\"\\") {
+		logger.Warning("No %s found: the Git server's SSH host key is not verified", knownHosts)
+		return fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null", keyPath), nil
+	}
+	return fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s", keyPath, knownHosts), nil
+}
+
+// gitRemoteAuth prepares the credentials for cloning url locally: the URL to
+// clone, the environment for git commands, and a cleanup func to call once the
+// checkout is done
+func gitRemoteAuth(url string, gitConfig GitConfig) (string, []string, func(), error) {
+	noop := func() {}
+	authURL, header, err := gitTokenAuth(url, gitConfig)
+	if err != nil {
+		return "", nil, noop, err
+	}
+	if gitConfig.SSHKeyFile == "" {
+		return authURL, gitAuthEnv(header, ""), noop, nil
+	}
+
+	keyPath, temporary, err := prepareSSHKey(gitConfig.SSHKeyFile)
+	if err != nil {
+		return "", nil, noop, err
+	}
+	cleanup := noop
+	if temporary {
+		cleanup = func() {
+			// #nosec G104 -- the copy is also tracked by the workspace
+			removeTemp(keyPath)
+		}
+	}
+	sshCommand, err := gitSSHCommand(keyPath)
+	if err != nil {
+		cleanup()
+		return "", nil, noop, err
+	}
+	if !strings.HasPrefix(url, "ssh://") && !strings.HasPrefix(url, "git@") {
+		logger.Warning("--git-ssh-key-file is only used for ssh:// and git@ URLs, not %s", logger.SanitizeGitURL(url))
+	}
+	return authURL, gitAuthEnv(header, sshCommand), cleanup, nil
+}
+
+// buildkitGitAuthArgs returns the buildctl options that give BuildKit's Git
+// source credentials it cannot take from the URL: a header token as the
+// GIT_AUTH_HEADER secret and a deploy key as the default SSH agent.
+// The returned cleanup func removes the secret file after the build.
+func buildkitGitAuthArgs(gitURL string, gitConfig GitConfig) ([]string, func(), error) {
+	var args []string
+	cleanup := func() {}
+
+	if gitConfig.TokenFile != "" {
+		_, header, err := gitTokenAuth(gitURL, gitConfig)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		if header != "" {
+			file, err := newTempFile("", "kimia-git-auth-*")
+			if err != nil {
+				return nil, cleanup, fmt.Errorf("failed to write Git auth secret: %v", err)
+			}
+			_, err = file.WriteString(header)
+			file.Close()
+			cleanup = func() {
+				// #nosec G104 -- also tracked by the workspace
+				removeTemp(file.Name())
+			}
+			if err != nil {
+				cleanup()
+				return nil, func() {}, fmt.Errorf("failed to write Git auth secret: %v", err)
+			}
+			args = append(args, "--secret", "id=GIT_AUTH_HEADER,src="+file.Name())
+		}
+	}
+
+	if gitConfig.SSHKeyFile != "" {
+		if _, err := os.Stat(gitConfig.SSHKeyFile); err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("failed to read git SSH key file: %v", err)
+		}
+		// BuildKit's Git source does not verify SSH host keys of build contexts
+		args = append(args, "--ssh", "default="+gitConfig.SSHKeyFile)
+	}
+	return args, cleanup, nil
+}
@@ -0,0 +1,102 @@
+package build
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// HeartbeatData is the data of a heartbeat event
+type HeartbeatData struct {
+	Phase          string  `json:"phase"`            // build, export, push, cache-save or cache-restore
+	Detail         string  `json:"detail,omitempty"` // Image or reference the phase works on
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	QuietSeconds   float64 `json:"quietSeconds"` // Time since the phase last printed anything
+}
+
+// heartbeat logs a progress line, and writes a heartbeat event, whenever a
+// long-running phase has printed nothing for its interval, so CI systems that
+// kill jobs without output do not abort it. Output of the phase is passed
+// through Write; a nil heartbeat does nothing.
+type heartbeat struct {
+	data       HeartbeatData
+	eventsFile string
+	interval   time.Duration
+	started    time.Time
+	lastOutput atomic.Int64 // UnixNano of the last output or heartbeat
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+// startHeartbeat starts heartbeats for a phase; it returns nil when interval
+// is 0 (heartbeats disabled)
+func startHeartbeat(interval time.Duration, eventsFile, phase, detail string) *heartbeat {
+	if interval <= 0 {
+		return nil
+	}
+	h := &heartbeat{
+		data:       HeartbeatData{Phase: phase, Detail: detail},
+		eventsFile: eventsFile,
+		interval:   interval,
+		started:    time.Now(),
+		done:       make(chan struct{}),
+	}
+	h.lastOutput.Store(h.started.UnixNano())
+	go h.run()
+	return h
+}
+
+// run waits until the phase has been quiet for the interval and beats
+func (h *heartbeat) run() {
+	timer := time.NewTimer(h.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-timer.C:
+			quiet := now.Sub(time.Unix(0, h.lastOutput.Load()))
+			if quiet >= h.interval {
+				h.beat(now, quiet)
+				h.lastOutput.Store(now.UnixNano())
+				quiet = 0
+			}
+			timer.Reset(h.interval - quiet)
+		}
+	}
+}
+
+// beat logs and records one heartbeat
+func (h *heartbeat) beat(now time.Time, quiet time.Duration) {
+	elapsed := now.Sub(h.started)
+	what := h.data.Phase
+	if h.data.Detail != "" {
+		what += " " + h.data.Detail
+	}
+	logger.Info("Heartbeat: %s still running (%s elapsed, no output for %s)",
+		what, elapsed.Round(time.Second), quiet.Round(time.Second))
+
+	data := h.data
+	data.ElapsedSeconds = roundSeconds(elapsed.Seconds())
+	data.QuietSeconds = roundSeconds(quiet.Seconds())
+	if err := writeEvent(h.eventsFile, EventHeartbeat, data); err != nil {
+		logger.Warning("%v", err)
+	}
+}
+
+// Write records output of the phase, which postpones the next heartbeat
+func (h *heartbeat) Write(p []byte) (int, error) {
+	if h != nil && len(p) > 0 {
+		h.lastOutput.Store(time.Now().UnixNano())
+	}
+	return len(p), nil
+}
+
+// stop ends the heartbeats of the phase; it may be called more than once
+func (h *heartbeat) stop() {
+	if h != nil {
+		h.stopOnce.Do(func() { close(h.done) })
+	}
+}
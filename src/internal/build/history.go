@@ -0,0 +1,301 @@
+package build
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxHistoryEntries is how many builds the history file keeps; older ones are dropped
+const maxHistoryEntries = 1000
+
+// DefaultHistoryFile returns the default location of the build history
+func DefaultHistoryFile() string {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	return filepath.Join(homeDir, ".kimia", "history.json")
+}
+
+// BuildInputs identify what a build was made from
+type BuildInputs struct {
+	Context          string            `json:"context"`          // Directory or sanitized Git URL
+	ContextDigest    string            `json:"contextDigest"`    // Files sent to the builder, after ignore rules
+	Dockerfile       string            `json:"dockerfile"`       // Relative to the context
+	DockerfileDigest string            `json:"dockerfileDigest"` // sha256 of the Dockerfile content
+	Target           string            `json:"target,omitempty"`
+	Platform         string            `json:"platform,omitempty"`
+	BuildArgs        map[string]string `json:"buildArgs,omitempty"`  // Hashed values, never in plain text
+	BaseImages       []BaseImageDigest `json:"baseImages,omitempty"` // Resolved with --skip-unchanged
+	InputHash        string            `json:"inputHash,omitempty"`  // Everything the image is built from (--skip-unchanged)
+}
+
+// BuildRecord is one build in the history
+type BuildRecord struct {
+	ID           string            `json:"id"`
+	Started      time.Time         `json:"started"`
+	Seconds      float64           `json:"seconds"`
+	Succeeded    bool              `json:"succeeded"`
+	Error        string            `json:"error,omitempty"`
+	Builder      string            `json:"builder,omitempty"`
+	Inputs       BuildInputs       `json:"inputs"`
+	Destinations []string          `json:"destinations,omitempty"`
+	Digests      map[string]string `json:"digests,omitempty"` // Destination -> pushed digest
+	Steps        int               `json:"steps"`
+	CachedSteps  int               `json:"cachedSteps"`
+	ReusedFrom   string            `json:"reusedFrom,omitempty"` // Build whose image was tagged instead of building (--skip-unchanged)
+	Signatures   []SignedImage     `json:"signatures,omitempty"` // Images signed with --sign
+}
+
+// historyState is the content of the history file, oldest build first
+type historyState struct {
+	Builds []BuildRecord `json:"builds"`
+}
+
+// NewBuildRecord starts the history record of a build, computing the digests
+// of its context and Dockerfile. The builder fills in the step counts and
+// BuildKit's pushed digests while it runs.
+func NewBuildRecord(config Config, ctx *Context) *BuildRecord {
+	record := &BuildRecord{
+		ID:           nextBuildID(),
+		Started:      time.Now().UTC(),
+		Destinations: config.Destination,
+		Inputs: BuildInputs{
+			Context:  ctx.Path,
+			Target:   config.Target,
+			Platform: config.CustomPlatform,
+		},
+	}
+	if ctx.GitURL != "" {
+		record.Inputs.Context = logger.SanitizeGitURL(ctx.GitURL)
+		if ctx.SubContext != "" {
+			record.Inputs.Context += "#" + ctx.SubContext
+		}
+	}
+	if len(config.BuildArgs) > 0 {
+		record.Inputs.BuildArgs = make(map[string]string, len(config.BuildArgs))
+		for name, value := range config.BuildArgs {
+			record.Inputs.BuildArgs[name] = hashStrings(value)
+		}
+	}
+
+	dockerfile := config.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	record.Inputs.Dockerfile = dockerfile
+	if ctx.dockerfileDir != "" {
+		// A temporary copy: record the Dockerfile it was made from
+		record.Inputs.Dockerfile = ctx.dockerfileSource
+		record.Inputs.DockerfileDigest = fileSHA256(dockerfile)
+	}
+	if ctx.Path == "" {
+		// BuildKit reads Git contexts itself; only the URL identifies them
+		return record
+	}
+	dockerfilePath := dockerfile
+	if !filepath.IsAbs(dockerfilePath) {
+		dockerfilePath = filepath.Join(ctx.Path, dockerfilePath)
+	}
+	if rel, err := filepath.Rel(ctx.Path, dockerfilePath); err == nil && ctx.dockerfileDir == "" {
+		record.Inputs.Dockerfile = rel
+	}
+	record.Inputs.DockerfileDigest = fileSHA256(dockerfilePath)
+	record.Inputs.ContextDigest = contextDigest(ctx.Path, dockerfilePath, config.IgnoreFile)
+	return record
+}
+
+// newBuildID returns a random identifier of a build
+func newBuildID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%012x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// fileSHA256 returns the sha256 digest of a file, or "" when it cannot be read
+func fileSHA256(path string) string {
+	// #nosec G304 -- a file within the build context
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// contextDigest hashes the paths, modes and content of the context files the
+// builder receives, after ignore rules. Paths are relative, so the digest of
+// the same sources is the same in every checkout.
+func contextDigest(contextPath, dockerfilePath, ignoreFile string) string {
+	ignore := loadDockerIgnore(contextPath, dockerfilePath, ignoreFile)
+	var files []string
+	// #nosec G104 -- unreadable files are left out of the digest
+	filepath.Walk(contextPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == contextPath {
+			return nil
+		}
+		rel, err := filepath.Rel(contextPath, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if ignore.excluded(rel) {
+			if info.IsDir() && rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, rel := range files {
+		path := filepath.Join(contextPath, filepath.FromSlash(rel))
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			io.WriteString(h, target)
+		case info.Mode().IsRegular():
+			io.WriteString(h, fileSHA256(path))
+		}
+		h.Write([]byte{0})
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// observe records the step counts of the build
+func (r *BuildRecord) observe(timing *BuildTiming) {
+	r.Builder = timing.Builder
+	r.Steps, r.CachedSteps = len(timing.Steps), 0
+	for _, step := range timing.Steps {
+		if step.Status == stepCached {
+			r.CachedSteps++
+		}
+	}
+}
+
+// SetDigests records the digests pushed to the destinations
+func (r *BuildRecord) SetDigests(digests map[string]string) {
+	if len(digests) == 0 {
+		return
+	}
+	if r.Digests == nil {
+		r.Digests = make(map[string]string, len(digests))
+	}
+	for dest, digest := range digests {
+		r.Digests[dest] = digest
+	}
+}
+
+// Finish records the result and duration of the build
+func (r *BuildRecord) Finish(err error) {
+	r.Seconds = time.Since(r.Started).Seconds()
+	r.Succeeded = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// AppendHistory adds a finished build to the history file
+func AppendHistory(path string, record *BuildRecord) error {
+	return withHistoryFile(path, func(state *historyState) {
+		state.Builds = append(state.Builds, *record)
+		if len(state.Builds) > maxHistoryEntries {
+			state.Builds = state.Builds[len(state.Builds)-maxHistoryEntries:]
+		}
+	})
+}
+
+// ReadHistory returns the builds in the history file, oldest first. A
+// missing file is an empty history.
+func ReadHistory(path string) ([]BuildRecord, error) {
+	// #nosec G304 -- operator-supplied history file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read history file: %v", err)
+	}
+	var state historyState
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("failed to parse history file %s: %v", path, err)
+		}
+	}
+	return state.Builds, nil
+}
+
+// withHistoryFile loads the history file under an exclusive lock, applies
+// update and writes the result back before unlocking, so that builds in the
+// same pod can share it
+func withHistoryFile(path string, update func(*historyState)) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	// #nosec G304 -- operator-supplied history file
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %v", err)
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock history file: %v", err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("failed to read history file: %v", err)
+	}
+	var state historyState
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse history file %s: %v", path, err)
+		}
+	}
+
+	update(&state)
+
+	out, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Rewrite in place: other builds hold locks on this inode, so no rename
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write history file: %v", err)
+	}
+	if _, err := file.WriteAt(append(out, '\n'), 0); err != nil {
+		return fmt.Errorf("failed to write history file: %v", err)
+	}
+	return file.Sync()
+}
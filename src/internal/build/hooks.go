@@ -0,0 +1,148 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Points of the build at which hooks run
+const (
+	HookPostBuild = "post-build"
+	HookPrePush   = "pre-push"
+	HookPostPush  = "post-push"
+)
+
+// What a failing hook does to the build (--hook-failure)
+const (
+	HookFailureAbort = "abort"
+	HookFailureWarn  = "warn"
+)
+
+// HookFailureModes lists the valid --hook-failure values
+var HookFailureModes = []string{HookFailureAbort, HookFailureWarn}
+
+// Hooks are the executables run during a build (--post-build-hook,
+// --pre-push-hook and --post-push-hook)
+type Hooks struct {
+	PostBuild string
+	PrePush   string
+	PostPush  string
+	Failure   string // abort (default) or warn
+	Builder   string
+	DryRun    bool
+}
+
+// hookMetadata is the content of the METADATA_FILE given to hooks
+type hookMetadata struct {
+	Hook         string            `json:"hook"`
+	Builder      string            `json:"builder"`
+	Destinations []string          `json:"destinations"`
+	Digests      map[string]string `json:"digests,omitempty"`
+	Build        *BuildRecord      `json:"build,omitempty"`
+}
+
+// Enabled reports whether any hook is set
+func (h Hooks) Enabled() bool {
+	return h.PostBuild != "" || h.PrePush != "" || h.PostPush != ""
+}
+
+// path returns the executable of a hook, "" when it is not set
+func (h Hooks) path(hook string) string {
+	switch hook {
+	case HookPostBuild:
+		return h.PostBuild
+	case HookPrePush:
+		return h.PrePush
+	case HookPostPush:
+		return h.PostPush
+	}
+	return ""
+}
+
+// Run runs a hook with the image's destinations and digests in its
+// environment. A failing hook fails the build unless the failure mode is warn.
+func (h Hooks) Run(hook string, destinations []string, digests map[string]string, record *BuildRecord) error {
+	path := h.path(hook)
+	if path == "" {
+		return nil
+	}
+	if h.DryRun {
+		logger.Info("Dry run: would run the %s hook %s", hook, path)
+		return nil
+	}
+
+	err := h.run(hook, path, destinations, digests, record)
+	if err == nil {
+		return nil
+	}
+	if h.Failure == HookFailureWarn {
+		logger.Warning("%v (continuing: --hook-failure=warn)", err)
+		return nil
+	}
+	return err
+}
+
+// run runs one hook executable
+func (h Hooks) run(hook, path string, destinations []string, digests map[string]string, record *BuildRecord) error {
+	metadataFile, err := newTempFile("", "kimia-hook-*.json")
+	if err != nil {
+		return fmt.Errorf("%s hook: failed to create metadata file: %v", hook, err)
+	}
+	defer removeTemp(metadataFile.Name())
+	err = json.NewEncoder(metadataFile).Encode(hookMetadata{
+		Hook: hook, Builder: h.Builder, Destinations: destinations, Digests: digests, Build: record,
+	})
+	metadataFile.Close()
+	if err != nil {
+		return fmt.Errorf("%s hook: failed to write metadata file: %v", hook, err)
+	}
+
+	image, digest := "", ""
+	if len(destinations) > 0 {
+		image, digest = destinations[0], digests[destinations[0]]
+	}
+	if digest == "" {
+		// Any destination's digest, e.g. when only the staging reference was pushed
+		if keys := sortedKeys(digests); len(keys) > 0 {
+			digest = digests[keys[0]]
+		}
+	}
+	env := append(os.Environ(),
+		"KIMIA_HOOK="+hook,
+		"KIMIA_BUILDER="+h.Builder,
+		"IMAGE="+image,
+		"IMAGE_DIGEST="+digest,
+		"DESTINATIONS="+strings.Join(destinations, " "),
+		"METADATA_FILE="+metadataFile.Name(),
+	)
+	if record != nil {
+		env = append(env, "KIMIA_BUILD_ID="+record.ID)
+	}
+
+	logger.Info("Running %s hook: %s", hook, path)
+	// #nosec G204 -- hook executable given by the user
+	cmd := exec.Command(path)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook %s failed: %v", hook, path, err)
+	}
+	return nil
+}
+
+// ValidateHook checks that a hook is an executable file
+func ValidateHook(flag, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", flag, err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s: %s is not an executable file", flag, path)
+	}
+	return nil
+}
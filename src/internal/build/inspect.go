@@ -0,0 +1,277 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// kimiaLabelPrefix marks the labels Kimia itself adds to images
+const kimiaLabelPrefix = "io.rapidfort.kimia."
+
+// InspectConfig selects the image for `kimia inspect`
+type InspectConfig struct {
+	Image            string
+	Insecure         bool
+	InsecureRegistry []string
+	Platform         string // Only inspect this platform of a multi-platform image ("" = all)
+}
+
+// ImageInspection is what a registry holds for an image: its manifest or
+// index, the configuration and layers of every platform, and the artifacts
+// attached to it
+type ImageInspection struct {
+	Image       string               `json:"image"`
+	Digest      string               `json:"digest"`
+	MediaType   string               `json:"mediaType"`
+	Annotations map[string]string    `json:"annotations,omitempty"`
+	Platforms   []PlatformInspection `json:"platforms"`
+	Artifacts   []TrustArtifact      `json:"artifacts"`
+	Warnings    []string             `json:"warnings,omitempty"`
+}
+
+// PlatformInspection is the image of one platform
+type PlatformInspection struct {
+	Platform     string            `json:"platform"`
+	Digest       string            `json:"digest"`
+	ConfigDigest string            `json:"configDigest"`
+	Created      string            `json:"created,omitempty"`
+	User         string            `json:"user,omitempty"`
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	WorkingDir   string            `json:"workingDir,omitempty"`
+	ExposedPorts []string          `json:"exposedPorts,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Layers       []LayerInspection `json:"layers"`
+	Size         int64             `json:"size"` // Compressed size of all layers
+}
+
+// LayerInspection is one layer of an image
+type LayerInspection struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"createdBy,omitempty"` // Instruction from the image history
+}
+
+// inspectedConfig holds the fields of an image config that are reported
+type inspectedConfig struct {
+	auth.Platform
+	Created string `json:"created"`
+	Config  struct {
+		User         string              `json:"User"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		WorkingDir   string              `json:"WorkingDir"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Labels       map[string]string   `json:"Labels"`
+	} `json:"config"`
+	History []struct {
+		CreatedBy  string `json:"created_by"`
+		EmptyLayer bool   `json:"empty_layer"`
+	} `json:"history"`
+}
+
+// InspectImage reads an image and everything attached to it from its registry
+func InspectImage(config InspectConfig) (*ImageInspection, error) {
+	insecure := config.Insecure || isInsecureRegistry(config.Image, config.InsecureRegistry)
+	repo, reference := auth.NewRepository(config.Image, insecure)
+	raw, mediaType, err := repo.FetchRawManifest(reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", config.Image, err)
+	}
+	var manifest auth.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of %s: %v", config.Image, err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+
+	inspection := &ImageInspection{
+		Image:       config.Image,
+		Digest:      sha256Digest(raw),
+		MediaType:   mediaType,
+		Annotations: manifest.Annotations,
+		Platforms:   []PlatformInspection{},
+	}
+	logger.Info("Inspecting %s@%s", repo.Repository, inspection.Digest)
+
+	if len(manifest.Manifests) == 0 {
+		platform, err := inspectPlatform(repo, inspection.Digest, &manifest)
+		if err != nil {
+			return nil, err
+		}
+		inspection.Platforms = append(inspection.Platforms, platform)
+	}
+	for _, child := range manifest.Manifests {
+		// Attestations are stored as unknown/unknown manifests
+		if child.Annotations["vnd.docker.reference.type"] == "attestation-manifest" || child.Platform == nil || child.Platform.OS == "unknown" {
+			continue
+		}
+		if config.Platform != "" && normalizePlatform(formatPlatform(*child.Platform)) != normalizePlatform(config.Platform) {
+			continue
+		}
+		childManifest, err := fetchVerifiedManifest(repo, child.Digest, child.Size)
+		if err != nil {
+			return nil, err
+		}
+		platform, err := inspectPlatform(repo, child.Digest, childManifest)
+		if err != nil {
+			return nil, err
+		}
+		inspection.Platforms = append(inspection.Platforms, platform)
+	}
+	if config.Platform != "" && len(inspection.Platforms) == 0 {
+		return nil, fmt.Errorf("%s has no %s image", config.Image, config.Platform)
+	}
+
+	inspection.Artifacts, inspection.Warnings = collectArtifacts(repo, inspection.Digest, &manifest)
+	if inspection.Artifacts == nil {
+		inspection.Artifacts = []TrustArtifact{}
+	}
+	return inspection, nil
+}
+
+// inspectPlatform reads the config of a single-platform image and pairs its
+// layers with the history entries that created them
+func inspectPlatform(repo *auth.Repository, digest string, manifest *auth.Manifest) (PlatformInspection, error) {
+	platform := PlatformInspection{
+		Digest:       digest,
+		ConfigDigest: manifest.Config.Digest,
+		Annotations:  manifest.Annotations,
+		Layers:       []LayerInspection{},
+	}
+	data, err := fetchImageConfig(repo, manifest.Config)
+	if err != nil {
+		return platform, err
+	}
+	var config inspectedConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return platform, fmt.Errorf("invalid image config %s: %v", manifest.Config.Digest, err)
+	}
+
+	platform.Platform = formatPlatform(config.Platform)
+	platform.Created = config.Created
+	platform.User = config.Config.User
+	platform.Entrypoint = config.Config.Entrypoint
+	platform.Cmd = config.Config.Cmd
+	platform.WorkingDir = config.Config.WorkingDir
+	platform.Labels = config.Config.Labels
+	for port := range config.Config.ExposedPorts {
+		platform.ExposedPorts = append(platform.ExposedPorts, port)
+	}
+	sort.Strings(platform.ExposedPorts)
+
+	var createdBy []string
+	for _, entry := range config.History {
+		if !entry.EmptyLayer {
+			createdBy = append(createdBy, entry.CreatedBy)
+		}
+	}
+	for i, layer := range manifest.Layers {
+		inspected := LayerInspection{Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size}
+		// The history only matches the layers when it has an entry for each
+		if len(createdBy) == len(manifest.Layers) {
+			inspected.CreatedBy = createdBy[i]
+		}
+		platform.Layers = append(platform.Layers, inspected)
+		platform.Size += layer.Size
+	}
+	return platform, nil
+}
+
+// PrintImageInspection prints a human-readable inspection
+func PrintImageInspection(inspection *ImageInspection) {
+	logger.Info("")
+	logger.Info("Kimia Image Inspection")
+	logger.Info("═══════════════════════════════════════════════════════")
+	logger.Info("  Image:                   %s", inspection.Image)
+	logger.Info("  Digest:                  %s", inspection.Digest)
+	logger.Info("  Media type:              %s", inspection.MediaType)
+	platforms := make([]string, len(inspection.Platforms))
+	for i, platform := range inspection.Platforms {
+		platforms[i] = platform.Platform
+	}
+	logger.Info("  Platforms:               %s", strings.Join(platforms, ", "))
+	printStringMap("  ", "Annotations", inspection.Annotations)
+	logger.Info("")
+
+	for _, platform := range inspection.Platforms {
+		logger.Info("PLATFORM %s", platform.Platform)
+		logger.Info("  Digest:                  %s", platform.Digest)
+		logger.Info("  Config:                  %s", platform.ConfigDigest)
+		if platform.Created != "" {
+			logger.Info("  Created:                 %s", platform.Created)
+		}
+		if platform.User != "" {
+			logger.Info("  User:                    %s", platform.User)
+		}
+		if len(platform.Entrypoint) > 0 {
+			logger.Info("  Entrypoint:              %s", strings.Join(platform.Entrypoint, " "))
+		}
+		if len(platform.Cmd) > 0 {
+			logger.Info("  Cmd:                     %s", strings.Join(platform.Cmd, " "))
+		}
+		if platform.WorkingDir != "" {
+			logger.Info("  Working directory:       %s", platform.WorkingDir)
+		}
+		if len(platform.ExposedPorts) > 0 {
+			logger.Info("  Exposed ports:           %s", strings.Join(platform.ExposedPorts, ", "))
+		}
+		printStringMap("  ", "Labels", platform.Labels)
+		printStringMap("  ", "Annotations", platform.Annotations)
+
+		logger.Info("  Layers (%d, %s compressed):", len(platform.Layers), formatBytes(platform.Size))
+		for i, layer := range platform.Layers {
+			createdBy := layer.CreatedBy
+			if len(createdBy) > 60 {
+				createdBy = createdBy[:57] + "..."
+			}
+			logger.Info("  %3d  %-10s %s  %s", i+1, formatBytes(layer.Size), layer.Digest, createdBy)
+		}
+		logger.Info("")
+	}
+
+	logger.Info("ARTIFACTS")
+	if len(inspection.Artifacts) == 0 {
+		logger.Info("  none")
+	}
+	for _, artifact := range inspection.Artifacts {
+		logger.Info("  %-12s %-48s %s", artifact.Kind, artifact.Type, artifact.Source)
+		if artifact.Digest != "" {
+			logger.Info("  %-12s %s", "", artifact.Digest)
+		}
+	}
+	logger.Info("")
+
+	for _, warning := range inspection.Warnings {
+		logger.Warning("%s", warning)
+	}
+}
+
+// printStringMap prints labels or annotations sorted by key, marking the ones
+// Kimia added
+func printStringMap(indent, title string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	logger.Info("%s%s:", indent, title)
+	for _, key := range keys {
+		marker := ""
+		if strings.HasPrefix(key, kimiaLabelPrefix) {
+			marker = "  (kimia)"
+		}
+		logger.Info("%s  %s=%s%s", indent, key, values[key], marker)
+	}
+}
@@ -0,0 +1,520 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxSplitInstructions bounds how many COPY instructions a single oversized
+// COPY may be split into. Each one becomes a layer, and overlay storage
+// limits images to roughly 128 layers in total.
+const maxSplitInstructions = 64
+
+// sizeUnits maps size suffixes to multipliers. Registries quote limits in
+// decimal units (10GB), so KB/MB/GB are decimal and KiB/MiB/GiB binary.
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "kib": 1 << 10,
+	"m": 1e6, "mb": 1e6, "mib": 1 << 20,
+	"g": 1e9, "gb": 1e9, "gib": 1 << 30,
+	"t": 1e12, "tb": 1e12, "tib": 1 << 40,
+}
+
+var (
+	sizeRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([A-Za-z]*)$`)
+	// imageIDRegex matches the image ID printed by buildah bud
+	imageIDRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// ParseSize parses a size such as "10GB", "512MiB" or a plain byte count
+func ParseSize(value string) (int64, error) {
+	m := sizeRegex.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 10GB, 512MiB or a byte count)", value)
+	}
+	multiplier, ok := sizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q in %q", m[2], value)
+	}
+	number, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", value, err)
+	}
+	size := number * multiplier
+	if size < 1 || size > math.MaxInt64 {
+		return 0, fmt.Errorf("size out of range: %q", value)
+	}
+	return int64(size), nil
+}
+
+// ignorePattern is a compiled .dockerignore line
+type ignorePattern struct {
+	regex  *regexp.Regexp
+	negate bool
+}
+
+// dockerIgnore evaluates .dockerignore patterns the way Docker does: the last
+// matching pattern wins, "!" re-includes paths, and a pattern matching a
+// directory also matches everything below it
+type dockerIgnore struct {
+	patterns      []ignorePattern
+	hasExceptions bool
+}
+
+// ignoreFilePath returns the ignore file that applies to a build: the
+// --ignore-file override, else the Dockerfile-specific ignore file, else
+// .dockerignore in the context root. It returns "" when there is none.
+func ignoreFilePath(contextDir, dockerfilePath, override string) string {
+	if override != "" {
+		return override
+	}
+	for _, candidate := range []string{dockerfilePath + ".dockerignore", filepath.Join(contextDir, ".dockerignore")} {
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// loadDockerIgnore reads the ignore file that applies to a build (see ignoreFilePath)
+func loadDockerIgnore(contextDir, dockerfilePath, override string) *dockerIgnore {
+	ignore := &dockerIgnore{}
+	path := ignoreFilePath(contextDir, dockerfilePath, override)
+	if path == "" {
+		return ignore
+	}
+	// #nosec G304 -- user-specified ignore file or .dockerignore in the build context
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Warning("Failed to read %s: %v", path, err)
+		return ignore
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		negate := strings.HasPrefix(line, "!")
+		if negate {
+			line = strings.TrimSpace(line[1:])
+			ignore.hasExceptions = true
+		}
+		line = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		regex, err := regexp.Compile(ignorePatternRegex(line))
+		if err != nil {
+			logger.Warning("Ignoring invalid .dockerignore pattern %q: %v", line, err)
+			continue
+		}
+		ignore.patterns = append(ignore.patterns, ignorePattern{regex: regex, negate: negate})
+	}
+	return ignore
+}
+
+// ignorePatternRegex converts a .dockerignore glob to an anchored regular expression
+func ignorePatternRegex(pattern string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					re.WriteString("(.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// excluded reports whether a slash-separated context-relative path is ignored
+func (d *dockerIgnore) excluded(rel string) bool {
+	excluded := false
+	for _, p := range d.patterns {
+		for candidate := rel; candidate != "." && candidate != "/"; candidate = path.Dir(candidate) {
+			if p.regex.MatchString(candidate) {
+				excluded = !p.negate
+				break
+			}
+		}
+	}
+	return excluded
+}
+
+// layerSizeChecker estimates the layers COPY and ADD produce from the build context
+type layerSizeChecker struct {
+	contextDir string
+	maxSize    int64
+	ignore     *dockerIgnore
+	sizes      map[string]int64 // Context-relative path -> size of included files
+}
+
+// size returns the total size of the non-ignored regular files at rel
+func (c *layerSizeChecker) size(rel string) int64 {
+	if size, ok := c.sizes[rel]; ok {
+		return size
+	}
+
+	walked := make(map[string]int64)
+	// #nosec G104 -- best-effort estimation; unreadable files are skipped
+	filepath.Walk(filepath.Join(c.contextDir, rel), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		r, _ := filepath.Rel(c.contextDir, p)
+		r = filepath.ToSlash(r)
+		if info.IsDir() {
+			if !c.ignore.hasExceptions && r != rel && c.ignore.excluded(r) {
+				return filepath.SkipDir
+			}
+			walked[r] += 0
+			return nil
+		}
+		if !info.Mode().IsRegular() || c.ignore.excluded(r) {
+			return nil
+		}
+		for d := r; ; d = path.Dir(d) {
+			walked[d] += info.Size()
+			if d == rel || d == "." {
+				break
+			}
+		}
+		return nil
+	})
+
+	for p, size := range walked {
+		if _, ok := c.sizes[p]; !ok {
+			c.sizes[p] = size
+		}
+	}
+	return walked[rel]
+}
+
+// parseCopyArgs splits COPY/ADD arguments into flags, sources and destination
+func parseCopyArgs(args string) ([]string, []string, string, bool) {
+	if strings.Contains(args, "<<") {
+		return nil, nil, "", false // heredocs are not context files
+	}
+
+	fields := strings.Fields(args)
+	var flags []string
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		flags = append(flags, fields[0])
+		fields = fields[1:]
+	}
+
+	paths := fields
+	if rest := strings.Join(fields, " "); strings.HasPrefix(rest, "[") {
+		if err := json.Unmarshal([]byte(rest), &paths); err != nil {
+			return nil, nil, "", false
+		}
+	}
+	if len(paths) < 2 {
+		return nil, nil, "", false
+	}
+	return flags, paths[:len(paths)-1], paths[len(paths)-1], true
+}
+
+// checkLayerSizes estimates the layer produced by every COPY/ADD from the build
+// context. An oversized layer fails the build, naming the instruction, unless
+// split is set, in which case simple COPY instructions are rewritten into
+// several smaller ones. It returns the resulting Dockerfile and, for each split
+// instruction, its line number and the number of instructions it became.
+func checkLayerSizes(content, contextDir, dockerfilePath, ignoreFile string, maxSize int64, split bool) (string, map[int]int, error) {
+	checker := &layerSizeChecker{
+		contextDir: contextDir,
+		maxSize:    maxSize,
+		ignore:     loadDockerIgnore(contextDir, dockerfilePath, ignoreFile),
+		sizes:      make(map[string]int64),
+	}
+
+	lines := strings.Split(content, "\n")
+	splits := make(map[int]int)
+	replacements := make(map[int]dockerfileInstruction)
+	replacementLines := make(map[int][]string)
+	checked := 0
+
+	for _, inst := range parseDockerfile(content) {
+		if inst.Command != "COPY" && inst.Command != "ADD" {
+			continue
+		}
+		flags, sources, dest, ok := parseCopyArgs(inst.Args)
+		if !ok || hasFlag(flags, "--from") {
+			continue
+		}
+
+		var total int64
+		for _, src := range sources {
+			if strings.Contains(src, "://") || strings.HasPrefix(src, "git@") {
+				continue
+			}
+			if strings.Contains(src, "$") {
+				logger.Debug("Line %d: cannot estimate size of %s (uses a variable)", inst.Line, src)
+				continue
+			}
+			matches, _ := filepath.Glob(filepath.Join(contextDir, filepath.Clean("/"+src)))
+			for _, match := range matches {
+				rel, err := filepath.Rel(contextDir, match)
+				if err == nil {
+					total += checker.size(filepath.ToSlash(rel))
+				}
+			}
+		}
+		checked++
+		logger.Debug("Line %d: %s produces a layer of about %s", inst.Line, inst.Command, formatBytes(total))
+
+		if total <= maxSize {
+			continue
+		}
+
+		desc := fmt.Sprintf("Dockerfile line %d (%s %s)", inst.Line, inst.Command, truncateInstruction(inst.Args))
+		if !split {
+			return "", nil, fmt.Errorf("%s produces a layer of about %s, exceeding --max-layer-size %s (split the sources or use --split-large-layers)",
+				desc, formatBytes(total), formatBytes(maxSize))
+		}
+
+		instructions, err := checker.splitCopy(inst, flags, sources, dest)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s produces a layer of about %s, exceeding --max-layer-size %s, and cannot be split: %v",
+				desc, formatBytes(total), formatBytes(maxSize), err)
+		}
+		logger.Info("Splitting %s (about %s) into %d COPY instructions of at most %s",
+			desc, formatBytes(total), len(instructions), formatBytes(maxSize))
+		splits[inst.Line] = len(instructions)
+		replacements[inst.Line] = inst
+		replacementLines[inst.Line] = append([]string{fmt.Sprintf("# Split by kimia from line %d: %s %s", inst.Line, inst.Command, inst.Args)}, instructions...)
+	}
+
+	logger.Info("Layer size check: %d COPY/ADD instructions estimated against --max-layer-size %s", checked, formatBytes(maxSize))
+	if len(splits) == 0 {
+		return content, nil, nil
+	}
+
+	var result []string
+	for i := 0; i < len(lines); i++ {
+		if inst, ok := replacements[i+1]; ok {
+			result = append(result, replacementLines[inst.Line]...)
+			i = inst.EndLine - 1
+			continue
+		}
+		result = append(result, lines[i])
+	}
+	return strings.Join(result, "\n"), splits, nil
+}
+
+// splitCopy rewrites a COPY of a single context directory into several COPY
+// instructions whose sources each stay under the size limit
+func (c *layerSizeChecker) splitCopy(inst dockerfileInstruction, flags, sources []string, dest string) ([]string, error) {
+	if inst.Command != "COPY" {
+		return nil, fmt.Errorf("only COPY can be split (ADD extracts archives)")
+	}
+	for _, flag := range flags {
+		name := strings.SplitN(flag, "=", 2)[0]
+		if name != "--chown" && name != "--chmod" && name != "--link" {
+			return nil, fmt.Errorf("flag %s is not supported when splitting", name)
+		}
+	}
+	if len(sources) != 1 || !isSplittablePath(sources[0]) {
+		return nil, fmt.Errorf("only a single directory source without wildcards or variables can be split")
+	}
+
+	srcRel := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(sources[0])), "/")
+	if srcRel == "" {
+		srcRel = "."
+	}
+	info, err := os.Lstat(filepath.Join(c.contextDir, srcRel))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is a single file larger than the limit", sources[0])
+	}
+
+	prefix := "COPY "
+	if len(flags) > 0 {
+		prefix += strings.Join(flags, " ") + " "
+	}
+	var groups [][]string
+	if err := c.splitDir(srcRel, dest, &groups); err != nil {
+		return nil, err
+	}
+	if len(groups) > maxSplitInstructions {
+		return nil, fmt.Errorf("it would need %d instructions (limit %d); restructure the COPY or raise --max-layer-size",
+			len(groups), maxSplitInstructions)
+	}
+
+	instructions := make([]string, 0, len(groups))
+	for _, group := range groups {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(group); err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, prefix+strings.TrimSpace(buf.String()))
+	}
+	return instructions, nil
+}
+
+// splitDir packs the entries of a context directory into COPY source groups.
+// Files are combined into shared instructions; each subdirectory gets its own
+// (COPY copies a directory's contents, not the directory itself), and
+// subdirectories that are still too large are split recursively.
+func (c *layerSizeChecker) splitDir(srcRel, dest string, groups *[][]string) error {
+	entries, err := os.ReadDir(filepath.Join(c.contextDir, srcRel))
+	if err != nil {
+		return err
+	}
+	dest = strings.TrimSuffix(dest, "/") + "/"
+
+	var files []string
+	var filesSize int64
+	flush := func() {
+		if len(files) > 0 {
+			*groups = append(*groups, append(files, dest))
+			files, filesSize = nil, 0
+		}
+	}
+
+	for _, entry := range entries {
+		rel := path.Join(srcRel, entry.Name())
+		if !isSplittablePath(entry.Name()) {
+			return fmt.Errorf("%s contains characters that cannot be used in a COPY source", rel)
+		}
+		if entry.Type()&os.ModeSymlink != 0 {
+			// COPY follows symlinks named as sources, which would change the result
+			return fmt.Errorf("%s is a symlink", rel)
+		}
+
+		size := c.size(rel)
+		if c.ignore.excluded(rel) && size == 0 {
+			continue
+		}
+
+		if !entry.IsDir() {
+			if size > c.maxSize {
+				return fmt.Errorf("file %s is %s, larger than the limit", rel, formatBytes(size))
+			}
+			if filesSize+size > c.maxSize {
+				flush()
+			}
+			files = append(files, rel)
+			filesSize += size
+			continue
+		}
+
+		subDest := dest + entry.Name() + "/"
+		if size > c.maxSize {
+			if err := c.splitDir(rel, subDest, groups); err != nil {
+				return err
+			}
+			continue
+		}
+		*groups = append(*groups, []string{rel, subDest})
+	}
+	flush()
+	return nil
+}
+
+// isSplittablePath reports whether p can be named literally as a COPY source
+func isSplittablePath(p string) bool {
+	return p != "" && !strings.ContainsAny(p, "*?[]\\$\n") && !strings.Contains(p, "://")
+}
+
+// hasFlag reports whether flags contains name, with or without a value
+func hasFlag(flags []string, name string) bool {
+	for _, flag := range flags {
+		if flag == name || strings.HasPrefix(flag, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateInstruction shortens instruction text for error messages
+func truncateInstruction(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > 80 {
+		return text[:77] + "..."
+	}
+	return text
+}
+
+// layerInstructionLines returns the line of the instruction that created each
+// layer of the target stage (RUN, COPY and ADD), expanding split instructions
+func layerInstructionLines(content, target string, splits map[int]int) []int {
+	var lines []int
+	inTarget := false
+	for _, inst := range parseDockerfile(content) {
+		switch inst.Command {
+		case "FROM":
+			if inTarget {
+				return lines
+			}
+			lines = nil
+			fields := strings.Fields(inst.Args)
+			for i := 0; i+1 < len(fields); i++ {
+				if strings.EqualFold(fields[i], "AS") && target != "" && strings.EqualFold(fields[i+1], target) {
+					inTarget = true
+				}
+			}
+		case "RUN", "COPY", "ADD":
+			count := splits[inst.Line]
+			if count == 0 {
+				count = 1
+			}
+			for i := 0; i < count; i++ {
+				lines = append(lines, inst.Line)
+			}
+		}
+	}
+	return lines
+}
+
+// shortDigest abbreviates a sha256 digest for display
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
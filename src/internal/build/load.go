@@ -0,0 +1,226 @@
+package build
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// LoadTargets are the values accepted by --load
+var LoadTargets = []string{"auto", "containerd", "docker"}
+
+// Default runtime sockets and containerd namespace used by --load. The k8s.io
+// namespace is where the kubelet (and kind/minikube nodes) look for images.
+const (
+	defaultContainerdSocket    = "/run/containerd/containerd.sock"
+	defaultContainerdNamespace = "k8s.io"
+	defaultDockerSocket        = "/var/run/docker.sock"
+)
+
+// imageLoader imports a docker-archive tar into a local container runtime
+type imageLoader interface {
+	load(tarPath string) error
+	String() string
+}
+
+// containerdLoader imports with ctr, which talks to containerd over its socket
+type containerdLoader struct {
+	socket, namespace string
+}
+
+func (c containerdLoader) load(tarPath string) error {
+	// #nosec G204 -- socket and namespace come from the environment of the build pod, tarPath is a validated path
+	cmd := exec.Command("ctr", "--address", c.socket, "--namespace", c.namespace, "images", "import", tarPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ctr images import failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			logger.Debug("ctr: %s", line)
+		}
+	}
+	return nil
+}
+
+func (c containerdLoader) String() string {
+	return fmt.Sprintf("containerd (%s, namespace %s)", c.socket, c.namespace)
+}
+
+// dockerLoader posts the archive to the Docker Engine API, so no docker CLI is needed
+type dockerLoader struct {
+	socket string
+}
+
+func (d dockerLoader) load(tarPath string) error {
+	// #nosec G304 -- tarPath is a validated path written by this build
+	archive, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image archive: %v", err)
+	}
+	defer archive.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", d.socket)
+		},
+	}}
+	req, err := http.NewRequest(http.MethodPost, "http://docker/images/load?quiet=1", archive)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach docker daemon at %s: %v", d.socket, err)
+	}
+	defer resp.Body.Close()
+
+	// The response is a stream of JSON messages; errors can arrive after a 200
+	var failure string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			failure = strings.TrimSpace(scanner.Text())
+			continue
+		}
+		if msg.Error != "" {
+			failure = msg.Error
+		} else if line := strings.TrimSpace(msg.Stream); line != "" {
+			logger.Debug("docker: %s", line)
+		}
+	}
+	if resp.StatusCode != http.StatusOK || failure != "" {
+		return fmt.Errorf("docker daemon rejected the image (HTTP %d): %s", resp.StatusCode, failure)
+	}
+	return nil
+}
+
+func (d dockerLoader) String() string {
+	return fmt.Sprintf("docker (%s)", d.socket)
+}
+
+// isSocket reports whether path exists and is a unix socket
+func isSocket(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// newContainerdLoader returns the containerd loader when its socket and ctr are available
+func newContainerdLoader() (imageLoader, error) {
+	socket := os.Getenv("CONTAINERD_ADDRESS")
+	if socket == "" {
+		socket = defaultContainerdSocket
+	}
+	socket = strings.TrimPrefix(socket, "unix://")
+	namespace := os.Getenv("CONTAINERD_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+
+	if !isSocket(socket) {
+		return nil, fmt.Errorf("containerd socket %s not found (mount the node's socket or set CONTAINERD_ADDRESS)", socket)
+	}
+	if _, err := exec.LookPath("ctr"); err != nil {
+		return nil, fmt.Errorf("ctr not found in PATH (required to load into containerd)")
+	}
+	return containerdLoader{socket: socket, namespace: namespace}, nil
+}
+
+// newDockerLoader returns the Docker loader when its socket is available
+func newDockerLoader() (imageLoader, error) {
+	socket := defaultDockerSocket
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		if !strings.HasPrefix(host, "unix://") {
+			return nil, fmt.Errorf("DOCKER_HOST %s is not a unix socket", host)
+		}
+		socket = strings.TrimPrefix(host, "unix://")
+	}
+	if !isSocket(socket) {
+		return nil, fmt.Errorf("docker socket %s not found (mount it or set DOCKER_HOST)", socket)
+	}
+	return dockerLoader{socket: socket}, nil
+}
+
+// newImageLoader returns the loader for a --load target. "auto" prefers
+// containerd, which Kubernetes nodes run, and falls back to Docker.
+func newImageLoader(target string) (imageLoader, error) {
+	switch target {
+	case "containerd":
+		return newContainerdLoader()
+	case "docker":
+		return newDockerLoader()
+	case "auto":
+		loader, containerdErr := newContainerdLoader()
+		if containerdErr == nil {
+			return loader, nil
+		}
+		loader, dockerErr := newDockerLoader()
+		if dockerErr == nil {
+			return loader, nil
+		}
+		return nil, fmt.Errorf("no container runtime to load into:\n  %v\n  %v", containerdErr, dockerErr)
+	}
+	return nil, fmt.Errorf("invalid --load value %q (valid: %s)", target, strings.Join(LoadTargets, ", "))
+}
+
+// executeAndLoad runs a build that exports a docker-archive and imports it
+// into the local runtime selected by --load. Without --tar-path the archive is
+// written to a temporary directory and removed afterwards.
+func executeAndLoad(config Config, ctx *Context, execute func(Config, *Context) error) error {
+	loader, loaderErr := newImageLoader(config.Load)
+	if loaderErr != nil && !config.DryRun {
+		return loaderErr
+	}
+
+	if config.TarPath == "" {
+		homeDir := os.Getenv("HOME")
+		if homeDir == "" {
+			homeDir = "/home/kimia"
+		}
+		// Under HOME so the path passes the tar path validation of both builders
+		dir, err := newTempDir(filepath.Clean(homeDir), ".kimia-load-*")
+		if err != nil {
+			return fmt.Errorf("failed to create directory for the image archive: %v", err)
+		}
+		defer removeTemp(dir)
+		config.TarPath = filepath.Join(dir, "image.tar")
+	}
+
+	if err := execute(config, ctx); err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		if loaderErr != nil {
+			logger.Info("Dry run: would load %s into a local runtime (%v)", config.TarPath, loaderErr)
+		} else {
+			logger.Info("Dry run: would load %s into %s", config.TarPath, loader)
+		}
+		return nil
+	}
+
+	logger.Info("Loading image into %s", loader)
+	started := time.Now()
+	if err := loader.load(config.TarPath); err != nil {
+		return fmt.Errorf("failed to load image: %v", err)
+	}
+	logger.Info("Loaded %s in %s", strings.Join(config.Destination, ", "), time.Since(started).Round(time.Millisecond))
+	return nil
+}
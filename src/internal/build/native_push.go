@@ -0,0 +1,195 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Push backends (--push-backend)
+const (
+	PushBackendBuilder = "builder" // The builder pushes (buildah push, or BuildKit during the build)
+	PushBackendNative  = "native"  // Kimia pushes an OCI layout export with its own registry client
+)
+
+// PushBackends lists the valid --push-backend values
+var PushBackends = []string{PushBackendBuilder, PushBackendNative}
+
+// ociIndex is the index.json of an OCI layout
+type ociIndex struct {
+	Manifests []auth.Descriptor `json:"manifests"`
+}
+
+// pushNative exports the built image to an OCI layout with buildah and
+// uploads it to every destination with kimia's registry client. The digests
+// come from the manifest kimia uploads, not from buildah's output. Blobs
+// already in a destination are skipped and blobs uploaded to an earlier
+// destination on the same registry are mounted.
+func pushNative(ctx context.Context, config PushConfig, transport buildahTransport) (map[string]string, []PushedImage, error) {
+	digestMap := make(map[string]string)
+	if transport.remote() {
+		return digestMap, nil, fmt.Errorf("--push-backend=native is not supported with --buildah-remote")
+	}
+	if config.RegistryCertificate != "" {
+		logger.Warning("--registry-certificate is not used by the native push backend; use --ca-bundle instead")
+	}
+
+	// The layout holds the layers as they are uploaded, so they are compressed here
+	exportArgs := append([]string{"push"}, buildahCompressionArgs(config.Compression, config.CompressionLevel)...)
+	exportArgs = append(exportArgs, config.Destinations[0], "oci:<layout>")
+	if config.DryRun {
+		var env []string
+		if config.StorageDriver != "" {
+			env = append(env, fmt.Sprintf("STORAGE_DRIVER=%s", config.StorageDriver))
+		}
+		program, programArgs := transport.commandLine(exportArgs)
+		printDryRunCommand("buildah export command", env, program, programArgs)
+		logger.Info("Dry run: would push the OCI layout natively to %s", strings.Join(config.Destinations, ", "))
+		return digestMap, nil, nil
+	}
+
+	layout, err := newTempDir("", "kimia-push-*")
+	if err != nil {
+		return digestMap, nil, fmt.Errorf("failed to create OCI layout directory: %v", err)
+	}
+	defer removeTemp(layout)
+
+	logger.Info("Exporting %s to an OCI layout", config.Destinations[0])
+	beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "export", config.Destinations[0])
+	defer beat.stop()
+	exportArgs[len(exportArgs)-1] = "oci:" + layout
+	cmd := buildahCommandContext(ctx, transport, exportArgs...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Env = os.Environ()
+	if config.StorageDriver != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("STORAGE_DRIVER=%s", config.StorageDriver))
+	}
+	if err := timeoutError(ctx, cmd.Run(), "image export", "--push-timeout", config.Timeout); err != nil {
+		return digestMap, nil, fmt.Errorf("failed to export image: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	beat.stop()
+
+	image, err := readLayoutImage(layout)
+	if err != nil {
+		return digestMap, nil, err
+	}
+	return pushLayout(ctx, config, layout, image)
+}
+
+// pushLayout uploads image, from the OCI layout in layout, to every
+// destination with kimia's registry client
+func pushLayout(ctx context.Context, config PushConfig, layout string, image layoutImage) (map[string]string, []PushedImage, error) {
+	digestMap := make(map[string]string)
+	retries := config.PushRetry
+	if retries == 0 {
+		retries = 1
+	}
+	var pushed []PushedImage
+	var mountFrom []*auth.Repository
+	for _, dest := range config.Destinations {
+		logger.Info("Pushing image: %s", dest)
+		dst, reference := auth.NewRepository(dest, config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry))
+		dst.ChunkSize = config.ChunkSize
+		dst.Context = ctx
+
+		// Blobs uploaded for an earlier destination on this registry are mounted
+		var src *auth.Repository
+		for _, repo := range mountFrom {
+			if repo.Host == dst.Host {
+				src = repo
+				break
+			}
+		}
+
+		beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "push", dest)
+		var lastErr error
+		for i := 0; i < retries && ctx.Err() == nil; i++ {
+			if i > 0 {
+				logger.Info("Retrying push (attempt %d/%d)...", i+1, retries)
+				time.Sleep(time.Second * time.Duration(i*2))
+			}
+			p := &imageCopier{src: src, layout: layout, dst: dst, jobs: config.Jobs}
+			start := time.Now()
+			if lastErr = p.copyManifest(image.Digest, reference); lastErr == nil {
+				logger.Info("Pushed %s in %s (%d blobs uploaded, %s; %d mounted; %d already present)",
+					dest, time.Since(start).Round(time.Millisecond), p.copied, formatBytes(p.uploaded), p.mounted, p.present)
+				break
+			}
+			// Retrying does not help against missing permissions
+			if strings.Contains(lastErr.Error(), "HTTP 401") || strings.Contains(lastErr.Error(), "HTTP 403") {
+				logger.Warning("Authentication failed for %s", dest)
+				break
+			}
+			logger.Warning("Push attempt %d failed: %v", i+1, lastErr)
+		}
+		beat.stop()
+		if lastErr = timeoutError(ctx, lastErr, "push", "--push-timeout", config.Timeout); lastErr != nil {
+			return digestMap, pushed, fmt.Errorf("failed to push %s: %w", dest, lastErr)
+		}
+
+		digestMap[dest] = image.Digest
+		pushed = append(pushed, PushedImage{Destination: dest, Digest: image.Digest, Size: image.Size, ConfigDigest: image.configDigest})
+		mountFrom = append(mountFrom, dst)
+		logger.Info("Successfully pushed: %s@%s", dest, image.Digest)
+	}
+	return digestMap, pushed, nil
+}
+
+// layoutImage is the image manifest of an OCI layout
+type layoutImage struct {
+	auth.Descriptor
+	configDigest string // "" for an index
+}
+
+// readLayoutImage returns the single image of the OCI layout in dir
+func readLayoutImage(dir string) (layoutImage, error) {
+	var image layoutImage
+	// #nosec G304 -- OCI layout kimia exported
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return image, fmt.Errorf("failed to read OCI layout: %v", err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return image, fmt.Errorf("invalid OCI layout index: %v", err)
+	}
+	if len(index.Manifests) != 1 {
+		return image, fmt.Errorf("OCI layout holds %d images, expected 1", len(index.Manifests))
+	}
+	image.Descriptor = index.Manifests[0]
+
+	path, err := layoutBlobPath(dir, image.Digest)
+	if err != nil {
+		return image, err
+	}
+	// #nosec G304 -- blob of the OCI layout kimia exported
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return image, fmt.Errorf("failed to read manifest %s: %v", image.Digest, err)
+	}
+	var manifest auth.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return image, fmt.Errorf("invalid manifest %s: %v", image.Digest, err)
+	}
+	if len(manifest.Manifests) == 0 {
+		image.configDigest = manifest.Config.Digest
+	}
+	return image, nil
+}
+
+// layoutBlobPath returns the path of blob digest in the OCI layout in dir
+func layoutBlobPath(dir, digest string) (string, error) {
+	if !isDigest(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")), nil
+}
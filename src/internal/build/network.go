@@ -0,0 +1,84 @@
+package build
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseAddHost parses an --add-host value, host:ip or host=ip, where ip may be
+// an IPv6 address
+func ParseAddHost(value string) (string, string, error) {
+	host, ip, ok := strings.Cut(value, "=")
+	if !ok {
+		host, ip, ok = strings.Cut(value, ":")
+	}
+	ip = strings.Trim(ip, "[]")
+	if !ok || host == "" || ip == "" {
+		return "", "", fmt.Errorf("invalid --add-host %q (expected host:ip)", value)
+	}
+	if strings.ContainsAny(host, " \t,=") {
+		return "", "", fmt.Errorf("invalid --add-host %q: invalid host name %q", value, host)
+	}
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid --add-host %q: %q is not an IP address", value, ip)
+	}
+	return host, ip, nil
+}
+
+// NetworkModes are the values of --network
+var NetworkModes = []string{"host", "none", "slirp4netns"}
+
+// buildahNetworkArgs returns the buildah bud flags of --network, --add-host,
+// --dns and --dns-search
+func buildahNetworkArgs(config Config) []string {
+	var args []string
+	if config.Network != "" {
+		args = append(args, "--network="+config.Network)
+	}
+	for _, entry := range config.AddHosts {
+		host, ip, _ := ParseAddHost(entry)
+		args = append(args, "--add-host", host+":"+ip)
+	}
+	for _, server := range config.DNS {
+		args = append(args, "--dns", server)
+	}
+	for _, domain := range config.DNSSearch {
+		args = append(args, "--dns-search", domain)
+	}
+	return args
+}
+
+// buildkitAddHostsOpt returns the Dockerfile frontend option that adds the
+// --add-host entries to /etc/hosts of RUN steps
+func buildkitAddHostsOpt(addHosts []string) string {
+	entries := make([]string, 0, len(addHosts))
+	for _, entry := range addHosts {
+		host, ip, _ := ParseAddHost(entry)
+		entries = append(entries, host+"="+ip)
+	}
+	return "add-hosts=" + strings.Join(entries, ",")
+}
+
+// buildkitDNSConfig returns the buildkitd.toml [dns] section of --dns and
+// --dns-search, which the bundled buildkitd uses for RUN steps
+func buildkitDNSConfig(config Config) string {
+	var sb strings.Builder
+	sb.WriteString("[dns]\n")
+	if len(config.DNS) > 0 {
+		fmt.Fprintf(&sb, "  nameservers = [%s]\n", quoteTOMLStrings(config.DNS))
+	}
+	if len(config.DNSSearch) > 0 {
+		fmt.Fprintf(&sb, "  searchDomains = [%s]\n", quoteTOMLStrings(config.DNSSearch))
+	}
+	return sb.String()
+}
+
+// quoteTOMLStrings renders values as the elements of a TOML string array
+func quoteTOMLStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = fmt.Sprintf("%q", value)
+	}
+	return strings.Join(quoted, ", ")
+}
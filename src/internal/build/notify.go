@@ -0,0 +1,274 @@
+package build
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Payload formats of --notify-format
+const (
+	NotifyFormatGeneric     = "generic-json"
+	NotifyFormatCloudEvents = "cloudevents"
+	NotifyFormatSlack       = "slack"
+)
+
+// NotifyFormats lists the valid --notify-format values
+var NotifyFormats = []string{NotifyFormatGeneric, NotifyFormatCloudEvents, NotifyFormatSlack}
+
+// NotifySignatureHeader carries the HMAC-SHA256 of the body, as sha256=<hex>
+const NotifySignatureHeader = "X-Kimia-Signature-256"
+
+// notifyTimeout bounds each attempt to deliver a notification
+const notifyTimeout = 30 * time.Second
+
+// notifyAttempts is how often a notification is sent before giving up
+const notifyAttempts = 3
+
+// cloudEventTypePrefix is the CloudEvents type of notifications, followed by the status
+const cloudEventTypePrefix = "io.rapidfort.kimia.build."
+
+// NotifyConfig selects where and how build notifications are sent
+type NotifyConfig struct {
+	URL    string
+	Format string // generic-json (default), cloudevents or slack
+	Secret []byte // HMAC key signing the body; nil = unsigned
+}
+
+// NotificationArtifact is a signature or attestation of a pushed image
+type NotificationArtifact struct {
+	Kind string `json:"kind"` // signature, sbom, provenance or the artifact type of an --attach file
+	Ref  string `json:"ref"`
+}
+
+// BuildNotification is the payload posted when a build finishes or fails
+type BuildNotification struct {
+	ID           string                 `json:"id"`
+	Status       string                 `json:"status"` // succeeded or failed
+	Error        string                 `json:"error,omitempty"`
+	Context      string                 `json:"context,omitempty"`
+	Builder      string                 `json:"builder,omitempty"`
+	Destinations []string               `json:"destinations"`
+	Digests      map[string]string      `json:"digests,omitempty"`
+	Artifacts    []NotificationArtifact `json:"artifacts,omitempty"`
+	Started      time.Time              `json:"started"`
+	Finished     time.Time              `json:"finished"`
+	Seconds      float64                `json:"seconds"`
+	Steps        int                    `json:"steps"`
+	CachedSteps  int                    `json:"cachedSteps"`
+}
+
+// NewBuildNotification summarizes the builds of one kimia run. Each target
+// of a multi-target run has its own record.
+func NewBuildNotification(records []*BuildRecord, destinations []string, started time.Time, err error) BuildNotification {
+	n := BuildNotification{
+		ID:           newBuildID(),
+		Status:       "succeeded",
+		Destinations: destinations,
+		Started:      started.UTC(),
+		Finished:     time.Now().UTC(),
+	}
+	n.Seconds = n.Finished.Sub(n.Started).Seconds()
+	if err != nil {
+		n.Status, n.Error = "failed", err.Error()
+	}
+	for i, record := range records {
+		if i == 0 {
+			n.ID, n.Context = record.ID, record.Inputs.Context
+		}
+		if record.Builder != "" {
+			n.Builder = record.Builder
+		}
+		n.Steps += record.Steps
+		n.CachedSteps += record.CachedSteps
+		for dest, digest := range record.Digests {
+			if n.Digests == nil {
+				n.Digests = make(map[string]string)
+			}
+			n.Digests[dest] = digest
+		}
+	}
+	return n
+}
+
+// AddArtifacts lists the cosign signatures, the attestations and the --attach
+// artifacts of the pushed images. Signatures and attachments are in the
+// attestation repository of an image when it has one.
+func (n *BuildNotification) AddArtifacts(signed bool, attestations []string, attachments []Attachment, repos AttestationRepos) {
+	for _, dest := range sortedKeys(n.Digests) {
+		digest := n.Digests[dest]
+		host, repository, _ := auth.ParseImageReference(dest)
+		name := host + "/" + repository
+		stored := name
+		if repo := repos.For(dest); repo != "" {
+			stored = repo
+		}
+		if signed {
+			n.Artifacts = append(n.Artifacts, NotificationArtifact{Kind: "signature", Ref: stored + ":" + auth.ArtifactTag(digest, "sig")})
+		}
+		// Attestations are manifests in the image index; attachments are its referrers
+		for _, kind := range attestations {
+			n.Artifacts = append(n.Artifacts, NotificationArtifact{Kind: kind, Ref: name + "@" + digest})
+		}
+		for _, attachment := range attachments {
+			n.Artifacts = append(n.Artifacts, NotificationArtifact{Kind: attachment.ArtifactType, Ref: stored + "@" + digest})
+		}
+	}
+}
+
+// Notify posts the notification to the webhook, signed with the secret.
+// Network errors and 429 and 5xx responses are retried.
+func Notify(config NotifyConfig, n BuildNotification) error {
+	body, contentType, err := notificationBody(config.Format, n)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	for attempt := 1; ; attempt++ {
+		err = postNotification(client, config, body, contentType)
+		if err == nil {
+			logger.Info("Sent build notification to %s", redactURL(config.URL))
+			return nil
+		}
+		retry, ok := err.(retryableNotifyError)
+		if !ok || attempt == notifyAttempts {
+			return fmt.Errorf("build notification to %s failed: %v", redactURL(config.URL), err)
+		}
+		logger.Debug("Build notification attempt %d failed: %v", attempt, retry.err)
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+}
+
+// retryableNotifyError is a delivery failure worth another attempt
+type retryableNotifyError struct{ err error }
+
+func (e retryableNotifyError) Error() string { return e.err.Error() }
+
+// postNotification makes one delivery attempt
+func postNotification(client *http.Client, config NotifyConfig, body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "kimia")
+	if len(config.Secret) > 0 {
+		req.Header.Set(NotifySignatureHeader, SignNotification(config.Secret, body))
+	}
+
+	// #nosec G107 -- URL given by the user with --notify-url
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL in the error may hold the webhook's secret
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return retryableNotifyError{err}
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	err = fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return retryableNotifyError{err}
+	}
+	return err
+}
+
+// SignNotification returns the value of the signature header of body
+func SignNotification(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notificationBody renders the notification in the format of --notify-format
+func notificationBody(format string, n BuildNotification) ([]byte, string, error) {
+	switch format {
+	case "", NotifyFormatGeneric:
+		body, err := json.Marshal(n)
+		return body, "application/json", err
+
+	case NotifyFormatCloudEvents:
+		source := "kimia"
+		if host, err := os.Hostname(); err == nil && host != "" {
+			source = "kimia/" + host
+		}
+		subject := ""
+		if len(n.Destinations) > 0 {
+			subject = n.Destinations[0]
+		}
+		// Structured content mode of the CloudEvents HTTP binding
+		body, err := json.Marshal(map[string]interface{}{
+			"specversion":     "1.0",
+			"id":              n.ID,
+			"source":          source,
+			"type":            cloudEventTypePrefix + n.Status,
+			"subject":         subject,
+			"time":            n.Finished.Format(time.RFC3339),
+			"datacontenttype": "application/json",
+			"data":            n,
+		})
+		return body, "application/cloudevents+json", err
+
+	case NotifyFormatSlack:
+		body, err := json.Marshal(map[string]string{"text": slackText(n)})
+		return body, "application/json", err
+	}
+	return nil, "", fmt.Errorf("invalid notification format %q (valid: %s)", format, strings.Join(NotifyFormats, ", "))
+}
+
+// redactURL strips the path and query of a webhook URL for logging; Slack
+// and similar webhooks carry their secret in the path
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "the webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// slackText renders the notification as a Slack message
+func slackText(n BuildNotification) string {
+	var b strings.Builder
+	icon := ":white_check_mark:"
+	if n.Status != "succeeded" {
+		icon = ":x:"
+	}
+	fmt.Fprintf(&b, "%s Kimia build %s in %s", icon, n.Status, formatSeconds(n.Seconds))
+	if n.Context != "" {
+		fmt.Fprintf(&b, " (%s)", n.Context)
+	}
+	if n.Steps > 0 {
+		fmt.Fprintf(&b, ", %d of %d steps cached", n.CachedSteps, n.Steps)
+	}
+	dests := append([]string{}, n.Destinations...)
+	sort.Strings(dests)
+	for _, dest := range dests {
+		if digest := n.Digests[dest]; digest != "" {
+			fmt.Fprintf(&b, "\n• `%s@%s`", dest, digest)
+		} else {
+			fmt.Fprintf(&b, "\n• `%s`", dest)
+		}
+	}
+	if n.Error != "" {
+		fmt.Fprintf(&b, "\n```%s```", truncate(n.Error, 500))
+	}
+	return b.String()
+}
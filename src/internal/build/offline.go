@@ -0,0 +1,378 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Annotations naming the images of an OCI layout: the OCI reference name
+// (skopeo, buildah, crane) and the full name written by `ctr images export`
+const (
+	ociRefNameAnnotation       = "org.opencontainers.image.ref.name"
+	containerdImageAnnotation  = "io.containerd.image.name"
+	offlineLayoutStoreID       = "kimia-offline"
+	containerdImageStorePrefix = "containerd"
+)
+
+// ImageStore is the local store --offline builds take their base images from
+type ImageStore struct {
+	Spec   string                // --image-store value
+	Layout string                // OCI layout holding the base images
+	Images map[string]storeImage // Base image reference as written in FROM -> image in Layout
+	temp   string                // Layout exported from containerd, removed by Close
+}
+
+// storeImage is an image of the OCI layout of an ImageStore
+type storeImage struct {
+	auth.Descriptor
+	index int // Position in index.json, which names it for Buildah's oci: transport
+}
+
+// OpenImageStore checks that every base image needed to build targets is in
+// the store given by --image-store and returns the store. An OCI layout
+// directory is read directly; "containerd" or "containerd://NAMESPACE" reads
+// the node's containerd through its socket and exports the base images to a
+// temporary OCI layout. All missing images are reported at once.
+func OpenImageStore(config Config, ctx *Context, spec string, targets []string) (*ImageStore, error) {
+	if ctx.Path == "" {
+		return nil, fmt.Errorf("--offline requires a local build context")
+	}
+	images, err := offlineBaseImages(config, ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &ImageStore{Spec: spec, Layout: spec, Images: make(map[string]storeImage)}
+	if len(images) == 0 {
+		return store, nil
+	}
+	if spec == containerdImageStorePrefix || strings.HasPrefix(spec, containerdImageStorePrefix+"://") {
+		if err := store.exportFromContainerd(images, config); err != nil {
+			store.Close()
+			return nil, err
+		}
+	} else {
+		if _, err := os.Stat(filepath.Join(spec, "io.containerd.content.v1.content")); err == nil {
+			return nil, fmt.Errorf("%s is a containerd root; its image names live in containerd's database, use --image-store=containerd to read it through the containerd socket", spec)
+		}
+	}
+
+	entries, err := readLayoutIndex(store.Layout)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	var missing []string
+	for _, image := range images {
+		entry, ok := findStoreImage(entries, image)
+		if !ok {
+			missing = append(missing, image)
+			continue
+		}
+		path, err := layoutBlobPath(store.Layout, entry.Digest)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			missing = append(missing, image+" (manifest "+entry.Digest+" missing from the layout)")
+			continue
+		}
+		store.Images[image] = entry
+		logger.Info("Base image %s: %s in %s", image, entry.Digest, spec)
+	}
+	if len(missing) > 0 {
+		store.Close()
+		return nil, fmt.Errorf("--offline: base images not found in %s:\n  %s", spec, strings.Join(missing, "\n  "))
+	}
+	return store, nil
+}
+
+// Close removes the layout exported from containerd
+func (s *ImageStore) Close() {
+	if s != nil && s.temp != "" {
+		removeTemp(s.temp)
+		s.temp = ""
+	}
+}
+
+// offlineBaseImages returns the base images FROM instructions of the
+// targets pull, after ARG expansion and --base-image-rewrite
+func offlineBaseImages(config Config, ctx *Context, targets []string) ([]string, error) {
+	if len(targets) == 0 {
+		targets = []string{config.Target}
+	}
+	seen := make(map[string]bool)
+	var images []string
+	for _, target := range targets {
+		targetConfig := config
+		targetConfig.Target = target
+		plan, err := GeneratePlan(targetConfig, ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if plan.HasErrors() {
+			return nil, fmt.Errorf("--offline: cannot resolve base images: %s", strings.Join(plan.Errors, "; "))
+		}
+		for _, stage := range plan.Stages {
+			if !stage.Required || stage.BaseImage == "" || stage.BaseImage == "scratch" || seen[stage.BaseImage] {
+				continue
+			}
+			seen[stage.BaseImage] = true
+			images = append(images, stage.BaseImage)
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// offlineImageKey returns the fully qualified form of ref used to match
+// store names, with the implied :latest tag
+func offlineImageKey(ref string) string {
+	ref = NormalizeImageReference(ref)
+	if name, suffix := splitReferenceSuffix(ref); suffix == "" {
+		ref = name + ":latest"
+	}
+	return ref
+}
+
+// readLayoutIndex returns the images listed in index.json of an OCI layout
+func readLayoutIndex(dir string) ([]storeImage, error) {
+	// #nosec G304 -- image store given by the user with --image-store
+	data, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("--image-store %s is not an OCI layout: %v", dir, err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid OCI layout index in %s: %v", dir, err)
+	}
+	entries := make([]storeImage, 0, len(index.Manifests))
+	for i, desc := range index.Manifests {
+		entries = append(entries, storeImage{Descriptor: desc, index: i})
+	}
+	return entries, nil
+}
+
+// findStoreImage returns the layout entry of a base image. A digest-pinned
+// reference matches by digest; otherwise the full name of the entry, from
+// either annotation, must equal the reference. Bare tags such as "3.19" name
+// no repository and never match.
+func findStoreImage(entries []storeImage, ref string) (storeImage, bool) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		digest := ref[i+1:]
+		for _, entry := range entries {
+			if entry.Digest == digest {
+				return entry, true
+			}
+		}
+		return storeImage{}, false
+	}
+	key := offlineImageKey(ref)
+	for _, entry := range entries {
+		for _, name := range []string{entry.Annotations[containerdImageAnnotation], entry.Annotations[ociRefNameAnnotation]} {
+			if strings.Contains(name, "/") && offlineImageKey(name) == key {
+				return entry, true
+			}
+		}
+	}
+	return storeImage{}, false
+}
+
+// exportFromContainerd exports the base images from the node's containerd
+// into a temporary OCI layout
+func (s *ImageStore) exportFromContainerd(images []string, config Config) error {
+	loader, err := newContainerdLoader()
+	if err != nil {
+		return err
+	}
+	ctrd := loader.(containerdLoader)
+	if namespace, ok := strings.CutPrefix(s.Spec, containerdImageStorePrefix+"://"); ok && namespace != "" {
+		ctrd.namespace = namespace
+	}
+
+	// #nosec G204 -- socket and namespace come from the environment of the build pod or --image-store
+	output, err := exec.Command("ctr", "--address", ctrd.socket, "--namespace", ctrd.namespace, "images", "ls").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list containerd images: %v", err)
+	}
+	names := make(map[string]string) // offlineImageKey or digest -> containerd name
+	for _, line := range strings.Split(string(output), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		names[offlineImageKey(fields[0])] = fields[0]
+		names[fields[2]] = fields[0]
+	}
+
+	var refs, missing []string
+	for _, image := range images {
+		key := offlineImageKey(image)
+		if i := strings.Index(image, "@"); i >= 0 {
+			key = image[i+1:]
+		}
+		if name, ok := names[key]; ok {
+			refs = append(refs, name)
+		} else {
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("--offline: base images not found in containerd namespace %s:\n  %s", ctrd.namespace, strings.Join(missing, "\n  "))
+	}
+
+	if s.temp, err = newTempDir("", "kimia-image-store-*"); err != nil {
+		return fmt.Errorf("failed to create image store directory: %v", err)
+	}
+	s.Layout = filepath.Join(s.temp, "layout")
+	archive := filepath.Join(s.temp, "images.tar")
+	args := []string{"--address", ctrd.socket, "--namespace", ctrd.namespace, "images", "export"}
+	if config.CustomPlatform != "" {
+		for _, platform := range strings.Split(config.CustomPlatform, ",") {
+			args = append(args, "--platform", platform)
+		}
+	}
+	args = append(append(args, archive), refs...)
+	logger.Info("Exporting %d base images from containerd (%s)", len(refs), ctrd.namespace)
+	// #nosec G204 -- image names listed by containerd itself
+	if output, err := exec.Command("ctr", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ctr images export failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// #nosec G304 -- archive written by ctr above
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// #nosec G301 -- temporary layout of the build user
+	if err := os.Mkdir(s.Layout, 0700); err != nil {
+		return err
+	}
+	if _, err := extractStorageArchive(file, s.Layout); err != nil {
+		return fmt.Errorf("failed to unpack containerd export: %v", err)
+	}
+	removeTemp(archive)
+	return nil
+}
+
+// buildahLoadOfflineImages copies the base images from the store into
+// Buildah's storage under the names the Dockerfile uses, so the build runs
+// with --pull=never
+func buildahLoadOfflineImages(config Config, transport buildahTransport) error {
+	store := config.ImageStore
+	images := make([]string, 0, len(store.Images))
+	for image := range store.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	var env []string
+	if config.StorageDriver != "" {
+		env = append(env, fmt.Sprintf("STORAGE_DRIVER=%s", config.StorageDriver))
+	}
+	for _, image := range images {
+		entry := store.Images[image]
+		// Reference names may be bare tags shared by several images
+		source := fmt.Sprintf("oci:%s:@%d", store.Layout, entry.index)
+		pullArgs := []string{"pull", "--quiet"}
+		if config.CustomPlatform != "" {
+			pullArgs = append(pullArgs, "--platform", config.CustomPlatform)
+		}
+		pullArgs = append(pullArgs, source)
+		// A digest-pinned reference is found by digest under its repository
+		// name; the tag only keeps it from posing as :latest
+		name := NormalizeImageReference(image)
+		if i := strings.Index(name, "@"); i >= 0 {
+			repository, _ := splitReferenceSuffix(name[:i])
+			name = repository + ":" + strings.Replace(name[i+1:], ":", "-", 1)
+		}
+		tagArgs := []string{"tag", "<image-id>", name}
+
+		if config.DryRun {
+			program, programArgs := transport.commandLine(pullArgs)
+			printDryRunCommand("buildah command loading "+image, env, program, programArgs)
+			program, programArgs = transport.commandLine(tagArgs)
+			printDryRunCommand("buildah command naming "+image, env, program, programArgs)
+			continue
+		}
+
+		cmd := buildahCommand(transport, pullArgs...)
+		cmd.Env = append(os.Environ(), env...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("failed to load %s from %s: %v: %s", image, store.Spec, err, strings.TrimSpace(stderr.String()))
+		}
+		id := strings.TrimSpace(string(output))
+		if lines := strings.Split(id, "\n"); len(lines) > 1 {
+			id = lines[len(lines)-1]
+		}
+		tagArgs[1] = id
+		cmd = buildahCommand(transport, tagArgs...)
+		cmd.Env = append(os.Environ(), env...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to name %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+		}
+		logger.Info("Loaded base image %s from %s", image, store.Spec)
+	}
+	return nil
+}
+
+// buildkitOfflineArgs maps every base image to the store's OCI layout as a
+// named build context, so BuildKit never resolves it in a registry
+func buildkitOfflineArgs(store *ImageStore) []string {
+	args := []string{"--oci-layout", offlineLayoutStoreID + "=" + store.Layout}
+	images := make([]string, 0, len(store.Images))
+	for image := range store.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		args = append(args, "--opt", fmt.Sprintf("context:%s=oci-layout://%s@%s",
+			familiarImageName(image), offlineLayoutStoreID, store.Images[image].Digest))
+	}
+	return args
+}
+
+// familiarImageName returns the short form of ref under which the Dockerfile
+// frontend looks up named contexts ("docker.io/library/alpine:latest" -> "alpine")
+func familiarImageName(ref string) string {
+	ref = NormalizeImageReference(ref)
+	if rest, ok := strings.CutPrefix(ref, "docker.io/library/"); ok {
+		ref = rest
+	} else if rest, ok := strings.CutPrefix(ref, "docker.io/"); ok {
+		ref = rest
+	}
+	return strings.TrimSuffix(ref, ":latest")
+}
+
+// dockerfileSyntax returns the image of a "# syntax=" directive, which
+// BuildKit pulls to parse the Dockerfile
+func dockerfileSyntax(path string) string {
+	// #nosec G304 -- Dockerfile within the build context
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if match := syntaxDirectiveRegex.FindStringSubmatch(line); match != nil {
+			return match[2]
+		}
+	}
+	return ""
+}
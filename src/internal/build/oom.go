@@ -0,0 +1,123 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sigkillExitRegex matches a RUN step that exited with 137 (128 + SIGKILL),
+// which is how processes killed by the OOM killer are reported
+var sigkillExitRegex = regexp.MustCompile(`exit (?:code|status):? 137\b`)
+
+// oomWatch detects that the kernel OOM killer stopped a build. The OOM kill
+// counter of the container's cgroup is read before and after the build; when
+// it cannot be read, a RUN step or builder killed by SIGKILL is reported as a
+// probable OOM kill.
+type oomWatch struct {
+	kills int64 // OOM kills before the build, -1 if unknown
+}
+
+// startOOMWatch records the OOM kills so far
+func startOOMWatch() oomWatch {
+	return oomWatch{kills: cgroupOOMKills()}
+}
+
+// check returns an error explaining an OOM kill when the build that failed
+// with err (output: its log, failed: the step that failed if known) was
+// stopped by the OOM killer, or nil
+func (w oomWatch) check(err error, output string, failed *StepTiming) error {
+	if err == nil {
+		return nil
+	}
+	killed := sigkillExitRegex.MatchString(output) || killedBySIGKILL(err)
+
+	var cause string
+	kills := cgroupOOMKills()
+	switch {
+	case w.kills >= 0 && kills > w.kills:
+		cause = fmt.Sprintf("the kernel OOM killer killed %d process(es) of this container", kills-w.kills)
+	case w.kills < 0 && killed:
+		cause = "it was killed with SIGKILL (exit code 137), most likely by the kernel OOM killer"
+	default:
+		return nil
+	}
+
+	what := "a build process (buildkitd, buildah or a RUN step)"
+	if failed != nil {
+		what = fmt.Sprintf("%s (stage %s, step %s)", truncate(failed.Instruction, 72), failed.Stage, failed.Step)
+	}
+	return fmt.Errorf("out of memory in %s: %s; raise the memory limit of the build pod (resources.limits.memory) or make the step use less memory, e.g. with fewer parallel jobs", what, cause)
+}
+
+// killedBySIGKILL reports whether err is a command killed by SIGKILL
+func killedBySIGKILL(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
+
+// failedStep returns the step that failed, or nil
+func failedStep(steps []StepTiming) *StepTiming {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].Status == stepError {
+			return &steps[i]
+		}
+	}
+	return nil
+}
+
+// cgroupOOMKills returns the number of processes of this container's cgroup
+// killed by the OOM killer, from memory.events (cgroup v2) or
+// memory.oom_control (cgroup v1), or -1 when neither can be read
+func cgroupOOMKills() int64 {
+	for _, path := range oomEventFiles() {
+		// #nosec G304 -- cgroup files below /sys/fs/cgroup
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "oom_kill" {
+				if kills, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+					return kills
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// oomEventFiles returns the cgroup files that may hold the OOM kill count of
+// this process, most specific first
+func oomEventFiles() []string {
+	var files []string
+	// #nosec G304 -- fixed proc path
+	if data, err := os.ReadFile("/proc/self/cgroup"); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			// hierarchy-ID:controllers:path
+			parts := strings.SplitN(line, ":", 3)
+			if len(parts) != 3 || strings.Contains(parts[2], "..") {
+				continue
+			}
+			switch {
+			case parts[0] == "0" && parts[1] == "":
+				files = append(files, filepath.Join("/sys/fs/cgroup", parts[2], "memory.events"))
+			case strings.Contains(","+parts[1]+",", ",memory,"):
+				files = append(files, filepath.Join("/sys/fs/cgroup/memory", parts[2], "memory.oom_control"))
+			}
+		}
+	}
+	// With a cgroup namespace the container's cgroup is the root
+	return append(files, "/sys/fs/cgroup/memory.events", "/sys/fs/cgroup/memory/memory.oom_control")
+}
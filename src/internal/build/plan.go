@@ -0,0 +1,641 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// PlanInstruction is a single Dockerfile instruction with its estimated cache key
+type PlanInstruction struct {
+	Line     int
+	Command  string
+	Text     string
+	CacheKey string
+}
+
+// PlanStage describes one build stage
+type PlanStage struct {
+	Index        int
+	Name         string
+	BaseImage    string // Image reference after ARG expansion (empty for stage bases)
+	BaseStage    string // Parent stage when FROM refers to an earlier stage
+	Digest       string
+	Platform     string
+	Required     bool // Needed to build the selected target
+	Instructions []PlanInstruction
+}
+
+// PlanMount is a secret or SSH mount required by a RUN instruction
+type PlanMount struct {
+	Type  string // secret or ssh
+	ID    string
+	Stage string
+	Line  int
+}
+
+// Plan is the result of resolving a Dockerfile without building it
+type Plan struct {
+	Dockerfile string
+	Target     string
+	BuildArgs  map[string]string
+	Stages     []PlanStage
+	Mounts     []PlanMount
+	Warnings   []string
+	Errors     []string
+}
+
+// HasErrors reports whether the plan found problems that would fail the build
+func (p *Plan) HasErrors() bool {
+	return len(p.Errors) > 0
+}
+
+// dockerfileInstruction is a logical Dockerfile instruction (continuations joined)
+type dockerfileInstruction struct {
+	Line    int
+	EndLine int // Last physical line, including continuations and heredoc bodies
+	Command string
+	Args    string
+}
+
+// parseDockerfile splits a Dockerfile into logical instructions, joining line
+// continuations and skipping comments. Heredoc bodies are kept with their
+// instruction so that they contribute to the cache key.
+func parseDockerfile(content string) []dockerfileInstruction {
+	escape := `\`
+	var instructions []dockerfileInstruction
+	var current strings.Builder
+	startLine := 0
+	heredocEnd := ""
+	inPreamble := true
+
+	lines := strings.Split(content, "\n")
+	for i, raw := range lines {
+		line := strings.TrimRight(raw, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if heredocEnd != "" {
+			current.WriteString("\n" + line)
+			if trimmed == heredocEnd {
+				heredocEnd = ""
+				instructions = append(instructions, newInstruction(startLine, i+1, current.String()))
+				current.Reset()
+			}
+			continue
+		}
+
+		if inPreamble && strings.HasPrefix(trimmed, "#") {
+			directive := strings.TrimSpace(strings.TrimPrefix(trimmed, "#"))
+			if strings.HasPrefix(strings.ToLower(directive), "escape=") {
+				escape = strings.TrimSpace(directive[len("escape="):])
+			}
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		inPreamble = false
+
+		if current.Len() == 0 {
+			startLine = i + 1
+		} else {
+			current.WriteString(" ")
+		}
+
+		if strings.HasSuffix(trimmed, escape) {
+			current.WriteString(strings.TrimSpace(strings.TrimSuffix(trimmed, escape)))
+			continue
+		}
+		current.WriteString(trimmed)
+
+		if marker := heredocMarker(current.String()); marker != "" {
+			heredocEnd = marker
+			continue
+		}
+
+		instructions = append(instructions, newInstruction(startLine, i+1, current.String()))
+		current.Reset()
+	}
+
+	if current.Len() > 0 {
+		instructions = append(instructions, newInstruction(startLine, len(lines), current.String()))
+	}
+	return instructions
+}
+
+func newInstruction(line, endLine int, text string) dockerfileInstruction {
+	parts := strings.SplitN(text, " ", 2)
+	inst := dockerfileInstruction{Line: line, EndLine: endLine, Command: strings.ToUpper(parts[0])}
+	if len(parts) == 2 {
+		inst.Args = strings.TrimSpace(parts[1])
+	}
+	return inst
+}
+
+// heredocMarker returns the terminator of a heredoc started on this line, if any
+func heredocMarker(text string) string {
+	idx := strings.Index(text, "<<")
+	if idx < 0 {
+		return ""
+	}
+	marker := strings.TrimPrefix(text[idx+2:], "-")
+	marker = strings.Fields(marker + " ")[0]
+	marker = strings.Trim(marker, `"'`)
+	if marker == "" || !isHeredocWord(marker) {
+		return ""
+	}
+	return marker
+}
+
+func isHeredocWord(s string) bool {
+	for _, r := range s {
+		if !(r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// GeneratePlan parses and resolves a Dockerfile without executing the build.
+// When resolve is true, base image digests are looked up in their registries
+// and unreachable images are reported as errors.
+func GeneratePlan(config Config, ctx *Context, resolve bool) (*Plan, error) {
+	dockerfilePath := config.Dockerfile
+	if dockerfilePath == "" {
+		dockerfilePath = "Dockerfile"
+	}
+	if !filepath.IsAbs(dockerfilePath) {
+		dockerfilePath = filepath.Join(ctx.Path, dockerfilePath)
+	}
+
+	// #nosec G304 -- dockerfilePath is the user-specified Dockerfile within the build context
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+
+	rules, err := ParseBaseImageRewrites(config.BaseImageRewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Dockerfile: dockerfilePath,
+		Target:     config.Target,
+		BuildArgs:  make(map[string]string),
+	}
+
+	instructions := parseDockerfile(string(content))
+	globalArgs := make(map[string]string)
+	declaredArgs := make(map[string]bool)
+	stageIndex := make(map[string]int)
+	deps := make(map[int][]int)
+	var cacheKey string
+
+	for _, inst := range instructions {
+		switch inst.Command {
+		case "ARG":
+			for _, decl := range strings.Fields(inst.Args) {
+				kv := strings.SplitN(decl, "=", 2)
+				name := kv[0]
+				declaredArgs[name] = true
+
+				// Args given without a value were already read from the environment
+				value, provided := config.BuildArgs[name]
+				if !provided {
+					if len(kv) == 2 {
+						value = strings.Trim(kv[1], `"'`)
+					} else if len(plan.Stages) > 0 {
+						// A bare ARG inside a stage inherits the global default
+						value = globalArgs[name]
+					}
+				}
+				if !provided && value == "" && len(kv) == 1 && !isPredefinedArg(name) {
+					plan.Warnings = append(plan.Warnings,
+						fmt.Sprintf("line %d: ARG %s has no default and no --build-arg value", inst.Line, name))
+				}
+
+				if len(plan.Stages) == 0 {
+					globalArgs[name] = value
+				}
+				plan.BuildArgs[name] = value
+			}
+
+		case "FROM":
+			stage, problem := planFromStage(inst, len(plan.Stages), globalArgs, config.BuildArgs, stageIndex, rules)
+			if problem != "" {
+				plan.Errors = append(plan.Errors, problem)
+			}
+			if stage.BaseStage != "" {
+				parent := stageIndex[strings.ToLower(stage.BaseStage)]
+				deps[stage.Index] = append(deps[stage.Index], parent)
+				cacheKey = lastCacheKey(plan.Stages[parent])
+			} else {
+				cacheKey = hashStrings("FROM", stage.BaseImage)
+			}
+			if stage.Name != "" {
+				stageIndex[strings.ToLower(stage.Name)] = stage.Index
+			}
+			stage.Instructions = append(stage.Instructions, PlanInstruction{
+				Line: inst.Line, Command: inst.Command, Text: inst.Command + " " + inst.Args, CacheKey: cacheKey,
+			})
+			plan.Stages = append(plan.Stages, stage)
+
+		default:
+			if len(plan.Stages) == 0 {
+				plan.Errors = append(plan.Errors, fmt.Sprintf("line %d: %s before first FROM", inst.Line, inst.Command))
+				continue
+			}
+			stage := &plan.Stages[len(plan.Stages)-1]
+
+			for _, from := range instructionStageRefs(inst) {
+				if idx, ok := resolveStageRef(from, stageIndex, stage.Index); ok {
+					deps[stage.Index] = append(deps[stage.Index], idx)
+				}
+			}
+
+			if inst.Command == "RUN" {
+				plan.Mounts = append(plan.Mounts, runMounts(inst, stage.Name, stage.Index)...)
+			}
+
+			cacheKey = hashStrings(cacheKey, inst.Command, inst.Args, sourceDigest(inst, ctx.Path, stageIndex))
+			stage.Instructions = append(stage.Instructions, PlanInstruction{
+				Line: inst.Line, Command: inst.Command, Text: inst.Command + " " + inst.Args, CacheKey: cacheKey,
+			})
+		}
+	}
+
+	if len(plan.Stages) == 0 {
+		plan.Errors = append(plan.Errors, "Dockerfile contains no FROM instruction")
+		return plan, nil
+	}
+
+	// Build args that no ARG instruction consumes are ignored by the builder
+	for name := range config.BuildArgs {
+		if !declaredArgs[name] && !isPredefinedArg(name) {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("build arg %s is not declared by any ARG instruction", name))
+		}
+	}
+
+	// Mark stages required for the target (default: last stage)
+	targetIdx := len(plan.Stages) - 1
+	if config.Target != "" {
+		idx, ok := stageIndex[strings.ToLower(config.Target)]
+		if !ok {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("target stage %q not found in Dockerfile", config.Target))
+		} else {
+			targetIdx = idx
+		}
+	}
+	markRequired(plan, deps, targetIdx)
+
+	if resolve {
+		resolvePlanDigests(plan, config)
+	}
+
+	sort.Slice(plan.Mounts, func(i, j int) bool { return plan.Mounts[i].Line < plan.Mounts[j].Line })
+	return plan, nil
+}
+
+// planFromStage builds a PlanStage from a FROM instruction
+func planFromStage(inst dockerfileInstruction, index int, globalArgs, buildArgs map[string]string,
+	stageIndex map[string]int, rules []BaseImageRewrite) (PlanStage, string) {
+	stage := PlanStage{Index: index}
+	fields := strings.Fields(inst.Args)
+
+	imageIdx := 0
+	for imageIdx < len(fields) && strings.HasPrefix(fields[imageIdx], "--") {
+		if strings.HasPrefix(fields[imageIdx], "--platform=") {
+			stage.Platform = expandDockerfileArgs(strings.TrimPrefix(fields[imageIdx], "--platform="), globalArgs, buildArgs)
+		}
+		imageIdx++
+	}
+	if imageIdx >= len(fields) {
+		return stage, fmt.Sprintf("line %d: FROM without an image", inst.Line)
+	}
+	if imageIdx+2 < len(fields) && strings.EqualFold(fields[imageIdx+1], "AS") {
+		stage.Name = fields[imageIdx+2]
+	}
+
+	image := expandDockerfileArgs(fields[imageIdx], globalArgs, buildArgs)
+	if strings.Contains(image, "$") {
+		return stage, fmt.Sprintf("line %d: base image %s uses a build argument with no value (pass --build-arg or add an ARG default)",
+			inst.Line, fields[imageIdx])
+	}
+
+	if _, ok := stageIndex[strings.ToLower(image)]; ok {
+		stage.BaseStage = image
+		return stage, ""
+	}
+
+	if rewritten, ok := RewriteImageReference(image, rules); ok {
+		image = rewritten
+	}
+	stage.BaseImage = image
+	return stage, ""
+}
+
+// instructionStageRefs returns --from values used by COPY and RUN --mount
+func instructionStageRefs(inst dockerfileInstruction) []string {
+	var refs []string
+	for _, field := range strings.Fields(inst.Args) {
+		if strings.HasPrefix(field, "--from=") {
+			refs = append(refs, strings.TrimPrefix(field, "--from="))
+		}
+		if strings.HasPrefix(field, "--mount=") {
+			for _, opt := range strings.Split(strings.TrimPrefix(field, "--mount="), ",") {
+				if strings.HasPrefix(opt, "from=") {
+					refs = append(refs, strings.TrimPrefix(opt, "from="))
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// resolveStageRef maps a stage name or index to a stage index
+func resolveStageRef(ref string, stageIndex map[string]int, current int) (int, bool) {
+	if idx, ok := stageIndex[strings.ToLower(ref)]; ok {
+		return idx, true
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 0 && n < current {
+		return n, true
+	}
+	return 0, false
+}
+
+// runMounts extracts secret and ssh mounts from a RUN instruction
+func runMounts(inst dockerfileInstruction, stageName string, stageIdx int) []PlanMount {
+	if stageName == "" {
+		stageName = strconv.Itoa(stageIdx)
+	}
+
+	var mounts []PlanMount
+	for _, field := range strings.Fields(inst.Args) {
+		if !strings.HasPrefix(field, "--mount=") {
+			continue
+		}
+		opts := make(map[string]string)
+		for _, opt := range strings.Split(strings.TrimPrefix(field, "--mount="), ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) == 2 {
+				opts[kv[0]] = kv[1]
+			}
+		}
+
+		switch opts["type"] {
+		case "secret":
+			id := opts["id"]
+			if id == "" {
+				// BuildKit defaults the id to the basename of the target
+				id = filepath.Base(opts["target"])
+				if id == "." || id == "/" {
+					id = opts["dst"]
+				}
+			}
+			mounts = append(mounts, PlanMount{Type: "secret", ID: id, Stage: stageName, Line: inst.Line})
+		case "ssh":
+			id := opts["id"]
+			if id == "" {
+				id = "default"
+			}
+			mounts = append(mounts, PlanMount{Type: "ssh", ID: id, Stage: stageName, Line: inst.Line})
+		}
+	}
+	return mounts
+}
+
+// sourceDigest hashes the build context files referenced by COPY/ADD so that
+// estimated cache keys change when the sources change
+func sourceDigest(inst dockerfileInstruction, contextPath string, stageIndex map[string]int) string {
+	if inst.Command != "COPY" && inst.Command != "ADD" {
+		return ""
+	}
+
+	var sources []string
+	for _, field := range strings.Fields(inst.Args) {
+		if strings.HasPrefix(field, "--") {
+			if strings.HasPrefix(field, "--from=") {
+				// Copies from stages/images are keyed by the source stage, not the context
+				return "from:" + strings.TrimPrefix(field, "--from=")
+			}
+			continue
+		}
+		sources = append(sources, field)
+	}
+	if len(sources) < 2 || contextPath == "" {
+		return ""
+	}
+	sources = sources[:len(sources)-1] // last field is the destination
+
+	h := sha256.New()
+	for _, src := range sources {
+		if strings.Contains(src, "://") || strings.HasPrefix(src, "<<") {
+			io.WriteString(h, src)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(contextPath, filepath.Clean("/"+src)))
+		sort.Strings(matches)
+		for _, match := range matches {
+			hashPath(h, match)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashPath writes the relative paths and contents of a file or directory tree to h
+func hashPath(h io.Writer, root string) {
+	// #nosec G104 -- best-effort estimation; unreadable files are skipped
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		io.WriteString(h, path)
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		// #nosec G304 -- path is within the build context being planned
+		f, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		io.Copy(h, f)
+		return nil
+	})
+}
+
+// hashStrings returns a short sha256 over the given parts
+func hashStrings(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		io.WriteString(h, part)
+		h.Write([]byte{0})
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func lastCacheKey(stage PlanStage) string {
+	if len(stage.Instructions) == 0 {
+		return ""
+	}
+	return stage.Instructions[len(stage.Instructions)-1].CacheKey
+}
+
+// isPredefinedArg reports whether name is a proxy or platform arg the builder provides
+func isPredefinedArg(name string) bool {
+	switch strings.ToUpper(name) {
+	case "HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "NO_PROXY", "ALL_PROXY",
+		"SOURCE_DATE_EPOCH", "BUILDKIT_INLINE_CACHE", "BUILDKIT_SYNTAX",
+		"TARGETPLATFORM", "TARGETOS", "TARGETARCH", "TARGETVARIANT",
+		"BUILDPLATFORM", "BUILDOS", "BUILDARCH", "BUILDVARIANT":
+		return true
+	}
+	return false
+}
+
+// markRequired marks the target stage and everything it depends on
+func markRequired(plan *Plan, deps map[int][]int, target int) {
+	if target < 0 || target >= len(plan.Stages) || plan.Stages[target].Required {
+		return
+	}
+	plan.Stages[target].Required = true
+	for _, dep := range deps[target] {
+		markRequired(plan, deps, dep)
+	}
+}
+
+// resolvePlanDigests looks up digests for the base images of required stages
+func resolvePlanDigests(plan *Plan, config Config) {
+	resolved := make(map[string]string)
+	for i := range plan.Stages {
+		stage := &plan.Stages[i]
+		if !stage.Required || stage.BaseImage == "" || stage.BaseImage == "scratch" {
+			continue
+		}
+
+		if digest, ok := resolved[stage.BaseImage]; ok {
+			stage.Digest = digest
+			continue
+		}
+
+		insecure := config.Insecure || config.InsecurePull ||
+			isInsecureRegistry(stage.BaseImage, config.InsecureRegistry)
+		logger.Debug("Resolving digest for %s", stage.BaseImage)
+		digest, err := auth.ResolveImageDigest(stage.BaseImage, insecure)
+		if err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("base image %s: %v", stage.BaseImage, err))
+			resolved[stage.BaseImage] = ""
+			continue
+		}
+		stage.Digest = digest
+		resolved[stage.BaseImage] = digest
+
+		// Re-key the stage from the pinned digest so cache keys track base image updates
+		if len(stage.Instructions) > 0 {
+			rekeyStage(stage, hashStrings("FROM", stage.BaseImage+"@"+digest))
+		}
+	}
+}
+
+// rekeyStage recomputes the cache key chain of a stage from a new root key
+func rekeyStage(stage *PlanStage, root string) {
+	key := root
+	stage.Instructions[0].CacheKey = key
+	for i := 1; i < len(stage.Instructions); i++ {
+		old := stage.Instructions[i].CacheKey
+		key = hashStrings(key, old)
+		stage.Instructions[i].CacheKey = key
+	}
+}
+
+// PrintPlan prints a human-readable build plan
+func PrintPlan(plan *Plan) {
+	logger.Info("")
+	logger.Info("Kimia Build Plan")
+	logger.Info("═══════════════════════════════════════════════════════")
+	logger.Info("  Dockerfile:              %s", plan.Dockerfile)
+	if plan.Target != "" {
+		logger.Info("  Target:                  %s", plan.Target)
+	}
+	logger.Info("")
+
+	if len(plan.BuildArgs) > 0 {
+		logger.Info("BUILD ARGS")
+		names := make([]string, 0, len(plan.BuildArgs))
+		for name := range plan.BuildArgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := plan.BuildArgs[name]
+			if value == "" {
+				value = "(empty)"
+			}
+			logger.Info("  %-24s %s", name+":", value)
+		}
+		logger.Info("")
+	}
+
+	logger.Info("STAGES")
+	for _, stage := range plan.Stages {
+		name := stage.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		status := "required"
+		if !stage.Required {
+			status = "skipped"
+		}
+		logger.Info("  [%d] %s (%s)", stage.Index, name, status)
+
+		switch {
+		case stage.BaseStage != "":
+			logger.Info("      Base:     stage %s", stage.BaseStage)
+		case stage.Digest != "":
+			logger.Info("      Base:     %s@%s", stage.BaseImage, stage.Digest)
+		default:
+			logger.Info("      Base:     %s", stage.BaseImage)
+		}
+		if stage.Platform != "" {
+			logger.Info("      Platform: %s", stage.Platform)
+		}
+		for _, inst := range stage.Instructions[1:] {
+			text := inst.Text
+			if len(text) > 60 {
+				text = text[:57] + "..."
+			}
+			logger.Info("      %s  %-4d %s", inst.CacheKey, inst.Line, text)
+		}
+	}
+	logger.Info("")
+
+	if len(plan.Mounts) > 0 {
+		logger.Info("SECRETS & SSH")
+		for _, m := range plan.Mounts {
+			logger.Info("  %-7s %-20s stage %s, line %d", m.Type, m.ID, m.Stage, m.Line)
+		}
+		logger.Info("")
+	}
+
+	for _, w := range plan.Warnings {
+		logger.Warning("%s", w)
+	}
+	if plan.HasErrors() {
+		logger.Error("✗ Plan has %d error(s):", len(plan.Errors))
+		for _, e := range plan.Errors {
+			logger.Error("  %s", e)
+		}
+		return
+	}
+	logger.Info("✓ Plan resolved successfully (nothing was built)")
+}
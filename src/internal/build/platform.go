@@ -0,0 +1,69 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// PlatformAuto is the --custom-platform value that builds for the node
+const PlatformAuto = "auto"
+
+// BuildPlatformLabel records the platform detected for a build with
+// --custom-platform=auto, so that an image built on a mixed node pool shows
+// which node architecture it was built for
+const BuildPlatformLabel = "io.rapidfort.kimia.build-platform"
+
+// NodePlatform returns the platform of the node Kimia runs on, e.g.
+// linux/arm64 or linux/arm/v7
+func NodePlatform() string {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	if runtime.GOARCH == "arm" {
+		platform += "/" + armVariant()
+	}
+	return platform
+}
+
+// armVariant returns the variant of a 32-bit ARM CPU from /proc/cpuinfo,
+// v7 when it cannot be read
+func armVariant() string {
+	// #nosec G304 -- fixed proc path
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return "v7"
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "CPU architecture" {
+			continue
+		}
+		switch strings.TrimSpace(value) {
+		case "5", "6":
+			return "v" + strings.TrimSpace(value)
+		}
+		return "v7"
+	}
+	return "v7"
+}
+
+// ResolvePlatform returns the platform to build for a --custom-platform
+// value and whether it was detected. An empty value or auto selects the
+// node's platform, so the image does not depend on which node the build pod
+// was scheduled to. A remote builder runs on another node: without a value
+// its own platform is kept, and auto is an error.
+func ResolvePlatform(value string, remote bool) (string, bool, error) {
+	if value != "" && value != PlatformAuto {
+		return value, false, nil
+	}
+	if remote {
+		if value == PlatformAuto {
+			return "", false, fmt.Errorf("--custom-platform=auto cannot detect the platform of a remote builder (--buildkit-addr, --buildah-remote); name the platform, e.g. --custom-platform=linux/amd64")
+		}
+		logger.Debug("No --custom-platform: the remote builder builds for its own platform")
+		return "", false, nil
+	}
+	return NodePlatform(), true, nil
+}
@@ -0,0 +1,376 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// defaultPushJobs is the number of blobs kimia uploads at the same time
+// unless --push-jobs says otherwise
+const defaultPushJobs = 4
+
+// promoteWebhookTimeout bounds the wait for a --promote-webhook decision,
+// which may include a full image scan
+const promoteWebhookTimeout = 15 * time.Minute
+
+// PromoteConfig describes the promotion of a staged image to its destinations
+type PromoteConfig struct {
+	Staging          string   // Reference the image was pushed to
+	Digest           string   // Digest of the staged image ("" to resolve Staging)
+	Destinations     []string // Final references
+	Require          []string // Artifact kinds the staged image must carry
+	Webhook          string   // URL that must approve the staged image
+	Insecure         bool
+	InsecureRegistry []string
+	DryRun           bool
+	Verify           bool     // Read the promoted images back (--verify-push)
+	Platforms        []string // Platforms built, checked by Verify
+	Jobs             int      // Blobs copied at the same time (0 = defaultPushJobs)
+	ChunkSize        int64    // Upload blobs in chunks of this size (0 = one request)
+}
+
+// promoteWebhookRequest is the JSON body posted to --promote-webhook
+type promoteWebhookRequest struct {
+	Image        string   `json:"image"` // Staged image by digest
+	Digest       string   `json:"digest"`
+	Destinations []string `json:"destinations"`
+}
+
+// Promote gates a staged image on the required artifacts and the webhook,
+// then copies it to every destination registry-side: blobs already present
+// are skipped, blobs in the same registry are mounted, and only blobs on
+// another registry are transferred. The manifests are pushed unchanged, so
+// the destinations get the staged digest. Cosign signatures and attestations
+// and referrers of the staged image are promoted along with it. It returns
+// the digest promoted.
+func Promote(config PromoteConfig) (string, error) {
+	if config.DryRun {
+		logger.Info("Dry run: would promote %s to %s", config.Staging, strings.Join(config.Destinations, ", "))
+		return "", nil
+	}
+
+	insecure := config.Insecure || isInsecureRegistry(config.Staging, config.InsecureRegistry)
+	src, _ := auth.NewRepository(config.Staging, insecure)
+	digest := config.Digest
+	if digest == "" {
+		var err error
+		if digest, err = auth.ResolveImageDigest(config.Staging, insecure); err != nil {
+			return "", fmt.Errorf("failed to resolve staged image %s: %v", config.Staging, err)
+		}
+	}
+	staged := src.Host + "/" + src.Repository + "@" + digest
+	if strings.HasPrefix(staged, "registry-1.docker.io/") {
+		staged = "docker.io/" + strings.TrimPrefix(staged, "registry-1.docker.io/")
+	}
+	logger.Info("Promoting staged image %s", staged)
+
+	if len(config.Require) > 0 {
+		report, err := GenerateTrustReport(VerifyConfig{
+			Image:            staged,
+			Insecure:         config.Insecure,
+			InsecureRegistry: config.InsecureRegistry,
+			Require:          config.Require,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect staged image: %v", err)
+		}
+		if !report.Passed() {
+			PrintTrustReport(report)
+			return "", fmt.Errorf("staged image %s lacks required artifacts: %s", staged, strings.Join(report.Missing, ", "))
+		}
+		logger.Info("Staged image carries the required artifacts: %s", strings.Join(config.Require, ", "))
+	}
+
+	if config.Webhook != "" {
+		if err := callPromoteWebhook(config.Webhook, promoteWebhookRequest{Image: staged, Digest: digest, Destinations: config.Destinations}); err != nil {
+			return "", err
+		}
+	}
+
+	artifacts := stagedArtifacts(src, digest)
+	for _, dest := range config.Destinations {
+		dst, reference := auth.NewRepository(dest, config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry))
+		dst.ChunkSize = config.ChunkSize
+		p := &imageCopier{src: src, dst: dst, jobs: config.Jobs}
+		if err := p.copyImage(digest, reference, artifacts); err != nil {
+			return "", fmt.Errorf("failed to promote to %s: %v", dest, err)
+		}
+		logger.Info("Promoted %s (%d blobs mounted, %d copied, %d already present)", dest, p.mounted, p.copied, p.present)
+	}
+
+	if config.Verify {
+		promoted := make([]PushedImage, len(config.Destinations))
+		for i, dest := range config.Destinations {
+			promoted[i] = PushedImage{Destination: dest, Digest: digest}
+		}
+		insecure := func(dest string) bool {
+			return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+		}
+		if err := VerifyPushedImages(promoted, config.Platforms, insecure); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// stagedArtifact is a manifest attached to a staged or copied image
+type stagedArtifact struct {
+	digest      string
+	tag         string // Tag to push it under, or its digest
+	description string
+}
+
+// stagedArtifacts lists the cosign tags and referrers of image digest
+func stagedArtifacts(src *auth.Repository, digest string) []stagedArtifact {
+	var artifacts []stagedArtifact
+	tags, err := src.CosignTags(digest)
+	if err != nil {
+		logger.Warning("Failed to list cosign artifacts of %s: %v", digest, err)
+	}
+	for _, suffix := range []string{"sig", "att", "sbom"} {
+		if tagDigest, ok := tags[suffix]; ok && tagDigest != "" {
+			artifacts = append(artifacts, stagedArtifact{digest: tagDigest, tag: auth.ArtifactTag(digest, suffix), description: "cosign ." + suffix})
+		}
+	}
+
+	referrers, source, err := src.Referrers(digest)
+	if err != nil {
+		logger.Warning("Failed to list referrers of %s: %v", digest, err)
+	}
+	for _, referrer := range referrers {
+		artifacts = append(artifacts, stagedArtifact{digest: referrer.Digest, tag: referrer.Digest, description: "referrer " + referrer.Digest})
+	}
+	// Registries without the referrers API find them through the index under this tag
+	if len(referrers) > 0 && source == auth.ReferrersTag {
+		tag := auth.ArtifactTag(digest, "")
+		if index, _, err := src.FetchRawManifest(tag); err == nil {
+			artifacts = append(artifacts, stagedArtifact{digest: sha256Digest(index), tag: tag, description: "referrers index"})
+		}
+	}
+	return artifacts
+}
+
+// callPromoteWebhook posts the staged image to url; any 2xx response approves it
+func callPromoteWebhook(url string, request promoteWebhookRequest) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	logger.Info("Waiting for approval from promote webhook %s", url)
+	client := &http.Client{Timeout: promoteWebhookTimeout}
+	// #nosec G107 -- URL given by the user with --promote-webhook
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("promote webhook failed: %v", err)
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("promote webhook rejected %s (HTTP %d): %s", request.Image, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	logger.Info("Promote webhook approved %s", request.Image)
+	return nil
+}
+
+// imageCopier copies manifests and their blobs to another repository, from
+// a registry repository or from an OCI layout directory
+type imageCopier struct {
+	src    *auth.Repository // Repository to read from, or to mount from with layout set
+	layout string           // OCI layout holding the content ("" = read from src)
+	dst    *auth.Repository
+	jobs   int
+
+	mu                       sync.Mutex
+	mounted, copied, present int
+	uploaded                 int64 // Bytes of the copied blobs
+}
+
+// count adds one to a counter of p
+func (p *imageCopier) count(counter *int) {
+	p.mu.Lock()
+	*counter++
+	p.mu.Unlock()
+}
+
+// readManifest returns the manifest digest and its media type
+func (p *imageCopier) readManifest(digest string) ([]byte, string, error) {
+	if p.layout == "" {
+		return p.src.FetchRawManifest(digest)
+	}
+	path, err := layoutBlobPath(p.layout, digest)
+	if err != nil {
+		return nil, "", err
+	}
+	// #nosec G304 -- blob of the OCI layout kimia exported
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest %s: %v", digest, err)
+	}
+	return raw, "", nil
+}
+
+// copyImage copies image digest under reference, followed by the artifacts
+// attached to it
+func (p *imageCopier) copyImage(digest, reference string, artifacts []stagedArtifact) error {
+	if err := p.copyManifest(digest, reference); err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		if err := p.copyManifest(artifact.digest, artifact.tag); err != nil {
+			return fmt.Errorf("%s: %v", artifact.description, err)
+		}
+	}
+	return nil
+}
+
+// copyManifest copies manifest digest, the manifests of an index and all
+// blobs, then pushes it under reference (a tag or the digest)
+func (p *imageCopier) copyManifest(digest, reference string) error {
+	raw, mediaType, err := p.readManifest(digest)
+	if err != nil {
+		return err
+	}
+	if got := sha256Digest(raw); got != digest {
+		return fmt.Errorf("source returned content with digest %s for %s", got, digest)
+	}
+	var manifest auth.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return fmt.Errorf("invalid manifest %s: %v", digest, err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+
+	for _, child := range manifest.Manifests {
+		if err := p.copyManifest(child.Digest, child.Digest); err != nil {
+			return err
+		}
+	}
+	if len(manifest.Manifests) == 0 {
+		if err := p.copyBlobs(append([]auth.Descriptor{manifest.Config}, manifest.Layers...)); err != nil {
+			return err
+		}
+	}
+
+	pushed, err := p.dst.PushManifest(reference, mediaType, raw)
+	if err != nil {
+		return err
+	}
+	if pushed != digest {
+		return fmt.Errorf("manifest %s was stored as %s", digest, pushed)
+	}
+	return nil
+}
+
+// copyBlobs copies blobs with up to p.jobs at a time and returns the first error
+func (p *imageCopier) copyBlobs(blobs []auth.Descriptor) error {
+	jobs := p.jobs
+	if jobs <= 0 {
+		jobs = defaultPushJobs
+	}
+	errs := make([]error, len(blobs))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, blob := range blobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = p.copyBlob(blob)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlob makes blob available in the destination repository
+func (p *imageCopier) copyBlob(blob auth.Descriptor) error {
+	if blob.Digest == "" {
+		return nil
+	}
+	exists, err := p.dst.BlobExists(blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		p.count(&p.present)
+		return nil
+	}
+	if p.src != nil && p.dst.Host == p.src.Host {
+		mounted, err := p.dst.MountBlob(blob.Digest, p.src.Repository)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			p.count(&p.mounted)
+			return nil
+		}
+		logger.Debug("Registry did not mount %s, copying it", blob.Digest)
+	}
+
+	var size int64
+	start := time.Now()
+	if p.layout != "" {
+		path, err := layoutBlobPath(p.layout, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if err := p.dst.PushBlob(path, blob.Digest, blob.Size); err != nil {
+			return err
+		}
+		size = blob.Size
+	} else if size, err = p.downloadAndPush(blob); err != nil {
+		return err
+	}
+	logger.Info("Uploaded %s (%s in %s)", blob.Digest, formatBytes(size), time.Since(start).Round(time.Millisecond))
+
+	p.mu.Lock()
+	p.copied++
+	p.uploaded += size
+	p.mu.Unlock()
+	return nil
+}
+
+// downloadAndPush transfers blob from the source repository and returns its size
+func (p *imageCopier) downloadAndPush(blob auth.Descriptor) (int64, error) {
+	// Blobs are staged on disk so the upload can be retried after an auth challenge
+	file, err := newTempFile("", "kimia-promote-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer removeTemp(file.Name())
+	defer file.Close()
+
+	body, err := p.src.FetchBlob(blob.Digest)
+	if err != nil {
+		return 0, err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), body)
+	body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to download blob %s: %v", blob.Digest, err)
+	}
+	if got := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); got != blob.Digest {
+		return 0, fmt.Errorf("blob digest mismatch: expected %s, got %s", blob.Digest, got)
+	}
+	return size, p.dst.PushBlob(file.Name(), blob.Digest, size)
+}
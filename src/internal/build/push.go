@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
@@ -19,27 +18,90 @@ type PushConfig struct {
 	InsecureRegistry    []string
 	SkipTLSVerify       bool
 	RegistryCertificate string
+	PinnedCertDirs      map[string]string // --cert-dir of the registries with pinned certificates (--pin-registry-cert), by host
 	PushRetry           int
 	StorageDriver       string
+	StorageRoot         string // Buildah storage holding the built image ("" = the default storage)
+	DryRun              bool   // Print the push commands instead of running them
+	Builder             string // Builder selected with --builder ("" = auto)
+	BuildahRemote       string // Podman service holding the built images (--buildah-remote)
+	VerifyPush          bool   // Read pushed images back from the registry (--verify-push)
+	Platform            string // Platform built, checked by VerifyPush
+
+	// Promotion of the image pushed to Destinations[0] (--staging-destination)
+	PromoteTo      []string // Final destinations
+	PromoteRequire []string // Artifact kinds the staged image must carry
+	PromoteWebhook string   // URL that must approve the staged image
+
+	Jobs      int    // Layers uploaded at the same time (--push-jobs, 0 = builder default)
+	ChunkSize int64  // Upload chunk size of kimia's own uploads (--push-chunk-size)
+	Backend   string // PushBackendBuilder or PushBackendNative (--push-backend)
+
+	// Layer compression (--compression, see ResolveCompression) and its level
+	// (0 = the builder default)
+	Compression      string
+	CompressionLevel int
+
+	Attach           []Attachment     // Files attached to the pushed image as referrer artifacts (--attach)
+	AttestationRepos AttestationRepos // Repositories the attachments are pushed to (--attestation-repo)
+
+	Scan ScanWebhookConfig // Scanner that must approve the pushed images (--scan-webhook)
+
+	Timeout time.Duration // Time limit of the push phase (--push-timeout, 0 = none)
+
+	// Heartbeats while a push prints nothing (--heartbeat-interval, 0 = off),
+	// also written to EventsFile
+	HeartbeatInterval time.Duration
+	EventsFile        string
 }
 
 // Push pushes built images to registries with authentication
 // Returns a map of destination->digest for each successfully pushed image
 func Push(config PushConfig) (map[string]string, error) {
-	// BuildKit pushes during build (via --output with push=true)
-	// Only buildah needs a separate push step
-	builder := DetectBuilder()
-	if builder == "buildkit" {
-		return make(map[string]string), nil
+	// BuildKit pushes during build (via --output with push=true), and so does
+	// the buildpacks lifecycle. Only buildah needs a separate push step
+	builder := DetectBuilderFor(config.Builder, "", config.BuildahRemote)
+	if pushesWhileBuilding(builder) {
+		if (config.Jobs > 0 || config.ChunkSize > 0) && len(config.PromoteTo) == 0 {
+			logger.Warning("--push-jobs and --push-chunk-size are ignored by %s, which uploads all layers of an image at once", builderName(builder))
+		}
+		if config.Backend == PushBackendNative {
+			logger.Warning("--push-backend=native is ignored by %s, which pushes during the build", builderName(builder))
+		}
+		digestMap := make(map[string]string)
+		if err := attachPushed(config, nil); err != nil {
+			return digestMap, err
+		}
+		if err := scanPushed(config, nil); err != nil {
+			return digestMap, err
+		}
+		return digestMap, promoteStaged(config, nil, digestMap)
+	}
+
+	transport := newBuildahTransport(config.BuildahRemote, config.StorageRoot)
+	pushCtx, cancelPush := phaseContext(config.Timeout)
+	defer cancelPush()
+	if config.Backend == PushBackendNative {
+		digestMap, pushed, err := pushNative(pushCtx, config, transport)
+		if err != nil {
+			return digestMap, err
+		}
+		return digestMap, finishPush(config, pushed, digestMap)
 	}
 
 	digestMap := make(map[string]string)
+	var pushed []PushedImage
+
+	pushEnv, err := buildahPushEnv(config, transport)
+	if err != nil {
+		return digestMap, err
+	}
 
 	for _, dest := range config.Destinations {
 		logger.Info("Pushing image: %s", dest)
 
 		// List images to verify the image exists before pushing
-		listCmd := exec.Command("buildah", "images", "--format", "{{.Name}}:{{.Tag}}")
+		listCmd := buildahCommand(transport, "images", "--format", "{{.Name}}:{{.Tag}}")
 		listCmd.Env = os.Environ()
 		if config.StorageDriver != "" {
 			listCmd.Env = append(listCmd.Env, fmt.Sprintf("STORAGE_DRIVER=%s", config.StorageDriver))
@@ -70,19 +132,47 @@ func Push(config PushConfig) (map[string]string, error) {
 		}
 
 		// Add specific registry certificates if configured
-		if config.RegistryCertificate != "" {
-			args = append(args, "--cert-dir", config.RegistryCertificate)
+		if certDir := certDirFor(config, dest); certDir != "" {
+			args = append(args, "--cert-dir", certDir)
 		}
 
+		args = append(args, buildahCompressionArgs(config.Compression, config.CompressionLevel)...)
+
 		// Add retry logic
 		retries := config.PushRetry
 		if retries == 0 {
 			retries = 1
 		}
 
+		// Buildah writes the manifest digest it pushed to this file
+		digestFile := ""
+		if !config.DryRun {
+			file, err := newTempFile("", "kimia-push-digest-*")
+			if err != nil {
+				return digestMap, fmt.Errorf("failed to create digest file: %v", err)
+			}
+			file.Close()
+			digestFile = file.Name()
+			defer removeTemp(digestFile)
+			args = append(args, "--digestfile", digestFile)
+		}
+
 		args = append(args, dest)
 
-		// Try push with retries
+		if config.DryRun {
+			env := []string{fmt.Sprintf("DOCKER_CONFIG=%s", auth.GetDockerConfigDir())}
+			if config.StorageDriver != "" {
+				env = append(env, fmt.Sprintf("STORAGE_DRIVER=%s", config.StorageDriver))
+			}
+			env = append(env, pushEnv...)
+			program, programArgs := transport.commandLine(args)
+			printDryRunCommand("buildah push command", env, program, programArgs)
+			continue
+		}
+
+		// Try push with retries; buildah push output is only logged afterwards
+		beat := startHeartbeat(config.HeartbeatInterval, config.EventsFile, "push", dest)
+		defer beat.stop()
 		var lastErr error
 		for i := 0; i < retries; i++ {
 			if i > 0 {
@@ -91,7 +181,7 @@ func Push(config PushConfig) (map[string]string, error) {
 				time.Sleep(time.Second * time.Duration(i*2))
 			}
 
-			cmd := exec.Command("buildah", args...)
+			cmd := buildahCommandContext(pushCtx, transport, args...)
 
 			// Capture both stdout and stderr for better debugging
 			var stdout, stderr bytes.Buffer
@@ -111,6 +201,7 @@ func Push(config PushConfig) (map[string]string, error) {
 				cmd.Env = append(cmd.Env, fmt.Sprintf("STORAGE_DRIVER=%s", config.StorageDriver))
 				logger.Debug("Set STORAGE_DRIVER=%s for push", config.StorageDriver)
 			}
+			cmd.Env = append(cmd.Env, pushEnv...)
 
 			err := cmd.Run()
 
@@ -126,6 +217,9 @@ func Push(config PushConfig) (map[string]string, error) {
 				}
 			}
 
+			if err != nil && pushCtx.Err() != nil {
+				return digestMap, timeoutError(pushCtx, err, "push of "+dest, "--push-timeout", config.Timeout)
+			}
 			if err != nil {
 				lastErr = err
 
@@ -165,37 +259,190 @@ func Push(config PushConfig) (map[string]string, error) {
 				continue
 			}
 
-			// Success - extract digest from stderr
-			stderrStr := stderr.String()
-			digest := extractDigestFromPushOutput(stderrStr)
-			if digest != "" {
-				digestMap[dest] = digest
-				logger.Debug("Extracted digest for %s: %s", dest, digest)
+			digest, err := readDigestFile(digestFile)
+			if err != nil {
+				return digestMap, fmt.Errorf("failed to read pushed digest of %s: %v", dest, err)
 			}
+			digestMap[dest] = digest
+			pushed = append(pushed, PushedImage{Destination: dest, Digest: digest})
+			logger.Debug("Pushed digest for %s: %s", dest, digest)
 
 			logger.Info("Successfully pushed: %s", dest)
 			lastErr = nil
 			break
 		}
 
+		beat.stop()
+
 		if lastErr != nil {
 			return digestMap, fmt.Errorf("failed to push %s after %d attempts: %v", dest, retries, lastErr)
 		}
 	}
 
-	return digestMap, nil
+	return digestMap, finishPush(config, pushed, digestMap)
+}
+
+// finishPush verifies the pushed images with --verify-push and promotes the
+// staged image
+func finishPush(config PushConfig, pushed []PushedImage, digestMap map[string]string) error {
+	if config.VerifyPush && len(pushed) > 0 {
+		insecure := func(dest string) bool {
+			return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+		}
+		if err := VerifyPushedImages(pushed, splitPlatforms(config.Platform), insecure); err != nil {
+			return err
+		}
+	}
+	if err := attachPushed(config, pushed); err != nil {
+		return err
+	}
+	if err := scanPushed(config, pushed); err != nil {
+		return err
+	}
+	return promoteStaged(config, pushed, digestMap)
+}
+
+// scanPushed has the --scan-webhook approve the pushed images before any
+// promotion, so that a blocked staged image is never promoted
+func scanPushed(config PushConfig, pushed []PushedImage) error {
+	if config.Scan.URL == "" {
+		return nil
+	}
+	if config.DryRun {
+		logger.Info("Dry run: would have %s scan the pushed image", redactURL(config.Scan.URL))
+		return nil
+	}
+	insecure := func(dest string) bool {
+		return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+	}
+	pushed, err := resolvePushed(config, pushed, insecure)
+	if err != nil {
+		return err
+	}
+	return ScanPushedImages(config.Scan, pushed, config.AttestationRepos, insecure, config.EventsFile)
+}
+
+// attachPushed attaches the --attach files to the pushed images before any
+// promotion, which copies them along. BuildKit does not report what it
+// pushed to this step, so its destinations are resolved in the registry.
+func attachPushed(config PushConfig, pushed []PushedImage) error {
+	if len(config.Attach) == 0 {
+		return nil
+	}
+	insecure := func(dest string) bool {
+		return config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+	}
+	if !config.DryRun {
+		var err error
+		if pushed, err = resolvePushed(config, pushed, insecure); err != nil {
+			return err
+		}
+	}
+	return AttachArtifacts(pushed, config.Attach, config.AttestationRepos, insecure, config.DryRun)
+}
+
+// resolvePushed returns pushed, or the destinations with their digests in the
+// registry when the builder did not report what it pushed
+func resolvePushed(config PushConfig, pushed []PushedImage, insecure func(string) bool) ([]PushedImage, error) {
+	if pushed != nil {
+		return pushed, nil
+	}
+	for _, dest := range config.Destinations {
+		digest, err := auth.ResolveImageDigest(dest, insecure(dest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve pushed image %s: %v", dest, err)
+		}
+		pushed = append(pushed, PushedImage{Destination: dest, Digest: digest})
+	}
+	return pushed, nil
+}
+
+// buildahPushEnv returns the environment applying --push-jobs to buildah
+// push: a containers.conf override setting image_parallel_copies. Buildah
+// uploads each layer in a single request, so --push-chunk-size does not apply.
+func buildahPushEnv(config PushConfig, transport buildahTransport) ([]string, error) {
+	if config.ChunkSize > 0 && len(config.PromoteTo) == 0 {
+		logger.Warning("--push-chunk-size is ignored by Buildah, which uploads each layer in a single request")
+	}
+	if config.Jobs <= 0 {
+		return nil, nil
+	}
+	if transport.remote() {
+		logger.Warning("--push-jobs is ignored with --buildah-remote; set image_parallel_copies in the Podman service's containers.conf")
+		return nil, nil
+	}
+
+	file, err := newTempFile("", "kimia-containers-*.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create containers.conf override: %v", err)
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "[engine]\nimage_parallel_copies = %d\n", config.Jobs); err != nil {
+		return nil, fmt.Errorf("failed to write containers.conf override: %v", err)
+	}
+	logger.Debug("Uploading up to %d layers at a time", config.Jobs)
+	return []string{"CONTAINERS_CONF_OVERRIDE=" + file.Name()}, nil
+}
+
+// promoteStaged promotes the image pushed to the staging destination, using
+// the digest reported by the push when there is one, and records the digest
+// of every promoted destination in digestMap
+func promoteStaged(config PushConfig, pushed []PushedImage, digestMap map[string]string) error {
+	if len(config.PromoteTo) == 0 || len(config.Destinations) == 0 {
+		return nil
+	}
+	promote := PromoteConfig{
+		Staging:          config.Destinations[0],
+		Destinations:     config.PromoteTo,
+		Require:          config.PromoteRequire,
+		Webhook:          config.PromoteWebhook,
+		Insecure:         config.Insecure,
+		InsecureRegistry: config.InsecureRegistry,
+		DryRun:           config.DryRun,
+		Verify:           config.VerifyPush,
+		Platforms:        splitPlatforms(config.Platform),
+		Jobs:             config.Jobs,
+		ChunkSize:        config.ChunkSize,
+	}
+	if len(pushed) > 0 {
+		promote.Digest = pushed[0].Digest
+	}
+	digest, err := Promote(promote)
+	if err != nil {
+		return fmt.Errorf("promotion failed: %v", err)
+	}
+	if digest != "" {
+		for _, dest := range config.PromoteTo {
+			digestMap[dest] = digest
+		}
+	}
+	return nil
+}
+
+// certDirFor returns the --cert-dir of pushes to dest: the pinned
+// certificates of its registry, else --registry-certificate
+func certDirFor(config PushConfig, dest string) string {
+	registry := auth.NormalizeRegistryURL(auth.ExtractRegistry(dest))
+	if certDir, ok := config.PinnedCertDirs[registry]; ok {
+		if config.RegistryCertificate != "" {
+			logger.Debug("Pushing to %s with its pinned certificate instead of --registry-certificate", registry)
+		}
+		return certDir
+	}
+	return config.RegistryCertificate
 }
 
 // PushSingle pushes a single image with retries (used by hardening)
 // Returns the manifest digest of the pushed image
 func PushSingle(image string, config PushConfig) (string, error) {
-	// BuildKit pushes during build (via --output with push=true)
+	// BuildKit and the buildpacks lifecycle push during build
 	// Only buildah needs a separate push step
-	builder := DetectBuilder()
-	if builder == "buildkit" {
-		logger.Debug("Skipping separate push step for %s (BuildKit pushes during build)", image)
+	builder := DetectBuilderFor(config.Builder, "", config.BuildahRemote)
+	if pushesWhileBuilding(builder) {
+		logger.Debug("Skipping separate push step for %s (%s pushes during build)", image, builderName(builder))
 		return "", nil
 	}
+	transport := newBuildahTransport(config.BuildahRemote, config.StorageRoot)
 
 	// Build push command
 	args := []string{"push"}
@@ -206,10 +453,18 @@ func PushSingle(image string, config PushConfig) (string, error) {
 	}
 
 	// Add specific registry certificates if configured
-	if config.RegistryCertificate != "" {
-		args = append(args, "--cert-dir", config.RegistryCertificate)
+	if certDir := certDirFor(config, image); certDir != "" {
+		args = append(args, "--cert-dir", certDir)
 	}
 
+	digestFile, err := newTempFile("", "kimia-push-digest-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create digest file: %v", err)
+	}
+	digestFile.Close()
+	defer removeTemp(digestFile.Name())
+	args = append(args, "--digestfile", digestFile.Name())
+
 	// Add the image
 	args = append(args, image)
 
@@ -219,14 +474,17 @@ func PushSingle(image string, config PushConfig) (string, error) {
 		retries = 1
 	}
 
+	pushCtx, cancelPush := phaseContext(config.Timeout)
+	defer cancelPush()
+
 	var lastErr error
-	for i := 0; i < retries; i++ {
+	for i := 0; i < retries && pushCtx.Err() == nil; i++ {
 		if i > 0 {
 			logger.Debug("Retrying push of %s (attempt %d/%d)...", image, i+1, retries)
 			time.Sleep(time.Second * time.Duration(i*2))
 		}
 
-		cmd := exec.Command("buildah", args...)
+		cmd := buildahCommandContext(pushCtx, transport, args...)
 
 		var stdout, stderr bytes.Buffer
 		cmd.Stdout = &stdout
@@ -244,7 +502,8 @@ func PushSingle(image string, config PushConfig) (string, error) {
 		}
 
 		// Log full command for debugging
-		logger.Debug("Buildah push command: buildah %s", strings.Join(args, " "))
+		program, programArgs := transport.commandLine(args)
+		logger.Debug("Buildah push command: %s %s", program, strings.Join(programArgs, " "))
 
 		err := cmd.Run()
 
@@ -256,18 +515,36 @@ func PushSingle(image string, config PushConfig) (string, error) {
 		}
 
 		if err == nil {
-			// Extract digest from stderr
-			digest := extractDigestFromPushOutput(stderr.String())
-			if digest != "" {
-				logger.Debug("Extracted digest for %s: %s", image, digest)
+			digest, err := readDigestFile(digestFile.Name())
+			if err != nil {
+				return "", fmt.Errorf("failed to read pushed digest of %s: %v", image, err)
 			}
+			logger.Debug("Pushed digest for %s: %s", image, digest)
 			return digest, nil
 		}
 
 		lastErr = err
 	}
 
-	return "", lastErr
+	return "", timeoutError(pushCtx, lastErr, "push of "+image, "--push-timeout", config.Timeout)
+}
+
+// pushesWhileBuilding reports whether builder pushes the image itself
+func pushesWhileBuilding(builder string) bool {
+	return builder == "buildkit" || builder == "buildpacks"
+}
+
+// builderName returns the name of builder for messages
+func builderName(builder string) string {
+	switch builder {
+	case "buildkit":
+		return "BuildKit"
+	case "buildah":
+		return "Buildah"
+	case "buildpacks":
+		return "the buildpacks lifecycle"
+	}
+	return builder
 }
 
 // isInsecureRegistry checks if a destination matches an insecure registry pattern
@@ -280,21 +557,16 @@ func isInsecureRegistry(dest string, insecureRegistries []string) bool {
 	return false
 }
 
-// extractDigestFromPushOutput extracts the manifest digest from buildah push stderr
-// Example stderr line: "Copying config sha256:0b0a90c89d1e19e603b72d1d02efdd324a622d7ee93071c8e268165f2f0e6821"
-func extractDigestFromPushOutput(stderr string) string {
-	// Look for "Copying config sha256:..." in the output
-	lines := strings.Split(stderr, "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "Copying config sha256:") {
-			// Extract the sha256 digest
-			parts := strings.Split(line, "sha256:")
-			if len(parts) >= 2 {
-				digest := strings.TrimSpace(parts[1])
-				// Return with sha256: prefix
-				return "sha256:" + digest
-			}
-		}
+// readDigestFile returns the digest buildah push wrote with --digestfile
+func readDigestFile(path string) (string, error) {
+	// #nosec G304 -- temporary file created by kimia
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
-	return ""
-}
\ No newline at end of file
+	digest := strings.TrimSpace(string(data))
+	if !isDigest(digest) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return digest, nil
+}
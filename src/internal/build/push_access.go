@@ -0,0 +1,45 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// PushAccessConfig holds the destinations checked by CheckPushAccess
+type PushAccessConfig struct {
+	Destinations     []string
+	Insecure         bool
+	InsecureRegistry []string
+}
+
+// CheckPushAccess verifies, before building, that the credentials can push
+// to every destination repository by starting and cancelling a blob upload.
+// All repositories are checked so that one run reports every missing permission.
+func CheckPushAccess(config PushAccessConfig) error {
+	var failures []string
+	checked := make(map[string]bool)
+	for _, dest := range config.Destinations {
+		repo, _ := auth.NewRepository(dest, config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry))
+		name := repo.Host + "/" + repo.Repository
+		if checked[name] {
+			continue
+		}
+		checked[name] = true
+
+		logger.Info("Checking push access to %s...", name)
+		if err := repo.CheckPushAccess(); err != nil {
+			logger.Error("No push access to %s: %v", name, err)
+			failures = append(failures, dest)
+			continue
+		}
+		logger.Info("Push access to %s confirmed", name)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("cannot push to %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
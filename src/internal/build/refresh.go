@@ -0,0 +1,170 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// BaseImageDigest is a base image reference and the manifest digest it resolved to
+type BaseImageDigest struct {
+	Ref    string `json:"ref"`
+	Digest string `json:"digest"`
+}
+
+// BuildMetadata is written by `kimia rebuild-if-base-changed` after a build so
+// the next run can tell whether any base image moved
+type BuildMetadata struct {
+	Destinations []string          `json:"destinations"`
+	Built        time.Time         `json:"built"`
+	BaseImages   []BaseImageDigest `json:"baseImages"`
+}
+
+// BaseImageChange describes a base image whose digest differs from the previous build
+type BaseImageChange struct {
+	Ref            string
+	PreviousDigest string // Empty when the base image is new
+	CurrentDigest  string
+}
+
+// PlanBaseImages returns the resolved base images of the stages needed for the target
+func PlanBaseImages(plan *Plan) []BaseImageDigest {
+	seen := make(map[string]bool)
+	images := []BaseImageDigest{}
+	for _, stage := range plan.Stages {
+		if !stage.Required || stage.BaseImage == "" || stage.BaseImage == "scratch" {
+			continue
+		}
+		ref := NormalizeImageReference(stage.BaseImage)
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		images = append(images, BaseImageDigest{Ref: ref, Digest: stage.Digest})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Ref < images[j].Ref })
+	return images
+}
+
+// LoadBaseImageDigests reads the base image digests of a previous build. It
+// accepts Kimia build metadata as well as SLSA provenance (v0.2 materials or
+// v1 resolvedDependencies), bare or wrapped in an in-toto statement.
+func LoadBaseImageDigests(path string) ([]BaseImageDigest, error) {
+	// #nosec G304 -- user-specified metadata file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		BaseImages []BaseImageDigest `json:"baseImages"`
+		Materials  []provenanceRef   `json:"materials"`
+		Predicate  *struct {
+			Materials       []provenanceRef `json:"materials"`
+			BuildDefinition struct {
+				ResolvedDependencies []provenanceRef `json:"resolvedDependencies"`
+			} `json:"buildDefinition"`
+		} `json:"predicate"`
+		BuildDefinition struct {
+			ResolvedDependencies []provenanceRef `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	if doc.BaseImages != nil {
+		return doc.BaseImages, nil
+	}
+
+	refs := append(doc.Materials, doc.BuildDefinition.ResolvedDependencies...)
+	if doc.Predicate != nil {
+		refs = append(refs, doc.Predicate.Materials...)
+		refs = append(refs, doc.Predicate.BuildDefinition.ResolvedDependencies...)
+	}
+	var images []BaseImageDigest
+	for _, ref := range refs {
+		if image, ok := ref.baseImage(); ok {
+			images = append(images, image)
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%s contains no base image digests (expected Kimia metadata or SLSA provenance)", path)
+	}
+	return images, nil
+}
+
+// provenanceRef is a SLSA material (v0.2) or resolved dependency (v1)
+type provenanceRef struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// baseImage converts a pkg:docker purl material to a base image digest
+func (r provenanceRef) baseImage() (BaseImageDigest, bool) {
+	if !strings.HasPrefix(r.URI, "pkg:docker/") || r.Digest["sha256"] == "" {
+		return BaseImageDigest{}, false
+	}
+
+	// pkg:docker/<name>@<tag>?platform=..., with the name percent-encoded
+	purl := strings.TrimPrefix(r.URI, "pkg:docker/")
+	if idx := strings.IndexAny(purl, "?#"); idx >= 0 {
+		purl = purl[:idx]
+	}
+	name, tag := purl, "latest"
+	if idx := strings.LastIndex(purl, "@"); idx >= 0 {
+		name, tag = purl[:idx], purl[idx+1:]
+	}
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+
+	ref := name + ":" + tag
+	if strings.HasPrefix(tag, "sha256:") {
+		ref = name + "@" + tag
+	}
+	return BaseImageDigest{Ref: NormalizeImageReference(ref), Digest: "sha256:" + r.Digest["sha256"]}, true
+}
+
+// CompareBaseImages returns the current base images whose digest is not the
+// one recorded for the same reference in the previous build
+func CompareBaseImages(previous, current []BaseImageDigest) []BaseImageChange {
+	recorded := make(map[string]string, len(previous))
+	for _, image := range previous {
+		recorded[NormalizeImageReference(image.Ref)] = image.Digest
+	}
+
+	var changes []BaseImageChange
+	for _, image := range current {
+		if prev := recorded[image.Ref]; prev != image.Digest {
+			changes = append(changes, BaseImageChange{Ref: image.Ref, PreviousDigest: prev, CurrentDigest: image.Digest})
+		}
+	}
+	return changes
+}
+
+// WriteBuildMetadata saves the base image digests of a completed build
+func WriteBuildMetadata(path string, metadata BuildMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// #nosec G301 -- directory for a non-sensitive build artifact
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %v", err)
+	}
+	// #nosec G306 -- 0644 for build metadata (public build artifact, not sensitive)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write build metadata: %v", err)
+	}
+	logger.Info("Build metadata written to %s", path)
+	return nil
+}
@@ -0,0 +1,125 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// buildahRegistriesDropIn is the registries.conf.d file Kimia writes for
+// --registry-config; drop-ins are merged with the system registries.conf
+const buildahRegistriesDropIn = "90-kimia-registry-config.conf"
+
+// containersConfigDir returns where Buildah reads user configuration:
+// /etc/containers for root, $HOME/.config/containers otherwise
+func containersConfigDir() string {
+	if os.Getuid() == 0 {
+		return "/etc/containers"
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = "/home/kimia"
+	}
+	return filepath.Join(filepath.Clean(home), ".config", "containers")
+}
+
+// configureBuildahRegistries makes the --registry-config settings visible to
+// Buildah: insecure registries in a registries.conf.d drop-in, CAs and client
+// certificates in the per-registry certs.d directories
+func configureBuildahRegistries(config Config, transport buildahTransport) error {
+	if len(config.RegistryTLS) == 0 {
+		return nil
+	}
+	if transport.remote() {
+		logger.Warning("--registry-config is not forwarded to the Podman service; configure its registries.conf and certs.d instead")
+		return nil
+	}
+	if config.RegistryCertificate != "" {
+		logger.Warning("--registry-certificate replaces Buildah's per-registry certificate lookup; the ca and client-cert of --registry-config only apply to Kimia's own registry access")
+	}
+
+	configDir := containersConfigDir()
+	var dropIn strings.Builder
+	dropIn.WriteString("# Generated by Kimia from --registry-config\n")
+	for _, registry := range config.RegistryTLS {
+		if registry.Insecure {
+			fmt.Fprintf(&dropIn, "\n[[registry]]\nlocation = %q\ninsecure = true\n", registry.Host)
+		}
+	}
+
+	files := map[string]string{}
+	for _, registry := range config.RegistryTLS {
+		certDir := filepath.Join(configDir, "certs.d", registry.Host)
+		if registry.CA != "" {
+			files[filepath.Join(certDir, "kimia-ca.crt")] = registry.CA
+		}
+		if registry.ClientCert != "" {
+			files[filepath.Join(certDir, "kimia-client.cert")] = registry.ClientCert
+			files[filepath.Join(certDir, "kimia-client.key")] = registry.ClientKey
+		}
+	}
+
+	dropInPath := filepath.Join(configDir, "registries.conf.d", buildahRegistriesDropIn)
+	if config.DryRun {
+		logger.Debug("Dry run: not writing %s or %d certificate files", dropInPath, len(files))
+		return nil
+	}
+
+	// #nosec G301 -- registries.conf.d holds configuration, not credentials
+	if err := os.MkdirAll(filepath.Dir(dropInPath), 0755); err != nil {
+		return fmt.Errorf("failed to create registries.conf.d: %v", err)
+	}
+	// #nosec G306 -- registries.conf is configuration, not credentials
+	if err := os.WriteFile(dropInPath, []byte(dropIn.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", dropInPath, err)
+	}
+	logger.Debug("Wrote Buildah registry configuration: %s", dropInPath)
+
+	targets := make([]string, 0, len(files))
+	for target := range files {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		// #nosec G304 -- certificate files given by the user with --registry-config
+		data, err := os.ReadFile(files[target])
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", files[target], err)
+		}
+		// #nosec G301 -- certs.d directories are readable like /etc/containers/certs.d
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", filepath.Dir(target), err)
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %v", target, err)
+		}
+		logger.Debug("Installed %s for Buildah", target)
+	}
+	return nil
+}
+
+// buildkitRegistryTLS returns the buildkitd.toml settings of a registry with
+// --registry-config beyond insecure: its CAs (with extraCA, the --ca-bundle,
+// when set) and client certificate
+func buildkitRegistryTLS(registry auth.RegistryTLS, extraCA string) string {
+	var sb strings.Builder
+	var cas []string
+	if extraCA != "" {
+		cas = append(cas, fmt.Sprintf("%q", extraCA))
+	}
+	if registry.CA != "" {
+		cas = append(cas, fmt.Sprintf("%q", registry.CA))
+	}
+	if len(cas) > 0 {
+		fmt.Fprintf(&sb, "  ca = [%s]\n", strings.Join(cas, ", "))
+	}
+	if registry.ClientCert != "" {
+		fmt.Fprintf(&sb, "\n[[registry.%q.keypair]]\n  key = %q\n  cert = %q\n", registry.Host, registry.ClientKey, registry.ClientCert)
+	}
+	return sb.String()
+}
@@ -0,0 +1,108 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// remoteBuildkitdTimeout bounds the reachability check of an external buildkitd
+const remoteBuildkitdTimeout = 15 * time.Second
+
+// buildkitAddrSchemes are the buildctl address schemes accepted by --buildkit-addr
+var buildkitAddrSchemes = []string{"tcp://", "unix://", "kube-pod://", "docker-container://", "podman-container://", "nerdctl-container://"}
+
+// validateBuildKitAddr checks the external buildkitd address and its TLS files
+func validateBuildKitAddr(config Config) error {
+	hasTLS := config.BuildkitTLSCACert != "" || config.BuildkitTLSCert != "" || config.BuildkitTLSKey != "" || config.BuildkitTLSServerName != ""
+	if config.BuildkitAddr == "" {
+		if hasTLS {
+			return fmt.Errorf("--buildkit-tls-* options require --buildkit-addr or BUILDKIT_HOST")
+		}
+		return nil
+	}
+
+	if strings.ContainsAny(config.BuildkitAddr, "\x00 \t\n") {
+		return fmt.Errorf("invalid buildkit address %q", config.BuildkitAddr)
+	}
+	supported := false
+	for _, scheme := range buildkitAddrSchemes {
+		if strings.HasPrefix(config.BuildkitAddr, scheme) && len(config.BuildkitAddr) > len(scheme) {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("invalid buildkit address %q (expected one of: %s)", config.BuildkitAddr, strings.Join(buildkitAddrSchemes, ", "))
+	}
+
+	if hasTLS && !strings.HasPrefix(config.BuildkitAddr, "tcp://") {
+		return fmt.Errorf("--buildkit-tls-* options require a tcp:// buildkit address")
+	}
+	if (config.BuildkitTLSCert == "") != (config.BuildkitTLSKey == "") {
+		return fmt.Errorf("--buildkit-tls-cert and --buildkit-tls-key must be used together")
+	}
+	for flag, path := range map[string]string{
+		"--buildkit-tls-ca":   config.BuildkitTLSCACert,
+		"--buildkit-tls-cert": config.BuildkitTLSCert,
+		"--buildkit-tls-key":  config.BuildkitTLSKey,
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("invalid %s: %v", flag, err)
+		}
+	}
+	return nil
+}
+
+// buildctlGlobalArgs returns the buildctl options that select and authenticate
+// to an external buildkitd; the address itself is passed as BUILDKIT_HOST
+func buildctlGlobalArgs(config Config) []string {
+	var args []string
+	if config.BuildkitTLSCACert != "" {
+		args = append(args, "--tlscacert", config.BuildkitTLSCACert)
+	}
+	if config.BuildkitTLSCert != "" {
+		args = append(args, "--tlscert", config.BuildkitTLSCert, "--tlskey", config.BuildkitTLSKey)
+	}
+	if config.BuildkitTLSServerName != "" {
+		args = append(args, "--tlsservername", config.BuildkitTLSServerName)
+	}
+	return args
+}
+
+// checkRemoteBuildkitd fails early with buildctl's error when the external
+// buildkitd cannot be reached, e.g. because of a wrong address or certificate.
+// A tcp:// daemon's certificate is verified first; without TLS a warning is logged.
+func checkRemoteBuildkitd(config Config) error {
+	if strings.HasPrefix(config.BuildkitAddr, "tcp://") {
+		if config.BuildkitTLSCACert == "" {
+			logger.Warning("buildkitd at %s is used without TLS: its identity is not verified", config.BuildkitAddr)
+			logger.Warning("and build contexts and secrets are sent in clear text (see 'kimia buildkit-certs')")
+		} else if err := verifyBuildkitdIdentity(config); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteBuildkitdTimeout)
+	defer cancel()
+
+	args := append(buildctlGlobalArgs(config), "debug", "info")
+	// #nosec G204 -- address and TLS paths validated by validateBuildKitAddr
+	cmd := exec.CommandContext(ctx, "buildctl", args...)
+	cmd.Env = append(os.Environ(), "BUILDKIT_HOST="+config.BuildkitAddr)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot reach buildkitd at %s: %v: %s", config.BuildkitAddr, err, strings.TrimSpace(string(output)))
+	}
+	logger.Info("Using external buildkitd at %s", config.BuildkitAddr)
+	logger.Debug("buildkitd info: %s", strings.TrimSpace(string(output)))
+	return nil
+}
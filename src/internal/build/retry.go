@@ -0,0 +1,78 @@
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// transientErrorPatterns match builder output of failures caused by flaky
+// networks or package mirrors rather than by the Dockerfile itself
+var transientErrorPatterns = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"DNS failure", regexp.MustCompile(`(?i)temporary failure in name resolution|could not resolve host|no such host|server misbehaving|EAI_AGAIN|name or service not known`)},
+	{"TLS handshake timeout", regexp.MustCompile(`(?i)TLS handshake timeout`)},
+	{"connection timeout", regexp.MustCompile(`(?i)i/o timeout|connection timed out|ETIMEDOUT|operation timed out`)},
+	{"connection reset", regexp.MustCompile(`(?i)connection reset by peer|ECONNRESET|unexpected EOF`)},
+	{"server error from mirror", regexp.MustCompile(`(?i)\b50[0234] (?:Internal Server Error|Bad Gateway|Service Unavailable|Gateway Time-?out)|\bHTTP error 5\d\d\b|\b5\d\d Server Error\b`)},
+	{"mirror sync in progress", regexp.MustCompile(`(?i)Hash Sum mismatch`)},
+}
+
+// stageNameRegex matches Dockerfile stage names that are safe to pass to no-cache
+var stageNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// unnamedStageRegex matches the names BuildKit shows for stages without AS
+var unnamedStageRegex = regexp.MustCompile(`^stage-\d+$`)
+
+// transientFailure returns the kind of transient error found in output, or ""
+func transientFailure(output string) string {
+	for _, p := range transientErrorPatterns {
+		if p.pattern.MatchString(output) {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// buildkitFailedStep returns the step that failed in BuildKit plain progress
+// output and the log lines of that step
+func buildkitFailedStep(output string) (StepTiming, string, bool) {
+	for _, step := range parseBuildKitTimings(output) {
+		if step.Status != stepError {
+			continue
+		}
+		var logs []string
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, "#"+step.vertex+" ") {
+				logs = append(logs, line)
+			}
+		}
+		return step, strings.Join(logs, "\n"), true
+	}
+	return StepTiming{}, "", false
+}
+
+// buildkitRetryArgs returns buildctl args for retrying a build whose stage
+// failed: the cache of that stage is ignored, or of every stage when the
+// failed stage has no name the Dockerfile frontend can match
+func buildkitRetryArgs(args []string, stage string) []string {
+	retry := append([]string(nil), args...)
+
+	if stage != "" && stageNameRegex.MatchString(stage) && !unnamedStageRegex.MatchString(stage) {
+		return append(retry, "--opt", "no-cache="+stage)
+	}
+	return append(retry, "--no-cache")
+}
+
+// transientRetryDelay is the pause before a retry, growing with each attempt
+func transientRetryDelay(attempt int) time.Duration {
+	return time.Duration(attempt*5) * time.Second
+}
+
+// transientRetryMessage describes why a build is retried
+func transientRetryMessage(signature string, attempt, retries int) string {
+	return fmt.Sprintf("Build failed with a transient network error (%s); retrying (attempt %d/%d)", signature, attempt, retries)
+}
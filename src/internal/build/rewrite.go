@@ -0,0 +1,403 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// BaseImageRewriteLabel records the original base image references when
+// --base-image-rewrite changes them. BuildKit includes labels in the
+// provenance invocation parameters, so the originals also end up there.
+const BaseImageRewriteLabel = "io.rapidfort.kimia.base-image-rewrites"
+
+// BaseImageRewrite is a single --base-image-rewrite rule of the form
+// PATTERN=REPLACEMENT, e.g. docker.io/*=mirror.corp/proxy/*
+type BaseImageRewrite struct {
+	Pattern     string
+	Replacement string
+}
+
+// RewrittenImage records an image reference changed by a rewrite rule
+type RewrittenImage struct {
+	Original  string `json:"original"`
+	Rewritten string `json:"rewritten"`
+}
+
+// ParseBaseImageRewrites parses --base-image-rewrite rules
+func ParseBaseImageRewrites(rules []string) ([]BaseImageRewrite, error) {
+	parsed := make([]BaseImageRewrite, 0, len(rules))
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid base image rewrite %q (expected PATTERN=REPLACEMENT)", rule)
+		}
+		if strings.ContainsAny(rule, " \t\n\r\x00") {
+			return nil, fmt.Errorf("invalid base image rewrite %q: contains whitespace or null bytes", rule)
+		}
+		if strings.Count(parts[0], "*") > 1 || strings.Count(parts[1], "*") > 1 {
+			return nil, fmt.Errorf("invalid base image rewrite %q: only one '*' wildcard is supported", rule)
+		}
+		if strings.Contains(parts[1], "*") && !strings.Contains(parts[0], "*") {
+			return nil, fmt.Errorf("invalid base image rewrite %q: replacement wildcard requires a pattern wildcard", rule)
+		}
+		parsed = append(parsed, BaseImageRewrite{
+			Pattern:     normalizeRewritePattern(parts[0]),
+			Replacement: parts[1],
+		})
+	}
+	return parsed, nil
+}
+
+// normalizeRewritePattern expands Docker Hub shorthands in a pattern so that
+// "ubuntu*" and "docker.io/library/ubuntu*" behave the same
+func normalizeRewritePattern(pattern string) string {
+	idx := strings.Index(pattern, "*")
+	if idx < 0 {
+		return NormalizeImageReference(pattern)
+	}
+
+	prefix := pattern[:idx]
+	if prefix == "" {
+		return pattern
+	}
+	if slash := strings.Index(prefix, "/"); slash >= 0 {
+		domain := prefix[:slash]
+		if domain == "index.docker.io" {
+			return "docker.io" + pattern[slash:]
+		}
+		if strings.ContainsAny(domain, ".:") || domain == "localhost" {
+			return pattern
+		}
+		return "docker.io/" + pattern
+	}
+	// "docker.io*" globs registries; "ubuntu*" globs official images
+	if strings.ContainsAny(prefix, ".:") {
+		return pattern
+	}
+	return "docker.io/library/" + pattern
+}
+
+// NormalizeImageReference expands a familiar image name to its fully
+// qualified form (e.g. "ubuntu:22.04" -> "docker.io/library/ubuntu:22.04")
+func NormalizeImageReference(ref string) string {
+	firstSlash := strings.Index(ref, "/")
+	if firstSlash < 0 {
+		return "docker.io/library/" + ref
+	}
+
+	domain := ref[:firstSlash]
+	if !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+		return "docker.io/" + ref
+	}
+
+	if domain == "index.docker.io" {
+		ref = "docker.io" + ref[firstSlash:]
+	}
+	if strings.HasPrefix(ref, "docker.io/") && !strings.Contains(ref[len("docker.io/"):], "/") {
+		return "docker.io/library/" + ref[len("docker.io/"):]
+	}
+	return ref
+}
+
+// splitReferenceSuffix splits an image reference into name and tag/digest suffix
+func splitReferenceSuffix(ref string) (string, string) {
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		return ref[:idx], ref[idx:]
+	}
+	lastSlash := strings.LastIndex(ref, "/")
+	if idx := strings.LastIndex(ref, ":"); idx > lastSlash {
+		return ref[:idx], ref[idx:]
+	}
+	return ref, ""
+}
+
+// Apply rewrites ref if it matches the rule. Wildcard patterns match the full
+// normalized reference; plain patterns match the image name and keep the tag.
+func (r BaseImageRewrite) Apply(ref string) (string, bool) {
+	normalized := NormalizeImageReference(ref)
+
+	if idx := strings.Index(r.Pattern, "*"); idx >= 0 {
+		prefix, suffix := r.Pattern[:idx], r.Pattern[idx+1:]
+		if !strings.HasPrefix(normalized, prefix) || !strings.HasSuffix(normalized, suffix) ||
+			len(normalized) < len(prefix)+len(suffix) {
+			return ref, false
+		}
+		captured := normalized[len(prefix) : len(normalized)-len(suffix)]
+		return strings.Replace(r.Replacement, "*", captured, 1), true
+	}
+
+	name, tag := splitReferenceSuffix(normalized)
+	if name != r.Pattern {
+		return ref, false
+	}
+	return r.Replacement + tag, true
+}
+
+// RewriteImageReference applies the first matching rule to ref
+func RewriteImageReference(ref string, rules []BaseImageRewrite) (string, bool) {
+	for _, rule := range rules {
+		if rewritten, ok := rule.Apply(ref); ok {
+			return rewritten, true
+		}
+	}
+	return ref, false
+}
+
+var (
+	// argRefRegex matches $VAR and ${VAR} references
+	argRefRegex = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)\}?`)
+	// syntaxDirectiveRegex matches the BuildKit frontend directive
+	syntaxDirectiveRegex = regexp.MustCompile(`^(#\s*syntax\s*=\s*)(\S+)(.*)$`)
+)
+
+// RewriteDockerfile rewrites FROM, COPY --from and "# syntax=" image references
+// in a Dockerfile. Global ARG defaults and buildArgs are substituted into FROM
+// lines first so that parameterized base images can be rewritten too.
+func RewriteDockerfile(content string, rules []BaseImageRewrite, buildArgs map[string]string) (string, []RewrittenImage) {
+	var rewrites []RewrittenImage
+	stages := make(map[string]bool)
+	globalArgs := make(map[string]string)
+	seenFrom := false
+	inPreamble := true
+
+	record := func(original, rewritten string) {
+		rewrites = append(rewrites, RewrittenImage{Original: original, Rewritten: rewritten})
+		logger.Info("Rewriting base image %s -> %s", original, rewritten)
+	}
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		// Parser directives only appear before any instruction
+		if inPreamble && strings.HasPrefix(trimmed, "#") {
+			if m := syntaxDirectiveRegex.FindStringSubmatch(trimmed); m != nil {
+				if rewritten, ok := RewriteImageReference(m[2], rules); ok {
+					record(m[2], rewritten)
+					lines[i] = m[1] + rewritten + m[3]
+				}
+			}
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		inPreamble = false
+
+		fields := strings.Fields(trimmed)
+		instruction := strings.ToUpper(fields[0])
+
+		switch instruction {
+		case "ARG":
+			if seenFrom {
+				continue
+			}
+			for _, decl := range fields[1:] {
+				kv := strings.SplitN(decl, "=", 2)
+				if len(kv) == 2 {
+					globalArgs[kv[0]] = strings.Trim(kv[1], `"'`)
+				} else {
+					globalArgs[kv[0]] = ""
+				}
+			}
+
+		case "FROM":
+			seenFrom = true
+			if idx, image, ok := fromImage(fields, globalArgs, buildArgs, stages); ok {
+				if rewritten, ok := RewriteImageReference(image, rules); ok {
+					record(image, rewritten)
+					fields[idx] = rewritten
+					lines[i] = leadingWhitespace(line) + strings.Join(fields, " ")
+				}
+			}
+			// Stage names take effect from the next instruction onward
+			for name := range stageNames(fields) {
+				stages[name] = true
+			}
+
+		case "COPY":
+			changed := false
+			for j, field := range fields[1:] {
+				if !strings.HasPrefix(field, "--from=") {
+					continue
+				}
+				src := strings.TrimPrefix(field, "--from=")
+				// Stage names and indexes are not images
+				if stages[strings.ToLower(src)] || isAllDigits(src) || strings.Contains(src, "$") {
+					continue
+				}
+				if rewritten, ok := RewriteImageReference(src, rules); ok {
+					record(src, rewritten)
+					fields[j+1] = "--from=" + rewritten
+					changed = true
+				}
+			}
+			if changed {
+				lines[i] = leadingWhitespace(line) + strings.Join(fields, " ")
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n"), rewrites
+}
+
+// fromImage returns the index and ARG-expanded value of the image in a FROM
+// instruction, or false when it is scratch, a previous stage or unresolvable
+func fromImage(fields []string, globalArgs, buildArgs map[string]string, stages map[string]bool) (int, string, bool) {
+	idx := 1
+	for idx < len(fields) && strings.HasPrefix(fields[idx], "--") {
+		idx++
+	}
+	if idx >= len(fields) {
+		return 0, "", false
+	}
+
+	image := expandDockerfileArgs(fields[idx], globalArgs, buildArgs)
+	if strings.Contains(image, "$") {
+		logger.Warning("Cannot rewrite base image %s: unresolved build argument", fields[idx])
+		return 0, "", false
+	}
+	if image == "scratch" || stages[strings.ToLower(image)] {
+		return 0, "", false
+	}
+	return idx, image, true
+}
+
+// stageNames returns the stage name declared by a FROM instruction
+func stageNames(fields []string) map[string]bool {
+	names := make(map[string]bool)
+	for i := 1; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], "AS") {
+			names[strings.ToLower(fields[i+1])] = true
+		}
+	}
+	return names
+}
+
+// expandDockerfileArgs substitutes $VAR/${VAR} using build args, then global ARG defaults
+func expandDockerfileArgs(value string, globalArgs, buildArgs map[string]string) string {
+	return argRefRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		name := argRefRegex.FindStringSubmatch(ref)[1]
+		if v, ok := buildArgs[name]; ok && v != "" {
+			return v
+		}
+		if v, ok := globalArgs[name]; ok && v != "" {
+			return v
+		}
+		return ref
+	})
+}
+
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+func isAllDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// preparedDockerfile is a copy of the user's Dockerfile changed by
+// --base-image-rewrite or --split-large-layers
+type preparedDockerfile struct {
+	Dir      string           // Temporary directory holding the generated Dockerfile
+	Rewrites []RewrittenImage // Base images changed by rewrite rules
+	Splits   map[int]int      // Line of each split COPY -> number of COPY instructions
+}
+
+// prepareRewrittenDockerfile applies --base-image-rewrite rules and the
+// --max-layer-size check to dockerfilePath and writes the result into a new
+// temporary directory, together with the --ignore-file override. It returns
+// nil when the Dockerfile is unchanged and no ignore file is given.
+func prepareRewrittenDockerfile(config Config, dockerfilePath, contextDir string) (*preparedDockerfile, error) {
+	rules, err := ParseBaseImageRewrites(config.BaseImageRewrites)
+	if err != nil {
+		return nil, fmt.Errorf("base image rewrite failed: %v", err)
+	}
+
+	// #nosec G304 -- dockerfilePath is the user-specified Dockerfile within the build context
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+
+	prepared := &preparedDockerfile{}
+	result := string(content)
+	if len(rules) > 0 {
+		result, prepared.Rewrites = RewriteDockerfile(result, rules, config.BuildArgs)
+		if len(prepared.Rewrites) == 0 {
+			logger.Info("No base images matched --base-image-rewrite rules")
+		}
+	}
+
+	if config.MaxLayerSize > 0 {
+		result, prepared.Splits, err = checkLayerSizes(result, contextDir, dockerfilePath, config.IgnoreFile, config.MaxLayerSize, config.SplitLargeLayers)
+		if err != nil {
+			return nil, fmt.Errorf("layer size check failed: %v", err)
+		}
+	}
+
+	if len(prepared.Rewrites) == 0 && len(prepared.Splits) == 0 && config.IgnoreFile == "" {
+		return nil, nil
+	}
+
+	prepared.Dir, err = newTempDir("", "kimia-dockerfile-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory for generated Dockerfile: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(prepared.Dir, "Dockerfile"), []byte(result), 0600); err != nil {
+		removeTemp(prepared.Dir)
+		return nil, fmt.Errorf("failed to write generated Dockerfile: %v", err)
+	}
+
+	// BuildKit reads a Dockerfile-specific ignore file from next to the Dockerfile,
+	// which is also how an --ignore-file override takes precedence over .dockerignore
+	ignoreFile := config.IgnoreFile
+	if ignoreFile == "" {
+		ignoreFile = dockerfilePath + ".dockerignore"
+	}
+	// #nosec G304 -- user-specified ignore file or sibling of the user-specified Dockerfile
+	if ignore, err := os.ReadFile(ignoreFile); err == nil {
+		if err := os.WriteFile(filepath.Join(prepared.Dir, "Dockerfile.dockerignore"), ignore, 0600); err != nil {
+			logger.Warning("Failed to copy %s: %v", ignoreFile, err)
+		}
+	} else if config.IgnoreFile != "" {
+		removeTemp(prepared.Dir)
+		return nil, fmt.Errorf("failed to read --ignore-file: %v", err)
+	}
+
+	return prepared, nil
+}
+
+// rewriteLabelValue encodes rewritten references for BaseImageRewriteLabel
+func rewriteLabelValue(rewrites []RewrittenImage) string {
+	data, err := json.Marshal(rewrites)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// withLabel returns a copy of labels with key set to value
+func withLabel(labels map[string]string, key, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[key] = value
+	return result
+}
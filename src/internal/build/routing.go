@@ -0,0 +1,201 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/internal/validation"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// ociImageIndexType is the media type of the index merging routed platform images
+const ociImageIndexType = "application/vnd.oci.image.index.v1+json"
+
+// imageIndex is an OCI image index as pushed by Kimia
+type imageIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []auth.Descriptor `json:"manifests"`
+}
+
+// routedImage is a platform image pushed by digest to every destination
+type routedImage struct {
+	platform string
+	digests  map[string]string // Destination -> manifest or index digest
+}
+
+// ParseBuilderEndpoint parses a --builder-endpoint PLATFORM=ADDR value and
+// returns the normalized platform and the buildkitd address
+func ParseBuilderEndpoint(spec string) (string, string, error) {
+	platform, addr, ok := strings.Cut(spec, "=")
+	platform, addr = strings.TrimSpace(platform), strings.TrimSpace(addr)
+	if !ok || platform == "" || addr == "" {
+		return "", "", fmt.Errorf("invalid --builder-endpoint %q (expected PLATFORM=ADDR, e.g. linux/arm64=tcp://arm-builders:1234)", spec)
+	}
+	if err := validation.ValidatePlatform(platform); err != nil {
+		return "", "", fmt.Errorf("invalid --builder-endpoint %q: %v", spec, err)
+	}
+	if err := validateBuildKitAddr(Config{BuildkitAddr: addr}); err != nil {
+		return "", "", fmt.Errorf("invalid --builder-endpoint %q: %v", spec, err)
+	}
+	return normalizePlatform(platform), addr, nil
+}
+
+// EndpointPlatforms returns the platforms of the --builder-endpoint values,
+// sorted, in the comma-separated form of --custom-platform
+func EndpointPlatforms(endpoints map[string]string) string {
+	platforms := make([]string, 0, len(endpoints))
+	for platform := range endpoints {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return strings.Join(platforms, ",")
+}
+
+// EndpointFor returns the --builder-endpoint address of platform
+func EndpointFor(endpoints map[string]string, platform string) (string, bool) {
+	addr, ok := endpoints[normalizePlatform(platform)]
+	return addr, ok
+}
+
+// RoutedBuildkitAddr returns the buildkitd address that selects BuildKit for
+// a build: --buildkit-addr, or any --builder-endpoint when it is not given
+func RoutedBuildkitAddr(buildkitAddr string, endpoints map[string]string) string {
+	if buildkitAddr != "" || len(endpoints) == 0 {
+		return buildkitAddr
+	}
+	return endpoints[strings.Split(EndpointPlatforms(endpoints), ",")[0]]
+}
+
+// executeRoutedBuildKit builds each platform on the buildkitd given for it
+// with --builder-endpoint, or on --buildkit-addr or the bundled buildkitd
+// when it has none, so that no platform needs QEMU on a native builder. The
+// platform images are pushed by digest and merged into one image index that
+// is pushed to every destination.
+func executeRoutedBuildKit(config Config, ctx *Context) error {
+	platforms := splitPlatforms(config.CustomPlatform)
+	if len(platforms) == 0 {
+		return fmt.Errorf("--builder-endpoint needs the platforms to build (--custom-platform)")
+	}
+	built := make(map[string]bool, len(platforms))
+	for _, platform := range platforms {
+		built[normalizePlatform(platform)] = true
+	}
+	for platform := range config.BuilderEndpoints {
+		if !built[platform] {
+			logger.Warning("--builder-endpoint %s is not used: %s is not in --custom-platform", platform, platform)
+		}
+	}
+
+	images := make([]routedImage, 0, len(platforms))
+	for i, platform := range platforms {
+		platformConfig := config
+		platformConfig.CustomPlatform = platform
+		platformConfig.pushByDigest = true
+		// Verification, signing and digest files apply to the merged index
+		platformConfig.VerifyPush = false
+		platformConfig.Sign = false
+		platformConfig.DigestFile = ""
+		platformConfig.ImageNameWithDigestFile = ""
+		platformConfig.ImageNameTagWithDigestFile = ""
+		platformConfig.DigestMapFile = ""
+		if addr, ok := EndpointFor(config.BuilderEndpoints, platform); ok {
+			platformConfig.BuildkitAddr = addr
+		}
+
+		builder := platformConfig.BuildkitAddr
+		if builder == "" {
+			if _, err := exec.LookPath("buildkitd"); err != nil && !config.DryRun {
+				return fmt.Errorf("platform %s has no --builder-endpoint and buildkitd is not installed; add an endpoint for it or set --buildkit-addr", platform)
+			}
+			builder = "the local buildkitd"
+		}
+		logger.Info("Building platform %d/%d: %s on %s", i+1, len(platforms), platform, builder)
+		digests, _, err := runBuildKit(platformConfig, ctx)
+		if err != nil {
+			return fmt.Errorf("platform %s: %w", platform, err)
+		}
+		images = append(images, routedImage{platform: platform, digests: digests})
+	}
+
+	if config.DryRun {
+		logger.Info("Dry run: the %d platform images would be merged into an image index pushed to %s", len(platforms), strings.Join(config.Destination, ", "))
+		return nil
+	}
+
+	digestMap := make(map[string]string)
+	var descriptor auth.Descriptor
+	for _, dest := range config.Destination {
+		merged, err := mergePlatformImages(config, dest, images)
+		if err != nil {
+			return fmt.Errorf("failed to merge the platform images into %s: %v", dest, err)
+		}
+		logger.Info("Pushed image index %s@%s (%d platforms)", dest, merged.Digest, len(images))
+		digestMap[dest] = merged.Digest
+		descriptor = merged
+	}
+	return publishPushedImages(config, digestMap, descriptor)
+}
+
+// mergePlatformImages pushes an image index with the platform images pushed
+// to dest. A platform image that is an index itself, because BuildKit added
+// an attestation manifest, contributes all of its manifests.
+func mergePlatformImages(config Config, dest string, images []routedImage) (auth.Descriptor, error) {
+	insecure := config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+	repo, reference := auth.NewRepository(dest, insecure)
+
+	index := imageIndex{SchemaVersion: 2, MediaType: ociImageIndexType, Manifests: []auth.Descriptor{}}
+	for _, image := range images {
+		digest := image.digests[dest]
+		if digest == "" {
+			return auth.Descriptor{}, fmt.Errorf("the digest of the %s image is unknown", image.platform)
+		}
+		raw, mediaType, err := repo.FetchRawManifest(digest)
+		if err != nil {
+			return auth.Descriptor{}, err
+		}
+		if got := sha256Digest(raw); got != digest {
+			return auth.Descriptor{}, fmt.Errorf("registry returned manifest content with digest %s for %s", got, digest)
+		}
+		var manifest auth.Manifest
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return auth.Descriptor{}, fmt.Errorf("invalid manifest %s: %v", digest, err)
+		}
+		if len(manifest.Manifests) > 0 {
+			index.Manifests = append(index.Manifests, manifest.Manifests...)
+			continue
+		}
+		if mediaType == "" {
+			mediaType = manifest.MediaType
+		}
+		platform := routedPlatform(image.platform)
+		index.Manifests = append(index.Manifests, auth.Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(raw)), Platform: &platform})
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return auth.Descriptor{}, err
+	}
+	digest, err := repo.PushManifest(reference, ociImageIndexType, data)
+	if err != nil {
+		return auth.Descriptor{}, err
+	}
+	return auth.Descriptor{MediaType: ociImageIndexType, Digest: digest, Size: int64(len(data))}, nil
+}
+
+// routedPlatform splits an os/arch[/variant] platform
+func routedPlatform(platform string) auth.Platform {
+	parts := strings.SplitN(normalizePlatform(platform), "/", 3)
+	result := auth.Platform{OS: parts[0]}
+	if len(parts) > 1 {
+		result.Architecture = parts[1]
+	}
+	if len(parts) > 2 {
+		result.Variant = parts[2]
+	}
+	return result
+}
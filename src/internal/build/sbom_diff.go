@@ -0,0 +1,485 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// SBOMDiffArtifactType is the artifact type of the SBOM diff attached to the image
+const SBOMDiffArtifactType = "application/vnd.rapidfort.kimia.sbom-diff+json"
+
+// Predicate types of the SBOMs read for the diff
+const (
+	spdxPredicateType      = "https://spdx.dev/Document"
+	cycloneDXPredicateType = "https://cyclonedx.org/bom"
+)
+
+// maxSBOMDiffLines bounds the packages printed per section of the diff; the
+// attached artifact lists them all
+const maxSBOMDiffLines = 50
+
+// SBOMDiffConfig selects the build whose SBOM is compared with the previous build
+type SBOMDiffConfig struct {
+	HistoryFile      string
+	Record           *BuildRecord // The build just pushed
+	Insecure         bool
+	InsecureRegistry []string
+	AttestationRepos AttestationRepos
+	EventsFile       string
+}
+
+// SBOMPackage is a package listed in an SBOM
+type SBOMPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+}
+
+// PackageChange is a package found in both SBOMs with another version
+type PackageChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	PURL string `json:"purl,omitempty"` // Package URL in the new SBOM
+}
+
+// SBOMDiff lists how the packages of an image changed since the previous build
+type SBOMDiff struct {
+	Image         string          `json:"image"`         // repository@digest of this build
+	Previous      string          `json:"previous"`      // repository@digest of the previous build
+	PreviousBuild string          `json:"previousBuild"` // ID of the previous build in the history
+	Added         []SBOMPackage   `json:"added"`
+	Removed       []SBOMPackage   `json:"removed"`
+	Upgraded      []PackageChange `json:"upgraded"`
+	Downgraded    []PackageChange `json:"downgraded"`
+}
+
+// DiffSBOM compares the SBOM of the pushed image with the SBOM of the image
+// the previous build in the history pushed to the same repository, prints
+// the added, removed, upgraded and downgraded packages and attaches the diff
+// to the image. Nothing is compared without a previous build or its SBOM.
+func DiffSBOM(config SBOMDiffConfig) error {
+	record := config.Record
+	dest := ""
+	for _, name := range sortedKeys(record.Digests) {
+		if record.Digests[name] != "" {
+			dest = name
+			break
+		}
+	}
+	if dest == "" {
+		return fmt.Errorf("no pushed image to compare")
+	}
+	digest := record.Digests[dest]
+
+	records, err := ReadHistory(config.HistoryFile)
+	if err != nil {
+		return err
+	}
+	previous, previousDigest := previousImageBuild(records, record, dest)
+	if previous == nil {
+		logger.Info("SBOM diff: no earlier build of %s in the history", dest)
+		return nil
+	}
+	if previousDigest == digest {
+		logger.Info("SBOM diff: %s is the image of build %s, no packages changed", dest, previous.ID)
+		return nil
+	}
+
+	insecure := func(ref string) bool {
+		return config.Insecure || isInsecureRegistry(ref, config.InsecureRegistry)
+	}
+	repo, _ := auth.NewRepository(dest, insecure(dest))
+	var stored *auth.Repository
+	if name := config.AttestationRepos.For(dest); name != "" {
+		stored, _ = auth.NewRepository(name, insecure(name))
+	}
+
+	current, err := imageSBOMs(repo, stored, digest)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("no SBOM found for %s@%s; build with --attestation=max, --attest type=sbom or --attach type=spdx", repo.Repository, digest)
+	}
+	before, err := imageSBOMs(repo, stored, previousDigest)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		logger.Info("SBOM diff: the image of build %s has no SBOM to compare with", previous.ID)
+		return nil
+	}
+
+	name := repo.Host + "/" + repo.Repository
+	diff := diffPackages(sbomPackages(before), sbomPackages(current))
+	diff.Image = name + "@" + digest
+	diff.Previous = name + "@" + previousDigest
+	diff.PreviousBuild = previous.ID
+	printSBOMDiff(diff)
+
+	if err := writeEvent(config.EventsFile, EventSBOMDiff, diff); err != nil {
+		logger.Warning("%v", err)
+	}
+	return attachSBOMDiff(diff, PushedImage{Destination: dest, Digest: digest}, config.AttestationRepos, insecure)
+}
+
+// previousImageBuild returns the newest successful build before record that
+// pushed to the repository of dest, and the digest it pushed there
+func previousImageBuild(records []BuildRecord, record *BuildRecord, dest string) (*BuildRecord, string) {
+	key := repositoryKey(dest)
+	for i := len(records) - 1; i >= 0; i-- {
+		previous := records[i]
+		if previous.ID == record.ID || !previous.Succeeded {
+			continue
+		}
+		for _, name := range sortedKeys(previous.Digests) {
+			if digest := previous.Digests[name]; digest != "" && repositoryKey(name) == key {
+				return &previous, digest
+			}
+		}
+	}
+	return nil, ""
+}
+
+// imageSBOMs returns every SBOM document of image digest: the BuildKit
+// attestations in its index and the SBOM referrers in repo and in its
+// attestation repository. It returns nil when the image has no SBOM.
+func imageSBOMs(repo, stored *auth.Repository, digest string) ([]json.RawMessage, error) {
+	manifest, _, err := repo.FetchManifest(digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s@%s: %v", repo.Repository, digest, err)
+	}
+
+	var documents []json.RawMessage
+	for _, predicateType := range []string{spdxPredicateType, cycloneDXPredicateType} {
+		for _, statement := range indexAttestations(repo, manifest, predicateType) {
+			documents = append(documents, statement.Predicate)
+		}
+	}
+
+	for _, source := range []*auth.Repository{repo, stored} {
+		if source == nil {
+			continue
+		}
+		referrers, _, err := source.Referrers(digest)
+		if err != nil {
+			logger.Debug("Failed to list referrers of %s: %v", digest, err)
+			continue
+		}
+		for _, desc := range referrers {
+			artifactType := desc.ArtifactType
+			if artifactType == "" {
+				artifactType = desc.MediaType
+			}
+			if classifyArtifact(artifactType, desc.Annotations) != ArtifactSBOM {
+				continue
+			}
+			artifact, _, err := source.FetchManifest(desc.Digest)
+			if err != nil {
+				logger.Debug("Failed to fetch SBOM %s: %v", desc.Digest, err)
+				continue
+			}
+			for _, layer := range artifact.Layers {
+				data, err := fetchSBOMBlob(source, layer.Digest)
+				if err != nil {
+					logger.Debug("Failed to read SBOM %s: %v", layer.Digest, err)
+					continue
+				}
+				documents = append(documents, sbomPredicate(data))
+			}
+		}
+	}
+	return documents, nil
+}
+
+// sbomPredicate returns the document an in-toto statement wraps, or data
+// when it is not a statement
+func sbomPredicate(data []byte) json.RawMessage {
+	var statement inTotoStatement
+	if err := json.Unmarshal(data, &statement); err == nil && len(statement.Predicate) > 0 {
+		return statement.Predicate
+	}
+	return data
+}
+
+// sbomPackages returns the packages of the SBOM documents
+func sbomPackages(documents []json.RawMessage) []SBOMPackage {
+	var packages []SBOMPackage
+	for _, document := range documents {
+		packages = append(packages, parseSBOMPackages(document)...)
+	}
+	return packages
+}
+
+// fetchSBOMBlob downloads an SBOM document and checks its digest
+func fetchSBOMBlob(repo *auth.Repository, digest string) ([]byte, error) {
+	body, err := repo.FetchBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxStatementSize))
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256Digest(data); got != digest {
+		return nil, fmt.Errorf("registry returned content with digest %s for %s", got, digest)
+	}
+	return data, nil
+}
+
+// sbomDocument holds the packages of SPDX and CycloneDX JSON documents
+type sbomDocument struct {
+	SPDXVersion string `json:"spdxVersion"`
+	BOMFormat   string `json:"bomFormat"`
+	Packages    []struct {
+		Name         string `json:"name"`
+		VersionInfo  string `json:"versionInfo"`
+		ExternalRefs []struct {
+			ReferenceType    string `json:"referenceType"`
+			ReferenceLocator string `json:"referenceLocator"`
+		} `json:"externalRefs"`
+	} `json:"packages"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// cycloneDXComponent is a CycloneDX component and the components it contains
+type cycloneDXComponent struct {
+	Name       string               `json:"name"`
+	Version    string               `json:"version"`
+	PURL       string               `json:"purl"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// parseSBOMPackages returns the packages of an SPDX or CycloneDX document
+func parseSBOMPackages(data []byte) []SBOMPackage {
+	var doc sbomDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+
+	var packages []SBOMPackage
+	for _, p := range doc.Packages {
+		pkg := SBOMPackage{Name: p.Name, Version: p.VersionInfo}
+		for _, ref := range p.ExternalRefs {
+			if ref.ReferenceType == "purl" {
+				pkg.PURL = ref.ReferenceLocator
+			}
+		}
+		if pkg.Name != "" {
+			packages = append(packages, pkg)
+		}
+	}
+	var walk func([]cycloneDXComponent)
+	walk = func(components []cycloneDXComponent) {
+		for _, c := range components {
+			if c.Name != "" {
+				packages = append(packages, SBOMPackage{Name: c.Name, Version: c.Version, PURL: c.PURL})
+			}
+			walk(c.Components)
+		}
+	}
+	walk(doc.Components)
+	return packages
+}
+
+// packageKey identifies a package across versions: its package URL without
+// the version and qualifiers, or its name
+func packageKey(pkg SBOMPackage) string {
+	if pkg.PURL == "" {
+		return pkg.Name
+	}
+	key := pkg.PURL
+	if i := strings.IndexAny(key, "?#"); i >= 0 {
+		key = key[:i]
+	}
+	if i := strings.LastIndex(key, "@"); i > strings.LastIndex(key, "/") {
+		key = key[:i]
+	}
+	return key
+}
+
+// diffPackages compares the packages of two SBOMs. A package found in both
+// with one version each is upgraded or downgraded; when either has several
+// versions, the versions only in one of them are added or removed.
+func diffPackages(before, after []SBOMPackage) SBOMDiff {
+	index := func(packages []SBOMPackage) map[string]map[string]SBOMPackage {
+		byKey := make(map[string]map[string]SBOMPackage)
+		for _, pkg := range packages {
+			key := packageKey(pkg)
+			if byKey[key] == nil {
+				byKey[key] = make(map[string]SBOMPackage)
+			}
+			byKey[key][pkg.Version] = pkg
+		}
+		return byKey
+	}
+	old, current := index(before), index(after)
+
+	diff := SBOMDiff{Added: []SBOMPackage{}, Removed: []SBOMPackage{}, Upgraded: []PackageChange{}, Downgraded: []PackageChange{}}
+	for key, versions := range current {
+		previous, ok := old[key]
+		if !ok {
+			for _, pkg := range versions {
+				diff.Added = append(diff.Added, pkg)
+			}
+			continue
+		}
+		if len(versions) == 1 && len(previous) == 1 {
+			pkg, was := onlyPackage(versions), onlyPackage(previous)
+			if pkg.Version == was.Version {
+				continue
+			}
+			change := PackageChange{Name: pkg.Name, From: was.Version, To: pkg.Version, PURL: pkg.PURL}
+			if compareVersions(pkg.Version, was.Version) < 0 {
+				diff.Downgraded = append(diff.Downgraded, change)
+			} else {
+				diff.Upgraded = append(diff.Upgraded, change)
+			}
+			continue
+		}
+		for version, pkg := range versions {
+			if _, ok := previous[version]; !ok {
+				diff.Added = append(diff.Added, pkg)
+			}
+		}
+		for version, pkg := range previous {
+			if _, ok := versions[version]; !ok {
+				diff.Removed = append(diff.Removed, pkg)
+			}
+		}
+	}
+	for key, versions := range old {
+		if _, ok := current[key]; !ok {
+			for _, pkg := range versions {
+				diff.Removed = append(diff.Removed, pkg)
+			}
+		}
+	}
+
+	sortPackages := func(packages []SBOMPackage) {
+		sort.Slice(packages, func(i, j int) bool {
+			if packages[i].Name != packages[j].Name {
+				return packages[i].Name < packages[j].Name
+			}
+			return packages[i].Version < packages[j].Version
+		})
+	}
+	sortChanges := func(changes []PackageChange) {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+	sortPackages(diff.Added)
+	sortPackages(diff.Removed)
+	sortChanges(diff.Upgraded)
+	sortChanges(diff.Downgraded)
+	return diff
+}
+
+// onlyPackage returns the package of a map holding one
+func onlyPackage(versions map[string]SBOMPackage) SBOMPackage {
+	for _, pkg := range versions {
+		return pkg
+	}
+	return SBOMPackage{}
+}
+
+// compareVersions compares two version strings by their runs of digits, as
+// numbers, and the text between them, returning -1, 0 or 1. As in Debian
+// versions, a part starting with ~ (1.0~rc1) sorts before anything else.
+func compareVersions(a, b string) int {
+	for a != "" || b != "" {
+		partA, restA := versionPart(a)
+		partB, restB := versionPart(b)
+		if tildeA, tildeB := strings.HasPrefix(partA, "~"), strings.HasPrefix(partB, "~"); tildeA != tildeB {
+			if tildeA {
+				return -1
+			}
+			return 1
+		}
+		numA, errA := strconv.ParseUint(partA, 10, 64)
+		numB, errB := strconv.ParseUint(partB, 10, 64)
+		switch {
+		case errA == nil && errB == nil && numA != numB:
+			if numA < numB {
+				return -1
+			}
+			return 1
+		case (errA != nil || errB != nil) && partA != partB:
+			if partA < partB {
+				return -1
+			}
+			return 1
+		}
+		a, b = restA, restB
+	}
+	return 0
+}
+
+// versionPart splits the leading run of digits or of other characters off a version
+func versionPart(version string) (string, string) {
+	if version == "" {
+		return "", ""
+	}
+	digit := version[0] >= '0' && version[0] <= '9'
+	i := 1
+	for i < len(version) && (version[i] >= '0' && version[i] <= '9') == digit {
+		i++
+	}
+	return version[:i], version[i:]
+}
+
+// printSBOMDiff logs the diff, up to maxSBOMDiffLines packages per section
+func printSBOMDiff(diff SBOMDiff) {
+	logger.Info("SBOM diff against build %s (%s): %d added, %d removed, %d upgraded, %d downgraded",
+		diff.PreviousBuild, diff.Previous, len(diff.Added), len(diff.Removed), len(diff.Upgraded), len(diff.Downgraded))
+	printPackages := func(mark string, packages []SBOMPackage) {
+		for i, pkg := range packages {
+			if i == maxSBOMDiffLines {
+				logger.Info("  %s ... and %d more", mark, len(packages)-i)
+				return
+			}
+			logger.Info("  %s %s %s", mark, pkg.Name, pkg.Version)
+		}
+	}
+	printChanges := func(mark string, changes []PackageChange) {
+		for i, change := range changes {
+			if i == maxSBOMDiffLines {
+				logger.Info("  %s ... and %d more", mark, len(changes)-i)
+				return
+			}
+			logger.Info("  %s %s %s -> %s", mark, change.Name, change.From, change.To)
+		}
+	}
+	printPackages("+", diff.Added)
+	printPackages("-", diff.Removed)
+	printChanges("↑", diff.Upgraded)
+	printChanges("↓", diff.Downgraded)
+}
+
+// attachSBOMDiff attaches the diff to the image as a referrer artifact
+func attachSBOMDiff(diff SBOMDiff, image PushedImage, repos AttestationRepos, insecure func(string) bool) error {
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode SBOM diff: %v", err)
+	}
+	dir, err := newTempDir("", "kimia-sbom-diff-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer removeTemp(dir)
+	file := filepath.Join(dir, "sbom-diff.json")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return fmt.Errorf("failed to write SBOM diff: %v", err)
+	}
+	return AttachArtifacts([]PushedImage{image}, []Attachment{{File: file, ArtifactType: SBOMDiffArtifactType}}, repos, insecure, false)
+}
@@ -0,0 +1,245 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// DefaultScanWebhookTimeout bounds the wait for a --scan-webhook verdict
+const DefaultScanWebhookTimeout = 10 * time.Minute
+
+// scanPollInterval is how often a pending scan is polled unless the scanner
+// asks for another interval with Retry-After
+const scanPollInterval = 5 * time.Second
+
+// Verdicts of a scan webhook
+const (
+	ScanVerdictPass  = "pass"
+	ScanVerdictWarn  = "warn"
+	ScanVerdictBlock = "block"
+)
+
+// ScanWebhookConfig selects the scanner that must approve pushed images (--scan-webhook)
+type ScanWebhookConfig struct {
+	URL     string
+	Timeout time.Duration // Time to wait for the verdict (0 = DefaultScanWebhookTimeout)
+	Secret  []byte        // HMAC key signing the request body; nil = unsigned
+}
+
+// ScanRequest is the JSON body posted to --scan-webhook
+type ScanRequest struct {
+	Image        string          `json:"image"` // repository@digest to scan
+	Digest       string          `json:"digest"`
+	Destinations []string        `json:"destinations"`
+	SBOMFormat   string          `json:"sbomFormat,omitempty"` // spdx or cyclonedx
+	SBOM         json.RawMessage `json:"sbom,omitempty"`       // SBOM of the image, when it has one
+}
+
+// ScanVerdict is the answer of a scan webhook
+type ScanVerdict struct {
+	Image           string         `json:"image,omitempty"` // Filled in by kimia
+	Verdict         string         `json:"verdict"`         // pass, warn or block
+	Summary         string         `json:"summary,omitempty"`
+	Vulnerabilities map[string]int `json:"vulnerabilities,omitempty"` // Count per severity
+	ReportURL       string         `json:"reportUrl,omitempty"`
+}
+
+// ScanPushedImages posts every pushed image to the scan webhook and waits for
+// the verdicts. An image the scanner blocks, or that cannot be scanned,
+// fails the push.
+func ScanPushedImages(config ScanWebhookConfig, images []PushedImage, repos AttestationRepos, insecure func(string) bool, eventsFile string) error {
+	byImage := make(map[string]*ScanRequest)
+	var order []string
+	for _, image := range images {
+		if image.Digest == "" {
+			return exitcode.Wrap(exitcode.Scan, fmt.Errorf("no digest known for %s to scan", image.Destination))
+		}
+		ref := repositoryKey(image.Destination) + "@" + image.Digest
+		if request, ok := byImage[ref]; ok {
+			request.Destinations = append(request.Destinations, image.Destination)
+			continue
+		}
+		request := &ScanRequest{Image: ref, Digest: image.Digest, Destinations: []string{image.Destination}}
+		repo, _ := auth.NewRepository(image.Destination, insecure(image.Destination))
+		var stored *auth.Repository
+		if name := repos.For(image.Destination); name != "" {
+			stored, _ = auth.NewRepository(name, insecure(name))
+		}
+		if documents, err := imageSBOMs(repo, stored, image.Digest); err != nil {
+			logger.Warning("Scanning %s without its SBOM: %v", ref, err)
+		} else if len(documents) > 0 {
+			request.SBOM = documents[0]
+			request.SBOMFormat = sbomFormat(documents[0])
+		}
+		byImage[ref] = request
+		order = append(order, ref)
+	}
+
+	for _, ref := range order {
+		verdict, err := requestScan(config, *byImage[ref])
+		if err != nil {
+			return exitcode.Wrap(exitcode.Scan, err)
+		}
+		verdict.Image = ref
+		if err := writeEvent(eventsFile, EventScanVerdict, verdict); err != nil {
+			logger.Warning("%v", err)
+		}
+		detail := scanVerdictDetail(verdict)
+		switch verdict.Verdict {
+		case ScanVerdictBlock:
+			return exitcode.Wrap(exitcode.Scan, fmt.Errorf("scan webhook blocked %s%s", ref, detail))
+		case ScanVerdictWarn:
+			logger.Warning("Scan webhook passed %s with warnings%s", ref, detail)
+		default:
+			logger.Info("Scan webhook passed %s%s", ref, detail)
+		}
+	}
+	return nil
+}
+
+// requestScan posts the request and waits for the verdict. A scanner that
+// needs time answers 202 Accepted with a Location to poll until it answers
+// with the verdict.
+func requestScan(config ScanWebhookConfig, request ScanRequest) (ScanVerdict, error) {
+	var verdict ScanVerdict
+	body, err := json.Marshal(request)
+	if err != nil {
+		return verdict, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScanWebhookTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: notifyTimeout}
+
+	logger.Info("Waiting for the verdict of scan webhook %s on %s", redactURL(config.URL), request.Image)
+	req, err := http.NewRequest(http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		return verdict, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kimia")
+	if len(config.Secret) > 0 {
+		req.Header.Set(NotifySignatureHeader, SignNotification(config.Secret, body))
+	}
+
+	for {
+		// #nosec G107 -- URL given by the user with --scan-webhook, or the Location it answered with
+		resp, err := client.Do(req)
+		if err != nil {
+			// The URL in the error may hold the webhook's secret
+			if urlErr, ok := err.(*url.Error); ok {
+				err = urlErr.Err
+			}
+			return verdict, fmt.Errorf("scan webhook %s failed: %v", redactURL(config.URL), err)
+		}
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusAccepted:
+			location := resp.Header.Get("Location")
+			if location == "" {
+				return verdict, fmt.Errorf("scan webhook %s answered 202 without a Location to poll", redactURL(config.URL))
+			}
+			next, err := req.URL.Parse(location)
+			if err != nil {
+				return verdict, fmt.Errorf("scan webhook %s answered an invalid Location: %v", redactURL(config.URL), err)
+			}
+			wait := scanPollInterval
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+			if time.Now().Add(wait).After(deadline) {
+				return verdict, fmt.Errorf("no verdict from scan webhook %s within %s", redactURL(config.URL), timeout)
+			}
+			logger.Debug("Scan of %s pending, polling again in %s", request.Image, wait)
+			time.Sleep(wait)
+			if req, err = http.NewRequest(http.MethodGet, next.String(), nil); err != nil {
+				return verdict, err
+			}
+			req.Header.Set("User-Agent", "kimia")
+
+		case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+			if err := json.Unmarshal(message, &verdict); err != nil {
+				return verdict, fmt.Errorf("invalid answer from scan webhook %s: %v", redactURL(config.URL), err)
+			}
+			switch verdict.Verdict {
+			case ScanVerdictPass, ScanVerdictWarn, ScanVerdictBlock:
+				return verdict, nil
+			}
+			return verdict, fmt.Errorf("scan webhook %s answered verdict %q (expected %s, %s or %s)", redactURL(config.URL), verdict.Verdict, ScanVerdictPass, ScanVerdictWarn, ScanVerdictBlock)
+
+		default:
+			return verdict, fmt.Errorf("scan webhook %s failed (HTTP %d): %s", redactURL(config.URL), resp.StatusCode, strings.TrimSpace(string(message)))
+		}
+	}
+}
+
+// scanVerdictDetail formats the summary, counts and report of a verdict for the log
+func scanVerdictDetail(verdict ScanVerdict) string {
+	var parts []string
+	if verdict.Summary != "" {
+		parts = append(parts, verdict.Summary)
+	}
+	for _, severity := range sortedSeverities(verdict.Vulnerabilities) {
+		parts = append(parts, fmt.Sprintf("%d %s", verdict.Vulnerabilities[severity], severity))
+	}
+	if verdict.ReportURL != "" {
+		parts = append(parts, "report: "+verdict.ReportURL)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// sortedSeverities returns the severities of counts, most severe first
+func sortedSeverities(counts map[string]int) []string {
+	rank := map[string]int{"critical": 0, "high": 1, "medium": 2, "low": 3, "negligible": 4, "unknown": 5}
+	severities := make([]string, 0, len(counts))
+	for severity := range counts {
+		severities = append(severities, severity)
+	}
+	rankOf := func(severity string) int {
+		if r, ok := rank[strings.ToLower(severity)]; ok {
+			return r
+		}
+		return len(rank)
+	}
+	sort.Slice(severities, func(i, j int) bool {
+		if rankOf(severities[i]) != rankOf(severities[j]) {
+			return rankOf(severities[i]) < rankOf(severities[j])
+		}
+		return severities[i] < severities[j]
+	})
+	return severities
+}
+
+// sbomFormat returns spdx or cyclonedx for an SBOM document, "" when unknown
+func sbomFormat(document json.RawMessage) string {
+	var doc sbomDocument
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return ""
+	}
+	switch {
+	case doc.SPDXVersion != "":
+		return "spdx"
+	case strings.EqualFold(doc.BOMFormat, "CycloneDX"):
+		return "cyclonedx"
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/validation"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// BuildSecret is a secret that RUN steps read with
+// RUN --mount=type=secret,id=ID, taken from a mounted Kubernetes Secret file
+// (--build-arg-from-secret) or an environment variable (--secret-from-env).
+// It is passed to the builder as a secret, never as a build arg, so it ends
+// up neither in the image history nor in the provenance.
+type BuildSecret struct {
+	ID   string
+	File string // Secret file, e.g. /var/run/secrets/npm/token
+	Env  string // Environment variable holding the secret
+}
+
+// ParseSecretFile parses a --build-arg-from-secret value: ID=PATH
+func ParseSecretFile(spec string) (BuildSecret, error) {
+	id, path, ok := strings.Cut(spec, "=")
+	if !ok || id == "" || path == "" {
+		return BuildSecret{}, fmt.Errorf("invalid --build-arg-from-secret %q (expected NAME=/path/to/secret/file)", spec)
+	}
+	return BuildSecret{ID: id, File: path}, nil
+}
+
+// ParseSecretEnv parses a --secret-from-env value: id=ID,env=VAR. Without
+// env the variable is named like the secret.
+func ParseSecretEnv(spec string) (BuildSecret, error) {
+	var secret BuildSecret
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || value == "" {
+			return secret, fmt.Errorf("invalid --secret-from-env field %q (expected key=value)", field)
+		}
+		switch key {
+		case "id":
+			secret.ID = value
+		case "env":
+			secret.Env = value
+		default:
+			return secret, fmt.Errorf("invalid --secret-from-env field %q (valid: id, env)", key)
+		}
+	}
+	if secret.ID == "" {
+		return secret, fmt.Errorf("invalid --secret-from-env %q: id is required", spec)
+	}
+	if secret.Env == "" {
+		secret.Env = secret.ID
+	}
+	return secret, nil
+}
+
+// PrepareSecrets checks that every secret can be read, and registers the
+// values with the logger so that they are redacted from Kimia's messages and
+// from the build output
+func PrepareSecrets(secrets []BuildSecret) error {
+	seen := make(map[string]bool)
+	for _, secret := range secrets {
+		if err := validation.ValidateSecretID(secret.ID); err != nil {
+			return err
+		}
+		if seen[secret.ID] {
+			return fmt.Errorf("secret %s is given more than once", secret.ID)
+		}
+		seen[secret.ID] = true
+
+		var value string
+		if secret.File != "" {
+			// #nosec G304 -- path is a user-provided CLI argument
+			data, err := os.ReadFile(secret.File)
+			if err != nil {
+				return fmt.Errorf("failed to read secret %s: %v", secret.ID, err)
+			}
+			value = string(data)
+		} else {
+			var set bool
+			if value, set = os.LookupEnv(secret.Env); !set {
+				return fmt.Errorf("secret %s: environment variable %s is not set", secret.ID, secret.Env)
+			}
+		}
+		if strings.TrimSpace(value) == "" {
+			logger.Warning("Secret %s is empty", secret.ID)
+		}
+		logger.AddSecret(value)
+		logger.Debug("Secret %s will be mounted into RUN --mount=type=secret,id=%s", secret.ID, secret.ID)
+	}
+	return nil
+}
+
+// secretArgs returns the --secret flags for the secrets; buildctl and
+// buildah take the same syntax
+func secretArgs(secrets []BuildSecret) []string {
+	var args []string
+	for _, secret := range secrets {
+		if secret.File != "" {
+			args = append(args, "--secret", "id="+secret.ID+",src="+secret.File)
+		} else {
+			args = append(args, "--secret", "id="+secret.ID+",env="+secret.Env)
+		}
+	}
+	return args
+}
@@ -0,0 +1,216 @@
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// rekorIndexPattern matches the transparency log entry cosign sign reports
+var rekorIndexPattern = regexp.MustCompile(`tlog entry created with index:\s*(\d+)`)
+
+// SignedImage is an image signed with cosign, as recorded in the signing report
+type SignedImage struct {
+	Reference     string   `json:"reference"`    // repository@digest that was signed
+	Digest        string   `json:"digest"`       // Image digest
+	Destinations  []string `json:"destinations"` // Destinations of this image in the repository
+	Signature     string   `json:"signature"`    // Tag of the signature, in the attestation repository if there is one
+	Key           string   `json:"key"`          // Key file or KMS URI
+	PublicKey     string   `json:"publicKeySha256,omitempty"`
+	RekorLogIndex *int64   `json:"rekorLogIndex,omitempty"` // Transparency log entry of the signature
+}
+
+// signImages signs every destination by digest. Destinations in the same
+// repository share one signature. What was signed, also when signing fails
+// part way, is written to the events file and the build history.
+func signImages(config Config, digestMap map[string]string) (err error) {
+	images, err := signingTargets(config, digestMap)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Sign, err)
+	}
+	logger.Info("Signing %d image(s) with cosign...", len(images))
+	publicKey := cosignPublicKeyID(config)
+
+	var report []SignedImage
+	defer func() {
+		if config.History != nil {
+			config.History.Signatures = report
+		}
+		if eventErr := writeEvent(config.EventsFile, EventImageSigning, report); eventErr != nil {
+			logger.Warning("%v", eventErr)
+		}
+	}()
+
+	for _, image := range images {
+		logger.Info("Signing with digest reference: %s", image.Reference)
+		index, err := signImageWithCosign(image.Reference, config.AttestationRepos.For(image.Destinations[0]), config)
+		if err != nil {
+			return exitcode.Wrap(exitcode.Sign, fmt.Errorf("failed to sign image %s: %v", image.Reference, err))
+		}
+		image.Key, image.PublicKey, image.RekorLogIndex = config.CosignKeyPath, publicKey, index
+		report = append(report, image)
+		if index != nil {
+			logger.Info("Successfully signed: %s (Rekor log index %d)", image.Reference, *index)
+		} else {
+			logger.Info("Successfully signed: %s", image.Reference)
+		}
+	}
+	return nil
+}
+
+// signingTargets returns the repository@digest references of the
+// destinations, resolving the digests the build did not report. The
+// signature tag is in the attestation repository of the destinations.
+func signingTargets(config Config, digestMap map[string]string) ([]SignedImage, error) {
+	byRef := make(map[string]*SignedImage)
+	for _, dest := range config.Destination {
+		digest := digestMap[dest]
+		if digest == "" {
+			insecure := config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry)
+			resolved, err := auth.ResolveImageDigest(dest, insecure)
+			if err != nil {
+				return nil, fmt.Errorf("cannot sign %s by digest: %v", dest, err)
+			}
+			digest = resolved
+		}
+		host, repository, _ := auth.ParseImageReference(dest)
+		name := host + "/" + repository
+		ref := name + "@" + digest
+		image, ok := byRef[ref]
+		if !ok {
+			signatures := name
+			if repo := config.AttestationRepos.For(dest); repo != "" {
+				signatures = repo
+			}
+			image = &SignedImage{Reference: ref, Digest: digest, Signature: signatures + ":" + auth.ArtifactTag(digest, "sig")}
+			byRef[ref] = image
+		}
+		image.Destinations = append(image.Destinations, dest)
+	}
+
+	refs := make([]string, 0, len(byRef))
+	for ref := range byRef {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	images := make([]SignedImage, 0, len(refs))
+	for _, ref := range refs {
+		images = append(images, *byRef[ref])
+	}
+	return images, nil
+}
+
+// cosignEnv returns the environment of cosign, with the key password
+func cosignEnv(config Config) ([]string, error) {
+	env := append(os.Environ(), "COSIGN_EXPERIMENTAL=1")
+
+	// Set cosign password from the password file or environment variable if specified
+	if config.CosignPasswordFile != "" {
+		password, err := readCosignPassword(config.CosignPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, "COSIGN_PASSWORD="+password)
+		logger.Debug("Set COSIGN_PASSWORD from %s", config.CosignPasswordFile)
+	} else if config.CosignPasswordEnv != "" {
+		password := os.Getenv(config.CosignPasswordEnv)
+		if password == "" {
+			logger.Warning("Cosign password environment variable %s is not set or empty", config.CosignPasswordEnv)
+		} else {
+			env = append(env, fmt.Sprintf("COSIGN_PASSWORD=%s", password))
+			logger.Debug("Set COSIGN_PASSWORD from %s", config.CosignPasswordEnv)
+		}
+	}
+	return env, nil
+}
+
+// cosignPublicKeyID returns the sha256 fingerprint of the public key of the
+// signing key, identifying it in the report; "" when cosign cannot tell
+func cosignPublicKeyID(config Config) string {
+	env, err := cosignEnv(config)
+	if err != nil {
+		return ""
+	}
+	// #nosec G204 -- key path from config
+	cmd := exec.Command("cosign", "public-key", "--key", config.CosignKeyPath)
+	cmd.Env = env
+	output, err := cmd.Output()
+	if err != nil {
+		logger.Debug("Could not read the public key of %s: %v", config.CosignKeyPath, err)
+		return ""
+	}
+	block, _ := pem.Decode(output)
+	if block == nil {
+		return ""
+	}
+	if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// signImageWithCosign signs a container image using cosign, storing the
+// signature in repository unless it is "", and returns the Rekor log index of
+// the signature, nil when it was not uploaded
+func signImageWithCosign(image, repository string, config Config) (*int64, error) {
+	logger.Debug("Signing image with cosign: %s", image)
+
+	// Prepare cosign command
+	args := []string{"sign", "--key", config.CosignKeyPath}
+
+	// Add insecure registry flag if needed
+	if config.Insecure || len(config.InsecureRegistry) > 0 {
+		args = append(args, "--allow-insecure-registry")
+		logger.Debug("Added --allow-insecure-registry flag for insecure registry")
+	}
+
+	// Add the image reference
+	args = append(args, image)
+
+	env, err := cosignEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	if repository != "" {
+		env = append(env, "COSIGN_REPOSITORY="+repository)
+		logger.Debug("Storing the signature in %s", repository)
+	}
+
+	// Create the command
+	// #nosec G204 -- image validated by validateBuildahInputs or validateBuildKitInputs, key path from config
+	cmd := exec.Command("cosign", args...)
+	var output bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	cmd.Env = env
+
+	// Log the command being executed
+	logger.Debug("Executing: cosign %s", strings.Join(sanitizeCommandArgs(args), " "))
+
+	// Execute cosign
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cosign signing failed: %v", err)
+	}
+
+	if match := rekorIndexPattern.FindStringSubmatch(output.String()); match != nil {
+		if index, err := strconv.ParseInt(match[1], 10, 64); err == nil {
+			return &index, nil
+		}
+	}
+	return nil, nil
+}
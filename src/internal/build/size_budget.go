@@ -0,0 +1,301 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// largestLayersShown is how many layers the breakdown of an image over its
+// size budget lists
+const largestLayersShown = 5
+
+// imageHistory is the part of an image config that names the instruction
+// behind each layer
+type imageHistory struct {
+	History []struct {
+		CreatedBy  string `json:"created_by"`
+		EmptyLayer bool   `json:"empty_layer"`
+	} `json:"history"`
+}
+
+// layerSize is one layer of a built image and where it came from
+type layerSize struct {
+	Index     int // Position in the image, from 1
+	Digest    string
+	Size      int64
+	CreatedBy string // "" when the history does not match the layers
+	Line      int    // Dockerfile line of the target stage (0 = unknown)
+	Base      bool   // The layer belongs to the base image
+}
+
+// hasSizeBudget reports whether the built image is checked against
+// --max-layer-size or --max-image-size
+func hasSizeBudget(config Config) bool {
+	return config.MaxLayerSize > 0 || config.MaxImageSize > 0
+}
+
+// imageLayerSizes pairs the layers of a manifest with the history of its
+// config and the Dockerfile lines of the target stage. The target stage's
+// layers come last; earlier ones belong to its base.
+func imageLayerSizes(layers []auth.Descriptor, history imageHistory, instructionLines []int) []layerSize {
+	var createdBy []string
+	for _, h := range history.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	if len(createdBy) != len(layers) {
+		createdBy = nil
+	}
+	offset := len(layers) - len(instructionLines)
+
+	sizes := make([]layerSize, len(layers))
+	for i, layer := range layers {
+		sizes[i] = layerSize{Index: i + 1, Digest: layer.Digest, Size: layer.Size}
+		if createdBy != nil {
+			sizes[i].CreatedBy = instructionText(createdBy[i])
+		}
+		if offset >= 0 && i >= offset {
+			sizes[i].Line = instructionLines[i-offset]
+		}
+		sizes[i].Base = offset >= 0 && i < offset
+	}
+	return sizes
+}
+
+// instructionText strips what Buildah and BuildKit add to the instruction
+// recorded in an image's history
+func instructionText(createdBy string) string {
+	createdBy = strings.TrimPrefix(createdBy, "/bin/sh -c #(nop) ")
+	return strings.TrimSuffix(createdBy, " # buildkit")
+}
+
+// origin describes the instruction that created l
+func (l layerSize) origin() string {
+	var desc string
+	if l.CreatedBy != "" {
+		desc = "created by: " + truncateInstruction(l.CreatedBy)
+	}
+	switch {
+	case l.Line > 0 && desc != "":
+		desc += fmt.Sprintf(" (Dockerfile line %d)", l.Line)
+	case l.Line > 0:
+		desc = fmt.Sprintf("Dockerfile line %d", l.Line)
+	case l.Base && desc != "":
+		desc += " (base image)"
+	case l.Base:
+		desc = "base image"
+	}
+	return desc
+}
+
+// checkSizeBudget fails when a layer exceeds --max-layer-size or the layers
+// together exceed --max-image-size, listing the largest layers and the
+// instructions that created them. image names the image (and its platform)
+// in messages; kind says how the sizes were measured.
+func checkSizeBudget(image, kind string, layers []layerSize, config Config) error {
+	var total int64
+	var oversized []string
+	for _, layer := range layers {
+		total += layer.Size
+		if config.MaxLayerSize <= 0 || layer.Size <= config.MaxLayerSize {
+			continue
+		}
+		desc := fmt.Sprintf("layer %d (%s) is %s", layer.Index, shortDigest(layer.Digest), formatBytes(layer.Size))
+		if origin := layer.origin(); origin != "" {
+			desc += ", " + origin
+		}
+		logger.Error("Layer exceeds --max-layer-size %s: %s", formatBytes(config.MaxLayerSize), desc)
+		oversized = append(oversized, desc)
+	}
+
+	var problems []string
+	if config.MaxImageSize > 0 && total > config.MaxImageSize {
+		problems = append(problems, fmt.Sprintf("%s is %s (%s), exceeding --max-image-size %s",
+			image, formatBytes(total), kind, formatBytes(config.MaxImageSize)))
+	}
+	if len(oversized) > 0 {
+		problems = append(problems, fmt.Sprintf("%d layer(s) exceed --max-layer-size %s: %s",
+			len(oversized), formatBytes(config.MaxLayerSize), strings.Join(oversized, "; ")))
+	}
+	if len(problems) == 0 {
+		if config.MaxLayerSize > 0 {
+			logger.Info("All %d layers of %s are within --max-layer-size %s", len(layers), image, formatBytes(config.MaxLayerSize))
+		}
+		if config.MaxImageSize > 0 {
+			logger.Info("Size of %s: %s (%s), within --max-image-size %s", image, formatBytes(total), kind, formatBytes(config.MaxImageSize))
+		}
+		return nil
+	}
+
+	logLargestLayers(image, kind, layers, total)
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// logLargestLayers prints the largest layers of an image over its size
+// budget with their share of the image
+func logLargestLayers(image, kind string, layers []layerSize, total int64) {
+	sorted := make([]layerSize, len(layers))
+	copy(sorted, layers)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Size > sorted[j].Size })
+	if len(sorted) > largestLayersShown {
+		sorted = sorted[:largestLayersShown]
+	}
+
+	logger.Error("Largest layers of %s (%s in %d layers, %s):", image, formatBytes(total), len(layers), kind)
+	for _, layer := range sorted {
+		share := 0.0
+		if total > 0 {
+			share = float64(layer.Size) * 100 / float64(total)
+		}
+		line := fmt.Sprintf("  %10s %5.1f%%  layer %d (%s)", formatBytes(layer.Size), share, layer.Index, shortDigest(layer.Digest))
+		if origin := layer.origin(); origin != "" {
+			line += "  " + origin
+		}
+		logger.Error("%s", line)
+	}
+}
+
+// dockerfileLayerLines returns the Dockerfile line of each layer of the
+// target stage, or nil when the Dockerfile cannot be read
+func dockerfileLayerLines(dockerfilePath, target string, splits map[int]int) []int {
+	// #nosec G304 -- dockerfilePath is the user-specified Dockerfile
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return nil
+	}
+	return layerInstructionLines(string(content), target, splits)
+}
+
+// checkImageLayerSizes inspects an image built by Buildah and checks it
+// against the size budgets. Layer sizes in local storage are uncompressed,
+// so the check is conservative.
+func checkImageLayerSizes(image string, env []string, config Config, dockerfilePath string, splits map[int]int) error {
+	// #nosec G204 -- image is the ID Buildah printed or a validated destination
+	cmd := buildahCommand(localBuildah{root: config.StorageRoot}, "inspect", "--type", "image", image)
+	cmd.Env = env
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to inspect image %s: %v", image, err)
+	}
+
+	var info struct {
+		Manifest string       `json:"Manifest"`
+		OCIv1    imageHistory `json:"OCIv1"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return fmt.Errorf("failed to parse image inspection: %v", err)
+	}
+	var manifest auth.Manifest
+	if err := json.Unmarshal([]byte(info.Manifest), &manifest); err != nil {
+		return fmt.Errorf("failed to parse image manifest: %v", err)
+	}
+
+	layers := imageLayerSizes(manifest.Layers, info.OCIv1, dockerfileLayerLines(dockerfilePath, config.Target, splits))
+	return checkSizeBudget("the image", "uncompressed", layers, config)
+}
+
+// checkLayoutSizeBudget checks every platform of the image BuildKit exported
+// to an OCI layout against the size budgets. The layout holds the compressed
+// layers the registry receives.
+func checkLayoutSizeBudget(layout string, config Config, dockerfilePath string, splits map[int]int) error {
+	image, err := readLayoutImage(layout)
+	if err != nil {
+		return err
+	}
+	manifest, err := readLayoutManifest(layout, image.Digest)
+	if err != nil {
+		return err
+	}
+	lines := dockerfileLayerLines(dockerfilePath, config.Target, splits)
+
+	type platformImage struct {
+		name   string
+		digest string
+	}
+	images := []platformImage{{"the image", image.Digest}}
+	if len(manifest.Manifests) > 0 {
+		images = nil
+		for _, child := range manifest.Manifests {
+			if child.Annotations["vnd.docker.reference.type"] == "attestation-manifest" || child.Platform == nil || child.Platform.OS == "unknown" {
+				continue
+			}
+			platform := child.Platform.OS + "/" + child.Platform.Architecture
+			if child.Platform.Variant != "" {
+				platform += "/" + child.Platform.Variant
+			}
+			images = append(images, platformImage{"the " + platform + " image", child.Digest})
+		}
+	}
+
+	var failed []string
+	for _, platform := range images {
+		manifest, err := readLayoutManifest(layout, platform.digest)
+		if err != nil {
+			return err
+		}
+		var history imageHistory
+		path, err := layoutBlobPath(layout, manifest.Config.Digest)
+		if err != nil {
+			return err
+		}
+		// #nosec G304 -- blob of the OCI layout kimia exported
+		if data, err := os.ReadFile(path); err == nil {
+			// #nosec G104 -- without a history the layers are listed without instructions
+			json.Unmarshal(data, &history)
+		}
+		layers := imageLayerSizes(manifest.Layers, history, lines)
+		if err := checkSizeBudget(platform.name, "compressed", layers, config); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// readLayoutManifest reads manifest digest from the OCI layout in dir
+func readLayoutManifest(dir, digest string) (auth.Manifest, error) {
+	var manifest auth.Manifest
+	path, err := layoutBlobPath(dir, digest)
+	if err != nil {
+		return manifest, err
+	}
+	// #nosec G304 -- blob of the OCI layout kimia exported
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read manifest %s: %v", digest, err)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest %s: %v", digest, err)
+	}
+	return manifest, nil
+}
+
+// pushBuildKitLayout pushes the image BuildKit exported to an OCI layout,
+// once it passed the size budgets, to the destinations of the build
+func pushBuildKitLayout(config Config, layout string) (map[string]string, auth.Descriptor, error) {
+	image, err := readLayoutImage(layout)
+	if err != nil {
+		return nil, auth.Descriptor{}, err
+	}
+	ctx, cancel := phaseContext(config.PushTimeout)
+	defer cancel()
+	pushConfig := PushConfig{
+		Destinations:      config.Destination,
+		Insecure:          config.Insecure,
+		InsecureRegistry:  config.InsecureRegistry,
+		Timeout:           config.PushTimeout,
+		HeartbeatInterval: config.HeartbeatInterval,
+		EventsFile:        config.EventsFile,
+	}
+	digestMap, _, err := pushLayout(ctx, pushConfig, layout, image)
+	return digestMap, image.Descriptor, err
+}
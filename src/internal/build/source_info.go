@@ -0,0 +1,182 @@
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// SourceInfo is the exact source revision a build used, written to
+// --source-info-file and passed as the SOURCE_COMMIT and SOURCE_URL build args
+type SourceInfo struct {
+	URL    string `json:"url"`              // Remote URL without credentials
+	Ref    string `json:"ref,omitempty"`    // Full ref that was built, e.g. refs/heads/main
+	Commit string `json:"commit"`           // Resolved commit ID
+	Subdir string `json:"subdir,omitempty"` // Context sub-path within the repository
+}
+
+// BuildArgs returns the implicit build args for info. SOURCE_URL is left out
+// for a work tree without an origin remote: an empty build arg would be taken
+// from the environment instead.
+func (info *SourceInfo) BuildArgs() map[string]string {
+	args := map[string]string{"SOURCE_COMMIT": info.Commit}
+	if info.URL != "" {
+		args["SOURCE_URL"] = info.URL
+	}
+	return args
+}
+
+// ResolveSourceInfo determines the commit of a build context: from the local
+// clone, from the remote with git ls-remote when BuildKit fetches the context
+// itself, or from the work tree of a local context. It returns nil without an
+// error for local contexts that are not Git work trees.
+func ResolveSourceInfo(ctx *Context) (*SourceInfo, error) {
+	var (
+		info *SourceInfo
+		err  error
+	)
+	switch {
+	case ctx.IsGitRepo && ctx.GitURL != "":
+		info, err = resolveRemoteSource(ctx.GitURL, ctx.GitConfig)
+	case ctx.IsGitRepo && ctx.TempDir != "":
+		info, err = resolveWorkTreeSource(ctx.TempDir)
+	default:
+		info, err = resolveWorkTreeSource(ctx.Path)
+		if err != nil {
+			logger.Debug("Context is not a Git work tree: %v", err)
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Subdir = strings.Trim(filepath.ToSlash(filepath.Clean("/"+ctx.SubContext)), "/")
+	return info, nil
+}
+
+// resolveWorkTreeSource reads HEAD and the origin URL of the work tree at dir
+func resolveWorkTreeSource(dir string) (*SourceInfo, error) {
+	// The context may be owned by another user (bind mounts, arbitrary UIDs)
+	git := func(args ...string) (string, error) {
+		// #nosec G204 -- fixed git subcommands on a context path
+		cmd := exec.Command("git", append([]string{"-c", "safe.directory=*", "-C", dir}, args...)...)
+		output, err := cmd.Output()
+		return strings.TrimSpace(string(output)), err
+	}
+
+	commit, err := git("rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD in %s: %v", dir, err)
+	}
+	remote, _ := git("remote", "get-url", "origin")
+	ref, _ := git("symbolic-ref", "-q", "HEAD")
+	return &SourceInfo{URL: stripGitCredentials(remote), Ref: ref, Commit: commit}, nil
+}
+
+// resolveRemoteSource resolves the requested branch, tag or default branch of
+// a remote repository with git ls-remote
+func resolveRemoteSource(url string, gitConfig GitConfig) (*SourceInfo, error) {
+	info := &SourceInfo{URL: stripGitCredentials(url)}
+	if gitFullSHAPattern.MatchString(gitConfig.Revision) {
+		info.Commit = gitConfig.Revision
+		return info, nil
+	}
+	if gitConfig.Revision != "" {
+		return nil, fmt.Errorf("cannot resolve abbreviated revision %s without a clone", gitConfig.Revision)
+	}
+
+	remoteURL, env, cleanup, err := gitRemoteAuth(url, gitConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	args := []string{"ls-remote", "--symref", remoteURL, "HEAD"}
+	if gitConfig.Branch != "" {
+		if err := validateGitRef(gitConfig.Branch); err != nil {
+			return nil, fmt.Errorf("invalid git branch name: %v", err)
+		}
+		branch := strings.TrimPrefix(strings.TrimPrefix(gitConfig.Branch, "refs/heads/"), "refs/tags/")
+		args = []string{"ls-remote", remoteURL, "refs/heads/" + branch, "refs/tags/" + branch, "refs/tags/" + branch + "^{}"}
+	}
+
+	// #nosec G204 -- URL validated as a Git URL, refs by validateGitRef
+	cmd := exec.Command("git", args...)
+	cmd.Env = env
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-remote failed: %v", err)
+	}
+
+	// Annotated tags are listed twice; the peeled ^{} entry is the commit
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "ref:" {
+			info.Ref = fields[1]
+			continue
+		}
+		refs[fields[1]] = fields[0]
+	}
+
+	if gitConfig.Branch == "" {
+		info.Commit = refs["HEAD"]
+	} else {
+		branch := strings.TrimPrefix(strings.TrimPrefix(gitConfig.Branch, "refs/heads/"), "refs/tags/")
+		for _, ref := range []string{"refs/heads/" + branch, "refs/tags/" + branch} {
+			if commit, ok := refs[ref+"^{}"]; ok {
+				info.Ref, info.Commit = ref, commit
+				break
+			}
+			if commit, ok := refs[ref]; ok {
+				info.Ref, info.Commit = ref, commit
+				break
+			}
+		}
+	}
+	if info.Commit == "" {
+		return nil, fmt.Errorf("ref %s not found in %s", gitConfig.Branch, info.URL)
+	}
+	return info, nil
+}
+
+// stripGitCredentials removes the user info from an https:// URL, so tokens
+// never end up in build args or provenance
+func stripGitCredentials(url string) string {
+	scheme, rest, found := strings.Cut(url, "://")
+	if !found || (scheme != "https" && scheme != "http") {
+		return url
+	}
+	authority, path, _ := strings.Cut(rest, "/")
+	if idx := strings.LastIndex(authority, "@"); idx >= 0 {
+		authority = authority[idx+1:]
+	}
+	if path == "" {
+		return scheme + "://" + authority
+	}
+	return scheme + "://" + authority + "/" + path
+}
+
+// WriteSourceInfo writes info as JSON to path
+func WriteSourceInfo(path string, info *SourceInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	// #nosec G306 -- 0644 for source metadata (public build artifact, not sensitive)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write source info file: %v", err)
+	}
+	logger.Info("Source info saved to: %s", path)
+	return nil
+}
@@ -0,0 +1,452 @@
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Media types of the storage snapshots written by `kimia cache save`
+const (
+	storageCacheArtifactType = "application/vnd.rapidfort.kimia.storage.v1"
+	storageCacheLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociManifestType          = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyType             = "application/vnd.oci.empty.v1+json"
+	// sha256 of the empty JSON object "{}" used as the config of artifacts
+	ociEmptyDigest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+)
+
+// Annotations recorded on storage snapshots
+const (
+	storageCacheBuilderAnnotation = "com.rapidfort.kimia.cache.builder"
+	storageCacheCreatedAnnotation = "org.opencontainers.image.created"
+)
+
+// StorageCacheConfig describes a `kimia cache save` or `kimia cache restore`
+type StorageCacheConfig struct {
+	Ref       string // Registry reference of the snapshot
+	Dir       string // Storage directory (default: the builder's storage)
+	Builder   string // buildah or buildkit
+	Insecure  bool
+	ChunkSize int64 // Upload the snapshot in chunks of this size (0 = one request)
+
+	HeartbeatInterval time.Duration // Log a heartbeat this often while archiving and transferring (0 = off)
+}
+
+// StorageCacheDir returns the directory `kimia cache` snapshots for builder.
+// Buildah keeps its images and layers in containers storage. The bundled
+// buildkitd keeps no state between runs, so BuildKit snapshots the local
+// cache directory used with --cache-export-dir/--cache-import-dir.
+func StorageCacheDir(builder string) (string, error) {
+	if builder != "buildah" {
+		return "", fmt.Errorf("--dir is required with BuildKit: use the directory given to --cache-export-dir and --cache-import-dir")
+	}
+	output, err := exec.Command("buildah", "info", "--format", "{{.store.GraphRoot}}").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate Buildah storage: %v", err)
+	}
+	dir := strings.TrimSpace(string(output))
+	if dir == "" {
+		return "", fmt.Errorf("buildah info returned no storage directory")
+	}
+	return dir, nil
+}
+
+// SaveStorageCache archives config.Dir and pushes it to config.Ref as an OCI
+// artifact with a single gzip layer. Run it after the build has finished; files
+// changing during the snapshot can make it inconsistent.
+func SaveStorageCache(config StorageCacheConfig) error {
+	info, err := os.Stat(config.Dir)
+	if err != nil {
+		return fmt.Errorf("cannot snapshot %s: %v", config.Dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("cannot snapshot %s: not a directory", config.Dir)
+	}
+
+	archive, err := newTempFile("", "kimia-cache-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+	defer removeTemp(archive.Name())
+	defer archive.Close()
+
+	beat := startHeartbeat(config.HeartbeatInterval, "", "cache-save", config.Ref)
+	defer beat.stop()
+
+	logger.Info("Archiving %s...", config.Dir)
+	started := time.Now()
+	hasher := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(archive, hasher))
+	files, err := writeStorageArchive(gz, config.Dir)
+	if err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %v", err)
+	}
+	size, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	logger.Info("Archived %d entries (%s compressed) in %s", files, formatBytes(size), time.Since(started).Round(time.Second))
+
+	repo, reference := auth.NewRepository(config.Ref, config.Insecure)
+	if strings.HasPrefix(reference, "sha256:") {
+		return fmt.Errorf("--ref must be a tag, not a digest: %s", config.Ref)
+	}
+	repo.ChunkSize = config.ChunkSize
+
+	started = time.Now()
+	exists, err := repo.BlobExists(digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		logger.Info("Registry already has this snapshot (%s)", digest)
+	} else {
+		logger.Info("Uploading snapshot to %s/%s...", repo.Host, repo.Repository)
+		if err := repo.PushBlob(archive.Name(), digest, size); err != nil {
+			return err
+		}
+	}
+	if err := pushEmptyConfig(repo); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal(auth.Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		ArtifactType:  storageCacheArtifactType,
+		Config:        auth.Descriptor{MediaType: ociEmptyType, Digest: ociEmptyDigest, Size: 2},
+		Layers:        []auth.Descriptor{{MediaType: storageCacheLayerType, Digest: digest, Size: size}},
+		Annotations: map[string]string{
+			storageCacheBuilderAnnotation: config.Builder,
+			storageCacheCreatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	manifestDigest, err := repo.PushManifest(reference, ociManifestType, manifest)
+	if err != nil {
+		return err
+	}
+	logger.Info("Saved %s cache to %s@%s in %s", config.Builder, config.Ref, manifestDigest, time.Since(started).Round(time.Second))
+	return nil
+}
+
+// pushEmptyConfig uploads the "{}" config blob shared by all artifacts
+func pushEmptyConfig(repo *auth.Repository) error {
+	exists, err := repo.BlobExists(ociEmptyDigest)
+	if err != nil || exists {
+		return err
+	}
+	file, err := newTempFile("", "kimia-empty-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write empty config: %v", err)
+	}
+	defer removeTemp(file.Name())
+	if _, err := file.WriteString("{}"); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write empty config: %v", err)
+	}
+	file.Close()
+	return repo.PushBlob(file.Name(), ociEmptyDigest, 2)
+}
+
+// RestoreStorageCache downloads the snapshot at config.Ref into config.Dir.
+// A directory that already has content is left alone, so the restore can run
+// unconditionally before every build; a missing snapshot is reported, not fatal.
+func RestoreStorageCache(config StorageCacheConfig) error {
+	if entries, err := os.ReadDir(config.Dir); err == nil && len(entries) > 0 {
+		logger.Info("%s is not empty, keeping the existing cache", config.Dir)
+		return nil
+	}
+
+	repo, reference := auth.NewRepository(config.Ref, config.Insecure)
+	manifest, _, err := repo.FetchManifest(reference)
+	if err != nil {
+		logger.Warning("No cache restored: %v", err)
+		return nil
+	}
+	if manifest.ArtifactType != storageCacheArtifactType || len(manifest.Layers) != 1 {
+		return fmt.Errorf("%s is not a kimia cache snapshot", config.Ref)
+	}
+	if builder := manifest.Annotations[storageCacheBuilderAnnotation]; builder != config.Builder {
+		return fmt.Errorf("%s was saved by %s, not %s", config.Ref, builder, config.Builder)
+	}
+	layer := manifest.Layers[0]
+	logger.Info("Restoring %s cache from %s (%s, saved %s)", config.Builder, config.Ref, formatBytes(layer.Size), manifest.Annotations[storageCacheCreatedAnnotation])
+
+	// #nosec G301 -- builder storage directory of the build user
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", config.Dir, err)
+	}
+
+	beat := startHeartbeat(config.HeartbeatInterval, "", "cache-restore", config.Ref)
+	defer beat.stop()
+
+	started := time.Now()
+	files, err := downloadStorageArchive(repo, layer.Digest, config.Dir)
+	if err != nil {
+		// Builds must start cold rather than from a partial storage
+		clearDir(config.Dir)
+		return err
+	}
+	logger.Info("Restored %d entries into %s in %s", files, config.Dir, time.Since(started).Round(time.Second))
+	return nil
+}
+
+// downloadStorageArchive extracts blob digest into dir and verifies the digest
+func downloadStorageArchive(repo *auth.Repository, digest, dir string) (int, error) {
+	blob, err := repo.FetchBlob(digest)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+
+	hasher := sha256.New()
+	body := io.TeeReader(blob, hasher)
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return 0, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	files, err := extractStorageArchive(gz, dir)
+	if err != nil {
+		return files, err
+	}
+	// Hash any trailing bytes the tar reader did not consume
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return files, fmt.Errorf("failed to download snapshot: %v", err)
+	}
+	if got := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); got != digest {
+		return files, fmt.Errorf("snapshot digest mismatch: expected %s, got %s", digest, got)
+	}
+	return files, nil
+}
+
+// writeStorageArchive writes dir to w as a tar stream, keeping ownership,
+// modes, hardlinks, device nodes (overlay whiteouts) and extended attributes
+func writeStorageArchive(w io.Writer, dir string) (int, error) {
+	tw := tar.NewWriter(w)
+	links := make(map[[2]uint64]string)
+	count := 0
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		target := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, target)
+		if err != nil {
+			return fmt.Errorf("cannot archive %s: %v", path, err)
+		}
+		header.Name = filepath.ToSlash(rel)
+		header.Format = tar.FormatPAX
+		header.Uname, header.Gname = "", ""
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			key := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+			if first, seen := links[key]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[key] = header.Name
+			}
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			for name, value := range readXattrs(path) {
+				if header.PAXRecords == nil {
+					header.PAXRecords = make(map[string]string)
+				}
+				header.PAXRecords["SCHILY.xattr."+name] = value
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write snapshot: %v", err)
+		}
+		count++
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		// #nosec G304 -- file within the builder storage directory
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := io.Copy(tw, file); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, tw.Close()
+}
+
+// extractStorageArchive restores a tar stream written by writeStorageArchive
+// into dir. Ownership, device nodes and extended attributes are restored where
+// the current user may set them.
+func extractStorageArchive(r io.Reader, dir string) (int, error) {
+	type dirMeta struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirs []dirMeta
+	count := 0
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("invalid snapshot: %v", err)
+		}
+		if !filepath.IsLocal(header.Name) {
+			return count, fmt.Errorf("invalid snapshot: unsafe path %q", header.Name)
+		}
+		path := filepath.Join(dir, header.Name)
+		mode := header.FileInfo().Mode()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// #nosec G301 -- the final mode is applied once the directory is filled
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return count, err
+			}
+			dirs = append(dirs, dirMeta{path, mode, header.ModTime})
+		case tar.TypeReg:
+			// #nosec G304 -- path checked with filepath.IsLocal
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return count, err
+			}
+			// #nosec G110 -- the archive is the user's own snapshot, verified by digest
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return count, fmt.Errorf("failed to extract %s: %v", header.Name, err)
+			}
+			if err := file.Close(); err != nil {
+				return count, err
+			}
+		case tar.TypeLink:
+			if !filepath.IsLocal(header.Linkname) {
+				return count, fmt.Errorf("invalid snapshot: unsafe link %q", header.Linkname)
+			}
+			if err := os.Link(filepath.Join(dir, header.Linkname), path); err != nil {
+				return count, err
+			}
+		case tar.TypeSymlink:
+			// Symlinks inside image layers point into the image, not the host
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return count, err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devType := uint32(syscall.S_IFCHR)
+			switch header.Typeflag {
+			case tar.TypeBlock:
+				devType = syscall.S_IFBLK
+			case tar.TypeFifo:
+				devType = syscall.S_IFIFO
+			}
+			dev := int((header.Devmajor << 8) | (header.Devminor & 0xff) | ((header.Devminor &^ 0xff) << 12))
+			if err := syscall.Mknod(path, devType|uint32(mode.Perm()), dev); err != nil {
+				logger.Debug("Cannot restore device node %s: %v", header.Name, err)
+				continue
+			}
+		default:
+			logger.Debug("Skipping unsupported entry %s (type %c)", header.Name, header.Typeflag)
+			continue
+		}
+		count++
+
+		// #nosec G104 -- ownership is best effort without CAP_CHOWN
+		os.Lchown(path, header.Uid, header.Gid)
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			continue
+		}
+		for key, value := range header.PAXRecords {
+			if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+				// #nosec G104 -- best effort, e.g. trusted.* needs privileges
+				syscall.Setxattr(path, name, []byte(value), 0)
+			}
+		}
+		if header.Typeflag != tar.TypeDir {
+			// #nosec G302 -- mode recorded in the snapshot
+			if err := os.Chmod(path, mode); err != nil {
+				return count, err
+			}
+			// #nosec G104 -- modification times are informational for builder storage
+			os.Chtimes(path, header.ModTime, header.ModTime)
+		}
+	}
+
+	// Apply directory modes last so read-only directories could be filled
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// #nosec G302 -- mode recorded in the snapshot
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return count, err
+		}
+		// #nosec G104
+		os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+	}
+	return count, nil
+}
+
+// clearDir removes the contents of dir but keeps dir itself, which may be a mount point
+func clearDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		// Restored read-only directories must be writable to be removed
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				// #nosec G104,G302 -- making the partial restore removable
+				os.Chmod(p, 0700)
+			}
+			return nil
+		})
+		// #nosec G104 -- best effort cleanup of a failed restore
+		os.RemoveAll(path)
+	}
+}
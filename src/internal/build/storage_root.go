@@ -0,0 +1,61 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// unsafeStorageName matches the characters of a build name not used in the
+// name of its storage root
+var unsafeStorageName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// DefaultStorageRootDir returns where parallel Buildah builds keep their own
+// storage roots
+func DefaultStorageRootDir() string {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	return filepath.Join(homeDir, ".kimia", "storage")
+}
+
+// IsolatedStorageRoot returns the Buildah storage root of the build called
+// name under dir. The root is the same in every run, so --cache keeps working.
+func IsolatedStorageRoot(dir, name string) string {
+	safe := unsafeStorageName.ReplaceAllString(name, "-")
+	if safe == "" || safe == "." || safe == ".." {
+		safe = "build"
+	}
+	return filepath.Join(dir, safe)
+}
+
+// LockStorageRoot takes an exclusive lock on a storage root, waiting while
+// another build, in this process or another one, uses it. Call the returned
+// function to release it.
+func LockStorageRoot(root string) (func(), error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage root %s: %v", root, err)
+	}
+	// #nosec G304 -- lock file next to a storage root chosen by kimia
+	file, err := os.OpenFile(root+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock of storage root %s: %v", root, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		logger.Info("Waiting for another build using storage root %s", root)
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock storage root %s: %v", root, err)
+		}
+	}
+	return func() {
+		// #nosec G104 -- closing the file releases the lock as well
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
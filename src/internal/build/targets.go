@@ -0,0 +1,132 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TargetDestination maps an image to the stage it is tagged from
+// (--destination target=STAGE,image=REF)
+type TargetDestination struct {
+	Target string
+	Image  string
+}
+
+// TargetBuild is one stage built by a multi-target invocation and the images
+// tagged from it. A target without destinations is built but not tagged.
+type TargetBuild struct {
+	Target       string
+	Destinations []string
+}
+
+// IsTargetDestination reports whether a --destination value maps an image to a target
+func IsTargetDestination(spec string) bool {
+	return strings.HasPrefix(spec, "target=") || strings.HasPrefix(spec, "image=")
+}
+
+// ParseTargetDestination parses a --destination value of the form target=STAGE,image=REF
+func ParseTargetDestination(spec string) (TargetDestination, error) {
+	var dest TargetDestination
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return dest, fmt.Errorf("invalid destination %q (expected target=STAGE,image=REF)", spec)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "target":
+			dest.Target = strings.TrimSpace(kv[1])
+		case "image":
+			dest.Image = strings.TrimSpace(kv[1])
+		default:
+			return dest, fmt.Errorf("invalid destination %q: unknown key %q (expected target and image)", spec, kv[0])
+		}
+	}
+	if dest.Target == "" || dest.Image == "" {
+		return dest, fmt.Errorf("invalid destination %q (expected target=STAGE,image=REF)", spec)
+	}
+	return dest, nil
+}
+
+// PlanTargetBuilds assigns destinations to the targets to build, in the order
+// the targets were given. Mapped destinations go to their target; plain
+// destinations go to the last target, which is also the default stage when no
+// target is given.
+func PlanTargetBuilds(targets, destinations []string, mapped []TargetDestination) ([]TargetBuild, error) {
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+
+	index := make(map[string]int, len(targets))
+	builds := make([]TargetBuild, len(targets))
+	for i, target := range targets {
+		if _, dup := index[strings.ToLower(target)]; dup {
+			return nil, fmt.Errorf("target %q given more than once", target)
+		}
+		index[strings.ToLower(target)] = i
+		builds[i].Target = target
+	}
+
+	mappedImages := make(map[string]bool, len(mapped))
+	for _, dest := range mapped {
+		i, ok := index[strings.ToLower(dest.Target)]
+		if !ok || dest.Target == "" {
+			return nil, fmt.Errorf("destination %s maps to target %q, which is not being built (add --target=%s)", dest.Image, dest.Target, dest.Target)
+		}
+		builds[i].Destinations = append(builds[i].Destinations, dest.Image)
+		mappedImages[dest.Image] = true
+	}
+
+	last := len(builds) - 1
+	for _, dest := range destinations {
+		if !mappedImages[dest] {
+			builds[last].Destinations = append(builds[last].Destinations, dest)
+		}
+	}
+	return builds, nil
+}
+
+// ValidateTargets checks that every target names a stage of the Dockerfile,
+// so a typo fails before the builder starts instead of after earlier targets
+// have been built
+func ValidateTargets(contextPath, dockerfile string, targets []string) error {
+	dockerfilePath := dockerfile
+	if dockerfilePath == "" {
+		dockerfilePath = "Dockerfile"
+	}
+	if !filepath.IsAbs(dockerfilePath) {
+		dockerfilePath = filepath.Join(contextPath, dockerfilePath)
+	}
+
+	// #nosec G304 -- dockerfilePath is the user-specified Dockerfile within the build context
+	content, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+
+	stages := make(map[string]bool)
+	var names []string
+	for _, inst := range parseDockerfile(string(content)) {
+		if inst.Command != "FROM" {
+			continue
+		}
+		fields := strings.Fields(inst.Args)
+		if len(fields) >= 3 && strings.EqualFold(fields[len(fields)-2], "AS") {
+			name := fields[len(fields)-1]
+			stages[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, target := range targets {
+		if target == "" || stages[strings.ToLower(target)] {
+			continue
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("target stage %q not found: Dockerfile has no named stages", target)
+		}
+		return fmt.Errorf("target stage %q not found in Dockerfile (stages: %s)", target, strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package build
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// ParseTestCommand parses a --test-cmd value. A JSON array is run as is, like
+// the exec form of RUN; anything else is run with /bin/sh -c.
+func ParseTestCommand(spec string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, fmt.Errorf("--test-cmd is empty")
+	}
+	if !strings.HasPrefix(spec, "[") {
+		return []string{"/bin/sh", "-c", spec}, nil
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(spec), &argv); err != nil || len(argv) == 0 || argv[0] == "" {
+		return nil, fmt.Errorf("invalid --test-cmd %s (expected a command or a JSON array such as [\"/app\", \"--version\"])", spec)
+	}
+	return argv, nil
+}
+
+// TestCommandString returns a parsed --test-cmd for messages
+func TestCommandString(argv []string) string {
+	if len(argv) == 3 && argv[0] == "/bin/sh" && argv[1] == "-c" {
+		return argv[2]
+	}
+	return strings.Join(argv, " ")
+}
+
+// NewTestChain returns the chained build that runs the --test-cmd in the
+// primary image on BuildKit, which cannot run a container of an image it
+// built: a generated Dockerfile whose only step runs argv. Its build argument
+// changes on every run, so the step is never a cache hit.
+func NewTestChain(argv []string) (ChainBuild, func(), error) {
+	dir, err := newTempDir("", "kimia-test-")
+	if err != nil {
+		return ChainBuild{}, nil, fmt.Errorf("failed to create the --test-cmd Dockerfile: %v", err)
+	}
+	// #nosec G104 -- best-effort cleanup
+	cleanup := func() { removeTemp(dir) }
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		cleanup()
+		return ChainBuild{}, nil, err
+	}
+	run, err := json.Marshal(argv)
+	if err != nil {
+		cleanup()
+		return ChainBuild{}, nil, err
+	}
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	content := fmt.Sprintf("FROM %s\nARG KIMIA_TEST_RUN=%s\nRUN %s\n", DefaultChainContext, hex.EncodeToString(nonce), run)
+	// #nosec G306 -- the builder reads the Dockerfile
+	if err := os.WriteFile(dockerfile, []byte(content), 0644); err != nil {
+		cleanup()
+		return ChainBuild{}, nil, fmt.Errorf("failed to write the --test-cmd Dockerfile: %v", err)
+	}
+	return ChainBuild{Dockerfile: dockerfile, Name: DefaultChainContext, TestCmd: argv}, cleanup, nil
+}
+
+// runBuildahTest runs the --test-cmd in a container of image, which Buildah
+// just built, before anything is exported or pushed. A Podman service runs it
+// with podman run.
+func runBuildahTest(ctx context.Context, transport buildahTransport, env []string, image string, argv []string) error {
+	logger.Info("Testing the image: %s", TestCommandString(argv))
+	if transport.remote() {
+		args := append([]string{"run", "--rm", "--pull=never", "--entrypoint", argv[0], image}, argv[1:]...)
+		cmd := buildahCommandContext(ctx, transport, args...)
+		cmd.Stdout, cmd.Stderr, cmd.Env = os.Stdout, os.Stderr, env
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("--test-cmd failed: %w", err)
+		}
+		logger.Info("Image test passed")
+		return nil
+	}
+
+	cmd := buildahCommandContext(ctx, transport, "from", "--pull=never", image)
+	cmd.Env = env
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to create the --test-cmd container: %v", err)
+	}
+	container := strings.TrimSpace(string(output))
+	defer func() {
+		rm := buildahCommand(transport, "rm", container)
+		rm.Env = env
+		if err := rm.Run(); err != nil {
+			logger.Warning("Failed to remove the --test-cmd container %s: %v", container, err)
+		}
+	}()
+
+	cmd = buildahCommandContext(ctx, transport, append([]string{"run", container, "--"}, argv...)...)
+	cmd.Stdout, cmd.Stderr, cmd.Env = os.Stdout, os.Stderr, env
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--test-cmd failed: %w", err)
+	}
+	logger.Info("Image test passed")
+	return nil
+}
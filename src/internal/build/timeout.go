@@ -0,0 +1,89 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/exitcode"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// phaseKillGrace is how long a command killed by a phase timeout has to exit
+// after SIGTERM before its process group gets SIGKILL
+const phaseKillGrace = 10 * time.Second
+
+// runContext is the parent of every build and push phase of this process.
+// Canceling it (`kimia cancel`, SIGTERM, SIGINT) stops the running phase and
+// fails the ones that would start.
+var runContext, cancelRun = context.WithCancel(context.Background())
+
+// CancelOnSignal cancels the run on the first SIGTERM or SIGINT, so the
+// builder's process groups are stopped before kimia exits; a second signal
+// kills kimia right away. The returned function stops the handling.
+func CancelOnSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			logger.Warning("Received %v: canceling the build (send it again to exit immediately)", sig)
+			cancelRun()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// phaseContext returns the context of a build or push phase, canceled after
+// timeout (0 = no limit) or when the run is canceled
+func phaseContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(runContext)
+	}
+	return context.WithTimeout(runContext, timeout)
+}
+
+// commandContext returns a command that is stopped when ctx is done. The
+// command runs in its own process group so the helpers it starts (buildah's
+// RUN containers, buildctl sessions) are stopped with it.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	// #nosec G204 -- callers pass validated arguments
+	cmd := exec.CommandContext(ctx, name, args...)
+	if ctx.Done() == nil {
+		return cmd
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		time.AfterFunc(phaseKillGrace, func() {
+			// #nosec G104 -- the group may already be gone
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = phaseKillGrace
+	return cmd
+}
+
+// timeoutError returns the error of a phase whose command failed with err,
+// naming the flag when the phase ran out of time
+func timeoutError(ctx context.Context, err error, phase, flag string, timeout time.Duration) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return exitcode.Wrap(exitcode.Timeout, fmt.Errorf("%s timed out after %s (%s)", phase, timeout, flag))
+	}
+	if err != nil && runContext.Err() != nil {
+		return exitcode.Wrap(exitcode.Canceled, fmt.Errorf("%s canceled", phase))
+	}
+	return err
+}
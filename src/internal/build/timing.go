@@ -0,0 +1,315 @@
+package build
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Step states in the timing report
+const (
+	stepDone     = "done"
+	stepCached   = "cached"
+	stepError    = "error"
+	stepCanceled = "canceled"
+)
+
+// StepTiming is the time spent on one Dockerfile instruction
+type StepTiming struct {
+	Stage       string  `json:"stage"`
+	Step        string  `json:"step"` // Position within the stage, e.g. "2/4"
+	Instruction string  `json:"instruction"`
+	Seconds     float64 `json:"seconds"`
+	Status      string  `json:"status"` // done, cached, error or canceled
+
+	vertex string // BuildKit progress vertex number
+}
+
+// StageTiming is the time spent on all instructions of a stage
+type StageTiming struct {
+	Stage   string  `json:"stage"`
+	Seconds float64 `json:"seconds"`
+	Steps   int     `json:"steps"`
+	Cached  int     `json:"cached"`
+}
+
+// BuildTiming is the per-stage and per-instruction timing of a build
+type BuildTiming struct {
+	Builder      string        `json:"builder"`
+	Succeeded    bool          `json:"succeeded"`
+	TotalSeconds float64       `json:"totalSeconds"`
+	Stages       []StageTiming `json:"stages"`
+	Steps        []StepTiming  `json:"steps"`
+}
+
+// newBuildTiming summarises steps into per-stage totals, in build order
+func newBuildTiming(builder string, total time.Duration, succeeded bool, steps []StepTiming) *BuildTiming {
+	timing := &BuildTiming{
+		Builder:      builder,
+		Succeeded:    succeeded,
+		TotalSeconds: roundSeconds(total.Seconds()),
+		Stages:       []StageTiming{},
+		Steps:        steps,
+	}
+	if timing.Steps == nil {
+		timing.Steps = []StepTiming{}
+	}
+
+	index := make(map[string]int)
+	for _, step := range timing.Steps {
+		i, ok := index[step.Stage]
+		if !ok {
+			i = len(timing.Stages)
+			index[step.Stage] = i
+			timing.Stages = append(timing.Stages, StageTiming{Stage: step.Stage})
+		}
+		timing.Stages[i].Seconds = roundSeconds(timing.Stages[i].Seconds + step.Seconds)
+		timing.Stages[i].Steps++
+		if step.Status == stepCached {
+			timing.Stages[i].Cached++
+		}
+	}
+	return timing
+}
+
+// roundSeconds rounds to tenths of a second, the resolution BuildKit reports
+func roundSeconds(s float64) float64 {
+	return math.Round(s*10) / 10
+}
+
+// ========================================
+// BuildKit: parse plain progress output
+// ========================================
+
+var (
+	// "#7 [builder 2/4] RUN go build ./..." (optionally prefixed by a platform)
+	buildkitVertexRegex = regexp.MustCompile(`^#(\d+) \[([^\]]+)\] (.*)$`)
+	// "#7 DONE 12.3s", "#7 CACHED", "#7 ERROR: ...", "#7 CANCELED"
+	buildkitDoneRegex     = regexp.MustCompile(`^#(\d+) DONE ([0-9.]+)s`)
+	buildkitCachedRegex   = regexp.MustCompile(`^#(\d+) CACHED`)
+	buildkitErrorRegex    = regexp.MustCompile(`^#(\d+) ERROR`)
+	buildkitCanceledRegex = regexp.MustCompile(`^#(\d+) CANCELED`)
+	stepPositionRegex     = regexp.MustCompile(`^\d+/\d+$`)
+)
+
+// parseBuildKitTimings extracts per-instruction timing from BuildKit plain
+// progress output. Internal vertices (context transfer, exports) are skipped.
+func parseBuildKitTimings(output string) []StepTiming {
+	var order []string
+	steps := make(map[string]*StepTiming)
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if m := buildkitVertexRegex.FindStringSubmatch(line); m != nil {
+			if _, seen := steps[m[1]]; seen {
+				continue
+			}
+			fields := strings.Fields(m[2])
+			if len(fields) == 0 || !stepPositionRegex.MatchString(fields[len(fields)-1]) {
+				continue
+			}
+			stage := "stage-0"
+			if names := fields[:len(fields)-1]; len(names) > 0 {
+				// Multi-platform builds prefix the stage with the platform
+				if len(names) > 1 && strings.Contains(names[0], "/") {
+					names = names[1:]
+				}
+				stage = strings.Join(names, " ")
+			}
+			steps[m[1]] = &StepTiming{Stage: stage, Step: fields[len(fields)-1], Instruction: m[3], vertex: m[1]}
+			order = append(order, m[1])
+			continue
+		}
+
+		if m := buildkitDoneRegex.FindStringSubmatch(line); m != nil {
+			if step, ok := steps[m[1]]; ok && step.Status == "" {
+				seconds, _ := strconv.ParseFloat(m[2], 64)
+				step.Seconds = roundSeconds(seconds)
+				step.Status = stepDone
+			}
+		} else if m := buildkitCachedRegex.FindStringSubmatch(line); m != nil {
+			if step, ok := steps[m[1]]; ok {
+				step.Status = stepCached
+			}
+		} else if m := buildkitErrorRegex.FindStringSubmatch(line); m != nil {
+			if step, ok := steps[m[1]]; ok {
+				step.Status = stepError
+			}
+		} else if m := buildkitCanceledRegex.FindStringSubmatch(line); m != nil {
+			if step, ok := steps[m[1]]; ok {
+				step.Status = stepCanceled
+			}
+		}
+	}
+
+	var result []StepTiming
+	for _, id := range order {
+		step := steps[id]
+		if step.Status == "" {
+			continue // Never started or still running when the build stopped
+		}
+		result = append(result, *step)
+	}
+	return result
+}
+
+// ========================================
+// Buildah: timestamp STEP lines as they are printed
+// ========================================
+
+var (
+	// "STEP 2/4: RUN make" or "[1/2] STEP 2/4: RUN make" in multi-stage builds
+	buildahStepRegex = regexp.MustCompile(`^(?:\[(\d+)/\d+\] )?STEP (\d+/\d+): (.*)$`)
+	// "COMMIT image" or "[2/2] COMMIT image"
+	buildahCommitRegex = regexp.MustCompile(`^(?:\[\d+/\d+\] )?COMMIT`)
+	// "FROM golang:1.22 AS builder"
+	buildahStageNameRegex = regexp.MustCompile(`(?i)^FROM\s+.*\s+AS\s+(\S+)\s*$`)
+)
+
+// buildahStepRecorder is an io.Writer on buildah's stdout that records when
+// each STEP starts and ends. Buildah does not report step durations itself.
+type buildahStepRecorder struct {
+	mu         sync.Mutex
+	partial    []byte
+	steps      []StepTiming
+	started    time.Time
+	open       bool // The last step has not finished yet
+	stageNames map[int]string
+}
+
+func newBuildahStepRecorder() *buildahStepRecorder {
+	return &buildahStepRecorder{stageNames: make(map[int]string)}
+}
+
+// Write records step boundaries for every complete line in p
+func (r *buildahStepRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.partial = append(r.partial, p...)
+	for {
+		idx := strings.IndexByte(string(r.partial), '\n')
+		if idx < 0 {
+			break
+		}
+		r.processLine(strings.TrimRight(string(r.partial[:idx]), "\r"), now)
+		r.partial = r.partial[idx+1:]
+	}
+	return len(p), nil
+}
+
+func (r *buildahStepRecorder) processLine(line string, now time.Time) {
+	switch {
+	case buildahStepRegex.MatchString(line):
+		r.endStep(now, stepDone)
+		m := buildahStepRegex.FindStringSubmatch(line)
+		stage := 0
+		if m[1] != "" {
+			stage, _ = strconv.Atoi(m[1])
+			stage--
+		}
+		if name := buildahStageNameRegex.FindStringSubmatch(m[3]); name != nil {
+			r.stageNames[stage] = name[1]
+		}
+		stageName := r.stageNames[stage]
+		if stageName == "" {
+			stageName = fmt.Sprintf("stage-%d", stage)
+		}
+		r.steps = append(r.steps, StepTiming{Stage: stageName, Step: m[2], Instruction: m[3]})
+		r.started = now
+		r.open = true
+
+	case strings.HasPrefix(line, "--> Using cache"):
+		r.endStep(now, stepCached)
+
+	case strings.HasPrefix(line, "--> "), buildahCommitRegex.MatchString(line):
+		r.endStep(now, stepDone)
+	}
+}
+
+// endStep closes the running step, if any
+func (r *buildahStepRecorder) endStep(now time.Time, status string) {
+	if !r.open {
+		return
+	}
+	step := &r.steps[len(r.steps)-1]
+	step.Seconds = roundSeconds(now.Sub(r.started).Seconds())
+	step.Status = status
+	r.open = false
+}
+
+// finish closes the running step when buildah exits and returns all steps
+func (r *buildahStepRecorder) finish(succeeded bool) []StepTiming {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if succeeded {
+		r.endStep(time.Now(), stepDone)
+	} else {
+		r.endStep(time.Now(), stepError)
+	}
+	return append([]StepTiming(nil), r.steps...)
+}
+
+// ========================================
+// Report
+// ========================================
+
+// reportBuildTiming prints the timing summary and appends it to the events file
+func reportBuildTiming(config Config, timing *BuildTiming) {
+	if err := writeEvent(config.EventsFile, EventBuildTiming, timing); err != nil {
+		logger.Warning("%v", err)
+	}
+	if config.CacheExplain != nil {
+		config.CacheExplain.observe(timing.Steps)
+	}
+	if config.History != nil {
+		config.History.observe(timing)
+	}
+
+	if len(timing.Steps) == 0 {
+		logger.Debug("No per-step timing found in %s output", timing.Builder)
+		return
+	}
+
+	logger.Info("")
+	logger.Info("Build timing (%s total)", formatSeconds(timing.TotalSeconds))
+	logger.Info("  %-28s %10s %6s %7s", "STAGE", "TIME", "STEPS", "CACHED")
+	for _, stage := range timing.Stages {
+		logger.Info("  %-28s %10s %6d %7d", truncate(stage.Stage, 28), formatSeconds(stage.Seconds), stage.Steps, stage.Cached)
+	}
+	logger.Info("")
+	logger.Info("  %-28s %10s  %s", "STEP", "TIME", "INSTRUCTION")
+	for _, step := range timing.Steps {
+		elapsed := formatSeconds(step.Seconds)
+		if step.Status != stepDone {
+			elapsed = step.Status
+		}
+		logger.Info("  %-28s %10s  %s", truncate(step.Stage+" "+step.Step, 28), elapsed, truncate(step.Instruction, 72))
+	}
+	logger.Info("")
+}
+
+// formatSeconds renders seconds rounded to tenths, e.g. 0.4s, 52.1s or 1m4.2s
+func formatSeconds(s float64) string {
+	if s < 60 {
+		return fmt.Sprintf("%.1fs", s)
+	}
+	return (time.Duration(math.Round(s*10)) * 100 * time.Millisecond).String()
+}
+
+// truncate shortens s to at most n characters
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -0,0 +1,150 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// ResolveInputHash resolves the base image digests of the build and sets the
+// input hash of the record: a digest of the context files, the Dockerfile,
+// the build args, the base images and the options that change the image.
+// Two builds with the same input hash produce the same image.
+func (r *BuildRecord) ResolveInputHash(config Config, ctx *Context) error {
+	if ctx.Path == "" || r.Inputs.ContextDigest == "" {
+		return fmt.Errorf("the build context is not local, so its content cannot be hashed")
+	}
+	if r.Inputs.DockerfileDigest == "" {
+		return fmt.Errorf("cannot read the Dockerfile")
+	}
+
+	// Base images come from the local store with --offline; their references are pinned by it
+	plan, err := GeneratePlan(config, ctx, config.ImageStore == nil)
+	if err != nil {
+		return err
+	}
+	if plan.HasErrors() {
+		return fmt.Errorf("cannot resolve base images: %s", strings.Join(plan.Errors, "; "))
+	}
+	r.Inputs.BaseImages = PlanBaseImages(plan)
+	for _, image := range r.Inputs.BaseImages {
+		if image.Digest == "" && config.ImageStore == nil {
+			return fmt.Errorf("cannot resolve the digest of base image %s", image.Ref)
+		}
+	}
+
+	h := sha256.New()
+	write := func(name string, value interface{}) {
+		fmt.Fprintf(h, "%s=%v\x00", name, value)
+	}
+	write("context", r.Inputs.ContextDigest)
+	write("dockerfile", r.Inputs.Dockerfile)
+	write("dockerfileDigest", r.Inputs.DockerfileDigest)
+	write("target", config.Target)
+	write("platform", config.CustomPlatform)
+	for _, name := range sortedKeys(config.BuildArgs) {
+		write("arg:"+name, config.BuildArgs[name])
+	}
+	for _, name := range sortedKeys(config.Labels) {
+		write("label:"+name, config.Labels[name])
+	}
+	for _, image := range r.Inputs.BaseImages {
+		write("base:"+image.Ref, image.Digest)
+	}
+	write("reproducible", config.Reproducible)
+	write("timestamp", config.Timestamp)
+	if n := config.NormalizeContext; n != nil {
+		write("normalizeContext", fmt.Sprintf("%d:%d@%d", n.UID, n.GID, n.ModTime.Unix()))
+	}
+	write("squash", config.Squash)
+	write("squashNew", config.SquashNew)
+	write("attestation", config.Attestation)
+	for _, attestation := range config.AttestationConfigs {
+		write("attest:"+attestation.Type, sortedPairs(attestation.Params))
+	}
+	write("buildkitOpts", strings.Join(config.BuildKitOpts, ","))
+	write("buildahOpts", strings.Join(config.BuildahOpts, ","))
+	io.WriteString(h, "end")
+	r.Inputs.InputHash = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// LastUnchangedBuild returns the newest successful build in the history with
+// the input hash of record that pushed an image, or nil when there is none
+func LastUnchangedBuild(path string, record *BuildRecord) (*BuildRecord, error) {
+	if record.Inputs.InputHash == "" {
+		return nil, nil
+	}
+	records, err := ReadHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		previous := records[i]
+		if previous.Succeeded && previous.Inputs.InputHash == record.Inputs.InputHash && len(previous.Digests) > 0 {
+			return &previous, nil
+		}
+	}
+	return nil, nil
+}
+
+// ReuseBuild tags the image of a previous build with the destinations instead
+// of building it again: the image is copied from a reference it was pushed
+// to, which only pushes manifests when the destination is in the same
+// repository. It returns the digest of every destination.
+func ReuseBuild(config Config, previous *BuildRecord, destinations []string, retry int) (map[string]string, error) {
+	source := ""
+	for _, dest := range sortedKeys(previous.Digests) {
+		if digest := previous.Digests[dest]; digest != "" {
+			repo, _ := auth.NewRepository(dest, config.Insecure || isInsecureRegistry(dest, config.InsecureRegistry))
+			source = repo.Host + "/" + repo.Repository + "@" + digest
+			break
+		}
+	}
+	if source == "" {
+		return nil, fmt.Errorf("build %s recorded no pushed digest", previous.ID)
+	}
+
+	logger.Info("Inputs unchanged since build %s (%s), reusing %s", previous.ID, previous.Started.Format("2006-01-02 15:04:05 MST"), source)
+	digest, err := CopyImage(CopyConfig{
+		Source:           source,
+		Destinations:     destinations,
+		Insecure:         config.Insecure,
+		InsecureRegistry: config.InsecureRegistry,
+		Retry:            retry,
+		DryRun:           config.DryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string, len(destinations))
+	for _, dest := range destinations {
+		digests[dest] = digest
+	}
+	return digests, nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedPairs formats m as sorted key=value pairs
+func sortedPairs(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for _, key := range sortedKeys(m) {
+		pairs = append(pairs, key+"="+m[key])
+	}
+	return strings.Join(pairs, ",")
+}
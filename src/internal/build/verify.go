@@ -0,0 +1,337 @@
+package build
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Kinds of artifacts attached to an image
+const (
+	ArtifactSignature   = "signature"
+	ArtifactSBOM        = "sbom"
+	ArtifactProvenance  = "provenance"
+	ArtifactVEX         = "vex"
+	ArtifactAttestation = "attestation" // in-toto attestation with an unknown predicate
+	ArtifactOther       = "other"
+)
+
+// attestationManifestSource marks attestations BuildKit stores in the image index
+const attestationManifestSource = "attestation manifest"
+
+// VerifyConfig selects the image and policy for `kimia verify`
+type VerifyConfig struct {
+	Image            string
+	Insecure         bool
+	InsecureRegistry []string
+	Require          []string // Artifact kinds that must be present
+	CosignKeyPath    string   // Verify signatures with this public key
+	AttestationRepo  string   // Repository holding signatures and attestations ("" = the image repository)
+	Policy           *VerifyPolicy
+}
+
+// VerifyArtifactKinds are the artifact kinds accepted by --require
+var VerifyArtifactKinds = []string{ArtifactSignature, ArtifactSBOM, ArtifactProvenance, ArtifactVEX, ArtifactAttestation}
+
+// TrustArtifact is a signature, SBOM, provenance or other artifact attached to an image
+type TrustArtifact struct {
+	Kind   string `json:"kind"`
+	Type   string `json:"type"` // Artifact, media or predicate type
+	Digest string `json:"digest,omitempty"`
+	Source string `json:"source"` // Referrers API, referrers tag, cosign tag or attestation manifest
+}
+
+// TrustReport is the consolidated view of everything attached to an image
+type TrustReport struct {
+	Image     string
+	Digest    string
+	Artifacts []TrustArtifact
+	Warnings  []string
+
+	SignatureChecked  bool // A cosign key was given and signatures were checked
+	SignatureVerified bool
+	Missing           []string      // Required artifact kinds that were not found
+	Policy            []PolicyCheck // Rules of the --policy file
+}
+
+// Passed reports whether the image satisfies the required policy
+func (r *TrustReport) Passed() bool {
+	for _, check := range r.Policy {
+		if !check.Passed {
+			return false
+		}
+	}
+	return len(r.Missing) == 0 && (!r.SignatureChecked || r.SignatureVerified)
+}
+
+// count returns how many artifacts of kind were found
+func (r *TrustReport) count(kind string) int {
+	n := 0
+	for _, artifact := range r.Artifacts {
+		if artifact.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// GenerateTrustReport resolves an image to its digest, collects the artifacts
+// attached to it and checks them against the requirements and policy
+func GenerateTrustReport(config VerifyConfig) (*TrustReport, error) {
+	config.Insecure = config.Insecure || isInsecureRegistry(config.Image, config.InsecureRegistry)
+	repo, reference := auth.NewRepository(config.Image, config.Insecure)
+	manifest, digest, err := repo.FetchManifest(reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", config.Image, err)
+	}
+	if digest == "" {
+		return nil, fmt.Errorf("registry did not return a digest for %s", config.Image)
+	}
+
+	report := &TrustReport{Image: config.Image, Digest: digest}
+	logger.Info("Verifying %s@%s", repo.Repository, digest)
+	report.Artifacts, report.Warnings = collectArtifacts(repo, digest, manifest)
+	if config.AttestationRepo != "" {
+		insecure := config.Insecure || isInsecureRegistry(config.AttestationRepo, config.InsecureRegistry)
+		attestations, _ := auth.NewRepository(config.AttestationRepo, insecure)
+		logger.Info("Looking up artifacts of %s in %s", digest, config.AttestationRepo)
+		artifacts, warnings := collectArtifacts(attestations, digest, &auth.Manifest{})
+		for _, artifact := range artifacts {
+			artifact.Source += " in " + config.AttestationRepo
+			report.Artifacts = append(report.Artifacts, artifact)
+		}
+		for _, warning := range warnings {
+			report.Warnings = append(report.Warnings, config.AttestationRepo+": "+warning)
+		}
+		sort.SliceStable(report.Artifacts, func(i, j int) bool { return report.Artifacts[i].Kind < report.Artifacts[j].Kind })
+	}
+
+	if config.CosignKeyPath != "" {
+		report.SignatureChecked = true
+		report.SignatureVerified = verifyCosignSignature(config, repo, digest)
+	}
+
+	require := config.Require
+	if config.Policy != nil {
+		evaluatePolicy(config, repo, digest, manifest, report)
+		require = append(append([]string{}, require...), config.Policy.Require...)
+	}
+	for _, kind := range require {
+		if containsKind(report.Missing, kind) {
+			continue
+		}
+		if report.count(kind) == 0 {
+			report.Missing = append(report.Missing, kind)
+		}
+	}
+	return report, nil
+}
+
+// collectArtifacts returns the artifacts attached to an image by any tool:
+// OCI referrers (API or fallback tag), legacy cosign tags and BuildKit
+// attestation manifests, sorted by kind, and the lookups that failed
+func collectArtifacts(repo *auth.Repository, digest string, manifest *auth.Manifest) ([]TrustArtifact, []string) {
+	var artifacts []TrustArtifact
+	var warnings []string
+
+	referrers, source, err := repo.Referrers(digest)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("referrers lookup failed: %v", err))
+	}
+	for _, desc := range referrers {
+		artifactType := desc.ArtifactType
+		if artifactType == "" {
+			artifactType = desc.MediaType
+		}
+		artifacts = append(artifacts, TrustArtifact{
+			Kind:   classifyArtifact(artifactType, desc.Annotations),
+			Type:   artifactType,
+			Digest: desc.Digest,
+			Source: source,
+		})
+	}
+
+	cosignTags, err := repo.CosignTags(digest)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("cosign tag lookup failed: %v", err))
+	}
+	for suffix, tagDigest := range cosignTags {
+		kind := map[string]string{"sig": ArtifactSignature, "att": ArtifactAttestation, "sbom": ArtifactSBOM}[suffix]
+		artifacts = append(artifacts, TrustArtifact{
+			Kind:   kind,
+			Type:   "cosign ." + suffix,
+			Digest: tagDigest,
+			Source: auth.CosignTag,
+		})
+	}
+
+	// BuildKit stores SBOM and provenance attestations inside the image index
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations["vnd.docker.reference.type"] != "attestation-manifest" {
+			continue
+		}
+		attestation, _, err := repo.FetchManifest(desc.Digest)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("attestation manifest %s: %v", desc.Digest, err))
+			continue
+		}
+		for _, layer := range attestation.Layers {
+			predicate := layer.Annotations["in-toto.io/predicate-type"]
+			artifacts = append(artifacts, TrustArtifact{
+				Kind:   classifyPredicate(predicate),
+				Type:   predicate,
+				Digest: layer.Digest,
+				Source: attestationManifestSource,
+			})
+		}
+	}
+
+	sort.SliceStable(artifacts, func(i, j int) bool { return artifacts[i].Kind < artifacts[j].Kind })
+	return artifacts, warnings
+}
+
+// classifyArtifact maps an OCI artifact type to an artifact kind
+func classifyArtifact(artifactType string, annotations map[string]string) string {
+	switch {
+	case strings.HasPrefix(artifactType, "application/vnd.dev.sigstore.bundle"):
+		// Sigstore bundles hold either a signature or a DSSE attestation
+		if predicate := annotations["dev.sigstore.bundle.predicateType"]; predicate != "" {
+			return classifyPredicate(predicate)
+		}
+		return ArtifactSignature
+	case artifactType == "application/vnd.dev.cosign.artifact.sig.v1+json",
+		artifactType == "application/vnd.cncf.notary.signature":
+		return ArtifactSignature
+	case strings.Contains(artifactType, "spdx"), strings.Contains(artifactType, "cyclonedx"),
+		strings.Contains(artifactType, "syft"):
+		return ArtifactSBOM
+	case strings.Contains(artifactType, "openvex"):
+		return ArtifactVEX
+	case strings.Contains(artifactType, "in-toto"):
+		if predicate := annotations["in-toto.io/predicate-type"]; predicate != "" {
+			return classifyPredicate(predicate)
+		}
+		return ArtifactAttestation
+	}
+	return ArtifactOther
+}
+
+// classifyPredicate maps an in-toto predicate type to an artifact kind
+func classifyPredicate(predicate string) string {
+	switch {
+	case strings.HasPrefix(predicate, "https://slsa.dev/provenance/"):
+		return ArtifactProvenance
+	case strings.HasPrefix(predicate, "https://spdx.dev/Document"), strings.HasPrefix(predicate, "https://cyclonedx.org/bom"):
+		return ArtifactSBOM
+	case strings.HasPrefix(predicate, "https://openvex.dev/ns"):
+		return ArtifactVEX
+	}
+	return ArtifactAttestation
+}
+
+// verifyCosignSignature checks the image signature with cosign and the given public key
+func verifyCosignSignature(config VerifyConfig, repo *auth.Repository, digest string) bool {
+	if _, err := exec.LookPath("cosign"); err != nil {
+		logger.Warning("cosign not found in PATH; cannot verify signatures")
+		return false
+	}
+
+	image := digestReference(repo, digest)
+	args := []string{"verify", "--key", config.CosignKeyPath}
+	if config.Insecure {
+		args = append(args, "--allow-insecure-registry")
+	}
+	args = append(args, image)
+
+	logger.Debug("Executing: cosign %s", strings.Join(args, " "))
+	// #nosec G204 -- image is a digest reference built from the parsed image name; key path from config
+	cmd := exec.Command("cosign", args...)
+	cmd.Env = cosignVerifyEnv(config)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		logger.Debug("cosign verify output: %s", strings.TrimSpace(string(output)))
+		return false
+	}
+	return true
+}
+
+// PrintTrustReport prints a human-readable trust report
+func PrintTrustReport(report *TrustReport) {
+	logger.Info("")
+	logger.Info("Kimia Trust Report")
+	logger.Info("═══════════════════════════════════════════════════════")
+	logger.Info("  Image:                   %s", report.Image)
+	logger.Info("  Digest:                  %s", report.Digest)
+	logger.Info("")
+
+	logger.Info("SUMMARY")
+	for _, kind := range []string{ArtifactSignature, ArtifactSBOM, ArtifactProvenance, ArtifactVEX, ArtifactAttestation, ArtifactOther} {
+		status := fmt.Sprintf("%d found", report.count(kind))
+		if kind == ArtifactSignature && report.SignatureChecked {
+			if report.SignatureVerified {
+				status += ", verified"
+			} else {
+				status += ", NOT verified"
+			}
+		}
+		logger.Info("  %-24s %s", kind+":", status)
+	}
+	logger.Info("")
+
+	if len(report.Policy) > 0 {
+		logger.Info("POLICY")
+		for _, check := range report.Policy {
+			status := "PASS"
+			if !check.Passed {
+				status = "FAIL"
+			}
+			logger.Info("  %-4s %-44s %s", status, check.Rule, check.Detail)
+		}
+		logger.Info("")
+	}
+
+	if len(report.Artifacts) > 0 {
+		logger.Info("ARTIFACTS")
+		for _, artifact := range report.Artifacts {
+			logger.Info("  %-12s %-48s %s", artifact.Kind, artifact.Type, artifact.Source)
+			if artifact.Digest != "" {
+				logger.Info("  %-12s %s", "", artifact.Digest)
+			}
+		}
+		logger.Info("")
+	}
+
+	for _, warning := range report.Warnings {
+		logger.Warning("%s", warning)
+	}
+	for _, kind := range report.Missing {
+		logger.Error("Required %s not found", kind)
+	}
+	if report.SignatureChecked && !report.SignatureVerified {
+		logger.Error("No signature could be verified with the given key")
+	}
+	for _, check := range report.Policy {
+		if !check.Passed {
+			logger.Error("Policy %s: %s", check.Rule, check.Detail)
+		}
+	}
+
+	if report.Passed() {
+		logger.Info("Result: PASS")
+	} else {
+		logger.Info("Result: FAIL")
+	}
+}
+
+// containsKind reports whether kinds contains kind
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxStatementSize bounds in-toto statements read from attestation manifests
+const maxStatementSize = 16 << 20
+
+// VerifyPolicy is the deployment gate of `kimia verify --policy`
+type VerifyPolicy struct {
+	Keys         []string                 // Cosign public keys, any of which may sign
+	Identities   []SignerIdentity         // Keyless signers, any of which may sign
+	Attestations []AttestationRequirement // Signed attestations the image must carry
+	Require      []string                 // Artifact kinds that must be attached
+}
+
+// SignerIdentity is a keyless (Fulcio certificate) signer
+type SignerIdentity struct {
+	Issuer        string // OIDC issuer of the certificate
+	Subject       string // Exact certificate identity
+	SubjectRegexp string // Or a regular expression it must match
+}
+
+// AttestationRequirement is an attestation the image must carry
+type AttestationRequirement struct {
+	PredicateType string        // Exact type, or a prefix when it ends in "/"
+	MaxAge        time.Duration // Oldest acceptable build time (0 = any)
+}
+
+// PolicyCheck is the outcome of one policy rule
+type PolicyCheck struct {
+	Rule   string
+	Passed bool
+	Detail string
+}
+
+// inTotoStatement is the part of an in-toto statement checked by the policy
+type inTotoStatement struct {
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// signedStatement is an attestation and where its trust comes from
+type signedStatement struct {
+	statement inTotoStatement
+	signer    string
+}
+
+// cosignSigner holds the cosign arguments that trust one policy signer
+type cosignSigner struct {
+	name string
+	args []string
+}
+
+// signers returns the cosign arguments of every key and identity in the policy
+func (p *VerifyPolicy) signers() []cosignSigner {
+	var signers []cosignSigner
+	for _, key := range p.Keys {
+		signers = append(signers, cosignSigner{name: "key " + key, args: []string{"--key", key}})
+	}
+	for _, identity := range p.Identities {
+		args := []string{"--certificate-oidc-issuer", identity.Issuer}
+		name := identity.Subject
+		if identity.SubjectRegexp != "" {
+			args = append(args, "--certificate-identity-regexp", identity.SubjectRegexp)
+			name = identity.SubjectRegexp
+		} else {
+			args = append(args, "--certificate-identity", identity.Subject)
+		}
+		signers = append(signers, cosignSigner{name: name + " (" + identity.Issuer + ")", args: args})
+	}
+	return signers
+}
+
+// evaluatePolicy checks the signatures and attestations of the image digest
+// against the policy and records one PolicyCheck per rule
+func evaluatePolicy(config VerifyConfig, repo *auth.Repository, digest string, manifest *auth.Manifest, report *TrustReport) {
+	policy := config.Policy
+	signers := policy.signers()
+	if len(signers) == 0 {
+		return
+	}
+	if _, err := exec.LookPath("cosign"); err != nil {
+		report.Policy = append(report.Policy, PolicyCheck{Rule: "signature", Detail: "cosign not found in PATH"})
+		return
+	}
+	image := digestReference(repo, digest)
+
+	var trusted []string
+	for _, signer := range signers {
+		if _, err := runCosignVerify(append([]string{"verify"}, signer.args...), image, config); err == nil {
+			trusted = append(trusted, signer.name)
+		}
+	}
+	check := PolicyCheck{Rule: "signature", Passed: len(trusted) > 0, Detail: "no signature from an allowed key or identity"}
+	if check.Passed {
+		check.Detail = "signed by " + strings.Join(trusted, ", ")
+	}
+	report.Policy = append(report.Policy, check)
+
+	for _, requirement := range policy.Attestations {
+		var statements []signedStatement
+		for _, signer := range signers {
+			args := []string{"verify-attestation"}
+			// cosign matches --type exactly; prefixes are matched below
+			if !strings.HasSuffix(requirement.PredicateType, "/") {
+				args = append(args, "--type", requirement.PredicateType)
+			}
+			args = append(args, signer.args...)
+			output, err := runCosignVerify(args, image, config)
+			if err != nil {
+				continue
+			}
+			for _, statement := range parseAttestationEnvelopes(output) {
+				statements = append(statements, signedStatement{statement: statement, signer: signer.name})
+			}
+		}
+		// BuildKit attestations are covered by a signature of the index that lists them
+		if len(trusted) > 0 {
+			for _, statement := range indexAttestations(repo, manifest, requirement.PredicateType) {
+				statements = append(statements, signedStatement{statement: statement, signer: "the signed image index"})
+			}
+		}
+		report.Policy = append(report.Policy, checkAttestations(requirement, statements, time.Now()))
+	}
+}
+
+// checkAttestations evaluates one attestation requirement against the
+// newest matching attestation
+func checkAttestations(requirement AttestationRequirement, statements []signedStatement, now time.Time) PolicyCheck {
+	check := PolicyCheck{Rule: "attestation " + requirement.PredicateType}
+	signer := ""
+	var built time.Time
+	for _, candidate := range statements {
+		if !matchesPredicateType(candidate.statement.PredicateType, requirement.PredicateType) {
+			continue
+		}
+		if signer == "" {
+			signer = candidate.signer
+		}
+		if t, ok := statementTime(candidate.statement.Predicate); ok && t.After(built) {
+			signer, built = candidate.signer, t
+		}
+	}
+
+	switch {
+	case signer == "":
+		check.Detail = "no attestation signed by an allowed key or identity"
+	case requirement.MaxAge == 0:
+		check.Passed = true
+		check.Detail = "signed by " + signer
+	case built.IsZero():
+		check.Detail = "attestation records no build time to check max-age against"
+	case now.Sub(built) > requirement.MaxAge:
+		check.Detail = fmt.Sprintf("newest attestation is from %s, older than max-age %s", built.UTC().Format(time.RFC3339), requirement.MaxAge)
+	default:
+		check.Passed = true
+		check.Detail = fmt.Sprintf("signed by %s, built %s", signer, built.UTC().Format(time.RFC3339))
+	}
+	return check
+}
+
+// matchesPredicateType compares a predicate type with a required type or prefix
+func matchesPredicateType(predicateType, required string) bool {
+	if strings.HasSuffix(required, "/") {
+		return strings.HasPrefix(predicateType, required)
+	}
+	return predicateType == required
+}
+
+// statementTime returns the build or creation time recorded in a predicate:
+// SLSA provenance v0.2 and v1, SPDX and CycloneDX documents
+func statementTime(predicate json.RawMessage) (time.Time, bool) {
+	var fields struct {
+		Metadata struct {
+			BuildFinishedOn string `json:"buildFinishedOn"`
+			BuildStartedOn  string `json:"buildStartedOn"`
+			Timestamp       string `json:"timestamp"`
+		} `json:"metadata"`
+		RunDetails struct {
+			Metadata struct {
+				FinishedOn string `json:"finishedOn"`
+				StartedOn  string `json:"startedOn"`
+			} `json:"metadata"`
+		} `json:"runDetails"`
+		CreationInfo struct {
+			Created string `json:"created"`
+		} `json:"creationInfo"`
+	}
+	if err := json.Unmarshal(predicate, &fields); err != nil {
+		return time.Time{}, false
+	}
+	for _, value := range []string{
+		fields.Metadata.BuildFinishedOn, fields.RunDetails.Metadata.FinishedOn,
+		fields.Metadata.BuildStartedOn, fields.RunDetails.Metadata.StartedOn,
+		fields.CreationInfo.Created, fields.Metadata.Timestamp,
+	} {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseAttestationEnvelopes decodes the DSSE envelopes cosign
+// verify-attestation prints, one JSON object per line
+func parseAttestationEnvelopes(output []byte) []inTotoStatement {
+	var statements []inTotoStatement
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStatementSize)
+	for scanner.Scan() {
+		var envelope struct {
+			Payload string `json:"payload"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &envelope) != nil || envelope.Payload == "" {
+			continue
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			continue
+		}
+		var statement inTotoStatement
+		if json.Unmarshal(payload, &statement) == nil {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// indexAttestations reads the BuildKit attestations of predicateType stored
+// in the image index
+func indexAttestations(repo *auth.Repository, index *auth.Manifest, predicateType string) []inTotoStatement {
+	var statements []inTotoStatement
+	for _, desc := range index.Manifests {
+		if desc.Annotations["vnd.docker.reference.type"] != "attestation-manifest" {
+			continue
+		}
+		attestation, _, err := repo.FetchManifest(desc.Digest)
+		if err != nil {
+			logger.Debug("Failed to fetch attestation manifest %s: %v", desc.Digest, err)
+			continue
+		}
+		for _, layer := range attestation.Layers {
+			if !matchesPredicateType(layer.Annotations["in-toto.io/predicate-type"], predicateType) {
+				continue
+			}
+			statement, err := fetchStatement(repo, layer.Digest)
+			if err != nil {
+				logger.Debug("Failed to read attestation %s: %v", layer.Digest, err)
+				continue
+			}
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// fetchStatement downloads an in-toto statement blob and checks its digest
+func fetchStatement(repo *auth.Repository, digest string) (inTotoStatement, error) {
+	var statement inTotoStatement
+	body, err := repo.FetchBlob(digest)
+	if err != nil {
+		return statement, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxStatementSize))
+	if err != nil {
+		return statement, err
+	}
+	if got := sha256Digest(data); got != digest {
+		return statement, fmt.Errorf("registry returned content with digest %s for %s", got, digest)
+	}
+	return statement, json.Unmarshal(data, &statement)
+}
+
+// runCosignVerify runs a cosign verify command against image and returns its
+// standard output
+func runCosignVerify(args []string, image string, config VerifyConfig) ([]byte, error) {
+	if config.Insecure {
+		args = append(args, "--allow-insecure-registry")
+	}
+	args = append(args, image)
+	logger.Debug("Executing: cosign %s", strings.Join(args, " "))
+	// #nosec G204 -- image is a digest reference built from the parsed image name; keys and identities from the policy file
+	cmd := exec.Command("cosign", args...)
+	cmd.Env = cosignVerifyEnv(config)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		logger.Debug("cosign %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return output, err
+}
+
+// cosignVerifyEnv returns the environment of cosign, pointing it to the
+// attestation repository when there is one
+func cosignVerifyEnv(config VerifyConfig) []string {
+	env := os.Environ()
+	if config.AttestationRepo != "" {
+		env = append(env, "COSIGN_REPOSITORY="+config.AttestationRepo)
+	}
+	return env
+}
+
+// digestReference returns the digest reference cosign resolves for repo
+func digestReference(repo *auth.Repository, digest string) string {
+	if repo.Host == "registry-1.docker.io" {
+		return fmt.Sprintf("docker.io/%s@%s", repo.Repository, digest)
+	}
+	return fmt.Sprintf("%s/%s@%s", repo.Host, repo.Repository, digest)
+}
@@ -0,0 +1,256 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/auth"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// maxImageConfigSize bounds image configs read back by --verify-push
+const maxImageConfigSize = 8 << 20
+
+// PushedImage is an image as the builder reports having pushed it
+type PushedImage struct {
+	Destination  string
+	Digest       string // Manifest or index digest
+	Size         int64  // Manifest or index size, 0 if not reported
+	ConfigDigest string // Config digest of a single-platform image, "" if not reported
+}
+
+// VerifyPushedImages reads every pushed image back from its registry and
+// checks that the tag resolves to the digest that was pushed, that the
+// manifest content matches that digest and size, that every manifest and blob
+// it refers to is present with the expected size, and that it holds exactly
+// the platforms built. platforms is empty when the builder's default
+// platform was built, in which case a single platform is expected.
+func VerifyPushedImages(images []PushedImage, platforms []string, insecure func(string) bool) error {
+	for _, image := range images {
+		logger.Info("Verifying push of %s...", image.Destination)
+		if err := verifyPushedImage(image, platforms, insecure(image.Destination)); err != nil {
+			return fmt.Errorf("push verification failed for %s: %v", image.Destination, err)
+		}
+		logger.Info("Verified %s@%s", image.Destination, image.Digest)
+	}
+	return nil
+}
+
+func verifyPushedImage(image PushedImage, platforms []string, insecure bool) error {
+	if image.Digest == "" {
+		return fmt.Errorf("the builder did not report the digest it pushed")
+	}
+	repo, reference := auth.NewRepository(image.Destination, insecure)
+
+	// The tag must point to what was pushed, not to an older or rewritten image
+	if !strings.HasPrefix(reference, "sha256:") {
+		tagged, err := auth.ResolveImageDigest(image.Destination, insecure)
+		if err != nil {
+			return fmt.Errorf("failed to resolve tag: %v", err)
+		}
+		if tagged != image.Digest {
+			return fmt.Errorf("tag %s points to %s, expected %s", reference, tagged, image.Digest)
+		}
+	}
+
+	manifest, err := fetchVerifiedManifest(repo, image.Digest, image.Size)
+	if err != nil {
+		return err
+	}
+
+	var found []string
+	if len(manifest.Manifests) > 0 {
+		for _, child := range manifest.Manifests {
+			childManifest, err := fetchVerifiedManifest(repo, child.Digest, child.Size)
+			if err != nil {
+				return err
+			}
+			if err := verifyManifestBlobs(repo, childManifest); err != nil {
+				return err
+			}
+			// Attestations are stored as unknown/unknown manifests
+			if child.Annotations["vnd.docker.reference.type"] == "attestation-manifest" || child.Platform == nil || child.Platform.OS == "unknown" {
+				continue
+			}
+			found = append(found, formatPlatform(*child.Platform))
+		}
+	} else {
+		if image.ConfigDigest != "" && manifest.Config.Digest != image.ConfigDigest {
+			return fmt.Errorf("manifest refers to config %s, expected %s", manifest.Config.Digest, image.ConfigDigest)
+		}
+		if err := verifyManifestBlobs(repo, manifest); err != nil {
+			return err
+		}
+		platform, err := fetchConfigPlatform(repo, manifest.Config)
+		if err != nil {
+			return err
+		}
+		found = append(found, formatPlatform(platform))
+	}
+	return comparePlatforms(found, platforms)
+}
+
+// fetchVerifiedManifest fetches a manifest by digest and checks that its
+// content hashes to that digest and, when known, has the expected size
+func fetchVerifiedManifest(repo *auth.Repository, digest string, size int64) (*auth.Manifest, error) {
+	raw, _, err := repo.FetchRawManifest(digest)
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256Digest(raw); got != digest {
+		return nil, fmt.Errorf("registry returned manifest content with digest %s for %s", got, digest)
+	}
+	if size > 0 && int64(len(raw)) != size {
+		return nil, fmt.Errorf("manifest %s is %d bytes, expected %d", digest, len(raw), size)
+	}
+
+	var manifest auth.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", digest, err)
+	}
+	return &manifest, nil
+}
+
+// verifyManifestBlobs checks that the config and layers of a manifest exist
+// in the repository with the sizes the manifest records
+func verifyManifestBlobs(repo *auth.Repository, manifest *auth.Manifest) error {
+	for _, blob := range append([]auth.Descriptor{manifest.Config}, manifest.Layers...) {
+		size, err := repo.BlobSize(blob.Digest)
+		if err != nil {
+			return err
+		}
+		// Registries may omit Content-Length on HEAD
+		if size >= 0 && size != blob.Size {
+			return fmt.Errorf("blob %s is %d bytes in the registry, expected %d", blob.Digest, size, blob.Size)
+		}
+	}
+	return nil
+}
+
+// fetchConfigPlatform returns the platform recorded in an image config
+func fetchConfigPlatform(repo *auth.Repository, config auth.Descriptor) (auth.Platform, error) {
+	var platform auth.Platform
+	data, err := fetchImageConfig(repo, config)
+	if err != nil {
+		return platform, err
+	}
+	if err := json.Unmarshal(data, &platform); err != nil {
+		return platform, fmt.Errorf("invalid image config: %v", err)
+	}
+	return platform, nil
+}
+
+// fetchImageConfig returns an image config blob after checking its digest
+func fetchImageConfig(repo *auth.Repository, config auth.Descriptor) ([]byte, error) {
+	body, err := repo.FetchBlob(config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, maxImageConfigSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %v", err)
+	}
+	if got := sha256Digest(data); got != config.Digest {
+		return nil, fmt.Errorf("registry returned image config content with digest %s for %s", got, config.Digest)
+	}
+	return data, nil
+}
+
+// comparePlatforms checks that the platforms found are the platforms built
+func comparePlatforms(found, built []string) error {
+	if len(built) == 0 {
+		if len(found) != 1 {
+			return fmt.Errorf("expected a single-platform image, found platforms %s", strings.Join(found, ", "))
+		}
+		return nil
+	}
+
+	want := make([]string, len(built))
+	for i, platform := range built {
+		want[i] = normalizePlatform(platform)
+	}
+	got := make([]string, len(found))
+	for i, platform := range found {
+		got[i] = normalizePlatform(platform)
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(want, ",") != strings.Join(got, ",") {
+		return fmt.Errorf("image has platforms %s, expected %s", strings.Join(got, ", "), strings.Join(want, ", "))
+	}
+	return nil
+}
+
+// formatPlatform returns os/arch[/variant]
+func formatPlatform(platform auth.Platform) string {
+	result := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		result += "/" + platform.Variant
+	}
+	return result
+}
+
+// normalizePlatform drops the default variants builders and registries
+// disagree on writing: arm64 is arm64/v8 and arm is arm/v7
+func normalizePlatform(platform string) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	switch {
+	case strings.HasSuffix(platform, "/arm64/v8"):
+		return strings.TrimSuffix(platform, "/v8")
+	case strings.HasSuffix(platform, "/arm"):
+		return platform + "/v7"
+	}
+	return platform
+}
+
+// sha256Digest returns the sha256 digest of data
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// isDigest reports whether s is a sha256 digest
+func isDigest(s string) bool {
+	encoded, ok := strings.CutPrefix(s, "sha256:")
+	return ok && len(encoded) == 64 && strings.Trim(encoded, "0123456789abcdef") == ""
+}
+
+// readBuildKitMetadata returns the image descriptor buildctl wrote with
+// --metadata-file
+func readBuildKitMetadata(path string) (auth.Descriptor, error) {
+	var metadata struct {
+		Digest     string          `json:"containerimage.digest"`
+		Descriptor auth.Descriptor `json:"containerimage.descriptor"`
+	}
+	// #nosec G304 -- temporary file created by kimia
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return metadata.Descriptor, fmt.Errorf("failed to read build metadata: %v", err)
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata.Descriptor, fmt.Errorf("invalid build metadata: %v", err)
+	}
+	if metadata.Descriptor.Digest == "" {
+		metadata.Descriptor.Digest = metadata.Digest
+	}
+	return metadata.Descriptor, nil
+}
+
+// splitPlatforms splits a --custom-platform value
+func splitPlatforms(platforms string) []string {
+	var result []string
+	for _, platform := range strings.Split(platforms, ",") {
+		if platform = strings.TrimSpace(platform); platform != "" {
+			result = append(result, platform)
+		}
+	}
+	return result
+}
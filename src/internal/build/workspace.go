@@ -0,0 +1,258 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// contextCacheMaxAge is how long an unused synced context (context-*) is kept
+const contextCacheMaxAge = 7 * 24 * time.Hour
+
+// workspace is the Workspace of this process, nil until StartWorkspace
+var workspace *Workspace
+
+// Workspace tracks the temporary files and directories of a kimia run (Git
+// clones, generated Dockerfiles, --load archives, cache snapshots) in a
+// manifest under $HOME/.cache/kimia/runs. The manifest stays locked while the
+// run is alive, so a later run can tell a crashed run's leftovers from those of
+// a concurrent build sharing the volume, and remove them.
+type Workspace struct {
+	mu       sync.Mutex
+	manifest *os.File
+	started  time.Time
+	paths    []string
+	build    *ActiveBuild // Set by RegisterBuild
+	output   *outputTee   // Copy of the output in the build log
+	idUsed   bool         // The build ID was given to a history record
+}
+
+// workspaceManifest is the content of a run manifest
+type workspaceManifest struct {
+	PID     int          `json:"pid"`
+	Started time.Time    `json:"started"`
+	Paths   []string     `json:"paths"`
+	Build   *ActiveBuild `json:"build,omitempty"`
+}
+
+// StartWorkspace registers this run, removes what crashed runs left behind
+// and prunes synced contexts unused for contextCacheMaxAge. Temporary paths
+// created afterwards are removed by Close, or by the next run after a crash.
+func StartWorkspace() (*Workspace, error) {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	runsDir := workspaceRunsDir()
+	// #nosec G301 -- per-user state directory
+	if err := os.MkdirAll(runsDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create workspace directory: %v", err)
+	}
+
+	manifest, err := os.CreateTemp(runsDir, "run-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace manifest: %v", err)
+	}
+	if err := syscall.Flock(int(manifest.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		manifest.Close()
+		os.Remove(manifest.Name())
+		return nil, fmt.Errorf("failed to lock workspace manifest: %v", err)
+	}
+
+	w := &Workspace{manifest: manifest, started: time.Now().UTC()}
+	if err := w.save(); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	removeStaleRuns(runsDir, manifest.Name())
+	pruneContextCache(filepath.Join(homeDir, ".cache", "buildkit"))
+
+	workspace = w
+	return w, nil
+}
+
+// workspaceRunsDir returns the directory of the run manifests
+func workspaceRunsDir() string {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		homeDir = "/home/kimia"
+	}
+	return filepath.Join(homeDir, ".cache", "kimia", "runs")
+}
+
+// save rewrites the manifest with the currently tracked paths
+func (w *Workspace) save() error {
+	data, err := json.Marshal(workspaceManifest{PID: os.Getpid(), Started: w.started, Paths: w.paths, Build: w.build})
+	if err != nil {
+		return err
+	}
+	if err := w.manifest.Truncate(0); err != nil {
+		return fmt.Errorf("failed to update workspace manifest: %v", err)
+	}
+	if _, err := w.manifest.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to update workspace manifest: %v", err)
+	}
+	return nil
+}
+
+// track records path so it is removed even if this run crashes
+func (w *Workspace) track(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paths = append(w.paths, path)
+	if err := w.save(); err != nil {
+		logger.Debug("%v", err)
+	}
+}
+
+// untrack forgets a path that has been removed
+func (w *Workspace) untrack(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, p := range w.paths {
+		if p == path {
+			w.paths = append(w.paths[:i], w.paths[i+1:]...)
+			break
+		}
+	}
+	if err := w.save(); err != nil {
+		logger.Debug("%v", err)
+	}
+}
+
+// Close removes every tracked path that is still present and releases the manifest
+func (w *Workspace) Close() {
+	if w == nil {
+		return
+	}
+	// Builds following the log read it to the end once the manifest is unlocked
+	w.output.stop()
+
+	w.mu.Lock()
+	paths := w.paths
+	w.paths = nil
+	w.mu.Unlock()
+
+	for _, path := range paths {
+		logger.Debug("Cleaning up temporary path: %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			logger.Warning("Failed to clean up %s: %v", path, err)
+		}
+	}
+	name := w.manifest.Name()
+	// #nosec G104 -- closing releases the lock; the manifest is removed next
+	w.manifest.Close()
+	// #nosec G104
+	os.Remove(name)
+	if w.build != nil && w.build.Log != "" {
+		// #nosec G104 -- followers keep reading the open log
+		os.Remove(w.build.Log)
+	}
+	if workspace == w {
+		workspace = nil
+	}
+}
+
+// newTempDir creates a directory like os.MkdirTemp and tracks it in the workspace
+func newTempDir(dir, pattern string) (string, error) {
+	path, err := os.MkdirTemp(dir, pattern)
+	if err == nil && workspace != nil {
+		workspace.track(path)
+	}
+	return path, err
+}
+
+// newTempFile creates a file like os.CreateTemp and tracks it in the workspace
+func newTempFile(dir, pattern string) (*os.File, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err == nil && workspace != nil {
+		workspace.track(file.Name())
+	}
+	return file, err
+}
+
+// removeTemp removes a path created by newTempDir or newTempFile
+func removeTemp(path string) error {
+	err := os.RemoveAll(path)
+	if workspace != nil {
+		workspace.untrack(path)
+	}
+	return err
+}
+
+// removeStaleRuns removes the paths recorded by runs whose manifest is no
+// longer locked, i.e. runs that exited without cleaning up
+func removeStaleRuns(runsDir, own string) {
+	manifests, _ := filepath.Glob(filepath.Join(runsDir, "run-*.json"))
+	for _, name := range manifests {
+		if name == own {
+			continue
+		}
+		// #nosec G304 -- manifest in the per-user runs directory
+		file, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close() // Still running
+			continue
+		}
+
+		// A run that has just created its manifest may not have locked it yet
+		var stale workspaceManifest
+		if err := json.NewDecoder(file).Decode(&stale); err != nil {
+			if info, statErr := file.Stat(); statErr != nil || time.Since(info.ModTime()) < time.Hour {
+				file.Close()
+				continue
+			}
+			logger.Debug("Removing unreadable workspace manifest %s: %v", name, err)
+		}
+		removed := 0
+		for _, path := range stale.Paths {
+			// Only ever remove paths kimia names itself
+			base := filepath.Base(path)
+			if !filepath.IsAbs(path) || !(strings.HasPrefix(base, "kimia-") || strings.HasPrefix(base, ".kimia-")) {
+				continue
+			}
+			if _, err := os.Lstat(path); err != nil {
+				continue
+			}
+			if err := os.RemoveAll(path); err != nil {
+				logger.Warning("Failed to remove leftover %s: %v", path, err)
+				continue
+			}
+			removed++
+		}
+		if removed > 0 {
+			logger.Info("Removed %d temporary paths left by an interrupted run (PID %d, started %s)",
+				removed, stale.PID, stale.Started.Format(time.RFC3339))
+		}
+		// #nosec G104 -- the stale manifest is removed while still locked
+		os.Remove(name)
+		file.Close()
+	}
+}
+
+// pruneContextCache removes synced contexts (see stableContextDir) that no
+// build has used for contextCacheMaxAge
+func pruneContextCache(cacheDir string) {
+	dirs, _ := filepath.Glob(filepath.Join(cacheDir, "context-*"))
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < contextCacheMaxAge {
+			continue
+		}
+		logger.Info("Removing synced context unused since %s: %s", info.ModTime().Format("2006-01-02"), dir)
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Warning("Failed to remove %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Severity ranks how risky an audit finding is
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "INFO"
+	case SeverityLow:
+		return "LOW"
+	case SeverityMedium:
+		return "MEDIUM"
+	case SeverityHigh:
+		return "HIGH"
+	case SeverityCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// AuditFinding describes a single risky runtime configuration
+type AuditFinding struct {
+	Check       string
+	Severity    Severity
+	Description string
+	Remediation []string
+}
+
+// AuditReport holds the results of a container escape hardening audit
+type AuditReport struct {
+	Platform Platform
+	Findings []AuditFinding
+	Passed   []string
+}
+
+// MaxSeverity returns the highest severity across all findings
+func (r *AuditReport) MaxSeverity() Severity {
+	maxSeverity := SeverityInfo
+	for _, f := range r.Findings {
+		if f.Severity > maxSeverity {
+			maxSeverity = f.Severity
+		}
+	}
+	return maxSeverity
+}
+
+func (r *AuditReport) add(check string, severity Severity, description string, remediation ...string) {
+	r.Findings = append(r.Findings, AuditFinding{
+		Check:       check,
+		Severity:    severity,
+		Description: description,
+		Remediation: remediation,
+	})
+}
+
+// capabilityNames maps Linux capability bit positions to their names
+var capabilityNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER",
+	"CAP_FSETID", "CAP_KILL", "CAP_SETGID", "CAP_SETUID",
+	"CAP_SETPCAP", "CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER",
+	"CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD",
+	"CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// escapeCapabilities are capabilities with known container escape paths
+var escapeCapabilities = map[string]bool{
+	"CAP_SYS_ADMIN":       true,
+	"CAP_SYS_MODULE":      true,
+	"CAP_SYS_PTRACE":      true,
+	"CAP_SYS_RAWIO":       true,
+	"CAP_DAC_READ_SEARCH": true,
+	"CAP_SYS_BOOT":        true,
+	"CAP_BPF":             true,
+	"CAP_MAC_ADMIN":       true,
+	"CAP_MAC_OVERRIDE":    true,
+}
+
+// hostSockets are container runtime sockets that grant control of the host
+var hostSockets = []string{
+	"/var/run/docker.sock",
+	"/run/docker.sock",
+	"/run/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+	"/run/podman/podman.sock",
+	"/var/run/cri-dockerd.sock",
+}
+
+// sensitiveHostPaths are host directories that should never be mounted into a build pod
+var sensitiveHostPaths = []string{
+	"/var/lib/kubelet",
+	"/etc/kubernetes",
+	"/var/lib/docker",
+	"/var/lib/containerd",
+	"/var/log",
+	"/host",
+	"/rootfs",
+}
+
+// mountEntry is a parsed line of /proc/self/mountinfo
+type mountEntry struct {
+	Root       string
+	MountPoint string
+	Options    string
+	FSType     string
+	Source     string
+}
+
+// readMountInfo parses /proc/self/mountinfo
+func readMountInfo() ([]mountEntry, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /proc/self/mountinfo: %v", err)
+	}
+	defer file.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Format: id parent major:minor root mountpoint options [optional...] - fstype source superopts
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Root:       fields[3],
+			MountPoint: fields[4],
+			Options:    fields[5],
+			FSType:     fields[sep+1],
+			Source:     fields[sep+2],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading /proc/self/mountinfo: %v", err)
+	}
+	return mounts, nil
+}
+
+// isReadOnly reports whether mount options include "ro"
+func (m mountEntry) isReadOnly() bool {
+	for _, opt := range strings.Split(m.Options, ",") {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// readProcStatusField returns the value of a field in /proc/self/status
+func readProcStatusField(name string) string {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, name+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, name+":"))
+		}
+	}
+	return ""
+}
+
+// RunSecurityAudit inspects the current runtime for configurations that
+// weaken container isolation beyond what Kimia needs
+func RunSecurityAudit(storageDriver string) *AuditReport {
+	report := &AuditReport{Platform: DetectPlatform()}
+
+	auditUser(report)
+	auditCapabilities(report, storageDriver)
+	auditSeccomp(report)
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		logger.Debug("Skipping mount checks: %v", err)
+	} else {
+		auditProcMounts(report, mounts)
+		auditHostMounts(report, mounts)
+	}
+	auditHostSockets(report)
+	auditHostNamespaces(report)
+	auditSubIDRange(report)
+
+	return report
+}
+
+// auditUser flags running as root
+func auditUser(report *AuditReport) {
+	if os.Getuid() == 0 {
+		report.add("User", SeverityCritical,
+			"Running as root (UID 0); Kimia is designed to run rootless",
+			"Set securityContext.runAsUser: 1000 and runAsNonRoot: true")
+		return
+	}
+	report.Passed = append(report.Passed, fmt.Sprintf("Running as non-root user (UID %d)", os.Getuid()))
+}
+
+// auditCapabilities flags effective capabilities beyond the required set
+func auditCapabilities(report *AuditReport, storageDriver string) {
+	caps, err := CheckCapabilities()
+	if err != nil {
+		report.add("Capabilities", SeverityLow, fmt.Sprintf("Unable to read capabilities: %v", err))
+		return
+	}
+
+	required := make(map[string]bool)
+	for _, name := range RequiredCapabilities(storageDriver) {
+		required["CAP_"+name] = true
+	}
+
+	var extra, escape []string
+	for bit, name := range capabilityNames {
+		if caps.EffectiveCaps&(1<<uint(bit)) == 0 || required[name] {
+			continue
+		}
+		if escapeCapabilities[name] {
+			escape = append(escape, name)
+		} else {
+			extra = append(extra, name)
+		}
+	}
+
+	allowed := capabilityList(RequiredCapabilities(storageDriver))
+
+	if len(escape) > 0 {
+		report.add("Capabilities", SeverityCritical,
+			fmt.Sprintf("Capabilities with known container escape paths: %s", strings.Join(escape, ", ")),
+			"Drop all capabilities and add back only what Kimia needs:",
+			"  capabilities:",
+			"    drop: [ALL]",
+			"    add: "+allowed)
+	}
+	if len(extra) > 0 {
+		report.add("Capabilities", SeverityMedium,
+			fmt.Sprintf("Capabilities beyond the required set: %s", strings.Join(extra, ", ")),
+			"Use capabilities.drop: [ALL] and add only "+allowed)
+	}
+	if len(escape) == 0 && len(extra) == 0 {
+		report.Passed = append(report.Passed, "No capabilities beyond the required set")
+	}
+}
+
+// auditSeccomp flags disabled seccomp filtering and missing AppArmor confinement
+func auditSeccomp(report *AuditReport) {
+	profiles := CheckSecurityProfiles()
+
+	switch profiles.SeccompMode {
+	case SeccompDisabled:
+		// Unconfined is a documented fallback for user namespaces, so this
+		// is reported but does not fail the audit on its own
+		report.add("Seccomp", SeverityMedium,
+			"Seccomp filtering is disabled (Unconfined)",
+			"Use seccompProfile.type: RuntimeDefault unless unconfined is strictly required;",
+			"if builds fail with RuntimeDefault, prefer a Localhost profile that only adds",
+			"the unshare/clone/mount syscalls needed for user namespaces")
+	case SeccompStrict, SeccompFilter:
+		report.Passed = append(report.Passed, "Seccomp filter is active")
+	default:
+		report.add("Seccomp", SeverityLow, "Unable to determine seccomp mode")
+	}
+
+	if profiles.AppArmorEnabled {
+		if profiles.IsAppArmorConfined() {
+			report.Passed = append(report.Passed, "AppArmor profile is active: "+profiles.AppArmorProfile)
+		} else {
+			report.add("AppArmor", SeverityLow,
+				"AppArmor is enabled on the host but the container is unconfined",
+				"Use appArmorProfile.type: RuntimeDefault if user namespace creation still works with it")
+		}
+	}
+}
+
+// auditProcMounts flags writable /proc/sys and unmasked kernel interfaces
+func auditProcMounts(report *AuditReport, mounts []mountEntry) {
+	procWritable := false
+	procSysReadOnly := false
+	for _, m := range mounts {
+		switch m.MountPoint {
+		case "/proc":
+			procWritable = !m.isReadOnly()
+		case "/proc/sys":
+			procSysReadOnly = m.isReadOnly()
+		}
+	}
+
+	if procWritable && !procSysReadOnly {
+		report.add("/proc", SeverityHigh,
+			"/proc/sys is writable; kernel parameters may be modifiable from the container",
+			"Do not use procMount: Unmasked or privileged: true;",
+			"the default runtime mounts /proc/sys read-only")
+	} else {
+		report.Passed = append(report.Passed, "/proc/sys is read-only")
+	}
+
+	// The runtime masks these by mounting /dev/null or an empty tmpfs over them
+	var unmasked []string
+	for _, path := range []string{"/proc/kcore", "/proc/sysrq-trigger", "/proc/keys"} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		masked := false
+		for _, m := range mounts {
+			if m.MountPoint == path {
+				masked = true
+				break
+			}
+		}
+		if !masked {
+			unmasked = append(unmasked, path)
+		}
+	}
+	if len(unmasked) > 0 {
+		report.add("/proc", SeverityMedium,
+			fmt.Sprintf("Sensitive /proc paths are not masked: %s", strings.Join(unmasked, ", ")),
+			"Use procMount: Default and avoid privileged: true")
+	}
+}
+
+// auditHostMounts flags host filesystem paths mounted into the container
+func auditHostMounts(report *AuditReport, mounts []mountEntry) {
+	var hostRoot, sensitive []string
+	for _, m := range mounts {
+		if m.MountPoint == "/" {
+			continue
+		}
+		// A block-device filesystem mounted from its root is typically a hostPath of /
+		if m.Root == "/" && strings.HasPrefix(m.Source, "/dev/") &&
+			(m.FSType == "ext4" || m.FSType == "xfs" || m.FSType == "btrfs") {
+			hostRoot = append(hostRoot, m.MountPoint)
+			continue
+		}
+		// Match whole-directory mounts only; per-pod files such as /etc/hosts
+		// legitimately live under the kubelet and runtime state directories
+		for _, path := range sensitiveHostPaths {
+			if m.MountPoint == path || strings.HasPrefix(m.MountPoint, path+"/") || m.Root == path {
+				sensitive = append(sensitive, m.MountPoint)
+				break
+			}
+		}
+	}
+
+	if len(hostRoot) > 0 {
+		report.add("Host mounts", SeverityCritical,
+			fmt.Sprintf("Host filesystem root appears mounted at: %s", strings.Join(hostRoot, ", ")),
+			"Remove hostPath volumes; use emptyDir or a PersistentVolumeClaim for build storage")
+	}
+	if len(sensitive) > 0 {
+		report.add("Host mounts", SeverityHigh,
+			fmt.Sprintf("Sensitive host paths are mounted: %s", strings.Join(sensitive, ", ")),
+			"Remove hostPath volumes for kubelet, runtime and log directories")
+	}
+	if len(hostRoot) == 0 && len(sensitive) == 0 {
+		report.Passed = append(report.Passed, "No sensitive host paths mounted")
+	}
+}
+
+// auditHostSockets flags container runtime sockets visible in the container
+func auditHostSockets(report *AuditReport) {
+	var found []string
+	for _, path := range hostSockets {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			found = append(found, path)
+		}
+	}
+
+	if len(found) > 0 {
+		report.add("Runtime sockets", SeverityCritical,
+			fmt.Sprintf("Container runtime socket is mounted: %s", strings.Join(found, ", ")),
+			"Kimia is daemonless and never needs the host runtime socket; remove the hostPath volume")
+		return
+	}
+	report.Passed = append(report.Passed, "No container runtime sockets mounted")
+}
+
+// auditHostNamespaces flags sharing the host PID namespace
+func auditHostNamespaces(report *AuditReport) {
+	// In a private PID namespace PID 1 is the container entrypoint, not an init system
+	data, err := os.ReadFile("/proc/1/comm")
+	if err != nil {
+		return
+	}
+	comm := strings.TrimSpace(string(data))
+	if comm == "systemd" || comm == "init" {
+		report.add("Namespaces", SeverityHigh,
+			fmt.Sprintf("PID 1 is %q; the container appears to share the host PID namespace", comm),
+			"Set hostPID: false (Kubernetes) or drop --pid=host (Docker)")
+		return
+	}
+	report.Passed = append(report.Passed, "Private PID namespace")
+}
+
+// auditSubIDRange flags the shared image-default subordinate ID range on
+// multi-tenant nodes, where builds from different pods map to the same host UIDs
+func auditSubIDRange(report *AuditReport) {
+	uid := os.Getuid()
+	entry, err := checkSubIDFile("/etc/subuid", lookupUsername(uid), uid)
+	if err != nil || entry == "" {
+		return
+	}
+
+	parts := strings.Split(entry, ":")
+	if parts[1] == strconv.Itoa(arbitrarySubIDStart) && parts[2] == strconv.Itoa(arbitrarySubIDCount) &&
+		report.Platform.IsKubernetes() {
+		report.add("User namespace", SeverityLow,
+			fmt.Sprintf("Using the shared default subordinate ID range %s:%s; concurrent builds on this node map to the same host UIDs", parts[1], parts[2]),
+			"Pass --userns-range-file on a shared hostPath volume, or --userns-range from your controller")
+		return
+	}
+	report.Passed = append(report.Passed, fmt.Sprintf("Subordinate ID range %s:%s", parts[1], parts[2]))
+}
+
+// AuditSecurity runs the security self-audit and prints a report.
+// It returns 1 when HIGH or CRITICAL findings are present.
+func AuditSecurity() int {
+	builder := build.DetectBuilder()
+	storageDriver := detectStorageDriver(builder)
+	report := RunSecurityAudit(storageDriver)
+
+	logger.Info("")
+	logger.Info("Kimia Security Audit (%s)", builder)
+	logger.Info("═══════════════════════════════════════════════════════")
+	logger.Info("")
+	logger.Info("  Platform:                %s", report.Platform)
+	logger.Info("  Storage Driver:          %s", storageDriver)
+	logger.Info("")
+
+	logger.Info("PASSED CHECKS")
+	for _, passed := range report.Passed {
+		logger.Info("  ✓ %s", passed)
+	}
+	logger.Info("")
+
+	logger.Info("FINDINGS")
+	if len(report.Findings) == 0 {
+		logger.Info("  None")
+	}
+	for _, f := range report.Findings {
+		msg := fmt.Sprintf("  [%s] %s: %s", f.Severity, f.Check, f.Description)
+		if f.Severity >= SeverityHigh {
+			logger.Error("%s", msg)
+		} else if f.Severity >= SeverityMedium {
+			logger.Warning("%s", msg)
+		} else {
+			logger.Info("%s", msg)
+		}
+		for _, line := range f.Remediation {
+			logger.Info("      %s", line)
+		}
+	}
+	logger.Info("")
+
+	logger.Info("VERDICT")
+	logger.Info("═══════════════════════════════════════════════════════")
+	if report.MaxSeverity() >= SeverityHigh {
+		logger.Error("✗ Risky configuration detected (highest severity: %s)", report.MaxSeverity())
+		return 1
+	}
+	logger.Info("✓ No high-risk configuration detected")
+	return 0
+}
@@ -0,0 +1,241 @@
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// binfmtDir is where the binfmt_misc filesystem is mounted
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArchs maps GOARCH names used in platforms to QEMU's names
+var qemuArchs = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i386",
+	"arm64":    "aarch64",
+	"arm":      "arm",
+	"ppc64le":  "ppc64le",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64le": "mips64el",
+	"loong64":  "loongarch64",
+}
+
+// qemuMagic holds the ELF magic and mask that select the binaries of each
+// QEMU architecture, as registered by qemu-binfmt-conf.sh
+var qemuMagic = map[string][2]string{
+	"x86_64":  {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`, `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"i386":    {`\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x03\x00`, `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"aarch64": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"arm":     {`\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+	"ppc64le": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x15\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\x00`},
+	"s390x":   {`\x7fELF\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x16`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`},
+	"riscv64": {`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`, `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`},
+}
+
+// BinfmtHandler is a binfmt_misc handler that runs foreign binaries
+type BinfmtHandler struct {
+	Name        string
+	Interpreter string
+	Enabled     bool
+	FixBinary   bool // F flag: the interpreter is opened at registration, so it works inside containers
+}
+
+// CheckEmulation checks, before a cross-platform build, that the RUN steps
+// of every platform can run on this node: natively, or through a QEMU
+// binfmt_misc handler. Without a handler the build would fail halfway with
+// "exec format error". With register, missing handlers are registered from
+// the qemu-*-static binaries in PATH, which needs a privileged pod.
+func CheckEmulation(platforms []string, register bool) error {
+	for _, platform := range platforms {
+		parts := strings.Split(strings.TrimSpace(platform), "/")
+		if len(parts) < 2 || runsNatively(parts[1]) {
+			continue
+		}
+		arch := parts[1]
+		qemuArch, ok := qemuArchs[arch]
+		if !ok {
+			return fmt.Errorf("cannot build %s on this %s node: Kimia knows no QEMU emulator for %s", platform, runtime.GOARCH, arch)
+		}
+
+		handlers, mounted := BinfmtHandlers()
+		if !mounted && register {
+			if err := mountBinfmt(); err != nil {
+				return err
+			}
+			handlers, mounted = BinfmtHandlers()
+		}
+		if !mounted {
+			logger.Warning("Cannot check QEMU emulation for %s: binfmt_misc is not mounted in this container; the build fails with \"exec format error\" unless the node has a handler for %s", platform, qemuArch)
+			continue
+		}
+
+		handler := findHandler(handlers, qemuArch)
+		switch {
+		case handler != nil && handler.Enabled:
+			if !handler.FixBinary {
+				logger.Warning("The binfmt_misc handler %s was registered without the F flag; RUN steps of %s only work if %s also exists inside the build", handler.Name, platform, handler.Interpreter)
+			}
+			logger.Info("Emulating %s with %s", platform, handler.Interpreter)
+			continue
+		case arch == "arm" && runtime.GOARCH == "arm64":
+			// Many arm64 CPUs run 32-bit ARM binaries natively
+			logger.Warning("No binfmt_misc handler for %s; its RUN steps only work if this CPU runs 32-bit ARM code", platform)
+			continue
+		case !register:
+			if handler != nil {
+				return fmt.Errorf("cannot build %s on this %s node: the binfmt_misc handler %s is disabled, so RUN steps would fail with \"exec format error\"; enable it (echo 1 > %s) or use --register-binfmt in a privileged pod", platform, runtime.GOARCH, handler.Name, filepath.Join(binfmtDir, handler.Name))
+			}
+			return fmt.Errorf("cannot build %s on this %s node: no binfmt_misc handler for %s, so RUN steps would fail with \"exec format error\"; register QEMU on the node (e.g. a privileged DaemonSet running tonistiigi/binfmt --install %s), use --register-binfmt in a privileged pod, or build on a %s node", platform, runtime.GOARCH, qemuArch, arch, arch)
+		}
+
+		if err := registerBinfmt(qemuArch, handler); err != nil {
+			return fmt.Errorf("cannot build %s on this %s node: %v", platform, runtime.GOARCH, err)
+		}
+	}
+	return nil
+}
+
+// runsNatively reports whether this node runs binaries of arch without
+// emulation
+func runsNatively(arch string) bool {
+	return arch == runtime.GOARCH || (arch == "386" && runtime.GOARCH == "amd64")
+}
+
+// BinfmtHandlers returns the binfmt_misc handlers of this node, and whether
+// binfmt_misc is mounted at all
+func BinfmtHandlers() ([]BinfmtHandler, bool) {
+	entries, err := os.ReadDir(binfmtDir)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(filepath.Join(binfmtDir, "status")); err != nil {
+		return nil, false
+	}
+	var handlers []BinfmtHandler
+	for _, entry := range entries {
+		if entry.Name() == "register" || entry.Name() == "status" {
+			continue
+		}
+		// #nosec G304 -- entries of the binfmt_misc filesystem
+		data, err := os.ReadFile(filepath.Join(binfmtDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		handler := BinfmtHandler{Name: entry.Name()}
+		for _, line := range strings.Split(string(data), "\n") {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch key {
+			case "enabled":
+				handler.Enabled = true
+			case "interpreter":
+				handler.Interpreter = value
+			case "flags:":
+				handler.FixBinary = strings.Contains(value, "F")
+			}
+		}
+		handlers = append(handlers, handler)
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].Name < handlers[j].Name })
+	return handlers, true
+}
+
+// findHandler returns the QEMU handler for qemuArch, or nil
+func findHandler(handlers []BinfmtHandler, qemuArch string) *BinfmtHandler {
+	for i, handler := range handlers {
+		interpreter := filepath.Base(handler.Interpreter)
+		if interpreter == "qemu-"+qemuArch || strings.HasPrefix(interpreter, "qemu-"+qemuArch+"-") {
+			return &handlers[i]
+		}
+	}
+	return nil
+}
+
+// mountBinfmt mounts binfmt_misc, which containers usually do not have
+func mountBinfmt() error {
+	if err := syscall.Mount("binfmt_misc", binfmtDir, "binfmt_misc", 0, ""); err != nil {
+		return binfmtPermissionError("mount binfmt_misc", err)
+	}
+	logger.Info("Mounted binfmt_misc at %s", binfmtDir)
+	return nil
+}
+
+// registerBinfmt registers (or enables) the QEMU handler for qemuArch with the
+// F flag, so that the interpreter also works inside the build's containers.
+// binfmt_misc handlers apply to the whole node.
+func registerBinfmt(qemuArch string, existing *BinfmtHandler) error {
+	if existing != nil {
+		path := filepath.Join(binfmtDir, existing.Name)
+		if err := os.WriteFile(path, []byte("1"), 0); err != nil {
+			return binfmtPermissionError("enable the binfmt_misc handler "+existing.Name, err)
+		}
+		logger.Warning("Audit: enabled the binfmt_misc handler %s for the whole node", existing.Name)
+		return nil
+	}
+
+	magic, ok := qemuMagic[qemuArch]
+	if !ok {
+		return fmt.Errorf("--register-binfmt cannot register %s; register it on the node instead", qemuArch)
+	}
+	var interpreter string
+	for _, name := range []string{"qemu-" + qemuArch + "-static", "qemu-" + qemuArch} {
+		if path, err := exec.LookPath(name); err == nil {
+			interpreter = path
+			break
+		}
+	}
+	if interpreter == "" {
+		return fmt.Errorf("--register-binfmt needs qemu-%s-static in PATH (install qemu-user-static in the image), or register QEMU on the node", qemuArch)
+	}
+
+	rule := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:F", qemuArch, magic[0], magic[1], interpreter)
+	if err := os.WriteFile(filepath.Join(binfmtDir, "register"), []byte(rule), 0); err != nil {
+		return binfmtPermissionError("register the binfmt_misc handler qemu-"+qemuArch, err)
+	}
+	logger.Warning("Audit: registered the binfmt_misc handler qemu-%s (%s) for the whole node", qemuArch, interpreter)
+	return nil
+}
+
+// binfmtPermissionError explains that changing binfmt_misc needs privileges
+func binfmtPermissionError(action string, err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("cannot %s: %v (needs a privileged pod; otherwise register QEMU on the node, e.g. with a DaemonSet running tonistiigi/binfmt --install all)", action, err)
+	}
+	return fmt.Errorf("cannot %s: %v", action, err)
+}
+
+// printEmulation prints the QEMU handlers for `kimia check-environment`
+func printEmulation() {
+	logger.Info("EMULATION (binfmt_misc)")
+	handlers, mounted := BinfmtHandlers()
+	if !mounted {
+		logger.Info("  Status:                  Not mounted in this container (cross-platform builds cannot be checked)")
+		logger.Info("")
+		return
+	}
+	var emulated []string
+	for arch, qemuArch := range qemuArchs {
+		if runsNatively(arch) {
+			continue
+		}
+		if handler := findHandler(handlers, qemuArch); handler != nil && handler.Enabled {
+			emulated = append(emulated, arch)
+		}
+	}
+	sort.Strings(emulated)
+	if len(emulated) == 0 {
+		logger.Info("  Foreign platforms:       None (only %s can be built)", runtime.GOARCH)
+	} else {
+		logger.Info("  Foreign platforms:       %s %s", strings.Join(emulated, ", "), getCheckmark(true))
+	}
+	logger.Info("")
+}
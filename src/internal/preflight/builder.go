@@ -0,0 +1,73 @@
+package preflight
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/build"
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// CheckBuilderRequirements checks that this host can run the builder selected
+// with --builder before the build starts, rather than failing halfway through
+// it. A remote builder (--buildkit-addr, --buildah-remote) only needs its
+// client. A local BuildKit runs buildkitd under rootlesskit, which needs user
+// namespaces; a local Buildah needs them unless it runs as root.
+func CheckBuilderRequirements(builder string, remote bool) error {
+	binaries, needsUserNS, err := builderRequirements(builder, remote, os.Getuid())
+	if err != nil {
+		return err
+	}
+
+	problems := missingBinaries(binaries)
+	if needsUserNS {
+		userns, err := CheckUserNamespaces()
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("cannot check user namespaces: %v", err))
+		case !userns.IsUserNamespaceReady():
+			problems = append(problems, userns.GetIssues()...)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s cannot run here: %s (run `kimia check-environment --builder=%s` for details)", builder, strings.Join(problems, "; "), builder)
+	}
+	logger.Debug("Builder requirements met: %s", builder)
+	return nil
+}
+
+// builderRequirements returns the binaries builder needs and whether it needs
+// to create user namespaces when run as uid
+func builderRequirements(builder string, remote bool, uid int) ([]string, bool, error) {
+	switch {
+	case builder == "buildkit" && remote:
+		return []string{"buildctl"}, false, nil
+	case builder == "buildkit":
+		return []string{"buildkitd", "buildctl", "rootlesskit"}, true, nil
+	case builder == "buildah" && remote:
+		return []string{"podman"}, false, nil
+	case builder == "buildah":
+		return []string{"buildah"}, uid != 0, nil
+	case builder == "buildpacks":
+		// The lifecycle pushes to the registry and needs no user namespace
+		creator := build.LifecycleCreator()
+		if creator == "" {
+			creator = "creator"
+		}
+		return []string{creator}, false, nil
+	}
+	return nil, false, fmt.Errorf("unknown builder %q", builder)
+}
+
+// missingBinaries returns a problem for each binary not found in PATH
+func missingBinaries(binaries []string) []string {
+	var problems []string
+	for _, binary := range binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			problems = append(problems, binary+" not found in PATH")
+		}
+	}
+	return problems
+}
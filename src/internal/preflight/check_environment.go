@@ -44,28 +44,30 @@ func DetectEnvironment() Environment {
 	return EnvStandalone
 }
 
-// CheckEnvironment performs comprehensive environment check
-func CheckEnvironment() int {
-	// Get storage driver from environment or default to vfs
-	var storageDriver string
-	if build.DetectBuilder() == "buildah" {
-		storageDriver = os.Getenv("STORAGE_DRIVER")
-		if storageDriver == "" {
-			storageDriver = "vfs"
-		}
-	} else {
-		storageDriver = os.Getenv("STORAGE_DRIVER")
-		if storageDriver == "" {
-			storageDriver = "native"
-		}
+// CheckEnvironment performs comprehensive environment check for the builder
+// selected with --builder ("" = the detected one)
+func CheckEnvironment(choice string) int {
+	builder := build.DetectChosenBuilder(choice)
+	if builder == "unknown" && choice != "" && choice != "auto" {
+		// Report what is missing for the builder asked for
+		builder = choice
 	}
+	return CheckEnvironmentWithDriver(builder, detectStorageDriver(builder))
+}
 
-	return CheckEnvironmentWithDriver(storageDriver)
+// detectStorageDriver returns STORAGE_DRIVER or the builder's default (vfs for Buildah, native for BuildKit)
+func detectStorageDriver(builder string) string {
+	if storageDriver := os.Getenv("STORAGE_DRIVER"); storageDriver != "" {
+		return storageDriver
+	}
+	if builder == "buildah" {
+		return "vfs"
+	}
+	return "native"
 }
 
 // CheckEnvironmentWithDriver performs comprehensive environment check with storage driver context
-func CheckEnvironmentWithDriver(storageDriver string) int {
-	builder := build.DetectBuilder()
+func CheckEnvironmentWithDriver(builder, storageDriver string) int {
 	logger.Info("")
 	logger.Info("Kimia Environment Check (%s)", builder)
 	logger.Info("═══════════════════════════════════════════════════════")
@@ -103,16 +105,25 @@ func CheckEnvironmentWithDriver(storageDriver string) int {
 	}
 
 	env := DetectEnvironment()
+	platform := DetectPlatform()
 
 	checkmark := getCheckmark(true)
 	logger.Info("  User ID:                 %d %s", uid, checkmark)
 	logger.Info("  Environment:             %s", getEnvironment(env))
+	logger.Info("  Platform:                %s", platform)
 	logger.Info("  Storage Driver:          %s", storageDriver)
 
 	if username := os.Getenv("USER"); username != "" {
 		logger.Info("  User Name:               %s", username)
 	}
 
+	if arbitrary := CheckArbitraryUID(); arbitrary.IsArbitrary {
+		logger.Info("  Arbitrary UID:           Yes (GID %d, OpenShift compatibility mode)", arbitrary.GID)
+		if arbitrary.SCC != "" {
+			logger.Info("  OpenShift SCC:           %s", arbitrary.SCC)
+		}
+	}
+
 	if home := os.Getenv("HOME"); home != "" {
 		logger.Info("  Home Directory:          %s", home)
 	}
@@ -226,6 +237,43 @@ func CheckEnvironmentWithDriver(storageDriver string) int {
 	}
 	logger.Info("")
 
+	// Seccomp / AppArmor
+	logger.Info("SECURITY PROFILES")
+	profiles := CheckSecurityProfiles()
+	if profiles.SeccompFilters > 0 {
+		logger.Info("  Seccomp:                 %s (%d filters)", profiles.SeccompMode, profiles.SeccompFilters)
+	} else {
+		logger.Info("  Seccomp:                 %s", profiles.SeccompMode)
+	}
+	if profiles.AppArmorEnabled {
+		if profiles.AppArmorProfile != "" {
+			logger.Info("  AppArmor:                %s", profiles.AppArmorProfile)
+		} else {
+			logger.Info("  AppArmor:                Enabled (profile unknown)")
+		}
+		if profiles.AppArmorRestrictsUserNS {
+			logger.Info("  AppArmor UserNS:         Restricted (kernel.apparmor_restrict_unprivileged_userns=1)")
+		}
+	} else {
+		logger.Info("  AppArmor:                Not enabled")
+	}
+	logger.Info("  No New Privileges:       %s", getEnabled(profiles.NoNewPrivs))
+	if profiles.UnshareTested {
+		if profiles.UnshareBlocked {
+			logger.Info("  clone(CLONE_NEWUSER):    Blocked by %s %s", profiles.BlockedBy, getCheckmark(false))
+			for _, issue := range profiles.GetIssues(platform) {
+				logger.Error("    %s", issue)
+			}
+			allGood = false
+		} else {
+			logger.Info("  clone(CLONE_NEWUSER):    Allowed %s", getCheckmark(true))
+		}
+	}
+	logger.Info("")
+
+	// QEMU emulation for cross-platform builds
+	printEmulation()
+
 	// Storage Drivers
 	logger.Info("STORAGE DRIVERS")
 
@@ -321,10 +369,18 @@ func CheckEnvironmentWithDriver(storageDriver string) int {
 	if builder == "buildah" {
 		checkDependency("buildah", "/usr/local/bin/buildah")
 		checkDependencyVersion("buildah", "buildah", "--version")
+	} else if builder == "buildpacks" {
+		checkDependency("creator", filepath.Join(build.DefaultLifecycleDir, "creator"))
 	} else {
+		checkDependency("buildkitd", "/usr/local/bin/buildkitd")
+		checkDependency("rootlesskit", "/usr/local/bin/rootlesskit")
 		checkDependency("buildctl", "/usr/local/bin/buildctl")
 		checkDependencyVersion("buildctl", "buildctl", "--version")
 	}
+	if build.DetectChosenBuilder(builder) == "unknown" {
+		// No builder, or not the one selected with --builder
+		allGood = false
+	}
 	checkDependency("git", "/usr/bin/git")
 	checkDependencyVersion("git", "git", "--version")
 	logger.Info("")
@@ -439,80 +495,9 @@ func CheckEnvironmentWithDriver(storageDriver string) int {
 		}
 
 		if needsHelp {
-			// Provide environment-specific guidance
-			switch env {
-			case EnvKubernetes:
-				logger.Info("Kubernetes Configuration Required:")
-				logger.Info("")
-				logger.Info("Some Kubernetes clusters require unconfined seccomp and AppArmor profiles")
-				logger.Info("for user namespace operations to work properly.")
-				logger.Info("")
-				logger.Info("Complete Pod/Job specification:")
-				logger.Info("")
-				logger.Info("---")
-				logger.Info("apiVersion: batch/v1")
-				logger.Info("kind: Job")
-				logger.Info("metadata:")
-				logger.Info("  name: kimia-build")
-				logger.Info("spec:")
-				logger.Info("  template:")
-				logger.Info("    spec:")
-				logger.Info("      restartPolicy: Never")
-				logger.Info("      securityContext:")
-				logger.Info("        runAsUser: 1000")
-				logger.Info("        runAsGroup: 1000")
-				logger.Info("        fsGroup: 1000")
-				logger.Info("        seccompProfile:")
-				logger.Info("          type: Unconfined  # May be required for user namespaces")
-				logger.Info("      containers:")
-				logger.Info("      - name: kimia")
-				logger.Info("        image: ghcr.io/rapidfort/kimia:latest")
-				logger.Info("        securityContext:")
-				logger.Info("          runAsUser: 1000")
-				logger.Info("          runAsGroup: 1000")
-				logger.Info("          allowPrivilegeEscalation: true  # CRITICAL: Required!")
-				logger.Info("          appArmorProfile:")
-				logger.Info("            type: Unconfined  # May be required for user namespaces")
-				logger.Info("          seccompProfile:")
-				logger.Info("            type: Unconfined  # May be required for user namespaces")
-				logger.Info("          capabilities:")
-				logger.Info("            drop: [ALL]")
-
-				if storageDriver == "overlay" {
-					logger.Info("            add: [SETUID, SETGID, MKNOD, DAC_OVERRIDE]")
-				} else {
-					logger.Info("            add: [SETUID, SETGID]")
-				}
-
-			case EnvDocker:
-				logger.Info("Docker Configuration Required:")
-				logger.Info("")
-				logger.Info("Run Kimia with the following Docker options:")
-				logger.Info("")
-				if storageDriver == "overlay" {
-					logger.Info("  docker run --cap-add SETUID --cap-add SETGID --cap-add MKNOD \\")
-					logger.Info("             --user 1000:1000 \\")
-					logger.Info("             ghcr.io/rapidfort/kimia:latest")
-				} else {
-					logger.Info("  docker run --cap-add SETUID --cap-add SETGID \\")
-					logger.Info("             --user 1000:1000 \\")
-					logger.Info("             ghcr.io/rapidfort/kimia:latest")
-				}
-				logger.Info("")
-				logger.Info("If capabilities don't work, try with SETUID binaries:")
-				logger.Info("  docker run --security-opt seccomp=unconfined \\")
-				logger.Info("             --user 1000:1000 \\")
-				logger.Info("             ghcr.io/rapidfort/kimia:latest")
-
-			case EnvStandalone:
-				logger.Info("Standalone/VM Configuration Required:")
-				logger.Info("")
-				logger.Info("Ensure the following are available:")
-				logger.Info("  1. User namespaces enabled in kernel")
-				logger.Info("  2. Subuid/subgid mappings configured in /etc/subuid and /etc/subgid")
-				logger.Info("  3. Either:")
-				logger.Info("     - Run with capabilities (CAP_SETUID, CAP_SETGID)")
-				logger.Info("     - Have newuidmap/newgidmap SETUID binaries available")
+			// Provide platform-specific guidance
+			for _, line := range PlatformRemediation(platform, storageDriver) {
+				logger.Info("%s", line)
 			}
 
 			logger.Info("")
@@ -566,14 +551,20 @@ func CheckEnvironmentWithDriver(storageDriver string) int {
 			}
 
 			logger.Info("Troubleshooting Steps:")
-			if env == EnvKubernetes {
+			if platform == PlatformOpenShift {
+				logger.Info("  1. Apply the SCC and securityContext above")
+				logger.Info("  2. Check which SCC admitted the pod: oc get pod <pod-name> -o jsonpath='{.metadata.annotations.openshift\\.io/scc}'")
+				logger.Info("  3. Describe pod: oc describe pod <pod-name>")
+				logger.Info("  4. View logs: oc logs <pod-name>")
+				logger.Info("  5. Run preflight check: oc exec <pod-name> -- kimia check-environment")
+			} else if platform.IsKubernetes() {
 				logger.Info("  1. Apply the YAML configuration above")
 				logger.Info("  2. Check pod status: kubectl get pod <pod-name>")
 				logger.Info("  3. Describe pod: kubectl describe pod <pod-name>")
 				logger.Info("  4. View logs: kubectl logs <pod-name>")
 				logger.Info("  5. Run preflight check: kubectl exec <pod-name> -- kimia check-environment")
-			} else if env == EnvDocker {
-				logger.Info("  1. Run with the recommended Docker options above")
+			} else if platform == PlatformDocker || platform == PlatformContainerd {
+				logger.Info("  1. Run with the recommended container options above")
 				logger.Info("  2. Check container status: docker ps")
 				logger.Info("  3. View logs: docker logs <container-name>")
 				logger.Info("  4. Run preflight check: docker exec <container-name> kimia check-environment")
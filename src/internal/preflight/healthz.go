@@ -0,0 +1,112 @@
+package preflight
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rapidfort/kimia/internal/build"
+)
+
+// HealthConfig selects the checks of `kimia healthz`
+type HealthConfig struct {
+	Builder    string // buildkit or buildah
+	Remote     bool   // The builder runs elsewhere (--buildkit-addr, --buildah-remote)
+	StorageDir string // Storage directory to check ("" = the builder's default)
+	Daemon     bool   // Also check that buildkitd answers (serve mode)
+
+	// Address and TLS files of the buildkitd checked with Daemon
+	Buildkit build.Config
+}
+
+// HealthCheck is the result of one check; Err is nil when it passed
+type HealthCheck struct {
+	Name string
+	Err  error
+}
+
+// RunHealthChecks runs the cheap checks a liveness or readiness probe can
+// afford every few seconds: the builder binaries, a write to the storage
+// directory, the creation of a user namespace and, in serve mode, a buildkitd
+// request. Unlike CheckEnvironment it prints nothing.
+func RunHealthChecks(config HealthConfig) []HealthCheck {
+	binaries, needsUserNS, err := builderRequirements(config.Builder, config.Remote, os.Getuid())
+	if err != nil {
+		return []HealthCheck{{Name: "builder", Err: err}}
+	}
+
+	var checks []HealthCheck
+	if problems := missingBinaries(binaries); len(problems) > 0 {
+		checks = append(checks, HealthCheck{Name: "builder", Err: fmt.Errorf("%s", strings.Join(problems, "; "))})
+	} else {
+		checks = append(checks, HealthCheck{Name: "builder"})
+	}
+
+	// A remote builder keeps its storage elsewhere
+	if !config.Remote {
+		dir := config.StorageDir
+		if dir == "" {
+			dir = defaultStorageDir(config.Builder)
+		}
+		checks = append(checks, HealthCheck{Name: "storage", Err: checkStorageWritable(dir)})
+	}
+
+	if needsUserNS {
+		var err error
+		if _, err = testUserNamespaceCreation(); err != nil {
+			err = fmt.Errorf("cannot create a user namespace: %v", err)
+		}
+		checks = append(checks, HealthCheck{Name: "userns", Err: err})
+	}
+
+	if config.Daemon {
+		var err error
+		if config.Builder != "buildkit" {
+			err = fmt.Errorf("serve mode needs a buildkitd, not %s", config.Builder)
+		} else {
+			err = build.CheckBuildkitd(config.Buildkit)
+		}
+		checks = append(checks, HealthCheck{Name: "daemon", Err: err})
+	}
+	return checks
+}
+
+// defaultStorageDir returns where builder keeps its images and layers: the
+// containers storage graphroot for Buildah, the buildkitd root for BuildKit
+func defaultStorageDir(builder string) string {
+	if os.Getuid() == 0 {
+		if builder == "buildah" {
+			return "/var/lib/containers/storage"
+		}
+		return "/var/lib/buildkit"
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+	if builder == "buildah" {
+		return filepath.Join(dataHome, "containers", "storage")
+	}
+	return filepath.Join(dataHome, "buildkit")
+}
+
+// checkStorageWritable checks that files can be created in dir, or in its
+// closest existing parent when the first build has not created it yet
+func checkStorageWritable(dir string) error {
+	probe := filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(probe); err == nil {
+			break
+		}
+		parent := filepath.Dir(probe)
+		if parent == probe {
+			return fmt.Errorf("%s does not exist", dir)
+		}
+		probe = parent
+	}
+	if !isWritableDir(probe) {
+		return fmt.Errorf("%s is not writable", probe)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Default image layout for the kimia user (see Dockerfile.buildah / Dockerfile.buildkit)
+const (
+	defaultKimiaHome = "/home/kimia"
+	defaultKimiaUID  = 1000
+
+	// arbitraryUIDThreshold is the lowest UID OpenShift hands out from a
+	// namespace's openshift.io/sa.scc.uid-range annotation (e.g. 1000650000/10000)
+	arbitraryUIDThreshold = 100000
+
+	// Subordinate ID range written for arbitrary UIDs (matches the image default)
+	arbitrarySubIDStart = 100000
+	arbitrarySubIDCount = 65536
+)
+
+// ArbitraryUIDCheck holds the result of arbitrary UID detection
+// OpenShift's restricted-v2 SCC runs containers with a random UID from the
+// namespace range and GID 0, which has no /etc/passwd or /etc/subuid entry.
+type ArbitraryUIDCheck struct {
+	UID              int
+	GID              int
+	IsArbitrary      bool
+	HasPasswdEntry   bool
+	SubuidConfigured bool
+	SubgidConfigured bool
+	Home             string
+	HomeWritable     bool
+	SCC              string // SCC name from the downward API, if mounted
+	OpenShift        bool   // SCC annotation present or UID from an OpenShift range
+}
+
+// CheckArbitraryUID detects whether Kimia is running with an arbitrary (non-image) UID
+func CheckArbitraryUID() *ArbitraryUIDCheck {
+	result := &ArbitraryUIDCheck{
+		UID:  os.Getuid(),
+		GID:  os.Getgid(),
+		Home: os.Getenv("HOME"),
+	}
+
+	result.HasPasswdEntry = hasIDFileEntry("/etc/passwd", result.UID, 2)
+	_, err := checkSubIDFile("/etc/subuid", lookupUsername(result.UID), result.UID)
+	result.SubuidConfigured = err == nil
+	_, err = checkSubIDFile("/etc/subgid", lookupUsername(result.UID), result.UID)
+	result.SubgidConfigured = err == nil
+	result.HomeWritable = result.Home != "" && result.Home != "/" && isWritableDir(result.Home)
+	result.SCC = podAnnotation("openshift.io/scc")
+	result.OpenShift = result.SCC != "" || result.UID >= arbitraryUIDThreshold
+
+	// Arbitrary UID: not the image UID, and either from an OpenShift range,
+	// running with the root group, or unknown to /etc/passwd
+	if result.UID != 0 && result.UID != defaultKimiaUID {
+		result.IsArbitrary = result.UID >= arbitraryUIDThreshold ||
+			(result.GID == 0 && !result.HasPasswdEntry)
+	}
+
+	logger.Debug("Arbitrary UID check: UID=%d GID=%d arbitrary=%v openshift=%v passwd=%v subuid=%v subgid=%v home=%s writable=%v scc=%s",
+		result.UID, result.GID, result.IsArbitrary, result.OpenShift, result.HasPasswdEntry,
+		result.SubuidConfigured, result.SubgidConfigured, result.Home, result.HomeWritable, result.SCC)
+
+	return result
+}
+
+// PrepareArbitraryUID adjusts the process environment so builds work under an
+// arbitrary UID: it relocates HOME/XDG_RUNTIME_DIR to writable locations,
+// points buildah storage at the new HOME and, under OpenShift, registers
+// passwd/subuid/subgid entries when the image made those files writable for
+// GID 0. It is a no-op when running with the image's own UID, and is only
+// called before builds.
+func PrepareArbitraryUID() error {
+	check := CheckArbitraryUID()
+	if !check.IsArbitrary {
+		return nil
+	}
+
+	logger.Debug("Arbitrary UID %d (GID %d) detected - enabling OpenShift compatibility mode", check.UID, check.GID)
+
+	// 1. HOME must be writable (OpenShift often sets HOME=/)
+	home := check.Home
+	if !check.HomeWritable {
+		home = defaultKimiaHome
+		if !isWritableDir(home) {
+			home = filepath.Join(os.TempDir(), fmt.Sprintf("kimia-%d", check.UID))
+			if err := os.MkdirAll(home, 0700); err != nil {
+				return fmt.Errorf("failed to create HOME for arbitrary UID: %v", err)
+			}
+		}
+		if err := os.Setenv("HOME", home); err != nil {
+			return fmt.Errorf("failed to set HOME: %v", err)
+		}
+		logger.Debug("Using HOME=%s", home)
+	}
+
+	// 2. XDG_RUNTIME_DIR from the image (/run/user/1000) belongs to UID 1000
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" || !isWritableDir(runtimeDir) {
+		runtimeDir = filepath.Join(os.TempDir(), fmt.Sprintf("run-%d", check.UID))
+		if err := os.MkdirAll(runtimeDir, 0700); err != nil {
+			return fmt.Errorf("failed to create XDG_RUNTIME_DIR for arbitrary UID: %v", err)
+		}
+		if err := os.Setenv("XDG_RUNTIME_DIR", runtimeDir); err != nil {
+			return fmt.Errorf("failed to set XDG_RUNTIME_DIR: %v", err)
+		}
+		logger.Debug("Using XDG_RUNTIME_DIR=%s", runtimeDir)
+	}
+
+	// 3. Keep a mounted Docker config if present, otherwise use the new HOME
+	dockerConfig := os.Getenv("DOCKER_CONFIG")
+	if dockerConfig == "" || (!fileExists(filepath.Join(dockerConfig, "config.json")) && !isWritableDir(dockerConfig)) {
+		dockerConfig = filepath.Join(home, ".docker")
+		// #nosec G301 -- 0700 for Docker config directory (contains credentials)
+		if err := os.MkdirAll(dockerConfig, 0700); err != nil {
+			return fmt.Errorf("failed to create Docker config directory: %v", err)
+		}
+		if err := os.Setenv("DOCKER_CONFIG", dockerConfig); err != nil {
+			return fmt.Errorf("failed to set DOCKER_CONFIG: %v", err)
+		}
+		logger.Debug("Using DOCKER_CONFIG=%s", dockerConfig)
+	}
+
+	// 4. Buildah storage.conf in the image hardcodes /home/kimia paths
+	if home != defaultKimiaHome {
+		if err := writeArbitraryUIDStorageConf(home, runtimeDir); err != nil {
+			logger.Warning("Failed to write storage.conf for arbitrary UID: %v", err)
+		}
+	}
+
+	// 5. Register the UID so newuidmap/newgidmap and getpwuid() resolve it.
+	// The entry reuses the "kimia" name so the image's name-keyed subuid range also matches.
+	// Elsewhere a UID without entries is the host's business, not kimia's.
+	if !check.OpenShift {
+		return nil
+	}
+	if !check.HasPasswdEntry && isWritableFile("/etc/passwd") {
+		entry := fmt.Sprintf("kimia:x:%d:%d:Kimia (arbitrary UID):%s:/sbin/nologin", check.UID, check.GID, home)
+		if err := appendIDFileEntry("/etc/passwd", entry); err != nil {
+			logger.Warning("Cannot add /etc/passwd entry for UID %d: %v", check.UID, err)
+		} else {
+			logger.Debug("Added /etc/passwd entry for UID %d", check.UID)
+		}
+	}
+
+	subIDEntry := fmt.Sprintf("%d:%d:%d", check.UID, arbitrarySubIDStart, arbitrarySubIDCount)
+	if !check.SubuidConfigured && isWritableFile("/etc/subuid") {
+		if err := appendIDFileEntry("/etc/subuid", subIDEntry); err != nil {
+			logger.Warning("Cannot add /etc/subuid entry for UID %d: %v", check.UID, err)
+		} else {
+			logger.Debug("Added /etc/subuid entry: %s", subIDEntry)
+		}
+	}
+	if !check.SubgidConfigured && isWritableFile("/etc/subgid") {
+		if err := appendIDFileEntry("/etc/subgid", subIDEntry); err != nil {
+			logger.Warning("Cannot add /etc/subgid entry for UID %d: %v", check.UID, err)
+		} else {
+			logger.Debug("Added /etc/subgid entry: %s", subIDEntry)
+		}
+	}
+
+	return nil
+}
+
+// validateOpenShiftSCC checks the SCC the pod was admitted under.
+// restricted-v2 drops all capabilities and sets allowPrivilegeEscalation: false,
+// which leaves no way to create user namespaces.
+func validateOpenShiftSCC(result *ValidationResult) ValidationStatus {
+	check := CheckArbitraryUID()
+	result.ArbitraryUID = check
+
+	hasCapabilities := result.Capabilities != nil && result.Capabilities.HasRequiredCapabilities()
+	restricted := check.SCC == "restricted" || check.SCC == "restricted-v2" ||
+		(check.SCC == "" && !hasCapabilities && !CanSetuidBinariesWork())
+
+	if restricted {
+		scc := check.SCC
+		if scc == "" {
+			scc = "restricted-v2 (inferred: no capabilities, privilege escalation blocked)"
+		}
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Pod is running under the %s SCC", scc),
+			"restricted-v2 drops SETUID/SETGID and forbids privilege escalation,",
+			"so Kimia cannot create the user namespace it builds in.",
+			"")
+		result.Errors = append(result.Errors, PlatformRemediation(PlatformOpenShift, result.StorageDriver)...)
+		return StatusError
+	}
+
+	if check.IsArbitrary {
+		if !check.SubuidConfigured || !check.SubgidConfigured {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("Arbitrary UID %d has no /etc/subuid or /etc/subgid entry", check.UID),
+				"Kimia adds one before a build under OpenShift if the files are writable for GID 0")
+			return StatusWarning
+		}
+	}
+
+	return StatusSuccess
+}
+
+// lookupUsername resolves a UID to a username via /etc/passwd, falling back to $USER
+func lookupUsername(uid int) string {
+	if name := idFileField("/etc/passwd", uid, 2, 0); name != "" {
+		return name
+	}
+	if user := os.Getenv("USER"); user != "" {
+		return user
+	}
+	return strconv.Itoa(uid)
+}
+
+// hasIDFileEntry reports whether a colon-separated file has a line whose
+// field at uidField equals uid
+func hasIDFileEntry(filename string, uid int, uidField int) bool {
+	return idFileField(filename, uid, uidField, uidField) != ""
+}
+
+// idFileField returns field `want` of the first line whose field at uidField equals uid
+func idFileField(filename string, uid int, uidField int, want int) string {
+	// #nosec G304 -- only called with fixed system paths (/etc/passwd)
+	file, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	target := strconv.Itoa(uid)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ":")
+		if len(parts) > uidField && len(parts) > want && parts[uidField] == target {
+			return parts[want]
+		}
+	}
+	return ""
+}
+
+// appendIDFileEntry appends a line to /etc/passwd, /etc/subuid or /etc/subgid
+func appendIDFileEntry(filename, entry string) error {
+	switch filename {
+	case "/etc/passwd", "/etc/subuid", "/etc/subgid":
+	default:
+		return fmt.Errorf("unexpected file: %s", filename)
+	}
+
+	// #nosec G302,G304 -- filename restricted to fixed system files above; mode unchanged for existing file
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(entry + "\n")
+	return err
+}
+
+// writeArbitraryUIDStorageConf writes a buildah storage.conf rooted in the relocated HOME
+func writeArbitraryUIDStorageConf(home, runtimeDir string) error {
+	configDir := filepath.Join(home, ".config", "containers")
+	// #nosec G301 -- 0755 for config directory (contains TOML, not credentials)
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		return err
+	}
+
+	confPath := filepath.Join(configDir, "storage.conf")
+	if fileExists(confPath) {
+		return nil
+	}
+
+	driver := os.Getenv("STORAGE_DRIVER")
+	if driver == "" {
+		driver = "vfs"
+	}
+
+	content := fmt.Sprintf(`# Generated by Kimia for arbitrary UID builds
+[storage]
+driver = "%s"
+runroot = "%s"
+graphroot = "%s"
+
+[storage.options]
+vfs.ignore_chown_errors = "true"
+`, driver, filepath.Join(runtimeDir, "containers"), filepath.Join(home, ".local", "share", "containers", "storage"))
+
+	// #nosec G306 -- storage.conf is configuration, not credentials
+	return os.WriteFile(confPath, []byte(content), 0644)
+}
+
+// isWritableDir reports whether dir exists and the current user can create files in it
+func isWritableDir(dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	probe, err := os.CreateTemp(dir, ".kimia-write-test-*")
+	if err != nil {
+		return false
+	}
+	name := probe.Name()
+	probe.Close()
+	// #nosec G104 -- best-effort removal of probe file
+	os.Remove(name)
+	return true
+}
+
+// isWritableFile reports whether the current user may write to an existing file
+func isWritableFile(path string) bool {
+	return syscall.Access(path, 2) == nil // W_OK
+}
+
+// podAnnotation returns the value of a downward API annotation, if mounted
+func podAnnotation(key string) string {
+	data, err := os.ReadFile(podInfoAnnotationsPath)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == key {
+			return strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	return ""
+}
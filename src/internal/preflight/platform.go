@@ -0,0 +1,379 @@
+package preflight
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Platform represents the detected hosting platform
+// This is more specific than Environment: it is used to tailor remediation
+// hints (e.g. the exact securityContext or SCC) to where Kimia is running.
+type Platform int
+
+const (
+	PlatformStandalone Platform = iota
+	PlatformDocker
+	PlatformContainerd
+	PlatformKubernetes
+	PlatformEKS
+	PlatformGKE
+	PlatformGKEAutopilot
+	PlatformOpenShift
+)
+
+func (p Platform) String() string {
+	switch p {
+	case PlatformStandalone:
+		return "Standalone"
+	case PlatformDocker:
+		return "Docker"
+	case PlatformContainerd:
+		return "containerd"
+	case PlatformKubernetes:
+		return "Kubernetes"
+	case PlatformEKS:
+		return "Amazon EKS"
+	case PlatformGKE:
+		return "Google GKE"
+	case PlatformGKEAutopilot:
+		return "Google GKE Autopilot"
+	case PlatformOpenShift:
+		return "Red Hat OpenShift"
+	default:
+		return "Unknown"
+	}
+}
+
+// Paths used for platform detection (downward API mounts and service account files)
+const (
+	podInfoLabelsPath      = "/etc/podinfo/labels"
+	podInfoAnnotationsPath = "/etc/podinfo/annotations"
+	serviceCAPath          = "/var/run/secrets/kubernetes.io/serviceaccount/service-ca.crt"
+)
+
+// DetectPlatform determines the hosting platform using environment variables,
+// downward API files and cgroup/kernel hints.
+// KIMIA_PLATFORM can be set to override detection (openshift, eks, gke,
+// gke-autopilot, kubernetes, docker, containerd, standalone).
+func DetectPlatform() Platform {
+	if override := strings.ToLower(strings.TrimSpace(os.Getenv("KIMIA_PLATFORM"))); override != "" {
+		if p, ok := parsePlatform(override); ok {
+			logger.Debug("Platform overridden by KIMIA_PLATFORM: %s", p)
+			return p
+		}
+		logger.Warning("Ignoring unknown KIMIA_PLATFORM value: %s", override)
+	}
+
+	env := DetectEnvironment()
+	if env == EnvKubernetes {
+		podInfo := readPodInfo()
+
+		// OpenShift: injected service CA bundle, SCC annotation, or OpenShift build env
+		if fileExists(serviceCAPath) ||
+			strings.Contains(podInfo, "openshift.io/scc") ||
+			os.Getenv("OPENSHIFT_BUILD_NAME") != "" {
+			return PlatformOpenShift
+		}
+
+		// GKE Autopilot: Autopilot annotates every pod it admits
+		if strings.Contains(podInfo, "autopilot.gke.io") {
+			return PlatformGKEAutopilot
+		}
+
+		// EKS: IRSA / Pod Identity credentials, or an Amazon Linux / Bottlerocket kernel
+		kernel := readKernelRelease()
+		if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" ||
+			os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" ||
+			strings.Contains(podInfo, "eks.amazonaws.com") ||
+			strings.Contains(kernel, "amzn") {
+			return PlatformEKS
+		}
+
+		// GKE: Container-Optimized OS kernel or GKE node labels
+		if strings.Contains(podInfo, "cloud.google.com/gke") ||
+			strings.Contains(readProcVersion(), "Chromium OS") {
+			return PlatformGKE
+		}
+
+		return PlatformKubernetes
+	}
+
+	if env == EnvDocker {
+		// DetectEnvironment treats containerd as Docker; split them here
+		if data, err := os.ReadFile("/proc/1/cgroup"); err == nil {
+			content := string(data)
+			if !strings.Contains(content, "docker") && strings.Contains(content, "containerd") {
+				return PlatformContainerd
+			}
+		}
+		return PlatformDocker
+	}
+
+	return PlatformStandalone
+}
+
+// IsKubernetes reports whether the platform is a Kubernetes distribution
+func (p Platform) IsKubernetes() bool {
+	switch p {
+	case PlatformKubernetes, PlatformEKS, PlatformGKE, PlatformGKEAutopilot, PlatformOpenShift:
+		return true
+	default:
+		return false
+	}
+}
+
+// parsePlatform maps a KIMIA_PLATFORM value to a Platform
+func parsePlatform(name string) (Platform, bool) {
+	switch name {
+	case "standalone":
+		return PlatformStandalone, true
+	case "docker":
+		return PlatformDocker, true
+	case "containerd", "nerdctl":
+		return PlatformContainerd, true
+	case "kubernetes", "k8s":
+		return PlatformKubernetes, true
+	case "eks":
+		return PlatformEKS, true
+	case "gke":
+		return PlatformGKE, true
+	case "gke-autopilot", "autopilot":
+		return PlatformGKEAutopilot, true
+	case "openshift", "ocp":
+		return PlatformOpenShift, true
+	default:
+		return PlatformStandalone, false
+	}
+}
+
+// readPodInfo returns the concatenated downward API labels and annotations, if mounted
+func readPodInfo() string {
+	var sb strings.Builder
+	for _, path := range []string{podInfoLabelsPath, podInfoAnnotationsPath} {
+		if data, err := os.ReadFile(path); err == nil {
+			sb.Write(data)
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// readKernelRelease returns the running kernel release string
+func readKernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readProcVersion returns the contents of /proc/version
+func readProcVersion() string {
+	data, err := os.ReadFile("/proc/version")
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// fileExists reports whether a path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// PlatformRemediation returns platform-specific configuration snippets
+// that grant Kimia what it needs for rootless builds
+func PlatformRemediation(platform Platform, storageDriver string) []string {
+	capsList := capabilityList(RequiredCapabilities(storageDriver))
+
+	switch platform {
+	case PlatformOpenShift:
+		return []string{
+			"OpenShift Configuration Required:",
+			"",
+			"The default restricted-v2 SCC drops all capabilities and forbids",
+			"privilege escalation. Create a dedicated SCC for Kimia builds:",
+			"",
+			"---",
+			"apiVersion: security.openshift.io/v1",
+			"kind: SecurityContextConstraints",
+			"metadata:",
+			"  name: kimia-builder",
+			"allowPrivilegeEscalation: true",
+			"allowPrivilegedContainer: false",
+			"allowedCapabilities: " + capsList,
+			"requiredDropCapabilities: [KILL]",
+			"runAsUser:",
+			"  type: MustRunAsRange",
+			"seLinuxContext:",
+			"  type: MustRunAs",
+			"fsGroup:",
+			"  type: MustRunAs",
+			"supplementalGroups:",
+			"  type: RunAsAny",
+			"seccompProfiles: [runtime/default, unconfined]",
+			"volumes: [configMap, downwardAPI, emptyDir, projected, secret, persistentVolumeClaim]",
+			"",
+			"Grant it to the build service account:",
+			"  oc adm policy add-scc-to-user kimia-builder -z <service-account>",
+			"",
+			"Container securityContext:",
+			"  securityContext:",
+			"    allowPrivilegeEscalation: true",
+			"    capabilities:",
+			"      drop: [ALL]",
+			"      add: " + capsList,
+		}
+
+	case PlatformEKS:
+		return []string{
+			"Amazon EKS Configuration Required:",
+			"",
+			"Container securityContext:",
+			"  securityContext:",
+			"    runAsUser: 1000",
+			"    runAsGroup: 1000",
+			"    allowPrivilegeEscalation: true",
+			"    capabilities:",
+			"      drop: [ALL]",
+			"      add: " + capsList,
+			"",
+			"User namespaces are enabled on Amazon Linux 2023 nodes.",
+			"On Bottlerocket nodes, enable them in the node user data:",
+			"  [settings.kernel.sysctl]",
+			"  \"user.max_user_namespaces\" = \"15000\"",
+		}
+
+	case PlatformGKEAutopilot:
+		return []string{
+			"GKE Autopilot Configuration Required:",
+			"",
+			"Autopilot rejects Unconfined seccomp profiles; keep RuntimeDefault",
+			"and request only the capabilities Kimia needs:",
+			"",
+			"  securityContext:",
+			"    runAsUser: 1000",
+			"    runAsGroup: 1000",
+			"    allowPrivilegeEscalation: true",
+			"    seccompProfile:",
+			"      type: RuntimeDefault",
+			"    capabilities:",
+			"      drop: [ALL]",
+			"      add: [SETUID, SETGID]",
+			"",
+			"Note: overlay storage needs MKNOD, which Autopilot does not allow.",
+			"      Use the default native/vfs storage driver on Autopilot.",
+		}
+
+	case PlatformGKE:
+		return []string{
+			"Google GKE Configuration Required:",
+			"",
+			"Container securityContext:",
+			"  securityContext:",
+			"    runAsUser: 1000",
+			"    runAsGroup: 1000",
+			"    allowPrivilegeEscalation: true",
+			"    appArmorProfile:",
+			"      type: Unconfined  # Container-Optimized OS confines unshare",
+			"    capabilities:",
+			"      drop: [ALL]",
+			"      add: " + capsList,
+		}
+
+	case PlatformKubernetes:
+		return []string{
+			"Kubernetes Configuration Required:",
+			"",
+			"Some Kubernetes clusters require unconfined seccomp and AppArmor profiles",
+			"for user namespace operations to work properly.",
+			"",
+			"Complete Pod/Job specification:",
+			"",
+			"---",
+			"apiVersion: batch/v1",
+			"kind: Job",
+			"metadata:",
+			"  name: kimia-build",
+			"spec:",
+			"  template:",
+			"    spec:",
+			"      restartPolicy: Never",
+			"      securityContext:",
+			"        runAsUser: 1000",
+			"        runAsGroup: 1000",
+			"        fsGroup: 1000",
+			"        seccompProfile:",
+			"          type: Unconfined  # May be required for user namespaces",
+			"      containers:",
+			"      - name: kimia",
+			"        image: ghcr.io/rapidfort/kimia:latest",
+			"        securityContext:",
+			"          runAsUser: 1000",
+			"          runAsGroup: 1000",
+			"          allowPrivilegeEscalation: true  # CRITICAL: Required!",
+			"          appArmorProfile:",
+			"            type: Unconfined  # May be required for user namespaces",
+			"          seccompProfile:",
+			"            type: Unconfined  # May be required for user namespaces",
+			"          capabilities:",
+			"            drop: [ALL]",
+			"            add: " + capsList,
+		}
+
+	case PlatformDocker:
+		capFlags := "--cap-add SETUID --cap-add SETGID"
+		if storageDriver == "overlay" {
+			capFlags += " --cap-add MKNOD"
+		}
+		return []string{
+			"Docker Configuration Required:",
+			"",
+			"Run Kimia with the following Docker options:",
+			"",
+			"  docker run " + capFlags + " \\",
+			"             --user 1000:1000 \\",
+			"             ghcr.io/rapidfort/kimia:latest",
+			"",
+			"If capabilities don't work, try with SETUID binaries:",
+			"  docker run --security-opt seccomp=unconfined \\",
+			"             --user 1000:1000 \\",
+			"             ghcr.io/rapidfort/kimia:latest",
+		}
+
+	case PlatformContainerd:
+		capFlags := "--cap-add SETUID --cap-add SETGID"
+		if storageDriver == "overlay" {
+			capFlags += " --cap-add MKNOD"
+		}
+		return []string{
+			"containerd Configuration Required:",
+			"",
+			"Run Kimia with the following nerdctl options:",
+			"",
+			"  nerdctl run " + capFlags + " \\",
+			"              --user 1000:1000 \\",
+			"              ghcr.io/rapidfort/kimia:latest",
+			"",
+			"If capabilities don't work, try with SETUID binaries:",
+			"  nerdctl run --security-opt seccomp=unconfined \\",
+			"              --user 1000:1000 \\",
+			"              ghcr.io/rapidfort/kimia:latest",
+		}
+
+	default:
+		return []string{
+			"Standalone/VM Configuration Required:",
+			"",
+			"Ensure the following are available:",
+			"  1. User namespaces enabled in kernel",
+			"  2. Subuid/subgid mappings configured in /etc/subuid and /etc/subgid",
+			"  3. Either:",
+			"     - Run with capabilities (CAP_SETUID, CAP_SETGID)",
+			"     - Have newuidmap/newgidmap SETUID binaries available",
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package preflight
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BuildUID is the user of the Kimia images, which the pods running them
+// should keep
+const BuildUID = 1000
+
+// PodSecurity is the container securityContext a build needs, as checked by
+// the preflight checks before it runs
+type PodSecurity struct {
+	RunAsUser                int64
+	AllowPrivilegeEscalation bool     // newuidmap and newgidmap are setuid binaries
+	Capabilities             []string // Added to an empty set (drop: [ALL]), without the CAP_ prefix
+	UserNamespaces           bool     // The builder creates user namespaces, which seccomp or AppArmor may block
+}
+
+// RequiredCapabilities returns the capabilities a rootless build needs with
+// the storage driver, without the CAP_ prefix
+func RequiredCapabilities(storageDriver string) []string {
+	if storageDriver == "overlay" {
+		return []string{"SETUID", "SETGID", "MKNOD", "DAC_OVERRIDE"}
+	}
+	return []string{"SETUID", "SETGID"}
+}
+
+// capabilityList formats capabilities as a YAML flow sequence
+func capabilityList(caps []string) string {
+	return "[" + strings.Join(caps, ", ") + "]"
+}
+
+// BuildPodSecurity returns the securityContext of a pod running builder as
+// BuildUID. Builders that create user namespaces need the capabilities of
+// RequiredCapabilities and privilege escalation; a remote builder or the
+// buildpacks lifecycle needs neither. capAdd are the capabilities given to
+// privileged RUN steps, which must be in the container's bounding set too.
+func BuildPodSecurity(builder string, remote bool, storageDriver string, capAdd []string) (PodSecurity, error) {
+	_, needsUserNS, err := builderRequirements(builder, remote, BuildUID)
+	if err != nil {
+		return PodSecurity{}, err
+	}
+	security := PodSecurity{RunAsUser: BuildUID, UserNamespaces: needsUserNS}
+	if needsUserNS {
+		security.AllowPrivilegeEscalation = true
+		security.Capabilities = RequiredCapabilities(storageDriver)
+	}
+	for _, name := range capAdd {
+		name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+		if _, ok := linuxCapabilities["CAP_"+name]; !ok {
+			return PodSecurity{}, fmt.Errorf("--cap-add: unknown capability CAP_%s", name)
+		}
+		if !containsCapability(security.Capabilities, name) {
+			security.Capabilities = append(security.Capabilities, name)
+		}
+	}
+	return security, nil
+}
+
+// containsCapability reports whether caps holds name
+func containsCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
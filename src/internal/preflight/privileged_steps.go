@@ -0,0 +1,90 @@
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// linuxCapabilities maps capability names to their bit (linux/capability.h)
+var linuxCapabilities = map[string]uint{
+	"CAP_CHOWN": 0, "CAP_DAC_OVERRIDE": 1, "CAP_DAC_READ_SEARCH": 2, "CAP_FOWNER": 3,
+	"CAP_FSETID": 4, "CAP_KILL": 5, "CAP_SETGID": 6, "CAP_SETUID": 7,
+	"CAP_SETPCAP": 8, "CAP_LINUX_IMMUTABLE": 9, "CAP_NET_BIND_SERVICE": 10, "CAP_NET_BROADCAST": 11,
+	"CAP_NET_ADMIN": 12, "CAP_NET_RAW": 13, "CAP_IPC_LOCK": 14, "CAP_IPC_OWNER": 15,
+	"CAP_SYS_MODULE": 16, "CAP_SYS_RAWIO": 17, "CAP_SYS_CHROOT": 18, "CAP_SYS_PTRACE": 19,
+	"CAP_SYS_PACCT": 20, "CAP_SYS_ADMIN": 21, "CAP_SYS_BOOT": 22, "CAP_SYS_NICE": 23,
+	"CAP_SYS_RESOURCE": 24, "CAP_SYS_TIME": 25, "CAP_SYS_TTY_CONFIG": 26, "CAP_MKNOD": 27,
+	"CAP_LEASE": 28, "CAP_AUDIT_WRITE": 29, "CAP_AUDIT_CONTROL": 30, "CAP_SETFCAP": 31,
+	"CAP_MAC_OVERRIDE": 32, "CAP_MAC_ADMIN": 33, "CAP_SYSLOG": 34, "CAP_WAKE_ALARM": 35,
+	"CAP_BLOCK_SUSPEND": 36, "CAP_AUDIT_READ": 37, "CAP_PERFMON": 38, "CAP_BPF": 39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// CheckPrivilegedSteps checks the --device and --cap-add values of privileged
+// RUN steps before the build: every device must be a device node the build
+// user can open, and every capability a known name. Capabilities missing
+// from Kimia's own bounding set cannot be passed on and are reported as a
+// warning. It returns the capabilities with the CAP_ prefix.
+func CheckPrivilegedSteps(devices, capAdd []string) ([]string, error) {
+	for _, device := range devices {
+		path := strings.SplitN(device, ":", 2)[0]
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("--device %s: %v (is it mounted into the pod?)", device, err)
+		}
+		if info.Mode()&os.ModeDevice == 0 {
+			return nil, fmt.Errorf("--device %s: %s is not a device node", device, path)
+		}
+		if err := syscall.Access(path, 0x6); err != nil { // R_OK|W_OK
+			return nil, fmt.Errorf("--device %s: not readable and writable by UID %d: %v", device, os.Getuid(), err)
+		}
+	}
+
+	bounding, err := readCapabilitySet("CapBnd")
+	if err != nil {
+		logger.Debug("Cannot read the capability bounding set: %v", err)
+	}
+	caps := make([]string, 0, len(capAdd))
+	for _, name := range capAdd {
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		bit, ok := linuxCapabilities[name]
+		if !ok {
+			return nil, fmt.Errorf("--cap-add: unknown capability %s", name)
+		}
+		if err == nil && bounding&(1<<bit) == 0 {
+			logger.Warning("%s is not in Kimia's capability bounding set; add it to the container's securityContext.capabilities", name)
+		}
+		caps = append(caps, name)
+	}
+	return caps, nil
+}
+
+// readCapabilitySet returns a capability set (CapEff, CapBnd, ...) of this
+// process from /proc/self/status
+func readCapabilitySet(field string) (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), field+":"); ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s not found in /proc/self/status", field)
+}
@@ -0,0 +1,193 @@
+package preflight
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// Seccomp modes as reported in the Seccomp field of /proc/self/status
+const (
+	SeccompDisabled = "disabled"
+	SeccompStrict   = "strict"
+	SeccompFilter   = "filter"
+	SeccompUnknown  = "unknown"
+)
+
+// Causes for a blocked user namespace clone
+const (
+	BlockedBySeccomp  = "seccomp"
+	BlockedByAppArmor = "apparmor"
+	BlockedByLimit    = "max_user_namespaces"
+	BlockedByKernel   = "kernel"
+	BlockedByUnknown  = "unknown"
+)
+
+// SecurityProfileCheck holds the result of seccomp/AppArmor detection
+type SecurityProfileCheck struct {
+	SeccompMode             string // disabled, strict, filter or unknown
+	SeccompFilters          int    // number of attached filters (kernel 5.9+)
+	NoNewPrivs              bool
+	AppArmorEnabled         bool
+	AppArmorProfile         string // e.g. "unconfined" or "cri-containerd.apparmor.d (enforce)"
+	AppArmorRestrictsUserNS bool   // Ubuntu 23.10+ kernel.apparmor_restrict_unprivileged_userns
+	UnshareTested           bool
+	UnshareBlocked          bool
+	UnshareError            string
+	BlockedBy               string
+}
+
+// CheckSecurityProfiles detects the active seccomp and AppArmor confinement
+// and tests whether clone(CLONE_NEWUSER) is permitted
+func CheckSecurityProfiles() *SecurityProfileCheck {
+	logger.Debug("Checking seccomp and AppArmor profiles")
+
+	result := &SecurityProfileCheck{}
+
+	switch readProcStatusField("Seccomp") {
+	case "0":
+		result.SeccompMode = SeccompDisabled
+	case "1":
+		result.SeccompMode = SeccompStrict
+	case "2":
+		result.SeccompMode = SeccompFilter
+	default:
+		result.SeccompMode = SeccompUnknown
+	}
+	if n, err := strconv.Atoi(readProcStatusField("Seccomp_filters")); err == nil {
+		result.SeccompFilters = n
+	}
+	result.NoNewPrivs = readProcStatusField("NoNewPrivs") == "1"
+
+	result.AppArmorEnabled = readTrimmedFile("/sys/module/apparmor/parameters/enabled") == "Y"
+	if result.AppArmorEnabled {
+		// Newer kernels expose the LSM-specific attribute; fall back to the shared one
+		profile := readTrimmedFile("/proc/self/attr/apparmor/current")
+		if profile == "" {
+			profile = readTrimmedFile("/proc/self/attr/current")
+		}
+		result.AppArmorProfile = profile
+		result.AppArmorRestrictsUserNS = readTrimmedFile("/proc/sys/kernel/apparmor_restrict_unprivileged_userns") == "1"
+	}
+
+	logger.Debug("Seccomp: %s (filters: %d), NoNewPrivs: %v", result.SeccompMode, result.SeccompFilters, result.NoNewPrivs)
+	logger.Debug("AppArmor: enabled=%v profile=%q restrictUserNS=%v",
+		result.AppArmorEnabled, result.AppArmorProfile, result.AppArmorRestrictsUserNS)
+
+	result.testUserNamespaceClone()
+	return result
+}
+
+// IsAppArmorConfined reports whether the process runs under an AppArmor profile
+func (s *SecurityProfileCheck) IsAppArmorConfined() bool {
+	return s.AppArmorEnabled && s.AppArmorProfile != "" && s.AppArmorProfile != "unconfined"
+}
+
+// testUserNamespaceClone spawns a child with CLONE_NEWUSER and classifies any failure
+func (s *SecurityProfileCheck) testUserNamespaceClone() {
+	truePath, err := exec.LookPath("true")
+	if err != nil {
+		logger.Debug("Skipping clone(CLONE_NEWUSER) test: %v", err)
+		return
+	}
+
+	cmd := exec.Command(truePath)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER}
+	s.UnshareTested = true
+
+	err = cmd.Run()
+	if err == nil {
+		logger.Debug("clone(CLONE_NEWUSER) permitted")
+		return
+	}
+
+	s.UnshareBlocked = true
+	s.UnshareError = err.Error()
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		s.BlockedBy = BlockedByUnknown
+		return
+	}
+
+	switch errno {
+	case syscall.ENOSPC:
+		s.BlockedBy = BlockedByLimit
+	case syscall.EINVAL, syscall.ENOSYS:
+		s.BlockedBy = BlockedByKernel
+	case syscall.EACCES:
+		s.BlockedBy = BlockedByAppArmor
+	case syscall.EPERM:
+		// Docker/containerd default seccomp profiles deny CLONE_NEWUSER without CAP_SYS_ADMIN
+		if s.SeccompMode == SeccompFilter {
+			s.BlockedBy = BlockedBySeccomp
+		} else if s.IsAppArmorConfined() || s.AppArmorRestrictsUserNS {
+			s.BlockedBy = BlockedByAppArmor
+		} else {
+			s.BlockedBy = BlockedByUnknown
+		}
+	default:
+		s.BlockedBy = BlockedByUnknown
+	}
+	logger.Debug("clone(CLONE_NEWUSER) blocked (%s): %v", s.BlockedBy, err)
+}
+
+// GetIssues returns targeted explanations and fixes for a blocked user namespace clone
+func (s *SecurityProfileCheck) GetIssues(platform Platform) []string {
+	if !s.UnshareBlocked {
+		return nil
+	}
+
+	issues := []string{"clone(CLONE_NEWUSER) is blocked: " + s.UnshareError}
+
+	switch s.BlockedBy {
+	case BlockedBySeccomp:
+		issues = append(issues,
+			"The active seccomp profile denies user namespace creation",
+			"(the runtime default profile blocks unshare/clone without CAP_SYS_ADMIN)")
+		if platform.IsKubernetes() {
+			issues = append(issues,
+				"Fix: set seccompProfile.type: Unconfined in the container securityContext,",
+				"     or a Localhost profile that allows unshare and clone")
+		} else {
+			issues = append(issues, "Fix: run with --security-opt seccomp=unconfined")
+		}
+	case BlockedByAppArmor:
+		issues = append(issues, "AppArmor denies user namespace creation (profile: "+s.AppArmorProfile+")")
+		if s.AppArmorRestrictsUserNS {
+			issues = append(issues,
+				"The host sets kernel.apparmor_restrict_unprivileged_userns=1")
+		}
+		if platform.IsKubernetes() {
+			issues = append(issues, "Fix: set appArmorProfile.type: Unconfined in the container securityContext")
+		} else {
+			issues = append(issues, "Fix: run with --security-opt apparmor=unconfined")
+		}
+	case BlockedByLimit:
+		issues = append(issues,
+			"The user namespace limit has been reached",
+			"Fix: raise user.max_user_namespaces on the node (e.g. sysctl -w user.max_user_namespaces=15000)")
+	case BlockedByKernel:
+		issues = append(issues, "The kernel does not support unprivileged user namespaces")
+	default:
+		issues = append(issues,
+			"Check seccomp, AppArmor/SELinux policy and user.max_user_namespaces on the node")
+	}
+
+	return issues
+}
+
+// readTrimmedFile returns the trimmed contents of a small file, or "" on error
+func readTrimmedFile(path string) string {
+	// #nosec G304 -- only called with fixed /proc and /sys paths
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(data), "\x00"))
+}
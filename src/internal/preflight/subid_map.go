@@ -0,0 +1,152 @@
+package preflight
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+// IDMapping maps Size IDs starting at ContainerID inside the builder's user
+// namespace to IDs starting at HostID outside of it
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// String returns the mapping in the container:host:size form of Buildah's
+// --userns-uid-map
+func (m IDMapping) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
+// ParseIDMappings parses --userns-uid-map and --userns-gid-map values: one or
+// more comma-separated container:host:size triples
+func ParseIDMappings(values []string) ([]IDMapping, error) {
+	var mappings []IDMapping
+	for _, value := range values {
+		for _, triple := range strings.Split(value, ",") {
+			fields := strings.Split(strings.TrimSpace(triple), ":")
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("invalid ID mapping %q (expected container:host:size)", triple)
+			}
+			var numbers [3]int
+			for i, field := range fields {
+				n, err := strconv.Atoi(field)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid ID mapping %q: %q is not a non-negative number", triple, field)
+				}
+				numbers[i] = n
+			}
+			if numbers[2] == 0 {
+				return nil, fmt.Errorf("invalid ID mapping %q: size must be positive", triple)
+			}
+			mappings = append(mappings, IDMapping{ContainerID: numbers[0], HostID: numbers[1], Size: numbers[2]})
+		}
+	}
+
+	sorted := append([]IDMapping(nil), mappings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ContainerID < sorted[j].ContainerID })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].ContainerID+sorted[i-1].Size > sorted[i].ContainerID {
+			return nil, fmt.Errorf("ID mappings %s and %s overlap", sorted[i-1], sorted[i])
+		}
+	}
+	return mappings, nil
+}
+
+// SetupIDMappings makes a rootless builder use exactly the given mappings.
+// Rootless Buildah and rootlesskit always map ID 0 to the calling user and
+// IDs from 1 upwards to the user's /etc/subuid and /etc/subgid ranges in file
+// order, so the mappings must have that shape: an optional 0:<own ID>:1 and
+// contiguous container IDs from 1. The host ranges are written to
+// /etc/subuid and /etc/subgid, replacing what preflight detected there.
+func SetupIDMappings(uidMappings, gidMappings []IDMapping) error {
+	subUIDs, subGIDs, err := rootlessRanges(uidMappings, gidMappings)
+	if err != nil {
+		return err
+	}
+
+	uid := os.Getuid()
+	username := lookupUsername(uid)
+	files := []struct {
+		name   string
+		ranges []IDMapping
+	}{{"/etc/subuid", subUIDs}, {"/etc/subgid", subGIDs}}
+	for _, file := range files {
+		if err := writeSubIDEntries(file.name, username, uid, file.ranges); err != nil {
+			if os.IsPermission(err) {
+				// The image makes these files writable by GID 0 only
+				return fmt.Errorf("cannot update %s: %v (run with supplementalGroups: [0] or runAsGroup: 0)", file.name, err)
+			}
+			return fmt.Errorf("failed to update %s: %v", file.name, err)
+		}
+	}
+	logger.Info("Audit: user namespace UID map %s, GID map %s (user %s)",
+		formatIDMappings(uidMappings), formatIDMappings(gidMappings), username)
+	return nil
+}
+
+// ValidateIDMappings checks that mappings can be applied by SetupIDMappings
+func ValidateIDMappings(uidMappings, gidMappings []IDMapping) error {
+	_, _, err := rootlessRanges(uidMappings, gidMappings)
+	return err
+}
+
+// rootlessRanges returns the subordinate UID and GID ranges of the mappings
+func rootlessRanges(uidMappings, gidMappings []IDMapping) ([]IDMapping, []IDMapping, error) {
+	subUIDs, err := subordinateRanges(uidMappings, os.Getuid(), "UID")
+	if err != nil {
+		return nil, nil, err
+	}
+	subGIDs, err := subordinateRanges(gidMappings, os.Getgid(), "GID")
+	if err != nil {
+		return nil, nil, err
+	}
+	return subUIDs, subGIDs, nil
+}
+
+// subordinateRanges checks that mappings have the shape a rootless user
+// namespace can take and returns the ranges mapped from container ID 1 on
+func subordinateRanges(mappings []IDMapping, ownID int, kind string) ([]IDMapping, error) {
+	sorted := append([]IDMapping(nil), mappings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ContainerID < sorted[j].ContainerID })
+
+	if len(sorted) > 0 && sorted[0].ContainerID == 0 {
+		if sorted[0].HostID != ownID || sorted[0].Size != 1 {
+			return nil, fmt.Errorf("rootless %s mapping must map container ID 0 to the calling user as 0:%d:1, not %s", kind, ownID, sorted[0])
+		}
+		sorted = sorted[1:]
+	}
+	if len(sorted) == 0 {
+		return nil, fmt.Errorf("%s mappings need a range from container ID 1 (e.g. 1:200000:65536)", kind)
+	}
+	next := 1
+	for _, mapping := range sorted {
+		if mapping.ContainerID != next {
+			return nil, fmt.Errorf("rootless %s mappings must be contiguous from container ID 1; %s starts at %d instead of %d", kind, mapping, mapping.ContainerID, next)
+		}
+		if mapping.HostID <= ownID && ownID < mapping.HostID+mapping.Size {
+			return nil, fmt.Errorf("%s mapping %s includes the calling user's own ID %d", kind, mapping, ownID)
+		}
+		next += mapping.Size
+	}
+	if next-1 < DefaultSubIDRangeSize {
+		logger.Warning("%s mappings cover %d subordinate IDs, fewer than %d; images using high IDs (e.g. nobody) will fail",
+			kind, next-1, DefaultSubIDRangeSize)
+	}
+	return sorted, nil
+}
+
+// formatIDMappings joins mappings the way they are given on the command line
+func formatIDMappings(mappings []IDMapping) string {
+	values := make([]string, len(mappings))
+	for i, mapping := range mappings {
+		values[i] = mapping.String()
+	}
+	return strings.Join(values, ",")
+}
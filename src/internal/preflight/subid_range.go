@@ -0,0 +1,287 @@
+package preflight
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rapidfort/kimia/pkg/logger"
+)
+
+const (
+	// DefaultSubIDRangeSize is the number of subordinate IDs allocated per build.
+	// 65536 covers every UID/GID an image can reasonably use (nobody = 65534).
+	DefaultSubIDRangeSize = 65536
+
+	// Allocations start after the image default range (100000:65536) so isolated
+	// builds never overlap builds that still use the shared default
+	subIDPoolStart = arbitrarySubIDStart + arbitrarySubIDCount
+	subIDPoolEnd   = 1 << 31
+
+	// subIDLeaseTTL is how long an allocation is honoured without being released.
+	// Builds killed before cleanup leave their entry behind; it is reclaimed after this.
+	subIDLeaseTTL = 24 * time.Hour
+)
+
+// SubIDRangeConfig selects how a per-build subordinate ID range is obtained
+type SubIDRangeConfig struct {
+	Range          string // Explicit start:count assigned by a controller
+	AllocationFile string // Shared allocation file on a node-local volume
+	Size           int    // Range size when allocating from the file
+}
+
+// SubIDAllocation is the subordinate UID/GID range assigned to this build
+type SubIDAllocation struct {
+	Start     int       `json:"start"`
+	Count     int       `json:"count"`
+	Owner     string    `json:"owner"` // Pod or host name
+	PID       int       `json:"pid"`
+	Allocated time.Time `json:"allocated"`
+
+	file string // Allocation file the range was taken from (empty for explicit ranges)
+}
+
+// subIDAllocationState is the on-disk format of the allocation file
+type subIDAllocationState struct {
+	Allocations []SubIDAllocation `json:"allocations"`
+}
+
+// End returns the last ID in the range
+func (a *SubIDAllocation) End() int {
+	return a.Start + a.Count - 1
+}
+
+// SetupSubIDRange assigns this build a subordinate UID/GID range that is
+// disjoint from other builds on the node and rewrites /etc/subuid and
+// /etc/subgid so the builder's user namespace maps only that range.
+// It returns nil when no isolation was requested.
+func SetupSubIDRange(config SubIDRangeConfig) (*SubIDAllocation, error) {
+	if config.Range == "" && config.AllocationFile == "" {
+		return nil, nil
+	}
+
+	owner, _ := os.Hostname()
+	alloc := &SubIDAllocation{Owner: owner, PID: os.Getpid(), Allocated: time.Now().UTC()}
+
+	if config.Range != "" {
+		start, count, err := ParseSubIDRange(config.Range)
+		if err != nil {
+			return nil, err
+		}
+		alloc.Start, alloc.Count = start, count
+	} else {
+		size := config.Size
+		if size <= 0 {
+			size = DefaultSubIDRangeSize
+		}
+		alloc.Count = size
+		alloc.file = config.AllocationFile
+		if err := allocateSubIDRange(alloc); err != nil {
+			return nil, err
+		}
+	}
+
+	if alloc.Count < DefaultSubIDRangeSize {
+		logger.Warning("Subordinate ID range of %d IDs is smaller than %d; images using high UIDs (e.g. nobody) will fail",
+			alloc.Count, DefaultSubIDRangeSize)
+	}
+
+	uid := os.Getuid()
+	username := lookupUsername(uid)
+	for _, filename := range []string{"/etc/subuid", "/etc/subgid"} {
+		if err := writeSubIDEntry(filename, username, uid, alloc.Start, alloc.Count); err != nil {
+			alloc.Release()
+			if os.IsPermission(err) {
+				// The image makes these files writable by GID 0 only
+				return nil, fmt.Errorf("cannot update %s: %v (run with supplementalGroups: [0] or runAsGroup: 0)", filename, err)
+			}
+			return nil, fmt.Errorf("failed to update %s: %v", filename, err)
+		}
+	}
+
+	source := "explicit --userns-range"
+	if alloc.file != "" {
+		source = alloc.file
+	}
+	logger.Info("Audit: user namespace range %d-%d (%d IDs) assigned to %s (pid %d, user %s, source %s)",
+		alloc.Start, alloc.End(), alloc.Count, alloc.Owner, alloc.PID, username, source)
+	return alloc, nil
+}
+
+// Release returns the range to the allocation file. Explicit ranges are left untouched.
+func (a *SubIDAllocation) Release() {
+	if a == nil || a.file == "" {
+		return
+	}
+
+	err := withAllocationFile(a.file, func(state *subIDAllocationState) {
+		kept := state.Allocations[:0]
+		for _, existing := range state.Allocations {
+			if existing.Start == a.Start && existing.Owner == a.Owner && existing.PID == a.PID {
+				continue
+			}
+			kept = append(kept, existing)
+		}
+		state.Allocations = kept
+	})
+	if err != nil {
+		logger.Warning("Failed to release user namespace range %d-%d: %v", a.Start, a.End(), err)
+		return
+	}
+	logger.Info("Audit: user namespace range %d-%d released by %s (pid %d)", a.Start, a.End(), a.Owner, a.PID)
+}
+
+// ParseSubIDRange parses a start:count range and checks it stays inside the allocation pool
+func ParseSubIDRange(value string) (int, int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid user namespace range %q (expected start:count)", value)
+	}
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range start %q: %v", parts[0], err)
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range count %q: %v", parts[1], err)
+	}
+	if count < 1 {
+		return 0, 0, fmt.Errorf("range count must be positive: %d", count)
+	}
+	// Ranges below the pool could include real system or user IDs on the host
+	if start < arbitrarySubIDStart || start+count > subIDPoolEnd {
+		return 0, 0, fmt.Errorf("range %d:%d must lie between %d and %d", start, count, arbitrarySubIDStart, subIDPoolEnd)
+	}
+	return start, count, nil
+}
+
+// allocateSubIDRange takes the lowest free slot from the allocation file
+func allocateSubIDRange(alloc *SubIDAllocation) error {
+	var allocErr error
+	err := withAllocationFile(alloc.file, func(state *subIDAllocationState) {
+		now := time.Now()
+		live := state.Allocations[:0]
+		for _, existing := range state.Allocations {
+			if now.Sub(existing.Allocated) > subIDLeaseTTL {
+				logger.Info("Audit: reclaiming expired user namespace range %d-%d from %s",
+					existing.Start, existing.End(), existing.Owner)
+				continue
+			}
+			live = append(live, existing)
+		}
+		state.Allocations = live
+
+		for start := subIDPoolStart; start+alloc.Count <= subIDPoolEnd; start += alloc.Count {
+			if !overlapsAllocation(start, alloc.Count, state.Allocations) {
+				alloc.Start = start
+				state.Allocations = append(state.Allocations, *alloc)
+				return
+			}
+		}
+		allocErr = fmt.Errorf("no free user namespace range of %d IDs (%d in use)", alloc.Count, len(state.Allocations))
+	})
+	if err != nil {
+		return err
+	}
+	return allocErr
+}
+
+// overlapsAllocation reports whether [start, start+count) intersects any allocation
+func overlapsAllocation(start, count int, allocations []SubIDAllocation) bool {
+	for _, existing := range allocations {
+		if start < existing.Start+existing.Count && existing.Start < start+count {
+			return true
+		}
+	}
+	return false
+}
+
+// withAllocationFile loads the allocation file under an exclusive lock,
+// applies update and writes the result back before unlocking
+func withAllocationFile(path string, update func(*subIDAllocationState)) error {
+	// #nosec G301 -- directory is shared between build pods on the node
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return fmt.Errorf("failed to create allocation directory: %v", err)
+	}
+
+	// #nosec G302,G304 -- user-specified allocation file, group-writable so builds with different UIDs can share it
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return fmt.Errorf("failed to open allocation file: %v", err)
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock allocation file: %v", err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("failed to read allocation file: %v", err)
+	}
+
+	var state subIDAllocationState
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse allocation file %s: %v", path, err)
+		}
+	}
+
+	update(&state)
+
+	out, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Rewrite in place: other builds hold locks on this inode, so no rename
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write allocation file: %v", err)
+	}
+	if _, err := file.WriteAt(append(out, '\n'), 0); err != nil {
+		return fmt.Errorf("failed to write allocation file: %v", err)
+	}
+	return file.Sync()
+}
+
+// writeSubIDEntry replaces the user's entries in /etc/subuid or /etc/subgid
+// with a single start:count range
+func writeSubIDEntry(filename, username string, uid, start, count int) error {
+	return writeSubIDEntries(filename, username, uid, []IDMapping{{HostID: start, Size: count}})
+}
+
+// writeSubIDEntries replaces the user's entries in /etc/subuid or /etc/subgid
+// with the host ranges of mappings, in order
+func writeSubIDEntries(filename, username string, uid int, mappings []IDMapping) error {
+	if filename != "/etc/subuid" && filename != "/etc/subgid" {
+		return fmt.Errorf("unexpected subid file: %s (expected /etc/subuid or /etc/subgid)", filename)
+	}
+
+	// #nosec G304 -- filename validated to be /etc/subuid or /etc/subgid only
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		owner := strings.SplitN(strings.TrimSpace(line), ":", 2)[0]
+		if line == "" || owner == username || owner == strconv.Itoa(uid) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	for _, mapping := range mappings {
+		lines = append(lines, fmt.Sprintf("%s:%d:%d", username, mapping.HostID, mapping.Size))
+	}
+
+	// /etc is not writable, so the file is rewritten in place rather than renamed
+	// #nosec G306 -- subuid/subgid are world-readable system files
+	return os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -48,10 +48,7 @@ func CheckUserNamespaces() (*UserNamespaceCheck, error) {
 	
 	// Check subuid/subgid configuration
 	uid := os.Getuid()
-	username := os.Getenv("USER")
-	if username == "" {
-		username = fmt.Sprintf("%d", uid)
-	}
+	username := lookupUsername(uid)
 	
 	// Check /etc/subuid
 	subuidRange, err := checkSubIDFile("/etc/subuid", username, uid)
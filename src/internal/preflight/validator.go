@@ -34,16 +34,19 @@ func (m BuildMode) String() string {
 
 // ValidationResult holds the result of pre-flight validation
 type ValidationResult struct {
-	Status         ValidationStatus
-	BuildMode      BuildMode
-	StorageDriver  string
-	Errors         []string
-	Warnings       []string
-	UID            int
-	Capabilities   *CapabilityCheck
-	UserNamespace  *UserNamespaceCheck
-	Storage        *StorageCheck
-	SetuidBinaries *SetuidBinaryCheck
+	Status           ValidationStatus
+	BuildMode        BuildMode
+	StorageDriver    string
+	Errors           []string
+	Warnings         []string
+	UID              int
+	Platform         Platform
+	ArbitraryUID     *ArbitraryUIDCheck
+	Capabilities     *CapabilityCheck
+	UserNamespace    *UserNamespaceCheck
+	SecurityProfiles *SecurityProfileCheck
+	Storage          *StorageCheck
+	SetuidBinaries   *SetuidBinaryCheck
 }
 
 func Validate(storageDriver string) (*ValidationResult, error) {
@@ -57,8 +60,10 @@ func Validate(storageDriver string) (*ValidationResult, error) {
 
 	// 1. Detect current user context
 	result.UID = os.Getuid()
+	result.Platform = DetectPlatform()
 
 	logger.Info("Current UID: %d", result.UID)
+	logger.Debug("Detected platform: %s", result.Platform)
 
 	// CRITICAL: Kimia is rootless-only and does NOT support root mode
 	if result.UID == 0 {
@@ -119,10 +124,31 @@ func Validate(storageDriver string) (*ValidationResult, error) {
 	}
 	result.UserNamespace = userns
 
-	// 4. Validate rootless mode configuration
-	result.Status = validateRootlessMode(result)
+	// 3b. Check seccomp/AppArmor confinement and whether clone(CLONE_NEWUSER) is allowed
+	result.SecurityProfiles = CheckSecurityProfiles()
+	if issues := result.SecurityProfiles.GetIssues(result.Platform); len(issues) > 0 {
+		result.Errors = append(result.Errors, "Cannot create user namespaces:")
+		result.Errors = append(result.Errors, issues...)
+		result.Status = StatusError
+		return result, nil
+	}
+
+	// 4. Validate against the OpenShift SCC (restricted-v2 cannot build)
+	if result.Platform == PlatformOpenShift || CheckArbitraryUID().IsArbitrary {
+		if sccStatus := validateOpenShiftSCC(result); sccStatus == StatusError {
+			result.Status = StatusError
+			return result, nil
+		} else if sccStatus == StatusWarning {
+			result.Status = StatusWarning
+		}
+	}
+
+	// 5. Validate rootless mode configuration
+	if rootlessStatus := validateRootlessMode(result); rootlessStatus != StatusSuccess || result.Status != StatusWarning {
+		result.Status = rootlessStatus
+	}
 
-	// 5. Validate storage driver
+	// 6. Validate storage driver
 	if result.Status != StatusError {
 		storageStatus := validateStorageDriver(result)
 		if storageStatus == StatusError {
@@ -177,16 +203,21 @@ func validateRootlessMode(result *ValidationResult) ValidationStatus {
 				issues = append(issues, "SETUID binaries cannot escalate privileges")
 			}
 			issues = append(issues, "")
-			issues = append(issues, "Kubernetes requires:")
-			issues = append(issues, "  securityContext:")
-			issues = append(issues, "    allowPrivilegeEscalation: true")
-			issues = append(issues, "    capabilities:")
-			issues = append(issues, "      drop: [ALL]")
-
-			if needsMknod {
-				issues = append(issues, "      add: [SETUID, SETGID, MKNOD]  # MKNOD for overlay")
+			if result.Platform.IsKubernetes() && result.Platform != PlatformKubernetes {
+				// Distribution-specific advice (SCC, Autopilot restrictions, ...)
+				issues = append(issues, PlatformRemediation(result.Platform, result.StorageDriver)...)
 			} else {
-				issues = append(issues, "      add: [SETUID, SETGID]  # No MKNOD needed for vfs")
+				issues = append(issues, "Kubernetes requires:")
+				issues = append(issues, "  securityContext:")
+				issues = append(issues, "    allowPrivilegeEscalation: true")
+				issues = append(issues, "    capabilities:")
+				issues = append(issues, "      drop: [ALL]")
+
+				if needsMknod {
+					issues = append(issues, "      add: [SETUID, SETGID, MKNOD]  # MKNOD for overlay")
+				} else {
+					issues = append(issues, "      add: [SETUID, SETGID]  # No MKNOD needed for vfs")
+				}
 			}
 		}
 	} else {
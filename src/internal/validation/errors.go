@@ -0,0 +1,57 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Errors collects the problems found in a configuration so that they can be
+// reported together instead of one per run
+type Errors struct {
+	problems []string
+}
+
+// Add records a problem
+func (e *Errors) Add(format string, args ...interface{}) {
+	e.problems = append(e.problems, fmt.Sprintf(format, args...))
+}
+
+// Check records err, if any
+func (e *Errors) Check(err error) {
+	if err == nil {
+		return
+	}
+	// Nested collections are flattened
+	if errs, ok := err.(*Errors); ok {
+		e.problems = append(e.problems, errs.problems...)
+		return
+	}
+	e.problems = append(e.problems, err.Error())
+}
+
+// Problems returns the recorded problems in the order they were found
+func (e *Errors) Problems() []string {
+	return e.problems
+}
+
+// Err returns the collection as an error, or nil when nothing was recorded
+func (e *Errors) Err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error lists the problems, one per line when there are several
+func (e *Errors) Error() string {
+	if len(e.problems) == 1 {
+		return e.problems[0]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d configuration problems:", len(e.problems))
+	for _, problem := range e.problems {
+		b.WriteString("\n  - ")
+		b.WriteString(problem)
+	}
+	return b.String()
+}
@@ -0,0 +1,57 @@
+// Package exitcode defines the exit codes of kimia, one per class of failure,
+// so that CI systems can decide which failures to retry or alert on.
+package exitcode
+
+import "errors"
+
+// Exit codes of kimia
+const (
+	Success   = 0  // The build (and push) succeeded
+	General   = 1  // Any failure without a class of its own
+	Config    = 2  // Invalid flags or configuration
+	Build     = 3  // The builder failed to build the image
+	Push      = 4  // The image could not be pushed
+	Auth      = 5  // Registry authentication or certificate pinning failed
+	Preflight = 6  // No usable builder, or the node or registry is not ready for the build
+	Context   = 7  // The build context could not be prepared (Git clone, sub-path, size limits)
+	Sign      = 8  // Signing the pushed image failed
+	Timeout   = 9  // --build-timeout or --push-timeout expired
+	Scan      = 10 // The --scan-webhook blocked the image or gave no verdict
+	Canceled  = 11 // The build was canceled (kimia cancel, SIGTERM or SIGINT)
+)
+
+// Error is a failure of a known class
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Wrap gives err the exit code. An error that already has a class keeps it,
+// so the most specific class found where the failure happened wins.
+func Wrap(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Of returns the exit code of err: Success for nil and General for an error
+// without a class
+func Of(err error) int {
+	if err == nil {
+		return Success
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Code
+	}
+	return General
+}
@@ -38,45 +38,50 @@ func Debug(format string, args ...interface{}) {
 		return
 	}
 	if logLevel == "debug" {
-		logDebug.Printf(format, args...)
+		logDebug.Print(Redact(fmt.Sprintf(format, args...)))
 	}
 }
 
 func Info(format string, args ...interface{}) {
 	if logInfo == nil {
-		fmt.Printf("[INFO] "+format+"\n", args...)
+		fmt.Print("[INFO] "+Redact(fmt.Sprintf(format, args...))+"\n")
 		return
 	}
 	if logLevel == "debug" || logLevel == "info" {
-		logInfo.Printf(format, args...)
+		logInfo.Print(Redact(fmt.Sprintf(format, args...)))
 	}
 }
 
 func Warning(format string, args ...interface{}) {
 	if logWarn == nil {
-		fmt.Fprintf(os.Stderr, "[WARN] "+format+"\n", args...)
+		fmt.Fprint(os.Stderr, "[WARN] "+Redact(fmt.Sprintf(format, args...))+"\n")
 		return
 	}
 	if logLevel != "error" && logLevel != "fatal" {
-		logWarn.Printf(format, args...)
+		logWarn.Print(Redact(fmt.Sprintf(format, args...)))
 	}
 }
 
 func Error(format string, args ...interface{}) {
 	if logError == nil {
-		fmt.Fprintf(os.Stderr, "[ERROR] "+format+"\n", args...)
+		fmt.Fprint(os.Stderr, "[ERROR] "+Redact(fmt.Sprintf(format, args...))+"\n")
 		return
 	}
-	logError.Printf(format, args...)
+	logError.Print(Redact(fmt.Sprintf(format, args...)))
 }
 
 func Fatal(format string, args ...interface{}) {
+	FatalCode(1, format, args...)
+}
+
+// FatalCode logs like Fatal and exits with the given code
+func FatalCode(code int, format string, args ...interface{}) {
 	if logFatal == nil {
-		fmt.Fprintf(os.Stderr, "[FATAL] "+format+"\n", args...)
-		os.Exit(1)
+		fmt.Fprint(os.Stderr, "[FATAL] "+Redact(fmt.Sprintf(format, args...))+"\n")
+		os.Exit(code)
 	}
-	logFatal.Printf(format, args...)
-	os.Exit(1)
+	logFatal.Print(Redact(fmt.Sprintf(format, args...)))
+	os.Exit(code)
 }
 
 // SanitizeGitURL removes credentials from Git URLs for safe logging
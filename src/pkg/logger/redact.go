@@ -0,0 +1,108 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secret values in log messages and build output
+const Redacted = "****"
+
+// maxRedactLine is how much output a RedactWriter holds back while waiting
+// for the end of a line
+const maxRedactLine = 64 * 1024
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+	redactor  *strings.Replacer
+)
+
+// AddSecret registers a secret value that log messages and RedactWriter
+// output must not show. Values shorter than 4 characters are ignored, since
+// replacing them would garble unrelated output.
+func AddSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < 4 {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		if secret == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+	// The replacer tries secrets in order at each position; longest first
+	// keeps a secret from being half-replaced by one of its prefixes
+	sort.SliceStable(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, Redacted)
+	}
+	redactor = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces the registered secret values in s
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	if redactor == nil {
+		return s
+	}
+	return redactor.Replace(s)
+}
+
+func hasSecrets() bool {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	return redactor != nil
+}
+
+// RedactWriter passes output on to another writer with the registered
+// secret values replaced. Output is passed on a line at a time, so that a
+// secret split across writes is still found; Flush writes the rest.
+type RedactWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewRedactWriter returns a RedactWriter writing to w
+func NewRedactWriter(w io.Writer) *RedactWriter {
+	return &RedactWriter{w: w}
+}
+
+func (r *RedactWriter) Write(p []byte) (int, error) {
+	if len(r.buf) == 0 && !hasSecrets() {
+		return r.w.Write(p)
+	}
+	r.buf = append(r.buf, p...)
+	end := bytes.LastIndexAny(r.buf, "\r\n") + 1
+	if end == 0 && len(r.buf) < maxRedactLine {
+		return len(p), nil
+	}
+	if end == 0 {
+		end = len(r.buf)
+	}
+	out := Redact(string(r.buf[:end]))
+	r.buf = append(r.buf[:0], r.buf[end:]...)
+	if _, err := io.WriteString(r.w, out); err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+// Flush writes output held back for an unfinished line
+func (r *RedactWriter) Flush() error {
+	if len(r.buf) == 0 {
+		return nil
+	}
+	out := Redact(string(r.buf))
+	r.buf = r.buf[:0]
+	_, err := io.WriteString(r.w, out)
+	return err
+}